@@ -0,0 +1,301 @@
+// Command kvctl is a command-line client for the key/value server.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/client"
+)
+
+const usage = `Usage: kvctl [flags] <command> [args]
+
+Commands:
+  get <key>...          print the values of keys
+  set <key> <value>     store a value
+  del <key>...          delete keys
+  list [prefix]         print all pairs, optionally filtered by key prefix
+  stats                 print server statistics
+  export [file]         write all pairs as NDJSON (default stdout)
+  import [file]         load pairs from NDJSON (default stdin)
+
+Flags:
+`
+
+// importBatch is the number of pairs sent per request by import.
+const importBatch = 500
+
+type cli struct {
+	c      *client.Client
+	output string
+	stdout io.Writer
+}
+
+func main() {
+	fs := flag.NewFlagSet("kvctl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	server := fs.String("server", envOr("KVCTL_SERVER", "http://localhost:8080"), "server base URL (env KVCTL_SERVER)")
+	apiKey := fs.String("api-key", os.Getenv("KVCTL_API_KEY"), "API key sent as a Bearer token (env KVCTL_API_KEY)")
+	output := fs.String("o", "table", "output format: table or json")
+	timeout := fs.Duration("timeout", 10*time.Second, "per-request timeout")
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "kvctl: unknown output format %q\n", *output)
+		os.Exit(2)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	opts := []client.Option{client.WithTimeout(*timeout)}
+	if *apiKey != "" {
+		opts = append(opts, client.WithAPIKey(*apiKey))
+	}
+	app := &cli{c: client.New(*server, opts...), output: *output, stdout: os.Stdout}
+
+	if err := app.run(context.Background(), fs.Arg(0), fs.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "kvctl:", err)
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid arguments")
+
+func (a *cli) run(ctx context.Context, cmd string, args []string) error {
+	switch cmd {
+	case "get":
+		if len(args) == 0 {
+			return fmt.Errorf("%w: get <key>...", errUsage)
+		}
+		return a.get(ctx, args)
+	case "set":
+		if len(args) != 2 {
+			return fmt.Errorf("%w: set <key> <value>", errUsage)
+		}
+		return a.c.Set(ctx, args[0], args[1])
+	case "del":
+		if len(args) == 0 {
+			return fmt.Errorf("%w: del <key>...", errUsage)
+		}
+		for _, k := range args {
+			if err := a.c.Delete(ctx, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "list":
+		if len(args) > 1 {
+			return fmt.Errorf("%w: list [prefix]", errUsage)
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		return a.list(ctx, prefix)
+	case "stats":
+		return a.stats(ctx)
+	case "export":
+		if len(args) > 1 {
+			return fmt.Errorf("%w: export [file]", errUsage)
+		}
+		return a.export(ctx, args)
+	case "import":
+		if len(args) > 1 {
+			return fmt.Errorf("%w: import [file]", errUsage)
+		}
+		return a.importPairs(ctx, args)
+	}
+	return fmt.Errorf("%w: unknown command %q", errUsage, cmd)
+}
+
+func (a *cli) get(ctx context.Context, keys []string) error {
+	if len(keys) == 1 {
+		v, err := a.c.Get(ctx, keys[0])
+		if err != nil {
+			return err
+		}
+		return a.printPairs(map[string]string{keys[0]: v})
+	}
+	pairs, err := a.c.BatchGet(ctx, keys)
+	if err != nil {
+		return err
+	}
+	return a.printPairs(pairs)
+}
+
+func (a *cli) list(ctx context.Context, prefix string) error {
+	pairs, err := a.c.List(ctx)
+	if err != nil {
+		return err
+	}
+	for k := range pairs {
+		if !strings.HasPrefix(k, prefix) {
+			delete(pairs, k)
+		}
+	}
+	return a.printPairs(pairs)
+}
+
+func (a *cli) stats(ctx context.Context) error {
+	stats, err := a.c.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if a.output == "json" {
+		return a.printJSON(stats)
+	}
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tVALUE")
+	for _, k := range sortedKeys(stats) {
+		v := stats[k]
+		if m, ok := v.(map[string]interface{}); ok {
+			for _, sub := range sortedKeys(m) {
+				fmt.Fprintf(tw, "%s.%s\t%v\n", k, sub, m[sub])
+			}
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%v\n", k, v)
+	}
+	return tw.Flush()
+}
+
+// exportRecord matches the NDJSON format of the server's /backup endpoint.
+type exportRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (a *cli) export(ctx context.Context, args []string) error {
+	pairs, err := a.c.List(ctx)
+	if err != nil {
+		return err
+	}
+	w := a.stdout
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, k := range sortedKeys(pairs) {
+		if err := enc.Encode(exportRecord{Key: k, Value: pairs[k]}); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+func (a *cli) importPairs(ctx context.Context, args []string) error {
+	var r io.Reader = os.Stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	batch := make(map[string]string, importBatch)
+	total := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := a.c.SetMany(ctx, batch); err != nil {
+			return err
+		}
+		total += len(batch)
+		batch = make(map[string]string, importBatch)
+		return nil
+	}
+	for line := 1; ; line++ {
+		var rec exportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("record %d: %w", line, err)
+		}
+		if rec.Key == "" {
+			return fmt.Errorf("record %d: empty key", line)
+		}
+		batch[rec.Key] = rec.Value
+		if len(batch) >= importBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d keys\n", total)
+	return nil
+}
+
+func (a *cli) printPairs(pairs map[string]string) error {
+	if a.output == "json" {
+		return a.printJSON(pairs)
+	}
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE")
+	for _, k := range sortedKeys(pairs) {
+		fmt.Fprintf(tw, "%s\t%s\n", k, pairs[k])
+	}
+	return tw.Flush()
+}
+
+func (a *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(a.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
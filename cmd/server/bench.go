@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchConfig is the workload of the bench subcommand.
+type benchConfig struct {
+	Target       string        `json:"target"`
+	APIKey       string        `json:"-"`
+	Duration     time.Duration `json:"-"`
+	Requests     int           `json:"requests,omitempty"`
+	Concurrency  int           `json:"concurrency"`
+	ReadRatio    float64       `json:"read_ratio"`
+	Keys         int           `json:"keys"`
+	ValueSize    int           `json:"value_size"`
+	Prefix       string        `json:"prefix"`
+	Distribution string        `json:"distribution"`
+	Preload      bool          `json:"preload"`
+	Cleanup      bool          `json:"-"`
+	JSON         bool          `json:"-"`
+}
+
+// opStats summarizes the requests of one kind.
+type opStats struct {
+	Count     int     `json:"count"`
+	Errors    int     `json:"errors"`
+	PerSecond float64 `json:"per_second"`
+	P50       float64 `json:"p50_ms"`
+	P90       float64 `json:"p90_ms"`
+	P99       float64 `json:"p99_ms"`
+	P999      float64 `json:"p999_ms"`
+	Max       float64 `json:"max_ms"`
+}
+
+// benchReport is the result of a run, printed as a table or, with -json,
+// as JSON for comparing runs across releases.
+type benchReport struct {
+	Config  benchConfig        `json:"config"`
+	Seconds float64            `json:"seconds"`
+	Ops     map[string]opStats `json:"ops"`
+	// Statuses counts the failed requests by HTTP status, 0 for
+	// transport errors.
+	Statuses map[int]int `json:"statuses,omitempty"`
+}
+
+// benchWorker holds one worker's samples, merged once the run is over.
+type benchWorker struct {
+	reads, writes []time.Duration
+	readErrs      int
+	writeErrs     int
+	statuses      map[int]int
+}
+
+// runBench implements "server bench": it drives a read/write workload at a
+// running server and reports throughput and latency percentiles. It
+// returns the process exit code.
+func runBench(args []string) int {
+	var cfg benchConfig
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.StringVar(&cfg.Target, "target", "http://localhost:8080", "base URL of the server to load")
+	fs.StringVar(&cfg.APIKey, "api-key", "", "API key sent as a Bearer token")
+	fs.DurationVar(&cfg.Duration, "duration", 10*time.Second, "how long to run, unless -requests is set")
+	fs.IntVar(&cfg.Requests, "requests", 0, "stop after this many requests instead of after -duration")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 16, "number of concurrent workers")
+	fs.Float64Var(&cfg.ReadRatio, "read-ratio", 0.8, "fraction of requests that are reads, from 0 to 1")
+	fs.IntVar(&cfg.Keys, "keys", 1000, "number of distinct keys")
+	fs.IntVar(&cfg.ValueSize, "value-size", 128, "size of written values in bytes")
+	fs.StringVar(&cfg.Prefix, "prefix", "bench:", "prefix of the keys used")
+	fs.StringVar(&cfg.Distribution, "distribution", "uniform", "how keys are picked: uniform or zipf, which favours a few hot keys")
+	fs.BoolVar(&cfg.Preload, "preload", true, "write every key before the run so reads find them")
+	fs.BoolVar(&cfg.Cleanup, "cleanup", false, "delete the keys under -prefix afterwards")
+	fs.BoolVar(&cfg.JSON, "json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	switch {
+	case cfg.Concurrency <= 0, cfg.Keys <= 0, cfg.ValueSize < 0:
+		fmt.Fprintln(os.Stderr, "bench: -concurrency and -keys must be positive, -value-size not negative")
+		return 2
+	case cfg.ReadRatio < 0 || cfg.ReadRatio > 1:
+		fmt.Fprintln(os.Stderr, "bench: -read-ratio must be between 0 and 1")
+		return 2
+	case cfg.Distribution != "uniform" && cfg.Distribution != "zipf":
+		fmt.Fprintln(os.Stderr, "bench: -distribution must be uniform or zipf")
+		return 2
+	case cfg.Prefix == "":
+		fmt.Fprintln(os.Stderr, "bench: -prefix must not be empty")
+		return 2
+	}
+	cfg.Target = strings.TrimSuffix(cfg.Target, "/")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	b := &bencher{cfg: cfg, http: &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: cfg.Concurrency}}}
+	b.value = bytes.Repeat([]byte("x"), cfg.ValueSize)
+
+	if cfg.Preload {
+		if err := b.preload(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "bench: preload: %v\n", err)
+			return 1
+		}
+	}
+	rep := b.run(ctx)
+	if cfg.Cleanup {
+		if err := b.cleanup(); err != nil {
+			fmt.Fprintf(os.Stderr, "bench: cleanup: %v\n", err)
+		}
+	}
+	if cfg.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rep)
+	} else {
+		rep.print(os.Stdout)
+	}
+	return 0
+}
+
+type bencher struct {
+	cfg   benchConfig
+	http  *http.Client
+	value []byte
+}
+
+func (b *bencher) keyURL(i int) string {
+	return fmt.Sprintf("%s/v1/data/%s", b.cfg.Target, url.PathEscape(fmt.Sprintf("%s%d", b.cfg.Prefix, i)))
+}
+
+// do sends one request and returns its status, failing for anything but
+// 2xx.
+func (b *bencher) do(ctx context.Context, method, u string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if b.cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+b.cfg.APIKey)
+	}
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// preload writes every key once, with the configured concurrency.
+func (b *bencher) preload(ctx context.Context) error {
+	keys := make(chan int)
+	errs := make(chan error, b.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for w := 0; w < b.cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range keys {
+				if _, err := b.do(ctx, http.MethodPut, b.keyURL(i), b.value); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	var err error
+feed:
+	for i := 0; i < b.cfg.Keys; i++ {
+		select {
+		case keys <- i:
+		case err = <-errs:
+			break feed
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(keys)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
+
+// run drives the workload until the duration is up, the request budget is
+// spent or ctx is cancelled.
+func (b *bencher) run(ctx context.Context) benchReport {
+	if b.cfg.Requests == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.cfg.Duration)
+		defer cancel()
+	}
+	// budget hands out one token per request when -requests is set.
+	var budget chan struct{}
+	if b.cfg.Requests > 0 {
+		budget = make(chan struct{}, b.cfg.Requests)
+		for i := 0; i < b.cfg.Requests; i++ {
+			budget <- struct{}{}
+		}
+		close(budget)
+	}
+
+	workers := make([]*benchWorker, b.cfg.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for n := range workers {
+		w := &benchWorker{statuses: make(map[int]int)}
+		workers[n] = w
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			b.work(ctx, w, budget, rand.New(rand.NewSource(seed)))
+		}(start.UnixNano() + int64(n))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	rep := benchReport{Config: b.cfg, Seconds: elapsed.Seconds(), Ops: make(map[string]opStats)}
+	var reads, writes []time.Duration
+	var readErrs, writeErrs int
+	for _, w := range workers {
+		reads = append(reads, w.reads...)
+		writes = append(writes, w.writes...)
+		readErrs += w.readErrs
+		writeErrs += w.writeErrs
+		for status, n := range w.statuses {
+			if rep.Statuses == nil {
+				rep.Statuses = make(map[int]int)
+			}
+			rep.Statuses[status] += n
+		}
+	}
+	rep.Ops["read"] = summarize(reads, readErrs, elapsed)
+	rep.Ops["write"] = summarize(writes, writeErrs, elapsed)
+	rep.Ops["total"] = summarize(append(reads, writes...), readErrs+writeErrs, elapsed)
+	return rep
+}
+
+func (b *bencher) work(ctx context.Context, w *benchWorker, budget chan struct{}, rng *rand.Rand) {
+	var zipf *rand.Zipf
+	if b.cfg.Distribution == "zipf" && b.cfg.Keys > 1 {
+		zipf = rand.NewZipf(rng, 1.1, 1, uint64(b.cfg.Keys-1))
+	}
+	for ctx.Err() == nil {
+		if budget != nil {
+			if _, ok := <-budget; !ok {
+				return
+			}
+		}
+		i := rng.Intn(b.cfg.Keys)
+		if zipf != nil {
+			i = int(zipf.Uint64())
+		}
+		read := rng.Float64() < b.cfg.ReadRatio
+		method, body := http.MethodGet, []byte(nil)
+		if !read {
+			method, body = http.MethodPut, b.value
+		}
+		start := time.Now()
+		status, err := b.do(ctx, method, b.keyURL(i), body)
+		d := time.Since(start)
+		if err != nil && ctx.Err() != nil {
+			// Cut short by the end of the run.
+			return
+		}
+		if err != nil {
+			w.statuses[status]++
+		}
+		switch {
+		case read && err != nil:
+			w.readErrs++
+		case read:
+			w.reads = append(w.reads, d)
+		case err != nil:
+			w.writeErrs++
+		default:
+			w.writes = append(w.writes, d)
+		}
+	}
+}
+
+// cleanup deletes the keys under the prefix.
+func (b *bencher) cleanup() error {
+	u := b.cfg.Target + "/v1/data?prefix=" + url.QueryEscape(b.cfg.Prefix)
+	_, err := b.do(context.Background(), http.MethodDelete, u, nil)
+	return err
+}
+
+// summarize computes the throughput and latency percentiles of the
+// successful requests in samples; errors are counted but not timed.
+func summarize(samples []time.Duration, errs int, elapsed time.Duration) opStats {
+	st := opStats{Count: len(samples), Errors: errs}
+	if len(samples) == 0 {
+		return st
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	at := func(q float64) float64 {
+		return ms(samples[min(len(samples)-1, int(q*float64(len(samples))))])
+	}
+	st.PerSecond = float64(len(samples)) / elapsed.Seconds()
+	st.P50, st.P90, st.P99, st.P999 = at(0.50), at(0.90), at(0.99), at(0.999)
+	st.Max = ms(samples[len(samples)-1])
+	return st
+}
+
+func (r benchReport) print(w io.Writer) {
+	c := r.Config
+	fmt.Fprintf(w, "Target:   %s\n", c.Target)
+	fmt.Fprintf(w, "Workload: %d workers, %.0f%% reads, %d %s keys, %d-byte values\n",
+		c.Concurrency, c.ReadRatio*100, c.Keys, c.Distribution, c.ValueSize)
+	fmt.Fprintf(w, "Elapsed:  %.2fs\n\n", r.Seconds)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tcount\terrors\tops/s\tp50 ms\tp90 ms\tp99 ms\tp99.9 ms\tmax ms\t")
+	for _, op := range []string{"read", "write", "total"} {
+		st := r.Ops[op]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.0f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t\n",
+			op, st.Count, st.Errors, st.PerSecond, st.P50, st.P90, st.P99, st.P999, st.Max)
+	}
+	tw.Flush()
+	if len(r.Statuses) > 0 {
+		statuses := make([]int, 0, len(r.Statuses))
+		for s := range r.Statuses {
+			statuses = append(statuses, s)
+		}
+		sort.Ints(statuses)
+		parts := make([]string, len(statuses))
+		for i, s := range statuses {
+			label := fmt.Sprint(s)
+			if s == 0 {
+				label = "transport"
+			}
+			parts[i] = fmt.Sprintf("%s: %d", label, r.Statuses[s])
+		}
+		fmt.Fprintf(w, "\nFailures: %s\n", strings.Join(parts, ", "))
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/server"
+)
+
+// parseFlags parses the command-line arguments (without the program name).
+// checkOnly is set by -check-config.
+func parseFlags(args []string) (cfg *server.Config, checkOnly bool, err error) {
+	def := server.DefaultConfig()
+	cfg = &def
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+
+	fs.BoolVar(&checkOnly, "check-config", false, "run the pre-flight checks and validate the configuration, then exit: 0 if the server would start, 1 if not")
+
+	fs.StringVar(&cfg.Addr, "addr", def.Addr, "listen address, or unix:PATH for a Unix domain socket")
+	fs.Func("listen", "further address to serve the HTTP API on, as -addr (repeatable)", func(v string) error {
+		cfg.ExtraAddrs = append(cfg.ExtraAddrs, v)
+		return nil
+	})
+	fs.StringVar(&cfg.AdminAddr, "admin-addr", "", "listen address for the admin endpoints, which are then not served on the others (disabled when empty), e.g. 127.0.0.1:8081")
+	fs.Var(&cfg.AdminAPIKeys, "admin-api-key", "name=secret API key the admin listener accepts instead of the API's credentials (repeatable)")
+	fs.DurationVar(&cfg.AdminReadTimeout, "admin-read-timeout", 0, "-read-timeout of the admin listener (default -read-timeout)")
+	fs.DurationVar(&cfg.AdminWriteTimeout, "admin-write-timeout", 0, "-write-timeout of the admin listener, which profiles need longer than (default -write-timeout)")
+	fs.BoolVar(&cfg.Pprof, "pprof", false, "serve runtime profiles at /debug/pprof on the admin listener")
+	fs.BoolVar(&cfg.Expvar, "expvar", false, "serve the counters of /stats as expvar variables at /debug/vars")
+	fs.Func("unix-socket-mode", "permissions of Unix domain sockets, in octal (default 0660)", func(v string) error {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return err
+		}
+		cfg.UnixSocketMode = os.FileMode(mode)
+		return nil
+	})
+	fs.StringVar(&cfg.GRPCAddr, "grpc-addr", "", "listen address for the gRPC API (disabled when empty)")
+	fs.StringVar(&cfg.RedisAddr, "redis-addr", "", "listen address for the Redis protocol subset, also served on the HTTP port (disabled when empty)")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file; enables TLS alongside plaintext on the same port")
+	fs.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file")
+	fs.Var(&cfg.Headers, "header", `response header added to every reply, e.g. "X-Served-By: {hostname}" (repeatable)`)
+	fs.StringVar(&cfg.DataFile, "data-file", "", "snapshot file loaded on startup and written on shutdown")
+	fs.StringVar(&cfg.Storage, "storage", def.Storage, "backend of the default namespace: memory, sqlite or bolt")
+	fs.StringVar(&cfg.StoragePath, "storage-path", "", "database file of the sqlite or bolt backend")
+	fs.Func("cache-size", "memory for recently used values in front of the sqlite or bolt backend, e.g. 256MB; 0 disables it (default 64MB)", func(v string) error {
+		n, err := server.ParseBytes(v)
+		cfg.CacheSize = n
+		return err
+	})
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", 0, "how long a cached value is served before the backend is read again, for a database file other servers write too (0 until overwritten)")
+	fs.DurationVar(&cfg.CacheStaleWhileRevalidate, "cache-stale-while-revalidate", 0, "how long past -cache-ttl a cached value is still served while it is refreshed in the background")
+	fs.StringVar(&cfg.ShadowStorage, "shadow-storage", "", "second backend, memory, sqlite or bolt, every write is also applied to, for rehearsing a migration")
+	fs.StringVar(&cfg.ShadowStoragePath, "shadow-storage-path", "", "database file of the sqlite or bolt shadow backend")
+	fs.IntVar(&cfg.ShadowQueue, "shadow-queue", def.ShadowQueue, "writes that may wait for the shadow backend before it is copied again")
+	fs.DurationVar(&cfg.CompactInterval, "compact-interval", def.CompactInterval, "how often to consider compacting the bolt file (0 disables)")
+	fs.StringVar(&cfg.EncryptionKeyFile, "encryption-key-file", os.Getenv("KV_ENCRYPTION_KEY_FILE"), "file of AES-256 keys, primary first, that encrypt the data file and backups (default $KV_ENCRYPTION_KEY_FILE)")
+	cfg.EncryptionKey = os.Getenv("KV_ENCRYPTION_KEY")
+	fs.Func("encrypt-prefix", "key prefix whose values are encrypted before they are stored, using the encryption keys (repeatable)", func(v string) error {
+		cfg.EncryptPrefixes = append(cfg.EncryptPrefixes, v)
+		return nil
+	})
+	fs.StringVar(&cfg.DecryptScope, "decrypt-scope", def.DecryptScope, "API key scope (-api-key-scope) needed to read -encrypt-prefix values decrypted")
+	fs.StringVar(&cfg.SeedFile, "seed-file", "", "JSON, YAML or CSV file, or http(s) URL of one, of key/value pairs loaded into the store on startup")
+	fs.StringVar(&cfg.SeedChecksum, "seed-checksum", "", "hex SHA-256 the -seed-file contents must match")
+	fs.BoolVar(&cfg.SeedIfEmpty, "seed-if-empty", false, "load -seed-file only if the store holds no keys")
+	fs.BoolVar(&cfg.SeedOverwrite, "seed-overwrite", false, "let -seed-file replace keys that already exist")
+
+	fs.Var(&cfg.ValidationHooks, "validate-webhook", "prefix=URL of a webhook that must approve writes under prefix (repeatable)")
+	fs.DurationVar(&cfg.ValidateTimeout, "validate-timeout", def.ValidateTimeout, "timeout for validation webhook calls")
+	fs.BoolVar(&cfg.ValidateFailOpen, "validate-fail-open", false, "accept writes when a validation webhook is unreachable")
+	fs.Var(&cfg.Schemas, "schema", "prefix=path of a JSON Schema file values under prefix must match (repeatable)")
+	fs.Var(&cfg.ValueHooks, "value-hook", "prefix=name[?opt=value&...] of a value hook that transforms values under prefix as they are written and read, one of "+strings.Join(server.ValueHookNames(), ", ")+" (repeatable)")
+
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", def.ReadTimeout, "maximum duration for reading an entire request, or between reads of a streamed one such as /bulk or /import")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", def.ReadHeaderTimeout, "maximum duration for reading request headers")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", def.WriteTimeout, "maximum duration before timing out writes of a response, or between writes of a streamed one such as /export or a full listing")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", def.IdleTimeout, "maximum time to wait for the next request on a keep-alive connection")
+	fs.DurationVar(&cfg.DrainPeriod, "drain-period", def.DrainPeriod, "on shutdown, how long /readyz fails while requests are still served")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", def.ShutdownTimeout, "on shutdown, how long in-flight requests are given to finish after the drain period")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", def.RequestTimeout, "maximum time a handler may take before the client gets a 503 (0 disables; streaming endpoints are exempt)")
+	fs.DurationVar(&cfg.SlowRequestThreshold, "slow-request-threshold", 0, "log and count requests taking at least this long, with a timing breakdown (0 disables)")
+	fs.BoolVar(&cfg.LockStats, "lock-stats", false, "count contention on the server's locks, in total and per route, in /stats")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", def.MaxHeaderBytes, "maximum size of request headers")
+	fs.BoolVar(&cfg.H2C, "h2c", false, "serve HTTP/2 without TLS to clients that start with the HTTP/2 preface")
+	fs.IntVar(&cfg.HTTP2MaxStreams, "http2-max-streams", 0, "maximum concurrent HTTP/2 streams per connection (default 250)")
+	fs.Func("http2-stream-buffer", "request body bytes buffered per HTTP/2 stream, e.g. 256KB (default 1MB)", func(v string) error {
+		n, err := server.ParseBytes(v)
+		cfg.HTTP2StreamBuffer = int(n)
+		return err
+	})
+	fs.BoolVar(&cfg.ConfirmDestructive, "confirm-destructive", false, "require flushes, prefix deletes and restores to be repeated with the X-Confirm-Token they are answered with")
+	fs.DurationVar(&cfg.ConfirmWindow, "confirm-window", def.ConfirmWindow, "how long a confirmation token is valid")
+	fs.BoolVar(&cfg.ReadOnly, "read-only", false, "start in read-only mode, rejecting writes until it is switched off via /admin/maintenance")
+	fs.BoolVar(&cfg.Compression, "compress", def.Compression, "compress responses for clients that accept gzip or deflate, and accept compressed request bodies")
+	fs.Var(&cfg.Features, "feature", "name=on or name=off: start a feature flag (watch, webhooks, compression) on or off; flip it at runtime through /admin/flags (repeatable)")
+	fs.StringVar(&cfg.ValueCompression, "value-compression", "", "compress values held in memory: snappy or zstd (default off)")
+	fs.Func("value-compression-min", "smallest value to compress, e.g. 4KB (default 1KB)", func(v string) error {
+		n, err := server.ParseBytes(v)
+		cfg.ValueCompressionMin = int(n)
+		return err
+	})
+	fs.BoolVar(&cfg.Dedup, "dedup", false, "store identical values once in memory, shared by the keys that hold them")
+	fs.Func("dedup-min-size", "smallest value to deduplicate, e.g. 1KB (default 256B)", func(v string) error {
+		n, err := server.ParseBytes(v)
+		cfg.DedupMinSize = int(n)
+		return err
+	})
+	fs.Func("max-value-size", "largest value accepted, e.g. 64MB; 0 for no limit (default 32MB)", func(v string) error {
+		n, err := server.ParseBytes(v)
+		cfg.MaxValueSize = n
+		return err
+	})
+	fs.IntVar(&cfg.MaxConns, "max-conns", 0, "maximum number of concurrent connections (0 = unlimited)")
+	fs.IntVar(&cfg.MaxInFlight, "max-in-flight", 0, "shed requests with 503 while more than this many are in flight (0 = unlimited)")
+	fs.IntVar(&cfg.MaxLockQueue, "max-lock-queue", 0, "shed requests with 503 while more than this many wait for a lock (0 = unlimited)")
+	fs.DurationVar(&cfg.ShedRetryAfter, "shed-retry-after", def.ShedRetryAfter, "Retry-After sent with shed requests")
+	fs.Var(&cfg.DisabledRoutes, "disable-route", `route to turn off, as "METHOD /path", "/path" or "METHOD", e.g. "DELETE" or "/export" (comma-separated or repeatable)`)
+	fs.Var(&cfg.APIKeyPriorities, "api-key-priority", "name=class priority class, interactive or batch, of an API key's requests (repeatable)")
+	fs.Float64Var(&cfg.BatchShare, "batch-share", def.BatchShare, "share of -max-in-flight, -max-lock-queue and concurrency limits batch requests may use")
+	fs.Var(&cfg.ConcurrencyLimits, "concurrency-limit", `"METHOD /path=N" to serve at most N requests to a route at once, e.g. "GET /export=2" (repeatable)`)
+	fs.StringVar(&cfg.CacheControl, "cache-control", "", `Cache-Control header sent with key reads, e.g. "private, max-age=60"`)
+	fs.IntVar(&cfg.MaxKeyLength, "max-key-length", def.MaxKeyLength, "longest key accepted in bytes (0 = unlimited)")
+	fs.StringVar(&cfg.KeyPattern, "key-pattern", def.KeyPattern, "regular expression keys must match in full (empty allows any key)")
+	fs.Func("reserved-prefix", "key prefix clients may not write or delete under (repeatable)", func(v string) error {
+		cfg.ReservedPrefixes = append(cfg.ReservedPrefixes, v)
+		return nil
+	})
+	fs.StringVar(&cfg.KeyNormalization, "key-normalization", "", "Unicode normalization applied to keys: NFC, NFD, NFKC or NFKD (default none)")
+
+	fs.StringVar(&cfg.TopologyFile, "topology", "", "JSON file describing the nodes of a multi-node deployment")
+	fs.StringVar(&cfg.NodeID, "node-id", "", "ID of this node in the topology file")
+	fs.StringVar(&cfg.Discovery, "discovery", "static", "how nodes are found: static (the topology file and -peer), dns (-discovery-srv) or gossip (seeded by -peer)")
+	fs.StringVar(&cfg.DiscoverySRV, "discovery-srv", "", "SRV record naming the nodes for DNS discovery, e.g. _kv._tcp.example.com")
+	fs.Func("peer", `"id=url" of a node with static discovery, or the URL of a gossip seed (repeatable)`, func(v string) error {
+		cfg.Peers = append(cfg.Peers, v)
+		return nil
+	})
+	fs.StringVar(&cfg.AdvertiseURL, "advertise-url", "", "URL other nodes reach this node at, if not in the topology file")
+	fs.DurationVar(&cfg.DiscoveryInterval, "discovery-interval", def.DiscoveryInterval, "how often DNS is re-resolved or membership gossiped")
+	fs.StringVar(&cfg.RegistrationFile, "register-file", "", "JSON file this instance lists itself in while it serves, shared with other instances")
+	fs.StringVar(&cfg.RegistryURL, "registry-url", "", "registry endpoint this instance is PUT to at {url}/{id} while it serves, and DELETEd from on shutdown")
+	fs.DurationVar(&cfg.RegistrationInterval, "register-interval", def.RegistrationInterval, "how often the registration is refreshed")
+	fs.BoolVar(&cfg.Sharding, "shard", false, "spread keys over the topology's nodes by consistent hashing, proxying requests to the owning node")
+	fs.IntVar(&cfg.ShardVNodes, "shard-vnodes", def.ShardVNodes, "points per node on the consistent hash ring")
+	fs.IntVar(&cfg.RebalanceRate, "rebalance-rate", def.RebalanceRate, "keys per second a node moves to their new owners when the hash ring changes")
+	fs.StringVar(&cfg.RaftDir, "raft-dir", "", "directory for the Raft log; makes the topology's nodes a Raft cluster that elects its primary")
+	fs.StringVar(&cfg.RaftSecret, "raft-secret", os.Getenv("KV_RAFT_SECRET"), "secret cluster nodes authenticate to each other with (default $KV_RAFT_SECRET)")
+	fs.DurationVar(&cfg.RaftElectionTimeout, "raft-election-timeout", def.RaftElectionTimeout, "how long followers wait to hear from a leader before electing a new one")
+	fs.IntVar(&cfg.ReplicationBacklog, "replication-backlog", 0, "keep this many recent mutations for /changes and for replicas to catch up from (0 = disabled)")
+	fs.StringVar(&cfg.ReplicaOf, "replica-of", "", "URL of a primary to replicate from; the node is read-only otherwise until promoted with POST /admin/promote")
+	fs.DurationVar(&cfg.PromoteAfter, "promote-after", 0, "with -replica-of, promote this node to primary once the primary has not been heard from for this long (0 = only with POST /admin/promote)")
+	fs.StringVar(&cfg.ReplicaAPIKey, "replica-api-key", os.Getenv("KV_REPLICA_API_KEY"), "API key presented to the primary (default $KV_REPLICA_API_KEY)")
+	fs.StringVar(&cfg.MirrorURL, "mirror-to", "", "https URL of an instance at another site to mirror every mutation to asynchronously (needs -replication-backlog)")
+	fs.StringVar(&cfg.MirrorAPIKey, "mirror-api-key", os.Getenv("KV_MIRROR_API_KEY"), "API key presented to the mirror (default $KV_MIRROR_API_KEY)")
+	fs.StringVar(&cfg.MirrorCAFile, "mirror-ca", "", "PEM file of the CA the mirror's certificate is checked against (default the system roots)")
+	fs.IntVar(&cfg.MirrorBatch, "mirror-batch", def.MirrorBatch, "mutations sent to the mirror per request")
+	fs.StringVar(&cfg.ReadConsistency, "read-consistency", def.ReadConsistency, "default consistency of cluster reads: local, leader or linearizable")
+	fs.DurationVar(&cfg.ConsistencyTokenWait, "consistency-token-wait", def.ConsistencyTokenWait, "how long a follower or replica holds a read with X-Consistency-Token before redirecting it to the leader or primary")
+
+	fs.DurationVar(&cfg.StatsRetention, "stats-retention", def.StatsRetention, "how long worker stats snapshots are kept for /stats/history")
+	fs.StringVar(&cfg.DiagnosticsDir, "diagnostics-dir", def.DiagnosticsDir, "directory SIGUSR1 and POST /admin/diagnostics write diagnostic reports to (empty disables them)")
+	fs.DurationVar(&cfg.WorkerInterval, "worker-interval", def.WorkerInterval, "how often the worker records a stats snapshot (0 disables it)")
+	fs.StringVar(&cfg.WorkerLog, "worker-log", def.WorkerLog, "how the worker reports each snapshot in the log: text, json or none")
+	fs.Var(&cfg.Alerts, "alert", "metric>threshold or metric<threshold to alert on, e.g. error_rate>0.05 or memory>2GB; metrics are error_rate, memory, keys and replica_lag (repeatable)")
+	fs.StringVar(&cfg.AlertURL, "alert-url", "", "URL alerts are POSTed to, e.g. a Slack incoming webhook")
+	fs.DurationVar(&cfg.AlertCooldown, "alert-cooldown", def.AlertCooldown, "minimum time between two notifications of the same alert")
+	fs.StringVar(&cfg.StatsDAddr, "statsd", "", "host:port of a StatsD daemon to push metrics to over UDP (disabled when empty)")
+	fs.StringVar(&cfg.StatsDPrefix, "statsd-prefix", def.StatsDPrefix, "prefix of the metric names pushed to StatsD")
+	fs.DurationVar(&cfg.StatsDInterval, "statsd-interval", def.StatsDInterval, "how often metrics are pushed to StatsD")
+	fs.DurationVar(&cfg.HotKeyWindow, "hotkeys-window", def.HotKeyWindow, "sliding window over which /stats/hotkeys estimates the most read and written keys (0 disables)")
+
+	fs.BoolVar(&cfg.LegacyRoutes, "legacy-routes", def.LegacyRoutes, "also serve the unversioned routes (/data, /stats, ...) for older clients")
+	fs.BoolVar(&cfg.SwaggerUI, "swagger-ui", false, "serve the Swagger UI API explorer at /docs")
+	fs.BoolVar(&cfg.Dashboard, "ui", false, "serve a web dashboard at /ui")
+	fs.BoolVar(&cfg.StrictJSON, "strict-json", false, "reject unknown members of JSON request bodies, and non-string values in POST /data")
+	fs.BoolVar(&cfg.Chaos, "chaos", false, "enable fault injection through /admin/chaos (for testing clients only)")
+
+	fs.Var(&cfg.Webhooks, "webhook", "prefix=URL notified of changes to keys under prefix (repeatable)")
+	fs.StringVar(&cfg.WebhookSecret, "webhook-secret", "", "HMAC secret used to sign webhook notifications")
+
+	fs.IntVar(&cfg.MaxKeys, "max-keys", 0, "evict keys once the store holds more than this many (0 = unlimited)")
+	fs.Func("max-memory", "evict keys once their estimated size exceeds this, e.g. 256MB (default unlimited)", func(v string) error {
+		n, err := server.ParseBytes(v)
+		cfg.MaxMemory = n
+		return err
+	})
+	fs.StringVar(&cfg.EvictionPolicy, "eviction-policy", def.EvictionPolicy, "which keys to evict first: lru, lfu or random")
+	fs.StringVar(&cfg.BackupBucket, "backup-bucket", "", "S3 bucket for snapshot backups of the default namespace (disabled when empty)")
+	fs.StringVar(&cfg.BackupEndpoint, "backup-endpoint", def.BackupEndpoint, "URL of the S3-compatible object store")
+	fs.StringVar(&cfg.BackupRegion, "backup-region", def.BackupRegion, "region used to sign object store requests")
+	fs.StringVar(&cfg.BackupAccessKey, "backup-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "object store access key (default $AWS_ACCESS_KEY_ID)")
+	fs.StringVar(&cfg.BackupSecretKey, "backup-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "object store secret key (default $AWS_SECRET_ACCESS_KEY)")
+	fs.StringVar(&cfg.BackupPrefix, "backup-prefix", def.BackupPrefix, "object name prefix for backups")
+	fs.DurationVar(&cfg.BackupInterval, "backup-interval", 0, "how often to back up (0 = only on demand via /admin/backups)")
+	fs.IntVar(&cfg.BackupRetain, "backup-retain", def.BackupRetain, "number of backups to keep (0 = keep all)")
+	fs.IntVar(&cfg.AuditSize, "audit-size", def.AuditSize, "number of audit log entries kept in memory (0 with no -audit-file disables auditing)")
+	fs.StringVar(&cfg.AuditFile, "audit-file", "", "file every audit log entry is appended to as NDJSON")
+	fs.IntVar(&cfg.RecordSize, "record-size", 0, "number of recent requests and responses kept for /admin/recordings (0 with no -record-file disables recording)")
+	fs.StringVar(&cfg.RecordFile, "record-file", "", "file every recorded request and response is appended to as NDJSON, for \"server replay\"")
+	fs.IntVar(&cfg.RecordBodyLimit, "record-body-limit", 0, "bytes of each request and response body recorded (0 = 64 KiB)")
+	fs.StringVar(&cfg.PersistCodec, "persist-codec", "json", "codec the data file and write-ahead log are written in: json, gob, protobuf or binary; files in another are migrated")
+	fs.StringVar(&cfg.WALDir, "wal-dir", "", "directory of a write-ahead log of every mutation, with periodic snapshots, for point-in-time restores with POST /admin/restore")
+	fs.DurationVar(&cfg.WALSnapshotInterval, "wal-snapshot-interval", def.WALSnapshotInterval, "how often the write-ahead log takes a snapshot and starts a new segment")
+	fs.DurationVar(&cfg.WALRetention, "wal-retention", def.WALRetention, "how far back point-in-time restores can go before snapshots and segments are deleted")
+	fs.BoolVar(&cfg.Search, "search", false, "maintain a full-text index of values for /search")
+	fs.IntVar(&cfg.BloomKeys, "bloom-keys", 0, "keep a Bloom filter of each namespace's keys, sized for this many, for /data/{key}/exists (0 = off)")
+	fs.Float64Var(&cfg.BloomFPRate, "bloom-fp-rate", def.BloomFPRate, "false positive rate the Bloom filters are sized for")
+	fs.Var(&cfg.Indexes, "index", `secondary index as name=$.field, or a bare name to index whole values (repeatable)`)
+	fs.IntVar(&cfg.HistoryDepth, "history", 0, "number of past versions kept per key (0 = no history)")
+	fs.DurationVar(&cfg.SoftDeleteRetention, "soft-delete", 0, "keep deleted keys restorable for this long (0 = delete immediately)")
+	fs.DurationVar(&cfg.IdempotencyWindow, "idempotency-window", def.IdempotencyWindow, "how long responses to writes sent with an Idempotency-Key are replayed to retries (0 disables)")
+	fs.Var(&cfg.Quotas, "ns-quota", `namespace=KEYS:BYTES size limit, 0 for unlimited; namespace "*" sets the default (repeatable)`)
+
+	fs.Func("cors-origin", `origin browsers may call the API from, or "*" for any (repeatable); enables CORS`, func(v string) error {
+		cfg.CORSOrigins = append(cfg.CORSOrigins, v)
+		return nil
+	})
+	fs.Func("cors-methods", "comma-separated methods allowed in CORS requests (default all API methods)", func(v string) error {
+		cfg.CORSMethods = splitList(v)
+		return nil
+	})
+	fs.Func("cors-headers", "comma-separated request headers allowed in CORS requests (default those the browser asks for)", func(v string) error {
+		cfg.CORSHeaders = splitList(v)
+		return nil
+	})
+	fs.DurationVar(&cfg.CORSMaxAge, "cors-max-age", 0, "how long browsers may cache CORS preflight responses")
+
+	fs.BoolVar(&cfg.AccessLog, "access-log", false, "log one line per request")
+	fs.Var(&cfg.APIKeys, "api-key", "name=secret API key accepted as a Bearer token (repeatable); enables authentication")
+	fs.StringVar(&cfg.AuthProvider, "auth-provider", "", "how requests are authenticated: keys (the default with -api-key), file, ldap or oidc")
+	fs.StringVar(&cfg.AuthFile, "auth-file", "", "JSON file of identities for -auth-provider file: [{\"name\", \"token\" or \"token_sha256\", \"scopes\"}]")
+	fs.StringVar(&cfg.AuthLDAPURL, "auth-ldap-url", "", "ldap:// or ldaps:// URL of the directory for -auth-provider ldap")
+	fs.StringVar(&cfg.AuthLDAPUserDN, "auth-ldap-user-dn", "", "DN to bind as, with %s for the user name, e.g. uid=%s,ou=people,dc=example,dc=com")
+	fs.StringVar(&cfg.AuthOIDCURL, "auth-oidc-url", "", "OAuth 2.0 token introspection endpoint for -auth-provider oidc")
+	fs.StringVar(&cfg.AuthOIDCClientID, "auth-oidc-client-id", "", "client ID the server introspects tokens as")
+	fs.StringVar(&cfg.AuthOIDCClientSecret, "auth-oidc-client-secret", os.Getenv("KV_OIDC_CLIENT_SECRET"), "client secret for introspection (default $KV_OIDC_CLIENT_SECRET)")
+	fs.DurationVar(&cfg.AuthCacheTTL, "auth-cache-ttl", def.AuthCacheTTL, "how long an identity confirmed by LDAP or OIDC is trusted (0 = ask every time)")
+	fs.Var(&cfg.SigningKeys, "signing-key", "name=secret key machine clients sign requests with, as Authorization: KV-HMAC-SHA256 (repeatable)")
+	fs.DurationVar(&cfg.SigningWindow, "signing-window", def.SigningWindow, "how far a signed request's timestamp may be from the server's clock")
+	fs.IntVar(&cfg.AuthLockoutThreshold, "auth-lockout-threshold", 0, "failed authentications from one address within -auth-lockout-window that lock it out (0 = never)")
+	fs.DurationVar(&cfg.AuthLockoutWindow, "auth-lockout-window", def.AuthLockoutWindow, "window in which failed authentications are counted")
+	fs.DurationVar(&cfg.AuthLockoutDuration, "auth-lockout-duration", def.AuthLockoutDuration, "first lockout of an address; each further one doubles it")
+	fs.DurationVar(&cfg.AuthLockoutMax, "auth-lockout-max", def.AuthLockoutMax, "longest an address is locked out for")
+	fs.StringVar(&cfg.TokenSecret, "token-secret", os.Getenv("KV_TOKEN_SECRET"), "secret service account tokens are signed with; enables POST /auth/token (default $KV_TOKEN_SECRET)")
+	fs.StringVar(&cfg.TokenAdminScope, "token-admin-scope", def.TokenAdminScope, "scope a client needs to issue and revoke tokens")
+	fs.DurationVar(&cfg.TokenTTL, "token-ttl", def.TokenTTL, "lifetime of an issued token when the request gives none")
+	fs.DurationVar(&cfg.TokenMaxTTL, "token-max-ttl", def.TokenMaxTTL, "longest lifetime a token may be issued for")
+	fs.StringVar(&cfg.TokenRevocationFile, "token-revocation-file", "", "file the list of revoked tokens is kept in across restarts")
+	fs.Var(&cfg.APIKeyScopes, "api-key-scope", "name=scope,scope scopes held by an API key, for -tag-policy (repeatable)")
+	fs.Var(&cfg.TagPolicies, "tag-policy", "tag=rule,rule policy for keys written with the tag: scope:NAME requires the scope, no-export leaves them out of /export, mask keeps their values out of the audit log (repeatable)")
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", 0, "requests per second allowed per client (0 = unlimited)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", 0, "burst size for -rate-limit (default: one second's worth)")
+	fs.Func("trusted-proxy", "comma-separated CIDRs or addresses of load balancers whose Forwarded and X-Forwarded-For headers name the client (repeatable)", func(v string) error {
+		cfg.TrustedProxies = append(cfg.TrustedProxies, splitList(v)...)
+		return nil
+	})
+	fs.BoolVar(&cfg.ProxyProtocol, "proxy-protocol", false, "accept PROXY protocol v1 and v2 headers from -trusted-proxy peers")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	return cfg, checkOnly, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
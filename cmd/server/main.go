@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/server"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "verify-snapshot":
+			os.Exit(runVerifySnapshot(os.Args[2:]))
+		case "convert-snapshot":
+			os.Exit(runConvertSnapshot(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
+	cfg, checkOnly, err := parseFlags(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	// Find what would stop the server before it opens anything, rather
+	// than part way through starting.
+	checks := server.Preflight(*cfg)
+	if checkOnly {
+		os.Exit(printChecks(checks))
+	}
+	for _, c := range checks {
+		if !c.OK && c.Level == server.PreflightWarning {
+			log.Print(c)
+		}
+	}
+	if err := server.PreflightFailed(checks); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot start: %v\n", err)
+		os.Exit(1)
+	}
+
+	srv, err := server.New(server.WithConfig(*cfg))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot start: %v\n", err)
+		os.Exit(1)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	diag := make(chan os.Signal, 1)
+	notifyDiagnostics(diag)
+	go func() {
+		for range diag {
+			if _, err := srv.DumpDiagnostics(); err != nil {
+				log.Printf("Diagnostic report failed: %v", err)
+			}
+		}
+	}()
+
+	if err := srv.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot start: %v\n", err)
+		// Release the data file and close the backend opened by New.
+		srv.Stop(context.Background())
+		os.Exit(1)
+	}
+
+	upgrade := make(chan os.Signal, 1)
+	notifyUpgrade(upgrade)
+wait:
+	for {
+		select {
+		case <-stop:
+			fmt.Println("\nShutting down server...")
+			break wait
+		case <-upgrade:
+			if err := srv.Upgrade(); err != nil {
+				log.Printf("Restart failed, carrying on: %v", err)
+				continue
+			}
+			break wait
+		case err := <-srv.Err():
+			log.Printf("Server error: %v", err)
+			break wait
+		}
+	}
+	go func() {
+		<-stop
+		log.Fatal("Second signal received, exiting without waiting")
+	}()
+
+	// Graceful shutdown, bounded by -drain-period and -shutdown-timeout
+	if err := srv.Stop(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Server exited gracefully")
+}
+
+// printChecks prints the results of the pre-flight checks for
+// -check-config and returns the exit code: 1 if any failed with an error.
+func printChecks(checks []server.PreflightCheck) int {
+	for _, c := range checks {
+		fmt.Println(c)
+	}
+	if server.PreflightFailed(checks) != nil {
+		return 1
+	}
+	fmt.Println("Configuration OK")
+	return 0
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// replayRecording is a line of a record file, or of
+// /admin/recordings/export, as far as replaying it needs.
+type replayRecording struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Request   struct {
+		Method string      `json:"method"`
+		URL    string      `json:"url"`
+		Header http.Header `json:"header"`
+		replayBody
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+		replayBody
+	} `json:"response"`
+}
+
+type replayBody struct {
+	Body      string `json:"body"`
+	Encoding  string `json:"body_encoding"`
+	Truncated bool   `json:"body_truncated"`
+}
+
+func (b replayBody) bytes() ([]byte, error) {
+	if b.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(b.Body)
+	}
+	return []byte(b.Body), nil
+}
+
+// replayResult is how one recording fared.
+type replayResult struct {
+	Seq       uint64 `json:"seq"`
+	RequestID string `json:"request_id,omitempty"`
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	Recorded  int    `json:"recorded_status"`
+	Status    int    `json:"status,omitempty"`
+	// Outcome is "match", "mismatch", "skipped" or "failed".
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// replaySkipHeaders are the recorded headers not sent again: those the
+// transport sets, those compression would change the response for, and
+// the request ID, so that the replay gets one of its own.
+var replaySkipHeaders = []string{"Content-Length", "Connection", "Accept-Encoding", "X-Request-Id", "Transfer-Encoding"}
+
+// runReplay implements "server replay": it sends the requests of one or
+// more record files to a server, in order, and reports where the
+// responses differ from those recorded, so that a bug seen by a client
+// can be reproduced against a local server. Credentials were left out
+// when recording; -api-key supplies the replay's. It exits 1 if any
+// response differs or any request fails.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the server to replay against")
+	apiKey := fs.String("api-key", "", "API key sent as a Bearer token in place of the recorded credentials")
+	timing := fs.Bool("timing", false, "keep the recorded gaps between requests instead of sending them back to back")
+	compareBody := fs.Bool("compare-body", false, "also compare response bodies, ignoring request IDs in JSON")
+	filter := fs.String("request-id", "", "replay only the request with this ID")
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: server replay [flags] FILE... (- for standard input)")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	base := strings.TrimSuffix(*target, "/")
+	client := &http.Client{
+		Timeout: time.Minute,
+		// Redirects are part of what was recorded.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	var recs []replayRecording
+	for _, path := range fs.Args() {
+		r, err := readRecordings(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			return 1
+		}
+		recs = append(recs, r...)
+	}
+
+	code := 0
+	results := make([]replayResult, 0, len(recs))
+	var last time.Time
+	for _, rec := range recs {
+		if *filter != "" && rec.RequestID != *filter {
+			continue
+		}
+		if *timing && !last.IsZero() {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+		res := replayOne(client, base, *apiKey, *compareBody, rec)
+		if res.Outcome == "mismatch" || res.Outcome == "failed" {
+			code = 1
+		}
+		results = append(results, res)
+		if !*asJSON {
+			line := fmt.Sprintf("#%d %s %s: %s", res.Seq, res.Method, res.URL, res.Outcome)
+			if res.Status != 0 {
+				line += fmt.Sprintf(", %d (recorded %d)", res.Status, res.Recorded)
+			}
+			if res.Reason != "" {
+				line += ": " + res.Reason
+			}
+			fmt.Println(line)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+		return code
+	}
+	counts := map[string]int{}
+	for _, res := range results {
+		counts[res.Outcome]++
+	}
+	fmt.Printf("%d replayed: %d matched, %d differed, %d skipped, %d failed\n",
+		len(results), counts["match"], counts["mismatch"], counts["skipped"], counts["failed"])
+	return code
+}
+
+// readRecordings reads the recordings of an NDJSON file, or of standard
+// input for "-".
+func readRecordings(path string) ([]replayRecording, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var out []replayRecording
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for n := 1; ; n++ {
+		var rec replayRecording
+		if err := dec.Decode(&rec); err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return out, fmt.Errorf("%s: recording %d: %w", path, n, err)
+		}
+		out = append(out, rec)
+	}
+}
+
+// replayOne sends the request of rec to base and compares the response
+// with the one recorded.
+func replayOne(client *http.Client, base, apiKey string, compareBody bool, rec replayRecording) replayResult {
+	res := replayResult{Seq: rec.Seq, RequestID: rec.RequestID, Method: rec.Request.Method, URL: rec.Request.URL, Recorded: rec.Response.Status}
+	if rec.Request.Truncated {
+		res.Outcome, res.Reason = "skipped", "the request body was only partly recorded"
+		return res
+	}
+	body, err := rec.Request.bytes()
+	if err != nil {
+		res.Outcome, res.Reason = "failed", "request body: "+err.Error()
+		return res
+	}
+	req, err := http.NewRequest(rec.Request.Method, base+rec.Request.URL, bytes.NewReader(body))
+	if err != nil {
+		res.Outcome, res.Reason = "failed", err.Error()
+		return res
+	}
+	req.Header = rec.Request.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	for _, name := range replaySkipHeaders {
+		req.Header.Del(name)
+	}
+	for name, values := range req.Header {
+		if len(values) == 1 && values[0] == "[redacted]" {
+			req.Header.Del(name)
+		}
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Outcome, res.Reason = "failed", err.Error()
+		return res
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	res.Status = resp.StatusCode
+	switch {
+	case err != nil:
+		res.Outcome, res.Reason = "failed", "reading the response: "+err.Error()
+	case resp.StatusCode != rec.Response.Status:
+		res.Outcome = "mismatch"
+	case compareBody:
+		want, _ := rec.Response.bytes()
+		if rec.Response.Truncated && len(got) > len(want) {
+			got = got[:len(want)]
+		}
+		if !sameBody(want, got) {
+			res.Outcome, res.Reason = "mismatch", "response bodies differ"
+			return res
+		}
+		res.Outcome = "match"
+	default:
+		res.Outcome = "match"
+	}
+	return res
+}
+
+// sameBody compares response bodies, as JSON without request IDs if both
+// are JSON.
+func sameBody(a, b []byte) bool {
+	var ja, jb interface{}
+	if json.Unmarshal(a, &ja) == nil && json.Unmarshal(b, &jb) == nil {
+		return reflect.DeepEqual(dropRequestIDs(ja), dropRequestIDs(jb))
+	}
+	return bytes.Equal(a, b)
+}
+
+func dropRequestIDs(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		delete(v, "request_id")
+		for k, e := range v {
+			v[k] = dropRequestIDs(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = dropRequestIDs(e)
+		}
+	}
+	return v
+}
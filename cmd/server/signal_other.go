@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyDiagnostics does nothing where there is no SIGUSR1; reports can
+// still be requested with POST /admin/diagnostics.
+func notifyDiagnostics(c chan<- os.Signal) {}
+
+// notifyUpgrade does nothing where there is no SIGUSR2; sockets cannot be
+// handed over there.
+func notifyUpgrade(c chan<- os.Signal) {}
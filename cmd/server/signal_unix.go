@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDiagnostics relays SIGUSR1, which asks for a diagnostic report, to c.
+func notifyDiagnostics(c chan<- os.Signal) { signal.Notify(c, syscall.SIGUSR1) }
+
+// notifyUpgrade relays SIGUSR2, which asks for a restart that hands the
+// listening sockets to a new process, to c.
+func notifyUpgrade(c chan<- os.Signal) { signal.Notify(c, syscall.SIGUSR2) }
@@ -0,0 +1,298 @@
+// Package client is a Go client for the key/value server's HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultRetries = 3
+	defaultBackoff = 100 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+// Client talks to a server over HTTP. It is safe for concurrent use.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	apiKey  string
+	retries int
+	backoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient replaces the underlying http.Client.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithTimeout sets the per-attempt request timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.http.Timeout = d }
+}
+
+// WithRetries sets how many times a failed request is retried. Network
+// errors, 429 and 5xx responses are retried; other errors are not.
+func WithRetries(n int) Option {
+	return func(c *Client) { c.retries = n }
+}
+
+// WithBackoff sets the initial delay between retries. It doubles after each
+// attempt, with jitter, up to five seconds.
+func WithBackoff(d time.Duration) Option {
+	return func(c *Client) { c.backoff = d }
+}
+
+// WithAPIKey sends key as a Bearer token on every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// New returns a client for the server at baseURL, e.g.
+// "http://localhost:8080".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{Timeout: defaultTimeout},
+		retries: defaultRetries,
+		backoff: defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Get returns the value stored under key. It returns an error satisfying
+// errors.Is(err, ErrNotFound) when the key does not exist.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var out map[string]string
+	if err := c.do(ctx, http.MethodGet, "/v1/data/"+url.PathEscape(key), nil, &out); err != nil {
+		return "", err
+	}
+	return out[key], nil
+}
+
+// Set stores value under key.
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	return c.SetMany(ctx, map[string]string{key: value})
+}
+
+// SetMany stores all pairs in one request.
+func (c *Client) SetMany(ctx context.Context, pairs map[string]string) error {
+	return c.do(ctx, http.MethodPost, "/v1/data", pairs, nil)
+}
+
+// Delete removes key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/data/"+url.PathEscape(key), nil, nil)
+}
+
+// List returns every key/value pair.
+func (c *Client) List(ctx context.Context) (map[string]string, error) {
+	var out map[string]string
+	err := c.do(ctx, http.MethodGet, "/v1/data", nil, &out)
+	return out, err
+}
+
+// batchConcurrency bounds the number of parallel requests in BatchGet.
+const batchConcurrency = 8
+
+// BatchGet fetches several keys concurrently. Missing keys are omitted from
+// the result; any other error aborts the batch.
+func (c *Client) BatchGet(ctx context.Context, keys []string) (map[string]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		out      = make(map[string]string, len(keys))
+		firstErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, batchConcurrency)
+	)
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer func() { <-sem; wg.Done() }()
+			v, err := c.Get(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				out[key] = v
+			case errors.Is(err, ErrNotFound):
+			case firstErr == nil:
+				firstErr = err
+				cancel()
+			}
+		}(key)
+	}
+	wg.Wait()
+	return out, firstErr
+}
+
+// Stats returns the server's /v1/stats document.
+func (c *Client) Stats(ctx context.Context) (map[string]interface{}, error) {
+	var out map[string]interface{}
+	err := c.do(ctx, http.MethodGet, "/v1/stats", nil, &out)
+	return out, err
+}
+
+// do sends a JSON request, retrying transient failures, and decodes a JSON
+// response into out when out is non-nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, body)
+		if err == nil && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil {
+				io.Copy(io.Discard, resp.Body)
+				return nil
+			}
+			return json.NewDecoder(resp.Body).Decode(out)
+		}
+
+		var wait time.Duration
+		if err == nil {
+			err = decodeError(resp)
+			resp.Body.Close()
+			if !retryable(resp.StatusCode) {
+				return err
+			}
+			wait = retryAfter(resp)
+		}
+		if attempt >= c.retries || ctx.Err() != nil {
+			return err
+		}
+
+		if wait == 0 {
+			wait = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			backoff = min(backoff*2, maxBackoff)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// send issues a single request without retrying and returns the raw
+// response for the caller to consume.
+func (c *Client) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	return c.http.Do(req)
+}
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return min(time.Duration(secs)*time.Second, maxBackoff)
+}
+
+// APIError is an error response returned by the server.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+func (e *APIError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%d %s: %s (request %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Errors that APIError values can be matched against with errors.Is.
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrReadOnly     = errors.New("server is read-only")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrConflict     = errors.New("conflict")
+)
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Code == "key_not_found" || e.Code == "not_found"
+	case ErrReadOnly:
+		return e.Code == "read_only"
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	}
+	return false
+}
+
+func decodeError(resp *http.Response) error {
+	var body struct {
+		Error struct {
+			Code      string `json:"code"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+		} `json:"error"`
+	}
+	buf, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	e := &APIError{StatusCode: resp.StatusCode}
+	if json.Unmarshal(buf, &body) == nil && body.Error.Code != "" {
+		e.Code, e.Message, e.RequestID = body.Error.Code, body.Error.Message, body.Error.RequestID
+	} else {
+		e.Message = strings.TrimSpace(string(buf))
+		if e.Message == "" {
+			e.Message = resp.Status
+		}
+	}
+	return e
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Event is a change to a watched key.
+type Event struct {
+	Type     string    `json:"type"` // "set" or "delete"
+	Key      string    `json:"key"`
+	Value    string    `json:"value,omitempty"`
+	Created  bool      `json:"created,omitempty"`
+	Revision uint64    `json:"revision"`
+	Time     time.Time `json:"time"`
+}
+
+// watchPollTimeout is how long each long-poll request waits server-side.
+const watchPollTimeout = 30 * time.Second
+
+// Watch follows changes to key made after revision since, using the
+// server's long-poll API. Events are delivered on the returned channel,
+// which is closed when ctx is cancelled or a non-retryable error occurs.
+func (c *Client) Watch(ctx context.Context, key string, since uint64) <-chan Event {
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		// Each poll may legitimately take the full poll timeout.
+		hc := *c.http
+		hc.Timeout = watchPollTimeout + c.http.Timeout
+		poller := *c
+		poller.http = &hc
+
+		for ctx.Err() == nil {
+			path := "/v1/data/" + url.PathEscape(key) + "?watch=true&since=" +
+				strconv.FormatUint(since, 10) + "&timeout=" + watchPollTimeout.String()
+			resp, err := poller.send(ctx, http.MethodGet, path, nil)
+			if err != nil {
+				if !sleepCtx(ctx, c.backoff) {
+					return
+				}
+				continue
+			}
+
+			switch {
+			case resp.StatusCode == http.StatusNotModified:
+				resp.Body.Close()
+			case resp.StatusCode == http.StatusOK:
+				var ev Event
+				err := json.NewDecoder(resp.Body).Decode(&ev)
+				resp.Body.Close()
+				if err != nil {
+					return
+				}
+				since = ev.Revision
+				select {
+				case ch <- ev:
+				case <-ctx.Done():
+					return
+				}
+			default:
+				resp.Body.Close()
+				if !retryable(resp.StatusCode) || !sleepCtx(ctx, c.backoff) {
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShedRetryAfter is the Retry-After sent with shed requests when
+// none is configured.
+const defaultShedRetryAfter = time.Second
+
+// admission sheds load before it piles up: once more requests are in
+// flight than maxInFlight, or more are queued for the server's and
+// namespaces' locks than maxQueue, new requests are answered 503 at once
+// with a Retry-After, instead of queueing and timing out. Health checks
+// and /admin routes are always admitted, so that operators can still see
+// and act on an overloaded server.
+type admission struct {
+	maxInFlight int64 // 0 for no limit
+	maxQueue    int64 // 0 for no limit
+	retryAfter  time.Duration
+
+	// queue is the number of requests waiting for a lock, kept by the
+	// timedMutexes that share it.
+	queue atomic.Int64
+
+	shedInFlight atomic.Int64
+	shedQueue    atomic.Int64
+}
+
+// admissionStats is the "admission" entry of /stats.
+type admissionStats struct {
+	MaxInFlight  int64 `json:"max_in_flight,omitempty"`
+	MaxQueue     int64 `json:"max_lock_queue,omitempty"`
+	LockQueue    int64 `json:"lock_queue"`
+	ShedInFlight int64 `json:"shed_in_flight"`
+	ShedQueue    int64 `json:"shed_lock_queue"`
+}
+
+func newAdmission(cfg Config) *admission {
+	if cfg.MaxInFlight <= 0 && cfg.MaxLockQueue <= 0 {
+		return nil
+	}
+	retry := cfg.ShedRetryAfter
+	if retry <= 0 {
+		retry = defaultShedRetryAfter
+	}
+	return &admission{maxInFlight: int64(cfg.MaxInFlight), maxQueue: int64(cfg.MaxLockQueue), retryAfter: retry}
+}
+
+func (a *admission) stats() admissionStats {
+	return admissionStats{
+		MaxInFlight:  a.maxInFlight,
+		MaxQueue:     a.maxQueue,
+		LockQueue:    a.queue.Load(),
+		ShedInFlight: a.shedInFlight.Load(),
+		ShedQueue:    a.shedQueue.Load(),
+	}
+}
+
+// alwaysAdmitted reports whether r bypasses admission control.
+func alwaysAdmitted(r *http.Request) bool {
+	p := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	return p == "/healthz" || p == "/readyz" || strings.HasPrefix(p, "/admin/")
+}
+
+// withAdmission sheds requests while the server is over its in-flight or
+// lock queue threshold. It runs after withMetrics, so a request counts
+// itself among those in flight, and after withPriority.
+func (s *Server) withAdmission(next http.Handler) http.Handler {
+	a := s.admission
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if alwaysAdmitted(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Batch requests are shed once their share of either threshold
+		// is reached, leaving the rest for interactive ones.
+		class := priorityFrom(r.Context())
+		inFlight, queue := s.inFlight.Load(), a.queue.Load()
+		var shed *atomic.Int64
+		switch {
+		case a.maxInFlight > 0 && inFlight > s.priorities.limit(class, a.maxInFlight):
+			shed = &a.shedInFlight
+		case a.maxQueue > 0 && queue > s.priorities.limit(class, a.maxQueue):
+			shed = &a.shedQueue
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		shed.Add(1)
+		s.priorities.shed[class].Add(1)
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(a.retryAfter.Round(time.Second)/time.Second), 1)))
+		writeError(w, r, http.StatusServiceUnavailable, codeOverloaded,
+			fmt.Sprintf("Server is overloaded (%d requests in flight, %d waiting for locks); retry later", inFlight, queue))
+	})
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics alert rules can watch.
+const (
+	alertErrorRate  = "error_rate"  // fraction of requests failing over the last minute
+	alertMemory     = "memory"      // heap in use, in bytes
+	alertKeys       = "keys"        // keys in the default namespace
+	alertReplicaLag = "replica_lag" // entries behind: this replica's, or the furthest replica's on a primary
+)
+
+// AlertRule fires when Metric goes above, or with Below set, below
+// Threshold.
+type AlertRule struct {
+	Metric    string
+	Below     bool
+	Threshold float64
+}
+
+func (a AlertRule) String() string {
+	op := ">"
+	if a.Below {
+		op = "<"
+	}
+	v := strconv.FormatFloat(a.Threshold, 'g', -1, 64)
+	return a.Metric + op + v
+}
+
+// breached reports whether v crosses the rule's threshold.
+func (a AlertRule) breached(v float64) bool {
+	if a.Below {
+		return v < a.Threshold
+	}
+	return v > a.Threshold
+}
+
+// AlertRules holds the alert rules. It implements flag.Value, parsing
+// repeated "metric>threshold" or "metric<threshold" arguments such as
+// "error_rate>0.05" or "memory>2GB".
+type AlertRules []AlertRule
+
+func (f *AlertRules) String() string {
+	parts := make([]string, len(*f))
+	for i, a := range *f {
+		parts[i] = a.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *AlertRules) Set(v string) error {
+	i := strings.IndexAny(v, "<>")
+	if i < 0 {
+		return fmt.Errorf("alert %q must be in metric>threshold or metric<threshold form", v)
+	}
+	a := AlertRule{Metric: strings.TrimSpace(v[:i]), Below: v[i] == '<'}
+	value := strings.TrimSpace(v[i+1:])
+	var err error
+	switch a.Metric {
+	case alertMemory:
+		var n int64
+		n, err = ParseBytes(value)
+		a.Threshold = float64(n)
+	case alertErrorRate, alertKeys, alertReplicaLag:
+		a.Threshold, err = strconv.ParseFloat(value, 64)
+	default:
+		return fmt.Errorf("alert %q: unknown metric %q (want %s, %s, %s or %s)", v, a.Metric,
+			alertErrorRate, alertMemory, alertKeys, alertReplicaLag)
+	}
+	if err != nil {
+		return fmt.Errorf("alert %q: invalid threshold %q", v, value)
+	}
+	*f = append(*f, a)
+	return nil
+}
+
+// alertState is where a rule stands.
+type alertState struct {
+	Rule string `json:"rule"`
+	// Value is the metric when last checked; it is absent while the
+	// metric is unavailable, e.g. replica_lag on a server that does not
+	// replicate.
+	Value        *float64  `json:"value,omitempty"`
+	Firing       bool      `json:"firing"`
+	Since        time.Time `json:"since,omitempty"`
+	LastNotified time.Time `json:"last_notified,omitempty"`
+	Suppressed   int       `json:"suppressed"`
+
+	notified bool // whether the current breach has been notified
+}
+
+// alertPayload is the body POSTed to Config.AlertURL. Text makes it a
+// valid Slack incoming webhook message.
+type alertPayload struct {
+	Event     string    `json:"event"` // always "alert"
+	Status    string    `json:"status"`
+	Rule      string    `json:"rule"`
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Node      string    `json:"node,omitempty"`
+	Time      time.Time `json:"time"`
+	Text      string    `json:"text"`
+}
+
+// alerter checks the alert rules on every run of the "alerts" job and
+// notifies the alert URL when one starts or stops firing. Once a rule has
+// been notified it is not notified again until the cooldown has passed,
+// so a metric flapping around its threshold does not raise an alert
+// storm; a rule still firing after the cooldown is notified again.
+type alerter struct {
+	rules    AlertRules
+	target   *webhook
+	cooldown time.Duration
+
+	mu     sync.Mutex
+	states []alertState
+}
+
+func newAlerter(rules AlertRules, url, secret string, cooldown time.Duration) *alerter {
+	al := &alerter{
+		rules:    rules,
+		target:   &webhook{ID: "alerts", URL: url, secret: secret},
+		cooldown: cooldown,
+		states:   make([]alertState, len(rules)),
+	}
+	for i, a := range rules {
+		al.states[i].Rule = a.String()
+	}
+	return al
+}
+
+// alertMetric returns the current value of metric, and false if it is not
+// available.
+func (s *Server) alertMetric(metric string) (float64, bool) {
+	switch metric {
+	case alertErrorRate:
+		s.mu.lock(context.Background())
+		r, ok := s.rates["1m"]
+		s.mu.Unlock()
+		return r.ErrorRate, ok
+	case alertMemory:
+		return float64(s.runtimeStats().HeapInUse), true
+	case alertKeys:
+		return float64(s.store.Len()), true
+	case alertReplicaLag:
+		if rp := s.replica.Load(); rp != nil {
+			rp.mu.Lock()
+			defer rp.mu.Unlock()
+			return float64(rp.head - rp.applied), true
+		}
+		rl := s.namespaces.replication
+		if rl == nil {
+			return 0, false
+		}
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		var lag uint64
+		for _, c := range rl.replicas {
+			lag = max(lag, rl.next-1-c.Sent)
+		}
+		return float64(lag), len(rl.replicas) > 0
+	}
+	return 0, false
+}
+
+// checkAlerts evaluates every rule, sending the notifications that are
+// due. A notification that cannot be delivered is retried on the next
+// run.
+func (s *Server) checkAlerts() error {
+	al := s.alerter
+	now := time.Now().UTC()
+	var failed []string
+	for i, rule := range al.rules {
+		v, ok := s.alertMetric(rule.Metric)
+		al.mu.Lock()
+		st := &al.states[i]
+		st.Value = nil
+		if ok {
+			st.Value = &v
+		}
+		breached := ok && rule.breached(v)
+		due := st.LastNotified.IsZero() || now.Sub(st.LastNotified) >= al.cooldown
+		var status string
+		switch {
+		case breached && !st.Firing:
+			st.Firing, st.Since = true, now
+			if due {
+				status = "firing"
+			} else {
+				// A new breach soon after the last notification; it is
+				// notified once the cooldown is over if still firing.
+				st.Suppressed++
+			}
+		case breached:
+			if due {
+				status = "firing"
+			}
+		case st.Firing && st.notified:
+			status = "resolved"
+		case st.Firing:
+			st.Firing, st.Since = false, time.Time{}
+		}
+		al.mu.Unlock()
+		if status == "" {
+			continue
+		}
+		if err := s.notifyAlert(rule, status, v, now); err != nil {
+			failed = append(failed, rule.String())
+			continue
+		}
+		al.mu.Lock()
+		st.LastNotified = now
+		st.notified = status == "firing"
+		if status == "resolved" {
+			st.Firing, st.Since = false, time.Time{}
+		}
+		al.mu.Unlock()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not notify %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (s *Server) notifyAlert(rule AlertRule, status string, v float64, now time.Time) error {
+	p := alertPayload{
+		Event:     "alert",
+		Status:    status,
+		Rule:      rule.String(),
+		Metric:    rule.Metric,
+		Value:     v,
+		Threshold: rule.Threshold,
+		Node:      s.cfg.NodeID,
+		Time:      now,
+	}
+	cmp := "above"
+	if rule.Below {
+		cmp = "below"
+	}
+	value := strconv.FormatFloat(v, 'g', 4, 64)
+	if status == "firing" {
+		p.Text = fmt.Sprintf("[FIRING] %s is %s, %s %s", rule.Metric, value, cmp, strconv.FormatFloat(rule.Threshold, 'g', -1, 64))
+	} else {
+		p.Text = fmt.Sprintf("[RESOLVED] %s is back at %s", rule.Metric, value)
+	}
+	if p.Node != "" {
+		p.Text += " on " + p.Node
+	}
+	body, _ := json.Marshal(p)
+	_, err := s.webhooks.send(s.alerter.target, "alert", body)
+	if err != nil {
+		s.logger.Printf("[Worker] Alert %s %s could not be sent: %v", p.Rule, status, err)
+		return err
+	}
+	s.logger.Printf("[Worker] Alert %s %s: %s", p.Rule, status, p.Text)
+	return nil
+}
+
+// stats is the "alerts" section of /stats.
+func (al *alerter) stats() []alertState {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return append([]alertState(nil), al.states...)
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditSize  = 10000
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditEntry records one mutation.
+type auditEntry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"` // "set", "delete", "expire", "delete_namespace", "auth_failure" or "auth_lockout"
+	Namespace string    `json:"namespace"`
+	Key       string    `json:"key,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	// Remote is the address of the client, for authentication events.
+	Remote    string `json:"remote,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	OldHash   string `json:"old_hash,omitempty"`
+	NewHash   string `json:"new_hash,omitempty"`
+	// Masked is set, and the hashes left out, for keys with a tag whose
+	// policy masks them.
+	Masked bool `json:"masked,omitempty"`
+}
+
+// auditLog is an append-only record of mutations. The most recent entries
+// are kept in memory for /audit; when a file is configured every entry is
+// also appended to it as NDJSON.
+type auditLog struct {
+	mu    sync.Mutex
+	seq   uint64
+	ring  []auditEntry
+	start int
+	size  int
+
+	file *os.File
+	w    *bufio.Writer
+}
+
+func newAuditLog(size int, path string) (*auditLog, error) {
+	if size <= 0 {
+		size = defaultAuditSize
+	}
+	a := &auditLog{size: size}
+	if path != "" {
+		// Continue numbering from the last entry already in the file.
+		seq, err := lastAuditSeq(path)
+		if err != nil {
+			return nil, err
+		}
+		a.seq = seq
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+		a.w = bufio.NewWriter(f)
+	}
+	return a, nil
+}
+
+// lastAuditSeq returns the highest sequence number in an existing audit
+// file, or 0 if there is none.
+func lastAuditSeq(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var last uint64
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e auditEntry
+		if err := dec.Decode(&e); err != nil {
+			// A torn final line from a crash is not fatal.
+			return last, nil
+		}
+		last = max(last, e.Seq)
+	}
+}
+
+func hashValue(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// record appends an entry for a mutation made on behalf of ctx. hadOld and
+// hasNew say whether the key existed before and after it.
+func (a *auditLog) record(ctx context.Context, op, ns, key, old string, hadOld bool, value string, hasNew bool) {
+	e := auditEntry{
+		Time:      time.Now().UTC(),
+		Op:        op,
+		Namespace: ns,
+		Key:       key,
+		Client:    clientIDFrom(ctx),
+		RequestID: requestIDFrom(ctx),
+	}
+	if maskedAudit(ctx) {
+		e.Masked = true
+	} else {
+		if hadOld {
+			e.OldHash = hashValue(old)
+		}
+		if hasNew {
+			e.NewHash = hashValue(value)
+		}
+	}
+	a.append(e)
+}
+
+// authEvent appends an authentication event: op is "auth_failure" for
+// rejected credentials, naming the user they claimed if any, and
+// "auth_lockout" when remote is locked out for too many of them.
+func (a *auditLog) authEvent(ctx context.Context, op, user, remote string) {
+	a.append(auditEntry{
+		Time:      time.Now().UTC(),
+		Op:        op,
+		Client:    user,
+		Remote:    remote,
+		RequestID: requestIDFrom(ctx),
+	})
+}
+
+func (a *auditLog) append(e auditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq++
+	e.Seq = a.seq
+	if len(a.ring) < a.size {
+		a.ring = append(a.ring, e)
+	} else {
+		a.ring[a.start] = e
+		a.start = (a.start + 1) % a.size
+	}
+	if a.w != nil {
+		json.NewEncoder(a.w).Encode(e)
+		// Flush per entry so the file is complete if the process dies.
+		a.w.Flush()
+	}
+}
+
+// auditFilter selects entries for /audit.
+type auditFilter struct {
+	op, namespace, key, prefix, client string
+	after                              uint64
+	since, until                       time.Time
+}
+
+func (f auditFilter) match(e auditEntry) bool {
+	return (f.op == "" || e.Op == f.op) &&
+		(f.namespace == "" || e.Namespace == f.namespace) &&
+		(f.key == "" || e.Key == f.key) &&
+		strings.HasPrefix(e.Key, f.prefix) &&
+		(f.client == "" || e.Client == f.client) &&
+		e.Seq > f.after &&
+		(f.since.IsZero() || !e.Time.Before(f.since)) &&
+		(f.until.IsZero() || e.Time.Before(f.until))
+}
+
+// query returns up to limit matching entries, newest first. limit <= 0
+// returns every match, oldest first, for export.
+func (a *auditLog) query(f auditFilter, limit int) []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := len(a.ring)
+	var out []auditEntry
+	if limit <= 0 {
+		for i := 0; i < n; i++ {
+			if e := a.ring[(a.start+i)%n]; f.match(e) {
+				out = append(out, e)
+			}
+		}
+		return out
+	}
+	for i := n - 1; i >= 0 && len(out) < limit; i-- {
+		if e := a.ring[(a.start+i)%n]; f.match(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	a.w.Flush()
+	return a.file.Close()
+}
+
+// parseAuditFilter reads the filter query parameters shared by /audit and
+// /audit/export.
+func parseAuditFilter(r *http.Request) (auditFilter, string) {
+	q := r.URL.Query()
+	f := auditFilter{
+		op:        q.Get("op"),
+		namespace: q.Get("namespace"),
+		key:       q.Get("key"),
+		prefix:    q.Get("prefix"),
+		client:    q.Get("client"),
+	}
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return f, "Invalid after"
+		}
+		f.after = n
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &f.since}, {"until", &f.until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, "Invalid " + p.name
+			}
+			*p.dst = t
+		}
+	}
+	return f, ""
+}
+
+// GET
+//
+// auditHandler returns matching audit entries, newest first. Filters:
+// ?op, ?namespace, ?key, ?prefix, ?client, ?after=SEQ, ?since and ?until
+// (RFC 3339), and ?limit (default 100, max 1000).
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if s.audit == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Audit log is not enabled")
+		return
+	}
+	f, bad := parseAuditFilter(r)
+	if bad != "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, bad)
+		return
+	}
+	limit := defaultAuditLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid limit")
+			return
+		}
+		limit = min(n, maxAuditLimit)
+	}
+	entries := s.audit.query(f, limit)
+	if entries == nil {
+		entries = []auditEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// GET
+//
+// auditExportHandler streams every retained matching entry as NDJSON,
+// oldest first, as a file download.
+func (s *Server) auditExportHandler(w http.ResponseWriter, r *http.Request) {
+	if s.audit == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Audit log is not enabled")
+		return
+	}
+	f, bad := parseAuditFilter(r)
+	if bad != "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, bad)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.ndjson"`)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, e := range s.audit.query(f, 0) {
+		enc.Encode(e)
+	}
+	bw.Flush()
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeys maps API key names to secrets. It implements flag.Value, parsing
+// repeated "name=secret" arguments.
+type APIKeys map[string]string
+
+func (f *APIKeys) String() string {
+	names := make([]string, 0, len(*f))
+	for name := range *f {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *APIKeys) Set(v string) error {
+	name, secret, ok := strings.Cut(v, "=")
+	if !ok || name == "" || secret == "" {
+		return fmt.Errorf("api key %q must be in name=secret form", v)
+	}
+	if *f == nil {
+		*f = make(APIKeys)
+	}
+	(*f)[name] = secret
+	return nil
+}
+
+// clientIDFrom returns the name of the API key that authenticated the
+// request, or "" for anonymous requests.
+func clientIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(clientIDKey).(string)
+	return id
+}
+
+// bearerToken extracts the credential from "Authorization: Bearer ..." or
+// X-API-Key.
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// Authentication providers for Config.AuthProvider.
+const (
+	authKeys = "keys" // the configured API keys
+	authFile = "file" // the identities in a file
+	authLDAP = "ldap" // a simple bind to a directory
+	authOIDC = "oidc" // OAuth 2.0 token introspection
+)
+
+// defaultAuthCacheTTL is how long a provider that asks a remote service
+// trusts a successful lookup by default.
+const defaultAuthCacheTTL = 30 * time.Second
+
+// authCheckInterval is how long /readyz reuses the outcome of a provider's
+// health check, so that frequent probes do not load the directory.
+const authCheckInterval = 5 * time.Second
+
+// Credentials are what a request presents to authenticate: a bearer token
+// from "Authorization: Bearer" or X-API-Key, or a user name and password
+// from "Authorization: Basic".
+type Credentials struct {
+	Token    string
+	Username string
+	Password string
+}
+
+// Identity is a client an AuthProvider has authenticated. Name is what the
+// client is known as in logs, stats and the audit log and in APIKeyScopes;
+// Scopes are held on top of those listed there.
+type Identity struct {
+	Name   string
+	Scopes []string
+}
+
+// AuthProvider authenticates API requests. Authenticate returns
+// ErrUnauthenticated, possibly wrapped, for credentials it does not
+// accept, and any other error when it cannot tell, such as when its
+// directory is unreachable; those requests are answered with 503 so that
+// clients retry. Check reports whether the provider can authenticate
+// anyone at all, for /readyz. Both are called concurrently.
+type AuthProvider interface {
+	Name() string
+	Authenticate(ctx context.Context, c Credentials) (Identity, error)
+	Check(ctx context.Context) error
+}
+
+// credentialsFrom returns the credentials r presents.
+func credentialsFrom(r *http.Request) Credentials {
+	if user, pass, ok := r.BasicAuth(); ok {
+		return Credentials{Username: user, Password: pass}
+	}
+	return Credentials{Token: bearerToken(r)}
+}
+
+// scopesFrom returns the scopes the auth provider granted the client of
+// ctx.
+func scopesFrom(ctx context.Context) []string {
+	scopes, _ := ctx.Value(scopesKey).([]string)
+	return scopes
+}
+
+// keyProvider accepts the API keys of Config.APIKeys as bearer tokens.
+type keyProvider APIKeys
+
+func (keyProvider) Name() string { return authKeys }
+
+func (kp keyProvider) Authenticate(_ context.Context, c Credentials) (Identity, error) {
+	for name, secret := range kp {
+		if subtle.ConstantTimeCompare([]byte(c.Token), []byte(secret)) == 1 {
+			return Identity{Name: name}, nil
+		}
+	}
+	return Identity{}, ErrUnauthenticated
+}
+
+func (keyProvider) Check(context.Context) error { return nil }
+
+// newAuthProvider returns the provider cfg selects, or nil if requests are
+// not authenticated. Without AuthProvider, API keys select the keys
+// provider, as do signing keys alone, with no keys to accept.
+func newAuthProvider(cfg Config) (AuthProvider, error) {
+	mode := cfg.AuthProvider
+	if mode == "" && len(cfg.APIKeys) > 0 {
+		mode = authKeys
+	}
+	switch mode {
+	case "":
+		if len(cfg.SigningKeys) > 0 {
+			// Only signed requests are accepted.
+			return keyProvider(nil), nil
+		}
+		return nil, nil
+	case authKeys:
+		if len(cfg.APIKeys) == 0 {
+			return nil, errors.New("the keys auth provider requires API keys")
+		}
+		return keyProvider(cfg.APIKeys), nil
+	case authFile:
+		return newFileAuth(cfg.AuthFile)
+	case authLDAP:
+		return newLDAPAuth(cfg.AuthLDAPURL, cfg.AuthLDAPUserDN, cfg.AuthCacheTTL)
+	case authOIDC:
+		return newOIDCAuth(cfg.AuthOIDCURL, cfg.AuthOIDCClientID, cfg.AuthOIDCClientSecret, cfg.AuthCacheTTL)
+	}
+	return nil, fmt.Errorf("invalid auth provider %q", cfg.AuthProvider)
+}
+
+// authenticator puts an AuthProvider in front of the API. Tokens issued
+// by POST /auth/token are checked by tokens instead.
+type authenticator struct {
+	p       AuthProvider
+	tokens  *tokenIssuer
+	signer  *requestSigner // nil unless there are SigningKeys
+	lockout *authLockout   // nil unless AuthLockoutThreshold is set
+	audit   *auditLog
+	logger  *log.Logger
+
+	mu      sync.Mutex
+	checked time.Time
+	lastErr error
+}
+
+// middleware rejects requests whose credentials the provider does not
+// accept, other than health checks and the dashboard page, whose own
+// requests carry credentials.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] || r.URL.Path == uiPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		remote := remoteHost(r)
+		if a.lockout != nil {
+			if wait, locked := a.lockout.locked(remote, time.Now()); locked {
+				writeLockedOut(w, r, wait)
+				return
+			}
+		}
+		creds := credentialsFrom(r)
+		var id Identity
+		var grant *tokenClaims
+		var err error
+		if a.signer != nil && signed(r) {
+			var name string
+			if name, err = a.signer.verify(w, r, time.Now()); err == nil {
+				id = Identity{Name: name}
+			}
+			creds = Credentials{Username: name}
+		} else {
+			id, grant, err = a.identify(r.Context(), creds)
+		}
+		switch {
+		case err == nil:
+			if a.lockout != nil {
+				a.lockout.succeed(remote)
+			}
+		case errBodyTooLarge(err):
+			writeError(w, r, http.StatusRequestEntityTooLarge, codeValueTooLarge, "Request body is too large to be signed")
+			return
+		case errors.Is(err, ErrUnauthenticated):
+			if creds != (Credentials{}) {
+				a.failed(r.Context(), creds, remote)
+			}
+			w.Header().Add("WWW-Authenticate", `Bearer realm="kv"`)
+			if a.p.Name() == authLDAP {
+				w.Header().Add("WWW-Authenticate", `Basic realm="kv"`)
+			}
+			if a.signer != nil {
+				w.Header().Add("WWW-Authenticate", signingScheme+` realm="kv"`)
+			}
+			writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid credentials")
+			return
+		default:
+			a.logger.Printf("[Auth] %s provider: %v", a.p.Name(), err)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, codeAuthUnavailable, "The authentication provider is unavailable")
+			return
+		}
+		if slot, ok := r.Context().Value(clientSlotKey).(*string); ok {
+			*slot = id.Name
+		}
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id, grant)))
+	})
+}
+
+// identify checks creds against the issued tokens if they are one, and
+// the provider otherwise.
+func (a *authenticator) identify(ctx context.Context, creds Credentials) (Identity, *tokenClaims, error) {
+	if a.tokens != nil && strings.HasPrefix(creds.Token, issuedTokenPrefix) {
+		grant, err := a.tokens.verify(creds.Token)
+		if err != nil {
+			return Identity{}, nil, err
+		}
+		return Identity{Name: grant.Name, Scopes: grant.Scopes}, grant, nil
+	}
+	id, err := a.p.Authenticate(ctx, creds)
+	return id, nil, err
+}
+
+// withIdentity returns a copy of ctx for requests of the client id, with
+// the grant of its issued token, if it used one.
+func withIdentity(ctx context.Context, id Identity, grant *tokenClaims) context.Context {
+	ctx = context.WithValue(ctx, clientIDKey, id.Name)
+	if len(id.Scopes) > 0 {
+		ctx = context.WithValue(ctx, scopesKey, id.Scopes)
+	}
+	if grant != nil {
+		ctx = context.WithValue(ctx, grantKey, grant)
+	}
+	return ctx
+}
+
+// lockedOutError is returned by login for a client that is locked out.
+type lockedOutError struct{ wait time.Duration }
+
+func (e *lockedOutError) Error() string {
+	return fmt.Sprintf("too many failed authentication attempts; retry in %s", e.wait.Round(time.Second))
+}
+
+// login authenticates creds from remote for the gRPC and Redis listeners
+// as the middleware does for HTTP requests, lockout included, and returns
+// ctx carrying the client's identity. It returns ErrUnauthenticated,
+// possibly wrapped, for credentials that are refused, a *lockedOutError
+// for a client that is locked out, and any other error when the provider
+// cannot tell.
+func (a *authenticator) login(ctx context.Context, creds Credentials, remote string) (context.Context, error) {
+	if a.lockout != nil {
+		if wait, locked := a.lockout.locked(remote, time.Now()); locked {
+			return ctx, &lockedOutError{wait}
+		}
+	}
+	id, grant, err := a.identify(ctx, creds)
+	switch {
+	case err == nil:
+		if a.lockout != nil {
+			a.lockout.succeed(remote)
+		}
+		return withIdentity(ctx, id, grant), nil
+	case errors.Is(err, ErrUnauthenticated):
+		if creds != (Credentials{}) {
+			a.failed(ctx, creds, remote)
+		}
+	default:
+		a.logger.Printf("[Auth] %s provider: %v", a.p.Name(), err)
+	}
+	return ctx, err
+}
+
+// failed records credentials from remote that were refused, locking
+// remote out if they were one failure too many.
+func (a *authenticator) failed(ctx context.Context, creds Credentials, remote string) {
+	if a.audit != nil {
+		a.audit.authEvent(ctx, "auth_failure", creds.Username, remote)
+	}
+	if a.lockout == nil {
+		return
+	}
+	if d := a.lockout.fail(remote, time.Now()); d > 0 {
+		a.logger.Printf("[Auth] locked out %s for %s after %d failed attempts", remote, d, a.lockout.threshold)
+		if a.audit != nil {
+			a.audit.authEvent(ctx, "auth_lockout", creds.Username, remote)
+		}
+	}
+}
+
+// health returns the outcome of the provider's health check, run at most
+// once every authCheckInterval.
+func (a *authenticator) health(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(a.checked) < authCheckInterval {
+		return a.lastErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	err := a.p.Check(ctx)
+	if err != nil && a.lastErr == nil {
+		a.logger.Printf("[Auth] %s provider is unhealthy: %v", a.p.Name(), err)
+	}
+	a.checked, a.lastErr = time.Now(), err
+	return err
+}
+
+// authCache remembers the identities a remote provider returned, keyed by
+// a hash of the credentials, so that it is not asked on every request.
+type authCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]authCached
+}
+
+type authCached struct {
+	id    Identity
+	until time.Time
+}
+
+// authCacheMax bounds the entries of an authCache; expired ones are
+// dropped when it is reached.
+const authCacheMax = 10000
+
+func newAuthCache(ttl time.Duration) *authCache {
+	return &authCache{ttl: ttl, entries: make(map[[sha256.Size]byte]authCached)}
+}
+
+func credentialsHash(c Credentials) [sha256.Size]byte {
+	return sha256.Sum256([]byte(c.Token + "\x00" + c.Username + "\x00" + c.Password))
+}
+
+func (ac *authCache) get(c Credentials) (Identity, bool) {
+	if ac.ttl <= 0 {
+		return Identity{}, false
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	e, ok := ac.entries[credentialsHash(c)]
+	if !ok || time.Now().After(e.until) {
+		return Identity{}, false
+	}
+	return e.id, true
+}
+
+// put caches id for the cache's TTL, or until expires if that is sooner.
+func (ac *authCache) put(c Credentials, id Identity, expires time.Time) {
+	if ac.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	until := now.Add(ac.ttl)
+	if !expires.IsZero() && expires.Before(until) {
+		until = expires
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if len(ac.entries) >= authCacheMax {
+		for k, e := range ac.entries {
+			if now.After(e.until) {
+				delete(ac.entries, k)
+			}
+		}
+		if len(ac.entries) >= authCacheMax {
+			clear(ac.entries)
+		}
+	}
+	ac.entries[credentialsHash(c)] = authCached{id: id, until: until}
+}
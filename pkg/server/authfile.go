@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// authFileReload is how often the auth file is checked for changes.
+const authFileReload = time.Second
+
+// fileIdentity is an entry of the auth file. The token is given in plain
+// or, better, as the hex SHA-256 of it.
+type fileIdentity struct {
+	Name        string   `json:"name"`
+	Token       string   `json:"token,omitempty"`
+	TokenSHA256 string   `json:"token_sha256,omitempty"`
+	Scopes      []string `json:"scopes,omitempty"`
+}
+
+// fileAuth accepts the bearer tokens listed in a JSON file, an array of
+// fileIdentity. The file is read again whenever it changes, so tokens can
+// be added and revoked without a restart; if it cannot be read, the
+// tokens last read from it stay in force and Check fails.
+type fileAuth struct {
+	path string
+
+	mu      sync.Mutex
+	tokens  map[[sha256.Size]byte]Identity
+	modTime time.Time
+	stat    time.Time // when the file was last looked at
+	err     error
+}
+
+func newFileAuth(path string) (*fileAuth, error) {
+	if path == "" {
+		return nil, errors.New("the file auth provider requires an auth file")
+	}
+	fa := &fileAuth{path: path}
+	if err := fa.load(); err != nil {
+		return nil, err
+	}
+	fa.stat = time.Now()
+	return fa, nil
+}
+
+func (fa *fileAuth) Name() string { return authFile }
+
+// load reads the file. It is called with mu held, or before fa is shared.
+func (fa *fileAuth) load() error {
+	info, err := os.Stat(fa.path)
+	if err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(fa.path)
+	if err != nil {
+		return err
+	}
+	var entries []fileIdentity
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return fmt.Errorf("%s: %w", fa.path, err)
+	}
+	tokens := make(map[[sha256.Size]byte]Identity, len(entries))
+	for i, e := range entries {
+		var sum [sha256.Size]byte
+		switch {
+		case e.Name == "":
+			return fmt.Errorf("%s: entry %d has no name", fa.path, i)
+		case (e.Token == "") == (e.TokenSHA256 == ""):
+			return fmt.Errorf("%s: %s needs one of token and token_sha256", fa.path, e.Name)
+		case e.Token != "":
+			sum = sha256.Sum256([]byte(e.Token))
+		default:
+			b, err := hex.DecodeString(e.TokenSHA256)
+			if err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("%s: token_sha256 of %s is not a hex SHA-256", fa.path, e.Name)
+			}
+			copy(sum[:], b)
+		}
+		tokens[sum] = Identity{Name: e.Name, Scopes: e.Scopes}
+	}
+	fa.tokens, fa.modTime = tokens, info.ModTime()
+	return nil
+}
+
+// reload reads the file again if it has changed since it was last read,
+// looking at most once every authFileReload.
+func (fa *fileAuth) reload() {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	now := time.Now()
+	if now.Sub(fa.stat) < authFileReload {
+		return
+	}
+	fa.stat = now
+	info, err := os.Stat(fa.path)
+	if err == nil && info.ModTime().Equal(fa.modTime) {
+		fa.err = nil
+		return
+	}
+	if err == nil {
+		err = fa.load()
+	}
+	fa.err = err
+}
+
+func (fa *fileAuth) Authenticate(_ context.Context, c Credentials) (Identity, error) {
+	if c.Token == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+	fa.reload()
+	sum := sha256.Sum256([]byte(c.Token))
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	// Comparing every hash keeps the time taken independent of which
+	// entry, if any, matches.
+	var found Identity
+	ok := false
+	for h, id := range fa.tokens {
+		if subtle.ConstantTimeCompare(h[:], sum[:]) == 1 {
+			found, ok = id, true
+		}
+	}
+	if !ok {
+		return Identity{}, ErrUnauthenticated
+	}
+	return found, nil
+}
+
+func (fa *fileAuth) Check(context.Context) error {
+	fa.reload()
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	return fa.err
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupSuffix ends the name of every backup object: a gzipped snapshot
+// in the export format. Backups taken with an encryption key also carry
+// encSuffix.
+const (
+	backupSuffix = ".ndjson.gz"
+	encSuffix    = ".enc"
+)
+
+// backupManager uploads snapshots of the default namespace to object
+// storage and prunes all but the newest retain of them.
+type backupManager struct {
+	s3     *s3Client
+	prefix string
+	retain int
+
+	mu       sync.Mutex // serializes backups and restores
+	lastSnap *Snapshot  // snapshot of the last successful backup
+}
+
+// errNoBackups is returned when restoring the newest backup of an empty
+// bucket.
+var errNoBackups = errors.New("no backups")
+
+// backupInfo describes a backup just taken.
+type backupInfo struct {
+	Name  string    `json:"name"`
+	Keys  int       `json:"keys"`
+	Size  int       `json:"size"`
+	Taken time.Time `json:"taken"`
+}
+
+// runBackup uploads a snapshot of the default namespace and prunes old
+// backups. With onlyChanged set nothing is uploaded if the data has not
+// changed since the last backup, and ok is false.
+func (s *Server) runBackup(ctx context.Context, onlyChanged bool) (info backupInfo, ok bool, err error) {
+	bm := s.backups
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	// Stores hand out the same snapshot until they are modified.
+	stored := s.namespaces.def.store.Snapshot()
+	if onlyChanged && stored == bm.lastSnap {
+		return backupInfo{}, false, nil
+	}
+	snap := s.namespaces.def.annotate(stored)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	n, err := writeSnapshot(zw, snap)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return backupInfo{}, false, err
+	}
+	data, suffix, typ := buf.Bytes(), backupSuffix, "application/gzip"
+	if s.keys != nil {
+		data, suffix, typ = s.keys.seal(data), backupSuffix+encSuffix, "application/octet-stream"
+	}
+	now := time.Now().UTC()
+	info = backupInfo{
+		// The timestamp sorts lexically, so listing order is age order.
+		Name:  bm.prefix + now.Format("20060102T150405.000Z") + suffix,
+		Keys:  n,
+		Size:  len(data),
+		Taken: snap.Taken,
+	}
+	if err := bm.s3.put(ctx, info.Name, data, typ); err != nil {
+		return backupInfo{}, false, err
+	}
+	bm.lastSnap = stored
+	if err := bm.prune(ctx); err != nil {
+		s.logger.Printf("[Backup] Pruning old backups: %v", err)
+	}
+	return info, true, nil
+}
+
+// list returns the stored backups, newest first.
+func (bm *backupManager) list(ctx context.Context) ([]s3Object, error) {
+	objs, err := bm.s3.list(ctx, bm.prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := objs[:0]
+	for _, o := range objs {
+		if strings.HasSuffix(o.Key, backupSuffix) || strings.HasSuffix(o.Key, backupSuffix+encSuffix) {
+			out = append(out, o)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key > out[j].Key })
+	return out, nil
+}
+
+func (bm *backupManager) prune(ctx context.Context) error {
+	if bm.retain <= 0 {
+		return nil
+	}
+	objs, err := bm.list(ctx)
+	if err != nil {
+		return err
+	}
+	for i := bm.retain; i < len(objs); i++ {
+		if err := bm.s3.remove(ctx, objs[i].Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreBackup replaces the default namespace with the contents of the
+// named backup, or of the newest one when name is empty.
+func (s *Server) restoreBackup(ctx context.Context, name string) (importProgress, error) {
+	bm := s.backups
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if name == "" {
+		objs, err := bm.list(ctx)
+		if err != nil {
+			return importProgress{}, err
+		}
+		if len(objs) == 0 {
+			return importProgress{}, errNoBackups
+		}
+		name = objs[0].Key
+	} else if !strings.HasPrefix(name, bm.prefix) {
+		name = bm.prefix + name
+	}
+	body, err := bm.s3.get(ctx, name)
+	if err != nil {
+		return importProgress{}, err
+	}
+	defer body.Close()
+	var r io.Reader = body
+	if strings.HasSuffix(name, encSuffix) {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return importProgress{}, err
+		}
+		plain, _, err := s.keys.open(data)
+		if err != nil {
+			return importProgress{}, fmt.Errorf("%s: %w", name, err)
+		}
+		r = bytes.NewReader(plain)
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return importProgress{}, fmt.Errorf("%s: %w", name, err)
+	}
+	// Without a namespace in ctx the import targets the default one.
+	return s.importEntries(ctx, jsonEntries(zr), "replace", nil)
+}
+
+// backupTimeout bounds a scheduled backup.
+const backupTimeout = 5 * time.Minute
+
+// scheduledBackup is run by the background worker. It skips the upload
+// when nothing has changed since the previous backup.
+func (s *Server) scheduledBackup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	info, ok, err := s.runBackup(ctx, true)
+	if err != nil || !ok {
+		return err
+	}
+	s.events.publish(serverEvent{
+		Type:    eventBackupUploaded,
+		Source:  info.Name,
+		Message: fmt.Sprintf("Uploaded %s (%d keys, %d bytes)", info.Name, info.Keys, info.Size),
+		Fields:  map[string]interface{}{"keys": info.Keys, "size": info.Size},
+	})
+	return nil
+}
+
+// GET
+func (s *Server) listBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.backups == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Backups are not configured")
+		return
+	}
+	objs, err := s.backups.list(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, codeInternal, "Listing backups failed: "+err.Error())
+		return
+	}
+	if objs == nil {
+		objs = []s3Object{}
+	}
+	writeJSON(w, http.StatusOK, objs)
+}
+
+// POST
+func (s *Server) createBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if s.backups == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Backups are not configured")
+		return
+	}
+	info, _, err := s.runBackup(r.Context(), false)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, codeInternal, "Backup failed: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// POST
+//
+// restoreBackupHandler replaces the default namespace with a backup. The
+// body, {"name": "..."}, is optional; without it the newest backup is used.
+func (s *Server) restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if s.backups == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Backups are not configured")
+		return
+	}
+	if !s.checkWritable(w, r) {
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if r.ContentLength != 0 {
+		if !s.decodeJSON(w, r, &req) {
+			return
+		}
+	}
+	name := req.Name
+	if s.confirms != nil && r.Header.Get(confirmHeader) == "" && name == "" {
+		// Name the newest backup in the summary, and restore that one
+		// once confirmed even if a newer one is taken meanwhile.
+		objs, err := s.backups.list(r.Context())
+		if err != nil {
+			writeError(w, r, http.StatusBadGateway, codeInternal, "Listing backups failed: "+err.Error())
+			return
+		}
+		if len(objs) == 0 {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "No backups to restore")
+			return
+		}
+		name = objs[0].Key
+	}
+	impact := map[string]interface{}{"namespace": defaultNamespace, "backup": name, "keys_replaced": s.namespaces.def.store.Len()}
+	impact, ok := s.confirmed(w, r, "restore", req.Name, impact)
+	if !ok {
+		return
+	}
+	name, _ = impact["backup"].(string)
+	p, err := s.restoreBackup(r.Context(), name)
+	var s3err *s3Error
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, p)
+	case p.Status == "failed":
+		// The backup was read but applying it failed part way.
+		writeJSON(w, statusForError(err), p)
+	case errors.Is(err, errNoBackups):
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No backups to restore")
+	case errors.As(err, &s3err) && s3err.Status == http.StatusNotFound:
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Backup not found")
+	default:
+		writeError(w, r, http.StatusBadGateway, codeInternal, "Restore failed: "+err.Error())
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultContentType is recorded for PUT bodies sent without a
+	// Content-Type.
+	defaultContentType = "application/octet-stream"
+
+	defaultMaxValueSize = 32 << 20
+)
+
+// contentTypes remembers the media type of values written with PUT. Values
+// without an entry are plain strings served as JSON. Like the rest of a
+// namespace's side tables, it is kept in memory only.
+type contentTypes struct {
+	mu    sync.RWMutex
+	byKey map[string]string
+}
+
+func newContentTypes() *contentTypes {
+	return &contentTypes{byKey: make(map[string]string)}
+}
+
+func (ct *contentTypes) get(key string) string {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.byKey[key]
+}
+
+// set records the media type of key, or forgets it when typ is empty.
+func (ct *contentTypes) set(key, typ string) {
+	if typ == "" {
+		ct.mu.RLock()
+		_, ok := ct.byKey[key]
+		ct.mu.RUnlock()
+		if !ok {
+			return
+		}
+	}
+	ct.mu.Lock()
+	if typ == "" {
+		delete(ct.byKey, key)
+	} else {
+		ct.byKey[key] = typ
+	}
+	ct.mu.Unlock()
+}
+
+// forget is a watchHub listener that drops the type of deleted keys,
+// including ones removed by eviction rather than by a request.
+func (ct *contentTypes) forget(ev Event) {
+	if ev.Type == "delete" {
+		ct.set(ev.Key, "")
+	}
+}
+
+// withContentType returns a copy of ctx under which applySet records typ
+// as the media type of the value it writes.
+func withContentType(ctx context.Context, typ string) context.Context {
+	return context.WithValue(ctx, contentTypeKey, typ)
+}
+
+func contentTypeFrom(ctx context.Context) string {
+	typ, _ := ctx.Value(contentTypeKey).(string)
+	return typ
+}
+
+// PUT
+//
+// putKeyHandler stores the raw request body under the key, whatever it
+// contains, and remembers its Content-Type so that GET returns the same
+// bytes with the same type. The body, chunked or not, is copied straight
+// into the value without an intermediate buffer, and bodies over
+// MaxValueSize are cut off as soon as the limit is crossed.
+//
+// With ?mode=create or If-None-Match: * the write only succeeds if the key
+// does not exist yet, and fails with 409 otherwise; the check and the set
+// are one atomic step.
+func (s *Server) putKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	ctx := r.Context()
+	switch mode := r.URL.Query().Get("mode"); {
+	case mode == "create" || r.Header.Get("If-None-Match") == "*":
+		ctx = withCreateOnly(ctx)
+	case mode != "":
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "mode must be create")
+		return
+	}
+	key := r.PathValue("key")
+	tooLarge := &KeyError{Op: "set", Key: key, Err: ErrValueTooLarge}
+	body := r.Body
+	if max := s.cfg.MaxValueSize; max > 0 {
+		if r.ContentLength > max {
+			writeStoreError(w, r, tooLarge)
+			return
+		}
+		body = http.MaxBytesReader(w, r.Body, max)
+	}
+	var value strings.Builder
+	if r.ContentLength > 0 {
+		value.Grow(int(r.ContentLength))
+	}
+	if _, err := io.Copy(&value, s.streamDeadlines(w).reader(body)); err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			writeStoreError(w, r, tooLarge)
+		} else {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Could not read request body")
+		}
+		return
+	}
+	typ := r.Header.Get("Content-Type")
+	if typ == "" {
+		typ = defaultContentType
+	}
+	if err := s.setKey(withContentType(ctx, typ), key, value.String()); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "success"})
+}
+
+// writeRawValue sends a value stored by PUT as-is, with its content type.
+// The value is streamed from the stored string without copying it, and
+// Range requests are honoured so large values can be fetched in parts or
+// resumed.
+func writeRawValue(w http.ResponseWriter, r *http.Request, typ, value string) {
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(value))
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the key filters of Config.BloomKeys.
+const (
+	defaultBloomFPRate = 0.01
+	// bloomRebuildInterval is how often filters are checked for needing a
+	// rebuild.
+	bloomRebuildInterval = 5 * time.Minute
+	// bloomRebuildDeletes is the fraction of keys deleted since a filter
+	// was built that makes it worth building again.
+	bloomRebuildDeletes = 0.1
+)
+
+// bloomFilter is a fixed-size Bloom filter safe for concurrent use
+// without locks: bits are only ever set, with atomic ORs.
+type bloomFilter struct {
+	bits  []atomic.Uint64
+	m     uint64 // number of bits
+	k     int    // hashes per key
+	seed  maphash.Seed
+	built time.Time
+	keys  int // keys the filter was sized for
+}
+
+// newBloomFilter sizes a filter for n keys at false positive rate p.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	n = max(n, 1)
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = max((m+63)/64*64, 64)
+	k := max(int(math.Round(float64(m)/float64(n)*math.Ln2)), 1)
+	return &bloomFilter{
+		bits:  make([]atomic.Uint64, m/64),
+		m:     m,
+		k:     k,
+		seed:  maphash.MakeSeed(),
+		built: time.Now(),
+		keys:  n,
+	}
+}
+
+// positions calls fn with each bit of key, derived from one 64-bit hash
+// by double hashing.
+func (f *bloomFilter) positions(key string, fn func(uint64) bool) {
+	h := maphash.String(f.seed, key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	for i := range uint64(f.k) {
+		if !fn((h1 + i*h2) % f.m) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(key string) {
+	f.positions(key, func(b uint64) bool {
+		f.bits[b/64].Or(1 << (b % 64))
+		return true
+	})
+}
+
+// mayContain is false only if key was never added.
+func (f *bloomFilter) mayContain(key string) bool {
+	found := true
+	f.positions(key, func(b uint64) bool {
+		found = f.bits[b/64].Load()&(1<<(b%64)) != 0
+		return found
+	})
+	return found
+}
+
+// fpRate estimates the current false positive rate from the share of
+// bits set.
+func (f *bloomFilter) fpRate() float64 {
+	set := 0
+	for i := range f.bits {
+		set += bits.OnesCount64(f.bits[i].Load())
+	}
+	return math.Pow(float64(set)/float64(f.m), float64(f.k))
+}
+
+// keyFilter is the Bloom filter of a namespace's keys, fed from its watch
+// hub. Deleted keys cannot be taken out of a Bloom filter, so it is
+// rebuilt from the store once enough of them have gone or the store has
+// outgrown it. While a rebuild runs, keys are added to the filter being
+// built as well, so it misses none of them.
+type keyFilter struct {
+	n int // the configured number of keys
+	p float64
+
+	cur      atomic.Pointer[bloomFilter]
+	next     atomic.Pointer[bloomFilter]
+	deletes  atomic.Int64 // since cur was built
+	rebuilds atomic.Int64
+	probes   atomic.Uint64
+	maybes   atomic.Uint64
+}
+
+func newKeyFilter(n int, p float64, store Store) *keyFilter {
+	if p <= 0 || p >= 1 {
+		p = defaultBloomFPRate
+	}
+	kf := &keyFilter{n: n, p: p}
+	kf.rebuild(store)
+	return kf
+}
+
+// apply is a watchHub listener.
+func (kf *keyFilter) apply(ev Event) {
+	if ev.Type == "delete" {
+		kf.deletes.Add(1)
+		return
+	}
+	kf.cur.Load().add(ev.Key)
+	if next := kf.next.Load(); next != nil {
+		next.add(ev.Key)
+	}
+}
+
+// mayContain is false only if key is certainly not in the namespace.
+func (kf *keyFilter) mayContain(key string) bool {
+	kf.probes.Add(1)
+	ok := kf.cur.Load().mayContain(key)
+	if ok {
+		kf.maybes.Add(1)
+	}
+	return ok
+}
+
+// stale reports whether the filter should be rebuilt for a store holding
+// size keys.
+func (kf *keyFilter) stale(size int) bool {
+	cur := kf.cur.Load()
+	return float64(kf.deletes.Load()) > bloomRebuildDeletes*float64(max(size, 1)) || size > cur.keys
+}
+
+// rebuild builds a new filter from the keys in store, sized for the
+// configured number of keys or twice as many as there are, and swaps it
+// in. Rebuilds are run by one goroutine at a time.
+func (kf *keyFilter) rebuild(store Store) {
+	nf := newBloomFilter(max(kf.n, 2*store.Len()), kf.p)
+	kf.cur.CompareAndSwap(nil, nf)
+	// Keys set from here on go to nf too; the snapshot, taken after, has
+	// every key set before.
+	kf.next.Store(nf)
+	kf.deletes.Store(0)
+	snap := store.Snapshot()
+	for _, k := range snap.Between("", "") {
+		nf.add(k)
+	}
+	kf.cur.Store(nf)
+	kf.next.Store(nil)
+	kf.rebuilds.Add(1)
+}
+
+func (kf *keyFilter) stats() map[string]interface{} {
+	cur := kf.cur.Load()
+	return map[string]interface{}{
+		"bits":        cur.m,
+		"hashes":      cur.k,
+		"capacity":    cur.keys,
+		"built":       cur.built.UTC(),
+		"deletes":     kf.deletes.Load(),
+		"rebuilds":    kf.rebuilds.Load(),
+		"probes":      kf.probes.Load(),
+		"maybe":       kf.maybes.Load(),
+		"fp_estimate": cur.fpRate(),
+	}
+}
+
+// enableBloom starts maintaining the key filter of ns if configured.
+func (nr *namespaceRegistry) enableBloom(ns *namespace) {
+	if nr.bloomKeys > 0 {
+		ns.filter = newKeyFilter(nr.bloomKeys, nr.bloomFPRate, ns.store)
+		ns.hub.addListener(ns.filter.apply)
+	}
+}
+
+// rebuildBloomFilters rebuilds the key filters that deletes or growth
+// have made stale.
+func (s *Server) rebuildBloomFilters() error {
+	for _, ns := range s.namespaces.list() {
+		if ns.filter != nil && ns.filter.stale(ns.store.Len()) {
+			ns.filter.rebuild(ns.store)
+		}
+	}
+	return nil
+}
+
+// GET
+//
+// keyExistsHandler answers whether a key exists. With a key filter it
+// asks only the filter, taking no store lock: "exists": false is certain,
+// while "exists": true is wrong at about the filter's false positive
+// rate, which "approximate" flags. Without one it looks the key up.
+func (s *Server) keyExistsHandler(w http.ResponseWriter, r *http.Request) {
+	ns := s.namespaceFrom(r.Context())
+	key := r.PathValue("key")
+	res := struct {
+		Key         string `json:"key"`
+		Exists      bool   `json:"exists"`
+		Approximate bool   `json:"approximate,omitempty"`
+	}{Key: key}
+	if ns.filter != nil {
+		res.Exists = ns.filter.mayContain(key)
+		res.Approximate = res.Exists
+	} else {
+		_, res.Exists = peekValue(ns.store, key)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
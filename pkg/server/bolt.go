@@ -0,0 +1,499 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltData = []byte("kv")
+	boltMeta = []byte("meta")
+
+	boltRevision = []byte("revision")
+	boltCount    = []byte("count")
+)
+
+// boltEntryHeader is the size of the revision and the creation and update
+// times (UnixNano) that precede a value in the kv bucket.
+const boltEntryHeader = 24
+
+// Compaction is skipped unless at least this share of the file, and this
+// many bytes, are free pages.
+const (
+	boltCompactMinRatio = 0.25
+	boltCompactMinFree  = 1 << 20
+)
+
+// compactor is implemented by backends whose files keep the space of
+// deleted data until compacted. compact returns the file sizes before and
+// after; unless forced, it does nothing, returning zeroes, if compaction
+// is not worth it. freeSpace returns the size of the file and how much of
+// it compaction would reclaim.
+type compactor interface {
+	compact(force bool) (before, after int64, err error)
+	freeSpace() (size, free int64, err error)
+}
+
+// boltStore keeps keys in a bbolt B+tree file. It takes an exclusive lock
+// on the file, so only one process can have it open. Writes are serialized
+// by mu, which orders change events; reads run concurrently. The file does
+// not shrink as keys are deleted, so compact rewrites it, with dbMu held
+// exclusively to keep every other operation out meanwhile.
+//
+// As with sqliteStore, full reads copy every key into memory and access
+// counts start from zero when the file is opened.
+type boltStore struct {
+	path string
+
+	dbMu sync.RWMutex
+	db   *bolt.DB
+
+	mu  sync.Mutex
+	gen uint64 // last committed revision
+
+	snapMu  sync.Mutex
+	snap    *Snapshot
+	snapGen uint64
+
+	access   sync.Map // key -> *accessStats
+	onChange func(Event)
+}
+
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// openBoltStore opens or creates the file at path.
+func openBoltStore(path string) (*boltStore, error) {
+	if path == "" {
+		return nil, errors.New("the bolt backend requires a storage path")
+	}
+	db, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	st := &boltStore{path: path, db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltData); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+		st.gen = boltUint(meta.Get(boltRevision))
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	return st, nil
+}
+
+func boltUint(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func boltPutUint(b *bolt.Bucket, key []byte, v uint64) error {
+	return b.Put(key, binary.BigEndian.AppendUint64(nil, v))
+}
+
+// boltEntry is a decoded value of the kv bucket. value aliases the
+// transaction's memory.
+type boltEntry struct {
+	rev              uint64
+	created, updated int64
+	value            []byte
+}
+
+func decodeBoltEntry(b []byte) (boltEntry, bool) {
+	if len(b) < boltEntryHeader {
+		return boltEntry{}, false
+	}
+	return boltEntry{
+		rev:     binary.BigEndian.Uint64(b),
+		created: int64(binary.BigEndian.Uint64(b[8:])),
+		updated: int64(binary.BigEndian.Uint64(b[16:])),
+		value:   b[boltEntryHeader:],
+	}, true
+}
+
+func (e boltEntry) encode() []byte {
+	b := make([]byte, boltEntryHeader, boltEntryHeader+len(e.value))
+	binary.BigEndian.PutUint64(b, e.rev)
+	binary.BigEndian.PutUint64(b[8:], uint64(e.created))
+	binary.BigEndian.PutUint64(b[16:], uint64(e.updated))
+	return append(b, e.value...)
+}
+
+// Close closes the file.
+func (st *boltStore) Close() error {
+	st.dbMu.Lock()
+	defer st.dbMu.Unlock()
+	return st.db.Close()
+}
+
+// OnChange registers fn to be called after every committed mutation. It
+// must be set before the store is used concurrently.
+func (st *boltStore) OnChange(fn func(Event)) {
+	st.onChange = fn
+}
+
+func (st *boltStore) notify(ev Event) {
+	if st.onChange != nil {
+		ev.Time = time.Now().UTC()
+		st.onChange(ev)
+	}
+}
+
+// view runs fn in a read transaction.
+func (st *boltStore) view(fn func(data *bolt.Bucket) error) error {
+	st.dbMu.RLock()
+	defer st.dbMu.RUnlock()
+	return st.db.View(func(tx *bolt.Tx) error { return fn(tx.Bucket(boltData)) })
+}
+
+// entry reads key, with its value copied out of the transaction.
+func (st *boltStore) entry(op, key string) (boltEntry, error) {
+	var e boltEntry
+	err := st.view(func(data *bolt.Bucket) error {
+		var ok bool
+		if e, ok = decodeBoltEntry(data.Get([]byte(key))); !ok {
+			return &KeyError{Op: op, Key: key, Err: ErrKeyNotFound}
+		}
+		e.value = bytes.Clone(e.value)
+		return nil
+	})
+	return e, err
+}
+
+func (st *boltStore) Get(key string) (string, error) {
+	e, err := st.entry("get", key)
+	if err != nil {
+		return "", err
+	}
+	a, _ := st.access.LoadOrStore(key, new(accessStats))
+	a.(*accessStats).reads.Add(1)
+	a.(*accessStats).lastRead.Store(time.Now().UnixNano())
+	return string(e.value), nil
+}
+
+// Peek returns the value of key without counting a read.
+func (st *boltStore) Peek(key string) (string, error) {
+	e, err := st.entry("get", key)
+	return string(e.value), err
+}
+
+// Metadata returns the bookkeeping of key without counting it as a read.
+func (st *boltStore) Metadata(key string) (KeyMeta, error) {
+	e, err := st.entry("metadata", key)
+	if err != nil {
+		return KeyMeta{}, err
+	}
+	meta := KeyMeta{
+		CreatedAt: time.Unix(0, e.created).UTC(),
+		UpdatedAt: time.Unix(0, e.updated).UTC(),
+		Revision:  e.rev,
+		Size:      len(e.value),
+	}
+	if a, ok := st.access.Load(key); ok {
+		meta.Reads = a.(*accessStats).reads.Load()
+		if ns := a.(*accessStats).lastRead.Load(); ns != 0 {
+			meta.LastRead = time.Unix(0, ns).UTC()
+		}
+	}
+	return meta, nil
+}
+
+// LastRevision returns the revision of the latest write.
+func (st *boltStore) LastRevision() uint64 {
+	var gen uint64
+	st.dbMu.RLock()
+	defer st.dbMu.RUnlock()
+	st.db.View(func(tx *bolt.Tx) error {
+		gen = boltUint(tx.Bucket(boltMeta).Get(boltRevision))
+		return nil
+	})
+	return gen
+}
+
+// Revision returns the revision at which key was last written.
+func (st *boltStore) Revision(key string) (uint64, error) {
+	e, err := st.entry("revision", key)
+	return e.rev, err
+}
+
+// write runs fn in a write transaction with mu held. fn takes the
+// revisions of its changes from next and reports how it changed the number
+// of keys; the events it returns are published once the transaction has
+// committed.
+func (st *boltStore) write(fn func(data *bolt.Bucket, next func() uint64) (events []Event, added int, err error)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.dbMu.RLock()
+	defer st.dbMu.RUnlock()
+	gen := st.gen
+	var events []Event
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		var added int
+		var err error
+		events, added, err = fn(tx.Bucket(boltData), func() uint64 { gen++; return gen })
+		if err != nil || gen == st.gen {
+			return err
+		}
+		meta := tx.Bucket(boltMeta)
+		if err := boltPutUint(meta, boltRevision, gen); err != nil {
+			return err
+		}
+		return boltPutUint(meta, boltCount, uint64(int64(boltUint(meta.Get(boltCount)))+int64(added)))
+	})
+	if err != nil {
+		return err
+	}
+	st.gen = gen
+	for _, ev := range events {
+		st.notify(ev)
+	}
+	return nil
+}
+
+func (st *boltStore) Set(key, value string) error {
+	_, _, err := st.set(key, value, false)
+	return err
+}
+
+// Create sets key only if it is absent.
+func (st *boltStore) Create(key, value string) error {
+	_, _, err := st.set(key, value, true)
+	return err
+}
+
+// Swap sets key and returns the value it replaced.
+func (st *boltStore) Swap(key, value string) (string, bool, error) {
+	return st.set(key, value, false)
+}
+
+func (st *boltStore) set(key, value string, create bool) (old string, existed bool, err error) {
+	err = st.write(func(data *bolt.Bucket, next func() uint64) ([]Event, int, error) {
+		now := time.Now().UnixNano()
+		e := boltEntry{created: now, updated: now, value: []byte(value)}
+		if prev, ok := decodeBoltEntry(data.Get([]byte(key))); ok {
+			if create {
+				return nil, 0, &KeyError{Op: "create", Key: key, Err: ErrKeyExists}
+			}
+			old, existed = string(prev.value), true
+			e.created = prev.created
+		}
+		e.rev = next()
+		if err := data.Put([]byte(key), e.encode()); err != nil {
+			return nil, 0, err
+		}
+		added := 1
+		if existed {
+			added = 0
+		}
+		return []Event{{Type: "set", Key: key, Value: value, Created: !existed, Revision: e.rev}}, added, nil
+	})
+	var ke *KeyError
+	if err != nil && !errors.As(err, &ke) {
+		err = &KeyError{Op: "set", Key: key, Err: err}
+	}
+	return old, existed, err
+}
+
+func (st *boltStore) Delete(key string) error {
+	_, err := st.Take(key)
+	return err
+}
+
+// Take deletes key and returns its value.
+func (st *boltStore) Take(key string) (string, error) {
+	return st.take(key, false, 0)
+}
+
+// TakeAt deletes key and returns its value if it was last written at rev.
+func (st *boltStore) TakeAt(key string, rev uint64) (string, error) {
+	return st.take(key, true, rev)
+}
+
+// take deletes key, only if it was last written at rev when atRev is set.
+func (st *boltStore) take(key string, atRev bool, rev uint64) (old string, err error) {
+	err = st.write(func(data *bolt.Bucket, next func() uint64) ([]Event, int, error) {
+		prev, ok := decodeBoltEntry(data.Get([]byte(key)))
+		if !ok {
+			return nil, 0, &KeyError{Op: "delete", Key: key, Err: ErrKeyNotFound}
+		}
+		if atRev && prev.rev != rev {
+			return nil, 0, &KeyError{Op: "delete", Key: key, Err: ErrConflict}
+		}
+		old = string(prev.value)
+		if err := data.Delete([]byte(key)); err != nil {
+			return nil, 0, err
+		}
+		return []Event{{Type: "delete", Key: key, Revision: next()}}, -1, nil
+	})
+	var ke *KeyError
+	if err != nil && !errors.As(err, &ke) {
+		err = &KeyError{Op: "delete", Key: key, Err: err}
+	}
+	if err == nil {
+		st.access.Delete(key)
+	}
+	return old, err
+}
+
+// ClearPrefix removes the keys starting with prefix in one transaction.
+func (st *boltStore) ClearPrefix(prefix string) (map[string]string, error) {
+	removed := make(map[string]string)
+	err := st.write(func(data *bolt.Bucket, next func() uint64) ([]Event, int, error) {
+		var events []Event
+		c := data.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if e, ok := decodeBoltEntry(v); ok {
+				removed[string(k)] = string(e.value)
+			}
+			events = append(events, Event{Type: "delete", Key: string(k), Revision: next()})
+		}
+		for _, ev := range events {
+			if err := data.Delete([]byte(ev.Key)); err != nil {
+				return nil, 0, err
+			}
+		}
+		return events, -len(events), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for k := range removed {
+		st.access.Delete(k)
+	}
+	return removed, nil
+}
+
+// All returns a copy of the stored data.
+func (st *boltStore) All() map[string]string {
+	data, _ := st.load()
+	return data
+}
+
+// load reads every key, along with the revision the data is current as of.
+func (st *boltStore) load() (map[string]string, uint64) {
+	out := make(map[string]string)
+	var gen uint64
+	st.dbMu.RLock()
+	defer st.dbMu.RUnlock()
+	st.db.View(func(tx *bolt.Tx) error {
+		gen = boltUint(tx.Bucket(boltMeta).Get(boltRevision))
+		return tx.Bucket(boltData).ForEach(func(k, v []byte) error {
+			if e, ok := decodeBoltEntry(v); ok {
+				out[string(k)] = string(e.value)
+			}
+			return nil
+		})
+	})
+	return out, gen
+}
+
+func (st *boltStore) Len() int {
+	st.dbMu.RLock()
+	defer st.dbMu.RUnlock()
+	var n uint64
+	st.db.View(func(tx *bolt.Tx) error {
+		n = boltUint(tx.Bucket(boltMeta).Get(boltCount))
+		return nil
+	})
+	return int(n)
+}
+
+// Snapshot is served from a cached copy until a write has been committed
+// since it was taken.
+func (st *boltStore) Snapshot() *Snapshot {
+	st.snapMu.Lock()
+	defer st.snapMu.Unlock()
+	st.mu.Lock()
+	gen := st.gen
+	st.mu.Unlock()
+	if st.snap != nil && st.snapGen == gen {
+		return st.snap
+	}
+	data, gen := st.load()
+	st.snap = NewSnapshot(data)
+	st.snapGen = gen
+	return st.snap
+}
+
+// compact rewrites the file without its free pages, if forced or enough
+// of it is free. Every other operation waits until it is done.
+func (st *boltStore) compact(force bool) (before, after int64, err error) {
+	st.dbMu.Lock()
+	defer st.dbMu.Unlock()
+	fi, err := os.Stat(st.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	free := int64(st.db.Stats().FreeAlloc)
+	if !force && (free < boltCompactMinFree || float64(free) < boltCompactMinRatio*float64(fi.Size())) {
+		return 0, 0, nil
+	}
+
+	tmp := st.path + ".compact"
+	os.Remove(tmp)
+	dst, err := openBolt(tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := bolt.Compact(dst, st.db, 64<<20); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return 0, 0, fmt.Errorf("compact %s: %w", st.path, err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	if err := st.db.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	// Whatever happens from here, st.db must end up open again.
+	if err = os.Rename(tmp, st.path); err != nil {
+		os.Remove(tmp)
+	}
+	db, openErr := openBolt(st.path)
+	if openErr != nil {
+		return 0, 0, fmt.Errorf("reopen after compaction: %w", openErr)
+	}
+	st.db = db
+	if err != nil {
+		return 0, 0, err
+	}
+	if fi2, err := os.Stat(st.path); err == nil {
+		after = fi2.Size()
+	}
+	return fi.Size(), after, nil
+}
+
+func (st *boltStore) freeSpace() (size, free int64, err error) {
+	st.dbMu.RLock()
+	defer st.dbMu.RUnlock()
+	fi, err := os.Stat(st.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return fi.Size(), int64(st.db.Stats().FreeAlloc), nil
+}
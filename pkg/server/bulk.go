@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// bulkAckEvery is how many records are received between
+	// acknowledgements.
+	bulkAckEvery = 1000
+
+	// Records are staged in memory until the commit, so a load is limited
+	// to bulkMaxEntries records in a body of at most bulkMaxBytes.
+	bulkMaxEntries = 1_000_000
+	bulkMaxBytes   = 256 << 20
+)
+
+// bulkRecord is one line of a bulk load stream. Op is "set" (the default),
+// "delete", or one of the terminators "commit" and "abort".
+type bulkRecord struct {
+	Op    string `json:"op,omitempty"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+type bulkAck struct {
+	Status   string `json:"status"`
+	Received int    `json:"received"`
+	Applied  int    `json:"applied,omitempty"`
+	// RolledBack counts the records of a failed commit that were applied
+	// and then undone.
+	RolledBack int    `json:"rolled_back,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// POST
+//
+// bulkLoadHandler accepts a newline-delimited JSON stream of records in a
+// single request. Records are staged as they arrive and a progress line is
+// streamed back every bulkAckEvery records. Nothing touches the store until
+// the client sends {"op":"commit"}; {"op":"abort"}, a stream that ends
+// without a commit or one over bulkMaxEntries or bulkMaxBytes discards
+// everything. A commit applies all of the records or, failing part way,
+// none of them; see applyBulk.
+func (s *Server) bulkLoadHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+
+	// Acks are written while the body is still being read.
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+	dl := s.streamDeadlines(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(dl.writer(w))
+	ack := func(a bulkAck) {
+		enc.Encode(a)
+		rc.Flush()
+	}
+	abort := func(received int, err error) {
+		s.incrementError(r.Context())
+		ack(bulkAck{Status: "aborted", Received: received, Error: err.Error()})
+	}
+
+	var staged []bulkRecord
+	body := http.MaxBytesReader(w, r.Body, bulkMaxBytes)
+	dec := json.NewDecoder(bufio.NewReader(dl.reader(body)))
+	for {
+		var rec bulkRecord
+		if err := dec.Decode(&rec); err != nil {
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				err = fmt.Errorf("stream is over %d bytes", bulkMaxBytes)
+			} else {
+				err = fmt.Errorf("stream ended without commit: %v", err)
+			}
+			abort(len(staged), fmt.Errorf("record %d: %w", len(staged)+1, err))
+			return
+		}
+
+		switch rec.Op {
+		case "", "set", "delete":
+			if rec.Key == "" {
+				abort(len(staged), fmt.Errorf("record %d: missing key", len(staged)+1))
+				return
+			}
+			if len(staged) == bulkMaxEntries {
+				abort(len(staged), fmt.Errorf("record %d: stream is over %d records", len(staged)+1, bulkMaxEntries))
+				return
+			}
+			rec.Key = s.keyRules.canonical(rec.Key)
+			staged = append(staged, rec)
+			if len(staged)%bulkAckEvery == 0 {
+				ack(bulkAck{Status: "receiving", Received: len(staged)})
+			}
+			continue
+		case "abort":
+			ack(bulkAck{Status: "aborted", Received: len(staged)})
+			return
+		case "commit":
+		default:
+			abort(len(staged), fmt.Errorf("record %d: unknown op %q", len(staged)+1, rec.Op))
+			return
+		}
+
+		applied, rolledBack, err := s.applyBulk(r, staged)
+		if err != nil {
+			s.incrementError(r.Context())
+			ack(bulkAck{Status: "failed", Received: len(staged), Applied: applied, RolledBack: rolledBack, Error: err.Error()})
+			return
+		}
+		ack(bulkAck{Status: "committed", Received: len(staged), Applied: applied})
+		return
+	}
+}
+
+// bulkUndo is what a key held before a bulk record was applied to it.
+type bulkUndo struct {
+	key, value, typ string
+	existed         bool
+	tags            []string
+	expiry          *keyExpiry
+}
+
+// applyBulk validates and then applies staged records. If one fails, the
+// ones before it are undone, last first, by putting back what their keys
+// held before, and the number undone is returned with the error; only if
+// undoing fails too are any left applied, and counted. Other writers are
+// not held off meanwhile: a key one of them sets between the record and
+// the undo gets the value from before the record back.
+func (s *Server) applyBulk(r *http.Request, staged []bulkRecord) (applied, rolledBack int, err error) {
+	if err := s.writesAllowed(); err != nil {
+		return 0, 0, err
+	}
+	for _, rec := range staged {
+		op := rec.Op
+		if op == "" {
+			op = "set"
+		}
+		if err := s.validateWrite(r.Context(), op, rec.Key, rec.Value); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	ns := s.namespaceFrom(r.Context())
+	undo := make([]bulkUndo, 0, len(staged))
+	for _, rec := range staged {
+		u := bulkUndo{key: rec.Key, typ: ns.types.get(rec.Key), tags: ns.tags.get(rec.Key), expiry: ns.expiries.get(rec.Key)}
+		u.value, u.existed = peekValue(ns.store, rec.Key)
+		var err error
+		if rec.Op == "delete" {
+			err = s.applyDelete(r.Context(), ns, rec.Key)
+			if errors.Is(err, ErrKeyNotFound) {
+				err = nil
+			}
+		} else {
+			err = s.applySet(r.Context(), ns, rec.Key, rec.Value)
+		}
+		if err != nil {
+			return s.undoBulk(r.Context(), ns, undo, err)
+		}
+		undo = append(undo, u)
+	}
+	return len(staged), 0, nil
+}
+
+// undoBulk puts back the keys of undo, last first, after a bulk commit
+// failed with cause. It carries on if the client has gone away meanwhile.
+func (s *Server) undoBulk(ctx context.Context, ns *namespace, undo []bulkUndo, cause error) (applied, rolledBack int, err error) {
+	ctx = context.WithoutCancel(ctx)
+	for i := len(undo) - 1; i >= 0; i-- {
+		u := undo[i]
+		var err error
+		if u.existed {
+			uctx := withTags(withExpiry(withContentType(withStoredValue(ctx), u.typ), u.expiry), u.tags)
+			err = s.applySet(uctx, ns, u.key, u.value)
+		} else if err = s.applyDelete(ctx, ns, u.key); errors.Is(err, ErrKeyNotFound) {
+			err = nil
+		}
+		if err != nil {
+			s.logger.Printf("[Bulk] Rolling back %d records left %d applied: %v", len(undo), i+1, err)
+			return i + 1, len(undo) - i - 1, fmt.Errorf("%w; rolling back: %v", cause, err)
+		}
+	}
+	return 0, len(undo), cause
+}
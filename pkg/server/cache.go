@@ -0,0 +1,398 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCacheSize is the capacity of the cache in front of a disk backend.
+const defaultCacheSize = 64 << 20
+
+// cacheStats is the "cache" entry of /stats.
+type cacheStats struct {
+	Capacity  int64   `json:"capacity"`
+	Bytes     int64   `json:"bytes"`
+	Entries   int     `json:"entries"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Evictions uint64  `json:"evictions"`
+	HitRatio  float64 `json:"hit_ratio"`
+	// StaleHits are the hits served past the cache TTL while the value was
+	// refreshed; they are counted in Hits too.
+	StaleHits       uint64 `json:"stale_hits,omitempty"`
+	Refreshes       uint64 `json:"refreshes,omitempty"`
+	RefreshFailures uint64 `json:"refresh_failures,omitempty"`
+}
+
+// cacheEntry is a cached value and when it was read from, or written to,
+// the backend.
+type cacheEntry struct {
+	value  string
+	loaded time.Time
+}
+
+// cacheRead is how the cache answered a read, for the response headers of
+// GET /data/{key}.
+type cacheRead struct {
+	status string // "HIT", "STALE" or "MISS"
+	loaded time.Time
+	// bypass is set by the reader for a read that must not be stale.
+	bypass bool
+}
+
+// withCacheRead returns ctx carrying r, which the cache fills in when it
+// serves a read made with the returned context.
+func withCacheRead(ctx context.Context, r *cacheRead) context.Context {
+	return context.WithValue(ctx, cacheReadKey, r)
+}
+
+func cacheReadFrom(ctx context.Context) *cacheRead {
+	r, _ := ctx.Value(cacheReadKey).(*cacheRead)
+	return r
+}
+
+// cacheStore keeps the most recently used values of a disk backend in
+// memory, up to capacity bytes of keys and values. Reads are served from
+// the cache when they can and fill it when they miss; writes go to the
+// backend and then to the cache. Writes are serialized by wmu, so the cache
+// sees them in the order the backend committed them, and a read only fills
+// the cache if no write has happened since it started, so it cannot put
+// back a value that was just overwritten.
+//
+// Reads served from the cache are not counted in the backend's access
+// statistics.
+//
+// With a ttl, an entry is trusted for that long after it was loaded, for a
+// backend that is also written by others, such as a database file shared
+// between servers; after that a read goes to the backend again. Within
+// stale more, the entry is served as it is while one read in the
+// background refreshes it, so a slow backend does not hold up the reads of
+// hot keys; past it, the read waits for the backend.
+type cacheStore struct {
+	Store
+	capacity   int64
+	ttl, stale time.Duration
+
+	wmu sync.Mutex
+
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	lru        *lruPolicy
+	bytes      int64
+	writes     uint64
+	refreshing map[string]bool
+
+	hits, misses, evictions               uint64
+	staleHits, refreshes, refreshFailures uint64
+}
+
+func newCacheStore(inner Store, capacity int64, ttl, stale time.Duration) *cacheStore {
+	return &cacheStore{
+		Store:      inner,
+		capacity:   capacity,
+		ttl:        ttl,
+		stale:      stale,
+		entries:    make(map[string]cacheEntry),
+		lru:        newLRUPolicy(),
+		refreshing: make(map[string]bool),
+	}
+}
+
+func (cs *cacheStore) Get(key string) (string, error) {
+	return cs.GetContext(context.Background(), key)
+}
+
+// GetContext reads key from the cache or, failing that, the backend.
+func (cs *cacheStore) GetContext(ctx context.Context, key string) (string, error) {
+	read := cacheReadFrom(ctx)
+	cs.mu.Lock()
+	if e, ok := cs.entries[key]; ok {
+		age := time.Since(e.loaded)
+		switch {
+		case cs.ttl <= 0 || age < cs.ttl:
+			cs.hits++
+			cs.lru.touch(key)
+			cs.mu.Unlock()
+			read.set("HIT", e.loaded)
+			return e.value, nil
+		case age < cs.ttl+cs.stale && !read.noCache():
+			cs.hits++
+			cs.staleHits++
+			cs.lru.touch(key)
+			if !cs.refreshing[key] {
+				cs.refreshing[key] = true
+				cs.refreshes++
+				go cs.refresh(key, cs.writes)
+			}
+			cs.mu.Unlock()
+			read.set("STALE", e.loaded)
+			return e.value, nil
+		}
+	}
+	cs.misses++
+	writes := cs.writes
+	cs.mu.Unlock()
+	read.set("MISS", time.Time{})
+
+	v, err := forwardGet(ctx, cs.Store, key)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			cs.forget(key, writes)
+		}
+		return "", err
+	}
+	cs.mu.Lock()
+	if cs.writes == writes {
+		cs.putLocked(key, v)
+	}
+	cs.mu.Unlock()
+	return v, nil
+}
+
+// refresh reads key from the backend in the background to replace its
+// stale entry, unless a write has happened since writes. A key that is
+// gone is dropped; on other errors the stale entry stays, to be served
+// until it is too old.
+func (cs *cacheStore) refresh(key string, writes uint64) {
+	v, err := getValue(context.Background(), cs.Store, key)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.refreshing, key)
+	switch {
+	case err == nil:
+		if cs.writes == writes {
+			cs.putLocked(key, v)
+		}
+	case errors.Is(err, ErrKeyNotFound):
+		if cs.writes == writes {
+			cs.removeLocked(key)
+		}
+	default:
+		cs.refreshFailures++
+	}
+}
+
+// forget drops the entry of a key the backend no longer has, unless a
+// write has happened since writes.
+func (cs *cacheStore) forget(key string, writes uint64) {
+	cs.mu.Lock()
+	if cs.writes == writes {
+		cs.removeLocked(key)
+	}
+	cs.mu.Unlock()
+}
+
+// Peek reads key without counting a read or filling the cache.
+func (cs *cacheStore) Peek(key string) (string, error) {
+	cs.mu.Lock()
+	e, ok := cs.entries[key]
+	cs.mu.Unlock()
+	if ok && (cs.ttl <= 0 || time.Since(e.loaded) < cs.ttl+cs.stale) {
+		return e.value, nil
+	}
+	if v, ok := peekValue(cs.Store, key); ok {
+		return v, nil
+	}
+	return "", &KeyError{Op: "get", Key: key, Err: ErrKeyNotFound}
+}
+
+// putLocked caches value under key, evicting the least recently used
+// entries to make room. Values too big for the cache are not kept.
+func (cs *cacheStore) putLocked(key, value string) {
+	cs.removeLocked(key)
+	size := entrySize(key, value)
+	if size > cs.capacity {
+		return
+	}
+	cs.entries[key] = cacheEntry{value: value, loaded: time.Now()}
+	cs.lru.add(key)
+	cs.bytes += size
+	for cs.bytes > cs.capacity {
+		victim, ok := cs.lru.victim()
+		if !ok {
+			break
+		}
+		cs.removeLocked(victim)
+		cs.evictions++
+	}
+}
+
+func (cs *cacheStore) removeLocked(key string) {
+	if e, ok := cs.entries[key]; ok {
+		delete(cs.entries, key)
+		cs.lru.remove(key)
+		cs.bytes -= entrySize(key, e.value)
+	}
+}
+
+// write performs a write to the backend and applies its outcome to the
+// cache: the value key now holds, or none if the key was removed or the
+// write failed.
+func (cs *cacheStore) write(key string, do func() (value string, present bool, err error)) error {
+	cs.wmu.Lock()
+	defer cs.wmu.Unlock()
+	value, present, err := do()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.writes++
+	if err == nil && present {
+		cs.putLocked(key, value)
+	} else {
+		cs.removeLocked(key)
+	}
+	return err
+}
+
+func (cs *cacheStore) Set(key, value string) error {
+	return cs.write(key, func() (string, bool, error) {
+		return value, true, cs.Store.Set(key, value)
+	})
+}
+
+// Create sets key only if it is absent.
+func (cs *cacheStore) Create(key, value string) error {
+	return cs.write(key, func() (string, bool, error) {
+		return value, true, createValue(cs.Store, key, value)
+	})
+}
+
+// Swap sets key and returns the value it replaced.
+func (cs *cacheStore) Swap(key, value string) (old string, existed bool, err error) {
+	err = cs.write(key, func() (string, bool, error) {
+		var err error
+		old, existed, err = swapValue(cs.Store, key, value)
+		return value, true, err
+	})
+	return old, existed, err
+}
+
+func (cs *cacheStore) Delete(key string) error {
+	return cs.write(key, func() (string, bool, error) {
+		return "", false, cs.Store.Delete(key)
+	})
+}
+
+// Take deletes key and returns its value.
+func (cs *cacheStore) Take(key string) (old string, err error) {
+	err = cs.write(key, func() (string, bool, error) {
+		var err error
+		old, err = takeValue(cs.Store, key)
+		return "", false, err
+	})
+	return old, err
+}
+
+// TakeAt deletes key and returns its value if it was last written at rev.
+func (cs *cacheStore) TakeAt(key string, rev uint64) (old string, err error) {
+	err = cs.write(key, func() (string, bool, error) {
+		var err error
+		old, err = takeValueAt(cs.Store, key, rev)
+		return "", false, err
+	})
+	return old, err
+}
+
+// ClearPrefix removes the keys starting with prefix from the backend and
+// the cache.
+func (cs *cacheStore) ClearPrefix(prefix string) (map[string]string, error) {
+	cs.wmu.Lock()
+	defer cs.wmu.Unlock()
+	removed, err := clearPrefix(cs.Store, prefix)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.writes++
+	for k := range cs.entries {
+		if strings.HasPrefix(k, prefix) {
+			cs.removeLocked(k)
+		}
+	}
+	return removed, err
+}
+
+// OnChange forwards to the backend.
+func (cs *cacheStore) OnChange(fn func(Event)) {
+	if n, ok := cs.Store.(changeNotifier); ok {
+		n.OnChange(fn)
+	}
+}
+
+// LastRevision forwards to the backend when it numbers its writes.
+func (cs *cacheStore) LastRevision() uint64 {
+	if rc, ok := cs.Store.(revisionCounter); ok {
+		return rc.LastRevision()
+	}
+	return 0
+}
+
+// Revision forwards to the backend when it tracks revisions.
+func (cs *cacheStore) Revision(key string) (uint64, error) {
+	if rv, ok := cs.Store.(keyRevisioner); ok {
+		return rv.Revision(key)
+	}
+	return 0, &KeyError{Op: "revision", Key: key, Err: ErrKeyNotFound}
+}
+
+// Metadata forwards to the backend when it tracks metadata.
+func (cs *cacheStore) Metadata(key string) (KeyMeta, error) {
+	if mp, ok := cs.Store.(metadataProvider); ok {
+		return mp.Metadata(key)
+	}
+	return KeyMeta{}, &KeyError{Op: "metadata", Key: key, Err: ErrKeyNotFound}
+}
+
+func (cs *cacheStore) stats() cacheStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	st := cacheStats{
+		Capacity:  cs.capacity,
+		Bytes:     cs.bytes,
+		Entries:   len(cs.entries),
+		Hits:      cs.hits,
+		Misses:    cs.misses,
+		Evictions: cs.evictions,
+
+		StaleHits:       cs.staleHits,
+		Refreshes:       cs.refreshes,
+		RefreshFailures: cs.refreshFailures,
+	}
+	if n := cs.hits + cs.misses; n > 0 {
+		st.HitRatio = float64(cs.hits) / float64(n)
+	}
+	return st
+}
+
+func (r *cacheRead) set(status string, loaded time.Time) {
+	if r != nil {
+		r.status, r.loaded = status, loaded
+	}
+}
+
+// noCache reports whether the client asked, with Cache-Control: no-cache,
+// for a value the backend vouches for rather than a stale one.
+func (r *cacheRead) noCache() bool {
+	return r != nil && r.bypass
+}
+
+// writeCacheHeaders describes how the cache answered a read: X-Cache is
+// HIT, STALE or MISS, Age is the seconds since a cached value was loaded
+// from the backend, and with a cache TTL, X-Cache-Max-Stale is the bound
+// on the age of any value served, TTL plus the stale-while-revalidate
+// window.
+func (cs *cacheStore) writeCacheHeaders(w http.ResponseWriter, r *cacheRead) {
+	if r.status == "" {
+		return
+	}
+	h := w.Header()
+	h.Set("X-Cache", r.status)
+	if !r.loaded.IsZero() {
+		h.Set("Age", strconv.Itoa(int(time.Since(r.loaded).Seconds())))
+	}
+	if cs.ttl > 0 {
+		h.Set("X-Cache-Max-Stale", strconv.Itoa(int((cs.ttl + cs.stale).Seconds())))
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// changesPage is the GET /changes response. Next is the since to ask for
+// the following page with; it can be past the last event returned when a
+// namespace filter skipped some.
+type changesPage struct {
+	Epoch  string      `json:"epoch"`
+	Events []replEntry `json:"events"`
+	Next   uint64      `json:"next"`
+	Head   uint64      `json:"head"`
+}
+
+// GET
+//
+// changesHandler returns, in order, up to ?limit (default 100, max 1000)
+// of the mutations with sequence numbers after ?since. The numbers are
+// global across namespaces; on /ns/{namespace}/changes only that
+// namespace's events are returned. A consumer that passes the epoch of
+// its last page, or asks for changes the backlog no longer holds, gets
+// 410 when it has missed events and must start over from an export.
+func (s *Server) changesHandler(w http.ResponseWriter, r *http.Request) {
+	rl := s.namespaces.replication
+	if rl == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "The change log is not enabled")
+		return
+	}
+	q := r.URL.Query()
+	var since uint64
+	if v := q.Get("since"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "since must be a sequence number")
+			return
+		}
+		since = n
+	}
+	limit := defaultChangesLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid limit")
+			return
+		}
+		limit = min(n, maxChangesLimit)
+	}
+	if epoch := q.Get("epoch"); epoch != "" && epoch != rl.epoch {
+		writeError(w, r, http.StatusGone, codeResyncRequired, "The server has restarted since that epoch; changes were lost")
+		return
+	}
+	entries, head, _, err := rl.since(since + 1)
+	if err != nil {
+		writeError(w, r, http.StatusGone, codeResyncRequired, "Changes after that sequence number are no longer retained")
+		return
+	}
+
+	var ns string
+	if r.PathValue("namespace") != "" {
+		ns = s.namespaceFrom(r.Context()).name
+	}
+	page := changesPage{Epoch: rl.epoch, Events: []replEntry{}, Next: since, Head: head}
+	for _, e := range entries {
+		if len(page.Events) == limit {
+			break
+		}
+		page.Next = e.Seq
+		if ns == "" || e.NS == ns {
+			page.Events = append(page.Events, e)
+		}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
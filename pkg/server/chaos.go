@@ -0,0 +1,249 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// chaosAnyRoute is the rule key matching every route without a rule of
+// its own, other than the /admin routes.
+const chaosAnyRoute = "*"
+
+// chaosRule is the fault injected into one route. Each request is delayed
+// by Latency plus up to Jitter, then fails with a 500 with probability
+// ErrorRate before it is handled. A write that gets past that is applied
+// but answered with a 500 anyway with probability PartialWriteRate, so
+// clients see a failure for a write that happened.
+type chaosRule struct {
+	Latency          time.Duration
+	Jitter           time.Duration
+	ErrorRate        float64
+	PartialWriteRate float64
+}
+
+// chaosRuleJSON is how a rule is read from and shown in /admin/chaos.
+// Durations are strings such as "250ms" or numbers of seconds.
+type chaosRuleJSON struct {
+	Latency          json.RawMessage `json:"latency,omitempty"`
+	Jitter           json.RawMessage `json:"jitter,omitempty"`
+	ErrorRate        float64         `json:"error_rate"`
+	PartialWriteRate float64         `json:"partial_write_rate"`
+}
+
+func (cr chaosRule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Latency          string  `json:"latency"`
+		Jitter           string  `json:"jitter"`
+		ErrorRate        float64 `json:"error_rate"`
+		PartialWriteRate float64 `json:"partial_write_rate"`
+	}{cr.Latency.String(), cr.Jitter.String(), cr.ErrorRate, cr.PartialWriteRate})
+}
+
+func (cr *chaosRule) UnmarshalJSON(data []byte) error {
+	var in chaosRuleJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	var ok bool
+	if cr.Latency, ok = parseDurationJSON(in.Latency, 0); !ok {
+		return fmt.Errorf("latency must be a non-negative duration")
+	}
+	if cr.Jitter, ok = parseDurationJSON(in.Jitter, 0); !ok {
+		return fmt.Errorf("jitter must be a non-negative duration")
+	}
+	if in.ErrorRate < 0 || in.ErrorRate > 1 || in.PartialWriteRate < 0 || in.PartialWriteRate > 1 {
+		return fmt.Errorf("rates must be between 0 and 1")
+	}
+	cr.ErrorRate, cr.PartialWriteRate = in.ErrorRate, in.PartialWriteRate
+	return nil
+}
+
+// chaosStats counts the faults injected since the server started.
+type chaosStats struct {
+	Delayed       int64 `json:"delayed"`
+	Errors        int64 `json:"errors"`
+	PartialWrites int64 `json:"partial_writes"`
+}
+
+// chaosInjector holds the fault rules of chaos mode, by route as in
+// ConcurrencyLimits. Rules are replaced as a whole at runtime through
+// /admin/chaos; requests read them without locking.
+type chaosInjector struct {
+	rules  atomic.Pointer[map[string]chaosRule]
+	routes map[string]bool // registered routes, for checking rules
+
+	delayed, errors, partialWrites atomic.Int64
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+func newChaosInjector() *chaosInjector {
+	c := &chaosInjector{routes: make(map[string]bool), rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	c.rules.Store(&map[string]chaosRule{})
+	return c
+}
+
+func (c *chaosInjector) float64() float64 {
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	return c.rand.Float64()
+}
+
+// ruleFor returns the rule for route, falling back to the "*" rule for
+// routes outside /admin.
+func (c *chaosInjector) ruleFor(route, path string) (chaosRule, bool) {
+	rules := *c.rules.Load()
+	if cr, ok := rules[route]; ok {
+		return cr, true
+	}
+	if strings.HasPrefix(path, "/admin/") {
+		return chaosRule{}, false
+	}
+	cr, ok := rules[chaosAnyRoute]
+	return cr, ok
+}
+
+// setRules replaces the rules, rejecting ones for routes that do not
+// exist.
+func (c *chaosInjector) setRules(rules map[string]chaosRule) error {
+	for route := range rules {
+		if route != chaosAnyRoute && !c.routes[route] {
+			return fmt.Errorf("unknown route %q", route)
+		}
+	}
+	c.rules.Store(&rules)
+	return nil
+}
+
+// middleware injects the faults configured for method and path. The rule
+// is looked up on every request, so changes apply at once. Routes under
+// /ns/{namespace} share the rule of their twin.
+func (c *chaosInjector) middleware(method, path string) Middleware {
+	if rest, ok := strings.CutPrefix(path, "/ns/{namespace}"); ok && rest != "" {
+		path = rest
+	}
+	route := method + " " + path
+	c.routes[route] = true
+	write := method != http.MethodGet && method != http.MethodHead
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cr, ok := c.ruleFor(route, path)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if d := cr.Latency + time.Duration(c.float64()*float64(cr.Jitter)); d > 0 {
+				c.delayed.Add(1)
+				t := time.NewTimer(d)
+				select {
+				case <-t.C:
+				case <-r.Context().Done():
+					t.Stop()
+					return
+				}
+			}
+			if cr.ErrorRate > 0 && c.float64() < cr.ErrorRate {
+				c.errors.Add(1)
+				w.Header().Set("X-Chaos", "error")
+				writeError(w, r, http.StatusInternalServerError, codeInternal, "Injected failure (chaos mode)")
+				return
+			}
+			if write && cr.PartialWriteRate > 0 && c.float64() < cr.PartialWriteRate {
+				c.partialWrites.Add(1)
+				next.ServeHTTP(discardWriter{header: make(http.Header)}, r)
+				w.Header().Set("X-Chaos", "partial_write")
+				writeError(w, r, http.StatusInternalServerError, codeInternal, "Injected failure after the write was applied (chaos mode)")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// discardWriter swallows a response.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardWriter) WriteHeader(int)             {}
+
+// chaosStatus is the body of GET /admin/chaos.
+type chaosStatus struct {
+	Rules    map[string]chaosRule `json:"rules"`
+	Injected chaosStats           `json:"injected"`
+}
+
+func (c *chaosInjector) status() chaosStatus {
+	return chaosStatus{
+		Rules: *c.rules.Load(),
+		Injected: chaosStats{
+			Delayed:       c.delayed.Load(),
+			Errors:        c.errors.Load(),
+			PartialWrites: c.partialWrites.Load(),
+		},
+	}
+}
+
+// GET
+func (s *Server) getChaosHandler(w http.ResponseWriter, r *http.Request) {
+	if s.chaos == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Chaos mode is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.chaos.status())
+}
+
+// PUT
+//
+// putChaosHandler replaces the fault rules with the ones in the body, a
+// map from "METHOD /path" or "*" to a rule.
+func (s *Server) putChaosHandler(w http.ResponseWriter, r *http.Request) {
+	if s.chaos == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Chaos mode is not enabled")
+		return
+	}
+	var req struct {
+		Rules map[string]chaosRule `json:"rules"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid chaos rules: "+err.Error())
+		return
+	}
+	if req.Rules == nil {
+		req.Rules = map[string]chaosRule{}
+	}
+	if err := s.chaos.setRules(req.Rules); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+		return
+	}
+	routes := make([]string, 0, len(req.Rules))
+	for route := range req.Rules {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	s.logger.Printf("Chaos rules set for %s", strings.Join(routes, ", "))
+	writeJSON(w, http.StatusOK, s.chaos.status())
+}
+
+// DELETE
+//
+// deleteChaosHandler removes every fault rule.
+func (s *Server) deleteChaosHandler(w http.ResponseWriter, r *http.Request) {
+	if s.chaos == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Chaos mode is not enabled")
+		return
+	}
+	s.chaos.setRules(map[string]chaosRule{})
+	s.logger.Printf("Chaos rules cleared")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds the per-client table. Once it is full, the
+// client seen least recently makes room for a new one.
+const maxTrackedClients = 10000
+
+// clientStats are the counters of one client: an API key, shown as
+// "key:{name}", or for anonymous requests an IP address.
+type clientStats struct {
+	Client   string    `json:"client"`
+	Requests int       `json:"requests"`
+	Errors   int       `json:"errors"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// clientTable holds the counters behind /stats/clients.
+type clientTable struct {
+	mu       sync.Mutex
+	byClient map[string]*clientStats
+}
+
+func newClientTable() *clientTable {
+	return &clientTable{byClient: make(map[string]*clientStats)}
+}
+
+func (t *clientTable) record(client string, failed bool, in, out int64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cs := t.byClient[client]
+	if cs == nil {
+		if len(t.byClient) >= maxTrackedClients {
+			t.dropOldestLocked()
+		}
+		cs = &clientStats{Client: client}
+		t.byClient[client] = cs
+	}
+	if failed {
+		cs.Errors++
+	} else {
+		cs.Requests++
+	}
+	cs.BytesIn += in
+	cs.BytesOut += out
+	cs.LastSeen = now.UTC()
+}
+
+func (t *clientTable) dropOldestLocked() {
+	var oldest *clientStats
+	for _, cs := range t.byClient {
+		if oldest == nil || cs.LastSeen.Before(oldest.LastSeen) {
+			oldest = cs
+		}
+	}
+	if oldest != nil {
+		delete(t.byClient, oldest.Client)
+	}
+}
+
+// clientOrders are the ways /stats/clients can rank clients.
+var clientOrders = map[string]func(a, b *clientStats) bool{
+	"requests": func(a, b *clientStats) bool { return a.Requests+a.Errors > b.Requests+b.Errors },
+	"errors":   func(a, b *clientStats) bool { return a.Errors > b.Errors },
+	"bytes":    func(a, b *clientStats) bool { return a.BytesIn+a.BytesOut > b.BytesIn+b.BytesOut },
+}
+
+// top returns the n clients ranked first by less, and how many clients
+// are tracked.
+func (t *clientTable) top(n int, less func(a, b *clientStats) bool) ([]clientStats, int) {
+	t.mu.Lock()
+	all := make([]*clientStats, 0, len(t.byClient))
+	for _, cs := range t.byClient {
+		all = append(all, cs)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if less(all[i], all[j]) != less(all[j], all[i]) {
+			return less(all[i], all[j])
+		}
+		return all[i].Client < all[j].Client
+	})
+	out := make([]clientStats, 0, min(n, len(all)))
+	for _, cs := range all[:min(n, len(all))] {
+		out = append(out, *cs)
+	}
+	t.mu.Unlock()
+	return out, len(all)
+}
+
+func (t *clientTable) reset() {
+	t.mu.Lock()
+	t.byClient = make(map[string]*clientStats)
+	t.mu.Unlock()
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// GET
+//
+// clientStatsHandler returns the clients that sent the most traffic since
+// the last stats reset: the top ?n (default 10) by ?sort, which is
+// requests (the default), errors or bytes.
+func (s *Server) clientStatsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	n := 10
+	if v := q.Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "n must be a positive integer")
+			return
+		}
+	}
+	order := q.Get("sort")
+	if order == "" {
+		order = "requests"
+	}
+	less, ok := clientOrders[order]
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "sort must be requests, errors or bytes")
+		return
+	}
+	top, tracked := s.clients.top(n, less)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clients": top, "tracked": tracked, "sort": order})
+}
@@ -0,0 +1,36 @@
+package server
+
+import "time"
+
+// Clock is the time source of key TTLs, the background jobs, rate limiting
+// and the stats snapshots rates are computed over. New uses SystemClock
+// unless WithClock gives another, such as servertest.FakeClock, with which
+// tests move time on as they need instead of sleeping through it.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a timer that fires once d has passed on the clock.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single-shot timer of a Clock, like time.Timer.
+type Timer interface {
+	// C delivers the time the timer fired at.
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// SystemClock is the real time of the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time        { return t.t.C }
+func (t systemTimer) Stop() bool                 { return t.t.Stop() }
+func (t systemTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// cloneResult is the body of POST /ns/{namespace}/clone.
+type cloneResult struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	URL    string `json:"url,omitempty"`
+	importProgress
+}
+
+// POST
+//
+// cloneNamespaceHandler copies the namespace, or with prefix only the keys
+// under it, into the namespace target, as GET export piped into POST
+// import would: from a consistent snapshot, in the import mode given
+// (merge, replace or missing; default merge), leaving out keys whose tags
+// are not exported. With url the target is on that server, reached with
+// api_key as a Bearer token, and the export is streamed to its import
+// endpoint; otherwise it is a namespace here, created if need be, and
+// must differ from the source. It answers with the import's summary.
+func (s *Server) cloneNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+		URL    string `json:"url"`
+		APIKey string `json:"api_key"`
+		Prefix string `json:"prefix"`
+		Mode   string `json:"mode"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	switch req.Mode {
+	case "":
+		req.Mode = "merge"
+	case "merge", "replace", "missing":
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "mode must be merge, replace or missing")
+		return
+	}
+	if !namespaceNameRE.MatchString(req.Target) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "target must be a valid namespace name")
+		return
+	}
+	src := s.namespaceFrom(r.Context())
+	if req.URL == "" && req.Target == src.name {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "target must differ from the source namespace")
+		return
+	}
+	if req.URL != "" && !strings.HasPrefix(req.URL, "http://") && !strings.HasPrefix(req.URL, "https://") {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "url must be an http(s) URL")
+		return
+	}
+
+	snap := src.snapshot()
+	if req.Prefix != "" {
+		snap = snap.narrow(snap.Between(req.Prefix, prefixEnd(req.Prefix)))
+	}
+	snap = visible(snap, s.hiddenKeys(r.Context(), src, true))
+	res := cloneResult{Source: src.name, Target: req.Target, URL: req.URL}
+
+	if req.URL != "" {
+		p, err := s.cloneRemote(r.Context(), snap, req.URL, req.Target, req.APIKey, req.Mode)
+		if err != nil {
+			writeError(w, r, http.StatusBadGateway, codeInternal, "Clone to "+req.URL+": "+err.Error())
+			return
+		}
+		res.importProgress = p
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	if !s.checkWritable(w, r) {
+		return
+	}
+	dst := s.namespaces.get(req.Target, true)
+	entries := make([]snapshotEntry, 0, snap.Len())
+	snap.Range(func(k, v string) bool {
+		entries = append(entries, snap.entry(k, v))
+		return true
+	})
+	p, err := s.importEntries(context.WithValue(r.Context(), namespaceKey, dst), sliceEntries(entries), req.Mode, nil)
+	res.importProgress = p
+	if err != nil {
+		writeError(w, r, statusForError(err), codeForError(err), "Clone into "+req.Target+": "+err.Error())
+		return
+	}
+	s.logger.Printf("Cloned %d keys from namespace %s to %s", p.Received, src.name, req.Target)
+	writeJSON(w, http.StatusOK, res)
+}
+
+// cloneRemote streams snap to the import endpoint of namespace target on
+// the server at base, returning the summary it answers with.
+func (s *Server) cloneRemote(ctx context.Context, snap *Snapshot, base, target, apiKey, mode string) (importProgress, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(pw)
+		writeSnapshot(bw, snap)
+		pw.CloseWithError(bw.Flush())
+	}()
+	u := strings.TrimSuffix(base, "/") + apiPrefix + "/ns/" + url.PathEscape(target) + "/import?mode=" + url.QueryEscape(mode)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, pr)
+	if err != nil {
+		pr.Close()
+		return importProgress{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return importProgress{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e errorBody
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error.Message != "" {
+			return importProgress{}, fmt.Errorf("%s: %s", resp.Status, e.Error.Message)
+		}
+		return importProgress{}, errors.New(resp.Status)
+	}
+	// The import streams progress lines; the last is the summary.
+	var last importProgress
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var p importProgress
+		if err := dec.Decode(&p); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return last, err
+		}
+		last = p
+	}
+	if last.Status != "done" {
+		return last, fmt.Errorf("import %s: %s", last.Status, last.Error)
+	}
+	return last, nil
+}
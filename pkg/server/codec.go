@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/kvpb"
+)
+
+// bodyFormat is an encoding the data endpoints can exchange bodies in.
+// JSON is the default; clients pick another with Content-Type for request
+// bodies and Accept for responses. Error responses are always JSON.
+type bodyFormat int
+
+const (
+	formatJSON bodyFormat = iota
+	formatMsgpack
+	formatProtobuf
+)
+
+const (
+	msgpackContentType  = "application/msgpack"
+	protobufContentType = "application/x-protobuf"
+)
+
+// Protobuf bodies reuse the gRPC API's messages: POST /data takes a
+// BatchSetRequest and answers with a BatchSetResponse, GET /data answers
+// with a BatchGetResponse and GET /data/{key} with a GetResponse.
+
+// parseFormat maps a media type, ignoring parameters, to a format.
+func parseFormat(mediaType string) (bodyFormat, bool) {
+	mt, _, _ := strings.Cut(mediaType, ";")
+	switch strings.ToLower(strings.TrimSpace(mt)) {
+	case "application/json":
+		return formatJSON, true
+	case msgpackContentType, "application/x-msgpack", "application/vnd.msgpack":
+		return formatMsgpack, true
+	case protobufContentType, "application/protobuf", "application/vnd.google.protobuf":
+		return formatProtobuf, true
+	}
+	return formatJSON, false
+}
+
+// requestFormat returns the format of the request body. Unknown or missing
+// content types are read as JSON, as they always have been.
+func requestFormat(r *http.Request) bodyFormat {
+	f, _ := parseFormat(r.Header.Get("Content-Type"))
+	return f
+}
+
+// responseFormat returns the first format listed in the Accept header,
+// skipping those with q=0, or JSON if none is recognised.
+func responseFormat(r *http.Request) bodyFormat {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, _ := strings.Cut(part, ";")
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(v, 64); err == nil && q == 0 {
+				continue
+			}
+		}
+		if f, ok := parseFormat(mt); ok {
+			return f
+		}
+	}
+	return formatJSON
+}
+
+// decodeDataBody reads the body of POST /data in whichever format it was
+// sent. As with JSON, msgpack strings and binary values are stored as-is
+// and any other value as JSON text, or in strict mode rejected with a
+// field error.
+func decodeDataBody(r *http.Request, strict bool) (map[string]string, []fieldError, error) {
+	switch requestFormat(r) {
+	case formatMsgpack:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := decodeMsgpack(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, nil, errors.New("msgpack body must be a map")
+		}
+		out := make(map[string]string, len(m))
+		var fields []fieldError
+		for k, v := range m {
+			switch x := v.(type) {
+			case string:
+				out[k] = x
+			case []byte:
+				out[k] = string(x)
+			default:
+				if strict {
+					fields = append(fields, fieldError{Field: k, Code: fieldNotString, Reason: "value must be a string"})
+					continue
+				}
+				b, err := json.Marshal(x)
+				if err != nil {
+					return nil, nil, err
+				}
+				out[k] = string(b)
+			}
+		}
+		return out, fields, nil
+	case formatProtobuf:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		var req kvpb.BatchSetRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return nil, nil, err
+		}
+		out := make(map[string]string, len(req.GetItems()))
+		for _, item := range req.GetItems() {
+			out[item.GetKey()] = item.GetValue()
+		}
+		return out, nil, nil
+	}
+	return decodePayload(r, strict)
+}
+
+// invalidBodyMessage is the error message for a body that fails to decode
+// with err.
+func invalidBodyMessage(r *http.Request, err error) string {
+	switch requestFormat(r) {
+	case formatMsgpack:
+		return "Invalid msgpack body"
+	case formatProtobuf:
+		return "Invalid protobuf body"
+	}
+	return describeJSONError(err)
+}
+
+// writeBody sends a response in format f. v is the JSON form of the body,
+// also used for msgpack; pb is the protobuf form.
+func writeBody(w http.ResponseWriter, f bodyFormat, status int, v interface{}, pb func() proto.Message) {
+	w.Header().Add("Vary", "Accept")
+	switch f {
+	case formatMsgpack:
+		w.Header().Set("Content-Type", msgpackContentType)
+		w.WriteHeader(status)
+		w.Write(appendMsgpack(nil, v))
+	case formatProtobuf:
+		b, err := proto.Marshal(pb())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", protobufContentType)
+		w.WriteHeader(status)
+		w.Write(b)
+	default:
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+		}
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// revisionOf returns the revision of key in store, or 0 if unknown.
+func revisionOf(store Store, key string) uint64 {
+	if kr, ok := store.(keyRevisioner); ok {
+		if rev, err := kr.Revision(key); err == nil {
+			return rev
+		}
+	}
+	return 0
+}
+
+// writeDataMap answers GET /data.
+func writeDataMap(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	writeBody(w, responseFormat(r), http.StatusOK, data, func() proto.Message {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		resp := &kvpb.BatchGetResponse{Items: make([]*kvpb.KeyValue, len(keys))}
+		for i, k := range keys {
+			resp.Items[i] = &kvpb.KeyValue{Key: k, Value: data[k]}
+		}
+		return resp
+	})
+}
+
+// writeKeyValue answers GET /data/{key}.
+func writeKeyValue(w http.ResponseWriter, r *http.Request, store Store, key, value string) {
+	writeBody(w, responseFormat(r), http.StatusOK, map[string]string{key: value}, func() proto.Message {
+		return &kvpb.GetResponse{Item: &kvpb.KeyValue{Key: key, Value: value, Revision: revisionOf(store, key)}}
+	})
+}
+
+// writeRange answers a range scan. The protobuf form carries the entries in
+// order as a BatchGetResponse, with the continuation key in X-Range-Next.
+func writeRange(w http.ResponseWriter, r *http.Request, res rangeResult) {
+	f := responseFormat(r)
+	var v interface{} = res
+	switch f {
+	case formatMsgpack:
+		entries := make([]interface{}, len(res.Entries))
+		for i, e := range res.Entries {
+			entries[i] = map[string]interface{}{"key": e.Key, "value": e.Value}
+		}
+		m := map[string]interface{}{"entries": entries}
+		if res.Next != "" {
+			m["next"] = res.Next
+		}
+		v = m
+	case formatProtobuf:
+		if res.Next != "" {
+			w.Header().Set("X-Range-Next", res.Next)
+		}
+	default:
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+	writeBody(w, f, http.StatusOK, v, func() proto.Message {
+		resp := &kvpb.BatchGetResponse{Items: make([]*kvpb.KeyValue, len(res.Entries))}
+		for i, e := range res.Entries {
+			resp.Items[i] = &kvpb.KeyValue{Key: e.Key, Value: e.Value}
+		}
+		return resp
+	})
+}
+
+// writeStored answers a successful POST /data that stored n keys.
+func writeStored(w http.ResponseWriter, r *http.Request, n int) {
+	writeBody(w, responseFormat(r), http.StatusCreated, map[string]string{"status": "success"}, func() proto.Message {
+		return &kvpb.BatchSetResponse{Applied: int32(n)}
+	})
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Media types of collection values. A list or set is stored as a JSON
+// array of strings, so GET /data/{key} returns it whole; the element
+// routes read and rewrite that array under the key's patch lock.
+const (
+	listType = "application/vnd.kv.list+json"
+	setType  = "application/vnd.kv.set+json"
+)
+
+// loadCollection reads key as a collection of type typ. A missing key is
+// an empty collection. It answers 409 for a key holding anything else: a
+// value recorded with another type, or one that is not a JSON array of
+// strings. Callers hold patchLock(key).
+func (s *Server) loadCollection(w http.ResponseWriter, r *http.Request, key, typ string) ([]string, bool) {
+	ns := s.namespaceFrom(r.Context())
+	v, err := ns.store.Get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, true
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return nil, false
+	}
+	var elems []string
+	if t := ns.types.get(key); (t != "" && t != typ) || json.Unmarshal([]byte(v), &elems) != nil {
+		writeError(w, r, http.StatusConflict, codeWrongType, "Key holds a value of another type")
+		return nil, false
+	}
+	return elems, true
+}
+
+// storeCollection writes elems back to key, deleting the key once the
+// collection is empty.
+func (s *Server) storeCollection(r *http.Request, key, typ string, elems []string) error {
+	if len(elems) == 0 {
+		if err := s.deleteKey(r.Context(), key); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(elems)
+	if err != nil {
+		return err
+	}
+	return s.setKey(withContentType(r.Context(), typ), key, string(b))
+}
+
+// decodeElements reads {field: [...]} from the request body, answering 400
+// unless it holds at least one element.
+func (s *Server) decodeElements(w http.ResponseWriter, r *http.Request, field string) ([]string, bool) {
+	var req map[string][]string
+	if !s.decodeJSON(w, r, &req) {
+		return nil, false
+	}
+	if len(req[field]) == 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, field+" must be a non-empty array of strings")
+		return nil, false
+	}
+	return req[field], true
+}
+
+// listPush serves lpush and rpush.
+func (s *Server) listPush(w http.ResponseWriter, r *http.Request, front bool) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	values, ok := s.decodeElements(w, r, "values")
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	mu := patchLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	list, ok := s.loadCollection(w, r, key, listType)
+	if !ok {
+		return
+	}
+	if front {
+		// Like LPUSH, each value goes to the front in turn, so they
+		// end up in reverse order.
+		head := make([]string, len(values))
+		for i, v := range values {
+			head[len(values)-1-i] = v
+		}
+		list = append(head, list...)
+	} else {
+		list = append(list, values...)
+	}
+	if err := s.storeCollection(r, key, listType, list); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"length": len(list)})
+}
+
+// listPop serves lpop and rpop.
+func (s *Server) listPop(w http.ResponseWriter, r *http.Request, front bool) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	key := r.PathValue("key")
+	mu := patchLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	list, ok := s.loadCollection(w, r, key, listType)
+	if !ok {
+		return
+	}
+	if len(list) == 0 {
+		writeStoreError(w, r, &KeyError{Op: "pop", Key: key, Err: ErrKeyNotFound})
+		return
+	}
+	var v string
+	if front {
+		v, list = list[0], list[1:]
+	} else {
+		v, list = list[len(list)-1], list[:len(list)-1]
+	}
+	if err := s.storeCollection(r, key, listType, list); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": v, "length": len(list)})
+}
+
+// POST
+//
+// lpushHandler adds {"values": [...]} to the front of the list.
+func (s *Server) lpushHandler(w http.ResponseWriter, r *http.Request) { s.listPush(w, r, true) }
+
+// POST
+//
+// rpushHandler adds {"values": [...]} to the back of the list.
+func (s *Server) rpushHandler(w http.ResponseWriter, r *http.Request) { s.listPush(w, r, false) }
+
+// POST
+//
+// lpopHandler removes and returns the first element of the list.
+func (s *Server) lpopHandler(w http.ResponseWriter, r *http.Request) { s.listPop(w, r, true) }
+
+// POST
+//
+// rpopHandler removes and returns the last element of the list.
+func (s *Server) rpopHandler(w http.ResponseWriter, r *http.Request) { s.listPop(w, r, false) }
+
+// GET
+//
+// lrangeHandler returns the elements from ?start to ?stop, both inclusive
+// and counted from the end when negative, as in Redis. By default it
+// returns the whole list.
+func (s *Server) lrangeHandler(w http.ResponseWriter, r *http.Request) {
+	start, stop := 0, -1
+	for name, p := range map[string]*int{"start": &start, "stop": &stop} {
+		if v := r.URL.Query().Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid "+name)
+				return
+			}
+			*p = n
+		}
+	}
+	key := r.PathValue("key")
+	list, ok := s.loadCollection(w, r, key, listType)
+	if !ok {
+		return
+	}
+	n := len(list)
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	stop = min(stop, n-1)
+	values := []string{}
+	if start <= stop {
+		values = list[start : stop+1]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"values": values, "length": n})
+}
+
+// POST
+//
+// saddHandler adds {"members": [...]} to the set. Members are kept sorted.
+func (s *Server) saddHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	members, ok := s.decodeElements(w, r, "members")
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	mu := patchLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	set, ok := s.loadCollection(w, r, key, setType)
+	if !ok {
+		return
+	}
+	have := make(map[string]bool, len(set))
+	for _, m := range set {
+		have[m] = true
+	}
+	added := 0
+	for _, m := range members {
+		if !have[m] {
+			have[m] = true
+			set = append(set, m)
+			added++
+		}
+	}
+	sort.Strings(set)
+	if err := s.storeCollection(r, key, setType, set); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"added": added, "size": len(set)})
+}
+
+// POST
+//
+// sremHandler removes {"members": [...]} from the set.
+func (s *Server) sremHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	members, ok := s.decodeElements(w, r, "members")
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	mu := patchLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	set, ok := s.loadCollection(w, r, key, setType)
+	if !ok {
+		return
+	}
+	drop := make(map[string]bool, len(members))
+	for _, m := range members {
+		drop[m] = true
+	}
+	kept := make([]string, 0, len(set))
+	for _, m := range set {
+		if !drop[m] {
+			kept = append(kept, m)
+		}
+	}
+	removed := len(set) - len(kept)
+	if removed > 0 {
+		if err := s.storeCollection(r, key, setType, kept); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"removed": removed, "size": len(kept)})
+}
+
+// GET
+//
+// smembersHandler returns the members of the set, sorted. With ?member=
+// it reports only whether that one is a member.
+func (s *Server) smembersHandler(w http.ResponseWriter, r *http.Request) {
+	set, ok := s.loadCollection(w, r, r.PathValue("key"), setType)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Has("member") {
+		writeJSON(w, http.StatusOK, map[string]bool{"member": slices.Contains(set, r.URL.Query().Get("member"))})
+		return
+	}
+	if set == nil {
+		set = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"members": set, "size": len(set)})
+}
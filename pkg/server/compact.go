@@ -0,0 +1,206 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// reclaimable is how much of one kind of retained data is held and how
+// much compaction would reclaim now. Byte counts are estimates: the keys
+// and values held, or the size of files on disk.
+type reclaimable struct {
+	Items            int   `json:"items,omitempty"`
+	Bytes            int64 `json:"bytes"`
+	ReclaimableItems int   `json:"reclaimable_items,omitempty"`
+	ReclaimableBytes int64 `json:"reclaimable_bytes"`
+}
+
+// gcStats is the "gc" entry of /stats.
+type gcStats struct {
+	// Tombstones are reclaimable once expired.
+	Tombstones reclaimable `json:"tombstones"`
+	// History is reclaimable for keys that are deleted, but only when
+	// compaction is asked to drop it, as it is kept for auditing.
+	History *reclaimable `json:"history,omitempty"`
+	// WAL is reclaimable for the files older than the retention needs.
+	WAL *reclaimable `json:"wal,omitempty"`
+	// Storage is reclaimable for the free pages of the storage file.
+	Storage          *reclaimable     `json:"storage,omitempty"`
+	ReclaimableBytes int64            `json:"reclaimable_bytes"`
+	LastCompaction   *compactProgress `json:"last_compaction,omitempty"`
+}
+
+// gcStats estimates what compaction would reclaim now.
+func (s *Server) gcStats() gcStats {
+	var st gcStats
+	now := time.Now()
+	history := s.cfg.HistoryDepth > 0
+	if history {
+		st.History = &reclaimable{}
+	}
+	for _, ns := range s.namespaces.list() {
+		n, bytes, expired, expiredBytes := ns.tombstones.usage(now)
+		st.Tombstones.Items += n
+		st.Tombstones.Bytes += bytes
+		st.Tombstones.ReclaimableItems += expired
+		st.Tombstones.ReclaimableBytes += expiredBytes
+		if history && ns.history != nil {
+			n, bytes, deleted, deletedBytes := ns.history.usage()
+			st.History.Items += n
+			st.History.Bytes += bytes
+			st.History.ReclaimableItems += deleted
+			st.History.ReclaimableBytes += deletedBytes
+		}
+	}
+	st.ReclaimableBytes = st.Tombstones.ReclaimableBytes
+	if wl := s.namespaces.wal; wl != nil {
+		wal := &reclaimable{Bytes: wl.stats().Bytes}
+		if files, err := wl.prunable(now); err == nil {
+			wal.ReclaimableItems = len(files)
+			for _, f := range files {
+				wal.ReclaimableBytes += f.size
+			}
+		}
+		st.WAL = wal
+		st.ReclaimableBytes += wal.ReclaimableBytes
+	}
+	if c, ok := s.backend.(compactor); ok {
+		if size, free, err := c.freeSpace(); err == nil {
+			st.Storage = &reclaimable{Bytes: size, ReclaimableBytes: free}
+			st.ReclaimableBytes += free
+		}
+	}
+	st.LastCompaction = s.lastCompaction.Load()
+	return st
+}
+
+// compactStep is what one step of a compaction reclaimed.
+type compactStep struct {
+	Step           string `json:"step"` // "tombstones", "history", "wal" or "storage"
+	Items          int    `json:"items,omitempty"`
+	ReclaimedBytes int64  `json:"reclaimed_bytes"`
+	Error          string `json:"error,omitempty"`
+}
+
+// compactProgress is a line of the POST /admin/compact response.
+type compactProgress struct {
+	Status string `json:"status"` // "compacting", "done" or "failed"
+	// Step is the step a "compacting" line announces.
+	Step           string        `json:"step,omitempty"`
+	Done           []compactStep `json:"done"`
+	ReclaimedBytes int64         `json:"reclaimed_bytes"`
+	Started        time.Time     `json:"started"`
+	TookSeconds    float64       `json:"took_seconds"`
+}
+
+// POST
+//
+// compactHandler reclaims the space of retained data that is no longer
+// needed, streaming a line as each step starts and a summary at the end:
+// expired tombstones are purged, WAL files older than the retention needs
+// are deleted and the storage file is rewritten without its free pages,
+// if enough of it is free or with ?force=true. With ?history=true, a
+// destructive operation, the history of deleted keys is dropped as well.
+// One compaction runs at a time; another gets 409.
+func (s *Server) compactHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var force, history bool
+	for name, v := range map[string]*bool{"force": &force, "history": &history} {
+		if q.Has(name) {
+			b, err := strconv.ParseBool(q.Get(name))
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid "+name)
+				return
+			}
+			*v = b
+		}
+	}
+	if history {
+		if s.cfg.HistoryDepth <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Value history is not enabled")
+			return
+		}
+		st := s.gcStats()
+		impact := map[string]interface{}{"versions": st.History.ReclaimableItems, "bytes": st.History.ReclaimableBytes}
+		if _, ok := s.confirmed(w, r, "compact_history", "history", impact); !ok {
+			return
+		}
+	}
+	if !s.compactMu.TryLock() {
+		writeError(w, r, http.StatusConflict, codeConflict, "A compaction is already running")
+		return
+	}
+	defer s.compactMu.Unlock()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	p := &compactProgress{Status: "compacting", Done: []compactStep{}, Started: time.Now().UTC()}
+	step := func(name string, fn func(*compactStep) error) {
+		p.Step = name
+		p.TookSeconds = time.Since(p.Started).Seconds()
+		enc.Encode(p)
+		rc.Flush()
+		cs := compactStep{Step: name}
+		if err := fn(&cs); err != nil {
+			cs.Error = err.Error()
+			p.Status = "failed"
+		}
+		p.Done = append(p.Done, cs)
+		p.ReclaimedBytes += cs.ReclaimedBytes
+	}
+
+	step("tombstones", func(cs *compactStep) error {
+		now := time.Now()
+		for _, ns := range s.namespaces.list() {
+			_, _, _, bytes := ns.tombstones.usage(now)
+			cs.Items += ns.tombstones.purge(now)
+			cs.ReclaimedBytes += bytes
+		}
+		return nil
+	})
+	if history {
+		step("history", func(cs *compactStep) error {
+			for _, ns := range s.namespaces.list() {
+				if ns.history == nil {
+					continue
+				}
+				_, _, _, bytes := ns.history.usage()
+				cs.Items += ns.history.dropDeleted()
+				cs.ReclaimedBytes += bytes
+			}
+			return nil
+		})
+	}
+	if wl := s.namespaces.wal; wl != nil {
+		step("wal", func(cs *compactStep) error {
+			files, err := wl.prunable(time.Now())
+			if err != nil {
+				return err
+			}
+			before := wl.stats().Bytes
+			err = wl.prune(time.Now())
+			cs.Items = len(files)
+			cs.ReclaimedBytes = max(before-wl.stats().Bytes, 0)
+			return err
+		})
+	}
+	if c, ok := s.backend.(compactor); ok {
+		step("storage", func(cs *compactStep) error {
+			before, after, err := c.compact(force)
+			cs.ReclaimedBytes = max(before-after, 0)
+			return err
+		})
+	}
+
+	if p.Status != "failed" {
+		p.Status = "done"
+	}
+	p.Step = ""
+	p.TookSeconds = time.Since(p.Started).Seconds()
+	s.lastCompaction.Store(p)
+	s.logger.Printf("[Compact] Compaction %s, reclaimed %d bytes in %.1fs", p.Status, p.ReclaimedBytes, p.TookSeconds)
+	enc.Encode(p)
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minCompressSize is the smallest response body worth compressing;
+// anything shorter is sent as-is.
+const minCompressSize = 1024
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// withCompression compresses responses for clients that accept gzip or
+// deflate, and decompresses request bodies sent with either encoding.
+// Only textual bodies of at least minCompressSize bytes are compressed;
+// streamed responses are compressed as they are flushed.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ce := r.Header.Get("Content-Encoding"); ce != "" {
+			body, err := decompressBody(ce, r.Body)
+			if err != nil {
+				writeError(w, r, http.StatusUnsupportedMediaType, codeInvalidParam, err.Error())
+				return
+			}
+			r.Body = body
+			r.ContentLength = -1
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+		}
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func decompressBody(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	var dec io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		dec, err = gzip.NewReader(body)
+	case "deflate":
+		dec, err = zlib.NewReader(body)
+	default:
+		return nil, errUnsupportedEncoding(encoding)
+	}
+	if err != nil {
+		return nil, errUnsupportedEncoding(encoding + " (malformed body)")
+	}
+	return readCloser{dec, body}, nil
+}
+
+type errUnsupportedEncoding string
+
+func (e errUnsupportedEncoding) Error() string {
+	return "Unsupported Content-Encoding: " + string(e)
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip, or returns "" if the client accepts neither.
+func negotiateEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		accepted[name] = q > 0
+	}
+	switch {
+	case accepted["gzip"] || (accepted["*"] && !hasEncoding(header, "gzip")):
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+func hasEncoding(header, name string) bool {
+	for _, part := range strings.Split(header, ",") {
+		n, _, _ := strings.Cut(part, ";")
+		if strings.EqualFold(strings.TrimSpace(n), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether a response with these headers should be
+// compressed: textual, not already encoded, and not a partial response.
+func compressible(h http.Header, status int) bool {
+	if h.Get("Content-Encoding") != "" || status == http.StatusPartialContent ||
+		status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	ct, _, _ := strings.Cut(h.Get("Content-Type"), ";")
+	ct = strings.TrimSpace(ct)
+	switch {
+	case ct == "", strings.HasPrefix(ct, "text/"),
+		ct == "application/json", ct == "application/x-ndjson",
+		ct == "application/yaml", strings.HasSuffix(ct, "+json"):
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// the body is worth compressing, then either compresses everything or
+// passes it through untouched.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < minCompressSize {
+			return len(p), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// decide sends the headers, compressing the body from here on if big is
+// set and the response is compressible, and writes out anything buffered.
+func (w *compressWriter) decide(big bool) error {
+	w.decided = true
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	h := w.Header()
+	if compressible(h, status) {
+		h.Add("Vary", "Accept-Encoding")
+		if big {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", w.encoding)
+			w.enc = w.newEncoder()
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *compressWriter) newEncoder() io.WriteCloser {
+	if w.encoding == "gzip" {
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(w.ResponseWriter)
+		return gz
+	}
+	zw := zlibWriters.Get().(*zlib.Writer)
+	zw.Reset(w.ResponseWriter)
+	return zw
+}
+
+// Flush sends what has been written so far. A response that is flushed is
+// being streamed, so it is compressed regardless of how much has been
+// written yet.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// close finishes the response once the handler has returned.
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			// Nothing was written, or the connection was hijacked.
+			return
+		}
+		w.decide(false)
+	}
+	if w.enc == nil {
+		return
+	}
+	w.enc.Close()
+	switch enc := w.enc.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(enc)
+	case *zlib.Writer:
+		zlibWriters.Put(enc)
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *compressWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ConcurrencyLimits caps the number of requests served at once on a route,
+// keyed by "METHOD /path" as the route is registered, without the /v1
+// prefix, e.g. "GET /data". A limit also covers the route's twin under
+// /ns/{namespace}, sharing the same slots. It implements flag.Value as
+// "METHOD /path=N".
+type ConcurrencyLimits map[string]int
+
+func (f *ConcurrencyLimits) String() string {
+	parts := make([]string, 0, len(*f))
+	for route, n := range *f {
+		parts = append(parts, route+"="+strconv.Itoa(n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f *ConcurrencyLimits) Set(v string) error {
+	i := strings.LastIndexByte(v, '=')
+	if i < 0 {
+		return fmt.Errorf("concurrency limit %q must be in \"METHOD /path=N\" form", v)
+	}
+	method, path, ok := strings.Cut(strings.TrimSpace(v[:i]), " ")
+	path = strings.TrimSpace(path)
+	if !ok || method == "" || !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("concurrency limit %q must be in \"METHOD /path=N\" form", v)
+	}
+	n, err := strconv.Atoi(v[i+1:])
+	if err != nil || n <= 0 {
+		return fmt.Errorf("concurrency limit %q must be a positive number", v)
+	}
+	if *f == nil {
+		*f = make(ConcurrencyLimits)
+	}
+	(*f)[strings.ToUpper(method)+" "+path] = n
+	return nil
+}
+
+// routeLimit is a semaphore over one route. Batch requests hold at most
+// batchSlots of its slots at once.
+type routeLimit struct {
+	slots      chan struct{}
+	batchSlots int64
+	batch      atomic.Int64
+	rejectedBy [numPriorities]atomic.Int64
+	used       bool
+}
+
+// routeLimitStats is a route's entry in /stats.
+type routeLimitStats struct {
+	Limit         int   `json:"limit"`
+	InFlight      int   `json:"in_flight"`
+	Rejected      int64 `json:"rejected"`
+	RejectedBatch int64 `json:"rejected_batch"`
+}
+
+// routeLimits are the configured route semaphores, by route.
+type routeLimits map[string]*routeLimit
+
+func newRouteLimits(cfg ConcurrencyLimits, p *priorities) routeLimits {
+	if len(cfg) == 0 {
+		return nil
+	}
+	l := make(routeLimits, len(cfg))
+	for route, n := range cfg {
+		l[route] = &routeLimit{slots: make(chan struct{}, n), batchSlots: p.limit(priorityBatch, int64(n))}
+	}
+	return l
+}
+
+// middleware returns the limiter for method and path, or nil if the route
+// has no limit.
+func (l routeLimits) middleware(method, path string) Middleware {
+	if rest, ok := strings.CutPrefix(path, "/ns/{namespace}"); ok && rest != "" {
+		path = rest
+	}
+	rl := l[method+" "+path]
+	if rl == nil {
+		return nil
+	}
+	rl.used = true
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			class := priorityFrom(r.Context())
+			batch := class == priorityBatch
+			admitted := !batch || rl.batch.Add(1) <= rl.batchSlots
+			if admitted {
+				select {
+				case rl.slots <- struct{}{}:
+				default:
+					admitted = false
+				}
+			}
+			if batch {
+				defer rl.batch.Add(-1)
+			}
+			if !admitted {
+				rl.rejectedBy[class].Add(1)
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusServiceUnavailable, codeOverloaded, "Too many concurrent requests to this endpoint; retry later")
+				return
+			}
+			defer func() { <-rl.slots }()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// unused returns the configured routes that match no registered route.
+func (l routeLimits) unused() []string {
+	var out []string
+	for route, rl := range l {
+		if !rl.used {
+			out = append(out, route)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (l routeLimits) stats() map[string]routeLimitStats {
+	if len(l) == 0 {
+		return nil
+	}
+	out := make(map[string]routeLimitStats, len(l))
+	for route, rl := range l {
+		batch := rl.rejectedBy[priorityBatch].Load()
+		out[route] = routeLimitStats{
+			Limit:         cap(rl.slots),
+			InFlight:      len(rl.slots),
+			Rejected:      rl.rejectedBy[priorityInteractive].Load() + batch,
+			RejectedBatch: batch,
+		}
+	}
+	return out
+}
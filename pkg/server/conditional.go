@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// valueETag is the entity tag of a value. It is weak because the same
+// value is served in several formats and encodings.
+func valueETag(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return `W/"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison RFC 9110 prescribes for it.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeValidators sets the ETag, Last-Modified and configured Cache-Control
+// headers for a read of key, and answers 304 if the request's
+// If-None-Match, or failing that If-Modified-Since, shows the client
+// already has this value. It reports whether it answered.
+func (s *Server) writeValidators(w http.ResponseWriter, r *http.Request, store Store, key, value string) bool {
+	h := w.Header()
+	etag := valueETag(value)
+	h.Set("ETag", etag)
+	var modified time.Time
+	if mp, ok := store.(metadataProvider); ok {
+		if meta, err := mp.Metadata(key); err == nil {
+			modified = meta.UpdatedAt.UTC().Truncate(time.Second)
+			h.Set("Last-Modified", modified.Format(http.TimeFormat))
+		}
+	}
+	if s.cfg.CacheControl != "" {
+		h.Set("Cache-Control", s.cfg.CacheControl)
+	}
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		notModified = etagMatches(inm, etag)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		notModified = err == nil && !modified.After(t)
+	}
+	if !notModified {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
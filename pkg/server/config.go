@@ -0,0 +1,616 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of a Server. The zero value of each field
+// disables the corresponding feature; use DefaultConfig for the defaults of
+// the server binary.
+type Config struct {
+	// The HTTP API is served on Addr and on each of ExtraAddrs. With
+	// AdminAddr set, the admin endpoints (/admin, /stats, /audit, /info
+	// and /metrics, with Pprof the profiles under /debug/pprof and with
+	// Expvar the counters of /stats as expvar variables at /debug/vars)
+	// are served there instead, by a server of their own; health checks are
+	// served on every listener. Any listen address may be "unix:" and a
+	// path for a Unix domain socket, created with permissions
+	// UnixSocketMode.
+	Addr           string
+	ExtraAddrs     []string
+	AdminAddr      string
+	UnixSocketMode os.FileMode
+
+	// AdminAPIKeys, if set, are the only credentials the admin listener
+	// accepts, in place of the API's authentication. AdminReadTimeout and
+	// AdminWriteTimeout, if set, replace ReadTimeout and WriteTimeout
+	// there.
+	AdminAPIKeys      APIKeys
+	AdminReadTimeout  time.Duration
+	AdminWriteTimeout time.Duration
+	Pprof             bool
+	Expvar            bool
+	GRPCAddr          string
+	RedisAddr         string
+
+	TLSCert  string
+	TLSKey   string
+	Headers  HeaderList
+	DataFile string
+
+	// Storage is the backend of the default namespace: "memory", or
+	// "sqlite" or "bolt" for a database file at StoragePath, which makes
+	// every write durable without a DataFile and holds more data than fits
+	// in memory. The bolt file is compacted every CompactInterval (0
+	// disables it) once enough of it is free space. CacheSize bounds an
+	// in-memory cache of recently used values in front of either, in bytes
+	// of keys and values; 0 disables it. CacheTTL, for a database file
+	// other servers write too, is how long a cached value is served before
+	// the backend is read again; 0 trusts it until it is overwritten or
+	// evicted. For CacheStaleWhileRevalidate past the TTL, a cached value is
+	// still served at once while it is refreshed in the background, which
+	// keeps slow reads of the backend out of the response times of hot keys
+	// at the cost of values up to CacheTTL+CacheStaleWhileRevalidate old.
+	Storage                   string
+	StoragePath               string
+	CompactInterval           time.Duration
+	CacheSize                 int64
+	CacheTTL                  time.Duration
+	CacheStaleWhileRevalidate time.Duration
+
+	// ShadowStorage, if set, is a second backend, as Storage takes, at
+	// ShadowStoragePath, that every write of the default namespace is
+	// applied to as well, asynchronously, after the dataset is copied to
+	// it, as a rehearsal for moving to it. Up to ShadowQueue writes wait
+	// for it; more make it copy the dataset again. GET
+	// /admin/shadow/compare reports where the two differ.
+	ShadowStorage     string
+	ShadowStoragePath string
+	ShadowQueue       int
+
+	// SeedFile is a JSON, YAML or CSV file, or an http(s) URL of one, of
+	// key/value pairs written to the store on startup. SeedChecksum, the
+	// hex SHA-256 of its contents, rejects a seed that does not match;
+	// SeedIfEmpty seeds only a store that holds no keys, as loaded from
+	// the data file or storage backend.
+	SeedFile      string
+	SeedChecksum  string
+	SeedIfEmpty   bool
+	SeedOverwrite bool
+
+	ValidationHooks  PrefixURLList
+	ValidateTimeout  time.Duration
+	ValidateFailOpen bool
+
+	// Search maintains a full-text index of values for GET /search.
+	Search bool
+
+	// BloomKeys, if positive, keeps a Bloom filter of the keys of each
+	// namespace, sized for that many keys (or twice as many as there are)
+	// at a false positive rate of BloomFPRate, so that GET
+	// /data/{key}/exists is answered without touching the store. Filters
+	// are rebuilt in the background as keys are deleted.
+	BloomKeys   int
+	BloomFPRate float64
+
+	// Indexes are secondary indexes declared in every namespace.
+	Indexes IndexDefs
+
+	// Schemas maps key prefixes to JSON Schema files that values written
+	// under them must match.
+	Schemas SchemaFiles
+
+	// ValueHooks are the registered ValueHooks, built in or compiled-in
+	// plugins, that transform values under their prefixes as they are
+	// written and as clients read them. Exports, backups and replication
+	// carry values as they are stored.
+	ValueHooks ValueHookList
+
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// H2C serves HTTP/2 without TLS to clients that open the connection
+	// with the HTTP/2 preface ("prior knowledge"); HTTP/1 clients are
+	// unaffected. HTTP2MaxStreams bounds the concurrent streams per
+	// connection and HTTP2StreamBuffer the bytes buffered for each stream's
+	// request body; zero leaves Go's defaults of 250 and 1MB.
+	H2C               bool
+	HTTP2MaxStreams   int
+	HTTP2StreamBuffer int
+
+	// On Stop, /readyz fails for DrainPeriod while requests are still
+	// served, then in-flight requests get up to ShutdownTimeout (0 for no
+	// limit beyond the context passed to Stop) to finish.
+	DrainPeriod     time.Duration
+	ShutdownTimeout time.Duration
+
+	// RequestTimeout bounds how long a handler may take before the client
+	// is answered 503 and the request's context is cancelled; streaming
+	// and bulk endpoints are exempt. A client may give a sooner deadline
+	// in X-Request-Deadline or Grpc-Timeout, answered 504 once it passes.
+	RequestTimeout time.Duration
+
+	// SlowRequestThreshold, when positive, logs a warning for every
+	// request taking at least this long, with the time it spent queued
+	// behind middleware and limits, waiting for locks, in the store and
+	// writing its response, and counts them in /stats.
+	SlowRequestThreshold time.Duration
+
+	// LockStats counts how often the server's global lock and the
+	// namespaces' locks are acquired and how long acquisitions wait for
+	// them, in total and per route, and reports it in /stats.
+	LockStats bool
+
+	// ReadOnly starts the server in read-only mode, which can be switched
+	// off through /admin/maintenance.
+	ReadOnly bool
+
+	// Compression enables gzip and deflate for responses and request
+	// bodies.
+	Compression bool
+
+	// Features turns feature flags on or off at startup; they can be
+	// flipped at runtime through /admin/flags. Flags not named start on,
+	// except compression, which follows Compression.
+	Features FeatureToggles
+
+	// ValueCompression compresses values held in memory, "snappy" or
+	// "zstd", once they are at least ValueCompressionMin bytes; "" keeps
+	// them as they are.
+	ValueCompression    string
+	ValueCompressionMin int
+
+	// ConfirmDestructive makes flushes, prefix deletes and restores from
+	// backup take two steps: the first request gets a summary of what
+	// would be removed and a token, and repeating it with the token in
+	// X-Confirm-Token within ConfirmWindow carries it out.
+	ConfirmDestructive bool
+	ConfirmWindow      time.Duration
+
+	// Dedup stores identical values of at least DedupMinSize bytes once
+	// in memory, shared by every key that holds them, with the savings in
+	// /stats. It applies to the memory backend.
+	Dedup        bool
+	DedupMinSize int
+
+	// MaxValueSize is the largest value accepted in bytes, 0 for no limit.
+	MaxValueSize int64
+	MaxConns     int
+
+	// ConcurrencyLimits bound how many requests expensive routes, such
+	// as full dumps with GET /data, serve at once; requests beyond the
+	// limit get 503.
+	ConcurrencyLimits ConcurrencyLimits
+
+	// DisabledRoutes are routes turned off, such as writes and exports on
+	// a public read replica; requests to them get 404, or 405 if the path
+	// serves other methods, with the endpoint_disabled code.
+	DisabledRoutes DisabledRoutes
+
+	// MaxInFlight and MaxLockQueue, if positive, shed requests with 503
+	// while more than that many are being served, or waiting for the
+	// server's and namespaces' locks, telling clients to retry after
+	// ShedRetryAfter. Health checks and /admin routes are exempt.
+	MaxInFlight    int
+	MaxLockQueue   int
+	ShedRetryAfter time.Duration
+
+	// A request is "interactive", the default, or "batch", as
+	// APIKeyPriorities say for its API key or, for other clients, as it
+	// asks with X-Priority. Under MaxInFlight, MaxLockQueue and
+	// ConcurrencyLimits, batch requests are shed once BatchShare of the
+	// limit (0.5 by default) is in use, leaving the rest for interactive
+	// ones.
+	APIKeyPriorities APIKeyPriorities
+	BatchShare       float64
+
+	// CacheControl, if set, is sent as the Cache-Control header of key
+	// reads.
+	CacheControl string
+
+	// MaxKeyLength is the longest key accepted in bytes, 0 for no limit.
+	// KeyPattern, if set, is a regular expression keys must match in
+	// full. Keys under ReservedPrefixes cannot be written or deleted by
+	// clients. KeyNormalization, if set, is the Unicode normalization form
+	// (NFC, NFD, NFKC or NFKD) keys are converted to before use.
+	MaxKeyLength     int
+	KeyPattern       string
+	ReservedPrefixes []string
+	KeyNormalization string
+
+	TopologyFile string
+	NodeID       string
+
+	// Discovery is how the nodes of the topology are found: "static", the
+	// default, for those of TopologyFile and Peers given as "id=url";
+	// "dns" for the targets of the SRV record DiscoverySRV, with the
+	// target host as node ID; or "gossip" for those gossiping with this
+	// node, starting from the seed URLs in Peers and authenticated with
+	// RaftSecret. DNS and gossip membership is refreshed every
+	// DiscoveryInterval. AdvertiseURL is this node's URL when neither the
+	// file nor Peers list it.
+	Discovery         string
+	DiscoverySRV      string
+	Peers             []string
+	AdvertiseURL      string
+	DiscoveryInterval time.Duration
+
+	// RegistrationFile and RegistryURL list this instance, with its URL
+	// (AdvertiseURL, or its HTTP listener's address), version and role,
+	// for clients and load balancers to discover, from startup until it
+	// starts to shut down. RegistrationFile is a JSON object of instances
+	// by ID that instances sharing it take turns to update; the instance
+	// is PUT as JSON to RegistryURL/{id}, and DELETEd from it. Both are
+	// refreshed every RegistrationInterval, so that a registry can expire
+	// instances that stopped without deregistering. The ID is NodeID, or
+	// host:port.
+	RegistrationFile     string
+	RegistryURL          string
+	RegistrationInterval time.Duration
+
+	// RaftDir makes the nodes of the topology a Raft group: writes are
+	// committed through the elected leader and replicated to every node,
+	// and this node's term, vote and log are kept in RaftDir, the log
+	// cut short by a snapshot of the store every few thousand entries and
+	// encrypted, as the snapshot is, with an encryption key. Peers
+	// authenticate to each other with RaftSecret. ReadConsistency is the
+	// default for reads that do not send X-Read-Consistency: "local",
+	// "leader" or "linearizable".
+	RaftDir             string
+	RaftSecret          string
+	RaftElectionTimeout time.Duration
+	ReadConsistency     string
+
+	// ConsistencyTokenWait is how long a Raft follower or a replica holds
+	// a read carrying the X-Consistency-Token of an earlier write before
+	// sending it to the leader or the primary.
+	ConsistencyTokenWait time.Duration
+
+	// Sharding spreads the keyspace over the topology's nodes by
+	// consistent hashing, with ShardVNodes points per node on the ring.
+	// Requests for a key another node owns are proxied to it. When
+	// discovery changes the ring, each node moves the keys it no longer
+	// owns to their new owner at up to RebalanceRate keys a second.
+	Sharding      bool
+	ShardVNodes   int
+	RebalanceRate int
+
+	// ReplicationBacklog is the number of recent mutations kept for
+	// replicas to catch up from and for GET /changes; 0 disables both. A node
+	// with ReplicaOf set instead follows the primary at that URL, using
+	// ReplicaAPIKey if the primary requires one, and rejects other writes
+	// until it is promoted to a primary with POST /admin/promote or, with
+	// PromoteAfter set, once the primary has not been heard from for that
+	// long. A replica with a backlog of its own serves replicas as soon as
+	// it is promoted.
+	ReplicationBacklog int
+	ReplicaOf          string
+	ReplicaAPIKey      string
+	PromoteAfter       time.Duration
+
+	// MirrorURL, if set, is an https URL of an instance at another site
+	// that every mutation recorded in the replication backlog is replayed
+	// against asynchronously, MirrorBatch at a time, retrying until it
+	// accepts them. MirrorAPIKey is presented if the remote requires one,
+	// and its certificate is checked against MirrorCAFile if set, or the
+	// system roots otherwise.
+	MirrorURL    string
+	MirrorAPIKey string
+	MirrorCAFile string
+	MirrorBatch  int
+
+	// The background worker records a stats snapshot for /stats/history
+	// every WorkerInterval (0 disables it), kept for StatsRetention, and
+	// reports it in the log as WorkerLog: "text", "json", or "none" or ""
+	// for not at all.
+	StatsRetention time.Duration
+	WorkerInterval time.Duration
+	WorkerLog      string
+
+	// Alerts are checked by the background worker every WorkerInterval
+	// (every 5s if it is 0); a rule that starts or stops firing is POSTed
+	// to AlertURL, signed with WebhookSecret like webhook notifications.
+	// A rule is notified at most once per AlertCooldown.
+	Alerts        AlertRules
+	AlertURL      string
+	AlertCooldown time.Duration
+
+	// StatsDAddr, if set, is the host:port of a StatsD daemon the server
+	// pushes its counters, gauges and request timings to over UDP every
+	// StatsDInterval, each name prefixed with StatsDPrefix.
+	StatsDAddr     string
+	StatsDPrefix   string
+	StatsDInterval time.Duration
+
+	// HotKeyWindow is the sliding window /stats/hotkeys estimates key
+	// access frequencies over (0 disables tracking).
+	HotKeyWindow time.Duration
+	LegacyRoutes bool
+	SwaggerUI    bool
+	// Dashboard serves a web dashboard at /ui.
+	Dashboard bool
+
+	Webhooks      PrefixURLList
+	WebhookSecret string
+
+	// MaxKeys and MaxMemory bound the default namespace; once either is
+	// exceeded keys are evicted according to EvictionPolicy ("lru", "lfu"
+	// or "random").
+	MaxKeys        int
+	MaxMemory      int64
+	EvictionPolicy string
+
+	// Backups of the default namespace are uploaded to BackupBucket at
+	// BackupEndpoint, an S3-compatible object store, every BackupInterval
+	// (0 for on demand only), keeping the newest BackupRetain (0 for all).
+	BackupEndpoint  string
+	BackupBucket    string
+	BackupRegion    string
+	BackupAccessKey string
+	BackupSecretKey string
+	BackupPrefix    string
+	BackupInterval  time.Duration
+	BackupRetain    int
+
+	// EncryptionKeyFile names a file of AES-256 keys, one per line as
+	// "id:KEY" or a bare KEY in hex or base64, and EncryptionKey is a
+	// single such key. When either is set the data file and backups are
+	// encrypted with AES-GCM under the first key; the others are only used
+	// to read data written before a rotation, which is re-encrypted with
+	// the first key the next time it is saved.
+	EncryptionKeyFile string
+	EncryptionKey     string
+
+	// EncryptPrefixes are key prefixes whose values are encrypted before
+	// they are stored, each under its own data key wrapped by the first
+	// encryption key, so that neither memory, exports nor the Raft and
+	// replication logs hold them in plain text. Only clients whose API
+	// key holds DecryptScope read them decrypted; others get the sealed
+	// value.
+	EncryptPrefixes []string
+	DecryptScope    string
+
+	// AuditSize is the number of audit entries kept in memory for /audit,
+	// and AuditFile a file every entry is appended to. The audit log is
+	// disabled when both are zero.
+	AuditSize int
+	AuditFile string
+
+	// RecordSize is the number of requests, with their responses, kept in
+	// memory for /admin/recordings, and RecordFile a file every one is
+	// appended to, for replaying with "server replay". Recording is off
+	// when both are zero. Bodies are captured up to RecordBodyLimit bytes
+	// (default 64 KiB); credentials are left out.
+	RecordSize      int
+	RecordFile      string
+	RecordBodyLimit int
+
+	// WALDir keeps a write-ahead log of the mutations of every namespace
+	// there, with a snapshot of all of them on startup and every
+	// WALSnapshotInterval, for POST /admin/restore to rebuild a namespace
+	// as of any moment since the oldest snapshot. Snapshots older than
+	// WALRetention are deleted but the newest of them, with the log
+	// segments that only they need. With an encryption key, segments and
+	// snapshots are encrypted as the data file is.
+	WALDir              string
+	WALSnapshotInterval time.Duration
+	WALRetention        time.Duration
+
+	// PersistCodec is the PersistCodec DataFile and the write-ahead log are
+	// written in: "json" (the default), "gob", "protobuf", "binary" or one
+	// added with RegisterPersistCodec. Files are read in the codec they
+	// were written in, so changing it migrates DataFile when next saved,
+	// and the log with its next segment.
+	PersistCodec string
+
+	// HistoryDepth is the number of past versions kept per key for
+	// /data/{key}/history and ?version= reads; 0 disables history.
+	HistoryDepth int
+
+	// SoftDeleteRetention, when positive, makes deletes keep a tombstone
+	// for this long so the key can be restored.
+	SoftDeleteRetention time.Duration
+
+	// IdempotencyWindow is how long the response to a write made with an
+	// Idempotency-Key header is kept and replayed to retries; 0 disables
+	// idempotency keys.
+	IdempotencyWindow time.Duration
+
+	// Quotas limits the size of namespaces by name; the "*" entry applies
+	// to namespaces without one of their own.
+	Quotas Quotas
+
+	// CORSOrigins are the origins browsers may call the API from, "*" for
+	// any; CORS is disabled when empty. CORSMethods and CORSHeaders are
+	// the methods and request headers preflights allow, by default every
+	// API method and whichever headers are asked for. CORSMaxAge is how
+	// long browsers may cache a preflight response.
+	CORSOrigins []string
+	CORSMethods []string
+	CORSHeaders []string
+	CORSMaxAge  time.Duration
+
+	// StrictJSON rejects members of JSON request bodies that the endpoint
+	// does not know, rather than ignoring them, and non-string values in
+	// POST /data, rather than storing them as JSON text.
+	StrictJSON bool
+
+	// Chaos enables /admin/chaos, through which latency and failures can
+	// be injected into any route to exercise clients' retry logic. It is
+	// meant for test deployments only.
+	Chaos bool
+
+	// DiagnosticsDir is where DumpDiagnostics, SIGUSR1 and POST
+	// /admin/diagnostics write diagnostic reports; reports are disabled
+	// when it is empty.
+	DiagnosticsDir string
+
+	AccessLog bool
+	APIKeys   APIKeys
+	RateLimit float64
+	RateBurst int
+
+	// AuthProvider selects how API requests are authenticated: "keys",
+	// against APIKeys, the default when there are any; "file", against
+	// the identities in AuthFile, re-read when it changes; "ldap", by a
+	// simple bind to AuthLDAPURL as AuthLDAPUserDN with %s replaced by the
+	// user name of Basic credentials; or "oidc", by introspecting bearer
+	// tokens at AuthOIDCURL as AuthOIDCClientID. Identities the directory
+	// or identity provider confirms are trusted for AuthCacheTTL. The
+	// provider's health is part of /readyz. WithAuthProvider plugs in
+	// any other.
+	AuthProvider         string
+	AuthFile             string
+	AuthLDAPURL          string
+	AuthLDAPUserDN       string
+	AuthOIDCURL          string
+	AuthOIDCClientID     string
+	AuthOIDCClientSecret string
+	AuthCacheTTL         time.Duration
+
+	// SigningKeys are shared secrets, by name, with which machine clients
+	// may sign requests (Authorization: KV-HMAC-SHA256) instead of
+	// presenting a bearer token. A signature covers the method, path,
+	// query, timestamp and body, must be made within SigningWindow of the
+	// server's clock and is accepted only once. A signed request is
+	// authenticated as the key's name, with its APIKeyScopes.
+	SigningKeys   APIKeys
+	SigningWindow time.Duration
+
+	// AuthLockoutThreshold, if positive, locks out a client address that
+	// presents rejected credentials that many times within
+	// AuthLockoutWindow: its requests are answered 429 for
+	// AuthLockoutDuration, doubling with each further lockout up to
+	// AuthLockoutMax, until it authenticates successfully. Failures and
+	// lockouts are recorded in the audit log when there is one.
+	AuthLockoutThreshold int
+	AuthLockoutWindow    time.Duration
+	AuthLockoutDuration  time.Duration
+	AuthLockoutMax       time.Duration
+
+	// TokenSecret, if set, enables POST /auth/token, where clients
+	// holding TokenAdminScope mint short-lived tokens for service
+	// accounts, granting keys under a prefix with the permissions given,
+	// for TokenTTL by default and TokenMaxTTL at most. Tokens are signed
+	// with the secret, so nodes sharing it accept each other's. Revoked
+	// tokens are listed until they expire, in TokenRevocationFile as well
+	// if it is set.
+	TokenSecret         string
+	TokenAdminScope     string
+	TokenTTL            time.Duration
+	TokenMaxTTL         time.Duration
+	TokenRevocationFile string
+
+	// TagPolicies say what the tags keys are written with (X-Key-Tags)
+	// entail: a scope, from APIKeyScopes, required to read or write them,
+	// leaving them out of exports, or masking them in the audit log.
+	TagPolicies  TagPolicies
+	APIKeyScopes APIKeyScopes
+
+	// TrustedProxies are the CIDRs, or single addresses, of load
+	// balancers in front of the server. Requests from them are attributed
+	// to the client they name in Forwarded or X-Forwarded-For, for rate
+	// limiting, access logs and client stats. With ProxyProtocol set,
+	// connections from them may also start with a PROXY protocol header
+	// giving the client's address.
+	TrustedProxies []string
+	ProxyProtocol  bool
+}
+
+// DefaultConfig returns the configuration used when no options are given.
+func DefaultConfig() Config {
+	return Config{
+		Addr:                 ":8080",
+		UnixSocketMode:       0o660,
+		ValidateTimeout:      2 * time.Second,
+		ReadTimeout:          30 * time.Second,
+		ReadHeaderTimeout:    5 * time.Second,
+		WriteTimeout:         30 * time.Second,
+		IdleTimeout:          120 * time.Second,
+		RequestTimeout:       15 * time.Second,
+		ShedRetryAfter:       defaultShedRetryAfter,
+		BatchShare:           defaultBatchShare,
+		ShutdownTimeout:      5 * time.Second,
+		MaxHeaderBytes:       1 << 20,
+		MaxValueSize:         defaultMaxValueSize,
+		MaxKeyLength:         defaultMaxKeyLength,
+		KeyPattern:           defaultKeyPattern,
+		Compression:          true,
+		ValueCompressionMin:  defaultValueCompressionMin,
+		DedupMinSize:         defaultDedupMinSize,
+		ConfirmWindow:        defaultConfirmWindow,
+		StatsRetention:       defaultStatsRetention,
+		DiagnosticsDir:       os.TempDir(),
+		WorkerInterval:       workerInterval,
+		WorkerLog:            workerLogText,
+		AlertCooldown:        10 * time.Minute,
+		StatsDPrefix:         "kv.",
+		StatsDInterval:       10 * time.Second,
+		DecryptScope:         "decrypt",
+		HotKeyWindow:         defaultHotKeyWindow,
+		LegacyRoutes:         true,
+		EvictionPolicy:       "lru",
+		Storage:              storageMemory,
+		CompactInterval:      time.Hour,
+		CacheSize:            defaultCacheSize,
+		ShadowQueue:          defaultShadowQueue,
+		AuditSize:            defaultAuditSize,
+		WALSnapshotInterval:  defaultWALSnapshotInterval,
+		WALRetention:         defaultWALRetention,
+		BackupEndpoint:       "https://s3.amazonaws.com",
+		BackupRegion:         "us-east-1",
+		BackupPrefix:         "kv-backups/",
+		BackupRetain:         7,
+		RaftElectionTimeout:  time.Second,
+		ReadConsistency:      readLocal,
+		ConsistencyTokenWait: 500 * time.Millisecond,
+		ShardVNodes:          defaultShardVNodes,
+		DiscoveryInterval:    defaultDiscoveryInterval,
+		RegistrationInterval: defaultRegistrationInterval,
+		RebalanceRate:        defaultRebalanceRate,
+		MirrorBatch:          defaultMirrorBatch,
+		AuthCacheTTL:         defaultAuthCacheTTL,
+		SigningWindow:        defaultSigningWindow,
+		BloomFPRate:          defaultBloomFPRate,
+		AuthLockoutWindow:    defaultLockoutWindow,
+		AuthLockoutDuration:  defaultLockoutDuration,
+		AuthLockoutMax:       defaultLockoutMax,
+		TokenAdminScope:      "admin",
+		TokenTTL:             defaultTokenTTL,
+		TokenMaxTTL:          defaultTokenMaxTTL,
+		IdempotencyWindow:    24 * time.Hour,
+	}
+}
+
+// PrefixURL pairs a key prefix with a webhook URL.
+type PrefixURL struct {
+	Prefix string
+	URL    string
+}
+
+// PrefixURLList holds prefix/URL pairs. It implements flag.Value, parsing
+// repeated "prefix=URL" arguments.
+type PrefixURLList []PrefixURL
+
+func (f *PrefixURLList) String() string {
+	parts := make([]string, len(*f))
+	for i, h := range *f {
+		parts[i] = h.Prefix + "=" + h.URL
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *PrefixURLList) Set(v string) error {
+	prefix, url, ok := strings.Cut(v, "=")
+	if !ok || url == "" {
+		return fmt.Errorf("webhook %q must be in prefix=URL form", v)
+	}
+	*f = append(*f, PrefixURL{Prefix: prefix, URL: url})
+	return nil
+}
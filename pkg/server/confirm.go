@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// confirmHeader carries the token that confirms a destructive operation.
+const confirmHeader = "X-Confirm-Token"
+
+// defaultConfirmWindow is how long a confirmation token is valid by
+// default.
+const defaultConfirmWindow = time.Minute
+
+// pendingConfirm is a destructive operation waiting to be confirmed.
+type pendingConfirm struct {
+	op      string
+	subject string
+	client  string
+	impact  map[string]interface{}
+	expires time.Time
+}
+
+// confirmations are the tokens handed out for destructive operations:
+// flushes, prefix deletes and restores from backup. The first request
+// for one is answered 202 with a summary of what it would do and a
+// token; repeating it with the token in X-Confirm-Token within the window
+// carries it out. A token confirms one operation, on the same target, by
+// the same client, once. Tokens are held by the node that issued them.
+type confirmations struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]pendingConfirm
+}
+
+func newConfirmations(cfg Config) *confirmations {
+	if !cfg.ConfirmDestructive {
+		return nil
+	}
+	window := cfg.ConfirmWindow
+	if window <= 0 {
+		window = defaultConfirmWindow
+	}
+	return &confirmations{window: window, pending: make(map[string]pendingConfirm)}
+}
+
+// issue returns a new token for p, valid for the window.
+func (c *confirmations) issue(p pendingConfirm, now time.Time) (string, time.Time) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	p.expires = now.Add(c.window)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for t, q := range c.pending {
+		if now.After(q.expires) {
+			delete(c.pending, t)
+		}
+	}
+	c.pending[token] = p
+	return token, p.expires
+}
+
+// redeem consumes token if it was issued for p and has not expired,
+// returning the impact it was issued with.
+func (c *confirmations) redeem(token string, p pendingConfirm, now time.Time) (map[string]interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q, ok := c.pending[token]
+	if !ok || now.After(q.expires) {
+		return nil, false
+	}
+	if q.op != p.op || q.subject != p.subject || q.client != p.client {
+		return nil, false
+	}
+	delete(c.pending, token)
+	return q.impact, true
+}
+
+// confirmed reports whether the destructive operation op on subject may
+// go ahead. When confirmation is required and the request carries no
+// valid token, it answers the request, with a token and impact, a summary
+// of what the operation would do, or with an error, and returns false.
+// A confirmed request gets back the impact the token was issued with, so
+// that it carries out what was summarized.
+func (s *Server) confirmed(w http.ResponseWriter, r *http.Request, op, subject string, impact map[string]interface{}) (map[string]interface{}, bool) {
+	if s.confirms == nil {
+		return impact, true
+	}
+	p := pendingConfirm{op: op, subject: subject, client: clientIDFrom(r.Context()), impact: impact}
+	now := time.Now()
+	if token := r.Header.Get(confirmHeader); token != "" {
+		issued, ok := s.confirms.redeem(token, p, now)
+		if !ok {
+			writeError(w, r, http.StatusConflict, codeConfirmInvalid, "Confirmation token is unknown, expired or for another operation")
+			return nil, false
+		}
+		s.logger.Printf("%s confirmed %s of %s", clientKey(r), op, subject)
+		return issued, true
+	}
+	token, expires := s.confirms.issue(p, now)
+	redactRecording(r.Context())
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":        "confirmation_required",
+		"operation":     op,
+		"impact":        impact,
+		"confirm_token": token,
+		"expires_at":    expires.UTC(),
+	})
+	return nil, false
+}
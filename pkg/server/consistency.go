@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// consistencyTokenHeader is returned on every successful write with the
+// position this node's replicated state had reached once the write was
+// made. A read sending it back is only served by a node that has applied
+// at least as much, so a client reads its own writes from any replica.
+const consistencyTokenHeader = "X-Consistency-Token"
+
+// raftTokenPrefix starts the tokens of a Raft group, which are followed by
+// a log index. Tokens of a primary are its replication epoch, a dot and a
+// sequence number.
+const raftTokenPrefix = "raft."
+
+// consistencyToken returns the token for everything this node has
+// applied, or "" if it has no replicated state to read behind.
+func (s *Server) consistencyToken() string {
+	if s.raft != nil {
+		return raftTokenPrefix + strconv.FormatUint(s.raft.appliedIndex(), 10)
+	}
+	if rl := s.namespaces.replication; rl != nil && s.replica.Load() == nil {
+		return rl.epoch + "." + strconv.FormatUint(rl.head(), 10)
+	}
+	return ""
+}
+
+// withConsistencyToken sets X-Consistency-Token on successful writes.
+func (s *Server) withConsistencyToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&tokenWriter{ResponseWriter: w, s: s}, r)
+	})
+}
+
+// tokenWriter adds the consistency token to a 2xx response as its header
+// is written, which is after the handler has made its writes.
+type tokenWriter struct {
+	http.ResponseWriter
+	s           *Server
+	wroteHeader bool
+}
+
+func (w *tokenWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status >= 200 && status < 300 {
+			if tok := w.s.consistencyToken(); tok != "" {
+				w.Header().Set(consistencyTokenHeader, tok)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *tokenWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *tokenWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// awaitToken holds a read carrying a consistency token until this node has
+// applied what the token covers, for up to ConsistencyTokenWait. A node
+// still behind then sends the read to the Raft leader or the primary,
+// which are never behind their own writes, and awaitToken returns false
+// with the response written.
+func (s *Server) awaitToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	// A wait of 0 serves the read here only if this node is caught up.
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ConsistencyTokenWait)
+	defer cancel()
+	switch {
+	case s.raft != nil:
+		index, err := strconv.ParseUint(strings.TrimPrefix(token, raftTokenPrefix), 10, 64)
+		if err != nil || !strings.HasPrefix(token, raftTokenPrefix) {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid "+consistencyTokenHeader)
+			return false
+		}
+		if s.raft.waitApplied(ctx, index) {
+			return true
+		}
+		if s.raft.isLeader() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, codeNotCaughtUp, "The write of the consistency token is not applied yet")
+			return false
+		}
+		s.redirectToLeader(w, r)
+		return false
+	case s.replica.Load() != nil:
+		epoch, seqText, ok := strings.Cut(token, ".")
+		seq, err := strconv.ParseUint(seqText, 10, 64)
+		if !ok || err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid "+consistencyTokenHeader)
+			return false
+		}
+		if rp := s.replica.Load(); rp == nil || rp.waitApplied(ctx, epoch, seq) {
+			return true
+		}
+		s.redirectUpstream(w, r)
+		return false
+	}
+	// A primary or a standalone node has made every write it answered.
+	return true
+}
+
+// appliedIndex returns the index of the last entry applied on this node.
+func (n *raftNode) appliedIndex() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.applied
+}
+
+// waitApplied reports whether this node applies the entry at index before
+// ctx is done.
+func (n *raftNode) waitApplied(ctx context.Context, index uint64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.waitLocked(ctx, func() bool { return n.applied >= index }) == nil
+}
+
+// waitApplied reports whether the replica applies the primary's mutation
+// seq of epoch before ctx is done. Mutations of another epoch, from an
+// earlier or later primary process, cannot be compared and are never
+// waited for.
+func (rp *replica) waitApplied(ctx context.Context, epoch string, seq uint64) bool {
+	for {
+		rp.mu.Lock()
+		if rp.epoch != epoch {
+			rp.mu.Unlock()
+			return false
+		}
+		if rp.applied >= seq {
+			rp.mu.Unlock()
+			return true
+		}
+		ch := rp.changed
+		rp.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// advancedLocked wakes the reads waiting for the replica to catch up.
+func (rp *replica) advancedLocked() {
+	close(rp.changed)
+	rp.changed = make(chan struct{})
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// timedMutex is a mutex whose acquisitions can be counted towards lock
+// contention statistics and a request's lock wait. Lock and Unlock work as
+// on a plain mutex; lock(ctx) is the instrumented way in.
+type timedMutex struct {
+	sync.Mutex
+	name  string
+	stats *lockStats // nil unless Config.LockStats is set
+	// queue, if set, counts the acquisitions waiting for m, for admission
+	// control.
+	queue *atomic.Int64
+}
+
+// lock acquires m on behalf of the request ctx belongs to, if any. Only
+// contended acquisitions are timed: an uncontended one costs a TryLock.
+func (m *timedMutex) lock(ctx context.Context) {
+	t := timingFrom(ctx)
+	if m.stats == nil && t == nil && m.queue == nil {
+		m.Lock()
+		return
+	}
+	var wait time.Duration
+	contended := !m.TryLock()
+	if contended {
+		start := time.Now()
+		if m.queue != nil {
+			m.queue.Add(1)
+		}
+		m.Lock()
+		if m.queue != nil {
+			m.queue.Add(-1)
+		}
+		wait = time.Since(start)
+		t.addLockWait(wait)
+	}
+	m.stats.record(m.name, t.routeName(), contended, wait)
+}
+
+// lockCounters are the figures kept for a lock and for a route.
+type lockCounters struct {
+	acquisitions atomic.Int64
+	contended    atomic.Int64
+	waitNS       atomic.Int64
+	maxWaitNS    atomic.Int64
+}
+
+func (c *lockCounters) add(contended bool, wait time.Duration) {
+	c.acquisitions.Add(1)
+	if !contended {
+		return
+	}
+	c.contended.Add(1)
+	c.waitNS.Add(int64(wait))
+	for {
+		max := c.maxWaitNS.Load()
+		if int64(wait) <= max || c.maxWaitNS.CompareAndSwap(max, int64(wait)) {
+			return
+		}
+	}
+}
+
+// lockCounterStats is a lockCounters in /stats. Waits are in nanoseconds.
+type lockCounterStats struct {
+	Acquisitions int64 `json:"acquisitions"`
+	Contended    int64 `json:"contended"`
+	WaitNS       int64 `json:"wait_ns"`
+	MaxWaitNS    int64 `json:"max_wait_ns"`
+}
+
+func (c *lockCounters) stats() lockCounterStats {
+	return lockCounterStats{
+		Acquisitions: c.acquisitions.Load(),
+		Contended:    c.contended.Load(),
+		WaitNS:       c.waitNS.Load(),
+		MaxWaitNS:    c.maxWaitNS.Load(),
+	}
+}
+
+// lockStats counts how often the server's mutexes are acquired and how
+// long acquisitions wait, per lock and per route. Acquisitions made
+// outside a request, by the background worker, are counted under
+// "background".
+type lockStats struct {
+	locks  sync.Map // lock name -> *lockCounters
+	routes sync.Map // "METHOD /path" -> *lockCounters
+}
+
+func newLockStats() *lockStats {
+	return &lockStats{}
+}
+
+func (ls *lockStats) record(lock, route string, contended bool, wait time.Duration) {
+	if ls == nil {
+		return
+	}
+	counters(&ls.locks, lock).add(contended, wait)
+	counters(&ls.routes, route).add(contended, wait)
+}
+
+func counters(m *sync.Map, name string) *lockCounters {
+	if c, ok := m.Load(name); ok {
+		return c.(*lockCounters)
+	}
+	c, _ := m.LoadOrStore(name, &lockCounters{})
+	return c.(*lockCounters)
+}
+
+// stats is the "lock_contention" section of /stats.
+func (ls *lockStats) stats() map[string]interface{} {
+	collect := func(m *sync.Map) map[string]lockCounterStats {
+		out := make(map[string]lockCounterStats)
+		m.Range(func(name, c interface{}) bool {
+			out[name.(string)] = c.(*lockCounters).stats()
+			return true
+		})
+		return out
+	}
+	locks := collect(&ls.locks)
+	var total lockCounterStats
+	for _, c := range locks {
+		total.Acquisitions += c.Acquisitions
+		total.Contended += c.Contended
+		total.WaitNS += c.WaitNS
+		if c.MaxWaitNS > total.MaxWaitNS {
+			total.MaxWaitNS = c.MaxWaitNS
+		}
+	}
+	return map[string]interface{}{
+		"total":    total,
+		"locks":    locks,
+		"by_route": collect(&ls.routes),
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCORSMethods are the methods preflights are told are allowed when
+// CORSMethods is empty.
+var defaultCORSMethods = []string{"GET", "HEAD", "PUT", "POST", "PATCH", "DELETE"}
+
+// corsExposedHeaders are the response headers scripts on other origins may
+// read.
+var corsExposedHeaders = strings.Join([]string{
+	"X-Request-Id", "X-Revision", "X-Value-Length", "X-Range-Next", "X-Shard-Node",
+	"ETag", "Retry-After", "Idempotent-Replayed", "X-Total-Count", "X-Data-Version",
+}, ", ")
+
+// withCORS adds CORS headers to responses to the allowed origins ("*" for
+// any) and answers their preflight requests itself, allowing methods (by
+// default the API's) and headers (by default whichever the preflight asks
+// for); browsers may cache the answer for maxAge. It runs ahead of authentication and rate limiting, since browsers
+// send preflights without credentials.
+func withCORS(origins, methods, headers []string, maxAge time.Duration) Middleware {
+	if len(origins) == 0 {
+		return nil
+	}
+	anyOrigin := slices.Contains(origins, "*")
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if !anyOrigin && !slices.Contains(origins, origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if anyOrigin {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+
+			if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+				h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+				next.ServeHTTP(w, r)
+				return
+			}
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", allowMethods)
+			if allowHeaders != "" {
+				h.Set("Access-Control-Allow-Headers", allowHeaders)
+			} else if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+				h.Set("Access-Control-Allow-Headers", req)
+			}
+			if maxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge/time.Second)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
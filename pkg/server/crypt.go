@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted files start with encMagic, then a one-byte key ID length, the
+// key ID, a GCM nonce and the sealed data. The magic and key ID are
+// authenticated along with the data.
+const encMagic = "KVE1"
+
+// keyRing holds the AES-256 keys used to encrypt persisted data. Data is
+// always sealed with the primary key; the others only open data written
+// before a rotation, which is re-encrypted with the primary key the next
+// time it is saved.
+type keyRing struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// loadKeyRing builds a key ring from a key file and/or a single key given
+// directly, typically from the environment. The file holds one key per
+// line, as "id:KEY" or a bare KEY, where KEY is 32 bytes in base64 or hex;
+// blank lines and # comments are skipped. The first key is the primary.
+// A bare key's ID is derived from its hash. It returns nil if no key is
+// given.
+func loadKeyRing(file, key string) (*keyRing, error) {
+	var lines []string
+	if key != "" {
+		lines = append(lines, key)
+	}
+	if file != "" {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, strings.Split(string(buf), "\n")...)
+	}
+	kr := &keyRing{keys: make(map[string]cipher.AEAD)}
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, material, ok := strings.Cut(line, ":")
+		if !ok {
+			id, material = "", line
+		}
+		id = strings.TrimSpace(id)
+		if len(id) > 64 {
+			return nil, fmt.Errorf("encryption key %d: ID longer than 64 bytes", i+1)
+		}
+		raw, err := decodeKey(strings.TrimSpace(material))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d: %w", i+1, err)
+		}
+		if id == "" {
+			sum := sha256.Sum256(raw)
+			id = hex.EncodeToString(sum[:4])
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := kr.keys[id]; dup {
+			return nil, fmt.Errorf("duplicate encryption key ID %q", id)
+		}
+		kr.keys[id] = aead
+		if kr.primary == "" {
+			kr.primary = id
+		}
+	}
+	if kr.primary == "" {
+		return nil, nil
+	}
+	return kr, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if raw, err := hex.DecodeString(s); err == nil && len(raw) == 32 {
+		return raw, nil
+	}
+	if raw, err := base64.StdEncoding.DecodeString(s); err == nil && len(raw) == 32 {
+		return raw, nil
+	}
+	return nil, errors.New("key must be 32 bytes, base64 or hex encoded")
+}
+
+func (kr *keyRing) header(id string) []byte {
+	return append(append([]byte(encMagic), byte(len(id))), id...)
+}
+
+// seal encrypts plain with the primary key.
+func (kr *keyRing) seal(plain []byte) []byte {
+	aead := kr.keys[kr.primary]
+	hdr := kr.header(kr.primary)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	out := append(hdr, nonce...)
+	return aead.Seal(out, nonce, plain, hdr)
+}
+
+// open decrypts data written by seal with any key in the ring, returning
+// the ID of the key used.
+func (kr *keyRing) open(data []byte) (plain []byte, id string, err error) {
+	if !isEncrypted(data) || len(data) < len(encMagic)+1 {
+		return nil, "", errors.New("not an encrypted file")
+	}
+	n := int(data[len(encMagic)])
+	rest := data[len(encMagic)+1:]
+	if len(rest) < n {
+		return nil, "", errors.New("truncated encrypted file")
+	}
+	id = string(rest[:n])
+	if kr == nil {
+		return nil, id, fmt.Errorf("file is encrypted with key %q but no encryption key is configured", id)
+	}
+	aead, ok := kr.keys[id]
+	if !ok {
+		return nil, id, fmt.Errorf("file is encrypted with unknown key %q", id)
+	}
+	rest = rest[n:]
+	if len(rest) < aead.NonceSize() {
+		return nil, id, errors.New("truncated encrypted file")
+	}
+	hdr := data[:len(encMagic)+1+n]
+	plain, err = aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], hdr)
+	if err != nil {
+		return nil, id, fmt.Errorf("decrypt with key %q: %w", id, err)
+	}
+	return plain, id, nil
+}
+
+// isEncrypted reports whether data was written by keyRing.seal.
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encMagic))
+}
+
+// flushWriter is a buffered writer: a bufio.Writer, or a sealedWriter.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// sealedChunk is how much a sealedWriter buffers before it seals a frame
+// of its own accord.
+const sealedChunk = 64 << 10
+
+// sealedWriter encrypts a file that is appended to, such as a log, as a
+// series of frames: each is its length, 4 bytes big endian, then what was
+// written since the last one, sealed with the primary key of kr. A frame
+// is written on Flush, and once sealedChunk is buffered, so each flushed
+// record can be read back on its own even if the file is cut short later.
+type sealedWriter struct {
+	kr  *keyRing
+	w   *bufio.Writer
+	buf bytes.Buffer
+}
+
+func newSealedWriter(kr *keyRing, w *bufio.Writer) *sealedWriter {
+	return &sealedWriter{kr: kr, w: w}
+}
+
+func (sw *sealedWriter) Write(p []byte) (int, error) {
+	n, _ := sw.buf.Write(p)
+	if sw.buf.Len() >= sealedChunk {
+		return n, sw.seal()
+	}
+	return n, nil
+}
+
+// Flush seals what is buffered and flushes the underlying writer.
+func (sw *sealedWriter) Flush() error {
+	if err := sw.seal(); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+func (sw *sealedWriter) seal() error {
+	if sw.buf.Len() == 0 {
+		return nil
+	}
+	frame := sw.kr.seal(sw.buf.Bytes())
+	sw.buf.Reset()
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(frame)))
+	if _, err := sw.w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(frame)
+	return err
+}
+
+// sealedReader reads what a sealedWriter wrote. It returns io.EOF at the
+// end of the last frame and io.ErrUnexpectedEOF within one cut short, as
+// a crash while it was written leaves it.
+type sealedReader struct {
+	kr   *keyRing
+	r    io.Reader
+	left []byte
+}
+
+func newSealedReader(kr *keyRing, r io.Reader) *sealedReader {
+	return &sealedReader{kr: kr, r: r}
+}
+
+func (sr *sealedReader) Read(p []byte) (int, error) {
+	for len(sr.left) == 0 {
+		var size [4]byte
+		if _, err := io.ReadFull(sr.r, size[:]); err != nil {
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n > maxRecordSize {
+			return 0, fmt.Errorf("sealed frame of %d bytes is too large", n)
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(sr.r, frame); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		plain, _, err := sr.kr.open(frame)
+		if err != nil {
+			return 0, err
+		}
+		sr.left = plain
+	}
+	n := copy(p, sr.left)
+	sr.left = sr.left[n:]
+	return n, nil
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvMaxProblems bounds the problems and warnings listed in a CSV import
+// report; the counts cover them all.
+const csvMaxProblems = 100
+
+// Codes of the problems a CSV import reports, besides the field codes of
+// checkPayload.
+const (
+	csvBadRow       = "bad_row"
+	csvInvalidTTL   = "invalid_ttl"
+	csvDuplicateKey = "duplicate_key"
+)
+
+// csvProblem is a row of a CSV import that is rejected or, as a warning,
+// imported other than as written. Line is the line the row starts on.
+type csvProblem struct {
+	Line   int    `json:"line"`
+	Key    string `json:"key,omitempty"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// csvReport is the validation report of a CSV import.
+type csvReport struct {
+	Header   bool         `json:"header"`
+	Rows     int          `json:"rows"`
+	Invalid  int          `json:"invalid"`
+	Problems []csvProblem `json:"problems,omitempty"`
+	Warnings []csvProblem `json:"warnings,omitempty"`
+}
+
+func (rep *csvReport) problem(p csvProblem) {
+	rep.Invalid++
+	if len(rep.Problems) < csvMaxProblems {
+		rep.Problems = append(rep.Problems, p)
+	}
+}
+
+func (rep *csvReport) warn(p csvProblem) {
+	if len(rep.Warnings) < csvMaxProblems {
+		rep.Warnings = append(rep.Warnings, p)
+	}
+}
+
+// isCSVHeader reports whether the first row of a CSV import names its
+// columns rather than holding a key.
+func isCSVHeader(row []string) bool {
+	if len(row) < 2 || len(row) > 3 {
+		return false
+	}
+	names := []string{"key", "value", "ttl"}
+	for i, f := range row {
+		if strings.ToLower(strings.TrimSpace(f)) != names[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTTL reads the ttl column: seconds, or a Go duration such as "1h".
+func parseTTL(v string) (time.Duration, error) {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if n < 0 {
+			return 0, errors.New("ttl must not be negative")
+		}
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("ttl %q is neither seconds nor a duration", v)
+	}
+	return d, nil
+}
+
+// readCSVImport reads a CSV import of key,value[,ttl] rows, as a
+// spreadsheet saves them: a first row of column names is skipped, and so
+// is a UTF-8 byte order mark. Every row is checked against the key rules,
+// the value size limit and the schemas before anything is written, and
+// the entries are only returned if none is rejected. A ttl gives the key a
+// fixed expiry; an empty or zero one leaves it without.
+func (s *Server) readCSVImport(body io.Reader) ([]snapshotEntry, csvReport, error) {
+	var rep csvReport
+	br := bufio.NewReader(body)
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	var entries []snapshotEntry
+	seen := make(map[string]int) // key -> line of its first row
+	for first := true; ; first = false {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// The reader cannot resynchronise after a quoting error.
+			line := 0
+			var pe *csv.ParseError
+			if errors.As(err, &pe) {
+				line = pe.StartLine
+			}
+			rep.Rows++
+			rep.problem(csvProblem{Line: line, Code: csvBadRow, Reason: err.Error()})
+			break
+		}
+		line, _ := cr.FieldPos(0)
+		if first && isCSVHeader(row) {
+			rep.Header = true
+			continue
+		}
+		rep.Rows++
+		if len(row) != 2 && len(row) != 3 {
+			rep.problem(csvProblem{Line: line, Code: csvBadRow, Reason: fmt.Sprintf("want 2 or 3 columns (key,value[,ttl]), got %d", len(row))})
+			continue
+		}
+		key, value := s.keyRules.canonical(row[0]), row[1]
+		if fields := s.checkPayload(map[string]string{key: value}); len(fields) > 0 {
+			rep.problem(csvProblem{Line: line, Key: key, Code: fields[0].Code, Reason: fields[0].Reason})
+			continue
+		}
+		if err := s.schemas.Validate(key, value); err != nil {
+			rep.problem(csvProblem{Line: line, Key: key, Code: codeValidationFailed, Reason: messageForError(err)})
+			continue
+		}
+		var ttl time.Duration
+		if len(row) == 3 && strings.TrimSpace(row[2]) != "" {
+			var err error
+			if ttl, err = parseTTL(strings.TrimSpace(row[2])); err != nil {
+				rep.problem(csvProblem{Line: line, Key: key, Code: csvInvalidTTL, Reason: err.Error()})
+				continue
+			}
+		}
+		if prev, dup := seen[key]; dup {
+			rep.warn(csvProblem{Line: line, Key: key, Code: csvDuplicateKey, Reason: fmt.Sprintf("also on line %d; the last row wins", prev)})
+		} else {
+			seen[key] = line
+		}
+		entries = append(entries, snapshotEntry{Key: key, Value: value, TTL: ttl})
+	}
+	if rep.Invalid > 0 {
+		return nil, rep, fmt.Errorf("%d of %d rows rejected; nothing was imported", rep.Invalid, rep.Rows)
+	}
+	return entries, rep, nil
+}
+
+// sliceEntries returns a reader of entries, for importEntries.
+func sliceEntries(entries []snapshotEntry) func() (snapshotEntry, error) {
+	return func() (snapshotEntry, error) {
+		if len(entries) == 0 {
+			return snapshotEntry{}, io.EOF
+		}
+		e := entries[0]
+		entries = entries[1:]
+		return e, nil
+	}
+}
+
+// writeCSV writes snap as key,value rows under a header row.
+func writeCSV(w io.Writer, snap *Snapshot) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"key", "value"})
+	snap.Range(func(k, v string) bool {
+		return cw.Write([]string{k, v}) == nil
+	})
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// dataLockName is the name Upgrade hands the lock on the data file to the
+// new process under.
+const dataLockName = "datalock"
+
+// errLocked is returned by tryLock for a file another process has locked.
+var errLocked = errors.New("locked by another process")
+
+// lockDataFile locks path, the data file, against a second server loading
+// and overwriting it, with a lock on path.lock that the system releases
+// when this process exits, however it does. The lock file holds the PID of
+// the holder and is left in place. A process started by Upgrade inherits
+// the lock of the one it takes over from.
+func lockDataFile(path string) (*os.File, error) {
+	f, err := inheritedFile(dataLockName)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		if f, err = os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o644); err != nil {
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		if err := tryLock(f); err != nil {
+			defer f.Close()
+			if errors.Is(err, errLocked) {
+				return nil, fmt.Errorf("%s is in use by another server%s; stop it, or give this one another -data-file", path, lockHolder(f))
+			}
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
+
+// lockHolder names the process that wrote its PID to the lock file f, as
+// " (process PID)", or returns "" if it did not.
+func lockHolder(f *os.File) string {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(buf[:n])))
+	if err != nil || pid <= 0 {
+		return ""
+	}
+	return " (process " + strconv.Itoa(pid) + ")"
+}
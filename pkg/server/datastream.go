@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// streamBufferSize is how much of a streamed listing is buffered before it
+// is sent, as a chunk of the response.
+const streamBufferSize = 32 << 10
+
+// wantsNDJSON reports whether a listing should be streamed as NDJSON: with
+// ?format=ndjson, or application/x-ndjson listed in Accept before any
+// other format the server knows.
+func wantsNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, _ := strings.Cut(part, ";")
+		if strings.EqualFold(strings.TrimSpace(mt), "application/x-ndjson") {
+			return true
+		}
+		if _, ok := parseFormat(mt); ok {
+			return false
+		}
+	}
+	return false
+}
+
+// streamedListing reports whether r, a GET of /data, is a full listing
+// that streamListing answers. Such a listing moves the whole dataset, so
+// like /export it is exempt from the request timeout, which would buffer
+// it.
+func streamedListing(r *http.Request) bool {
+	q := r.URL.Query()
+	fields, msg := parseListFields(q)
+	if msg != "" || fields.meta || q.Has("sort") || q.Has("from") || q.Has("to") || q.Get("watch") == "true" {
+		return false
+	}
+	return wantsNDJSON(r) || responseFormat(r) == formatJSON
+}
+
+// streamListing answers GET /data from snap, writing each entry as it is
+// read rather than building the whole document first, so that listing a
+// large store needs memory for a buffer and not for a copy of every value.
+// The JSON body is the same object, or with keysOnly array, as before;
+// with NDJSON, each line is {"key":...,"value":...}, or {"key":...}.
+// reveal, if set, gives the value served for a stored one.
+func streamListing(w http.ResponseWriter, snap *Snapshot, keysOnly, ndjson bool, reveal func(key, value string) string) {
+	bw := bufio.NewWriterSize(w, streamBufferSize)
+	defer bw.Flush()
+	w.Header().Add("Vary", "Accept")
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(bw)
+		snap.Range(func(k, v string) bool {
+			if keysOnly {
+				return enc.Encode(struct {
+					Key string `json:"key"`
+				}{k}) == nil
+			}
+			if reveal != nil {
+				v = reveal(k, v)
+			}
+			return enc.Encode(snapshotEntry{Key: k, Value: v}) == nil
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	start, end := byte('{'), "}\n"
+	if keysOnly {
+		start, end = '[', "]\n"
+	}
+	bw.WriteByte(start)
+	sep := false
+	snap.Range(func(k, v string) bool {
+		if sep {
+			bw.WriteByte(',')
+		}
+		sep = true
+		key, _ := json.Marshal(k)
+		if _, err := bw.Write(key); err != nil || keysOnly {
+			return err == nil
+		}
+		if reveal != nil {
+			v = reveal(k, v)
+		}
+		value, _ := json.Marshal(v)
+		bw.WriteByte(':')
+		_, err := bw.Write(value)
+		return err == nil
+	})
+	bw.WriteString(end)
+}
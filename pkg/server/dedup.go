@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultDedupMinSize is the smallest value deduplicated by default;
+// below it the bookkeeping costs about as much as a copy.
+const defaultDedupMinSize = 256
+
+// sharedValue is a value held once for every key that stores it.
+type sharedValue struct {
+	digest [sha256.Size]byte
+	stored string // as the codec left it
+	packed bool
+	sum    uint32
+	refs   int // guarded by dedupPool.mu
+}
+
+// dedupPool stores identical values once, counting the keys that refer to
+// each. Values are matched by the SHA-256 of their contents, before
+// compression, so a value already held is not compressed again. Values
+// shorter than minSize are stored as usual. It is safe for concurrent use
+// and shared by every namespace.
+type dedupPool struct {
+	minSize int
+
+	mu     sync.Mutex
+	values map[[sha256.Size]byte]*sharedValue
+	refs   int   // references to the values
+	saved  int64 // bytes not stored thanks to sharing
+
+	hits   atomic.Int64 // writes that found their value held
+	misses atomic.Int64
+}
+
+// dedupStats is the "dedup" entry of /stats.
+type dedupStats struct {
+	MinSize    int   `json:"min_size"`
+	Values     int   `json:"values"`
+	References int   `json:"references"`
+	BytesSaved int64 `json:"bytes_saved"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+}
+
+func newDedupPool(enabled bool, minSize int) *dedupPool {
+	if !enabled {
+		return nil
+	}
+	if minSize <= 0 {
+		minSize = defaultDedupMinSize
+	}
+	return &dedupPool{minSize: minSize, values: make(map[[sha256.Size]byte]*sharedValue)}
+}
+
+// intern returns the shared copy of value, encoded with codec when it is
+// first stored, holding a reference to it for the caller. It returns nil
+// for values the pool does not take, and a nil pool takes none.
+func (p *dedupPool) intern(value string, codec *valueCodec) *sharedValue {
+	if p == nil || len(value) < p.minSize {
+		return nil
+	}
+	digest := sha256.Sum256([]byte(value))
+	if sv := p.acquire(digest); sv != nil {
+		p.hits.Add(1)
+		return sv
+	}
+	// Compress outside the lock; if another writer stored the same value
+	// meanwhile, its copy wins.
+	stored, packed := codec.encode(value)
+	sv := &sharedValue{digest: digest, stored: stored, packed: packed, sum: checksum(stored)}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if held := p.values[digest]; held != nil {
+		p.refLocked(held)
+		p.hits.Add(1)
+		return held
+	}
+	p.misses.Add(1)
+	p.values[digest] = sv
+	p.refLocked(sv)
+	return sv
+}
+
+func (p *dedupPool) acquire(digest [sha256.Size]byte) *sharedValue {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sv := p.values[digest]
+	if sv != nil {
+		p.refLocked(sv)
+	}
+	return sv
+}
+
+func (p *dedupPool) refLocked(sv *sharedValue) {
+	if sv.refs > 0 {
+		p.saved += int64(len(sv.stored))
+	}
+	sv.refs++
+	p.refs++
+}
+
+// release drops a reference to sv, forgetting the value with the last
+// one. A nil sv is ignored.
+func (p *dedupPool) release(sv *sharedValue) {
+	if sv == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sv.refs--
+	p.refs--
+	if sv.refs > 0 {
+		p.saved -= int64(len(sv.stored))
+	} else {
+		delete(p.values, sv.digest)
+	}
+}
+
+func (p *dedupPool) stats() dedupStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return dedupStats{
+		MinSize:    p.minSize,
+		Values:     len(p.values),
+		References: p.refs,
+		BytesSaved: p.saved,
+		Hits:       p.hits.Load(),
+		Misses:     p.misses.Load(),
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// recentErrorCount is how many failed requests a diagnostic report lists.
+const recentErrorCount = 50
+
+// recentError is a request that was answered with a 4xx or 5xx status.
+type recentError struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// errorRing keeps the most recent failed requests, oldest first.
+type errorRing struct {
+	mu   sync.Mutex
+	buf  [recentErrorCount]recentError
+	next int
+	n    int
+}
+
+func (e *errorRing) add(re recentError) {
+	e.mu.Lock()
+	e.buf[e.next] = re
+	e.next = (e.next + 1) % len(e.buf)
+	e.n = min(e.n+1, len(e.buf))
+	e.mu.Unlock()
+}
+
+func (e *errorRing) all() []recentError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]recentError, 0, e.n)
+	for i := 0; i < e.n; i++ {
+		out = append(out, e.buf[(e.next-e.n+i+len(e.buf))%len(e.buf)])
+	}
+	return out
+}
+
+const redacted = "[redacted]"
+
+// redactedConfig returns cfg with its secrets blanked out.
+func redactedConfig(cfg Config) Config {
+	for _, p := range []*string{&cfg.RaftSecret, &cfg.ReplicaAPIKey, &cfg.WebhookSecret,
+		&cfg.BackupAccessKey, &cfg.BackupSecretKey, &cfg.EncryptionKey, &cfg.MirrorAPIKey, &cfg.AuthOIDCClientSecret, &cfg.TokenSecret} {
+		if *p != "" {
+			*p = redacted
+		}
+	}
+	for _, p := range []*APIKeys{&cfg.APIKeys, &cfg.SigningKeys, &cfg.AdminAPIKeys} {
+		if len(*p) > 0 {
+			keys := make(APIKeys, len(*p))
+			for name := range *p {
+				keys[name] = redacted
+			}
+			*p = keys
+		}
+	}
+	return cfg
+}
+
+// DumpDiagnostics writes a report of the server's state to a timestamped
+// file in Config.DiagnosticsDir and returns its path. The report holds the
+// build, current stats, the configuration with secrets removed, the hot
+// keys, the background jobs, the most recent failed requests and the stack
+// of every goroutine. It is safe to call while the server is serving, and
+// meant for capturing the state of an instance that has stopped making
+// progress without restarting it.
+func (s *Server) DumpDiagnostics() (string, error) {
+	dir := s.cfg.DiagnosticsDir
+	if dir == "" {
+		return "", errors.New("diagnostics directory is not configured")
+	}
+	now := time.Now().UTC()
+
+	s.mu.lock(context.Background())
+	stats := s.snapshotLocked()
+	s.mu.Unlock()
+	report := map[string]interface{}{
+		"time":          now,
+		"build":         currentBuild(),
+		"uptime":        now.Sub(s.started).Round(time.Second).String(),
+		"stats":         stats,
+		"runtime":       s.runtimeStats(),
+		"config":        redactedConfig(s.cfg),
+		"jobs":          s.jobs.statuses(),
+		"recent_errors": s.recentErrors.all(),
+		"maintenance":   s.maintenance.get(),
+	}
+	if t := s.hotKeys; t != nil {
+		t.mu.Lock()
+		t.bucketLocked(now)
+		report["hot_keys"] = map[string][]hotKey{
+			"reads":  t.topLocked(now, 20, func(b *hotKeyBucket) *hotKeySet { return &b.reads }),
+			"writes": t.topLocked(now, 20, func(b *hotKeyBucket) *hotKeySet { return &b.writes }),
+		}
+		t.mu.Unlock()
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return "", err
+	}
+	buf.WriteString("\n--- goroutines ---\n\n")
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "kv-diagnostics-"+now.Format("20060102T150405.000Z")+".txt")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		return "", err
+	}
+	s.logger.Printf("Wrote diagnostic report to %s", path)
+	return path, nil
+}
+
+// POST
+//
+// diagnosticsHandler writes a diagnostic report, as SIGUSR1 does, and
+// returns where it was written.
+func (s *Server) diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.DiagnosticsDir == "" {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Diagnostic reports are not enabled")
+		return
+	}
+	path, err := s.DumpDiagnostics()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Diagnostic report failed: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "written", "path": path})
+}
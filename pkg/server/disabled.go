@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DisabledRoutes turns routes off. Each is "METHOD /path" as the route is
+// registered, without the /v1 prefix, e.g. "DELETE /data/{key}"; "/path"
+// for every method of a path, e.g. "/export"; or "METHOD" alone for every
+// route of that method, e.g. "DELETE". Like ConcurrencyLimits, a route
+// also covers its twin under /ns/{namespace}. It implements flag.Value,
+// taking routes separated by commas or repeated.
+type DisabledRoutes []string
+
+func (f *DisabledRoutes) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *DisabledRoutes) Set(v string) error {
+	for _, route := range strings.Split(v, ",") {
+		route = strings.TrimSpace(route)
+		method, path, _ := strings.Cut(route, " ")
+		path = strings.TrimSpace(path)
+		switch {
+		case strings.HasPrefix(route, "/"):
+		case method != "" && path == "":
+			route = strings.ToUpper(method)
+		case method != "" && strings.HasPrefix(path, "/"):
+			route = strings.ToUpper(method) + " " + path
+		default:
+			return fmt.Errorf("disabled route %q must be \"METHOD /path\", \"/path\" or \"METHOD\"", route)
+		}
+		*f = append(*f, route)
+	}
+	return nil
+}
+
+// routeSwitch decides which routes are disabled, and answers requests to
+// them once every route is registered.
+type routeSwitch struct {
+	rules map[string]bool // the configured routes, true once one matched
+	// enabled lists the methods still served on each registered path,
+	// for the Allow header of a disabled route.
+	enabled  map[string][]string
+	active   []string
+	disabled []string
+}
+
+func newRouteSwitch(cfg DisabledRoutes) *routeSwitch {
+	rs := &routeSwitch{rules: make(map[string]bool, len(cfg)), enabled: make(map[string][]string)}
+	for _, route := range cfg {
+		rs.rules[route] = false
+	}
+	return rs
+}
+
+// off reports whether method and path are disabled, recording the route
+// as active or disabled either way.
+func (rs *routeSwitch) off(method, path string) bool {
+	bare := path
+	if rest, ok := strings.CutPrefix(path, "/ns/{namespace}"); ok && rest != "" {
+		bare = rest
+	}
+	off := false
+	for _, rule := range []string{method + " " + bare, bare, method} {
+		if _, ok := rs.rules[rule]; ok {
+			rs.rules[rule] = true
+			off = true
+		}
+	}
+	route := method + " " + path
+	if off {
+		rs.disabled = append(rs.disabled, route)
+	} else {
+		rs.active = append(rs.active, route)
+		rs.enabled[path] = append(rs.enabled[path], method)
+	}
+	return off
+}
+
+// handler answers requests to the disabled route method and path: with
+// 405 and the methods still allowed if the path serves others, or else
+// with 404.
+func (rs *routeSwitch) handler(method, path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if allowed := rs.enabled[path]; len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, r, http.StatusMethodNotAllowed, codeEndpointDisabled, method+" "+path+" is disabled by configuration")
+			return
+		}
+		writeError(w, r, http.StatusNotFound, codeEndpointDisabled, method+" "+path+" is disabled by configuration")
+	}
+}
+
+// unused returns the configured routes that matched no registered route.
+func (rs *routeSwitch) unused() []string {
+	var out []string
+	for rule, used := range rs.rules {
+		if !used {
+			out = append(out, rule)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// routesInfo is the routes section of GET /info.
+type routesInfo struct {
+	Active   []string `json:"active"`
+	Disabled []string `json:"disabled"`
+}
+
+func (rs *routeSwitch) info() routesInfo {
+	info := routesInfo{Active: append([]string{}, rs.active...), Disabled: append([]string{}, rs.disabled...)}
+	sort.Strings(info.Active)
+	sort.Strings(info.Disabled)
+	return info
+}
@@ -0,0 +1,367 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Node discovery modes for Config.Discovery.
+const (
+	discoveryStatic = "static" // the topology file and Peers, never changing
+	discoveryDNS    = "dns"    // the targets of an SRV record
+	discoveryGossip = "gossip" // whoever gossips with the Peers
+)
+
+// defaultDiscoveryInterval is how often the topology is re-resolved or
+// gossiped by default.
+const defaultDiscoveryInterval = 10 * time.Second
+
+// gossipFailRounds is how many intervals a member may go without its
+// heartbeat advancing before the others drop it.
+const gossipFailRounds = 5
+
+// newTopology builds the topology from TopologyFile and, with static
+// discovery, Peers given as "id=url". The node itself must be in one of
+// them or have an AdvertiseURL. A static primary is required unless the
+// nodes elect one, shard the keyspace or are discovered.
+func newTopology(cfg Config) (*topology, error) {
+	mode := cmp.Or(cfg.Discovery, discoveryStatic)
+	switch mode {
+	case discoveryStatic, discoveryDNS, discoveryGossip:
+	default:
+		return nil, fmt.Errorf("invalid discovery mode %q", cfg.Discovery)
+	}
+	staticPeers := mode == discoveryStatic && len(cfg.Peers) > 0
+	if cfg.TopologyFile == "" && !staticPeers && mode == discoveryStatic {
+		return nil, nil
+	}
+	t := &topology{Self: cfg.NodeID}
+	if cfg.TopologyFile != "" {
+		buf, err := os.ReadFile(cfg.TopologyFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(buf, t); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.TopologyFile, err)
+		}
+	}
+	if mode == discoveryStatic {
+		for _, p := range cfg.Peers {
+			id, u, ok := strings.Cut(p, "=")
+			if !ok || id == "" || u == "" {
+				return nil, fmt.Errorf("peer %q must be id=url", p)
+			}
+			if t.node(id) != nil {
+				return nil, fmt.Errorf("node %q is listed twice", id)
+			}
+			t.Nodes = append(t.Nodes, topologyNode{ID: id, URL: u})
+		}
+	}
+	if t.node(t.Self) == nil && t.Self != "" && cfg.AdvertiseURL != "" {
+		t.Nodes = append(t.Nodes, topologyNode{ID: t.Self, URL: cfg.AdvertiseURL})
+	}
+	if t.node(t.Self) == nil {
+		return nil, fmt.Errorf("node %q is not in the topology", t.Self)
+	}
+	if mode == discoveryStatic && cfg.RaftDir == "" && !cfg.Sharding && t.primary() == nil {
+		return nil, errors.New("no primary node defined")
+	}
+	return t, nil
+}
+
+// gossipMember is a node as gossiped. Heartbeat starts at the node's start
+// time in milliseconds and goes up by one every round, so a restarted node
+// is told apart from what is still being said about it before.
+type gossipMember struct {
+	topologyNode
+	Heartbeat uint64 `json:"heartbeat"`
+}
+
+// gossipMessage is the body of POST /cluster/gossip and of its reply: the
+// members the sender knows of.
+type gossipMessage struct {
+	From    string         `json:"from"`
+	Members []gossipMember `json:"members"`
+}
+
+type gossipState struct {
+	member gossipMember
+	seen   time.Time // when its heartbeat last advanced
+}
+
+// discovery keeps the membership of the topology up to date. With DNS it
+// re-resolves an SRV record every interval; with gossip it swaps what it
+// knows of the members with one of them, or a seed, every interval, and
+// drops those whose heartbeat stops. Every change is logged.
+type discovery struct {
+	mode     string
+	topo     *topology
+	srv      string
+	seeds    []string
+	secret   string
+	interval time.Duration
+	client   *http.Client
+	logger   *log.Logger
+
+	mu      sync.Mutex
+	members map[string]*gossipState // gossip only, this node included
+	dead    map[string]gossipState  // gossip only: dropped members
+
+	joins  atomic.Int64
+	leaves atomic.Int64
+}
+
+func newDiscovery(cfg Config, t *topology, logger *log.Logger) (*discovery, error) {
+	d := &discovery{
+		mode:     cmp.Or(cfg.Discovery, discoveryStatic),
+		topo:     t,
+		srv:      cfg.DiscoverySRV,
+		secret:   cfg.RaftSecret,
+		interval: cmp.Or(cfg.DiscoveryInterval, defaultDiscoveryInterval),
+		logger:   logger,
+	}
+	d.client = &http.Client{Timeout: d.interval}
+	switch d.mode {
+	case discoveryStatic:
+	case discoveryDNS:
+		if d.srv == "" {
+			return nil, errors.New("DNS discovery requires an SRV name")
+		}
+	case discoveryGossip:
+		self := t.node(t.Self)
+		if self.URL == "" {
+			return nil, errors.New("gossip requires this node's URL")
+		}
+		d.seeds = cfg.Peers
+		d.members = map[string]*gossipState{
+			t.Self: {member: gossipMember{topologyNode: *self, Heartbeat: uint64(time.Now().UnixMilli())}, seen: time.Now()},
+		}
+		d.dead = make(map[string]gossipState)
+	}
+	return d, nil
+}
+
+// dynamic reports whether membership can change.
+func (d *discovery) dynamic() bool { return d.mode != discoveryStatic }
+
+// refresh runs one round of discovery.
+func (d *discovery) refresh() error {
+	switch d.mode {
+	case discoveryDNS:
+		return d.resolve()
+	case discoveryGossip:
+		return d.gossip()
+	}
+	return nil
+}
+
+// update makes nodes the topology's members, logging who joined and left.
+func (d *discovery) update(nodes []topologyNode) {
+	joined, left := d.topo.setMembers(nodes)
+	changed := make(map[string]bool, len(left))
+	for _, id := range left {
+		changed[id] = true
+	}
+	for _, id := range joined {
+		n := d.topo.node(id)
+		if changed[id] {
+			delete(changed, id)
+			d.logger.Printf("[Discovery] Node %s changed to %s", id, n.URL)
+			continue
+		}
+		d.joins.Add(1)
+		d.logger.Printf("[Discovery] Node %s joined at %s", id, n.URL)
+	}
+	for _, id := range left {
+		if changed[id] {
+			d.leaves.Add(1)
+			d.logger.Printf("[Discovery] Node %s left", id)
+		}
+	}
+}
+
+// resolve makes the targets of the SRV record the members, each with the
+// target host as its ID and an http URL on its port. A node keeps the
+// region and primary flag the topology file gave it.
+func (d *discovery) resolve() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.interval)
+	defer cancel()
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.srv)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", d.srv, err)
+	}
+	known := d.topo.members()
+	nodes := make([]topologyNode, 0, len(addrs))
+	for _, a := range addrs {
+		host := strings.TrimSuffix(a.Target, ".")
+		n := topologyNode{ID: host, URL: "http://" + net.JoinHostPort(host, strconv.Itoa(int(a.Port)))}
+		if k := nodesByID(known, host); k != nil {
+			n.Region, n.Primary = k.Region, k.Primary
+		}
+		if nodesByID(nodes, host) == nil {
+			nodes = append(nodes, n)
+		}
+	}
+	d.update(nodes)
+	return nil
+}
+
+// gossip advances this node's heartbeat and swaps members with a random
+// member or seed.
+func (d *discovery) gossip() error {
+	now := time.Now()
+	d.mu.Lock()
+	self := d.members[d.topo.Self]
+	self.member.Heartbeat++
+	self.seen = now
+	d.expireLocked(now)
+	msg := d.messageLocked()
+	targets := make([]string, 0, len(d.members)+len(d.seeds))
+	for id, m := range d.members {
+		if id != d.topo.Self {
+			targets = append(targets, m.member.URL)
+		}
+	}
+	d.mu.Unlock()
+	d.publish()
+	for _, u := range d.seeds {
+		if u != self.member.URL {
+			targets = append(targets, u)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	target := strings.TrimSuffix(targets[rand.Intn(len(targets))], "/")
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, target+"/cluster/gossip", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.secret != "" {
+		req.Header.Set("X-Raft-Secret", d.secret)
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("gossip with %s: %w", target, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("gossip with %s: %s", target, res.Status)
+	}
+	var reply gossipMessage
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("gossip with %s: %w", target, err)
+	}
+	d.merge(reply.Members)
+	return nil
+}
+
+// merge takes in what another node knows, keeping for each member the
+// highest heartbeat heard.
+func (d *discovery) merge(in []gossipMember) {
+	now := time.Now()
+	d.mu.Lock()
+	for _, m := range in {
+		if m.ID == "" || m.URL == "" || m.ID == d.topo.Self {
+			continue
+		}
+		if gone, ok := d.dead[m.ID]; ok {
+			if m.Heartbeat <= gone.member.Heartbeat {
+				continue
+			}
+			delete(d.dead, m.ID)
+		}
+		if cur := d.members[m.ID]; cur == nil || m.Heartbeat > cur.member.Heartbeat {
+			d.members[m.ID] = &gossipState{member: m, seen: now}
+		}
+	}
+	d.mu.Unlock()
+	d.publish()
+}
+
+// expireLocked drops the members not heard from for gossipFailRounds
+// intervals. Their last heartbeat is remembered for as long again, so that
+// nodes which have not dropped them yet cannot bring them back.
+func (d *discovery) expireLocked(now time.Time) {
+	fail := gossipFailRounds * d.interval
+	for id, m := range d.members {
+		if id != d.topo.Self && now.Sub(m.seen) > fail {
+			delete(d.members, id)
+			d.dead[id] = gossipState{member: m.member, seen: now}
+		}
+	}
+	for id, m := range d.dead {
+		if now.Sub(m.seen) > fail {
+			delete(d.dead, id)
+		}
+	}
+}
+
+func (d *discovery) messageLocked() gossipMessage {
+	msg := gossipMessage{From: d.topo.Self, Members: make([]gossipMember, 0, len(d.members))}
+	for _, m := range d.members {
+		msg.Members = append(msg.Members, m.member)
+	}
+	return msg
+}
+
+// publish makes the gossiped members the topology's.
+func (d *discovery) publish() {
+	d.mu.Lock()
+	nodes := make([]topologyNode, 0, len(d.members))
+	for _, m := range d.members {
+		nodes = append(nodes, m.member.topologyNode)
+	}
+	d.mu.Unlock()
+	d.update(nodes)
+}
+
+// gossipHandler serves POST /cluster/gossip, merging the members a node
+// sends and answering with the members known here. Like the Raft RPCs it
+// sits outside the API middleware and authenticates peers with the
+// cluster secret, if one is set.
+func (d *discovery) gossipHandler(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Raft-Secret")), []byte(d.secret)) != 1 {
+		writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid cluster secret")
+		return
+	}
+	var msg gossipMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+		return
+	}
+	d.merge(msg.Members)
+	d.mu.Lock()
+	reply := d.messageLocked()
+	d.mu.Unlock()
+	writeJSON(w, http.StatusOK, reply)
+}
+
+func (d *discovery) stats() map[string]int64 {
+	return map[string]int64{
+		"members": int64(len(d.topo.members())),
+		"joins":   d.joins.Load(),
+		"leaves":  d.leaves.Load(),
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A request chooses the shape of its response with ?envelope= or the
+// envelopeHeader: "true" wraps JSON bodies as {"data": ..., "meta": ...}
+// and sends the metadata headers, "headers" sends only the headers, and
+// "false", the default, answers as the API always has. Clients written
+// against either shape can then use the same server.
+const (
+	envelopeParam     = "envelope"
+	envelopeHeader    = "X-Envelope"
+	totalCountHeader  = "X-Total-Count"
+	dataVersionHeader = "X-Data-Version"
+)
+
+type envelopeMode int
+
+const (
+	envelopeOff envelopeMode = iota
+	envelopeHeaders
+	envelopeBody
+)
+
+// envelopeFor returns the envelope mode r asks for, and false if it names
+// none.
+func envelopeFor(r *http.Request) (envelopeMode, bool) {
+	v := r.URL.Query().Get(envelopeParam)
+	if v == "" {
+		v = r.Header.Get(envelopeHeader)
+	}
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "false", "0":
+		return envelopeOff, true
+	case "headers":
+		return envelopeHeaders, true
+	case "true", "1":
+		return envelopeBody, true
+	}
+	return envelopeOff, false
+}
+
+// envelopeMeta is the "meta" of an enveloped response. Version is the
+// revision of the latest write to the namespace, as in X-Data-Version,
+// and Count the number of items of a listing, as in X-Total-Count.
+type envelopeMeta struct {
+	Version uint64  `json:"version"`
+	Count   *int    `json:"count,omitempty"`
+	TookMS  float64 `json:"took_ms"`
+}
+
+// responseMeta collects what handlers know about a response for the
+// envelope: the namespace it is of, set by withNamespace, and the count
+// of a listing that is not a JSON array. It is nil, and its methods do
+// nothing, when the request asked for no envelope.
+type responseMeta struct {
+	ns    *namespace
+	count *int
+}
+
+func (m *responseMeta) setCount(n int) {
+	if m != nil {
+		m.count = &n
+	}
+}
+
+func (m *responseMeta) setNamespace(ns *namespace) {
+	if m != nil {
+		m.ns = ns
+	}
+}
+
+func responseMetaFrom(ctx context.Context) *responseMeta {
+	m, _ := ctx.Value(responseMetaKey).(*responseMeta)
+	return m
+}
+
+// withEnvelope answers requests that ask for an envelope in it. A JSON
+// body is held back until the handler returns, to be wrapped; any other
+// body, and upgrades, pass through with the headers alone. Error bodies
+// keep their "error" at the top, beside "meta".
+func (s *Server) withEnvelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode, ok := envelopeFor(r)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "envelope must be true, headers or false")
+			return
+		}
+		if mode == envelopeOff || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		if t := timingFrom(r.Context()); t != nil {
+			start = t.start
+		}
+		meta := &responseMeta{}
+		ew := &envelopeWriter{ResponseWriter: w, s: s, r: r, mode: mode, meta: meta, start: start}
+		next.ServeHTTP(ew, r.WithContext(context.WithValue(r.Context(), responseMetaKey, meta)))
+		ew.finish()
+	})
+}
+
+// envelopeWriter sets the metadata headers as the response starts and,
+// for an enveloped JSON body, buffers it to wrap once it is complete.
+type envelopeWriter struct {
+	http.ResponseWriter
+	s     *Server
+	r     *http.Request
+	mode  envelopeMode
+	meta  *responseMeta
+	start time.Time
+
+	status  int
+	wrap    bool
+	started bool
+	buf     bytes.Buffer
+}
+
+func (w *envelopeWriter) WriteHeader(status int) {
+	if w.started {
+		return
+	}
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.started, w.status = true, status
+	// Many JSON answers are written without a Content-Type and leave it to
+	// be sniffed, so a body without one is held too, and wrapped if it
+	// parses.
+	ct, _, _ := strings.Cut(w.Header().Get("Content-Type"), ";")
+	ct = strings.TrimSpace(ct)
+	w.wrap = w.mode == envelopeBody && (ct == "" || ct == "application/json") &&
+		w.r.Method != http.MethodHead && status != http.StatusNoContent && status != http.StatusNotModified
+	if !w.wrap {
+		w.setHeaders(nil)
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *envelopeWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.wrap {
+		return w.buf.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush passes through to a response that is not being wrapped; one that
+// is is sent whole once the handler returns.
+func (w *envelopeWriter) Flush() {
+	if !w.wrap {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *envelopeWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// envelopeMeta returns the meta of the response; count is that of the
+// body, if it is a JSON array and no handler gave one.
+func (w *envelopeWriter) envelopeMeta(count *int) envelopeMeta {
+	m := envelopeMeta{Count: w.meta.count, TookMS: float64(time.Since(w.start).Microseconds()) / 1000}
+	if m.Count == nil {
+		m.Count = count
+	}
+	ns := w.meta.ns
+	if ns == nil {
+		ns = w.s.namespaces.def
+	}
+	if rc, ok := ns.store.(revisionCounter); ok {
+		m.Version = rc.LastRevision()
+	}
+	return m
+}
+
+func (w *envelopeWriter) setHeaders(count *int) envelopeMeta {
+	m := w.envelopeMeta(count)
+	h := w.Header()
+	h.Set(dataVersionHeader, strconv.FormatUint(m.Version, 10))
+	if m.Count != nil {
+		h.Set(totalCountHeader, strconv.Itoa(*m.Count))
+	}
+	return m
+}
+
+// finish wraps and sends a buffered body, or sends it as it is if it is
+// not JSON after all.
+func (w *envelopeWriter) finish() {
+	if !w.wrap {
+		return
+	}
+	body := bytes.TrimSpace(w.buf.Bytes())
+	if len(body) > 0 && !json.Valid(body) {
+		w.setHeaders(nil)
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buf.Bytes())
+		return
+	}
+	var count *int
+	var items []json.RawMessage
+	if len(body) > 0 && body[0] == '[' && json.Unmarshal(body, &items) == nil {
+		n := len(items)
+		count = &n
+	}
+	if len(body) == 0 {
+		body = []byte("null")
+	}
+	env := struct {
+		Data  json.RawMessage `json:"data,omitempty"`
+		Error json.RawMessage `json:"error,omitempty"`
+		Meta  envelopeMeta    `json:"meta"`
+	}{Data: body}
+	if w.status >= 400 {
+		var e struct {
+			Error json.RawMessage `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != nil {
+			env.Data, env.Error = nil, e.Error
+		}
+	}
+	env.Meta = w.setHeaders(count)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.WriteHeader(w.status)
+	json.NewEncoder(w.ResponseWriter).Encode(env)
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors returned by Store implementations. Callers should compare with
+// errors.Is, since backends may wrap them with extra context.
+var (
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrConflict      = errors.New("conflict")
+	ErrReadOnly      = errors.New("store is read-only")
+	ErrValueTooLarge = errors.New("value too large")
+
+	// ErrKeyExists is returned by a create-only write to a key that is
+	// already set.
+	ErrKeyExists = errors.New("key already exists")
+
+	// ErrInvalidKey is returned for a write to a key that breaks the key
+	// naming rules.
+	ErrInvalidKey = errors.New("invalid key")
+
+	// ErrNotLeader is returned for writes to a cluster node that is not
+	// the Raft leader.
+	ErrNotLeader = errors.New("not the cluster leader")
+
+	// ErrValidationFailed is returned when a write is rejected by a
+	// validation webhook or a JSON Schema.
+	ErrValidationFailed = errors.New("validation failed")
+
+	// ErrCorrupted is returned for a read of a value that no longer
+	// matches the checksum taken when it was written.
+	ErrCorrupted = errors.New("value failed its checksum")
+
+	// ErrMissingScope is returned for access to a key whose tags require
+	// a scope the client's API key does not hold.
+	ErrMissingScope = errors.New("missing scope")
+
+	// ErrUnauthenticated is returned by an AuthProvider for credentials it
+	// does not accept.
+	ErrUnauthenticated = errors.New("unauthenticated")
+)
+
+// KeyError records the key an operation failed on.
+type KeyError struct {
+	Op  string
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("%s %q: %v", e.Op, e.Key, e.Err)
+}
+
+func (e *KeyError) Unwrap() error { return e.Err }
+
+// Machine-readable error codes used in error responses. Clients should
+// branch on these rather than on the human-readable message.
+const (
+	codeMethodNotAllowed      = "method_not_allowed"
+	codeInvalidJSON           = "invalid_json"
+	codeInvalidParam          = "invalid_parameter"
+	codeInvalidRequest        = "invalid_request"
+	codeUnsupportedMediaType  = "unsupported_media_type"
+	codeKeyNotFound           = "key_not_found"
+	codeKeyExists             = "key_exists"
+	codeInvalidKey            = "invalid_key"
+	codeNamespaceNotFound     = "namespace_not_found"
+	codeQuotaExceeded         = "quota_exceeded"
+	codeConflict              = "conflict"
+	codeReadOnly              = "read_only"
+	codeValidationFailed      = "validation_failed"
+	codeNotJSON               = "not_json"
+	codeValueTooLarge         = "value_too_large"
+	codeNotLeader             = "not_leader"
+	codeResyncRequired        = "resync_required"
+	codeNotCaughtUp           = "not_caught_up"
+	codeShardUnavailable      = "shard_unavailable"
+	codeCrossShard            = "cross_shard"
+	codeLockHeld              = "lock_held"
+	codeLockLost              = "lock_lost"
+	codeSessionNotFound       = "session_not_found"
+	codeWrongType             = "wrong_type"
+	codeIdempotencyKeyReused  = "idempotency_key_reused"
+	codeIdempotencyInProgress = "idempotency_in_progress"
+	codeNotFound              = "not_found"
+	codeUnauthorized          = "unauthorized"
+	codeRateLimited           = "rate_limited"
+	codeBadUpgrade            = "bad_upgrade"
+	codeTimeout               = "timeout"
+	codeDeadlineExceeded      = "deadline_exceeded"
+	codeRequestCancelled      = "request_cancelled"
+	codeOverloaded            = "overloaded"
+	codeCorrupted             = "corrupted"
+	codeForbidden             = "forbidden"
+	codeAuthUnavailable       = "auth_unavailable"
+	codeAuthLocked            = "auth_locked"
+	codeConfirmInvalid        = "confirm_invalid"
+	codeFeatureDisabled       = "feature_disabled"
+	codeEndpointDisabled      = "endpoint_disabled"
+	codeInternal              = "internal_error"
+)
+
+// errorBody is the envelope for every error response:
+//
+//	{"error": {"code": "...", "message": "...", "request_id": "..."}}
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code      string   `json:"code"`
+	Message   string   `json:"message"`
+	RequestID string   `json:"request_id,omitempty"`
+	Details   []string `json:"details,omitempty"`
+	// Fields lists what is wrong with each rejected part of the body
+	// of an invalid_request error.
+	Fields []fieldError `json:"fields,omitempty"`
+}
+
+// writeError sends a JSON error envelope. The error itself is counted by
+// withMetrics from the response status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeErrorDetails(w, r, status, code, message, nil)
+}
+
+// writeErrorDetails is writeError with a list of individual problems, such
+// as every schema violation found in a value.
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, status int, code, message string, details []string) {
+	message = localizedMessage(w, r, code, message)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{Error: errorDetail{
+		Code:      code,
+		Message:   message,
+		RequestID: requestIDFrom(r.Context()),
+		Details:   details,
+	}})
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+}
+
+// statusForError maps store errors to HTTP status codes.
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrMissingScope):
+		return http.StatusForbidden
+	case errors.Is(err, ErrConflict), errors.Is(err, ErrKeyExists), errors.Is(err, errSessionNotFound):
+		return http.StatusConflict
+	case errors.Is(err, ErrReadOnly):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrValidationFailed):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrInvalidKey):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotLeader), errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// codeForError maps store errors to error codes.
+func codeForError(err error) string {
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return codeKeyNotFound
+	case errors.Is(err, ErrQuotaExceeded):
+		return codeQuotaExceeded
+	case errors.Is(err, ErrConflict):
+		return codeConflict
+	case errors.Is(err, ErrKeyExists):
+		return codeKeyExists
+	case errors.Is(err, ErrReadOnly):
+		return codeReadOnly
+	case errors.Is(err, ErrValidationFailed):
+		return codeValidationFailed
+	case errors.Is(err, ErrValueTooLarge):
+		return codeValueTooLarge
+	case errors.Is(err, ErrInvalidKey):
+		return codeInvalidKey
+	case errors.Is(err, ErrNotLeader):
+		return codeNotLeader
+	case errors.Is(err, context.DeadlineExceeded):
+		return codeTimeout
+	case errors.Is(err, context.Canceled):
+		return codeRequestCancelled
+	case errors.Is(err, ErrCorrupted):
+		return codeCorrupted
+	case errors.Is(err, ErrMissingScope):
+		return codeForbidden
+	case errors.Is(err, errSessionNotFound):
+		return codeSessionNotFound
+	default:
+		return codeInternal
+	}
+}
+
+// messageForError returns the client-facing text for a store error.
+func messageForError(err error) string {
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return "Key not found"
+	case errors.Is(err, ErrQuotaExceeded):
+		return "Quota exceeded"
+	case errors.Is(err, ErrConflict):
+		return "Conflict"
+	case errors.Is(err, ErrKeyExists):
+		return "Key already exists"
+	case errors.Is(err, ErrReadOnly):
+		return "Server is read-only"
+	case errors.Is(err, ErrValidationFailed), errors.Is(err, ErrInvalidKey), errors.Is(err, ErrMissingScope):
+		return err.Error()
+	case errors.Is(err, ErrValueTooLarge):
+		return "Value too large"
+	case errors.Is(err, ErrNotLeader):
+		return "No cluster leader is available on this node"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "Request timed out"
+	case errors.Is(err, context.Canceled):
+		return "Request was cancelled"
+	case errors.Is(err, ErrCorrupted):
+		return "Stored value is corrupted"
+	case errors.Is(err, errSessionNotFound):
+		return "Session not found or expired"
+	default:
+		return "Internal server error"
+	}
+}
+
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	var details []string
+	var se *SchemaError
+	if errors.As(err, &se) {
+		details = se.Errors
+	}
+	var me *maintenanceError
+	if errors.As(err, &me) {
+		setRetryAfter(w, me)
+	}
+	writeErrorDetails(w, r, statusForError(err), codeForError(err), messageForError(err), details)
+}
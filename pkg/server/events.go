@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of the events on the server's event bus.
+const (
+	eventJobFailed      = "job_failed"
+	eventJobPanicked    = "job_panicked"
+	eventHandlerPanic   = "handler_panic"
+	eventEviction       = "eviction"
+	eventSnapshotSaved  = "snapshot_saved"
+	eventBackupUploaded = "backup_uploaded"
+)
+
+// eventTypes are the event types, for validating subscriptions.
+var eventTypes = []string{eventBackupUploaded, eventEviction, eventHandlerPanic, eventJobFailed, eventJobPanicked, eventSnapshotSaved}
+
+// eventFeedBuffer is how many events a GET /admin/events stream may fall
+// behind by before events are dropped for it, and eventFeedKeepalive how
+// often an idle stream gets a comment so that proxies keep it open.
+const (
+	eventFeedBuffer    = 256
+	eventFeedKeepalive = 30 * time.Second
+)
+
+// serverEvent is something that happened in a handler or background job,
+// as opposed to a change to a key.
+type serverEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Source is what the event is about: a job, a route, a file or a key.
+	Source  string                 `json:"source,omitempty"`
+	Message string                 `json:"message,omitempty"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+	// stack, of a panic, is logged but not sent anywhere else.
+	stack string
+}
+
+// eventPrefixes are the log prefixes of event types.
+var eventPrefixes = map[string]string{
+	eventJobFailed:      "[Worker] ",
+	eventJobPanicked:    "[Worker] ",
+	eventBackupUploaded: "[Backup] ",
+}
+
+// eventBus carries serverEvents from the handlers and jobs that publish
+// them to every subscriber: the log, the counts in /stats and /metrics,
+// webhooks subscribed to the type, and GET /admin/events streams.
+// Subscribers are called synchronously, possibly with a store lock held,
+// so they must not block.
+type eventBus struct {
+	mu     sync.RWMutex
+	subs   map[int]func(serverEvent)
+	nextID int
+	counts map[string]*atomic.Int64
+}
+
+func newEventBus() *eventBus {
+	b := &eventBus{subs: make(map[int]func(serverEvent)), counts: make(map[string]*atomic.Int64, len(eventTypes))}
+	for _, t := range eventTypes {
+		b.counts[t] = new(atomic.Int64)
+	}
+	return b
+}
+
+// subscribe calls fn with every event published until cancel is called.
+func (b *eventBus) subscribe(fn func(serverEvent)) (cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = fn
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, id)
+		b.mu.Unlock()
+	}
+}
+
+func (b *eventBus) publish(ev serverEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	b.counts[ev.Type].Add(1)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.subs {
+		fn(ev)
+	}
+}
+
+// stats counts the events published, by type.
+func (b *eventBus) stats() map[string]int64 {
+	out := make(map[string]int64, len(b.counts))
+	for t, n := range b.counts {
+		out[t] = n.Load()
+	}
+	return out
+}
+
+// snapshotSaved publishes that n keys were written to the data file, for
+// the reason given.
+func (s *Server) snapshotSaved(n int, reason string) {
+	s.events.publish(serverEvent{
+		Type:    eventSnapshotSaved,
+		Source:  s.cfg.DataFile,
+		Message: fmt.Sprintf("Persisted %d keys to %s%s", n, s.cfg.DataFile, reason),
+		Fields:  map[string]interface{}{"keys": n},
+	})
+}
+
+// logEvent is the log's subscription. Evictions are only counted, as they
+// come in bursts.
+func (s *Server) logEvent(ev serverEvent) {
+	if ev.Type == eventEviction {
+		return
+	}
+	if ev.stack != "" {
+		s.logger.Printf("%s%s\n%s", eventPrefixes[ev.Type], ev.Message, ev.stack)
+		return
+	}
+	s.logger.Printf("%s%s", eventPrefixes[ev.Type], ev.Message)
+}
+
+// parseEventTypes reads a comma-separated list of event types, "*" for
+// all of them.
+func parseEventTypes(v string) ([]string, error) {
+	var out []string
+	for _, t := range strings.Split(v, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return []string{"*"}, nil
+		}
+		if i := sort.SearchStrings(eventTypes, t); i == len(eventTypes) || eventTypes[i] != t {
+			return nil, fmt.Errorf("unknown event type %q; want one of %s", t, strings.Join(eventTypes, ", "))
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func hasEventType(types []string, t string) bool {
+	for _, u := range types {
+		if u == t || u == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// GET
+//
+// eventsHandler streams server events as Server-Sent Events, each an
+// "event:" line with the type and a "data:" line with the JSON event.
+// ?types limits the stream to a comma-separated list of types. A client
+// that falls too far behind misses events rather than holding up the
+// bus.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	types := []string{"*"}
+	if v := r.URL.Query().Get("types"); v != "" {
+		var err error
+		if types, err = parseEventTypes(v); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+			return
+		}
+	}
+	ch := make(chan serverEvent, eventFeedBuffer)
+	cancel := s.events.subscribe(func(ev serverEvent) {
+		if !hasEventType(types, ev.Type) {
+			return
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's write timeout.
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if rc.Flush() != nil {
+		return
+	}
+	keepalive := time.NewTicker(eventFeedKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev := <-ch:
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.shutdownCh:
+			return
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
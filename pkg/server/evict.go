@@ -0,0 +1,542 @@
+package server
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// entryOverhead approximates the per-key memory cost beyond the key and
+// value bytes (map entry, shard bookkeeping, string headers).
+const entryOverhead = 64
+
+func entryMemory(key, value string) int64 { return entryOverhead + entrySize(key, value) }
+
+// evictionPolicy chooses which key to drop when the store is over budget.
+// Implementations are not safe for concurrent use; evictingStore
+// serializes access.
+type evictionPolicy interface {
+	// add starts tracking key, or refreshes it on overwrite.
+	add(key string)
+	// touch records a read of key.
+	touch(key string)
+	remove(key string)
+	// victim returns the key to evict next.
+	victim() (string, bool)
+}
+
+func newEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case "lru", "":
+		return newLRUPolicy(), nil
+	case "lfu":
+		return newLFUPolicy(), nil
+	case "random":
+		return newRandomPolicy(), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q (want lru, lfu or random)", name)
+}
+
+// lruPolicy evicts the least recently used key.
+type lruPolicy struct {
+	order *list.List // front = most recent
+	elems map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) add(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) touch(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) remove(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy) victim() (string, bool) {
+	e := p.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+// lfuPolicy evicts the least frequently used key, breaking ties by age.
+type lfuPolicy struct {
+	items lfuHeap
+	index map[string]*lfuItem
+	tick  uint64
+}
+
+type lfuItem struct {
+	key   string
+	freq  uint64
+	tick  uint64 // last access, for tie-breaking
+	index int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	it := x.(*lfuItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+func newLFUPolicy() *lfuPolicy { return &lfuPolicy{index: make(map[string]*lfuItem)} }
+
+func (p *lfuPolicy) add(key string) {
+	if _, ok := p.index[key]; ok {
+		p.touch(key)
+		return
+	}
+	p.tick++
+	it := &lfuItem{key: key, freq: 1, tick: p.tick}
+	heap.Push(&p.items, it)
+	p.index[key] = it
+}
+
+func (p *lfuPolicy) touch(key string) {
+	it, ok := p.index[key]
+	if !ok {
+		return
+	}
+	p.tick++
+	it.freq++
+	it.tick = p.tick
+	heap.Fix(&p.items, it.index)
+}
+
+func (p *lfuPolicy) remove(key string) {
+	if it, ok := p.index[key]; ok {
+		heap.Remove(&p.items, it.index)
+		delete(p.index, key)
+	}
+}
+
+func (p *lfuPolicy) victim() (string, bool) {
+	if len(p.items) == 0 {
+		return "", false
+	}
+	return p.items[0].key, true
+}
+
+// randomPolicy evicts a uniformly random key.
+type randomPolicy struct {
+	keys  []string
+	index map[string]int
+}
+
+func newRandomPolicy() *randomPolicy { return &randomPolicy{index: make(map[string]int)} }
+
+func (p *randomPolicy) add(key string) {
+	if _, ok := p.index[key]; ok {
+		return
+	}
+	p.index[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *randomPolicy) touch(string) {}
+
+func (p *randomPolicy) remove(key string) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	last := len(p.keys) - 1
+	p.keys[i] = p.keys[last]
+	p.index[p.keys[i]] = i
+	p.keys = p.keys[:last]
+	delete(p.index, key)
+}
+
+func (p *randomPolicy) victim() (string, bool) {
+	if len(p.keys) == 0 {
+		return "", false
+	}
+	return p.keys[rand.Intn(len(p.keys))], true
+}
+
+// Budget bounds the size of the store. Zero fields are unlimited.
+type Budget struct {
+	MaxKeys   int   `json:"max_keys"`
+	MaxMemory int64 `json:"max_memory"`
+}
+
+// evictingStore keeps the store it wraps within a Budget by evicting keys
+// chosen by its policy after each write. Evictions go through the inner
+// store, so watchers and webhooks see them as deletes.
+type evictingStore struct {
+	Store
+	policyName string
+
+	mu        sync.Mutex
+	policy    evictionPolicy
+	budget    Budget
+	memory    int64
+	evictions int
+	// onEvict, if set, is called with each key evicted, with mu held.
+	onEvict func(key string)
+}
+
+func newEvictingStore(inner Store, policy string, budget Budget) (*evictingStore, error) {
+	p, err := newEvictionPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	if policy == "" {
+		policy = "lru"
+	}
+	es := &evictingStore{Store: inner, policyName: policy, policy: p, budget: budget}
+	inner.Snapshot().Range(func(k, v string) bool {
+		es.policy.add(k)
+		es.memory += entryMemory(k, v)
+		return true
+	})
+	es.mu.Lock()
+	es.evictLocked("")
+	es.mu.Unlock()
+	return es, nil
+}
+
+func (es *evictingStore) Get(key string) (string, error) {
+	return es.GetContext(context.Background(), key)
+}
+
+// GetContext reads key from the wrapped store, passing ctx on.
+func (es *evictingStore) GetContext(ctx context.Context, key string) (string, error) {
+	v, err := forwardGet(ctx, es.Store, key)
+	if err == nil {
+		es.mu.Lock()
+		es.policy.touch(key)
+		es.mu.Unlock()
+	}
+	return v, err
+}
+
+func (es *evictingStore) Set(key, value string) error {
+	return es.set(key, value, false, func() error { return es.Store.Set(key, value) })
+}
+
+// Create sets key only if it is absent.
+func (es *evictingStore) Create(key, value string) error {
+	return es.set(key, value, true, func() error { return createValue(es.Store, key, value) })
+}
+
+// Swap sets key and returns the value it replaced.
+func (es *evictingStore) Swap(key, value string) (old string, existed bool, err error) {
+	err = es.set(key, value, false, func() error {
+		var err error
+		old, existed, err = swapValue(es.Store, key, value)
+		return err
+	})
+	return old, existed, err
+}
+
+// set admits a write of key against the budget, performs it with write
+// and evicts to make room.
+func (es *evictingStore) set(key, value string, create bool, write func() error) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if m := es.budget.MaxMemory; m > 0 && entryMemory(key, value) > m {
+		return &KeyError{Op: "set", Key: key, Err: fmt.Errorf("%w: entry is larger than the memory budget", ErrQuotaExceeded)}
+	}
+	old, err := storedSize(es.Store, key)
+	existed := err == nil
+	if existed && create {
+		return &KeyError{Op: "create", Key: key, Err: ErrKeyExists}
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	if existed {
+		es.memory -= entryOverhead + old
+	}
+	es.memory += entryMemory(key, value)
+	es.policy.add(key)
+	es.evictLocked(key)
+	return nil
+}
+
+func (es *evictingStore) Delete(key string) error {
+	return es.remove(key, func() error { return es.Store.Delete(key) })
+}
+
+// Take deletes key and returns its value.
+func (es *evictingStore) Take(key string) (old string, err error) {
+	err = es.remove(key, func() error {
+		var err error
+		old, err = takeValue(es.Store, key)
+		return err
+	})
+	return old, err
+}
+
+// TakeAt deletes key and returns its value if it was last written at rev.
+func (es *evictingStore) TakeAt(key string, rev uint64) (old string, err error) {
+	err = es.remove(key, func() error {
+		var err error
+		old, err = takeValueAt(es.Store, key, rev)
+		return err
+	})
+	return old, err
+}
+
+func (es *evictingStore) remove(key string, del func() error) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	old, err := storedSize(es.Store, key)
+	if err != nil {
+		return err
+	}
+	if err := del(); err != nil {
+		return err
+	}
+	es.memory -= entryOverhead + old
+	es.policy.remove(key)
+	return nil
+}
+
+// ClearPrefix removes the keys starting with prefix and stops tracking
+// them.
+func (es *evictingStore) ClearPrefix(prefix string) (map[string]string, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	removed, err := clearPrefix(es.Store, prefix)
+	for k, v := range removed {
+		es.memory -= entryMemory(k, v)
+		es.policy.remove(k)
+	}
+	return removed, err
+}
+
+// LastRevision forwards to the wrapped store when it numbers its writes.
+func (es *evictingStore) LastRevision() uint64 {
+	if rc, ok := es.Store.(revisionCounter); ok {
+		return rc.LastRevision()
+	}
+	return 0
+}
+
+// Revision forwards to the wrapped store when it tracks revisions.
+func (es *evictingStore) Revision(key string) (uint64, error) {
+	if rv, ok := es.Store.(keyRevisioner); ok {
+		return rv.Revision(key)
+	}
+	return 0, &KeyError{Op: "revision", Key: key, Err: ErrKeyNotFound}
+}
+
+// Peek forwards to the wrapped store.
+func (es *evictingStore) Peek(key string) (string, error) {
+	if v, ok := peekValue(es.Store, key); ok {
+		return v, nil
+	}
+	return "", &KeyError{Op: "get", Key: key, Err: ErrKeyNotFound}
+}
+
+// Verify forwards to the wrapped store when it keeps checksums.
+func (es *evictingStore) Verify() (int, []string) {
+	checked, corrupt, _ := verifyStore(es.Store)
+	return checked, corrupt
+}
+
+// Metadata forwards to the wrapped store when it tracks metadata.
+func (es *evictingStore) Metadata(key string) (KeyMeta, error) {
+	if mp, ok := es.Store.(metadataProvider); ok {
+		return mp.Metadata(key)
+	}
+	return KeyMeta{}, &KeyError{Op: "metadata", Key: key, Err: ErrKeyNotFound}
+}
+
+func (es *evictingStore) overLocked() bool {
+	b := es.budget
+	return (b.MaxKeys > 0 && es.Store.Len() > b.MaxKeys) ||
+		(b.MaxMemory > 0 && es.memory > b.MaxMemory)
+}
+
+// evictLocked drops keys until the store is within budget. keep, the key
+// just written, is only evicted if nothing else is left. es.mu must be held.
+func (es *evictingStore) evictLocked(keep string) {
+	for es.overLocked() {
+		victim, ok := es.policy.victim()
+		if !ok {
+			return
+		}
+		if victim == keep && es.Store.Len() > 1 {
+			// Make the fresh key the most recently used and pick again.
+			es.policy.remove(keep)
+			next, ok := es.policy.victim()
+			es.policy.add(keep)
+			if !ok {
+				return
+			}
+			victim = next
+		}
+		old, err := storedSize(es.Store, victim)
+		if err == nil {
+			if err := es.Store.Delete(victim); err != nil {
+				return
+			}
+			es.memory -= entryOverhead + old
+		}
+		es.policy.remove(victim)
+		es.evictions++
+		if es.onEvict != nil {
+			es.onEvict(victim)
+		}
+	}
+}
+
+// evictionStatus is the body of GET /admin/eviction.
+type evictionStatus struct {
+	Policy    string `json:"policy"`
+	Budget    Budget `json:"budget"`
+	Keys      int    `json:"keys"`
+	Memory    int64  `json:"memory"`
+	Evictions int    `json:"evictions"`
+}
+
+func (es *evictingStore) status() evictionStatus {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return evictionStatus{
+		Policy:    es.policyName,
+		Budget:    es.budget,
+		Keys:      es.Store.Len(),
+		Memory:    es.memory,
+		Evictions: es.evictions,
+	}
+}
+
+func (es *evictingStore) evictionCount() int {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.evictions
+}
+
+// setBudget changes the budget, evicting immediately if the store no longer
+// fits.
+func (es *evictingStore) setBudget(b Budget) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.budget = b
+	es.evictLocked("")
+}
+
+// ParseBytes parses a byte size such as "512", "64KB", "100MB" or "2GB"
+// (powers of 1024).
+func ParseBytes(v string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", v)
+	}
+	return n * mult, nil
+}
+
+// GET
+func (s *Server) getEvictionHandler(w http.ResponseWriter, r *http.Request) {
+	if s.evictor == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Eviction is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.evictor.status())
+}
+
+// PUT
+//
+// putEvictionHandler changes the eviction budget at runtime. max_memory may
+// be a number of bytes or a size string such as "64MB".
+func (s *Server) putEvictionHandler(w http.ResponseWriter, r *http.Request) {
+	if s.evictor == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Eviction is not enabled")
+		return
+	}
+	var req struct {
+		MaxKeys   *int            `json:"max_keys"`
+		MaxMemory json.RawMessage `json:"max_memory"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	b := s.evictor.status().Budget
+	if req.MaxKeys != nil {
+		if *req.MaxKeys < 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "max_keys must not be negative")
+			return
+		}
+		b.MaxKeys = *req.MaxKeys
+	}
+	if len(req.MaxMemory) > 0 {
+		var n int64
+		var str string
+		switch {
+		case json.Unmarshal(req.MaxMemory, &n) == nil && n >= 0:
+		case json.Unmarshal(req.MaxMemory, &str) == nil:
+			var err error
+			if n, err = ParseBytes(str); err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid max_memory")
+				return
+			}
+		default:
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid max_memory")
+			return
+		}
+		b.MaxMemory = n
+	}
+	s.evictor.setBudget(b)
+	writeJSON(w, http.StatusOK, s.evictor.status())
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ttlHeader gives the keys a write sets a time to live, in seconds or as a
+// Go duration such as "30m"; reads of a key that expires return its
+// remaining seconds in it. A write without it keeps the key's expiry, and
+// "0" removes it.
+const ttlHeader = "X-Key-TTL"
+
+// ttlModeHeader is sent with ttlHeader: "fixed", the default, for a key
+// that expires a TTL after it was written, or "sliding" for one whose TTL
+// starts over on every read, as a session token's does. Reads of a
+// sliding key return it.
+const ttlModeHeader = "X-Key-TTL-Mode"
+
+// keyExpiry is when a key expires. A sliding key's At moves to TTL after
+// every read of it.
+type keyExpiry struct {
+	At      time.Time     `json:"at"`
+	TTL     time.Duration `json:"ttl"`
+	Sliding bool          `json:"sliding,omitempty"`
+}
+
+// remaining returns the whole seconds left before e, rounded up.
+func (e *keyExpiry) remaining(now time.Time) int64 {
+	return int64((e.At.Sub(now) + time.Second - 1) / time.Second)
+}
+
+// keyExpiries holds the expiries of the keys of a namespace. Like tags,
+// they are kept in memory beside the store and saved with the keys, so
+// keys loaded from a data file, the write-ahead log or a backup expire
+// when they would have.
+type keyExpiries struct {
+	mu    sync.Mutex
+	byKey map[string]keyExpiry
+}
+
+func newKeyExpiries() *keyExpiries {
+	return &keyExpiries{byKey: make(map[string]keyExpiry)}
+}
+
+// get returns a copy of the expiry of key, nil if it does not expire.
+func (ke *keyExpiries) get(key string) *keyExpiry {
+	ke.mu.Lock()
+	defer ke.mu.Unlock()
+	e, ok := ke.byKey[key]
+	if !ok {
+		return nil
+	}
+	return &e
+}
+
+// set replaces the expiry of key, forgetting it when e is nil.
+func (ke *keyExpiries) set(key string, e *keyExpiry) {
+	ke.mu.Lock()
+	defer ke.mu.Unlock()
+	if e == nil {
+		delete(ke.byKey, key)
+	} else {
+		ke.byKey[key] = *e
+	}
+}
+
+// touch returns the expiry of key as of now, and false if its time is up.
+// A read of a sliding key extends it first.
+func (ke *keyExpiries) touch(key string, now time.Time, read bool) (*keyExpiry, bool) {
+	ke.mu.Lock()
+	defer ke.mu.Unlock()
+	e, ok := ke.byKey[key]
+	if !ok {
+		return nil, true
+	}
+	if !now.Before(e.At) {
+		return nil, false
+	}
+	if read && e.Sliding {
+		e.At = now.Add(e.TTL)
+		ke.byKey[key] = e
+	}
+	return &e, true
+}
+
+// due returns the keys whose time is up at now.
+func (ke *keyExpiries) due(now time.Time) []string {
+	ke.mu.Lock()
+	defer ke.mu.Unlock()
+	var keys []string
+	for k, e := range ke.byKey {
+		if !now.Before(e.At) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// copy returns the expiry of every key that has one.
+func (ke *keyExpiries) copy() map[string]keyExpiry {
+	ke.mu.Lock()
+	defer ke.mu.Unlock()
+	out := make(map[string]keyExpiry, len(ke.byKey))
+	for k, e := range ke.byKey {
+		out[k] = e
+	}
+	return out
+}
+
+func (ke *keyExpiries) len() int {
+	ke.mu.Lock()
+	defer ke.mu.Unlock()
+	return len(ke.byKey)
+}
+
+// forget is a watchHub listener that drops the expiries of deleted keys.
+func (ke *keyExpiries) forget(ev Event) {
+	if ev.Type == "delete" {
+		ke.set(ev.Key, nil)
+	}
+}
+
+// expiryStats counts expired keys and sliding extensions for /stats.
+type expiryStats struct {
+	expired  atomic.Int64
+	extended atomic.Int64
+}
+
+// parseExpiry parses the X-Key-TTL and X-Key-TTL-Mode of a write into the
+// expiry it gives its keys at now, nil for a TTL of 0.
+func parseExpiry(ttl, mode string, now time.Time) (*keyExpiry, error) {
+	d, err := parseTTL(strings.TrimSpace(ttl))
+	if err != nil {
+		return nil, err
+	}
+	var sliding bool
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "fixed":
+	case "sliding":
+		sliding = true
+	default:
+		return nil, fmt.Errorf("mode %q must be fixed or sliding", mode)
+	}
+	if d == 0 {
+		return nil, nil
+	}
+	return &keyExpiry{At: now.Add(d), TTL: d, Sliding: sliding}, nil
+}
+
+// withExpiry returns a copy of ctx under which applySet gives the key it
+// writes e, replacing its current expiry; a nil e removes it.
+func withExpiry(ctx context.Context, e *keyExpiry) context.Context {
+	return context.WithValue(ctx, expiryKey, e)
+}
+
+// expiryFrom returns the expiry of a write, and false if it leaves the
+// key's expiry as it is.
+func expiryFrom(ctx context.Context) (*keyExpiry, bool) {
+	e, ok := ctx.Value(expiryKey).(*keyExpiry)
+	return e, ok
+}
+
+// writeExpiry returns the expiry key has once the write ctx belongs to is
+// applied.
+func writeExpiry(ctx context.Context, ns *namespace, key string) *keyExpiry {
+	if e, ok := expiryFrom(ctx); ok {
+		return e
+	}
+	return ns.expiries.get(key)
+}
+
+// withExpiring returns a copy of ctx under which applyDelete deletes a key
+// because its time is up: the delete is audited, replicated and watched
+// as an expiry.
+func withExpiring(ctx context.Context) context.Context {
+	return context.WithValue(ctx, expiringKey, true)
+}
+
+func expiring(ctx context.Context) bool {
+	on, _ := ctx.Value(expiringKey).(bool)
+	return on
+}
+
+// checkExpiry returns the expiry of key in ns, nil if it has none, after
+// extending it for a read of a sliding key. A key whose time is up is
+// deleted, and checkExpiry returns false.
+func (s *Server) checkExpiry(ns *namespace, key string, read bool) (*keyExpiry, bool) {
+	e, live := ns.expiries.touch(key, s.clock.Now(), read)
+	if !live {
+		s.expireKey(ns, key)
+		return nil, false
+	}
+	if read && e != nil && e.Sliding {
+		s.expiry.extended.Add(1)
+	}
+	return e, true
+}
+
+// expireKey deletes a key whose time is up. On a replica or a Raft
+// follower the delete is left to the primary or the leader, whose own
+// sweep replicates it; until then the key only reads as missing.
+func (s *Server) expireKey(ns *namespace, key string) bool {
+	if s.replica.Load() != nil || s.raft != nil && !s.raft.isLeader() {
+		return false
+	}
+	err := s.applyDelete(withExpiring(context.Background()), ns, key)
+	switch {
+	case err == nil:
+		s.expiry.expired.Add(1)
+		return true
+	case errors.Is(err, ErrKeyNotFound):
+		ns.expiries.set(key, nil)
+	default:
+		s.logger.Printf("Cannot expire %q: %v", key, err)
+	}
+	return false
+}
+
+// expireKeys deletes the keys of every namespace whose time is up,
+// returning how many it deleted.
+func (s *Server) expireKeys() int {
+	now := s.clock.Now()
+	n := 0
+	for _, ns := range s.namespaces.list() {
+		for _, key := range ns.expiries.due(now) {
+			if s.expireKey(ns, key) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (s *Server) expiryStats() map[string]int64 {
+	keys := 0
+	for _, ns := range s.namespaces.list() {
+		keys += ns.expiries.len()
+	}
+	return map[string]int64{
+		"keys":     int64(keys),
+		"expired":  s.expiry.expired.Load(),
+		"extended": s.expiry.extended.Load(),
+	}
+}
+
+// withKeyExpiry reads the X-Key-TTL and X-Key-Session of writes into the
+// context for applySet. On routes naming a key, a key whose time is up is deleted
+// first, and reads of it answer 404; reads of a key that expires return
+// its remaining TTL, extending it first for a GET of a sliding key other
+// than a long poll. The
+// background sweep deletes expired keys within a few seconds, so until
+// then a listing may still show them.
+func (s *Server) withKeyExpiry(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if ttl := r.Header.Values(ttlHeader); len(ttl) > 0 && !read {
+			e, err := parseExpiry(strings.Join(ttl, ""), r.Header.Get(ttlModeHeader), s.clock.Now())
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid "+ttlHeader+": "+err.Error())
+				return
+			}
+			ctx = withExpiry(ctx, e)
+		} else if r.Header.Get(ttlModeHeader) != "" && !read {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, ttlModeHeader+" requires "+ttlHeader)
+			return
+		}
+		if id := r.Header.Get(sessionHeader); id != "" && !read {
+			ctx = withSession(ctx, id)
+		}
+		if key := r.PathValue("key"); key != "" {
+			// Waiting for a change is not a read of the value.
+			slide := r.Method == http.MethodGet && r.URL.Query().Get("watch") != "true"
+			e, live := s.checkExpiry(s.namespaceFrom(ctx), key, slide)
+			if !live && read {
+				writeStoreError(w, r, &KeyError{Op: "get", Key: key, Err: ErrKeyNotFound})
+				return
+			}
+			if e != nil && read {
+				w.Header().Set(ttlHeader, strconv.FormatInt(e.remaining(s.clock.Now()), 10))
+				if e.Sliding {
+					w.Header().Set(ttlModeHeader, "sliding")
+				}
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
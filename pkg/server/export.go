@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// An export is a stream of JSON lines, one {"key": ..., "value": ...} entry
+// per key in key order: the same format as GET /backup and the -data-file
+// snapshot, so any of them can be fed back to POST /import.
+
+// GET
+//
+// exportHandler streams every key of the namespace, or with ?prefix only
+// the keys under it, from a consistent snapshot. Keys whose tags are not
+// exported, or require a scope the client lacks, are left out. Encrypted
+// values are exported sealed, and imported back as they are. With
+// ?format=csv the export is key,value rows under a header row instead, and
+// with ?format=resp a stream of Redis SET commands, to be piped into Redis
+// with redis-cli --pipe.
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "ndjson", "csv", "resp":
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "format must be ndjson, csv or resp")
+		return
+	}
+	ns := s.namespaceFrom(r.Context())
+	snap := ns.snapshot()
+	prefix := r.URL.Query().Get("prefix")
+	if prefix != "" {
+		// Snapshots are immutable, so the narrowed one can share the data.
+		snap = snap.narrow(snap.Between(prefix, prefixEnd(prefix)))
+	}
+	snap = visible(snap, s.hiddenKeys(r.Context(), ns, true))
+	if err := snap.Err(); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	ext, typ := "ndjson", "application/x-ndjson"
+	switch format {
+	case "csv":
+		ext, typ = "csv", "text/csv; charset=utf-8"
+	case "resp":
+		ext, typ = "resp", "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.%s"`,
+		ns.name, snap.Taken.Format("20060102T150405Z"), ext))
+	w.Header().Set("X-Snapshot-Time", snap.Taken.Format(time.RFC3339Nano))
+	w.Header().Set("X-Snapshot-Keys", strconv.Itoa(snap.Len()))
+	bw := bufio.NewWriter(s.streamDeadlines(w).writer(w))
+	switch format {
+	case "csv":
+		writeCSV(bw, snap)
+	case "resp":
+		snap.Range(func(k, v string) bool {
+			writeRESPArray(bw, []string{"SET", k, v})
+			return true
+		})
+	default:
+		writeSnapshot(bw, snap)
+	}
+	bw.Flush()
+}
+
+// prefixEnd returns the smallest string greater than every string with the
+// given prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// importAckEvery is how many entries are applied between progress lines.
+const importAckEvery = 1000
+
+// importProgress is a line of the POST /import response.
+type importProgress struct {
+	Status   string `json:"status"` // "importing", "done" or "failed"
+	Mode     string `json:"mode"`
+	Received int    `json:"received"`
+	Created  int    `json:"created"`
+	Updated  int    `json:"updated"`
+	Skipped  int    `json:"skipped,omitempty"`
+	Deleted  int    `json:"deleted,omitempty"`
+	// Unsupported counts the keys of an RDB dump left out for not holding
+	// strings.
+	Unsupported int    `json:"unsupported,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Report is the validation report of a CSV import, on the last line.
+	Report *csvReport `json:"report,omitempty"`
+}
+
+// POST
+//
+// importHandler loads an export into the namespace, streaming a progress
+// line every importAckEvery entries and a summary at the end; see
+// importEntries for the modes. With ?format=rdb the body is a Redis RDB
+// dump instead, whose string keys in database ?db (default 0) are
+// imported; see rdbReader. With ?format=csv, or a text/csv body, it is
+// key,value[,ttl] rows, validated in full before any is imported; see
+// readCSVImport.
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = "merge"
+	case "merge", "replace", "missing":
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "mode must be merge, replace or missing")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); format == "" && mt == "text/csv" {
+		format = "csv"
+	}
+	dl := s.streamDeadlines(w)
+	body := dl.reader(r.Body)
+	next := jsonEntries(body)
+	var rdb *rdbReader
+	switch format {
+	case "", "ndjson", "csv":
+	case "rdb":
+		var db uint64
+		if v := r.URL.Query().Get("db"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid db")
+				return
+			}
+			db = n
+		}
+		rdb = newRDBReader(body, db)
+		next = rdb.next
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "format must be ndjson, csv or rdb")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(dl.writer(w))
+	report := func(p importProgress) {
+		enc.Encode(p)
+		rc.Flush()
+	}
+	var csvRep *csvReport
+	if format == "csv" {
+		entries, rep, err := s.readCSVImport(body)
+		if err != nil {
+			s.incrementError(r.Context())
+			report(importProgress{Status: "failed", Mode: mode, Received: rep.Rows, Error: err.Error(), Report: &rep})
+			return
+		}
+		next, csvRep = sliceEntries(entries), &rep
+	}
+	p, err := s.importEntries(r.Context(), next, mode, report)
+	if err != nil {
+		s.incrementError(r.Context())
+	}
+	if rdb != nil {
+		p.Unsupported = rdb.skipped
+	}
+	p.Report = csvRep
+	report(p)
+}
+
+// importEntries applies the entries next returns to the namespace in ctx
+// as they are read, calling progress every importAckEvery entries. In merge
+// mode every entry is written over what is there; replace also deletes
+// keys the import does not contain once the whole stream has been
+// applied; missing writes only keys that do not exist yet. Entries with
+// tags or an expiry give their keys those, as X-Key-Tags and X-Key-TTL
+// do; a key whose time is up by then is swept once written. A malformed
+// line or rejected write stops the import: entries before it stay applied,
+// replace deletes nothing, and the returned summary has status "failed".
+func (s *Server) importEntries(ctx context.Context, next func() (snapshotEntry, error), mode string, progress func(importProgress)) (importProgress, error) {
+	p := importProgress{Status: "importing", Mode: mode}
+	fail := func(err error) (importProgress, error) {
+		p.Status = "failed"
+		p.Error = err.Error()
+		return p, err
+	}
+
+	ns := s.namespaceFrom(ctx)
+	var seen map[string]struct{}
+	if mode == "replace" {
+		seen = make(map[string]struct{})
+	}
+	for {
+		e, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fail(fmt.Errorf("entry %d: %v", p.Received+1, err))
+		}
+		p.Received++
+		if e.Key == "" {
+			return fail(fmt.Errorf("entry %d: missing key", p.Received))
+		}
+		if !e.intact() {
+			return fail(fmt.Errorf("entry %d: %w", p.Received, &KeyError{Op: "import", Key: e.Key, Err: ErrCorrupted}))
+		}
+		for _, tag := range e.Tags {
+			if !tagNameRE.MatchString(tag) {
+				return fail(fmt.Errorf("entry %d: invalid tag %q", p.Received, tag))
+			}
+		}
+		e.Key = s.keyRules.canonical(e.Key)
+		if seen != nil {
+			seen[e.Key] = struct{}{}
+		}
+		old, exists := peekValue(ns.store, e.Key)
+		switch {
+		case exists && mode == "missing",
+			exists && old == e.Value && e.TTL == 0 && e.Expiry == nil && (e.Tags == nil || slices.Equal(e.Tags, ns.tags.get(e.Key))):
+			p.Skipped++
+		default:
+			wctx := ctx
+			switch {
+			case e.Expiry != nil:
+				wctx = withExpiry(wctx, e.Expiry)
+			case e.TTL > 0:
+				wctx = withExpiry(wctx, &keyExpiry{At: time.Now().Add(e.TTL), TTL: e.TTL})
+			}
+			if e.Tags != nil {
+				wctx = withTags(wctx, e.Tags)
+			}
+			if err := s.setKey(wctx, e.Key, e.Value); err != nil {
+				return fail(fmt.Errorf("entry %d: %w", p.Received, err))
+			}
+			if exists {
+				p.Updated++
+			} else {
+				p.Created++
+			}
+		}
+		if p.Received%importAckEvery == 0 && progress != nil {
+			progress(p)
+		}
+	}
+
+	if seen != nil {
+		for _, k := range ns.store.Snapshot().keys {
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			err := s.deleteKey(ctx, k)
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return fail(fmt.Errorf("delete %q: %w", k, err))
+			}
+			p.Deleted++
+		}
+	}
+	p.Status = "done"
+	return p, nil
+}
+
+// jsonEntries returns a reader of the entries of an export in body, for
+// importEntries. It returns io.EOF after the last one.
+func jsonEntries(body io.Reader) func() (snapshotEntry, error) {
+	dec := json.NewDecoder(bufio.NewReader(body))
+	return func() (snapshotEntry, error) {
+		var e snapshotEntry
+		err := dec.Decode(&e)
+		return e, err
+	}
+}
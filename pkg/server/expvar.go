@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// expvarName is the variable the counters of /stats are published as.
+const expvarName = "kv"
+
+var publishExpvar sync.Once
+
+// expvarStats returns the body of /stats as JSON, for expvar.
+func (s *Server) expvarStats(ctx context.Context) json.RawMessage {
+	rt := s.runtimeStats()
+	s.mu.lock(ctx)
+	defer s.mu.Unlock()
+	b, err := json.Marshal(s.statsLocked(rt))
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	return b
+}
+
+// publishStats publishes the counters of /stats as the expvar variable
+// "kv", so that a program embedding the server and serving expvar's own
+// /debug/vars shows them too. Only the first server of a process is
+// published, as variables cannot be replaced.
+func (s *Server) publishStats() {
+	publishExpvar.Do(func() {
+		if expvar.Get(expvarName) != nil {
+			return
+		}
+		expvar.Publish(expvarName, expvar.Func(func() any { return s.expvarStats(context.Background()) }))
+	})
+}
+
+// GET
+//
+// expvarHandler serves /debug/vars the way expvar.Handler does, for tools
+// that scrape it: every published variable, with this server's counters
+// in "kv" and the values of secret flags left out of "cmdline".
+func (s *Server) expvarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	sep := "{\n"
+	emit := func(name, value string) {
+		fmt.Fprintf(bw, "%s%q: %s", sep, name, value)
+		sep = ",\n"
+	}
+	expvar.Do(func(kv expvar.KeyValue) {
+		switch kv.Key {
+		case "cmdline":
+			emit(kv.Key, redactedCmdline(os.Args))
+		case expvarName:
+		default:
+			emit(kv.Key, kv.Value.String())
+		}
+	})
+	stats, _ := json.Marshal(s.expvarStats(r.Context()))
+	emit(expvarName, string(stats))
+	fmt.Fprint(bw, "\n}\n")
+}
+
+// redactedCmdline returns args as JSON, without the values of flags whose
+// names suggest a secret, such as -api-key and -token-secret.
+func redactedCmdline(args []string) string {
+	out := append([]string{}, args...)
+	for i := 1; i < len(out); i++ {
+		arg := out[i]
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !secretFlag(name) {
+			continue
+		}
+		if hasValue {
+			out[i] = arg[:strings.IndexByte(arg, '=')+1] + redacted
+		} else if i+1 < len(out) && !strings.HasPrefix(out[i+1], "-") {
+			i++
+			out[i] = redacted
+		}
+	}
+	b, _ := json.Marshal(out)
+	return string(b)
+}
+
+func secretFlag(name string) bool {
+	for _, s := range []string{"key", "secret", "password", "token"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
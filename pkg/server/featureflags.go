@@ -0,0 +1,214 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Names of the feature flags.
+const (
+	featureWatch       = "watch"
+	featureWebhooks    = "webhooks"
+	featureCompression = "compression"
+)
+
+// featureDescriptions are the feature flags, each gating an optional
+// subsystem.
+var featureDescriptions = map[string]string{
+	featureWatch:       "GET /watch WebSocket streams and GET /changes; open streams are not cut off",
+	featureWebhooks:    "delivery of change events to webhooks; events while off are not sent later",
+	featureCompression: "gzip and deflate of responses and request bodies",
+}
+
+// FeatureToggles sets feature flags on or off at startup. It implements
+// flag.Value, parsing repeated "name=on" or "name=off" arguments.
+type FeatureToggles map[string]bool
+
+func (f *FeatureToggles) String() string {
+	parts := make([]string, 0, len(*f))
+	for name, on := range *f {
+		parts = append(parts, name+"="+onOff(on))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f *FeatureToggles) Set(v string) error {
+	name, state, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("feature %q must be in name=on or name=off form", v)
+	}
+	var on bool
+	switch state {
+	case "on":
+		on = true
+	case "off":
+	default:
+		b, err := strconv.ParseBool(state)
+		if err != nil {
+			return fmt.Errorf("feature %q must be in name=on or name=off form", v)
+		}
+		on = b
+	}
+	if *f == nil {
+		*f = make(FeatureToggles)
+	}
+	(*f)[name] = on
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// featureFlag is the state of one feature flag.
+type featureFlag struct {
+	on      atomic.Bool
+	mu      sync.Mutex
+	changed time.Time // since startup, if ever
+}
+
+// featureFlags are the runtime switches of /admin/flags. Checking a flag
+// takes no lock, so they can sit on hot paths. Flags start from
+// Config.Features, after the subsystem's own switch: a subsystem
+// configured off starts with its flag off, and can be turned on.
+type featureFlags struct {
+	flags map[string]*featureFlag
+}
+
+// featureFlagView is an entry of GET /admin/flags.
+type featureFlagView struct {
+	Name        string    `json:"name"`
+	Enabled     bool      `json:"enabled"`
+	Description string    `json:"description"`
+	ChangedAt   time.Time `json:"changed_at,omitzero"`
+}
+
+func newFeatureFlags(cfg Config) (*featureFlags, error) {
+	ff := &featureFlags{flags: make(map[string]*featureFlag, len(featureDescriptions))}
+	for name := range featureDescriptions {
+		ff.flags[name] = &featureFlag{}
+		ff.flags[name].on.Store(true)
+	}
+	ff.flags[featureCompression].on.Store(cfg.Compression)
+	for name, on := range cfg.Features {
+		f, ok := ff.flags[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown feature %q", name)
+		}
+		f.on.Store(on)
+	}
+	return ff, nil
+}
+
+// enabled reports whether the feature name is on. Before the flags are
+// set up, every feature is.
+func (ff *featureFlags) enabled(name string) bool {
+	if ff == nil {
+		return true
+	}
+	return ff.flags[name].on.Load()
+}
+
+// set turns a feature on or off, reporting false for an unknown one.
+func (ff *featureFlags) set(name string, on bool) (featureFlagView, bool) {
+	f, ok := ff.flags[name]
+	if !ok {
+		return featureFlagView{}, false
+	}
+	f.mu.Lock()
+	if f.on.Swap(on) != on {
+		f.changed = time.Now().UTC()
+	}
+	f.mu.Unlock()
+	return ff.view(name), true
+}
+
+func (ff *featureFlags) view(name string) featureFlagView {
+	f := ff.flags[name]
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return featureFlagView{Name: name, Enabled: f.on.Load(), Description: featureDescriptions[name], ChangedAt: f.changed}
+}
+
+func (ff *featureFlags) list() []featureFlagView {
+	out := make([]featureFlagView, 0, len(ff.flags))
+	for name := range ff.flags {
+		out = append(out, ff.view(name))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// requireFeature rejects requests while the feature name is off.
+func (s *Server) requireFeature(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.flags.enabled(name) {
+				writeError(w, r, http.StatusServiceUnavailable, codeFeatureDisabled, "The "+name+" feature is disabled")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withCompression applies withCompression while the compression feature
+// is on.
+func (s *Server) withCompression(next http.Handler) http.Handler {
+	compressed := withCompression(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.flags.enabled(featureCompression) {
+			compressed.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// enqueueWebhooks hands ev to the webhooks while the webhooks feature is
+// on. It is a watchHub listener.
+func (s *Server) enqueueWebhooks(ev Event) {
+	if s.flags.enabled(featureWebhooks) {
+		s.webhooks.enqueue(ev)
+	}
+}
+
+// GET
+func (s *Server) listFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.flags.list())
+}
+
+// PUT
+//
+// putFlagHandler turns a feature on or off with {"enabled": true}, taking
+// effect at once on this node.
+func (s *Server) putFlagHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Enabled == nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "enabled is required")
+		return
+	}
+	name := r.PathValue("name")
+	v, ok := s.flags.set(name, *req.Enabled)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Unknown feature")
+		return
+	}
+	s.logger.Printf("%s turned feature %s %s", clientKey(r), name, onOff(*req.Enabled))
+	writeJSON(w, http.StatusOK, v)
+}
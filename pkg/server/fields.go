@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/kvpb"
+)
+
+// listFields are the parts of each entry a listing returns. Keys are
+// always returned; by default so are values, and with ?meta=true the
+// metadata. ?fields, a comma-separated list of keys, values and meta,
+// names the parts wanted instead, and ?keys_only=true is fields=keys,
+// so that scans of large namespaces need not send or decrypt any value.
+type listFields struct {
+	values, meta bool
+}
+
+// parseListFields reads ?fields and ?keys_only, returning a message for
+// an invalid one.
+func parseListFields(q url.Values) (listFields, string) {
+	f := listFields{values: true, meta: q.Get("meta") == "true"}
+	keysOnly := q.Get("keys_only") == "true"
+	if !q.Has("fields") {
+		if keysOnly {
+			f = listFields{}
+		}
+		return f, ""
+	}
+	if keysOnly {
+		return f, "keys_only cannot be combined with fields"
+	}
+	f = listFields{}
+	for _, name := range strings.Split(q.Get("fields"), ",") {
+		switch strings.TrimSpace(name) {
+		case "keys":
+		case "values":
+			f.values = true
+		case "meta":
+			f.meta = true
+		default:
+			return f, "fields must list keys, values or meta"
+		}
+	}
+	return f, ""
+}
+
+// keyRange is the body of a range scan without values.
+type keyRange struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next,omitempty"`
+}
+
+// writeKeys answers a listing without values: a JSON array of the keys in
+// order, or the protobuf form with empty values.
+func writeKeys(w http.ResponseWriter, r *http.Request, keys []string) {
+	writeBody(w, responseFormat(r), http.StatusOK, keys, func() proto.Message {
+		return keysResponse(keys)
+	})
+}
+
+// writeKeyRange answers a range scan without values. The protobuf form is
+// that of writeKeys, with the continuation key in X-Range-Next.
+func writeKeyRange(w http.ResponseWriter, r *http.Request, res keyRange) {
+	f := responseFormat(r)
+	if f == formatProtobuf && res.Next != "" {
+		w.Header().Set("X-Range-Next", res.Next)
+	}
+	var v interface{} = res
+	if f == formatMsgpack {
+		m := map[string]interface{}{"keys": res.Keys}
+		if res.Next != "" {
+			m["next"] = res.Next
+		}
+		v = m
+	}
+	writeBody(w, f, http.StatusOK, v, func() proto.Message {
+		return keysResponse(res.Keys)
+	})
+}
+
+func keysResponse(keys []string) *kvpb.BatchGetResponse {
+	resp := &kvpb.BatchGetResponse{Items: make([]*kvpb.KeyValue, len(keys))}
+	for i, k := range keys {
+		resp.Items[i] = &kvpb.KeyValue{Key: k}
+	}
+	return resp
+}
@@ -0,0 +1,888 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxGraphQLBody is the largest request document accepted by /graphql.
+const maxGraphQLBody = 1 << 20
+
+// defaultGraphQLLimit is how many keys the keys query returns unless asked
+// for more.
+const defaultGraphQLLimit = 100
+
+// gqlObjectType is an object type of the schema, with its fields in the
+// order they are documented.
+type gqlObjectType struct {
+	name   string
+	fields []*gqlField
+}
+
+func (t *gqlObjectType) field(name string) *gqlField {
+	for _, f := range t.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// gqlField is a field of an object type. resolve is given the object the
+// field belongs to (nil on the root types) and the coerced arguments;
+// lists are returned as []interface{} and objects as the value the
+// object's own resolvers expect.
+type gqlField struct {
+	name    string
+	doc     string
+	typ     *gqlType
+	args    []gqlArgDef
+	resolve func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error)
+}
+
+type gqlArgDef struct {
+	name string
+	typ  *gqlType
+	def  interface{}
+}
+
+// gqlSchema is an executable schema. Its scalars are String, Int and
+// Boolean.
+type gqlSchema struct {
+	query, mutation *gqlObjectType
+	types           map[string]*gqlObjectType
+}
+
+var gqlScalars = map[string]bool{"String": true, "Int": true, "Boolean": true}
+
+// gqlTypeOf parses a type reference in the schema definition.
+func gqlTypeOf(s string) *gqlType {
+	p := &gqlParser{lex: &gqlLexer{src: s, line: 1, col: 1}}
+	if err := p.advance(); err != nil {
+		panic(err)
+	}
+	t, err := p.typeRef()
+	if err != nil || p.tok.kind != gqlEOF {
+		panic(fmt.Sprintf("invalid GraphQL type %q", s))
+	}
+	return t
+}
+
+// namedType strips the list and non-null wrappers from t.
+func namedType(t *gqlType) string {
+	for t.elem != nil {
+		t = t.elem
+	}
+	return t.name
+}
+
+// gqlFieldError is a resolver error with a message and code of its own,
+// rather than one derived from a store error.
+type gqlFieldError struct {
+	code, msg string
+}
+
+func (e *gqlFieldError) Error() string { return e.msg }
+
+// gqlError is an entry of the errors list of a response.
+type gqlError struct {
+	Message    string            `json:"message"`
+	Locations  []gqlLocation     `json:"locations,omitempty"`
+	Path       []interface{}     `json:"path,omitempty"`
+	Extensions map[string]string `json:"extensions,omitempty"`
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// gqlMap is a result object, which keeps its fields in the order they were
+// selected.
+type gqlMap struct {
+	keys []string
+	vals []interface{}
+}
+
+func (m *gqlMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		b.Write(kb)
+		b.WriteByte(':')
+		vb, err := json.Marshal(m.vals[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(vb)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// gqlRequest is the body of a GraphQL request.
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// gqlExecutor runs one operation.
+type gqlExecutor struct {
+	schema *gqlSchema
+	doc    *gqlDocument
+	vars   map[string]interface{}
+	errs   []gqlError
+}
+
+func (e *gqlExecutor) addError(msg string, code string, path []interface{}, at *gqlSelection) {
+	ge := gqlError{Message: msg, Path: append([]interface{}(nil), path...)}
+	if at != nil && at.line > 0 {
+		ge.Locations = []gqlLocation{{at.line, at.col}}
+	}
+	if code != "" {
+		ge.Extensions = map[string]string{"code": code}
+	}
+	e.errs = append(e.errs, ge)
+}
+
+// execute runs req against the schema and returns the response body.
+// Mutations are refused unless allowMutation is set, as for GET requests.
+func (sc *gqlSchema) execute(ctx context.Context, req gqlRequest, allowMutation bool) map[string]interface{} {
+	fail := func(msg string, at *gqlSelection) map[string]interface{} {
+		e := &gqlExecutor{}
+		e.addError(msg, "", nil, at)
+		return map[string]interface{}{"errors": e.errs}
+	}
+
+	doc, err := parseGQL(req.Query)
+	if err != nil {
+		var se *gqlSyntaxError
+		if errors.As(err, &se) {
+			return fail(err.Error(), &gqlSelection{line: se.line, col: se.col})
+		}
+		return fail(err.Error(), nil)
+	}
+	var op *gqlOperation
+	for _, o := range doc.operations {
+		if req.OperationName == "" && len(doc.operations) == 1 || o.name == req.OperationName && o.name != "" {
+			op = o
+		}
+	}
+	switch {
+	case op == nil && req.OperationName == "":
+		return fail("Must provide operation name if query contains multiple operations", nil)
+	case op == nil:
+		return fail(fmt.Sprintf("Unknown operation named %q", req.OperationName), nil)
+	case op.kind == "subscription":
+		return fail("Subscriptions are not supported; use GET /watch", nil)
+	case op.kind == "mutation" && !allowMutation:
+		return fail("Mutations must be sent with POST", nil)
+	}
+
+	e := &gqlExecutor{schema: sc, doc: doc}
+	root := sc.query
+	if op.kind == "mutation" {
+		root = sc.mutation
+	}
+	e.validate(op, root)
+	if len(e.errs) == 0 {
+		e.vars = e.coerceVariables(op, req.Variables)
+	}
+	if len(e.errs) > 0 {
+		return map[string]interface{}{"errors": e.errs}
+	}
+
+	data, _ := e.selectionSet(ctx, root, nil, op.sel, nil)
+	resp := map[string]interface{}{"data": data}
+	if data == nil {
+		resp["data"] = nil
+	}
+	if len(e.errs) > 0 {
+		resp["errors"] = e.errs
+	}
+	return resp
+}
+
+// validate reports selections the schema cannot answer, before anything is
+// executed.
+func (e *gqlExecutor) validate(op *gqlOperation, root *gqlObjectType) {
+	defined := make(map[string]*gqlType)
+	for _, v := range op.vars {
+		if !gqlScalars[namedType(v.typ)] {
+			e.addError(fmt.Sprintf("Variable $%s cannot be of non-input type %s", v.name, v.typ), "", nil, nil)
+		}
+		defined[v.name] = v.typ
+	}
+	var walk func(t *gqlObjectType, sels []*gqlSelection, visiting map[string]bool)
+	checkValue := func(v interface{}, at *gqlSelection) {
+		var check func(v interface{})
+		check = func(v interface{}) {
+			switch v := v.(type) {
+			case gqlVar:
+				if defined[string(v)] == nil {
+					e.addError(fmt.Sprintf("Variable $%s is not defined", v), "", nil, at)
+				}
+			case []interface{}:
+				for _, item := range v {
+					check(item)
+				}
+			case []gqlArg:
+				for _, a := range v {
+					check(a.value)
+				}
+			}
+		}
+		check(v)
+	}
+	checkDirectives := func(s *gqlSelection) {
+		for _, d := range s.directives {
+			if d.name != "skip" && d.name != "include" {
+				e.addError(fmt.Sprintf("Unknown directive @%s", d.name), "", nil, s)
+				continue
+			}
+			if len(d.args) != 1 || d.args[0].name != "if" {
+				e.addError(fmt.Sprintf("Directive @%s takes one argument, if", d.name), "", nil, s)
+				continue
+			}
+			checkValue(d.args[0].value, s)
+		}
+	}
+	walk = func(t *gqlObjectType, sels []*gqlSelection, visiting map[string]bool) {
+		seen := make(map[string]string)
+		for _, s := range sels {
+			checkDirectives(s)
+			switch {
+			case s.fragment != "":
+				f := e.doc.fragments[s.fragment]
+				if f == nil {
+					e.addError(fmt.Sprintf("Unknown fragment %q", s.fragment), "", nil, s)
+					continue
+				}
+				if f.on != t.name {
+					e.addError(fmt.Sprintf("Fragment %q on %s cannot be spread on %s", f.name, f.on, t.name), "", nil, s)
+					continue
+				}
+				if visiting[f.name] {
+					e.addError(fmt.Sprintf("Fragment %q spreads itself", f.name), "", nil, s)
+					continue
+				}
+				visiting[f.name] = true
+				walk(t, f.sel, visiting)
+				delete(visiting, f.name)
+				continue
+			case s.inline:
+				if s.on != "" && s.on != t.name {
+					e.addError(fmt.Sprintf("Fragment on %s cannot be spread on %s", s.on, t.name), "", nil, s)
+					continue
+				}
+				walk(t, s.sel, visiting)
+				continue
+			}
+
+			if prev, ok := seen[s.key()]; ok && prev != s.name {
+				e.addError(fmt.Sprintf("Fields %q conflict because %s and %s are different fields", s.key(), prev, s.name), "", nil, s)
+			}
+			seen[s.key()] = s.name
+			if s.name == "__typename" {
+				if s.sel != nil {
+					e.addError("Field \"__typename\" must not have a selection", "", nil, s)
+				}
+				continue
+			}
+			if strings.HasPrefix(s.name, "__") {
+				e.addError("Introspection is not supported; GET /graphql returns the schema", "", nil, s)
+				continue
+			}
+			f := t.field(s.name)
+			if f == nil {
+				e.addError(fmt.Sprintf("Cannot query field %q on type %q", s.name, t.name), "", nil, s)
+				continue
+			}
+			given := make(map[string]bool)
+			for _, a := range s.args {
+				var def *gqlArgDef
+				for i := range f.args {
+					if f.args[i].name == a.name {
+						def = &f.args[i]
+					}
+				}
+				if def == nil {
+					e.addError(fmt.Sprintf("Unknown argument %q on field %q", a.name, t.name+"."+f.name), "", nil, s)
+					continue
+				}
+				given[a.name] = true
+				checkValue(a.value, s)
+				if _, isVar := a.value.(gqlVar); !isVar && !containsVar(a.value) {
+					if _, err := coerceGQLValue(def.typ, a.value, nil); err != nil {
+						e.addError(fmt.Sprintf("Argument %q: %v", a.name, err), "", nil, s)
+					}
+				}
+			}
+			for _, def := range f.args {
+				if def.typ.nonNull && def.def == nil && !given[def.name] {
+					e.addError(fmt.Sprintf("Field %q argument %q of type %s is required", f.name, def.name, def.typ), "", nil, s)
+				}
+			}
+			if ot := e.schema.types[namedType(f.typ)]; ot != nil {
+				if s.sel == nil {
+					e.addError(fmt.Sprintf("Field %q of type %s must have a selection of subfields", f.name, f.typ), "", nil, s)
+					continue
+				}
+				walk(ot, s.sel, visiting)
+			} else if s.sel != nil {
+				e.addError(fmt.Sprintf("Field %q must not have a selection since type %s has no subfields", f.name, f.typ), "", nil, s)
+			}
+		}
+	}
+	walk(root, op.sel, make(map[string]bool))
+}
+
+func containsVar(v interface{}) bool {
+	switch v := v.(type) {
+	case gqlVar:
+		return true
+	case []interface{}:
+		for _, item := range v {
+			if containsVar(item) {
+				return true
+			}
+		}
+	case []gqlArg:
+		for _, a := range v {
+			if containsVar(a.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// coerceVariables checks the request's variables against the operation's
+// definitions and applies their defaults.
+func (e *gqlExecutor) coerceVariables(op *gqlOperation, given map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, v := range op.vars {
+		raw, ok := given[v.name]
+		if !ok {
+			if v.hasDefault {
+				raw, ok = v.def, true
+			} else if v.typ.nonNull {
+				e.addError(fmt.Sprintf("Variable $%s of required type %s was not provided", v.name, v.typ), "", nil, nil)
+				continue
+			} else {
+				continue
+			}
+		}
+		c, err := coerceGQLValue(v.typ, raw, nil)
+		if err != nil {
+			e.addError(fmt.Sprintf("Variable $%s: %v", v.name, err), "", nil, nil)
+			continue
+		}
+		out[v.name] = c
+	}
+	return out
+}
+
+// coerceGQLValue converts an argument literal, with variables taken from
+// vars, or a JSON variable value to type t: string, int, bool, nil or
+// []interface{}.
+func coerceGQLValue(t *gqlType, v interface{}, vars map[string]interface{}) (interface{}, error) {
+	if name, ok := v.(gqlVar); ok {
+		v = vars[string(name)]
+	}
+	if v == nil {
+		if t.nonNull {
+			return nil, fmt.Errorf("expected a value of type %s, found null", t)
+		}
+		return nil, nil
+	}
+	if t.elem != nil {
+		items, ok := v.([]interface{})
+		if !ok {
+			items = []interface{}{v}
+		}
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			c, err := coerceGQLValue(t.elem, item, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+	switch t.name {
+	case "String":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "Boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "Int":
+		switch n := v.(type) {
+		case int:
+			return n, nil
+		case int64:
+			if n >= math.MinInt32 && n <= math.MaxInt32 {
+				return int(n), nil
+			}
+		case float64:
+			if n == math.Trunc(n) && n >= math.MinInt32 && n <= math.MaxInt32 {
+				return int(n), nil
+			}
+		case json.Number:
+			if i, err := n.Int64(); err == nil && i >= math.MinInt32 && i <= math.MaxInt32 {
+				return int(i), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("expected a value of type %s", t)
+}
+
+// included evaluates the @skip and @include directives of s.
+func (e *gqlExecutor) included(s *gqlSelection) bool {
+	for _, d := range s.directives {
+		v, _ := coerceGQLValue(gqlTypeOf("Boolean!"), d.args[0].value, e.vars)
+		if b, _ := v.(bool); b == (d.name == "skip") {
+			return false
+		}
+	}
+	return true
+}
+
+// collect flattens fragments in sels into the fields to resolve, grouped
+// by response key in order of first appearance.
+func (e *gqlExecutor) collect(sels []*gqlSelection, keys *[]string, fields map[string][]*gqlSelection) {
+	for _, s := range sels {
+		if !e.included(s) {
+			continue
+		}
+		switch {
+		case s.fragment != "":
+			e.collect(e.doc.fragments[s.fragment].sel, keys, fields)
+		case s.inline:
+			e.collect(s.sel, keys, fields)
+		default:
+			if _, ok := fields[s.key()]; !ok {
+				*keys = append(*keys, s.key())
+			}
+			fields[s.key()] = append(fields[s.key()], s)
+		}
+	}
+}
+
+// selectionSet resolves sels on parent, an object of type t. failed is set
+// if a non-null field came out null, which makes the whole object null.
+func (e *gqlExecutor) selectionSet(ctx context.Context, t *gqlObjectType, parent interface{}, sels []*gqlSelection, path []interface{}) (out *gqlMap, failed bool) {
+	var keys []string
+	fields := make(map[string][]*gqlSelection)
+	e.collect(sels, &keys, fields)
+
+	out = &gqlMap{}
+	for _, key := range keys {
+		first := fields[key][0]
+		fpath := append(path[:len(path):len(path)], key)
+		if first.name == "__typename" {
+			out.keys, out.vals = append(out.keys, key), append(out.vals, t.name)
+			continue
+		}
+		f := t.field(first.name)
+		args := make(map[string]interface{})
+		var err error
+		for _, def := range f.args {
+			var v interface{} = def.def
+			for _, a := range first.args {
+				if a.name != def.name {
+					continue
+				}
+				if name, isVar := a.value.(gqlVar); isVar {
+					if given, ok := e.vars[string(name)]; ok || def.def == nil {
+						v = given
+					}
+				} else {
+					v = a.value
+				}
+			}
+			if args[def.name], err = coerceGQLValue(def.typ, v, e.vars); err != nil {
+				break
+			}
+		}
+		var v interface{}
+		if err == nil {
+			v, err = f.resolve(ctx, parent, args)
+		}
+		if err != nil {
+			msg, code := messageForError(err), codeForError(err)
+			var fe *gqlFieldError
+			if errors.As(err, &fe) {
+				msg, code = fe.msg, fe.code
+			}
+			e.addError(msg, code, fpath, first)
+			if f.typ.nonNull {
+				return nil, true
+			}
+			out.keys, out.vals = append(out.keys, key), append(out.vals, nil)
+			continue
+		}
+		var sub []*gqlSelection
+		for _, s := range fields[key] {
+			sub = append(sub, s.sel...)
+		}
+		r, failed := e.complete(ctx, f.typ, sub, v, fpath, first)
+		if failed {
+			return nil, true
+		}
+		out.keys, out.vals = append(out.keys, key), append(out.vals, r)
+	}
+	return out, false
+}
+
+// complete shapes a resolved value v of type t for the response.
+func (e *gqlExecutor) complete(ctx context.Context, t *gqlType, sel []*gqlSelection, v interface{}, path []interface{}, at *gqlSelection) (interface{}, bool) {
+	if t.nonNull {
+		inner := *t
+		inner.nonNull = false
+		if v == nil {
+			e.addError("Cannot return null for non-nullable field", "", path, at)
+			return nil, true
+		}
+		r, failed := e.complete(ctx, &inner, sel, v, path, at)
+		if failed || r == nil {
+			return nil, true
+		}
+		return r, false
+	}
+	if v == nil {
+		return nil, false
+	}
+	if t.elem != nil {
+		items, _ := v.([]interface{})
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			r, failed := e.complete(ctx, t.elem, sel, item, append(path[:len(path):len(path)], i), at)
+			if failed {
+				return nil, false
+			}
+			out[i] = r
+		}
+		return out, false
+	}
+	if ot := e.schema.types[t.name]; ot != nil {
+		m, failed := e.selectionSet(ctx, ot, v, sel, path)
+		if failed {
+			return nil, false
+		}
+		return m, false
+	}
+	return v, false
+}
+
+// sdl renders the schema in the GraphQL schema definition language.
+func (sc *gqlSchema) sdl() string {
+	var b strings.Builder
+	b.WriteString("schema {\n  query: Query\n  mutation: Mutation\n}\n")
+	for _, t := range []*gqlObjectType{sc.query, sc.mutation, sc.types["Key"]} {
+		fmt.Fprintf(&b, "\ntype %s {\n", t.name)
+		for _, f := range t.fields {
+			if f.doc != "" {
+				fmt.Fprintf(&b, "  %q\n", f.doc)
+			}
+			b.WriteString("  " + f.name)
+			if len(f.args) > 0 {
+				args := make([]string, len(f.args))
+				for i, a := range f.args {
+					args[i] = a.name + ": " + a.typ.String()
+					if a.def != nil {
+						d, _ := json.Marshal(a.def)
+						args[i] += " = " + string(d)
+					}
+				}
+				b.WriteString("(" + strings.Join(args, ", ") + ")")
+			}
+			b.WriteString(": " + f.typ.String() + "\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// gqlKey is a Key object: a key of a namespace, with its value and
+// metadata loaded when first asked for.
+type gqlKey struct {
+	ns    *namespace
+	key   string
+	value *string
+	meta  *KeyMeta
+	mErr  error
+	mDone bool
+}
+
+func (k *gqlKey) metadata() (*KeyMeta, error) {
+	if !k.mDone {
+		k.mDone = true
+		if mp, ok := k.ns.store.(metadataProvider); ok {
+			m, err := mp.Metadata(k.key)
+			if err == nil {
+				k.meta = &m
+			} else if !errors.Is(err, ErrKeyNotFound) {
+				k.mErr = err
+			}
+		}
+	}
+	return k.meta, k.mErr
+}
+
+// gqlNamespace resolves the namespace argument of a field.
+func (s *Server) gqlNamespace(args map[string]interface{}, create bool) (*namespace, error) {
+	name, _ := args["namespace"].(string)
+	if !namespaceNameRE.MatchString(name) {
+		return nil, &gqlFieldError{codeInvalidParam, "Invalid namespace name"}
+	}
+	ns := s.namespaces.get(name, create)
+	if ns == nil {
+		return nil, &gqlFieldError{codeNamespaceNotFound, "Namespace not found"}
+	}
+	return ns, nil
+}
+
+// newGraphQLSchema builds the schema served at /graphql: reads of single
+// keys, key ranges and namespaces, and set and delete mutations.
+func (s *Server) newGraphQLSchema() *gqlSchema {
+	str := func(v string) interface{} {
+		if v == "" {
+			return nil
+		}
+		return v
+	}
+	ts := func(t time.Time) interface{} {
+		if t.IsZero() {
+			return nil
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	metaField := func(name, typ, doc string, get func(m *KeyMeta) interface{}) *gqlField {
+		return &gqlField{name: name, typ: gqlTypeOf(typ), doc: doc, resolve: func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			m, err := parent.(*gqlKey).metadata()
+			if m == nil || err != nil {
+				return nil, err
+			}
+			return get(m), nil
+		}}
+	}
+	nsArg := gqlArgDef{"namespace", gqlTypeOf("String"), defaultNamespace}
+	withNS := func(ctx context.Context, ns *namespace) context.Context {
+		return context.WithValue(ctx, namespaceKey, ns)
+	}
+
+	key := &gqlObjectType{name: "Key", fields: []*gqlField{
+		{name: "key", typ: gqlTypeOf("String!"), resolve: func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			return parent.(*gqlKey).key, nil
+		}},
+		{name: "namespace", typ: gqlTypeOf("String!"), resolve: func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			return parent.(*gqlKey).ns.name, nil
+		}},
+		{name: "value", typ: gqlTypeOf("String"), doc: "null once the key no longer exists", resolve: func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			k := parent.(*gqlKey)
+			if k.value == nil {
+				if _, live := s.checkExpiry(k.ns, k.key, true); !live {
+					return nil, nil
+				}
+				v, err := getValue(ctx, k.ns.store, k.key)
+				if errors.Is(err, ErrKeyNotFound) {
+					return nil, nil
+				} else if err != nil {
+					return nil, err
+				}
+				k.value = &v
+			}
+			v, _ := s.reveal(ctx, k.key, *k.value)
+			return v, nil
+		}},
+		{name: "content_type", typ: gqlTypeOf("String"), resolve: func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			k := parent.(*gqlKey)
+			return str(k.ns.types.get(k.key)), nil
+		}},
+		metaField("version", "Int", "revision of the key, incremented by every write", func(m *KeyMeta) interface{} { return int(m.Revision) }),
+		metaField("created_at", "String", "RFC 3339 time", func(m *KeyMeta) interface{} { return ts(m.CreatedAt) }),
+		metaField("updated_at", "String", "RFC 3339 time", func(m *KeyMeta) interface{} { return ts(m.UpdatedAt) }),
+		metaField("size", "Int", "bytes", func(m *KeyMeta) interface{} { return m.Size }),
+		metaField("reads", "Int", "", func(m *KeyMeta) interface{} { return int(m.Reads) }),
+	}}
+
+	query := &gqlObjectType{name: "Query", fields: []*gqlField{
+		{name: "key", typ: gqlTypeOf("Key"), doc: "null if the key does not exist", args: []gqlArgDef{{"key", gqlTypeOf("String!"), nil}, nsArg},
+			resolve: func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error) {
+				ns, err := s.gqlNamespace(args, false)
+				if err != nil {
+					return nil, err
+				}
+				k := s.keyRules.canonical(args["key"].(string))
+				if err := s.checkRead(ctx, ns, k); err != nil {
+					return nil, err
+				}
+				if _, live := s.checkExpiry(ns, k, true); !live {
+					return nil, nil
+				}
+				s.hotKeys.read(ns.name, k)
+				v, err := getValue(ctx, ns.store, k)
+				if errors.Is(err, ErrKeyNotFound) {
+					return nil, nil
+				} else if err != nil {
+					return nil, err
+				}
+				return &gqlKey{ns: ns, key: k, value: &v}, nil
+			}},
+		{name: "keys", typ: gqlTypeOf("[Key!]!"), doc: "keys in order, under prefix and from <= key < to", args: []gqlArgDef{
+			{"prefix", gqlTypeOf("String"), nil},
+			{"from", gqlTypeOf("String"), nil},
+			{"to", gqlTypeOf("String"), nil},
+			{"limit", gqlTypeOf("Int"), defaultGraphQLLimit},
+			nsArg,
+		}, resolve: func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			ns, err := s.gqlNamespace(args, false)
+			if err != nil {
+				return nil, err
+			}
+			prefix, _ := args["prefix"].(string)
+			from, _ := args["from"].(string)
+			to, _ := args["to"].(string)
+			limit, _ := args["limit"].(int)
+			if limit <= 0 || limit > maxRangeLimit {
+				return nil, &gqlFieldError{codeInvalidParam, fmt.Sprintf("limit must be between 1 and %d", maxRangeLimit)}
+			}
+			if from < prefix {
+				from = prefix
+			}
+			snap := visible(ns.store.Snapshot(), s.hiddenKeys(ctx, ns, false))
+			out := []interface{}{}
+			for _, k := range snap.Between(from, to) {
+				if !strings.HasPrefix(k, prefix) {
+					if k > prefix {
+						break
+					}
+					continue
+				}
+				// A listing does not extend sliding keys, as on /data.
+				if _, live := s.checkExpiry(ns, k, false); !live {
+					continue
+				}
+				v, _ := snap.Get(k)
+				out = append(out, &gqlKey{ns: ns, key: k, value: &v})
+				if len(out) == limit {
+					break
+				}
+			}
+			return out, nil
+		}},
+		{name: "namespaces", typ: gqlTypeOf("[String!]!"), resolve: func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			var out []interface{}
+			for _, ns := range s.namespaces.list() {
+				out = append(out, ns.name)
+			}
+			return out, nil
+		}},
+	}}
+
+	mutation := &gqlObjectType{name: "Mutation", fields: []*gqlField{
+		{name: "set", typ: gqlTypeOf("Key!"), doc: "writes the key, creating the namespace if needed", args: []gqlArgDef{{"key", gqlTypeOf("String!"), nil}, {"value", gqlTypeOf("String!"), nil}, nsArg},
+			resolve: func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error) {
+				ns, err := s.gqlNamespace(args, true)
+				if err != nil {
+					return nil, err
+				}
+				k, v := s.keyRules.canonical(args["key"].(string)), args["value"].(string)
+				if err := s.setKey(withNS(ctx, ns), k, v); err != nil {
+					return nil, err
+				}
+				return &gqlKey{ns: ns, key: k, value: &v}, nil
+			}},
+		{name: "delete", typ: gqlTypeOf("Boolean!"), doc: "false if the key did not exist", args: []gqlArgDef{{"key", gqlTypeOf("String!"), nil}, nsArg},
+			resolve: func(ctx context.Context, parent interface{}, args map[string]interface{}) (interface{}, error) {
+				ns, err := s.gqlNamespace(args, false)
+				if err != nil {
+					return nil, err
+				}
+				err = s.deleteKey(withNS(ctx, ns), s.keyRules.canonical(args["key"].(string)))
+				if errors.Is(err, ErrKeyNotFound) {
+					return false, nil
+				}
+				return err == nil, err
+			}},
+	}}
+
+	return &gqlSchema{
+		query:    query,
+		mutation: mutation,
+		types:    map[string]*gqlObjectType{"Query": query, "Mutation": mutation, "Key": key},
+	}
+}
+
+// GET, POST
+//
+// graphqlHandler executes a GraphQL document, sent with POST as a JSON
+// request of query, operationName and variables or as a bare document with
+// Content-Type application/graphql, or with GET as the same parameters in
+// the query string. Mutations must use POST, and GET without a query
+// returns the schema in SDL form. Errors in the document or while
+// resolving fields are reported in the errors list of a 200 response, as
+// GraphQL clients expect.
+func (s *Server) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var req gqlRequest
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		if !q.Has("query") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, s.graphql.sdl())
+			return
+		}
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			dec := json.NewDecoder(strings.NewReader(v))
+			dec.UseNumber()
+			if err := dec.Decode(&req.Variables); err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParam, "variables must be a JSON object")
+				return
+			}
+		}
+	} else {
+		body := http.MaxBytesReader(w, r.Body, maxGraphQLBody)
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql") {
+			b, err := io.ReadAll(body)
+			if err != nil {
+				writeError(w, r, http.StatusRequestEntityTooLarge, codeValueTooLarge, "Request too large")
+				return
+			}
+			req.Query = string(b)
+		} else {
+			if !checkContentType(w, r, "application/json or application/graphql", isJSONMediaType) {
+				return
+			}
+			dec := json.NewDecoder(body)
+			dec.UseNumber()
+			if err := dec.Decode(&req); err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidJSON, describeJSONError(err))
+				return
+			}
+		}
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "query is required")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.graphql.execute(r.Context(), req, r.Method == http.MethodPost))
+}
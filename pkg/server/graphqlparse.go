@@ -0,0 +1,704 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file parses the subset of the GraphQL query language that /graphql
+// executes: queries and mutations with variables, aliases, arguments,
+// fragments, inline fragments and the @skip and @include directives.
+
+// gqlDocument is a parsed request document.
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind string // "query" or "mutation"
+	name string
+	vars []gqlVarDef
+	sel  []*gqlSelection
+}
+
+type gqlVarDef struct {
+	name       string
+	typ        *gqlType
+	def        interface{}
+	hasDefault bool
+}
+
+// gqlType is a type reference such as String!, [Key!] or Int.
+type gqlType struct {
+	name    string   // named type, or "" for a list
+	elem    *gqlType // element type of a list
+	nonNull bool
+}
+
+func (t *gqlType) String() string {
+	s := t.name
+	if t.elem != nil {
+		s = "[" + t.elem.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+type gqlFragment struct {
+	name, on string
+	sel      []*gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (fragment set) or an inline
+// fragment (inline set, with an optional type condition in on).
+type gqlSelection struct {
+	alias, name string
+	args        []gqlArg
+	directives  []gqlDirective
+	sel         []*gqlSelection
+
+	fragment string
+	inline   bool
+	on       string
+
+	line, col int
+}
+
+// key is the name the field's result is returned under.
+func (s *gqlSelection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlArg struct {
+	name  string
+	value interface{}
+}
+
+type gqlDirective struct {
+	name string
+	args []gqlArg
+}
+
+// Argument values are parsed to nil, bool, int64, float64, string,
+// gqlVar, gqlEnum, []interface{} or []gqlArg (an input object).
+type (
+	gqlVar  string
+	gqlEnum string
+)
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind      gqlTokenKind
+	text      string
+	line, col int
+}
+
+// gqlSyntaxError is a parse error at a position in the document.
+type gqlSyntaxError struct {
+	msg       string
+	line, col int
+}
+
+func (e *gqlSyntaxError) Error() string {
+	return fmt.Sprintf("Syntax error at %d:%d: %s", e.line, e.col, e.msg)
+}
+
+type gqlLexer struct {
+	src       string
+	pos       int
+	line, col int
+}
+
+func (l *gqlLexer) errorf(format string, args ...interface{}) error {
+	return &gqlSyntaxError{fmt.Sprintf(format, args...), l.line, l.col}
+}
+
+func (l *gqlLexer) advance(n int) {
+	for i := 0; i < n && l.pos < len(l.src); i++ {
+		if l.src[l.pos] == '\n' {
+			l.line++
+			l.col = 1
+		} else {
+			l.col++
+		}
+		l.pos++
+	}
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	// Whitespace, commas and comments are insignificant.
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			l.advance(1)
+		} else if c == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.advance(1)
+			}
+		} else {
+			break
+		}
+	}
+	tok := gqlToken{line: l.line, col: l.col}
+	if l.pos >= len(l.src) {
+		return tok, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		tok.kind, tok.text = gqlPunct, "..."
+		l.advance(3)
+	case strings.IndexByte("!$():=@[]{}|&", c) >= 0:
+		tok.kind, tok.text = gqlPunct, string(c)
+		l.advance(1)
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		start := l.pos
+		for l.pos < len(l.src) && isGQLNameByte(l.src[l.pos]) {
+			l.advance(1)
+		}
+		tok.kind, tok.text = gqlName, l.src[start:l.pos]
+	case c == '-' || c >= '0' && c <= '9':
+		start := l.pos
+		tok.kind = gqlInt
+		if c == '-' {
+			l.advance(1)
+		}
+		for l.pos < len(l.src) {
+			c := l.src[l.pos]
+			if c == '.' || c == 'e' || c == 'E' || (c == '+' || c == '-') && tok.kind == gqlFloat {
+				tok.kind = gqlFloat
+			} else if c < '0' || c > '9' {
+				break
+			}
+			l.advance(1)
+		}
+		tok.text = l.src[start:l.pos]
+	case c == '"':
+		s, err := l.string()
+		if err != nil {
+			return tok, err
+		}
+		tok.kind, tok.text = gqlString, s
+	default:
+		r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+		return tok, l.errorf("unexpected character %q", r)
+	}
+	return tok, nil
+}
+
+func isGQLNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// string lexes a quoted or block string starting at the opening quote.
+func (l *gqlLexer) string() (string, error) {
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		l.advance(3)
+		end := strings.Index(l.src[l.pos:], `"""`)
+		if end < 0 {
+			return "", l.errorf("unterminated block string")
+		}
+		s := l.src[l.pos : l.pos+end]
+		l.advance(end + 3)
+		return blockStringValue(s), nil
+	}
+	l.advance(1)
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return "", l.errorf("unterminated string")
+		}
+		c := l.src[l.pos]
+		if c == '"' {
+			l.advance(1)
+			return b.String(), nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			l.advance(1)
+			continue
+		}
+		if l.pos+1 >= len(l.src) {
+			return "", l.errorf("unterminated string")
+		}
+		esc := l.src[l.pos+1]
+		switch esc {
+		case '"', '\\', '/':
+			b.WriteByte(esc)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if l.pos+6 > len(l.src) {
+				return "", l.errorf("invalid unicode escape")
+			}
+			n, err := strconv.ParseUint(l.src[l.pos+2:l.pos+6], 16, 32)
+			if err != nil {
+				return "", l.errorf("invalid unicode escape")
+			}
+			b.WriteRune(rune(n))
+			l.advance(4)
+		default:
+			return "", l.errorf("invalid escape \\%c", esc)
+		}
+		l.advance(2)
+	}
+}
+
+// blockStringValue removes the common indentation and the blank first and
+// last lines of a block string.
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		if len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.ReplaceAll(strings.Join(lines, "\n"), `\"""`, `"""`)
+}
+
+type gqlParser struct {
+	lex *gqlLexer
+	tok gqlToken
+}
+
+// parseGQL parses a request document.
+func parseGQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{lex: &gqlLexer{src: src, line: 1, col: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.tok.kind != gqlEOF {
+		switch {
+		case p.is(gqlPunct, "{"):
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", sel: sel})
+		case p.is(gqlName, "query"), p.is(gqlName, "mutation"), p.is(gqlName, "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.is(gqlName, "fragment"):
+			f, err := p.fragmentDefinition()
+			if err != nil {
+				return nil, err
+			}
+			if doc.fragments[f.name] != nil {
+				return nil, fmt.Errorf("There can be only one fragment named %q", f.name)
+			}
+			doc.fragments[f.name] = f
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("Document contains no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *gqlParser) is(kind gqlTokenKind, text string) bool {
+	return p.tok.kind == kind && p.tok.text == text
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.tok.kind == gqlEOF {
+		return &gqlSyntaxError{"unexpected end of document", p.tok.line, p.tok.col}
+	}
+	return &gqlSyntaxError{fmt.Sprintf("unexpected %q", p.tok.text), p.tok.line, p.tok.col}
+}
+
+// expect consumes the punctuator text.
+func (p *gqlParser) expect(text string) error {
+	if !p.is(gqlPunct, text) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != gqlName {
+		return "", p.unexpected()
+	}
+	s := p.tok.text
+	return s, p.advance()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.tok.text}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == gqlName {
+		op.name = p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if p.is(gqlPunct, "(") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		for !p.is(gqlPunct, ")") {
+			v, err := p.varDef()
+			if err != nil {
+				return nil, err
+			}
+			op.vars = append(op.vars, v)
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.sel = sel
+	return op, nil
+}
+
+func (p *gqlParser) varDef() (gqlVarDef, error) {
+	var v gqlVarDef
+	if err := p.expect("$"); err != nil {
+		return v, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return v, err
+	}
+	v.name = name
+	if err := p.expect(":"); err != nil {
+		return v, err
+	}
+	if v.typ, err = p.typeRef(); err != nil {
+		return v, err
+	}
+	if p.is(gqlPunct, "=") {
+		if err := p.advance(); err != nil {
+			return v, err
+		}
+		if v.def, err = p.value(true); err != nil {
+			return v, err
+		}
+		v.hasDefault = true
+	}
+	_, err = p.directives()
+	return v, err
+}
+
+func (p *gqlParser) typeRef() (*gqlType, error) {
+	t := &gqlType{}
+	if p.is(gqlPunct, "[") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		elem, err := p.typeRef()
+		if err != nil {
+			return nil, err
+		}
+		t.elem = elem
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		t.name = name
+	}
+	if p.is(gqlPunct, "!") {
+		t.nonNull = true
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (p *gqlParser) fragmentDefinition() (*gqlFragment, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	f := &gqlFragment{}
+	var err error
+	if f.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if f.name == "on" {
+		return nil, &gqlSyntaxError{`a fragment cannot be named "on"`, p.tok.line, p.tok.col}
+	}
+	if !p.is(gqlName, "on") {
+		return nil, p.unexpected()
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if f.on, err = p.name(); err != nil {
+		return nil, err
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	f.sel, err = p.selectionSet()
+	return f, err
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var out []*gqlSelection
+	for !p.is(gqlPunct, "}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	if len(out) == 0 {
+		return nil, p.unexpected()
+	}
+	return out, p.advance()
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	s := &gqlSelection{line: p.tok.line, col: p.tok.col}
+	var err error
+	if p.is(gqlPunct, "...") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == gqlName && p.tok.text != "on" {
+			s.fragment = p.tok.text
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			s.directives, err = p.directives()
+			return s, err
+		}
+		s.inline = true
+		if p.is(gqlName, "on") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if s.on, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		s.sel, err = p.selectionSet()
+		return s, err
+	}
+
+	if s.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.is(gqlPunct, ":") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if s.args, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	if s.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.is(gqlPunct, "{") {
+		s.sel, err = p.selectionSet()
+	}
+	return s, err
+}
+
+func (p *gqlParser) arguments() ([]gqlArg, error) {
+	if !p.is(gqlPunct, "(") {
+		return nil, nil
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var out []gqlArg
+	for !p.is(gqlPunct, ")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value(false)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, gqlArg{name, v})
+	}
+	if len(out) == 0 {
+		return nil, p.unexpected()
+	}
+	return out, p.advance()
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var out []gqlDirective
+	for p.is(gqlPunct, "@") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, gqlDirective{name, args})
+	}
+	return out, nil
+}
+
+// value parses an argument value; constant values may not use variables.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	tok := p.tok
+	switch tok.kind {
+	case gqlPunct:
+		switch tok.text {
+		case "$":
+			if constant {
+				return nil, p.unexpected()
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			return gqlVar(name), err
+		case "[":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			list := []interface{}{}
+			for !p.is(gqlPunct, "]") {
+				v, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			return list, p.advance()
+		case "{":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			fields := []gqlArg{}
+			for !p.is(gqlPunct, "}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				v, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				fields = append(fields, gqlArg{name, v})
+			}
+			return fields, p.advance()
+		}
+	case gqlInt:
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, &gqlSyntaxError{fmt.Sprintf("invalid number %s", tok.text), tok.line, tok.col}
+		}
+		return n, p.advance()
+	case gqlFloat:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, &gqlSyntaxError{fmt.Sprintf("invalid number %s", tok.text), tok.line, tok.col}
+		}
+		return f, p.advance()
+	case gqlString:
+		return tok.text, p.advance()
+	case gqlName:
+		var v interface{}
+		switch tok.text {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = gqlEnum(tok.text)
+		}
+		return v, p.advance()
+	}
+	return nil, p.unexpected()
+}
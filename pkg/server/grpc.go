@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcService implements kvpb.KVServer on top of a Server, sharing its
+// store, validation and read-only rules with the HTTP API.
+type grpcService struct {
+	kvpb.UnimplementedKVServer
+	s *Server
+}
+
+func newGRPCServer(s *Server) *grpc.Server {
+	gs := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, done, err := s.grpcAdmit(ctx)
+			if err != nil {
+				return nil, err
+			}
+			defer done()
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, done, err := s.grpcAdmit(ss.Context())
+			if err != nil {
+				return err
+			}
+			defer done()
+			return handler(srv, &grpcStream{ServerStream: ss, ctx: ctx})
+		}),
+	)
+	kvpb.RegisterKVServer(gs, &grpcService{s: s})
+	return gs
+}
+
+// grpcStream is a stream whose calls see the context grpcAdmit returned.
+type grpcStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcStream) Context() context.Context { return s.ctx }
+
+// grpcAdmit holds a call to what the HTTP API holds a request to: it is
+// counted in flight, authenticated by the credentials of its
+// "authorization" (Bearer or Basic) or "x-api-key" metadata, held to the
+// namespace of an issued token and rate limited. It returns the context
+// to serve the call with and a function to call once it is served.
+func (s *Server) grpcAdmit(ctx context.Context) (context.Context, func(), error) {
+	remote := ""
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remote = p.Addr.String()
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			remote = host
+		}
+	}
+	if s.auth != nil {
+		var err error
+		ctx, err = s.auth.login(ctx, grpcCredentials(ctx), remote)
+		var locked *lockedOutError
+		switch {
+		case err == nil:
+		case errors.As(err, &locked):
+			return nil, nil, status.Error(codes.ResourceExhausted, "Too many failed authentication attempts")
+		case errors.Is(err, ErrUnauthenticated):
+			return nil, nil, status.Error(codes.Unauthenticated, "Missing or invalid credentials")
+		default:
+			return nil, nil, status.Error(codes.Unavailable, "The authentication provider is unavailable")
+		}
+	}
+	if g := grantFrom(ctx); g != nil && g.Namespace != "" && g.Namespace != defaultNamespace {
+		return nil, nil, status.Error(codes.PermissionDenied, "This token only grants access to namespace "+g.Namespace)
+	}
+	if l := s.limiter; l != nil {
+		if ok, wait := l.allow(clientKeyFor(clientIDFrom(ctx), remote), l.clock.Now()); !ok {
+			return nil, nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("Rate limit exceeded; retry in %ds", int(math.Ceil(wait.Seconds()))))
+		}
+	}
+	s.inFlight.Add(1)
+	return ctx, func() { s.inFlight.Add(-1) }, nil
+}
+
+// grpcCredentials returns the credentials the metadata of a call presents.
+func grpcCredentials(ctx context.Context) Credentials {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("authorization"); len(v) > 0 {
+		if token, ok := strings.CutPrefix(v[0], "Bearer "); ok {
+			return Credentials{Token: token}
+		}
+		if enc, ok := strings.CutPrefix(v[0], "Basic "); ok {
+			if b, err := base64.StdEncoding.DecodeString(enc); err == nil {
+				if user, pass, ok := strings.Cut(string(b), ":"); ok {
+					return Credentials{Username: user, Password: pass}
+				}
+			}
+		}
+	}
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		return Credentials{Token: v[0]}
+	}
+	return Credentials{}
+}
+
+// grpcError maps store errors to gRPC status codes.
+func grpcError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		code = codes.NotFound
+	case errors.Is(err, ErrQuotaExceeded):
+		code = codes.ResourceExhausted
+	case errors.Is(err, ErrConflict):
+		code = codes.Aborted
+	case errors.Is(err, ErrKeyExists):
+		code = codes.AlreadyExists
+	case errors.Is(err, ErrReadOnly), errors.Is(err, ErrNotLeader):
+		code = codes.Unavailable
+	case errors.Is(err, ErrValidationFailed):
+		code = codes.FailedPrecondition
+	case errors.Is(err, ErrInvalidKey):
+		code = codes.InvalidArgument
+	case errors.Is(err, ErrMissingScope):
+		code = codes.PermissionDenied
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, messageForError(err))
+}
+
+// keyValue returns the value of key, as readKey returned it to the client
+// of ctx, with its revision.
+func (g *grpcService) keyValue(key, value string) *kvpb.KeyValue {
+	kv := &kvpb.KeyValue{Key: key, Value: value}
+	if rv, ok := g.s.store.(keyRevisioner); ok {
+		kv.Revision, _ = rv.Revision(key)
+	}
+	return kv
+}
+
+func (g *grpcService) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	key := g.s.keyRules.canonical(req.GetKey())
+	v, err := g.s.readKey(ctx, g.s.namespaces.def, key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.GetResponse{Item: g.keyValue(key, v)}, nil
+}
+
+func (g *grpcService) Set(ctx context.Context, req *kvpb.SetRequest) (*kvpb.SetResponse, error) {
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "key must not be empty")
+	}
+	if err := g.s.setKey(ctx, g.s.keyRules.canonical(req.GetKey()), req.GetValue()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.SetResponse{}, nil
+}
+
+func (g *grpcService) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	if err := g.s.deleteKey(ctx, g.s.keyRules.canonical(req.GetKey())); err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.DeleteResponse{}, nil
+}
+
+func (g *grpcService) BatchGet(ctx context.Context, req *kvpb.BatchGetRequest) (*kvpb.BatchGetResponse, error) {
+	resp := &kvpb.BatchGetResponse{}
+	for _, key := range req.GetKeys() {
+		key = g.s.keyRules.canonical(key)
+		v, err := g.s.readKey(ctx, g.s.namespaces.def, key)
+		if errors.Is(err, ErrKeyNotFound) {
+			resp.Missing = append(resp.Missing, key)
+			continue
+		} else if err != nil {
+			return nil, grpcError(err)
+		}
+		resp.Items = append(resp.Items, g.keyValue(key, v))
+	}
+	return resp, nil
+}
+
+// BatchSet validates every item before applying any of them, like
+// POST /data.
+func (g *grpcService) BatchSet(ctx context.Context, req *kvpb.BatchSetRequest) (*kvpb.BatchSetResponse, error) {
+	if err := g.s.writesAllowed(); err != nil {
+		return nil, grpcError(err)
+	}
+	for _, item := range req.GetItems() {
+		if item.GetKey() == "" {
+			return nil, status.Error(codes.InvalidArgument, "key must not be empty")
+		}
+		item.Key = g.s.keyRules.canonical(item.GetKey())
+		if err := g.s.validateWrite(ctx, "set", item.GetKey(), item.GetValue()); err != nil {
+			return nil, grpcError(err)
+		}
+	}
+	applied := int32(0)
+	for _, item := range req.GetItems() {
+		if err := g.s.applySet(ctx, g.s.namespaces.def, item.GetKey(), item.GetValue()); err != nil {
+			return &kvpb.BatchSetResponse{Applied: applied}, grpcError(err)
+		}
+		applied++
+	}
+	return &kvpb.BatchSetResponse{Applied: applied}, nil
+}
+
+// Watch leaves out the events of keys the client may not list, as those
+// whose tags require a scope it lacks.
+func (g *grpcService) Watch(req *kvpb.WatchRequest, stream grpc.ServerStreamingServer[kvpb.Event]) error {
+	ctx := stream.Context()
+	if gr := grantFrom(ctx); gr != nil && (!strings.HasPrefix(req.GetPrefix(), gr.Prefix) || !gr.allows(http.MethodGet)) {
+		return status.Error(codes.PermissionDenied, "This token only grants reading keys under "+gr.Prefix)
+	}
+	hide := g.s.hiddenKeys(ctx, g.s.namespaces.def, false)
+	sub := g.s.hub.subscribe(req.GetPrefix())
+	defer g.s.hub.unsubscribe(sub)
+
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watcher fell too far behind")
+			}
+			if hide != nil && hide(ev.Key) {
+				continue
+			}
+			if err := stream.Send(eventToProto(ev)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-g.s.shutdownCh:
+			return status.Error(codes.Unavailable, "server shutting down")
+		}
+	}
+}
+
+func eventToProto(ev Event) *kvpb.Event {
+	typ := kvpb.Event_TYPE_SET
+	// The protocol has no expired type; an expiry is a delete to it.
+	if ev.Type == "delete" || ev.Type == "expired" {
+		typ = kvpb.Event_TYPE_DELETE
+	}
+	return &kvpb.Event{
+		Type:         typ,
+		Key:          ev.Key,
+		Value:        ev.Value,
+		Revision:     ev.Revision,
+		Created:      ev.Created,
+		TimeUnixNano: ev.Time.UnixNano(),
+	}
+}
@@ -0,0 +1,511 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/kvpb"
+)
+
+// POST
+//
+// postDataHandler sets the keys of the body. With ?mode=create, as with
+// PUT, only keys that do not exist yet are written: the batch fails with
+// 409 if any already does, and with ?partial=true those keys are rejected
+// on their own.
+func (s *Server) postDataHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "create":
+		r = r.WithContext(withCreateOnly(r.Context()))
+	case "":
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "mode must be create")
+		return
+	}
+
+	if !checkDataContentType(w, r) {
+		return
+	}
+	payload, fields, err := decodeDataBody(r, s.cfg.StrictJSON)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, invalidBodyMessage(r, err))
+		return
+	}
+	payload = s.keyRules.canonicalKeys(payload)
+	fields = append(fields, s.checkPayload(payload)...)
+	if r.URL.Query().Get("partial") == "true" {
+		s.postDataPartial(w, r, payload, fields)
+		return
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
+		return
+	}
+
+	for k, v := range payload {
+		if err := s.validateWrite(r.Context(), "set", k, v); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	ns := s.namespaceFrom(r.Context())
+	if createOnly(r.Context()) {
+		// Refuse the batch before any of it is written; a key created
+		// meanwhile still fails its own write.
+		for k := range payload {
+			if _, ok := peekValue(ns.store, k); ok {
+				writeStoreError(w, r, &KeyError{Op: "create", Key: k, Err: ErrKeyExists})
+				return
+			}
+		}
+	}
+	for k, v := range payload {
+		if err := s.applySet(r.Context(), ns, k, v); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	writeStored(w, r, len(payload))
+}
+
+// itemResult is the outcome of one key of a partial POST /data.
+type itemResult struct {
+	Status string `json:"status"` // "created", "updated" or "rejected"
+	Code   string `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// postDataPartial applies a POST /data?partial=true batch key by key,
+// storing those that pass validation and rejecting the rest, along with
+// the keys already found wrong in fields, and answers 207 with the result
+// of each.
+func (s *Server) postDataPartial(w http.ResponseWriter, r *http.Request, payload map[string]string, fields []fieldError) {
+	ns := s.namespaceFrom(r.Context())
+	results := make(map[string]itemResult, len(payload)+len(fields))
+	counts := map[string]int{"created": 0, "updated": 0, "rejected": 0}
+	for _, f := range fields {
+		results[f.Field] = itemResult{Status: "rejected", Code: f.Code, Reason: f.Reason}
+		counts["rejected"]++
+	}
+
+	keys := make([]string, 0, len(payload))
+	for k := range payload {
+		if _, rejected := results[k]; !rejected {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var prev previousValue
+		err := s.validateWrite(r.Context(), "set", k, payload[k])
+		if err == nil {
+			err = s.applySet(withPrevious(r.Context(), &prev), ns, k, payload[k])
+		}
+		res := itemResult{Status: "created"}
+		switch {
+		case err != nil:
+			res = itemResult{Status: "rejected", Code: codeForError(err), Reason: messageForError(err)}
+		case prev.Existed:
+			res.Status = "updated"
+		}
+		results[k] = res
+		counts[res.Status]++
+	}
+	applied := counts["created"] + counts["updated"]
+	writeBody(w, responseFormat(r), http.StatusMultiStatus, map[string]interface{}{
+		"results":  results,
+		"created":  counts["created"],
+		"updated":  counts["updated"],
+		"rejected": counts["rejected"],
+	}, func() proto.Message {
+		return &kvpb.BatchSetResponse{Applied: int32(applied)}
+	})
+}
+
+// DELETE
+//
+// deletePrefixHandler removes every key starting with ?prefix and returns
+// how many it deleted. The keys are those present when the request
+// starts; like a POST /data batch, every delete is validated before any
+// is applied. With ?dry_run=true it only lists the keys it would remove.
+func (s *Server) deletePrefixHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := s.keyRules.canonical(q.Get("prefix"))
+	if prefix == "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "prefix is required")
+		return
+	}
+	ns := s.namespaceFrom(r.Context())
+	keys := ns.store.Snapshot().Between(prefix, prefixEnd(prefix))
+	if q.Get("dry_run") == "true" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"dry_run": true, "count": len(keys), "keys": keys})
+		return
+	}
+	if !s.checkWritable(w, r) {
+		return
+	}
+	for _, k := range keys {
+		if err := s.validateWrite(r.Context(), "delete", k, ""); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+	impact := map[string]interface{}{"namespace": ns.name, "prefix": prefix, "keys": len(keys)}
+	if _, ok := s.confirmed(w, r, "delete_prefix", ns.name+"/"+prefix, impact); !ok {
+		return
+	}
+	deleted := 0
+	for _, k := range keys {
+		err := s.applyDelete(r.Context(), ns, k)
+		if errors.Is(err, ErrKeyNotFound) {
+			// Deleted by someone else since the snapshot.
+			continue
+		}
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		deleted++
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "deleted", "deleted": deleted})
+}
+
+// POST
+//
+// flushHandler clears a namespace, by default the default one, or only
+// its keys under {"prefix": "..."}, in one step that bypasses validation
+// webhooks, and returns how many keys it removed. It is recorded in the
+// audit log as one "flush" entry.
+func (s *Server) flushHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	var req struct {
+		Namespace string `json:"namespace"`
+		Prefix    string `json:"prefix"`
+	}
+	if r.ContentLength != 0 {
+		if !s.decodeJSON(w, r, &req) {
+			return
+		}
+	}
+	ns := s.namespaces.def
+	if req.Namespace != "" {
+		if ns = s.namespaces.get(req.Namespace, false); ns == nil {
+			writeError(w, r, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+			return
+		}
+	}
+	prefix := s.keyRules.canonical(req.Prefix)
+	count := ns.store.Len()
+	if prefix != "" {
+		count = len(ns.store.Snapshot().Between(prefix, prefixEnd(prefix)))
+	}
+	impact := map[string]interface{}{"namespace": ns.name, "prefix": prefix, "keys": count}
+	if _, ok := s.confirmed(w, r, "flush", ns.name+"/"+prefix, impact); !ok {
+		return
+	}
+	var n int
+	if err := s.applyFlush(withFlushed(r.Context(), &n), ns, prefix); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "flushed", "namespace": ns.name, "deleted": n})
+}
+
+// GET
+func (s *Server) getDataHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	fields, msg := parseListFields(q)
+	if msg != "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, msg)
+		return
+	}
+	if q.Has("sort") {
+		s.sortedListing(w, r, fields)
+		return
+	}
+	if fields.meta {
+		s.listWithMeta(w, r, fields)
+		return
+	}
+	if q.Has("from") || q.Has("to") {
+		s.rangeScan(w, r, fields)
+		return
+	}
+	// The snapshot is immutable, so it can be encoded without holding any
+	// store locks. JSON and NDJSON are streamed from it; msgpack and
+	// protobuf are built whole.
+	ns := s.namespaceFrom(r.Context())
+	snap := visible(ns.store.Snapshot(), s.hiddenKeys(r.Context(), ns, false))
+	responseMetaFrom(r.Context()).setCount(snap.Len())
+	if ndjson := wantsNDJSON(r); ndjson || responseFormat(r) == formatJSON {
+		var reveal func(key, value string) string
+		if fields.values && (s.sealer != nil || s.hooks != nil) {
+			reveal = func(key, value string) string {
+				v, _ := s.reveal(r.Context(), key, value)
+				return v
+			}
+		}
+		streamListing(s.streamDeadlines(w).writer(w), snap, !fields.values, ndjson, reveal)
+		return
+	}
+	if !fields.values {
+		writeKeys(w, r, snap.Between("", ""))
+		return
+	}
+	writeDataMap(w, r, s.revealAll(r.Context(), snap.values()))
+}
+
+// GET
+func (s *Server) getKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if r.URL.Query().Get("watch") == "true" {
+		s.longPollKey(w, r, key)
+		return
+	}
+	if r.URL.Query().Has("path") {
+		s.getKeyPath(w, r, key)
+		return
+	}
+	if r.URL.Query().Has("version") {
+		s.getKeyVersion(w, r, key)
+		return
+	}
+	ns := s.namespaceFrom(r.Context())
+	s.hotKeys.read(ns.name, key)
+	ctx := r.Context()
+	var read *cacheRead
+	if s.cache != nil {
+		read = &cacheRead{bypass: strings.Contains(r.Header.Get("Cache-Control"), "no-cache")}
+		ctx = withCacheRead(ctx, read)
+	}
+	v, err := getValue(ctx, ns.store, key)
+	if read != nil {
+		s.cache.writeCacheHeaders(w, read)
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if s.writeValidators(w, r, ns.store, key, v) {
+		return
+	}
+	// A value the client may not decrypt is sent sealed, as JSON text
+	// whatever its content type.
+	v, revealed := s.reveal(r.Context(), key, v)
+	if typ := ns.types.get(key); typ != "" && revealed {
+		writeRawValue(s.streamDeadlines(w).writer(w), r, typ, v)
+		return
+	}
+	writeKeyValue(w, r, ns.store, key, v)
+}
+
+// HEAD
+//
+// headKeyHandler is a cheap existence check: it answers 200 or 404 with no
+// body and without counting a read. The value's size in bytes is in
+// X-Value-Length, and its revision, when the store tracks one, in
+// X-Revision, alongside the validators a GET would send.
+func (s *Server) headKeyHandler(w http.ResponseWriter, r *http.Request) {
+	ns := s.namespaceFrom(r.Context())
+	key := r.PathValue("key")
+	v, ok := peekValue(ns.store, key)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	h := w.Header()
+	if typ := ns.types.get(key); typ != "" {
+		h.Set("Content-Type", typ)
+	}
+	h.Set("X-Value-Length", strconv.Itoa(len(v)))
+	if rev := revisionOf(ns.store, key); rev > 0 {
+		h.Set("X-Revision", strconv.FormatUint(rev, 10))
+	}
+	if !s.writeValidators(w, r, ns.store, key, v) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// DELETE
+func (s *Server) deleteDataHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.deleteKey(r.Context(), r.PathValue("key")); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// POST
+//
+// getSetHandler sets the key to {"value": "..."} and returns the value it
+// replaced, read and written in one atomic step. previous is null if the
+// key did not exist.
+func (s *Server) getSetHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	var req struct {
+		Value *string `json:"value"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Value == nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "value is required")
+		return
+	}
+	key := r.PathValue("key")
+	var prev previousValue
+	if err := s.setKey(withPrevious(r.Context(), &prev), key, *req.Value); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	var previous *string
+	if prev.Existed {
+		prev.Value, _ = s.reveal(r.Context(), key, prev.Value)
+		previous = &prev.Value
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "previous": previous})
+}
+
+// POST
+//
+// getDelHandler deletes the key and returns the value it held, in one
+// atomic step.
+func (s *Server) getDelHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	key := r.PathValue("key")
+	var prev previousValue
+	if err := s.deleteKey(withPrevious(r.Context(), &prev), key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	v, _ := s.reveal(r.Context(), key, prev.Value)
+	writeJSON(w, http.StatusOK, map[string]string{"key": key, "value": v})
+}
+
+// GET
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	rt := s.runtimeStats()
+	s.mu.lock(r.Context())
+	defer s.mu.Unlock()
+	json.NewEncoder(w).Encode(s.statsLocked(rt))
+}
+
+// statsLocked returns the body of /stats. It must be called, and the
+// result encoded, with s.mu held, as it shares the server's counters.
+func (s *Server) statsLocked(rt runtimeStats) map[string]interface{} {
+	stats := map[string]interface{}{
+		"total_requests": s.totalRequests,
+		"data_size":      s.store.Len(),
+		"method_count":   s.methodCount,
+		"errors":         s.errorCount,
+		"panics":         s.panicCount,
+		"writes":         s.writeCount.Load(),
+		"deletes":        s.deleteCount.Load(),
+		"in_flight":      s.inFlight.Load(),
+		"evictions":      s.evictionCount(),
+		"runtime":        rt,
+	}
+	if n := s.requests.cancelled.Load(); n > 0 {
+		stats["requests_cancelled"] = n
+	}
+	if queues := s.namespaces.def.queues.all(); len(queues) > 0 {
+		stats["queues"] = queues
+	}
+	if repl := s.replicationStats(); repl != nil {
+		stats["replication"] = repl
+	}
+	if s.admission != nil {
+		stats["admission"] = s.admission.stats()
+	}
+	stats["priority"] = s.priorityStats()
+	if limits := s.routeLimits.stats(); limits != nil {
+		stats["concurrency"] = limits
+	}
+	if len(s.rates) > 0 {
+		stats["rates"] = s.rates
+	}
+	if s.alerter != nil {
+		stats["alerts"] = s.alerter.stats()
+	}
+	if s.slowLog != nil {
+		stats["slow_requests"] = s.slowLog.stats()
+	}
+	if s.lockStats != nil {
+		stats["lock_contention"] = s.lockStats.stats()
+	}
+	if s.cache != nil {
+		stats["cache"] = s.cache.stats()
+	}
+	if s.codec != nil {
+		stats["value_compression"] = s.codec.stats()
+	}
+	if s.dedup != nil {
+		stats["dedup"] = s.dedup.stats()
+	}
+	if s.sealer != nil {
+		stats["value_encryption"] = s.sealer.stats()
+	}
+	if s.hooks != nil {
+		stats["value_hooks"] = s.hooks.stats()
+	}
+	stats["deadlines"] = s.deadlines.stats()
+	stats["events"] = s.events.stats()
+	stats["sessions"] = s.sessions.stats()
+	stats["expiry"] = s.expiryStats()
+	stats["key_sessions"] = s.keySessions.stats()
+	stats["schedules"] = s.schedules.stats()
+	if s.discovery != nil {
+		stats["discovery"] = s.discovery.stats()
+	}
+	if s.registration != nil {
+		stats["registration"] = s.registration.stats()
+	}
+	if s.namespaces.wal != nil {
+		stats["wal"] = s.namespaces.wal.stats()
+	}
+	stats["gc"] = s.gcStats()
+	if s.mirror != nil {
+		stats["mirror"] = s.mirror.snapshot()
+	}
+	if s.shadow != nil {
+		stats["shadow"] = s.shadow.snapshot()
+	}
+	if s.tokens != nil {
+		stats["tokens"] = s.tokens.stats()
+	}
+	if f := s.namespaces.def.filter; f != nil {
+		stats["bloom"] = f.stats()
+	}
+	if s.auth != nil && s.auth.signer != nil {
+		stats["request_signing"] = s.auth.signer.stats()
+	}
+	if s.auth != nil && s.auth.lockout != nil {
+		stats["auth_lockout"] = s.auth.lockout.stats()
+	}
+	return stats
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HeaderList holds "Name: value" response header specs. It implements
+// flag.Value so it can collect a repeated flag.
+type HeaderList []string
+
+func (h *HeaderList) String() string { return strings.Join(*h, ", ") }
+
+func (h *HeaderList) Set(v string) error {
+	if !strings.Contains(v, ":") {
+		return fmt.Errorf("header %q must be in \"Name: value\" form", v)
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+// parseResponseHeaders turns "Name: value" specs into a header set, expanding
+// the placeholders {hostname}, {pid} and {env:NAME} in values.
+func parseResponseHeaders(specs []string) (http.Header, error) {
+	hostname, _ := os.Hostname()
+	out := make(http.Header)
+	for _, spec := range specs {
+		name, value, _ := strings.Cut(spec, ":")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("header %q has an empty name", spec)
+		}
+		out.Add(name, expandHeaderTemplate(strings.TrimSpace(value), hostname))
+	}
+	return out, nil
+}
+
+func expandHeaderTemplate(value, hostname string) string {
+	value = strings.ReplaceAll(value, "{hostname}", hostname)
+	value = strings.ReplaceAll(value, "{pid}", strconv.Itoa(os.Getpid()))
+	for {
+		start := strings.Index(value, "{env:")
+		if start < 0 {
+			return value
+		}
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			return value
+		}
+		name := value[start+len("{env:") : start+end]
+		value = value[:start] + os.Getenv(name) + value[start+end+1:]
+	}
+}
+
+// withResponseHeaders adds the configured headers to every response.
+func withResponseHeaders(headers http.Header) Middleware {
+	if len(headers) == 0 {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range headers {
+				for _, v := range values {
+					w.Header().Add(name, v)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
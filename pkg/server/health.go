@@ -0,0 +1,38 @@
+package server
+
+import "net/http"
+
+// probePaths are the health checks. They are served outside /v1 and
+// without authentication, for load balancers and orchestrators.
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true}
+
+// GET
+//
+// healthzHandler reports that the process is up and serving requests.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET
+//
+// readyzHandler reports whether the server should be sent traffic. It
+// fails with 503 from the moment shutdown begins, so that load balancers
+// stop routing here during the drain period while requests already in
+// flight finish, and while the auth provider cannot authenticate anyone.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status, code := "ready", http.StatusOK
+	body := map[string]interface{}{"in_flight": s.inFlight.Load()}
+	if s.auth != nil {
+		auth := map[string]string{"provider": s.auth.p.Name(), "status": "ok"}
+		if err := s.auth.health(r.Context()); err != nil {
+			auth["status"], auth["error"] = "unavailable", err.Error()
+			status, code = "auth_unavailable", http.StatusServiceUnavailable
+		}
+		body["auth"] = auth
+	}
+	if s.notReady.Load() {
+		status, code = "draining", http.StatusServiceUnavailable
+	}
+	body["status"] = status
+	writeJSON(w, code, body)
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// version is one recorded state of a key.
+type version struct {
+	Revision uint64    `json:"revision"`
+	Value    string    `json:"value,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// valueHistory remembers the last depth versions of every key, fed from the
+// namespace's watch hub. History outlives deletes so that removed values
+// can still be audited.
+type valueHistory struct {
+	depth int
+
+	mu    sync.Mutex
+	byKey map[string][]version // oldest first
+}
+
+func newValueHistory(depth int) *valueHistory {
+	return &valueHistory{depth: depth, byKey: make(map[string][]version)}
+}
+
+// record is a watchHub listener.
+func (h *valueHistory) record(ev Event) {
+	v := version{Revision: ev.Revision, Time: ev.Time}
+	if ev.Type == "delete" {
+		v.Deleted = true
+	} else {
+		v.Value = ev.Value
+	}
+	h.mu.Lock()
+	versions := append(h.byKey[ev.Key], v)
+	if len(versions) > h.depth {
+		versions = append(versions[:0], versions[len(versions)-h.depth:]...)
+	}
+	h.byKey[ev.Key] = versions
+	h.mu.Unlock()
+}
+
+// versions returns the recorded versions of key, newest first.
+func (h *valueHistory) versions(key string) []version {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	src := h.byKey[key]
+	out := make([]version, len(src))
+	for i, v := range src {
+		out[len(src)-1-i] = v
+	}
+	return out
+}
+
+// at returns the state of key as of revision rev: the newest recorded
+// version at or below it. ok is false if that is older than the history
+// reaches.
+func (h *valueHistory) at(key string, rev uint64) (version, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	src := h.byKey[key]
+	for i := len(src) - 1; i >= 0; i-- {
+		if src[i].Revision <= rev {
+			return src[i], true
+		}
+	}
+	return version{}, false
+}
+
+// GET
+func (s *Server) keyHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	ns := s.namespaceFrom(r.Context())
+	if ns.history == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Value history is not enabled")
+		return
+	}
+	key := r.PathValue("key")
+	versions := ns.history.versions(key)
+	if len(versions) == 0 {
+		writeStoreError(w, r, &KeyError{Op: "history", Key: key, Err: ErrKeyNotFound})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "versions": versions})
+}
+
+// getKeyVersion answers GET /data/{key}?version=V with the value key had
+// as of revision V.
+func (s *Server) getKeyVersion(w http.ResponseWriter, r *http.Request, key string) {
+	ns := s.namespaceFrom(r.Context())
+	if ns.history == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Value history is not enabled")
+		return
+	}
+	rev, err := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid version")
+		return
+	}
+	v, ok := ns.history.at(key, rev)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Version not found")
+		return
+	}
+	if v.Deleted {
+		writeStoreError(w, r, &KeyError{Op: "get", Key: key, Err: ErrKeyNotFound})
+		return
+	}
+	w.Header().Set("X-Revision", strconv.FormatUint(v.Revision, 10))
+	value, _ := s.reveal(r.Context(), key, v.Value)
+	writeJSON(w, http.StatusOK, map[string]string{key: value})
+}
+
+// usage returns the number of recorded versions and the bytes of their
+// keys and values, in total and for keys whose newest version is a
+// delete.
+func (h *valueHistory) usage() (n int, bytes int64, deleted int, deletedBytes int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k, versions := range h.byKey {
+		var size int64
+		for _, v := range versions {
+			size += int64(len(k) + len(v.Value))
+		}
+		n, bytes = n+len(versions), bytes+size
+		if versions[len(versions)-1].Deleted {
+			deleted, deletedBytes = deleted+len(versions), deletedBytes+size
+		}
+	}
+	return n, bytes, deleted, deletedBytes
+}
+
+// dropDeleted forgets the history of keys whose newest version is a
+// delete, returning how many versions were dropped.
+func (h *valueHistory) dropDeleted() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for k, versions := range h.byKey {
+		if versions[len(versions)-1].Deleted {
+			n += len(versions)
+			delete(h.byKey, k)
+		}
+	}
+	return n
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The window is split into hotKeyBuckets buckets, and slides by
+	// dropping the oldest bucket.
+	hotKeyBuckets = 6
+
+	// hotKeyCandidates is how many of the keys with the highest estimates
+	// each bucket remembers, per kind of access.
+	hotKeyCandidates = 100
+
+	sketchDepth = 4
+	sketchWidth = 1 << 11
+
+	defaultHotKeyWindow = 5 * time.Minute
+)
+
+// countMinSketch estimates how often each key was seen in fixed space. An
+// estimate is never below the true count, and is above it only by the
+// collisions the key's cells happen to share.
+type countMinSketch struct {
+	counts [sketchDepth][sketchWidth]uint32
+}
+
+func sketchHashes(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// add counts key and returns its new estimate.
+func (c *countMinSketch) add(key string) uint32 {
+	h1, h2 := sketchHashes(key)
+	est := ^uint32(0)
+	for i := range c.counts {
+		cell := &c.counts[i][(h1+uint32(i)*h2)%sketchWidth]
+		*cell++
+		est = min(est, *cell)
+	}
+	return est
+}
+
+func (c *countMinSketch) estimate(key string) uint32 {
+	h1, h2 := sketchHashes(key)
+	est := ^uint32(0)
+	for i := range c.counts {
+		est = min(est, c.counts[i][(h1+uint32(i)*h2)%sketchWidth])
+	}
+	return est
+}
+
+// hotKeySet is one kind of access counted over one bucket: a sketch of
+// every key, and the keys with the highest estimates.
+type hotKeySet struct {
+	sketch countMinSketch
+	top    map[string]uint32
+	floor  uint32 // lowest estimate in top once it is full
+}
+
+func (hs *hotKeySet) reset() {
+	hs.sketch = countMinSketch{}
+	hs.top = make(map[string]uint32, hotKeyCandidates)
+	hs.floor = 0
+}
+
+func (hs *hotKeySet) add(key string) {
+	est := hs.sketch.add(key)
+	if _, ok := hs.top[key]; ok || len(hs.top) < hotKeyCandidates {
+		hs.top[key] = est
+		return
+	}
+	if est <= hs.floor {
+		return
+	}
+	var lowest string
+	for k, n := range hs.top {
+		if lowest == "" || n < hs.top[lowest] {
+			lowest = k
+		}
+	}
+	delete(hs.top, lowest)
+	hs.top[key] = est
+	hs.floor = est
+	for _, n := range hs.top {
+		hs.floor = min(hs.floor, n)
+	}
+}
+
+type hotKeyBucket struct {
+	start         time.Time
+	reads, writes hotKeySet
+}
+
+// hotKeyTracker estimates which keys are read and written most over a
+// sliding window.
+type hotKeyTracker struct {
+	mu      sync.Mutex
+	window  time.Duration
+	buckets [hotKeyBuckets]hotKeyBucket
+	cur     int
+}
+
+func newHotKeyTracker(window time.Duration) *hotKeyTracker {
+	t := &hotKeyTracker{window: window}
+	t.resetLocked()
+	return t
+}
+
+func (t *hotKeyTracker) resetLocked() {
+	for i := range t.buckets {
+		t.buckets[i].start = time.Time{}
+		t.buckets[i].reads.reset()
+		t.buckets[i].writes.reset()
+	}
+	t.cur = 0
+	t.buckets[0].start = time.Now()
+}
+
+func (t *hotKeyTracker) reset() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.resetLocked()
+	t.mu.Unlock()
+}
+
+// bucketLocked returns the bucket for now, moving on to a new one once the
+// current bucket's share of the window has passed.
+func (t *hotKeyTracker) bucketLocked(now time.Time) *hotKeyBucket {
+	span := t.window / hotKeyBuckets
+	for i := 0; i < hotKeyBuckets && now.Sub(t.buckets[t.cur].start) >= span; i++ {
+		next := t.buckets[t.cur].start.Add(span)
+		t.cur = (t.cur + 1) % hotKeyBuckets
+		b := &t.buckets[t.cur]
+		b.start = next
+		b.reads.reset()
+		b.writes.reset()
+	}
+	if now.Sub(t.buckets[t.cur].start) >= span {
+		// Idle for longer than the window: start afresh.
+		t.buckets[t.cur].start = now
+	}
+	return &t.buckets[t.cur]
+}
+
+func hotKeyID(ns, key string) string { return ns + "\x00" + key }
+
+func (t *hotKeyTracker) read(ns, key string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.bucketLocked(time.Now()).reads.add(hotKeyID(ns, key))
+	t.mu.Unlock()
+}
+
+func (t *hotKeyTracker) write(ns, key string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.bucketLocked(time.Now()).writes.add(hotKeyID(ns, key))
+	t.mu.Unlock()
+}
+
+// hotKey is an entry of /stats/hotkeys.
+type hotKey struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Count     uint32 `json:"count"` // estimated accesses over the window
+}
+
+// topLocked sums the estimates of every candidate over the buckets still
+// in the window and returns the n highest.
+func (t *hotKeyTracker) topLocked(now time.Time, n int, set func(*hotKeyBucket) *hotKeySet) []hotKey {
+	var live []*hotKeySet
+	for i := range t.buckets {
+		if b := &t.buckets[i]; now.Sub(b.start) < t.window {
+			live = append(live, set(b))
+		}
+	}
+	totals := make(map[string]uint32)
+	for _, hs := range live {
+		for id := range hs.top {
+			if _, ok := totals[id]; ok {
+				continue
+			}
+			var sum uint32
+			for _, other := range live {
+				sum += other.sketch.estimate(id)
+			}
+			totals[id] = sum
+		}
+	}
+	out := make([]hotKey, 0, len(totals))
+	for id, c := range totals {
+		ns, key, _ := strings.Cut(id, "\x00")
+		out = append(out, hotKey{Namespace: ns, Key: key, Count: c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return hotKeyID(out[i].Namespace, out[i].Key) < hotKeyID(out[j].Namespace, out[j].Key)
+	})
+	return out[:min(n, len(out))]
+}
+
+// GET
+//
+// hotKeysHandler returns the ?n (default 10) most read and most written
+// keys over the tracking window. Counts are estimates: they may be high by
+// the accesses of keys that share sketch cells, but are never low.
+func (s *Server) hotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	t := s.hotKeys
+	if t == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Hot-key tracking is not enabled")
+		return
+	}
+	n := 10
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "n must be a positive integer")
+			return
+		}
+	}
+	now := time.Now()
+	t.mu.Lock()
+	t.bucketLocked(now)
+	reads := t.topLocked(now, n, func(b *hotKeyBucket) *hotKeySet { return &b.reads })
+	writes := t.topLocked(now, n, func(b *hotKeyBucket) *hotKeySet { return &b.writes })
+	t.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"window": t.window.String(),
+		"reads":  reads,
+		"writes": writes,
+	})
+}
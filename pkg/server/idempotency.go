@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+
+	// maxIdempotencyKey bounds the length of an Idempotency-Key.
+	maxIdempotencyKey = 255
+
+	// maxIdempotentRequest is the largest request body accepted with an
+	// Idempotency-Key; the body is buffered to fingerprint the request.
+	maxIdempotentRequest = 32 << 20
+
+	// maxIdempotentBody is the largest response kept for replay. Larger
+	// responses are not cached, and a retry applies the write again.
+	maxIdempotentBody = 1 << 20
+)
+
+// idempotentResponse is a response kept for replay. done is closed once
+// it has been recorded; until then the original request is in flight.
+type idempotentResponse struct {
+	fingerprint [32]byte
+	done        chan struct{}
+	expires     time.Time
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyCache holds the responses to writes made with an
+// Idempotency-Key, by client and key, for a fixed window.
+type idempotencyCache struct {
+	mu     sync.Mutex
+	window time.Duration
+	clock  Clock
+	byKey  map[string]*idempotentResponse
+}
+
+func newIdempotencyCache(window time.Duration, clock Clock) *idempotencyCache {
+	return &idempotencyCache{window: window, clock: clock, byKey: make(map[string]*idempotentResponse)}
+}
+
+// begin returns the entry for key, and whether the caller created it and
+// must now perform the request and record or forget it.
+func (c *idempotencyCache) begin(key string, fp [32]byte, now time.Time) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.byKey[key]; e != nil && now.Before(e.expires) {
+		return e, false
+	}
+	e := &idempotentResponse{fingerprint: fp, done: make(chan struct{}), expires: now.Add(c.window)}
+	c.byKey[key] = e
+	return e, true
+}
+
+// record stores the response to the request that created e.
+func (c *idempotencyCache) record(e *idempotentResponse, status int, header http.Header, body []byte) {
+	e.status, e.header, e.body = status, header, body
+	c.mu.Lock()
+	e.expires = c.clock.Now().Add(c.window)
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// forget drops e so that a retry performs the request again.
+func (c *idempotencyCache) forget(key string, e *idempotentResponse) {
+	c.mu.Lock()
+	if c.byKey[key] == e {
+		delete(c.byKey, key)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// purge drops the responses that expired before now and returns how
+// many. Requests still in flight are kept.
+func (c *idempotencyCache) purge(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, e := range c.byKey {
+		if !now.Before(e.expires) {
+			select {
+			case <-e.done:
+				delete(c.byKey, key)
+				n++
+			default:
+			}
+		}
+	}
+	return n
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	*responseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.body.Len()+len(b) > maxIdempotentBody {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.responseWriter.Write(b)
+}
+
+// withIdempotency replays the recorded response when a write is retried
+// with the same Idempotency-Key, instead of applying it again. Keys are
+// scoped to the client and kept for the cache's window. A key reused for
+// a different request is rejected with 422, and a retry arriving while
+// the original is still being served gets 409. Responses with 5xx or 429
+// statuses are not kept, so a retry after one of those is applied anew.
+func withIdempotency(c *idempotencyCache) Middleware {
+	if c == nil {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			idemKey := r.Header.Get(idempotencyHeader)
+			if idemKey == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(idemKey) > maxIdempotencyKey {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Idempotency-Key is too long")
+				return
+			}
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentRequest))
+			if err != nil {
+				var mbe *http.MaxBytesError
+				if errors.As(err, &mbe) {
+					writeError(w, r, http.StatusRequestEntityTooLarge, codeValueTooLarge, "Request body is too large to be sent with an Idempotency-Key")
+				} else {
+					writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Could not read request body")
+				}
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			h := sha256.New()
+			for _, part := range []string{r.Method, r.URL.Path, r.URL.RawQuery} {
+				h.Write([]byte(part))
+				h.Write([]byte{0})
+			}
+			h.Write(body)
+			var fp [32]byte
+			h.Sum(fp[:0])
+
+			key := clientKey(r) + "\x00" + idemKey
+			e, owner := c.begin(key, fp, c.clock.Now())
+			if !owner {
+				if e.fingerprint != fp {
+					writeError(w, r, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "Idempotency-Key was used for a different request")
+					return
+				}
+				select {
+				case <-e.done:
+				default:
+					writeError(w, r, http.StatusConflict, codeIdempotencyInProgress, "A request with this Idempotency-Key is still in progress")
+					return
+				}
+				for k, v := range e.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(e.status)
+				w.Write(e.body)
+				return
+			}
+
+			rw := &recordingWriter{responseWriter: wrapResponseWriter(w)}
+			completed := false
+			defer func() {
+				if !completed || rw.overflow || rw.status >= 500 || rw.status == http.StatusTooManyRequests {
+					c.forget(key, e)
+					return
+				}
+				header := w.Header().Clone()
+				header.Del("X-Request-Id")
+				c.record(e, rw.status, header, rw.body.Bytes())
+			}()
+			next.ServeHTTP(rw, r)
+			completed = true
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var indexNameRE = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// IndexDef declares a secondary index. Field is a JSONPath into JSON
+// values; an empty Field indexes whole values.
+type IndexDef struct {
+	Name  string `json:"name"`
+	Field string `json:"field,omitempty"`
+}
+
+// IndexDefs is a list of index declarations. It implements flag.Value,
+// parsing repeated "name=$.field" arguments, or a bare "name" to index
+// whole values.
+type IndexDefs []IndexDef
+
+func (d *IndexDefs) String() string {
+	parts := make([]string, len(*d))
+	for i, def := range *d {
+		parts[i] = def.Name
+		if def.Field != "" {
+			parts[i] += "=" + def.Field
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (d *IndexDefs) Set(v string) error {
+	name, field, _ := strings.Cut(v, "=")
+	def := IndexDef{Name: name, Field: field}
+	if _, err := compileIndex(def); err != nil {
+		return err
+	}
+	*d = append(*d, def)
+	return nil
+}
+
+// secondaryIndex maps the terms extracted from values to the keys holding
+// them.
+type secondaryIndex struct {
+	def   IndexDef
+	steps []pathStep // nil for a whole-value index
+
+	byTerm map[string]map[string]struct{}
+	byKey  map[string][]string
+
+	// While the index is being built from existing data, touched records
+	// the keys whose indexed state already came from a live write.
+	touched map[string]struct{}
+}
+
+func compileIndex(def IndexDef) (*secondaryIndex, error) {
+	if !indexNameRE.MatchString(def.Name) {
+		return nil, fmt.Errorf("invalid index name %q", def.Name)
+	}
+	idx := &secondaryIndex{
+		def:    def,
+		byTerm: make(map[string]map[string]struct{}),
+		byKey:  make(map[string][]string),
+	}
+	if def.Field != "" {
+		steps, err := parseJSONPath(def.Field)
+		if err != nil {
+			return nil, fmt.Errorf("index %q: %w", def.Name, err)
+		}
+		idx.steps = steps
+	}
+	return idx, nil
+}
+
+// terms returns the index terms for value. String values index as
+// themselves, other JSON values as their compact JSON text, and every
+// element of a selected array is indexed separately. A value that is not
+// JSON, or lacks the field, has no terms.
+func (idx *secondaryIndex) terms(value string) []string {
+	if idx.steps == nil {
+		return []string{value}
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(value), &doc); err != nil {
+		return nil
+	}
+	v, err := evalJSONPath(doc, idx.steps)
+	if err != nil {
+		return nil
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+	seen := make(map[string]bool, len(items))
+	var out []string
+	for _, item := range items {
+		t := indexTerm(item)
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func indexTerm(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func (idx *secondaryIndex) remove(key string) {
+	for _, t := range idx.byKey[key] {
+		keys := idx.byTerm[t]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(idx.byTerm, t)
+		}
+	}
+	delete(idx.byKey, key)
+}
+
+func (idx *secondaryIndex) put(key, value string) {
+	idx.remove(key)
+	terms := idx.terms(value)
+	if len(terms) == 0 {
+		return
+	}
+	idx.byKey[key] = terms
+	for _, t := range terms {
+		keys := idx.byTerm[t]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			idx.byTerm[t] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+// indexSet holds a namespace's secondary indexes and keeps them up to date
+// from its watch hub.
+type indexSet struct {
+	mu     sync.RWMutex
+	byName map[string]*secondaryIndex
+}
+
+func newIndexSet() *indexSet {
+	return &indexSet{byName: make(map[string]*secondaryIndex)}
+}
+
+// apply is a watchHub listener.
+func (is *indexSet) apply(ev Event) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for _, idx := range is.byName {
+		if ev.Type == "delete" {
+			idx.remove(ev.Key)
+		} else {
+			idx.put(ev.Key, ev.Value)
+		}
+		if idx.touched != nil {
+			idx.touched[ev.Key] = struct{}{}
+		}
+	}
+}
+
+// add declares an index and builds it from the current contents of store.
+// The index is registered before the store is read, so writes racing with
+// the build are not lost.
+func (is *indexSet) add(def IndexDef, store Store) error {
+	idx, err := compileIndex(def)
+	if err != nil {
+		return err
+	}
+	idx.touched = make(map[string]struct{})
+	is.mu.Lock()
+	if _, ok := is.byName[def.Name]; ok {
+		is.mu.Unlock()
+		return fmt.Errorf("%w: index %q already exists", ErrConflict, def.Name)
+	}
+	is.byName[def.Name] = idx
+	is.mu.Unlock()
+
+	data := store.All()
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for k, v := range data {
+		if _, ok := idx.touched[k]; !ok {
+			idx.put(k, v)
+		}
+	}
+	idx.touched = nil
+	return nil
+}
+
+func (is *indexSet) remove(name string) bool {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if _, ok := is.byName[name]; !ok {
+		return false
+	}
+	delete(is.byName, name)
+	return true
+}
+
+// indexInfo describes an index in GET /indexes.
+type indexInfo struct {
+	IndexDef
+	Keys   int `json:"keys"`
+	Values int `json:"values"`
+}
+
+func (is *indexSet) list() []indexInfo {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	out := make([]indexInfo, 0, len(is.byName))
+	for _, idx := range is.byName {
+		out = append(out, indexInfo{IndexDef: idx.def, Keys: len(idx.byKey), Values: len(idx.byTerm)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// lookup returns the keys indexed under term, sorted. ok is false if the
+// index does not exist.
+func (is *indexSet) lookup(name, term string) (keys []string, ok bool) {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	idx, ok := is.byName[name]
+	if !ok {
+		return nil, false
+	}
+	keys = make([]string, 0, len(idx.byTerm[term]))
+	for k := range idx.byTerm[term] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, true
+}
+
+// GET
+func (s *Server) listIndexesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.namespaceFrom(r.Context()).indexes.list())
+}
+
+// POST
+//
+// createIndexHandler declares an index in the namespace and builds it from
+// the keys already stored there.
+func (s *Server) createIndexHandler(w http.ResponseWriter, r *http.Request) {
+	var def IndexDef
+	if !s.decodeJSON(w, r, &def) {
+		return
+	}
+	if _, err := compileIndex(def); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+		return
+	}
+	ns := s.namespaceFrom(r.Context())
+	if err := ns.indexes.add(def, ns.store); err != nil {
+		writeError(w, r, http.StatusConflict, codeConflict, "Index already exists")
+		return
+	}
+	writeJSON(w, http.StatusCreated, def)
+}
+
+// DELETE
+func (s *Server) deleteIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.namespaceFrom(r.Context()).indexes.remove(r.PathValue("name")) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Index not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// GET
+//
+// queryHandler returns the keys whose indexed field equals value.
+func (s *Server) queryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("index")
+	if name == "" || !q.Has("value") {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "index and value are required")
+		return
+	}
+	keys, ok := s.namespaceFrom(r.Context()).indexes.lookup(name, q.Get("value"))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Index not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"index": name,
+		"value": q.Get("value"),
+		"count": len(keys),
+		"keys":  keys,
+	})
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errRequestCancelled is the cause of the context of a request cancelled
+// with DELETE /admin/requests/{id}.
+var errRequestCancelled = errors.New("request cancelled by an administrator")
+
+// inflightRequest is a request being served, as GET /admin/requests
+// lists it.
+type inflightRequest struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Route is the route pattern, once the request has been matched to one.
+	Route     string    `json:"route,omitempty"`
+	Remote    string    `json:"remote"`
+	Started   time.Time `json:"started"`
+	ElapsedMS int64     `json:"elapsed_ms"`
+	// BytesWritten is how much of the response has been sent.
+	BytesWritten int64 `json:"bytes_written"`
+	Cancelled    bool  `json:"cancelled,omitempty"`
+}
+
+// inflightEntry tracks one request for the table.
+type inflightEntry struct {
+	seq              uint64
+	id, method, path string
+	remote           string
+	started          time.Time
+	route            atomic.Pointer[string]
+	written          atomic.Int64
+	cancelled        atomic.Bool
+	cancel           context.CancelCauseFunc
+	// unblock fails any write to the connection in progress.
+	unblock func()
+}
+
+// setRoute records the route the request was matched to. It does nothing
+// on a nil entry, for requests served outside withInflight.
+func (e *inflightEntry) setRoute(route string) {
+	if e != nil {
+		e.route.Store(&route)
+	}
+}
+
+func inflightFrom(ctx context.Context) *inflightEntry {
+	e, _ := ctx.Value(inflightKey).(*inflightEntry)
+	return e
+}
+
+// requestTable is every request being served, so that one holding the
+// server up, such as a huge export, can be found and cancelled. The zero
+// value is ready to use.
+type requestTable struct {
+	mu      sync.Mutex
+	seq     uint64
+	entries map[uint64]*inflightEntry
+
+	cancelled atomic.Int64
+}
+
+func (t *requestTable) add(r *http.Request, cancel context.CancelCauseFunc, unblock func()) *inflightEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = make(map[uint64]*inflightEntry)
+	}
+	t.seq++
+	e := &inflightEntry{
+		seq:     t.seq,
+		id:      requestIDFrom(r.Context()),
+		method:  r.Method,
+		path:    r.URL.Path,
+		remote:  remoteHost(r),
+		started: time.Now(),
+		cancel:  cancel,
+		unblock: unblock,
+	}
+	t.entries[e.seq] = e
+	return e
+}
+
+func (t *requestTable) remove(e *inflightEntry) {
+	t.mu.Lock()
+	delete(t.entries, e.seq)
+	t.mu.Unlock()
+}
+
+// list returns the requests that have been in flight for at least
+// minAge, oldest first.
+func (t *requestTable) list(minAge time.Duration) []inflightRequest {
+	now := time.Now()
+	t.mu.Lock()
+	out := make([]inflightRequest, 0, len(t.entries))
+	for _, e := range t.entries {
+		if now.Sub(e.started) < minAge {
+			continue
+		}
+		req := inflightRequest{
+			ID:           e.id,
+			Method:       e.method,
+			Path:         e.path,
+			Remote:       e.remote,
+			Started:      e.started.UTC(),
+			ElapsedMS:    now.Sub(e.started).Milliseconds(),
+			BytesWritten: e.written.Load(),
+			Cancelled:    e.cancelled.Load(),
+		}
+		if p := e.route.Load(); p != nil {
+			req.Route = *p
+		}
+		out = append(out, req)
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// cancel cancels the context of every request in flight with request ID
+// id, returning how many there were. Request IDs may come from clients,
+// so more than one request can share one.
+func (t *requestTable) cancel(id string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, e := range t.entries {
+		if e.id != id {
+			continue
+		}
+		n++
+		if !e.cancelled.Swap(true) {
+			t.cancelled.Add(1)
+			e.cancel(errRequestCancelled)
+			e.unblock()
+		}
+	}
+	return n
+}
+
+// withInflight tracks the request in s.requests for as long as it is
+// served and gives it a context DELETE /admin/requests/{id} can cancel.
+// Handlers that watch their context stop at once; those streaming a
+// response find their further writes failing, and one blocked on a slow
+// client is released by a write deadline. Either way the connection
+// of a response that had started is dropped, so that the client does not
+// take a cut-short body for a whole one.
+// A request cancelled before its response started is answered with the
+// error its handler, or withTimeout, gives, or else with 503.
+func (s *Server) withInflight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		rc := http.NewResponseController(w)
+		e := s.requests.add(r, cancel, func() { rc.SetWriteDeadline(time.Now()) })
+		defer s.requests.remove(e)
+		iw := &inflightWriter{ResponseWriter: w, e: e}
+		next.ServeHTTP(iw, r.WithContext(context.WithValue(ctx, inflightKey, e)))
+		if !e.cancelled.Load() {
+			return
+		}
+		if !iw.started {
+			rc.SetWriteDeadline(time.Time{})
+			writeError(w, r, http.StatusServiceUnavailable, codeRequestCancelled, "Request was cancelled by an administrator")
+			return
+		}
+		s.logger.Printf("[Requests] Dropped the connection of cancelled request %s %s after %d bytes (request=%s)",
+			r.Method, r.URL.Path, e.written.Load(), e.id)
+		panic(http.ErrAbortHandler)
+	})
+}
+
+// inflightWriter counts the bytes of a response and fails writes to one
+// that had started when its request was cancelled.
+type inflightWriter struct {
+	http.ResponseWriter
+	e       *inflightEntry
+	started bool
+}
+
+func (w *inflightWriter) WriteHeader(status int) {
+	if status >= 200 {
+		w.started = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *inflightWriter) Write(b []byte) (int, error) {
+	if w.started && w.e.cancelled.Load() {
+		return 0, errRequestCancelled
+	}
+	w.started = true
+	n, err := w.ResponseWriter.Write(b)
+	w.e.written.Add(int64(n))
+	return n, err
+}
+
+func (w *inflightWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *inflightWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// GET
+//
+// listRequestsHandler lists the requests being served, oldest first, or
+// with ?min_age (a duration) those in flight for at least that long.
+func (s *Server) listRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	var minAge time.Duration
+	if v := r.URL.Query().Get("min_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "min_age must be a duration")
+			return
+		}
+		minAge = d
+	}
+	writeJSON(w, http.StatusOK, s.requests.list(minAge))
+}
+
+// DELETE
+//
+// cancelRequestHandler cancels the in-flight request with the request ID
+// in the path.
+func (s *Server) cancelRequestHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	n := s.requests.cancel(id)
+	if n == 0 {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No request in flight with ID "+id)
+		return
+	}
+	s.logger.Printf("[Requests] Cancelled %d request(s) with ID %s", n, id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "cancelled", "cancelled": n})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Build information reported by GET /info. They are set at link time, for
+// example:
+//
+//	go build -ldflags "-X github.com/almanac13/AdvProgAsik2/pkg/server.Version=v1.4.0
+//	  -X github.com/almanac13/AdvProgAsik2/pkg/server.Commit=$(git rev-parse HEAD)
+//	  -X github.com/almanac13/AdvProgAsik2/pkg/server.BuildTime=$(date -u +%FT%TZ)"
+//
+// When Commit is left empty it is taken from the VCS stamp the go command
+// embeds, if any, and BuildTime then falls back to that commit's time.
+var (
+	Version   = "dev"
+	Commit    string
+	BuildTime string
+)
+
+// buildInfo is the build section of GET /info.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // built from a dirty tree
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+func currentBuild() buildInfo {
+	b := buildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+				}
+			case "vcs.time":
+				if b.BuildTime == "" {
+					b.BuildTime = s.Value
+				}
+			case "vcs.modified":
+				b.Modified = s.Value == "true" && Commit == ""
+			}
+		}
+	}
+	return b
+}
+
+// limitsInfo are the configured limits; zero means unlimited.
+type limitsInfo struct {
+	MaxValueSize   int64   `json:"max_value_size"`
+	MaxKeyLength   int     `json:"max_key_length"`
+	MaxKeys        int     `json:"max_keys"`
+	MaxMemory      int64   `json:"max_memory"`
+	MaxConns       int     `json:"max_conns"`
+	MaxHeaderBytes int     `json:"max_header_bytes"`
+	RateLimit      float64 `json:"rate_limit"`
+	RateBurst      int     `json:"rate_burst"`
+}
+
+// features reports which optional subsystems are enabled.
+func (s *Server) features() map[string]bool {
+	cfg := s.cfg
+	return map[string]bool{
+		"grpc":               cfg.GRPCAddr != "",
+		"redis":              cfg.RedisAddr != "",
+		"tls":                cfg.TLSCert != "",
+		"h2c":                cfg.H2C,
+		"auth":               s.auth != nil,
+		"rate_limit":         cfg.RateLimit > 0,
+		"proxies":            len(cfg.TrustedProxies) > 0,
+		"proxy_protocol":     cfg.ProxyProtocol,
+		"compression":        s.flags.enabled(featureCompression),
+		"watch":              s.flags.enabled(featureWatch),
+		"cors":               len(cfg.CORSOrigins) > 0,
+		"raft":               s.raft != nil,
+		"sharding":           s.shards != nil,
+		"discovery":          s.discovery != nil && s.discovery.dynamic(),
+		"registration":       s.registration != nil,
+		"point_in_time":      s.namespaces.wal != nil,
+		"replica":            s.replica.Load() != nil,
+		"replication":        cfg.ReplicationBacklog > 0,
+		"mirror":             s.mirror != nil,
+		"shadow_writes":      s.shadow != nil,
+		"tokens":             s.tokens != nil,
+		"auth_lockout":       s.auth != nil && s.auth.lockout != nil,
+		"request_signing":    s.auth != nil && s.auth.signer != nil,
+		"consistency_tokens": s.raft != nil || s.replica.Load() != nil || cfg.ReplicationBacklog > 0,
+		"persistence":        cfg.DataFile != "" || s.backend != nil,
+		"encryption":         cfg.EncryptionKey != "" || cfg.EncryptionKeyFile != "",
+		"backups":            cfg.BackupBucket != "",
+		"audit":              s.audit != nil,
+		"request_recording":  s.recorder != nil,
+		"history":            cfg.HistoryDepth > 0,
+		"soft_delete":        cfg.SoftDeleteRetention > 0,
+		"search":             cfg.Search,
+		"bloom":              cfg.BloomKeys > 0,
+		"eviction":           s.evictor != nil,
+		"cache":              s.cache != nil,
+		"value_compression":  s.codec != nil,
+		"dedup":              s.dedup != nil,
+		"confirm":            s.confirms != nil,
+		"admin_listener":     cfg.AdminAddr != "",
+		"pprof":              cfg.Pprof,
+		"expvar":             cfg.Expvar,
+		"admission_control":  s.admission != nil,
+		"value_encryption":   s.sealer != nil,
+		"value_hooks":        s.hooks != nil,
+		"quotas":             len(cfg.Quotas) > 0,
+		"idempotency":        s.idempotency != nil,
+		"hot_keys":           s.hotKeys != nil,
+		"validation":         s.validator != nil,
+		"webhooks":           len(cfg.Webhooks) > 0 && s.flags.enabled(featureWebhooks),
+		"legacy_routes":      cfg.LegacyRoutes,
+		"swagger_ui":         cfg.SwaggerUI,
+		"chaos":              s.chaos != nil,
+		"slow_request_log":   s.slowLog != nil,
+		"lock_stats":         s.lockStats != nil,
+		"alerts":             s.alerter != nil,
+		"statsd":             s.statsd != nil,
+		"tag_policies":       len(cfg.TagPolicies) > 0,
+		"read_only":          s.maintenance.get().ReadOnly,
+	}
+}
+
+// GET
+//
+// infoHandler tells operators exactly what is deployed: the build, how
+// long the process has been up, and the limits and features it runs with.
+func (s *Server) infoHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.cfg
+	uptime := time.Since(s.started).Round(time.Second)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"build":          currentBuild(),
+		"node_id":        cfg.NodeID,
+		"started":        s.started.UTC(),
+		"uptime":         uptime.String(),
+		"uptime_seconds": int64(uptime / time.Second),
+		"limits": limitsInfo{
+			MaxValueSize:   cfg.MaxValueSize,
+			MaxKeyLength:   cfg.MaxKeyLength,
+			MaxKeys:        cfg.MaxKeys,
+			MaxMemory:      cfg.MaxMemory,
+			MaxConns:       cfg.MaxConns,
+			MaxHeaderBytes: cfg.MaxHeaderBytes,
+			RateLimit:      cfg.RateLimit,
+			RateBurst:      cfg.RateBurst,
+		},
+		"features":      s.features(),
+		"routes":        s.routeSwitch.info(),
+		"error_locales": errorLocales(),
+	})
+}
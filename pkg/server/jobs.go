@@ -0,0 +1,215 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// jobStatus is the state of one background job in GET /admin/jobs.
+type jobStatus struct {
+	Name         string    `json:"name"`
+	Interval     string    `json:"interval"`
+	Runs         int       `json:"runs"`
+	Failures     int       `json:"failures"`
+	Panics       int       `json:"panics"`
+	LastRun      time.Time `json:"last_run,omitzero"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	NextRun      time.Time `json:"next_run,omitzero"`
+}
+
+// job is a task the scheduler runs every interval, delayed by up to jitter
+// so that jobs, and nodes, started together do not fire in lockstep.
+type job struct {
+	name     string
+	interval time.Duration
+	jitter   time.Duration
+	run      func() error
+
+	mu     sync.Mutex
+	status jobStatus
+}
+
+// runOnce runs the job, recovering from a panic so that one failing job
+// cannot take down the process or the other jobs. Failures and panics are
+// published to events.
+func (j *job) runOnce(clock Clock, events *eventBus) {
+	start, began := clock.Now(), time.Now()
+	var err error
+	panicked := false
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicked = true
+				err = fmt.Errorf("panic: %v", p)
+				events.publish(serverEvent{Type: eventJobPanicked, Source: j.name, Message: fmt.Sprintf("Job %s panicked: %v", j.name, p), stack: string(debug.Stack())})
+			}
+		}()
+		err = j.run()
+	}()
+	if err != nil && !panicked {
+		events.publish(serverEvent{Type: eventJobFailed, Source: j.name, Message: fmt.Sprintf("Job %s failed: %v", j.name, err)})
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Runs++
+	j.status.LastRun = start.UTC()
+	j.status.LastDuration = time.Since(began).String()
+	j.status.LastError = ""
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+	}
+	if panicked {
+		j.status.Panics++
+	}
+}
+
+func (j *job) next(clock Clock) time.Duration {
+	d := j.interval
+	if j.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(j.jitter)))
+	}
+	j.mu.Lock()
+	j.status.NextRun = clock.Now().Add(d).UTC()
+	j.mu.Unlock()
+	return d
+}
+
+func (j *job) loop(clock Clock, events *eventBus, stop <-chan struct{}) {
+	t := clock.NewTimer(j.next(clock))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C():
+			j.runOnce(clock, events)
+			t.Reset(j.next(clock))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// jobScheduler runs the server's periodic background tasks, each on its
+// own schedule and goroutine.
+type jobScheduler struct {
+	mu   sync.Mutex
+	jobs []*job
+}
+
+// register adds a job. Jobs registered after start are not run.
+func (js *jobScheduler) register(name string, interval, jitter time.Duration, run func() error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.jobs = append(js.jobs, &job{
+		name:     name,
+		interval: interval,
+		jitter:   jitter,
+		run:      run,
+		status:   jobStatus{Name: name, Interval: interval.String()},
+	})
+}
+
+// start runs every registered job on clock until stop is closed.
+func (js *jobScheduler) start(clock Clock, events *eventBus, stop <-chan struct{}) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	for _, j := range js.jobs {
+		go j.loop(clock, events, stop)
+	}
+}
+
+func (js *jobScheduler) statuses() []jobStatus {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	out := make([]jobStatus, 0, len(js.jobs))
+	for _, j := range js.jobs {
+		j.mu.Lock()
+		out = append(out, j.status)
+		j.mu.Unlock()
+	}
+	return out
+}
+
+// registerJobs sets up the built-in background jobs: recording and
+// reporting stats, unless WorkerInterval is 0, sweeping expired tombstones, leases and idempotency keys,
+// ending sessions that were not renewed, making scheduled operations, discovering nodes, uploading scheduled backups and compacting the storage file.
+func (s *Server) registerJobs() {
+	if s.cfg.WorkerInterval > 0 {
+		s.jobs.register("stats", s.cfg.WorkerInterval, 0, func() error {
+			s.reportSnapshot(s.recordSnapshot())
+			return nil
+		})
+	}
+	if s.statsd != nil && s.cfg.StatsDInterval > 0 {
+		s.jobs.register("statsd", s.cfg.StatsDInterval, 0, s.pushStatsD)
+	}
+	if s.alerter != nil {
+		interval := s.cfg.WorkerInterval
+		if interval <= 0 {
+			interval = workerInterval
+		}
+		s.jobs.register("alerts", interval, 0, s.checkAlerts)
+	}
+	s.jobs.register("sweep", workerInterval, workerInterval/5, func() error {
+		if n := s.purgeTombstones(); n > 0 {
+			s.logger.Printf("[Worker] Purged %d expired tombstones", n)
+		}
+		if n := s.expireKeys(); n > 0 {
+			s.logger.Printf("[Worker] Expired %d keys", n)
+		}
+		if n := s.locks.purge(s.clock.Now()); n > 0 {
+			s.logger.Printf("[Worker] Expired %d lock leases", n)
+		}
+		if s.idempotency != nil {
+			if n := s.idempotency.purge(s.clock.Now()); n > 0 {
+				s.logger.Printf("[Worker] Expired %d idempotency keys", n)
+			}
+		}
+		return nil
+	})
+	s.jobs.register("schedules", time.Second, 0, s.runScheduled)
+	s.jobs.register("sessions", time.Second, 0, s.expireSessions)
+	if s.cfg.BloomKeys > 0 {
+		s.jobs.register("bloom", bloomRebuildInterval, bloomRebuildInterval/10, s.rebuildBloomFilters)
+	}
+	if s.tokens != nil {
+		s.jobs.register("revocations", time.Hour, time.Minute, s.tokens.prune)
+	}
+	if s.discovery != nil && s.discovery.dynamic() {
+		s.jobs.register("discovery", s.discovery.interval, s.discovery.interval/5, s.discovery.refresh)
+	}
+	if wl := s.namespaces.wal; wl != nil {
+		s.jobs.register("wal", wl.interval, wl.interval/20, func() error {
+			return wl.rotate(s.namespaces.list())
+		})
+	}
+	if s.registration != nil {
+		s.jobs.register("registration", s.registration.interval, s.registration.interval/10, s.register)
+	}
+	if s.backups != nil && s.cfg.BackupInterval > 0 {
+		s.jobs.register("backup", s.cfg.BackupInterval, s.cfg.BackupInterval/20, s.scheduledBackup)
+	}
+	if c, ok := s.backend.(compactor); ok && s.cfg.CompactInterval > 0 {
+		s.jobs.register("compact", s.cfg.CompactInterval, s.cfg.CompactInterval/20, func() error {
+			before, after, err := c.compact(false)
+			if err == nil && before > 0 {
+				s.logger.Printf("[Worker] Compacted %s from %d to %d bytes", s.cfg.StoragePath, before, after)
+			}
+			return err
+		})
+	}
+}
+
+// GET
+//
+// listJobsHandler returns the background jobs with the outcome of their
+// last run and when they run next.
+func (s *Server) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.jobs.statuses())
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Values are always stored as strings. A JSON document is stored as its
+// compact JSON text, so it can be decoded again for ?path= queries and
+// merge patches.
+
+// decodePayload reads the body of POST /data: an object whose values are
+// either strings, stored as-is, or any other JSON value, stored as JSON
+// text. In strict mode values other than strings are rejected instead,
+// and returned as field errors rather than in the payload.
+func decodePayload(r *http.Request, strict bool) (map[string]string, []fieldError, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+	out := make(map[string]string, len(raw))
+	var fields []fieldError
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil && (!strict || v[0] == '"') {
+			out[k] = s
+			continue
+		}
+		if strict {
+			fields = append(fields, fieldError{Field: k, Code: fieldNotString, Reason: "value must be a string"})
+			continue
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, v); err != nil {
+			return nil, nil, err
+		}
+		out[k] = buf.String()
+	}
+	return out, fields, nil
+}
+
+// errPathNotFound is returned by evalJSONPath when the path selects nothing.
+var errPathNotFound = errors.New("path not found")
+
+// pathStep is one segment of a parsed JSONPath expression.
+type pathStep struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses the subset of JSONPath supported by ?path=:
+// $, .name, ['name'], [n] (negative counts from the end), .* and [*].
+func parseJSONPath(expr string) ([]pathStep, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("path must start with $")
+	}
+	rest := expr[1:]
+	var steps []pathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			n := strings.IndexAny(rest, ".[")
+			if n < 0 {
+				n = len(rest)
+			}
+			name := rest[:n]
+			rest = rest[n:]
+			if name == "" {
+				return nil, fmt.Errorf("empty member name")
+			}
+			if name == "*" {
+				steps = append(steps, pathStep{wildcard: true})
+			} else {
+				steps = append(steps, pathStep{name: name})
+			}
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [")
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				steps = append(steps, pathStep{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, pathStep{name: inner[1 : len(inner)-1]})
+			default:
+				i, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index %q", inner)
+				}
+				steps = append(steps, pathStep{index: i, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest[0])
+		}
+	}
+	return steps, nil
+}
+
+// evalJSONPath applies steps to doc. With a wildcard anywhere in the path
+// the result is the array of all matches; otherwise it is the single
+// selected value.
+func evalJSONPath(doc interface{}, steps []pathStep) (interface{}, error) {
+	nodes := []interface{}{doc}
+	multi := false
+	for _, st := range steps {
+		var next []interface{}
+		for _, n := range nodes {
+			switch v := n.(type) {
+			case map[string]interface{}:
+				if st.wildcard {
+					// Visit members in key order so results are stable.
+					for _, k := range sortedMemberNames(v) {
+						next = append(next, v[k])
+					}
+				} else if child, ok := v[st.name]; ok && !st.isIndex {
+					next = append(next, child)
+				}
+			case []interface{}:
+				if st.wildcard {
+					next = append(next, v...)
+				} else if st.isIndex {
+					i := st.index
+					if i < 0 {
+						i += len(v)
+					}
+					if i >= 0 && i < len(v) {
+						next = append(next, v[i])
+					}
+				}
+			}
+		}
+		multi = multi || st.wildcard
+		nodes = next
+	}
+	if multi {
+		if nodes == nil {
+			nodes = []interface{}{}
+		}
+		return nodes, nil
+	}
+	if len(nodes) == 0 {
+		return nil, errPathNotFound
+	}
+	return nodes[0], nil
+}
+
+func sortedMemberNames(m map[string]interface{}) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mergePatch applies an RFC 7386 JSON Merge Patch to target.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// getKeyPath answers GET /data/{key}?path=EXPR with the part of the key's
+// JSON document selected by EXPR.
+func (s *Server) getKeyPath(w http.ResponseWriter, r *http.Request, key string) {
+	expr := r.URL.Query().Get("path")
+	steps, err := parseJSONPath(expr)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid path: "+err.Error())
+		return
+	}
+	v, err := s.namespaceFrom(r.Context()).store.Get(key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	v, _ = s.reveal(r.Context(), key, v)
+	var doc interface{}
+	if err := json.Unmarshal([]byte(v), &doc); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, codeNotJSON, "Value is not a JSON document")
+		return
+	}
+	result, err := evalJSONPath(doc, steps)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Path not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "path": expr, "value": result})
+}
+
+// patchLocks serializes merge patches and collection element operations
+// on the same key so that concurrent updates are not lost. Writes by other
+// routes are not excluded.
+var patchLocks [64]sync.Mutex
+
+func patchLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &patchLocks[h.Sum32()%uint32(len(patchLocks))]
+}
+
+// PATCH
+//
+// patchKeyHandler applies a JSON Merge Patch (RFC 7386) to the key's JSON
+// document. A missing key is patched as if it held null.
+func (s *Server) patchKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	if !checkContentType(w, r, "application/merge-patch+json", func(mt string) bool {
+		return mt == "application/merge-patch+json" || mt == "application/json"
+	}) {
+		return
+	}
+	var patch interface{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, describeJSONError(err))
+		return
+	}
+
+	key := r.PathValue("key")
+	mu := patchLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	var doc interface{}
+	if v, err := s.namespaceFrom(r.Context()).store.Get(key); err == nil {
+		if err := json.Unmarshal([]byte(v), &doc); err != nil {
+			writeError(w, r, http.StatusUnprocessableEntity, codeNotJSON, "Value is not a JSON document")
+			return
+		}
+	} else if !errors.Is(err, ErrKeyNotFound) {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	b, err := json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+		return
+	}
+	if err := s.setKey(r.Context(), key, string(b)); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
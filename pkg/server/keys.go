@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	defaultMaxKeyLength = 1024
+
+	// defaultKeyPattern keeps "/" out of keys: a key with a slash can only
+	// be addressed as /data/{key} with the slash escaped, and unescaped it
+	// silently matches no route.
+	defaultKeyPattern = `[^/]+`
+)
+
+// keyRules are the naming rules for keys written by clients. Internal
+// writes, such as queue messages and replicated or restored data, are not
+// checked, so the rules may be tightened without losing existing keys.
+type keyRules struct {
+	maxLength int
+	pattern   *regexp.Regexp
+	expr      string // pattern as configured, for error messages
+	reserved  []string
+
+	// form, if normalize is set, is the Unicode normalization form keys
+	// are converted to wherever they enter the server.
+	form      norm.Form
+	normalize bool
+}
+
+func newKeyRules(cfg Config) (*keyRules, error) {
+	kr := &keyRules{maxLength: cfg.MaxKeyLength, reserved: cfg.ReservedPrefixes}
+	if cfg.KeyPattern != "" {
+		if _, err := regexp.Compile(cfg.KeyPattern); err != nil {
+			return nil, fmt.Errorf("invalid key pattern: %w", err)
+		}
+		kr.pattern = regexp.MustCompile(`^(?:` + cfg.KeyPattern + `)$`)
+		kr.expr = cfg.KeyPattern
+	}
+	switch strings.ToUpper(cfg.KeyNormalization) {
+	case "":
+	case "NFC":
+		kr.form, kr.normalize = norm.NFC, true
+	case "NFD":
+		kr.form, kr.normalize = norm.NFD, true
+	case "NFKC":
+		kr.form, kr.normalize = norm.NFKC, true
+	case "NFKD":
+		kr.form, kr.normalize = norm.NFKD, true
+	default:
+		return nil, fmt.Errorf("invalid key normalization %q: want NFC, NFD, NFKC or NFKD", cfg.KeyNormalization)
+	}
+	return kr, nil
+}
+
+// canonical returns key in the configured normalization form.
+func (kr *keyRules) canonical(key string) string {
+	if !kr.normalize || !utf8.ValidString(key) {
+		return key
+	}
+	return kr.form.String(key)
+}
+
+// check reports why a client may not apply op to key. Deletes are only
+// refused under reserved prefixes, so that keys written before the rules
+// changed can still be removed.
+func (kr *keyRules) check(op, key string) error {
+	for _, p := range kr.reserved {
+		if strings.HasPrefix(key, p) {
+			return fmt.Errorf("%w: prefix %q is reserved", ErrInvalidKey, p)
+		}
+	}
+	if op != "set" {
+		return nil
+	}
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: must not be empty", ErrInvalidKey)
+	case kr.maxLength > 0 && len(key) > kr.maxLength:
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidKey, kr.maxLength)
+	case !utf8.ValidString(key):
+		return fmt.Errorf("%w: not valid UTF-8", ErrInvalidKey)
+	case strings.IndexFunc(key, unicode.IsControl) >= 0:
+		return fmt.Errorf("%w: contains a control character", ErrInvalidKey)
+	case kr.pattern != nil && !kr.pattern.MatchString(key):
+		return fmt.Errorf("%w: must match %s", ErrInvalidKey, kr.expr)
+	}
+	return nil
+}
+
+// canonicalKeys returns payload with its keys normalized. Of keys that
+// normalize to the same form, the last in byte order wins.
+func (kr *keyRules) canonicalKeys(payload map[string]string) map[string]string {
+	if !kr.normalize {
+		return payload
+	}
+	out := make(map[string]string, len(payload))
+	for _, k := range slices.Sorted(maps.Keys(payload)) {
+		out[kr.canonical(k)] = payload[k]
+	}
+	return out
+}
+
+// normalizeKey rewrites the {key} path value of a request to its
+// normalized form, so that every handler and the shard router see the key
+// the way it is stored.
+func (s *Server) normalizeKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.PathValue("key"); key != "" {
+			r.SetPathValue("key", s.keyRules.canonical(key))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionHeader attaches the keys a write sets to a session created with
+// POST /sessions, so that they are deleted when it ends.
+const sessionHeader = "X-Key-Session"
+
+const (
+	defaultSessionTTL = 10 * time.Second
+	maxSessionTTL     = 24 * time.Hour
+)
+
+var errSessionNotFound = errors.New("session not found or expired")
+
+// keySession is a lease that keys are attached to, as etcd's are: a
+// short-lived worker creates one, writes its presence or registration
+// keys with sessionHeader and sends a heartbeat to renew it within every
+// TTL. When it stops, whether by ending the session or by no longer
+// renewing it, its keys are deleted.
+type keySession struct {
+	ID   string        `json:"id"`
+	Name string        `json:"name,omitempty"`
+	TTL  time.Duration `json:"-"`
+	// TTLSeconds is TTL as served.
+	TTLSeconds float64   `json:"ttl"`
+	Created    time.Time `json:"created"`
+	Renewed    time.Time `json:"renewed"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Keys       int       `json:"keys"`
+	// KeyList, of GET /sessions/{id}, names the keys by namespace.
+	KeyList map[string][]string `json:"key_list,omitempty"`
+
+	keys map[sessionKey]struct{}
+}
+
+// sessionKey is a key attached to a session.
+type sessionKey struct{ ns, key string }
+
+// sessionTable holds the sessions of the server. Like locks they are kept
+// in memory only, on the node that granted them, so a restart ends them
+// without deleting their keys.
+type sessionTable struct {
+	mu    sync.Mutex
+	byID  map[string]*keySession
+	byKey map[sessionKey]string
+	// n is len(byKey), for writes to check without taking mu.
+	n atomic.Int64
+
+	expired atomic.Int64 // sessions that were not renewed in time
+	ended   atomic.Int64 // sessions ended with DELETE
+	deleted atomic.Int64 // keys deleted with their session
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{byID: make(map[string]*keySession), byKey: make(map[sessionKey]string)}
+}
+
+// liveLocked returns the session id unless its lease has run out.
+func (st *sessionTable) liveLocked(id string, now time.Time) *keySession {
+	ks := st.byID[id]
+	if ks == nil || !now.Before(ks.ExpiresAt) {
+		return nil
+	}
+	return ks
+}
+
+func (st *sessionTable) create(name string, ttl time.Duration) keySession {
+	b := make([]byte, 16)
+	rand.Read(b)
+	now := time.Now().UTC()
+	ks := &keySession{ID: hex.EncodeToString(b), Name: name, TTL: ttl, Created: now, Renewed: now, ExpiresAt: now.Add(ttl), keys: make(map[sessionKey]struct{})}
+	st.mu.Lock()
+	st.byID[ks.ID] = ks
+	st.mu.Unlock()
+	return *ks
+}
+
+// renew starts the lease of id over, for ttl if it is not 0.
+func (st *sessionTable) renew(id string, ttl time.Duration) (keySession, error) {
+	now := time.Now().UTC()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ks := st.liveLocked(id, now)
+	if ks == nil {
+		return keySession{}, errSessionNotFound
+	}
+	if ttl > 0 {
+		ks.TTL = ttl
+	}
+	ks.Renewed, ks.ExpiresAt = now, now.Add(ks.TTL)
+	return ks.view(false), nil
+}
+
+// view returns a copy of ks to serve, listing its keys if list is set.
+func (ks *keySession) view(list bool) keySession {
+	v := *ks
+	v.Keys, v.keys = len(ks.keys), nil
+	v.TTLSeconds = ks.TTL.Seconds()
+	if list {
+		v.KeyList = make(map[string][]string)
+		for k := range ks.keys {
+			v.KeyList[k.ns] = append(v.KeyList[k.ns], k.key)
+		}
+		for _, keys := range v.KeyList {
+			sort.Strings(keys)
+		}
+	}
+	return v
+}
+
+func (st *sessionTable) get(id string) (keySession, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if ks := st.liveLocked(id, time.Now()); ks != nil {
+		return ks.view(true), true
+	}
+	return keySession{}, false
+}
+
+// list returns the live sessions, oldest first.
+func (st *sessionTable) list() []keySession {
+	now := time.Now()
+	st.mu.Lock()
+	out := make([]keySession, 0, len(st.byID))
+	for id := range st.byID {
+		if ks := st.liveLocked(id, now); ks != nil {
+			out = append(out, ks.view(false))
+		}
+	}
+	st.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// attach moves key of ns to the session id, or with id "" detaches it
+// from its session. It returns the session the key was attached to
+// before, for restore.
+func (st *sessionTable) attach(ns, key, id string) (prev string, err error) {
+	k := sessionKey{ns, key}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if id != "" && st.liveLocked(id, time.Now()) == nil {
+		return "", errSessionNotFound
+	}
+	prev = st.byKey[k]
+	st.setLocked(k, id)
+	return prev, nil
+}
+
+// restore undoes an attach whose write failed.
+func (st *sessionTable) restore(ns, key, prev string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.setLocked(sessionKey{ns, key}, prev)
+}
+
+func (st *sessionTable) setLocked(k sessionKey, id string) {
+	if cur, ok := st.byKey[k]; ok {
+		if ks := st.byID[cur]; ks != nil {
+			delete(ks.keys, k)
+		}
+		delete(st.byKey, k)
+	}
+	if ks := st.byID[id]; ks != nil {
+		ks.keys[k] = struct{}{}
+		st.byKey[k] = id
+	}
+	st.n.Store(int64(len(st.byKey)))
+}
+
+// attached reports whether any key is attached to a session, so that
+// writes need not take the lock while sessions are unused.
+func (st *sessionTable) attached() bool { return st.n.Load() > 0 }
+
+// detach detaches a deleted key from its session.
+func (st *sessionTable) detach(ns, key string) {
+	if st.attached() {
+		st.restore(ns, key, "")
+	}
+}
+
+// end removes the session id and returns the keys attached to it, still
+// attached so that a write racing with the deletes can move one away.
+func (st *sessionTable) end(id string) ([]sessionKey, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ks := st.byID[id]
+	if ks == nil {
+		return nil, false
+	}
+	delete(st.byID, id)
+	keys := make([]sessionKey, 0, len(ks.keys))
+	for k := range ks.keys {
+		keys = append(keys, k)
+	}
+	return keys, true
+}
+
+// due returns the sessions whose lease ran out by now.
+func (st *sessionTable) due(now time.Time) []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var ids []string
+	for id, ks := range st.byID {
+		if !now.Before(ks.ExpiresAt) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// release reports whether k is still attached to the ended session id,
+// detaching it.
+func (st *sessionTable) release(k sessionKey, id string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.byKey[k] != id {
+		return false
+	}
+	delete(st.byKey, k)
+	st.n.Store(int64(len(st.byKey)))
+	return true
+}
+
+func (st *sessionTable) stats() map[string]int64 {
+	st.mu.Lock()
+	active := len(st.byID)
+	st.mu.Unlock()
+	return map[string]int64{
+		"active":       int64(active),
+		"keys":         st.n.Load(),
+		"expired":      st.expired.Load(),
+		"ended":        st.ended.Load(),
+		"keys_deleted": st.deleted.Load(),
+	}
+}
+
+// withSession returns a copy of ctx under which applySet attaches the key
+// it writes to the session id.
+func withSession(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, keySessionKey, id)
+}
+
+func sessionFrom(ctx context.Context) string {
+	id, _ := ctx.Value(keySessionKey).(string)
+	return id
+}
+
+// bindSession attaches key of ns to the session of the write ctx belongs
+// to, or detaches it from the one it had: as with etcd, a write without a
+// session makes the key permanent again. The returned func undoes it, for
+// a write that failed.
+func (s *Server) bindSession(ctx context.Context, ns *namespace, key string) (func(), error) {
+	st := s.keySessions
+	id := sessionFrom(ctx)
+	if id == "" && !st.attached() {
+		return func() {}, nil
+	}
+	prev, err := st.attach(ns.name, key, id)
+	if err != nil {
+		return nil, err
+	}
+	return func() { st.restore(ns.name, key, prev) }, nil
+}
+
+// endSession deletes the keys of the ended session id that are still
+// attached to it, as expired keys are when it ran out. Like expireKey it
+// leaves the deletes to the primary or the Raft leader elsewhere, though
+// sessions are only granted there.
+func (s *Server) endSession(id string, keys []sessionKey, expired bool) int {
+	n := 0
+	for _, k := range keys {
+		if !s.keySessions.release(k, id) {
+			continue
+		}
+		ns := s.namespaces.get(k.ns, false)
+		if ns == nil {
+			continue
+		}
+		ctx := context.Background()
+		if expired {
+			ctx = withExpiring(ctx)
+		}
+		switch err := s.applyDelete(ctx, ns, k.key); {
+		case err == nil:
+			n++
+		case !errors.Is(err, ErrKeyNotFound):
+			s.logger.Printf("[Sessions] Cannot delete %q of session %s: %v", k.key, id, err)
+		}
+	}
+	s.keySessions.deleted.Add(int64(n))
+	return n
+}
+
+// expireSessions ends the sessions whose lease ran out, deleting their
+// keys.
+func (s *Server) expireSessions() error {
+	for _, id := range s.keySessions.due(time.Now()) {
+		keys, ok := s.keySessions.end(id)
+		if !ok {
+			continue
+		}
+		s.keySessions.expired.Add(1)
+		if n := s.endSession(id, keys, true); n > 0 {
+			s.logger.Printf("[Sessions] Session %s expired; deleted %d keys", id, n)
+		}
+	}
+	return nil
+}
+
+// sessionRequest is the body of POST and PUT /sessions.
+type sessionRequest struct {
+	Name string          `json:"name"`
+	TTL  json.RawMessage `json:"ttl"`
+}
+
+// decodeSessionRequest reads the optional body of POST and PUT
+// /sessions; an empty body takes def for the TTL.
+func (s *Server) decodeSessionRequest(w http.ResponseWriter, r *http.Request, def time.Duration) (sessionRequest, time.Duration, bool) {
+	var req sessionRequest
+	if r.ContentLength != 0 && !s.decodeJSON(w, r, &req) {
+		return req, 0, false
+	}
+	ttl, ok := parseDurationJSON(req.TTL, def)
+	if !ok || (ttl == 0 && def != 0) || ttl > maxSessionTTL {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "ttl must be seconds or a duration such as \"10s\", up to 24h")
+		return req, 0, false
+	}
+	return req, ttl, true
+}
+
+// POST
+//
+// createSessionHandler starts a session with a lease of ttl (default 10s),
+// which PUT /sessions/{id} renews.
+func (s *Server) createSessionHandler(w http.ResponseWriter, r *http.Request) {
+	req, ttl, ok := s.decodeSessionRequest(w, r, defaultSessionTTL)
+	if !ok || !s.checkWritable(w, r) {
+		return
+	}
+	ks := s.keySessions.create(req.Name, ttl)
+	writeJSON(w, http.StatusCreated, ks.view(false))
+}
+
+// PUT
+//
+// renewSessionHandler is the heartbeat of a session: it starts its lease
+// over, with a new ttl if the body gives one.
+func (s *Server) renewSessionHandler(w http.ResponseWriter, r *http.Request) {
+	_, ttl, ok := s.decodeSessionRequest(w, r, 0)
+	if !ok {
+		return
+	}
+	ks, err := s.keySessions.renew(r.PathValue("id"), ttl)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Session not found or expired")
+		return
+	}
+	writeJSON(w, http.StatusOK, ks)
+}
+
+// DELETE
+//
+// endSessionHandler ends a session, deleting its keys.
+func (s *Server) endSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	keys, ok := s.keySessions.end(id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Session not found or expired")
+		return
+	}
+	s.keySessions.ended.Add(1)
+	n := s.endSession(id, keys, false)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ended", "deleted": n})
+}
+
+// GET
+func (s *Server) getSessionHandler(w http.ResponseWriter, r *http.Request) {
+	ks, ok := s.keySessions.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Session not found or expired")
+		return
+	}
+	writeJSON(w, http.StatusOK, ks)
+}
+
+// GET
+func (s *Server) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.keySessions.list())
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ldapTimeout bounds a connection to the directory, from dialing to the
+// bind response.
+const ldapTimeout = 5 * time.Second
+
+// LDAP result codes checked for in a bind response.
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// ldapAuth authenticates the user name and password of Basic credentials
+// with a simple bind to an LDAP directory, as the DN made by replacing %s
+// in the user DN template with the escaped user name. An ldaps:// URL
+// binds over TLS.
+// Successful binds are cached by authCache, so the directory is asked
+// at most once per TTL for each client.
+type ldapAuth struct {
+	addr   string
+	tls    *tls.Config // nil for ldap://
+	userDN string
+	cache  *authCache
+}
+
+func newLDAPAuth(rawURL, userDN string, ttl time.Duration) (*ldapAuth, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %q", rawURL)
+	}
+	if strings.Count(userDN, "%s") != 1 {
+		return nil, fmt.Errorf("LDAP user DN %q must contain %%s once", userDN)
+	}
+	la := &ldapAuth{addr: u.Host, userDN: userDN, cache: newAuthCache(ttl)}
+	if u.Scheme == "ldaps" {
+		la.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if u.Port() == "" {
+			la.addr = net.JoinHostPort(u.Hostname(), "636")
+		}
+	} else if u.Port() == "" {
+		la.addr = net.JoinHostPort(u.Hostname(), "389")
+	}
+	return la, nil
+}
+
+func (la *ldapAuth) Name() string { return authLDAP }
+
+func (la *ldapAuth) dial(ctx context.Context) (net.Conn, error) {
+	d := &net.Dialer{Timeout: ldapTimeout}
+	if la.tls != nil {
+		return (&tls.Dialer{NetDialer: d, Config: la.tls}).DialContext(ctx, "tcp", la.addr)
+	}
+	return d.DialContext(ctx, "tcp", la.addr)
+}
+
+func (la *ldapAuth) Authenticate(ctx context.Context, c Credentials) (Identity, error) {
+	// An empty password would be an unauthenticated bind, which
+	// directories accept for anyone.
+	if c.Username == "" || c.Password == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+	if id, ok := la.cache.get(c); ok {
+		return id, nil
+	}
+	conn, err := la.dial(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(ldapTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	dn := fmt.Sprintf(la.userDN, ldapEscapeDN(c.Username))
+	code, msg, err := ldapBind(conn, dn, c.Password)
+	switch {
+	case err != nil:
+		return Identity{}, fmt.Errorf("bind to %s: %w", la.addr, err)
+	case code == ldapInvalidCredentials:
+		return Identity{}, ErrUnauthenticated
+	case code != ldapSuccess:
+		return Identity{}, fmt.Errorf("bind to %s: result %d %s", la.addr, code, msg)
+	}
+	id := Identity{Name: c.Username}
+	la.cache.put(c, id, time.Time{})
+	return id, nil
+}
+
+// Check connects to the directory.
+func (la *ldapAuth) Check(ctx context.Context) error {
+	conn, err := la.dial(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// ldapEscapeDN escapes s for use as an attribute value in a DN (RFC 4514).
+func ldapEscapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(s)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapBind sends a simple bind request for dn on conn and returns the
+// result code and diagnostic message of the response.
+func ldapBind(conn net.Conn, dn, password string) (int, string, error) {
+	req := berTLV(0x30, berTLV(0x02, []byte{1}), // message ID 1
+		berTLV(0x60, // BindRequest
+			berTLV(0x02, []byte{3}), // version 3
+			berTLV(0x04, []byte(dn)),
+			berTLV(0x80, []byte(password)))) // simple authentication
+	if _, err := conn.Write(req); err != nil {
+		return 0, "", err
+	}
+	tag, msg, err := berRead(bufio.NewReader(conn))
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != 0x30 {
+		return 0, "", errors.New("malformed response")
+	}
+	if _, _, msg, err = berNext(msg); err != nil { // message ID
+		return 0, "", err
+	}
+	tag, op, _, err := berNext(msg)
+	if err != nil || tag != 0x61 { // BindResponse
+		return 0, "", errors.New("malformed bind response")
+	}
+	tag, code, op, err := berNext(op)
+	if err != nil || tag != 0x0a || len(code) == 0 { // resultCode
+		return 0, "", errors.New("malformed bind response")
+	}
+	result := 0
+	for _, b := range code {
+		result = result<<8 | int(b)
+	}
+	var diag []byte
+	if _, _, op, err = berNext(op); err == nil { // matchedDN
+		_, diag, _, _ = berNext(op)
+	}
+	return result, string(diag), nil
+}
+
+// berTLV encodes a BER element of tag with the concatenated contents.
+func berTLV(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	out := []byte{tag}
+	if n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var l []byte
+		for v := n; v > 0; v >>= 8 {
+			l = append([]byte{byte(v)}, l...)
+		}
+		out = append(out, 0x80|byte(len(l)))
+		out = append(out, l...)
+	}
+	for _, c := range contents {
+		out = append(out, c...)
+	}
+	return out
+}
+
+// berMax bounds the size of a BER element read from the directory.
+const berMax = 1 << 20
+
+// berHeader parses the tag and definite length that start a BER element,
+// given its first bytes by next.
+func berHeader(next func() (byte, error)) (tag byte, size int, err error) {
+	if tag, err = next(); err != nil {
+		return 0, 0, err
+	}
+	n, err := next()
+	if err != nil {
+		return 0, 0, err
+	}
+	size = int(n)
+	if n&0x80 != 0 {
+		if n&0x7f == 0 || n&0x7f > 4 {
+			return 0, 0, errors.New("unsupported BER length")
+		}
+		size = 0
+		for range n & 0x7f {
+			b, err := next()
+			if err != nil {
+				return 0, 0, err
+			}
+			size = size<<8 | int(b)
+		}
+	}
+	if size > berMax {
+		return 0, 0, errors.New("BER element too large")
+	}
+	return tag, size, nil
+}
+
+// berRead reads one BER element from r.
+func berRead(r *bufio.Reader) (byte, []byte, error) {
+	tag, size, err := berHeader(r.ReadByte)
+	if err != nil {
+		return 0, nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	return tag, buf, nil
+}
+
+// berNext splits the first BER element off b.
+func berNext(b []byte) (tag byte, contents, rest []byte, err error) {
+	i := 0
+	tag, size, err := berHeader(func() (byte, error) {
+		if i == len(b) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		i++
+		return b[i-1], nil
+	})
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(b)-i < size {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, b[i : i+size], b[i+size:], nil
+}
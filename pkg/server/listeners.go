@@ -0,0 +1,237 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// unixPrefix marks a listen address as the path of a Unix domain socket.
+const unixPrefix = "unix:"
+
+// adminPaths are served only on the admin listener when one is configured.
+// Paths are given without the /v1 prefix; each also covers the paths below
+// it.
+var adminPaths = []string{"/admin", "/stats", "/audit", "/info", "/metrics", "/debug"}
+
+// httpListener is one socket the HTTP API is served on.
+type httpListener struct {
+	name string
+	ln   net.Listener
+	srv  *http.Server
+	// served is closed when srv's Serve returns.
+	served chan struct{}
+}
+
+// isAdminPath reports whether p is one of the admin endpoints.
+func isAdminPath(p string) bool {
+	p = strings.TrimPrefix(p, apiPrefix)
+	for _, a := range adminPaths {
+		if p == a || strings.HasPrefix(p, a+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitAdmin restricts h to the admin endpoints when admin is set and to
+// the rest of the API otherwise. Health checks are served on both.
+func splitAdmin(h http.Handler, admin bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !probePaths[r.URL.Path] && isAdminPath(r.URL.Path) != admin {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Not found")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// listen opens the named listener on addr, a TCP address or "unix:" and a
+// socket path, or takes it over from the process that started this one
+// with Upgrade.
+func (s *Server) listen(name, addr string) (net.Listener, error) {
+	ln, err := inheritedListener(name)
+	if err != nil {
+		return nil, err
+	}
+	if ln == nil {
+		if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+			ln, err = listenUnix(path, s.cfg.UnixSocketMode)
+		} else {
+			ln, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if ul, ok := ln.(*net.UnixListener); ok {
+		// Remove the socket file on Stop, as if this process had made it.
+		ul.SetUnlinkOnClose(true)
+	}
+	if s.sockets == nil {
+		s.sockets = make(map[string]net.Listener)
+	}
+	s.sockets[name] = ln
+	return ln, nil
+}
+
+// listenUnix creates a Unix domain socket at path with the given
+// permissions. A socket file left behind by a process that is no longer
+// running is removed first.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		c, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			c.Close()
+			return nil, fmt.Errorf("listen unix %s: %w", path, syscall.EADDRINUSE)
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			os.Remove(path)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// listenHTTP opens every listener the HTTP API is served on: Addr,
+// ExtraAddrs and AdminAddr, each limited to MaxConns connections,
+// accepting TLS alongside plaintext when a key pair is configured and
+// PROXY protocol headers when enabled. When the Redis protocol is served,
+// the listeners but the admin one accept its connections too.
+func (s *Server) listenHTTP() ([]*httpListener, error) {
+	cfg := s.cfg
+	var tlsCfg *tls.Config
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS key pair: %w", err)
+		}
+		tlsCfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	handler := s.handler
+	type spec struct{ name, addr string }
+	specs := []spec{{"http", cfg.Addr}}
+	for i, addr := range cfg.ExtraAddrs {
+		specs = append(specs, spec{"http." + strconv.Itoa(i+1), addr})
+	}
+	if cfg.AdminAddr != "" {
+		handler = splitAdmin(s.handler, false)
+		specs = append(specs, spec{"admin", cfg.AdminAddr})
+	}
+
+	var out []*httpListener
+	for _, sp := range specs {
+		ln, err := s.listen(sp.name, sp.addr)
+		if err != nil {
+			for _, hl := range out {
+				hl.ln.Close()
+			}
+			return nil, fmt.Errorf("%s listen: %w", sp.name, err)
+		}
+		if cfg.ProxyProtocol {
+			ln = &proxyListener{Listener: ln, trusted: s.proxies}
+		}
+		if cfg.MaxConns > 0 {
+			ln = newLimitListener(ln, cfg.MaxConns)
+		}
+		if resp := cfg.RedisAddr != "" && sp.name != "admin"; tlsCfg != nil || resp {
+			ln = newSniffListener(ln, tlsCfg, resp)
+		}
+		srv := s.newHTTPServer(handler)
+		if sp.name == "admin" {
+			srv.Handler = splitAdmin(s.adminHandler, true)
+			srv.ReadTimeout = cmp.Or(cfg.AdminReadTimeout, cfg.ReadTimeout)
+			srv.WriteTimeout = cmp.Or(cfg.AdminWriteTimeout, cfg.WriteTimeout)
+		}
+		out = append(out, &httpListener{name: sp.name, ln: ln, srv: srv})
+	}
+	return out, nil
+}
+
+func (s *Server) newHTTPServer(h http.Handler) *http.Server {
+	cfg := s.cfg
+	srv := &http.Server{
+		Handler:           h,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ErrorLog:          s.logger,
+	}
+	if cfg.H2C {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if cfg.HTTP2MaxStreams > 0 || cfg.HTTP2StreamBuffer > 0 {
+		srv.HTTP2 = &http.HTTP2Config{
+			MaxConcurrentStreams:      cfg.HTTP2MaxStreams,
+			MaxReceiveBufferPerStream: cfg.HTTP2StreamBuffer,
+		}
+	}
+	return srv
+}
+
+// serve runs hl's server in the background.
+func (s *Server) serve(hl *httpListener) {
+	hl.served = make(chan struct{})
+	go func() {
+		defer close(hl.served)
+		if err := hl.srv.Serve(hl.ln); err != nil && err != http.ErrServerClosed && !s.handedOff.Load() {
+			s.errs <- fmt.Errorf("%s: %w", hl.name, err)
+		}
+	}()
+	what := "Server"
+	if hl.name == "admin" {
+		what = "Admin server"
+	}
+	var serves []string
+	if s.cfg.TLSCert != "" {
+		serves = append(serves, "TLS and plaintext")
+	}
+	if sl, ok := hl.ln.(*sniffListener); ok && sl.resp != nil {
+		serves = append(serves, "Redis protocol")
+	}
+	if len(serves) > 0 {
+		s.logger.Println(what, "starting on", hl.ln.Addr(), "("+strings.Join(serves, ", ")+")")
+	} else {
+		s.logger.Println(what, "starting on", hl.ln.Addr())
+	}
+}
+
+// shutdown stops hl's server, waiting for its connections to finish until
+// ctx is done.
+func (hl *httpListener) shutdown(ctx context.Context) error {
+	err := hl.srv.Shutdown(ctx)
+	// A connection accepted just as Shutdown began is only tracked once
+	// Serve has returned; wait for that one too.
+	if err == nil {
+		select {
+		case <-hl.served:
+			err = hl.srv.Shutdown(ctx)
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	return err
+}
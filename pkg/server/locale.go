@@ -0,0 +1,107 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// The message catalogs of error responses, one JSON file per language
+// named by its BCP 47 tag. A catalog translates the message of an error
+// by its exact English text, and has a text for every error code to fall
+// back on for messages it does not know, such as those naming a key.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// messageCatalog is a language's translations of error messages.
+type messageCatalog struct {
+	Codes    map[string]string `json:"codes"`
+	Messages map[string]string `json:"messages"`
+}
+
+var (
+	// Catalogs are indexed as the tags of localeMatcher, after English,
+	// the language messages are written in.
+	catalogs      []*messageCatalog
+	localeTags    []language.Tag
+	localeMatcher language.Matcher
+)
+
+func init() {
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	localeTags = []language.Tag{language.English}
+	catalogs = []*messageCatalog{nil}
+	for _, e := range entries {
+		buf, err := localeFiles.ReadFile(path.Join("locales", e.Name()))
+		if err != nil {
+			panic(err)
+		}
+		cat := new(messageCatalog)
+		if err := json.Unmarshal(buf, cat); err != nil {
+			panic("server: message catalog " + e.Name() + ": " + err.Error())
+		}
+		localeTags = append(localeTags, language.MustParse(strings.TrimSuffix(e.Name(), ".json")))
+		catalogs = append(catalogs, cat)
+	}
+	localeMatcher = language.NewMatcher(localeTags)
+}
+
+// errorLocales lists the languages error messages are available in, for
+// /info.
+func errorLocales() []string {
+	out := make([]string, len(localeTags))
+	for i, t := range localeTags {
+		out[i] = t.String()
+	}
+	sort.Strings(out)
+	return out
+}
+
+// localizedMessage returns the message of an error response with code in
+// the language r prefers by its Accept-Language header, naming it in the
+// Content-Language header, or else the message as it is.
+func localizedMessage(w http.ResponseWriter, r *http.Request, code, message string) string {
+	w.Header().Add("Vary", "Accept-Language")
+	if m, lang, ok := localizeError(r, code, message); ok {
+		w.Header().Set("Content-Language", lang.String())
+		return m
+	}
+	return message
+}
+
+// localizeError translates the message of an error with code into the
+// language r prefers, returning the language, or ok false to leave the
+// message in English. A message the catalog has no translation for gets
+// the text of its code, followed by the English message so that what it
+// said is not lost.
+func localizeError(r *http.Request, code, message string) (localized string, lang language.Tag, ok bool) {
+	accept := r.Header.Get("Accept-Language")
+	if accept == "" {
+		return "", language.Und, false
+	}
+	prefs, _, err := language.ParseAcceptLanguage(accept)
+	if err != nil || len(prefs) == 0 {
+		return "", language.Und, false
+	}
+	_, i, conf := localeMatcher.Match(prefs...)
+	if i == 0 || conf == language.No {
+		return "", language.Und, false
+	}
+	cat := catalogs[i]
+	if m, ok := cat.Messages[message]; ok {
+		return m, localeTags[i], true
+	}
+	if c, ok := cat.Codes[code]; ok {
+		return c + " (" + message + ")", localeTags[i], true
+	}
+	return "", language.Und, false
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults for locking out clients that fail to authenticate.
+const (
+	defaultLockoutWindow   = 10 * time.Minute
+	defaultLockoutDuration = time.Minute
+	defaultLockoutMax      = time.Hour
+)
+
+// lockoutPruneInterval is how often idle clients are dropped.
+const lockoutPruneInterval = time.Minute
+
+// authFailures is the failure history of one client address.
+type authFailures struct {
+	count       int       // failures since first
+	first       time.Time // start of the current window
+	last        time.Time
+	lockouts    int // lockouts since the last success, for the backoff
+	lockedUntil time.Time
+}
+
+// authLockout counts failed authentications per client address and locks
+// out an address that fails threshold times within window: for duration
+// the first time, twice as long each following time, up to max. A success
+// clears the history. Only requests that present credentials count, so a
+// client that sends none is refused but never locked out.
+type authLockout struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	max       time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*authFailures
+	lastPrune time.Time
+	failures  uint64
+	rejected  uint64
+	lockouts  uint64
+}
+
+func newAuthLockout(cfg Config) *authLockout {
+	if cfg.AuthLockoutThreshold <= 0 {
+		return nil
+	}
+	l := &authLockout{
+		threshold: cfg.AuthLockoutThreshold,
+		window:    cfg.AuthLockoutWindow,
+		duration:  cfg.AuthLockoutDuration,
+		max:       cfg.AuthLockoutMax,
+		clients:   make(map[string]*authFailures),
+		lastPrune: time.Now(),
+	}
+	if l.window <= 0 {
+		l.window = defaultLockoutWindow
+	}
+	if l.duration <= 0 {
+		l.duration = defaultLockoutDuration
+	}
+	if l.max < l.duration {
+		l.max = l.duration
+	}
+	return l
+}
+
+// locked reports how much longer remote is locked out, if it is.
+func (l *authLockout) locked(remote string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.clients[remote]
+	if !ok || !now.Before(f.lockedUntil) {
+		return 0, false
+	}
+	l.rejected++
+	return f.lockedUntil.Sub(now), true
+}
+
+// fail records a failure by remote and returns how long it is now locked
+// out for, or 0 if it is not.
+func (l *authLockout) fail(remote string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(now)
+	l.failures++
+	f, ok := l.clients[remote]
+	if !ok {
+		f = &authFailures{}
+		l.clients[remote] = f
+	}
+	if now.Sub(f.first) > l.window {
+		f.count, f.first = 0, now
+	}
+	f.count++
+	f.last = now
+	if f.count < l.threshold {
+		return 0
+	}
+	d := l.duration
+	for i := 0; i < f.lockouts && d < l.max; i++ {
+		d *= 2
+	}
+	d = min(d, l.max)
+	f.lockouts++
+	f.count, f.first = 0, now
+	f.lockedUntil = now.Add(d)
+	l.lockouts++
+	return d
+}
+
+// succeed clears the history of remote.
+func (l *authLockout) succeed(remote string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, remote)
+}
+
+// unlock clears the history of remote, reporting whether it had one.
+func (l *authLockout) unlock(remote string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.clients[remote]
+	delete(l.clients, remote)
+	return ok
+}
+
+// pruneLocked drops clients whose lockout has run out and that have not
+// failed for long enough that their backoff no longer matters.
+func (l *authLockout) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < lockoutPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for remote, f := range l.clients {
+		if now.After(f.lockedUntil) && now.Sub(f.last) > max(l.window, l.max) {
+			delete(l.clients, remote)
+		}
+	}
+}
+
+// lockedClient is an address in GET /admin/lockouts.
+type lockedClient struct {
+	Remote      string    `json:"remote"`
+	Failures    int       `json:"failures"`
+	Lockouts    int       `json:"lockouts"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+// list returns the clients with a failure history, locked out ones first.
+func (l *authLockout) list(now time.Time) []lockedClient {
+	l.mu.Lock()
+	out := make([]lockedClient, 0, len(l.clients))
+	for remote, f := range l.clients {
+		c := lockedClient{Remote: remote, Failures: f.count, Lockouts: f.lockouts, LastFailure: f.last.UTC()}
+		if now.Before(f.lockedUntil) {
+			c.LockedUntil = f.lockedUntil.UTC()
+		}
+		out = append(out, c)
+	}
+	l.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].LockedUntil.IsZero() != out[j].LockedUntil.IsZero() {
+			return !out[i].LockedUntil.IsZero()
+		}
+		return out[i].Remote < out[j].Remote
+	})
+	return out
+}
+
+func (l *authLockout) stats() map[string]interface{} {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	locked := 0
+	for _, f := range l.clients {
+		if now.Before(f.lockedUntil) {
+			locked++
+		}
+	}
+	return map[string]interface{}{
+		"threshold": l.threshold,
+		"tracked":   len(l.clients),
+		"locked":    locked,
+		"failures":  l.failures,
+		"lockouts":  l.lockouts,
+		"rejected":  l.rejected,
+	}
+}
+
+// writeLockedOut answers a request from a client that is locked out.
+func writeLockedOut(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, codeAuthLocked, "Too many failed authentication attempts")
+}
+
+// GET
+//
+// listLockoutsHandler lists the client addresses that have failed to
+// authenticate recently and any lockouts in force.
+func (s *Server) listLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.auth == nil || s.auth.lockout == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Authentication lockout is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.auth.lockout.list(time.Now()))
+}
+
+// DELETE
+//
+// unlockHandler lifts the lockout of a client address and forgets its
+// failures.
+func (s *Server) unlockHandler(w http.ResponseWriter, r *http.Request) {
+	if s.auth == nil || s.auth.lockout == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Authentication lockout is not enabled")
+		return
+	}
+	remote := r.PathValue("remote")
+	if !s.auth.lockout.unlock(remote) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No failures recorded for "+remote)
+		return
+	}
+	s.logger.Printf("[Auth] %s lifted the lockout of %s", clientIDFrom(r.Context()), remote)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "unlocked"})
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLockTTL = 30 * time.Second
+	maxLockTTL     = 24 * time.Hour
+)
+
+// lease is a held lock. Token is a fencing token: every acquisition gets a
+// higher one than the last, so a resource guarded by the lock can reject
+// writes from a holder whose lease has since expired and passed on.
+type lease struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Token     uint64    `json:"token"`
+	Acquired  time.Time `json:"acquired"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var (
+	errLockHeld = errors.New("lock is held by another owner")
+	errLockLost = errors.New("lock is not held with that token")
+)
+
+// lockTable holds the leases of the server. Like other side tables it is
+// kept in memory only, on the node that granted it.
+type lockTable struct {
+	mu     sync.Mutex
+	byName map[string]*lease
+	last   uint64 // the latest fencing token handed out
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{byName: make(map[string]*lease)}
+}
+
+// liveLocked returns the unexpired lease on name, dropping an expired one.
+func (lt *lockTable) liveLocked(name string, now time.Time) *lease {
+	l := lt.byName[name]
+	if l != nil && !now.Before(l.ExpiresAt) {
+		delete(lt.byName, name)
+		return nil
+	}
+	return l
+}
+
+// acquire grants name to owner for ttl from now. An owner acquiring a
+// lock it already holds extends its lease and keeps its token.
+func (lt *lockTable) acquire(name, owner string, ttl time.Duration, now time.Time) (lease, error) {
+	now = now.UTC()
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if l := lt.liveLocked(name, now); l != nil {
+		if l.Owner != owner {
+			return *l, errLockHeld
+		}
+		l.ExpiresAt = now.Add(ttl)
+		return *l, nil
+	}
+	lt.last++
+	l := &lease{Name: name, Owner: owner, Token: lt.last, Acquired: now, ExpiresAt: now.Add(ttl)}
+	lt.byName[name] = l
+	return *l, nil
+}
+
+// refresh extends the lease on name held with token to ttl from now.
+func (lt *lockTable) refresh(name string, token uint64, ttl time.Duration, now time.Time) (lease, error) {
+	now = now.UTC()
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	l := lt.liveLocked(name, now)
+	if l == nil || l.Token != token {
+		return lease{}, errLockLost
+	}
+	l.ExpiresAt = now.Add(ttl)
+	return *l, nil
+}
+
+// release frees name if it is held with token.
+func (lt *lockTable) release(name string, token uint64, now time.Time) error {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	l := lt.liveLocked(name, now)
+	if l == nil || l.Token != token {
+		return errLockLost
+	}
+	delete(lt.byName, name)
+	return nil
+}
+
+func (lt *lockTable) get(name string, now time.Time) (lease, bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if l := lt.liveLocked(name, now); l != nil {
+		return *l, true
+	}
+	return lease{}, false
+}
+
+// list returns the leases live at now sorted by name, dropping expired
+// ones.
+func (lt *lockTable) list(now time.Time) []lease {
+	lt.mu.Lock()
+	out := make([]lease, 0, len(lt.byName))
+	for name := range lt.byName {
+		if l := lt.liveLocked(name, now); l != nil {
+			out = append(out, *l)
+		}
+	}
+	lt.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// purge drops the leases that expired before now and returns how many.
+func (lt *lockTable) purge(now time.Time) int {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	n := 0
+	for name := range lt.byName {
+		if lt.liveLocked(name, now) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// parseDurationJSON reads a duration given as seconds or as a string such
+// as "1m30s", returning def when raw is empty. Negative durations are
+// rejected.
+func parseDurationJSON(raw json.RawMessage, def time.Duration) (time.Duration, bool) {
+	if len(raw) == 0 {
+		return def, true
+	}
+	var d time.Duration
+	var secs float64
+	var str string
+	switch {
+	case json.Unmarshal(raw, &secs) == nil:
+		d = time.Duration(secs * float64(time.Second))
+	case json.Unmarshal(raw, &str) == nil:
+		var err error
+		if d, err = time.ParseDuration(str); err != nil {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	return d, d >= 0
+}
+
+// lockRequest is the body of POST and PUT /locks/{name}.
+type lockRequest struct {
+	Owner string          `json:"owner"`
+	Token uint64          `json:"token"`
+	TTL   json.RawMessage `json:"ttl"`
+}
+
+func (s *Server) decodeLockRequest(w http.ResponseWriter, r *http.Request) (lockRequest, time.Duration, bool) {
+	var req lockRequest
+	if !s.decodeJSON(w, r, &req) {
+		return req, 0, false
+	}
+	ttl, ok := parseDurationJSON(req.TTL, defaultLockTTL)
+	if !ok || ttl == 0 || ttl > maxLockTTL {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "ttl must be seconds or a duration such as \"30s\", up to 24h")
+		return req, 0, false
+	}
+	return req, ttl, true
+}
+
+// POST
+//
+// acquireLockHandler takes the lock for the owner in the body, with a
+// lease of ttl. It answers 409 with the current holder when another
+// owner has it.
+func (s *Server) acquireLockHandler(w http.ResponseWriter, r *http.Request) {
+	req, ttl, ok := s.decodeLockRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Owner == "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "owner is required")
+		return
+	}
+	l, err := s.locks.acquire(r.PathValue("name"), req.Owner, ttl, s.clock.Now())
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(l.ExpiresAt.Sub(s.clock.Now()).Seconds())+1))
+		writeErrorDetails(w, r, http.StatusConflict, codeLockHeld, "Lock is held by "+l.Owner,
+			[]string{"expires_at: " + l.ExpiresAt.Format(time.RFC3339Nano)})
+		return
+	}
+	writeJSON(w, http.StatusCreated, l)
+}
+
+// PUT
+//
+// refreshLockHandler extends the lease held with the token in the body.
+func (s *Server) refreshLockHandler(w http.ResponseWriter, r *http.Request) {
+	req, ttl, ok := s.decodeLockRequest(w, r)
+	if !ok {
+		return
+	}
+	l, err := s.locks.refresh(r.PathValue("name"), req.Token, ttl, s.clock.Now())
+	if err != nil {
+		writeError(w, r, http.StatusConflict, codeLockLost, "Lock is not held with that token")
+		return
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+// DELETE
+//
+// releaseLockHandler frees the lock held with ?token=.
+func (s *Server) releaseLockHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := strconv.ParseUint(r.URL.Query().Get("token"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "token is required")
+		return
+	}
+	if err := s.locks.release(r.PathValue("name"), token, s.clock.Now()); err != nil {
+		writeError(w, r, http.StatusConflict, codeLockLost, "Lock is not held with that token")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "released"})
+}
+
+// GET
+func (s *Server) getLockHandler(w http.ResponseWriter, r *http.Request) {
+	l, ok := s.locks.get(r.PathValue("name"), s.clock.Now())
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Lock is not held")
+		return
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+// GET
+func (s *Server) listLocksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.locks.list(s.clock.Now()))
+}
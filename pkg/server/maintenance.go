@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMaintenanceRetry is the Retry-After sent while in read-only mode
+// when none was given.
+const defaultMaintenanceRetry = time.Minute
+
+// maintenanceError rejects a write while the server is in read-only mode.
+// It is an ErrReadOnly that also tells clients when to retry.
+type maintenanceError struct {
+	retryAfter time.Duration
+}
+
+func (e *maintenanceError) Error() string { return ErrReadOnly.Error() + " for maintenance" }
+
+func (e *maintenanceError) Unwrap() error { return ErrReadOnly }
+
+// maintenanceStatus is the body of GET and PUT /admin/maintenance.
+type maintenanceStatus struct {
+	ReadOnly   bool      `json:"read_only"`
+	Reason     string    `json:"reason,omitempty"`
+	RetryAfter int       `json:"retry_after,omitempty"` // seconds
+	Since      time.Time `json:"since,omitzero"`
+}
+
+// maintenanceMode is the read-only switch of /admin/maintenance. While it
+// is on, client writes are rejected; reads, and writes replicated from a
+// leader or primary, carry on.
+type maintenanceMode struct {
+	mu     sync.RWMutex
+	status maintenanceStatus
+}
+
+func (m *maintenanceMode) get() maintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+func (m *maintenanceMode) set(on bool, reason string, retryAfter time.Duration) maintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !on {
+		m.status = maintenanceStatus{}
+		return m.status
+	}
+	if !m.status.ReadOnly {
+		m.status.Since = time.Now().UTC()
+	}
+	m.status.ReadOnly = true
+	m.status.Reason = reason
+	m.status.RetryAfter = int(retryAfter.Round(time.Second) / time.Second)
+	return m.status
+}
+
+// err returns the error writes fail with, or nil when writes are allowed.
+func (m *maintenanceMode) err() error {
+	st := m.get()
+	if !st.ReadOnly {
+		return nil
+	}
+	return &maintenanceError{retryAfter: time.Duration(st.RetryAfter) * time.Second}
+}
+
+// writesAllowed returns ErrReadOnly while the server is shutting down or
+// in read-only mode, and nil otherwise.
+func (s *Server) writesAllowed() error {
+	if s.draining.Load() {
+		return ErrReadOnly
+	}
+	return s.maintenance.err()
+}
+
+// GET
+func (s *Server) getMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.maintenance.get())
+}
+
+// PUT
+//
+// putMaintenanceHandler switches read-only mode with {"read_only": true}.
+// reason is shown to operators, and retry_after, in seconds or as a
+// duration such as "5m", is sent to rejected writers in Retry-After.
+func (s *Server) putMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ReadOnly   *bool           `json:"read_only"`
+		Reason     string          `json:"reason"`
+		RetryAfter json.RawMessage `json:"retry_after"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if req.ReadOnly == nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "read_only is required")
+		return
+	}
+	retry, ok := parseDurationJSON(req.RetryAfter, defaultMaintenanceRetry)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "retry_after must be seconds or a duration such as \"5m\"")
+		return
+	}
+	st := s.maintenance.set(*req.ReadOnly, req.Reason, retry)
+	if *req.ReadOnly {
+		s.logger.Printf("Read-only mode on: %s", req.Reason)
+	} else {
+		s.logger.Println("Read-only mode off")
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// setRetryAfter adds the Retry-After header for an error caused by
+// read-only mode.
+func setRetryAfter(w http.ResponseWriter, me *maintenanceError) {
+	if secs := int(me.retryAfter / time.Second); secs > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+}
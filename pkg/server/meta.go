@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+)
+
+// keyWithMeta is a list entry of GET /data?meta=true.
+type keyWithMeta struct {
+	Value       string   `json:"value"`
+	ContentType string   `json:"content_type,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	KeyMeta
+}
+
+// GET
+func (s *Server) getKeyMetaHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	mp, ok := s.namespaceFrom(r.Context()).store.(metadataProvider)
+	if !ok {
+		writeError(w, r, http.StatusNotImplemented, codeInternal, "Store does not track metadata")
+		return
+	}
+	meta, err := mp.Metadata(key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	ns := s.namespaceFrom(r.Context())
+	writeJSON(w, http.StatusOK, struct {
+		Key         string   `json:"key"`
+		ContentType string   `json:"content_type,omitempty"`
+		Tags        []string `json:"tags,omitempty"`
+		KeyMeta
+	}{key, ns.types.get(key), ns.tags.get(key), meta})
+}
+
+// keyMetaOnly is a list entry of GET /data?fields=meta.
+type keyMetaOnly struct {
+	ContentType string   `json:"content_type,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	KeyMeta
+}
+
+// listWithMeta answers GET /data?meta=true with every key's value and
+// metadata, or only its metadata unless fields include values. Keys
+// deleted between taking the snapshot and reading their metadata are
+// left out.
+func (s *Server) listWithMeta(w http.ResponseWriter, r *http.Request, fields listFields) {
+	ns := s.namespaceFrom(r.Context())
+	store := ns.store
+	mp, ok := store.(metadataProvider)
+	if !ok {
+		writeError(w, r, http.StatusNotImplemented, codeInternal, "Store does not track metadata")
+		return
+	}
+	snap := visible(store.Snapshot(), s.hiddenKeys(r.Context(), ns, false))
+	if !fields.values {
+		out := make(map[string]keyMetaOnly, snap.Len())
+		for _, k := range snap.Between("", "") {
+			if meta, err := mp.Metadata(k); err == nil {
+				out[k] = keyMetaOnly{ContentType: ns.types.get(k), Tags: ns.tags.get(k), KeyMeta: meta}
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+	out := make(map[string]keyWithMeta, snap.Len())
+	snap.Range(func(k, v string) bool {
+		if meta, err := mp.Metadata(k); err == nil {
+			v, _ := s.reveal(r.Context(), k, v)
+			out[k] = keyWithMeta{Value: v, ContentType: ns.types.get(k), Tags: ns.tags.get(k), KeyMeta: meta}
+		}
+		return true
+	})
+	writeJSON(w, http.StatusOK, out)
+}
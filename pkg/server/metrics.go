@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+)
+
+// metricsPrefix prefixes the names of the metrics of GET /metrics.
+const metricsPrefix = "kv_"
+
+// GET
+//
+// metricsHandler serves the request counters and gauges, as pushed to
+// StatsD, in the Prometheus text format. It is an admin endpoint, outside
+// /v1 where scrapers look for it.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.lock(r.Context())
+	snap := s.snapshotLocked()
+	s.mu.Unlock()
+	rt := s.runtimeStats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	metric := func(name, kind, help string, v int64) {
+		fmt.Fprintf(bw, "# HELP %s%s %s\n# TYPE %s%s %s\n%s%s %d\n", metricsPrefix, name, help, metricsPrefix, name, kind, metricsPrefix, name, v)
+	}
+	metric("requests_total", "counter", "Requests served.", int64(snap.TotalRequests))
+	fmt.Fprintf(bw, "# HELP %srequests_by_method_total Requests served, by method.\n# TYPE %srequests_by_method_total counter\n", metricsPrefix, metricsPrefix)
+	methods := make([]string, 0, len(snap.MethodCount))
+	for m := range snap.MethodCount {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		fmt.Fprintf(bw, "%srequests_by_method_total{method=%q} %d\n", metricsPrefix, m, snap.MethodCount[m])
+	}
+	metric("errors_total", "counter", "Requests answered with a 4xx or 5xx status.", int64(snap.Errors))
+	metric("panics_total", "counter", "Handler panics recovered.", int64(snap.Panics))
+	metric("writes_total", "counter", "Keys written.", int64(snap.Writes))
+	metric("deletes_total", "counter", "Keys deleted.", int64(snap.Deletes))
+	metric("evictions_total", "counter", "Keys evicted.", int64(snap.Evictions))
+	fmt.Fprintf(bw, "# HELP %sevents_total Server events published, by type.\n# TYPE %sevents_total counter\n", metricsPrefix, metricsPrefix)
+	events := s.events.stats()
+	for _, t := range eventTypes {
+		fmt.Fprintf(bw, "%sevents_total{type=%q} %d\n", metricsPrefix, t, events[t])
+	}
+	metric("keys", "gauge", "Keys in the default namespace.", int64(snap.DataSize))
+	metric("in_flight", "gauge", "Requests being served.", s.inFlight.Load())
+	metric("store_bytes", "gauge", "Bytes of keys and values held by every namespace.", rt.StoreBytes)
+	metric("heap_in_use_bytes", "gauge", "Bytes of heap in use.", int64(rt.HeapInUse))
+	metric("goroutines", "gauge", "Goroutines running.", int64(rt.Goroutines))
+	if s.shadow != nil {
+		st := s.shadow.snapshot()
+		metric("shadow_writes_total", "counter", "Writes applied to the shadow backend.", st.Applied)
+		metric("shadow_write_errors_total", "counter", "Writes the shadow backend failed.", st.Failed)
+		metric("shadow_writes_dropped_total", "counter", "Writes dropped from a full shadow queue.", st.Dropped)
+		metric("shadow_queue", "gauge", "Writes waiting for the shadow backend.", int64(st.Queued))
+	}
+}
+
+// handlePprof mounts the runtime profiles of net/http/pprof at
+// /debug/pprof/.
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a handler with cross-cutting behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h so that the first middleware is the outermost one.
+func chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		if mws[i] != nil {
+			h = mws[i](h)
+		}
+	}
+	return h
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	clientIDKey
+	namespaceKey
+	contentTypeKey
+	replayKey       // set on writes replayed from a Raft log or a primary
+	createOnlyKey   // set on writes that must not overwrite an existing key
+	previousKey     // set on writes that report the value they replace
+	storedKey       // set on writes of a value as it is stored, already hooked and sealed
+	flushedKey      // set on flushes that report how many keys they removed
+	clientSlotKey   // holds the *string the authenticator names the client in
+	redactSlotKey   // holds the *bool set when a recording must leave the bodies out
+	timingKey       // holds the *requestTiming of withTiming
+	tagsKey         // holds the tags a write gives its key
+	maskAuditKey    // set on writes audited without value hashes
+	expiryKey       // holds the *keyExpiry a write gives its key
+	expiringKey     // set on deletes of keys whose time is up
+	scopesKey       // holds the scopes the auth provider granted the client
+	grantKey        // holds the *tokenClaims of a client with an issued token
+	cacheReadKey    // holds the *cacheRead the cache reports a read in
+	priorityKey     // holds the priorityClass withPriority gave the request
+	keySessionKey   // holds the ID of the session a write attaches its key to
+	responseMetaKey // holds the *responseMeta of an enveloped response
+	inflightKey     // holds the *inflightEntry of withInflight
+	deleteAtKey     // holds the revision a delete requires its key to be at
+)
+
+// requestIDFrom returns the request ID assigned by withRequestID, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// withRequestID tags every request with an ID, reusing the client's
+// X-Request-ID when present, and echoes it in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// withRecovery turns a panicking handler into a 500 response instead of a
+// dropped connection, logging the stack together with the request ID.
+func (s *Server) withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			id := requestIDFrom(r.Context())
+			s.events.publish(serverEvent{
+				Type:    eventHandlerPanic,
+				Source:  r.Method + " " + r.URL.Path,
+				Message: fmt.Sprintf("panic serving %s %s (request %s): %v", r.Method, r.URL.Path, id, rec),
+				Fields:  map[string]interface{}{"request_id": id},
+				stack:   string(debug.Stack()),
+			})
+
+			s.mu.lock(r.Context())
+			s.panicCount++
+			s.mu.Unlock()
+
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withMetrics counts every request in flight and, once it has been
+// handled, 4xx and 5xx
+// responses as errors, everything else towards the per-method totals. The
+// request is also counted, with the bytes it moved, for its client; it
+// runs ahead of authentication, so the API key is reported back through
+// a slot in the context.
+func (s *Server) withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		var client string
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		r = r.WithContext(context.WithValue(r.Context(), clientSlotKey, &client))
+		rw := wrapResponseWriter(w)
+		start := time.Now()
+		next.ServeHTTP(rw, r)
+		if s.statsd != nil {
+			s.statsd.timing(r.Method, time.Since(start))
+		}
+		failed := rw.status >= 400
+		if failed {
+			s.incrementError(r.Context())
+			s.recentErrors.add(recentError{Time: time.Now().UTC(), Method: r.Method, Path: r.URL.Path,
+				Status: rw.status, RequestID: requestIDFrom(r.Context())})
+		} else {
+			s.countRequest(r)
+		}
+		s.clients.record(clientKeyFor(client, remoteHost(r)), failed, body.n, int64(rw.bytes), time.Now())
+	})
+}
+
+// withAccessLog logs one line per request.
+func (s *Server) withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := wrapResponseWriter(w)
+		next.ServeHTTP(rw, r)
+		s.logger.Printf("%s %s %d %dB %s client=%s request=%s", r.Method, r.URL.RequestURI(), rw.status,
+			rw.bytes, time.Since(start).Round(time.Microsecond), remoteHost(r), requestIDFrom(r.Context()))
+	})
+}
+
+// responseWriter records the status and size of a response as it passes
+// through to the client.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func wrapResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
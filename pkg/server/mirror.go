@@ -0,0 +1,430 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMirrorBatch is how many mutations are sent to the mirror at once
+// by default.
+const defaultMirrorBatch = 100
+
+// mirrorRetry is how long a failed batch waits before it is sent again the
+// first time; the wait doubles up to mirrorMaxRetry.
+const (
+	mirrorRetry    = time.Second
+	mirrorMaxRetry = 30 * time.Second
+)
+
+// mirrorBatch is the body of POST /replication/apply.
+type mirrorBatch struct {
+	Entries []replEntry `json:"entries"`
+}
+
+// mirrorStatus is what GET /admin/mirror reports.
+type mirrorStatus struct {
+	Remote    string `json:"remote"`
+	Connected bool   `json:"connected"`
+	// Sent is the sequence number of the last mutation the remote has
+	// accepted and Head the latest one made here.
+	Sent       uint64    `json:"sent_seq"`
+	Head       uint64    `json:"head_seq"`
+	Lag        uint64    `json:"lag_entries"`
+	Batches    int64     `json:"batches"`
+	Entries    int64     `json:"entries"`
+	Retries    int64     `json:"retries"`
+	Resyncs    int64     `json:"resyncs"`
+	LastSent   time.Time `json:"last_sent,omitzero"`
+	LastError  string    `json:"last_error,omitempty"`
+	ErrorSince time.Time `json:"error_since,omitzero"`
+}
+
+// mirror copies this node's mutations to a remote instance, typically in
+// another datacenter, as they are recorded in the replication log. It is
+// asynchronous and one-way: writes are answered here before the remote has
+// them, and the remote's own writes are not copied back. At start, and
+// whenever it falls further behind than the backlog reaches, it copies
+// every key over again first.
+type mirror struct {
+	s      *Server
+	remote string
+	apiKey string
+	batch  int
+	client *http.Client
+	logger *log.Logger
+
+	mu     sync.Mutex
+	status mirrorStatus
+}
+
+func newMirror(s *Server, cfg Config) (*mirror, error) {
+	u, err := url.Parse(cfg.MirrorURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("mirror URL %q must be an https URL", cfg.MirrorURL)
+	}
+	if cfg.ReplicationBacklog <= 0 {
+		return nil, errors.New("mirroring requires a replication backlog")
+	}
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.MirrorCAFile != "" {
+		pem, err := os.ReadFile(cfg.MirrorCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", cfg.MirrorCAFile)
+		}
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsCfg
+	remote := strings.TrimSuffix(cfg.MirrorURL, "/")
+	batch := cfg.MirrorBatch
+	if batch <= 0 {
+		batch = defaultMirrorBatch
+	}
+	return &mirror{
+		s:      s,
+		remote: remote,
+		apiKey: cfg.MirrorAPIKey,
+		batch:  batch,
+		client: &http.Client{Transport: tr, Timeout: mirrorMaxRetry},
+		logger: s.logger,
+		status: mirrorStatus{Remote: remote},
+	}, nil
+}
+
+// run mirrors until stop is closed.
+func (m *mirror) run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	rl := m.s.namespaces.replication
+	var next uint64 // 0 until every key has been copied
+	for ctx.Err() == nil {
+		if next == 0 {
+			from := rl.head() + 1
+			if !m.resync(ctx) {
+				return
+			}
+			next = from
+			m.mu.Lock()
+			m.status.Sent = from - 1
+			m.mu.Unlock()
+		}
+		entries, head, changed, err := rl.since(next)
+		if err != nil {
+			m.logger.Printf("[Mirror] Fell behind the replication backlog; copying every key to %s again", m.remote)
+			next = 0
+			continue
+		}
+		m.mu.Lock()
+		m.status.Head = head
+		m.status.Lag = head - m.status.Sent
+		m.mu.Unlock()
+		if len(entries) == 0 {
+			select {
+			case <-changed:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		for len(entries) > 0 {
+			n := min(len(entries), m.batch)
+			if !m.deliver(ctx, entries[:n]) {
+				return
+			}
+			next = entries[n-1].Seq + 1
+			entries = entries[n:]
+		}
+	}
+}
+
+// resync copies every key with its type, tags and expiry to the remote.
+// Keys deleted here while the mirror could not follow stay on the remote;
+// GET /admin/mirror/diff shows the namespaces they are in.
+func (m *mirror) resync(ctx context.Context) bool {
+	n := 0
+	batch := make([]replEntry, 0, m.batch)
+	for _, ns := range m.s.namespaces.list() {
+		ok := true
+		ns.store.Snapshot().Range(func(k, v string) bool {
+			batch = append(batch, replEntry{Op: "set", NS: ns.name, Key: k, Value: v,
+				Type: ns.types.get(k), Tags: ns.tags.get(k), Expiry: ns.expiries.get(k)})
+			if len(batch) < m.batch {
+				return true
+			}
+			n += len(batch)
+			ok = m.deliver(ctx, batch)
+			batch = batch[:0]
+			return ok
+		})
+		if !ok {
+			return false
+		}
+	}
+	if len(batch) > 0 {
+		n += len(batch)
+		if !m.deliver(ctx, batch) {
+			return false
+		}
+	}
+	m.mu.Lock()
+	m.status.Resyncs++
+	m.mu.Unlock()
+	m.logger.Printf("[Mirror] Copied %d keys to %s", n, m.remote)
+	return true
+}
+
+// deliver sends entries to the remote until it accepts them, backing off
+// between attempts. It returns false only if ctx is done first.
+func (m *mirror) deliver(ctx context.Context, entries []replEntry) bool {
+	wait := mirrorRetry
+	for {
+		err := m.post(ctx, entries)
+		now := time.Now()
+		m.mu.Lock()
+		if err == nil {
+			m.status.Connected, m.status.LastError, m.status.ErrorSince = true, "", time.Time{}
+			m.status.Batches++
+			m.status.Entries += int64(len(entries))
+			m.status.LastSent = now.UTC()
+			if seq := entries[len(entries)-1].Seq; seq != 0 {
+				m.status.Sent = seq
+				m.status.Lag = max(m.status.Head, seq) - seq
+			}
+			m.mu.Unlock()
+			return true
+		}
+		if ctx.Err() != nil {
+			m.mu.Unlock()
+			return false
+		}
+		if m.status.LastError == "" {
+			m.status.ErrorSince = now.UTC()
+			m.logger.Printf("[Mirror] %v; retrying", err)
+		}
+		m.status.Connected, m.status.LastError = false, err.Error()
+		m.status.Retries++
+		m.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, mirrorMaxRetry)
+	}
+}
+
+func (m *mirror) post(ctx context.Context, entries []replEntry) error {
+	body, err := json.Marshal(mirrorBatch{Entries: entries})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.remote+apiPrefix+"/replication/apply", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s from %s: %s", res.Status, m.remote, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, res.Body)
+	return nil
+}
+
+func (m *mirror) snapshot() mirrorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// POST
+//
+// applyMirrorHandler applies a batch of mutations mirrored from another
+// site, in order, with their types, tags and expiries. They are written
+// as this node's own writes, through Raft if it is a cluster node, but
+// without the key rules, schemas and webhooks, which the mirrored site
+// has already applied. Deleting a key that is not here is not an error.
+func (s *Server) applyMirrorHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	var batch mirrorBatch
+	if !s.decodeJSON(w, r, &batch) {
+		return
+	}
+	for _, e := range batch.Entries {
+		switch {
+		case e.Op != "set" && e.Op != "delete" && e.Op != "expire":
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "op must be set, delete or expire")
+			return
+		case e.Key == "":
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "key is required")
+			return
+		}
+	}
+	for _, e := range batch.Entries {
+		if err := s.applyReplicated(r.Context(), e); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"applied": len(batch.Entries)})
+}
+
+// namespaceDigest sums up the contents of a namespace so that two sites
+// can tell whether they hold the same data without sending it.
+type namespaceDigest struct {
+	Namespace string `json:"namespace"`
+	Keys      int    `json:"keys"`
+	// Checksum is the CRC-32C of every key and value in key order.
+	Checksum string `json:"checksum"`
+}
+
+// digests returns a digest of every namespace, sorted by name.
+func (s *Server) digests() []namespaceDigest {
+	out := []namespaceDigest{}
+	for _, ns := range s.namespaces.list() {
+		snap := ns.store.Snapshot()
+		var sum uint32
+		snap.Range(func(k, v string) bool {
+			sum = crc32.Update(sum, crcTable, []byte(k))
+			sum = crc32.Update(sum, crcTable, []byte{0})
+			sum = crc32.Update(sum, crcTable, []byte(v))
+			sum = crc32.Update(sum, crcTable, []byte{0})
+			return true
+		})
+		out = append(out, namespaceDigest{Namespace: ns.name, Keys: snap.Len(), Checksum: formatChecksum(sum)})
+	}
+	return out
+}
+
+// GET
+//
+// mirrorDigestHandler returns the key count and checksum of every
+// namespace, which GET /admin/mirror/diff compares between sites.
+func (s *Server) mirrorDigestHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.digests())
+}
+
+// GET
+func (s *Server) mirrorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if s.mirror == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Mirroring is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.mirror.snapshot())
+}
+
+// namespaceDiff compares a namespace between this site and the mirror.
+type namespaceDiff struct {
+	Namespace      string `json:"namespace"`
+	LocalKeys      int    `json:"local_keys"`
+	RemoteKeys     int    `json:"remote_keys"`
+	LocalChecksum  string `json:"local_checksum,omitempty"`
+	RemoteChecksum string `json:"remote_checksum,omitempty"`
+	Match          bool   `json:"match"`
+}
+
+type mirrorDiff struct {
+	Remote     string          `json:"remote"`
+	Diverged   bool            `json:"diverged"`
+	Lag        uint64          `json:"lag_entries"`
+	Namespaces []namespaceDiff `json:"namespaces"`
+}
+
+// GET
+//
+// mirrorDiffHandler compares the key count and checksum of every
+// namespace here with the mirror's. Mirroring is asynchronous, so a site
+// still applying recent writes differs too; lag_entries says how many
+// mutations the mirror had yet to accept when the comparison was made.
+func (s *Server) mirrorDiffHandler(w http.ResponseWriter, r *http.Request) {
+	m := s.mirror
+	if m == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Mirroring is not enabled")
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, m.remote+apiPrefix+"/replication/digest", nil)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+	lag := m.snapshot().Lag
+	local := s.digests()
+	res, err := m.client.Do(req)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, codeInternal, "Could not reach the mirror: "+err.Error())
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		writeError(w, r, http.StatusBadGateway, codeInternal, "The mirror answered "+res.Status)
+		return
+	}
+	var remote []namespaceDigest
+	if err := json.NewDecoder(res.Body).Decode(&remote); err != nil {
+		writeError(w, r, http.StatusBadGateway, codeInternal, "Invalid digest from the mirror")
+		return
+	}
+
+	byName := make(map[string]*namespaceDiff)
+	var order []string
+	entry := func(name string) *namespaceDiff {
+		d := byName[name]
+		if d == nil {
+			d = &namespaceDiff{Namespace: name}
+			byName[name] = d
+			order = append(order, name)
+		}
+		return d
+	}
+	for _, nd := range local {
+		d := entry(nd.Namespace)
+		d.LocalKeys, d.LocalChecksum = nd.Keys, nd.Checksum
+	}
+	for _, nd := range remote {
+		d := entry(nd.Namespace)
+		d.RemoteKeys, d.RemoteChecksum = nd.Keys, nd.Checksum
+	}
+	out := mirrorDiff{Remote: m.remote, Lag: lag, Namespaces: make([]namespaceDiff, 0, len(order))}
+	for _, name := range order {
+		d := byName[name]
+		// An empty namespace matches one the other site does not have.
+		d.Match = d.LocalKeys == d.RemoteKeys && (d.LocalKeys == 0 || d.LocalChecksum == d.RemoteChecksum)
+		out.Diverged = out.Diverged || !d.Match
+		out.Namespaces = append(out.Namespaces, *d)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// A minimal MessagePack codec covering the types that appear in request
+// and response bodies: nil, booleans, integers, floats, strings, binary,
+// arrays and maps with string keys. Extension types are not supported.
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// appendMsgpack appends the encoding of v to b. Strings that are not valid
+// UTF-8, such as binary values stored with PUT, are encoded as bin.
+func appendMsgpack(b []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if x {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case int:
+		return appendMsgpackInt(b, int64(x))
+	case int64:
+		return appendMsgpackInt(b, x)
+	case uint64:
+		if x <= math.MaxInt64 {
+			return appendMsgpackInt(b, int64(x))
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), x)
+	case float64:
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(x))
+	case string:
+		if !utf8.ValidString(x) {
+			return appendMsgpackBin(b, x)
+		}
+		n := len(x)
+		switch {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+		}
+		return append(b, x...)
+	case []byte:
+		return appendMsgpackBin(b, string(x))
+	case []interface{}:
+		b = appendMsgpackLen(b, len(x), 0x90, 16, 0xdc, 0xdd)
+		for _, item := range x {
+			b = appendMsgpack(b, item)
+		}
+		return b
+	case []string:
+		b = appendMsgpackLen(b, len(x), 0x90, 16, 0xdc, 0xdd)
+		for _, item := range x {
+			b = appendMsgpack(b, item)
+		}
+		return b
+	case map[string]string:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendMsgpackLen(b, len(x), 0x80, 16, 0xde, 0xdf)
+		for _, k := range keys {
+			b = appendMsgpack(appendMsgpack(b, k), x[k])
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendMsgpackLen(b, len(x), 0x80, 16, 0xde, 0xdf)
+		for _, k := range keys {
+			b = appendMsgpack(appendMsgpack(b, k), x[k])
+		}
+		return b
+	}
+	panic(fmt.Sprintf("msgpack: unsupported type %T", v))
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n < 128:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+func appendMsgpackBin(b []byte, x string) []byte {
+	n := len(x)
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+	return append(b, x...)
+}
+
+// appendMsgpackLen writes an array or map header: the fix form for lengths
+// below fixMax, otherwise the 16- or 32-bit form.
+func appendMsgpackLen(b []byte, n int, fix byte, fixMax int, tag16, tag32 byte) []byte {
+	switch {
+	case n < fixMax:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, tag16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, tag32), uint32(n))
+}
+
+// decodeMsgpack decodes a single value that must make up all of data.
+// Binary values decode to []byte, integers to int64 (or uint64 when too
+// large) and maps to map[string]interface{}.
+func decodeMsgpack(data []byte) (interface{}, error) {
+	d := msgpackDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("msgpack: trailing data after value")
+	}
+	return v, nil
+}
+
+// maxMsgpackDepth bounds nesting so hostile input cannot exhaust the stack.
+const maxMsgpackDepth = 100
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.take(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("msgpack: nesting too deep")
+	}
+	tb, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	t := tb[0]
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xe0 == 0xa0:
+		return d.str(int(t & 0x1f))
+	case t&0xf0 == 0x90:
+		return d.array(int(t&0x0f), depth)
+	case t&0xf0 == 0x80:
+		return d.dict(int(t&0x0f), depth)
+	}
+
+	// sized reads a length of the given width and passes it to fn.
+	sized := func(width int, fn func(int) (interface{}, error)) (interface{}, error) {
+		n, err := d.uint(width)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.data)) {
+			return nil, errMsgpackShort
+		}
+		return fn(int(n))
+	}
+	bin := func(n int) (interface{}, error) {
+		b, err := d.take(n)
+		return append([]byte(nil), b...), err
+	}
+	array := func(n int) (interface{}, error) { return d.array(n, depth) }
+	dict := func(n int) (interface{}, error) { return d.dict(n, depth) }
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4:
+		return sized(1, bin)
+	case 0xc5:
+		return sized(2, bin)
+	case 0xc6:
+		return sized(4, bin)
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case 0xd0:
+		n, err := d.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return int64(n), err
+	case 0xd9:
+		return sized(1, d.str)
+	case 0xda:
+		return sized(2, d.str)
+	case 0xdb:
+		return sized(4, d.str)
+	case 0xdc:
+		return sized(2, array)
+	case 0xdd:
+		return sized(4, array)
+	case 0xde:
+		return sized(2, dict)
+	case 0xdf:
+		return sized(4, dict)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", t)
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	b, err := d.take(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) array(n int, depth int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	out := make([]interface{}, n)
+	for i := range out {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (d *msgpackDecoder) dict(n int, depth int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	out := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		var key string
+		switch kk := k.(type) {
+		case string:
+			key = kk
+		case []byte:
+			key = string(kk)
+		default:
+			return nil, errors.New("msgpack: map keys must be strings")
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultNamespace is the name of the namespace served by the unprefixed
+// /data routes. It is backed by the server's main store.
+const defaultNamespace = "default"
+
+var namespaceNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// namespace is an isolated keyspace with its own store, watch hub and
+// request counters. Counters cover requests made through the /ns routes.
+type namespace struct {
+	name       string
+	store      Store
+	hub        *watchHub
+	tombstones *tombstoneSet
+	history    *valueHistory // nil unless value history is enabled
+	indexes    *indexSet
+	search     *searchIndex // nil unless full-text search is enabled
+	filter     *keyFilter   // nil unless Bloom filters are enabled
+	types      *contentTypes
+	tags       *keyTags
+	expiries   *keyExpiries
+	queues     *queueIndex
+
+	mu            timedMutex
+	totalRequests int
+	methodCount   map[string]int
+	errorCount    int
+}
+
+func newNamespace(name string, store Store, hub *watchHub) *namespace {
+	ns := &namespace{
+		name:        name,
+		store:       store,
+		hub:         hub,
+		tombstones:  newTombstoneSet(),
+		indexes:     newIndexSet(),
+		types:       newContentTypes(),
+		tags:        newKeyTags(),
+		expiries:    newKeyExpiries(),
+		queues:      newQueueIndex(),
+		methodCount: make(map[string]int),
+	}
+	ns.mu.name = "namespace"
+	hub.addListener(ns.indexes.apply)
+	hub.addListener(ns.types.forget)
+	hub.addListener(ns.tags.forget)
+	hub.addListener(ns.expiries.forget)
+	hub.addListener(ns.queues.apply)
+	return ns
+}
+
+// snapshot returns a snapshot of the store of ns carrying the tags and
+// expiries of its keys, which data files, backups and exports keep with
+// the entries.
+func (ns *namespace) snapshot() *Snapshot {
+	return ns.annotate(ns.store.Snapshot())
+}
+
+// annotate returns a copy of snap, taken of the store of ns, carrying the
+// tags and expiries its keys have now.
+func (ns *namespace) annotate(snap *Snapshot) *Snapshot {
+	out := *snap
+	if ns.name != defaultNamespace {
+		out.ns = ns.name
+	}
+	out.tags = ns.tags.copy()
+	out.expiries = ns.expiries.copy()
+	return &out
+}
+
+// namespaceStats is the body of GET /ns/{namespace}/stats.
+type namespaceStats struct {
+	Namespace     string                `json:"namespace"`
+	DataSize      int                   `json:"data_size"`
+	TotalRequests int                   `json:"total_requests"`
+	MethodCount   map[string]int        `json:"method_count"`
+	Errors        int                   `json:"errors"`
+	Queues        map[string]queueStats `json:"queues,omitempty"`
+}
+
+func (ns *namespace) stats(ctx context.Context) namespaceStats {
+	ns.mu.lock(ctx)
+	defer ns.mu.Unlock()
+	methods := make(map[string]int, len(ns.methodCount))
+	for k, v := range ns.methodCount {
+		methods[k] = v
+	}
+	return namespaceStats{
+		Namespace:     ns.name,
+		DataSize:      ns.store.Len(),
+		TotalRequests: ns.totalRequests,
+		MethodCount:   methods,
+		Errors:        ns.errorCount,
+		Queues:        ns.queues.all(),
+	}
+}
+
+// namespaceRegistry holds the server's namespaces. Namespaces other than
+// the default one are created by their first write, or by loading a data
+// file holding their keys, and are saved to it with the default one.
+type namespaceRegistry struct {
+	mu     sync.RWMutex
+	def    *namespace
+	all    map[string]*namespace
+	quotas Quotas
+
+	// historyDepth is the number of versions kept per key, 0 for none.
+	historyDepth int
+
+	// search enables the full-text index in every namespace.
+	search bool
+
+	// bloomKeys, if positive, keeps a Bloom filter of the keys of every
+	// namespace, sized for that many keys at bloomFPRate.
+	bloomKeys   int
+	bloomFPRate float64
+
+	// indexes are declared in every namespace when it is created.
+	indexes IndexDefs
+
+	// replication, if set, records the mutations of every namespace for
+	// replicas.
+	replication *replicationLog
+
+	// codec, if set, compresses the values of new namespaces, and dedup
+	// stores their identical values once.
+	codec *valueCodec
+	dedup *dedupPool
+
+	// lockStats, if set, counts the contention on the lock of every
+	// namespace.
+	lockStats *lockStats
+	// lockQueue, if set, counts the requests waiting for the lock of any
+	// namespace.
+	lockQueue *atomic.Int64
+
+	// wal, if set, logs the mutations of every namespace for
+	// point-in-time restores.
+	wal *walLog
+}
+
+func newNamespaceRegistry(def *namespace) *namespaceRegistry {
+	return &namespaceRegistry{def: def, all: map[string]*namespace{def.name: def}}
+}
+
+// get returns the named namespace, creating it when create is set. It
+// returns nil for a namespace that does not exist and is not created.
+func (nr *namespaceRegistry) get(name string, create bool) *namespace {
+	nr.mu.RLock()
+	ns := nr.all[name]
+	nr.mu.RUnlock()
+	if ns != nil || !create {
+		return ns
+	}
+
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	if ns := nr.all[name]; ns != nil {
+		return ns
+	}
+	mem := newMemoryStore()
+	mem.codec = nr.codec
+	mem.dedup = nr.dedup
+	ns = newNamespace(name, nr.withQuota(name, mem), newWatchHub())
+	ns.mu.stats = nr.lockStats
+	ns.mu.queue = nr.lockQueue
+	mem.OnChange(ns.hub.publish)
+	nr.enableHistory(ns)
+	nr.enableSearch(ns)
+	nr.enableBloom(ns)
+	nr.declareIndexes(ns)
+	nr.enableReplication(ns)
+	nr.enableWAL(ns)
+	nr.all[name] = ns
+	return ns
+}
+
+// enableHistory starts recording value history for ns if configured.
+func (nr *namespaceRegistry) enableHistory(ns *namespace) {
+	if nr.historyDepth > 0 {
+		ns.history = newValueHistory(nr.historyDepth)
+		ns.hub.addListener(ns.history.record)
+	}
+}
+
+// enableSearch starts maintaining the full-text index of ns if configured.
+func (nr *namespaceRegistry) enableSearch(ns *namespace) {
+	if nr.search {
+		ns.search = newSearchIndex()
+		ns.hub.addListener(ns.search.apply)
+	}
+}
+
+// declareIndexes adds the configured indexes to ns.
+func (nr *namespaceRegistry) declareIndexes(ns *namespace) {
+	for _, def := range nr.indexes {
+		// Definitions were checked when parsed, and ns has no others yet.
+		ns.indexes.add(def, ns.store)
+	}
+}
+
+// quotaFor returns the quota configured for name, falling back to the "*"
+// entry that applies to every namespace.
+func (nr *namespaceRegistry) quotaFor(name string) Quota {
+	if q, ok := nr.quotas[name]; ok {
+		return q
+	}
+	return nr.quotas["*"]
+}
+
+// withQuota wraps store in the quota of namespace name, if it has one.
+func (nr *namespaceRegistry) withQuota(name string, store Store) Store {
+	q := nr.quotaFor(name)
+	if q.unlimited() {
+		return store
+	}
+	return newQuotaStore(store, q)
+}
+
+func (nr *namespaceRegistry) remove(name string) bool {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	if _, ok := nr.all[name]; !ok || name == nr.def.name {
+		return false
+	}
+	delete(nr.all, name)
+	return true
+}
+
+// snapshots returns a snapshot of the default namespace and of every
+// other one holding keys, as data files hold them.
+func (nr *namespaceRegistry) snapshots() []*Snapshot {
+	snaps := []*Snapshot{nr.def.snapshot()}
+	for _, ns := range nr.list() {
+		if ns != nr.def && ns.store.Len() > 0 {
+			snaps = append(snaps, ns.snapshot())
+		}
+	}
+	return snaps
+}
+
+func (nr *namespaceRegistry) list() []*namespace {
+	nr.mu.RLock()
+	out := make([]*namespace, 0, len(nr.all))
+	for _, ns := range nr.all {
+		out = append(out, ns)
+	}
+	nr.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// namespaceFrom returns the namespace selected by withNamespace, or the
+// default namespace for requests outside the /ns routes.
+func (s *Server) namespaceFrom(ctx context.Context) *namespace {
+	if ns, ok := ctx.Value(namespaceKey).(*namespace); ok {
+		return ns
+	}
+	return s.namespaces.def
+}
+
+// withNamespace resolves the {namespace} path segment for the /ns routes
+// and counts the request against it. POST and PUT create the namespace on
+// first use; other methods answer 404 for a namespace that does not exist.
+func (s *Server) withNamespace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("namespace")
+		if !namespaceNameRE.MatchString(name) {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid namespace name")
+			return
+		}
+		ns := s.namespaces.get(name, r.Method == http.MethodPost || r.Method == http.MethodPut)
+		if ns == nil {
+			writeError(w, r, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+			return
+		}
+
+		responseMetaFrom(r.Context()).setNamespace(ns)
+		rw := wrapResponseWriter(w)
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), namespaceKey, ns)))
+
+		ns.mu.lock(r.Context())
+		if rw.status >= 400 {
+			ns.errorCount++
+		} else {
+			ns.totalRequests++
+			ns.methodCount[r.Method]++
+		}
+		ns.mu.Unlock()
+	})
+}
+
+// GET
+func (s *Server) listNamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		Name     string `json:"name"`
+		DataSize int    `json:"data_size"`
+	}
+	all := s.namespaces.list()
+	out := make([]entry, len(all))
+	for i, ns := range all {
+		out[i] = entry{Name: ns.name, DataSize: ns.store.Len()}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// GET
+func (s *Server) namespaceStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.namespaceFrom(r.Context()).stats(r.Context()))
+}
+
+// DELETE
+//
+// deleteNamespaceHandler drops a namespace and all of its keys. The default
+// namespace cannot be deleted.
+func (s *Server) deleteNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	ns := s.namespaceFrom(r.Context())
+	if ns == s.namespaces.def {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "The default namespace cannot be deleted")
+		return
+	}
+	if !s.namespaces.remove(ns.name) {
+		writeError(w, r, http.StatusNotFound, codeNamespaceNotFound, "Namespace not found")
+		return
+	}
+	if s.audit != nil {
+		s.audit.record(r.Context(), "delete_namespace", ns.name, "", "", false, "", false)
+	}
+	if s.namespaces.wal != nil {
+		s.namespaces.wal.dropped(ns.name)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "deleted", "keys": ns.store.Len()})
+}
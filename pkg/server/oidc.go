@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// oidcTimeout bounds a request to the introspection endpoint.
+const oidcTimeout = 5 * time.Second
+
+// introspection is the part of an OAuth 2.0 token introspection response
+// (RFC 7662) the server uses.
+type introspection struct {
+	Active   bool   `json:"active"`
+	Subject  string `json:"sub"`
+	Username string `json:"username"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+	Expiry   int64  `json:"exp"`
+}
+
+// oidcAuth accepts bearer tokens that the identity provider's token
+// introspection endpoint reports as active. The client is named by the
+// token's username, subject or client ID, in that order of preference,
+// and holds the token's scopes. Active tokens are cached until they
+// expire or for the cache TTL, whichever is sooner, so a revoked token
+// may be accepted for up to the TTL.
+type oidcAuth struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+	cache        *authCache
+}
+
+func newOIDCAuth(endpoint, clientID, clientSecret string, ttl time.Duration) (*oidcAuth, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid introspection URL %q", endpoint)
+	}
+	if clientID == "" {
+		return nil, errors.New("the oidc auth provider requires a client ID")
+	}
+	return &oidcAuth{
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: oidcTimeout},
+		cache:        newAuthCache(ttl),
+	}, nil
+}
+
+func (oa *oidcAuth) Name() string { return authOIDC }
+
+// introspect asks the endpoint about token, returning the response status
+// and, for 200, the decoded body.
+func (oa *oidcAuth) introspect(ctx context.Context, token string) (int, introspection, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, oa.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, introspection{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(oa.clientID), url.QueryEscape(oa.clientSecret))
+	res, err := oa.client.Do(req)
+	if err != nil {
+		return 0, introspection{}, err
+	}
+	defer res.Body.Close()
+	var in introspection
+	if res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&in); err != nil {
+			return res.StatusCode, in, fmt.Errorf("introspection response: %w", err)
+		}
+	}
+	return res.StatusCode, in, nil
+}
+
+func (oa *oidcAuth) Authenticate(ctx context.Context, c Credentials) (Identity, error) {
+	if c.Token == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+	if id, ok := oa.cache.get(c); ok {
+		return id, nil
+	}
+	status, in, err := oa.introspect(ctx, c.Token)
+	switch {
+	case err != nil:
+		return Identity{}, err
+	case status != http.StatusOK:
+		return Identity{}, fmt.Errorf("introspection answered %d", status)
+	case !in.Active:
+		return Identity{}, ErrUnauthenticated
+	}
+	var expires time.Time
+	if in.Expiry > 0 {
+		expires = time.Unix(in.Expiry, 0)
+		if time.Now().After(expires) {
+			return Identity{}, ErrUnauthenticated
+		}
+	}
+	name := in.Username
+	if name == "" {
+		name = in.Subject
+	}
+	if name == "" {
+		name = in.ClientID
+	}
+	id := Identity{Name: name, Scopes: strings.Fields(in.Scope)}
+	oa.cache.put(c, id, expires)
+	return id, nil
+}
+
+// Check introspects an empty token, which the endpoint answers without
+// looking anything up. Being refused the client credentials counts as
+// unhealthy, since no token could be checked with them either.
+func (oa *oidcAuth) Check(ctx context.Context) error {
+	status, _, err := oa.introspect(ctx, "")
+	switch {
+	case err != nil:
+		return err
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return fmt.Errorf("introspection refused the client credentials (%d)", status)
+	case status >= 500:
+		return fmt.Errorf("introspection answered %d", status)
+	}
+	return nil
+}
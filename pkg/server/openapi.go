@@ -0,0 +1,2620 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// obj is shorthand for the nested JSON objects of the OpenAPI document.
+type obj = map[string]interface{}
+
+// apiOperation documents one route for the OpenAPI document. Path
+// parameters are derived from the route pattern; everything else is listed
+// here.
+type apiOperation struct {
+	Summary     string
+	Tag         string
+	Query       []apiParam
+	RequestBody obj            // schema of a JSON request body
+	RequestType string         // content type of RequestBody, default application/json
+	Responses   map[string]obj // status code -> response object
+}
+
+type apiParam struct {
+	Name, Type, Description string
+}
+
+func jsonResponse(description string, schema obj) obj {
+	return obj{
+		"description": description,
+		"content":     obj{"application/json": obj{"schema": schema}},
+	}
+}
+
+func ref(name string) obj { return obj{"$ref": "#/components/schemas/" + name} }
+
+var statusSchema = obj{
+	"type":       "object",
+	"properties": obj{"status": obj{"type": "string"}},
+}
+
+var stringMapSchema = obj{
+	"type":                 "object",
+	"additionalProperties": obj{"type": "string"},
+}
+
+var sessionTTLSchema = obj{
+	"description": "lease length in seconds or as a duration such as \"10s\"; default 10s, at most 24h",
+	"oneOf":       []obj{{"type": "number"}, {"type": "string"}},
+}
+
+var lockTTLSchema = obj{
+	"description": "lease length in seconds or as a duration such as \"30s\"; default 30s, at most 24h",
+	"oneOf":       []obj{{"type": "number"}, {"type": "string"}},
+}
+
+// elementsBody is the request body of the collection routes that take
+// elements: {field: [...]}.
+func elementsBody(field string) obj {
+	return obj{
+		"type":       "object",
+		"required":   []string{field},
+		"properties": obj{field: obj{"type": "array", "items": obj{"type": "string"}, "minItems": 1}},
+	}
+}
+
+var listLengthSchema = obj{
+	"type":       "object",
+	"properties": obj{"length": obj{"type": "integer"}},
+}
+
+var batchResultSchema = obj{
+	"type": "object",
+	"properties": obj{
+		"results": obj{
+			"type": "object",
+			"additionalProperties": obj{
+				"type": "object",
+				"properties": obj{
+					"status": obj{"type": "string", "enum": []string{"created", "updated", "rejected"}},
+					"code":   obj{"type": "string", "description": "error code, when rejected"},
+					"reason": obj{"type": "string", "description": "why the key was rejected"},
+				},
+			},
+		},
+		"created":  obj{"type": "integer"},
+		"updated":  obj{"type": "integer"},
+		"rejected": obj{"type": "integer"},
+	},
+}
+
+var listPopSchema = obj{
+	"type": "object",
+	"properties": obj{
+		"value":  obj{"type": "string"},
+		"length": obj{"type": "integer", "description": "elements left"},
+	},
+}
+
+var auditFilterParams = []apiParam{
+	{"op", "string", "set, delete or delete_namespace"},
+	{"namespace", "string", "only entries in this namespace"},
+	{"key", "string", "only entries for this key"},
+	{"prefix", "string", "only entries for keys with this prefix"},
+	{"client", "string", "only entries made with this API key name"},
+	{"after", "integer", "only entries with a higher sequence number"},
+	{"since", "string", "only entries at or after this RFC 3339 time"},
+	{"until", "string", "only entries before this RFC 3339 time"},
+}
+
+var recordingFilterParams = []apiParam{
+	{"method", "string", "only requests with this method"},
+	{"prefix", "string", "only requests whose path and query start with this"},
+	{"status", "integer", "only requests answered with this status"},
+	{"request_id", "string", "only the request with this ID"},
+	{"after", "integer", "only recordings with a higher sequence number"},
+}
+
+// apiOperations describes every route registered in routes(), keyed by
+// "METHOD path" without the version prefix.
+var apiOperations = map[string]apiOperation{
+	"GET /data": {
+		Summary: "List all key/value pairs",
+		Tag:     "data",
+		Query: []apiParam{
+			{"meta", "boolean", "include each key's metadata"},
+			{"fields", "string", "comma-separated parts of each entry to return: keys, values and meta (default keys,values, or keys,values,meta with meta)"},
+			{"keys_only", "boolean", "return only the keys, as fields=keys"},
+			{"sort", "string", "list entries in order of key, updated_at, size or reads, as a SortedList"},
+			{"order", "string", "asc (default) or desc, with sort"},
+			{"after", "string", "with sort, the next cursor of the previous page"},
+			{"from", "string", "scan keys from this one (inclusive) in key order"},
+			{"to", "string", "scan keys up to this one (exclusive) in key order"},
+			{"limit", "integer", "maximum number of entries in a range scan (default and max 10000)"},
+			{"reverse", "boolean", "scan the range in descending key order"},
+			{"format", "string", "ndjson to stream a full listing as a line per key, as does Accept: application/x-ndjson"},
+		},
+		Responses: map[string]obj{
+			"200": {
+				"description": "All pairs; with meta each key's value and metadata; with from or to the ordered range; without values the keys in order, or in a range their KeyRange, or with meta each key's metadata alone. A full listing is streamed, in key order, and as NDJSON has a line per key of its key and, unless without values, its value.",
+				"content": obj{
+					"application/json": obj{"schema": obj{
+						"oneOf": []obj{stringMapSchema, {"type": "object", "additionalProperties": ref("KeyMeta")}, ref("Range"), {"type": "array", "items": obj{"type": "string"}}, ref("KeyRange"), ref("SortedList")},
+					}},
+					"application/x-ndjson": obj{"schema": obj{"type": "object", "properties": obj{"key": obj{"type": "string"}, "value": obj{"type": "string"}}}},
+				},
+			},
+			"400": errorResponse("Invalid limit, fields, sort, order or cursor"),
+		},
+	},
+	"PATCH /data/{key}": {
+		Summary:     "Update a JSON value with a JSON Merge Patch (RFC 7386)",
+		Tag:         "data",
+		RequestBody: obj{},
+		RequestType: "application/merge-patch+json",
+		Responses: map[string]obj{
+			"200": jsonResponse("The patched document", obj{}),
+			"400": errorResponse("Invalid JSON"),
+			"415": errorResponse("Unsupported content type"),
+			"422": errorResponse("Value is not a JSON document, or the result fails its schema"),
+		},
+	},
+	"HEAD /data/{key}": {
+		Summary: "Check whether a key exists without reading it",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"200": {"description": "The key exists; X-Value-Length holds its size in bytes and X-Revision its revision"},
+			"404": {"description": "Key not found"},
+		},
+	},
+	"GET /data/{key}/exists": {
+		Summary: "Check whether a key exists; with -bloom-keys answered from a Bloom filter, where a rare false positive has approximate set",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"200": jsonResponse("Whether the key exists", obj{
+				"type": "object",
+				"properties": obj{
+					"key":         obj{"type": "string"},
+					"exists":      obj{"type": "boolean"},
+					"approximate": obj{"type": "boolean", "description": "exists may be a false positive"},
+				},
+			}),
+		},
+	},
+	"GET /data/{key}/meta": {
+		Summary: "Get a key's metadata without counting a read",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"200": jsonResponse("Metadata", ref("KeyMeta")),
+			"404": errorResponse("Key not found"),
+		},
+	},
+	"DELETE /data": {
+		Summary: "Delete every key with a prefix",
+		Tag:     "data",
+		Query: []apiParam{
+			{"prefix", "string", "keys to delete start with this; required"},
+			{"dry_run", "boolean", "only list the keys that would be deleted"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Keys deleted, or with dry_run the keys that would be", obj{
+				"type": "object",
+				"properties": obj{
+					"status":  obj{"type": "string"},
+					"deleted": obj{"type": "integer"},
+					"dry_run": obj{"type": "boolean"},
+					"count":   obj{"type": "integer"},
+					"keys":    obj{"type": "array", "items": obj{"type": "string"}},
+				},
+			}),
+			"202": jsonResponse("With -confirm-destructive, repeat with the token in X-Confirm-Token to carry it out", ref("ConfirmationRequired")),
+			"400": errorResponse("Missing prefix"),
+			"409": errorResponse("Invalid or expired confirmation token"),
+			"422": errorResponse("Rejected by a validation webhook"),
+			"503": errorResponse("Server is read-only"),
+		},
+	},
+	"POST /data": {
+		Summary: "Set one or more keys",
+		Tag:     "data",
+		Query: []apiParam{
+			{"partial", "boolean", "store the keys that pass validation and report each key's result with 207, instead of rejecting the whole batch"},
+			{"mode", "string", "create to only write keys that do not exist yet, failing with 409 if any does"},
+		},
+		RequestBody: obj{
+			"type":                 "object",
+			"description":          "String values are stored as-is; other JSON values are stored as JSON text, or rejected with -strict-json. The same map may be sent as msgpack (application/msgpack), or as a kv.BatchSetRequest (application/x-protobuf); responses follow the Accept header likewise. X-Key-Tags tags every key set, and X-Key-TTL gives each the same expiry.",
+			"additionalProperties": obj{},
+		},
+		Responses: map[string]obj{
+			"201": jsonResponse("Keys stored", statusSchema),
+			"207": jsonResponse("With partial, the result of each key", batchResultSchema),
+			"400": errorResponse("Invalid JSON, or invalid_request listing every rejected key, such as empty keys and values over the size limit, in fields"),
+			"415": errorResponse("Body is not JSON, msgpack or protobuf, or not UTF-8"),
+			"403": errorResponse("Quota exceeded"),
+			"409": errorResponse("With mode=create, a key already exists"),
+			"422": errorResponse("Rejected by a schema or a validation webhook"),
+			"503": errorResponse("Server is read-only"),
+		},
+	},
+	"GET /data/{key}": {
+		Summary: "Get a key, or long-poll for its next change",
+		Tag:     "data",
+		Query: []apiParam{
+			{"watch", "boolean", "wait for a change instead of returning the current value"},
+			{"since", "integer", "with watch, return the first change after this revision"},
+			{"timeout", "string", "with watch, how long to wait (Go duration, default 30s, max 5m)"},
+			{"version", "integer", "return the value as of this revision (requires value history)"},
+			{"path", "string", "JSONPath ($.a.b, $.items[0], $.items[*]) selecting part of a JSON value"},
+			{"consistency", "string", "on a cluster node or replica: local (default), leader or linearizable; also X-Read-Consistency"},
+			{"max_staleness", "string", "with local consistency, the oldest data (Go duration) a follower or replica may serve before redirecting; also X-Max-Staleness"},
+		},
+		Responses: map[string]obj{
+			"200": {
+				"description": "The value, or with watch the change event. Values stored with PUT are returned as-is with their content type. Encrypted values are returned sealed, as JSON, unless the API key holds the decrypt scope. A key that expires has its remaining seconds in X-Key-TTL, and X-Key-TTL-Mode: sliding if this read extended it. With a cache in front of a disk backend, X-Cache is HIT, STALE (served past the cache TTL while it is refreshed) or MISS, Age the seconds since a cached value was read from the backend and, with a cache TTL, X-Cache-Max-Stale the most that can be; Cache-Control: no-cache skips stale values.",
+				"content": obj{
+					"application/json": obj{"schema": obj{"oneOf": []obj{stringMapSchema, ref("Event")}}},
+					"*/*":              obj{"schema": obj{"type": "string", "format": "binary"}},
+				},
+			},
+			"304": {"description": "The value matches If-None-Match or is unchanged since If-Modified-Since; with watch, no change before the timeout, and X-Revision holds the current revision"},
+			"403": errorResponse("A tag of the key requires a scope the API key lacks"),
+			"404": errorResponse("Key not found"),
+		},
+	},
+	"PUT /data/{key}": {
+		Summary: "Store the request body as the key's value, keeping its Content-Type",
+		Tag:     "data",
+		Query: []apiParam{
+			{"mode", "string", "create to fail with 409 if the key exists; If-None-Match: * does the same"},
+		},
+		RequestBody: obj{"type": "string", "format": "binary"},
+		RequestType: "*/*",
+		Responses: map[string]obj{
+			"201": jsonResponse("Value stored. A comma-separated X-Key-Tags replaces the key's tags, an empty one clears them, and without it they are kept. X-Key-TTL (seconds or a Go duration, 0 to remove) sets when the key expires, which with X-Key-TTL-Mode: sliding starts over on every GET; without it the expiry is kept. X-Key-Session attaches the key to a session of /sessions, deleting it when the session ends; a write without it detaches the key again.", statusSchema),
+			"400": errorResponse("Invalid mode, X-Key-Tags or X-Key-TTL"),
+			"403": errorResponse("Quota exceeded, or a tag requires a scope the API key lacks"),
+			"409": errorResponse("The key exists and mode is create, or the X-Key-Session has expired"),
+			"413": errorResponse("Value larger than the configured maximum"),
+			"422": errorResponse("Rejected by a schema or a validation webhook"),
+			"503": errorResponse("Server is read-only"),
+		},
+	},
+	"DELETE /data/{key}": {
+		Summary: "Delete a key",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"200": jsonResponse("Key deleted", statusSchema),
+			"403": errorResponse("A tag of the key requires a scope the API key lacks"),
+			"404": errorResponse("Key not found"),
+			"503": errorResponse("Server is read-only"),
+		},
+	},
+	"POST /data/{key}/getset": {
+		Summary: "Set a key and return the value it replaced, in one atomic step",
+		Tag:     "data",
+		RequestBody: obj{
+			"type":       "object",
+			"required":   []string{"value"},
+			"properties": obj{"value": obj{"type": "string"}},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Previous value", obj{
+				"type": "object",
+				"properties": obj{
+					"key":      obj{"type": "string"},
+					"previous": obj{"type": "string", "nullable": true, "description": "null if the key did not exist"},
+				},
+			}),
+			"400": errorResponse("Invalid body"),
+			"403": errorResponse("Quota exceeded"),
+			"422": errorResponse("Rejected by a schema or a validation webhook"),
+			"503": errorResponse("Server is read-only"),
+		},
+	},
+	"POST /data/{key}/getdel": {
+		Summary: "Delete a key and return its value, in one atomic step",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"200": jsonResponse("Deleted value", stringMapSchema),
+			"404": errorResponse("Key not found"),
+			"503": errorResponse("Server is read-only"),
+		},
+	},
+	"POST /data/{key}/lpush": {
+		Summary:     "Add values to the front of a list, creating it",
+		Tag:         "collections",
+		RequestBody: elementsBody("values"),
+		Responses: map[string]obj{
+			"200": jsonResponse("New length", listLengthSchema),
+			"400": errorResponse("Invalid body"),
+			"409": errorResponse("Key holds a value of another type"),
+		},
+	},
+	"POST /data/{key}/rpush": {
+		Summary:     "Add values to the back of a list, creating it",
+		Tag:         "collections",
+		RequestBody: elementsBody("values"),
+		Responses: map[string]obj{
+			"200": jsonResponse("New length", listLengthSchema),
+			"400": errorResponse("Invalid body"),
+			"409": errorResponse("Key holds a value of another type"),
+		},
+	},
+	"POST /data/{key}/lpop": {
+		Summary: "Remove and return the first element of a list",
+		Tag:     "collections",
+		Responses: map[string]obj{
+			"200": jsonResponse("The element", listPopSchema),
+			"404": errorResponse("List is empty"),
+			"409": errorResponse("Key holds a value of another type"),
+		},
+	},
+	"POST /data/{key}/rpop": {
+		Summary: "Remove and return the last element of a list",
+		Tag:     "collections",
+		Responses: map[string]obj{
+			"200": jsonResponse("The element", listPopSchema),
+			"404": errorResponse("List is empty"),
+			"409": errorResponse("Key holds a value of another type"),
+		},
+	},
+	"GET /data/{key}/lrange": {
+		Summary: "Elements of a list by position",
+		Tag:     "collections",
+		Query: []apiParam{
+			{"start", "integer", "first position, negative from the end (default 0)"},
+			{"stop", "integer", "last position, inclusive, negative from the end (default -1)"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Elements", obj{
+				"type": "object",
+				"properties": obj{
+					"values": obj{"type": "array", "items": obj{"type": "string"}},
+					"length": obj{"type": "integer"},
+				},
+			}),
+			"400": errorResponse("Invalid parameter"),
+			"409": errorResponse("Key holds a value of another type"),
+		},
+	},
+	"POST /data/{key}/sadd": {
+		Summary:     "Add members to a set, creating it",
+		Tag:         "collections",
+		RequestBody: elementsBody("members"),
+		Responses: map[string]obj{
+			"200": jsonResponse("Members added", obj{
+				"type": "object",
+				"properties": obj{
+					"added": obj{"type": "integer"},
+					"size":  obj{"type": "integer"},
+				},
+			}),
+			"400": errorResponse("Invalid body"),
+			"409": errorResponse("Key holds a value of another type"),
+		},
+	},
+	"POST /data/{key}/srem": {
+		Summary:     "Remove members from a set; the key is deleted once it is empty",
+		Tag:         "collections",
+		RequestBody: elementsBody("members"),
+		Responses: map[string]obj{
+			"200": jsonResponse("Members removed", obj{
+				"type": "object",
+				"properties": obj{
+					"removed": obj{"type": "integer"},
+					"size":    obj{"type": "integer"},
+				},
+			}),
+			"400": errorResponse("Invalid body"),
+			"409": errorResponse("Key holds a value of another type"),
+		},
+	},
+	"GET /data/{key}/smembers": {
+		Summary: "Members of a set, sorted, or whether ?member= is one",
+		Tag:     "collections",
+		Query: []apiParam{
+			{"member", "string", "report only whether this is a member"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Members", obj{
+				"type": "object",
+				"properties": obj{
+					"members": obj{"type": "array", "items": obj{"type": "string"}},
+					"size":    obj{"type": "integer"},
+					"member":  obj{"type": "boolean", "description": "with ?member= only"},
+				},
+			}),
+			"409": errorResponse("Key holds a value of another type"),
+		},
+	},
+	"GET /data/{key}/history": {
+		Summary: "Recorded past versions of a key, newest first",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"200": jsonResponse("Versions", obj{
+				"type": "object",
+				"properties": obj{
+					"key": obj{"type": "string"},
+					"versions": obj{"type": "array", "items": obj{
+						"type": "object",
+						"properties": obj{
+							"revision": obj{"type": "integer"},
+							"value":    obj{"type": "string"},
+							"deleted":  obj{"type": "boolean"},
+							"time":     obj{"type": "string", "format": "date-time"},
+						},
+					}},
+				},
+			}),
+			"404": errorResponse("Key not found or history not enabled"),
+		},
+	},
+	"POST /data/{key}/restore": {
+		Summary: "Restore a soft-deleted key",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"200": jsonResponse("The restored pair", stringMapSchema),
+			"404": errorResponse("No deleted key to restore"),
+			"409": errorResponse("Key exists"),
+		},
+	},
+	"GET /tombstones": {
+		Summary: "List soft-deleted keys that can still be restored",
+		Tag:     "data",
+		Responses: map[string]obj{"200": jsonResponse("Tombstones", obj{
+			"type": "array",
+			"items": obj{
+				"type": "object",
+				"properties": obj{
+					"key":        obj{"type": "string"},
+					"value":      obj{"type": "string"},
+					"deleted_at": obj{"type": "string", "format": "date-time"},
+					"expires_at": obj{"type": "string", "format": "date-time"},
+				},
+			},
+		})},
+	},
+	"GET /indexes": {
+		Summary: "List secondary indexes",
+		Tag:     "query",
+		Responses: map[string]obj{"200": jsonResponse("Indexes", obj{
+			"type": "array",
+			"items": obj{
+				"type": "object",
+				"properties": obj{
+					"name":   obj{"type": "string"},
+					"field":  obj{"type": "string"},
+					"keys":   obj{"type": "integer", "description": "number of indexed keys"},
+					"values": obj{"type": "integer", "description": "number of distinct indexed values"},
+				},
+			},
+		})},
+	},
+	"POST /indexes": {
+		Summary:     "Declare a secondary index and build it from existing keys",
+		Tag:         "query",
+		RequestBody: ref("IndexDef"),
+		Responses: map[string]obj{
+			"201": jsonResponse("Index created", ref("IndexDef")),
+			"400": errorResponse("Invalid index"),
+			"409": errorResponse("Index already exists"),
+		},
+	},
+	"DELETE /indexes/{name}": {
+		Summary: "Drop a secondary index",
+		Tag:     "query",
+		Responses: map[string]obj{
+			"200": jsonResponse("Index dropped", statusSchema),
+			"404": errorResponse("Index not found"),
+		},
+	},
+	"GET /query": {
+		Summary: "Find the keys whose indexed field has a value",
+		Tag:     "query",
+		Query: []apiParam{
+			{"index", "string", "name of the index"},
+			{"value", "string", "value to look up; non-string JSON values are given as JSON text"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Matching keys", obj{
+				"type": "object",
+				"properties": obj{
+					"index": obj{"type": "string"},
+					"value": obj{"type": "string"},
+					"count": obj{"type": "integer"},
+					"keys":  obj{"type": "array", "items": obj{"type": "string"}},
+				},
+			}),
+			"400": errorResponse("index and value are required"),
+			"404": errorResponse("Index not found"),
+		},
+	},
+	"GET /search": {
+		Summary: "Full-text search over values, best match first",
+		Tag:     "query",
+		Query: []apiParam{
+			{"q", "string", "words to search for"},
+			{"mode", "string", "all (default) to require every word, any to require one"},
+			{"prefix", "string", "only search keys with this prefix"},
+			{"limit", "integer", "maximum number of hits (default 20, max 1000)"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Ranked matches", obj{
+				"type": "object",
+				"properties": obj{
+					"query": obj{"type": "string"},
+					"total": obj{"type": "integer"},
+					"hits": obj{"type": "array", "items": obj{
+						"type": "object",
+						"properties": obj{
+							"key":   obj{"type": "string"},
+							"score": obj{"type": "number"},
+						},
+					}},
+				},
+			}),
+			"400": errorResponse("Invalid query"),
+			"404": errorResponse("Full-text search is not enabled"),
+		},
+	},
+	"GET /graphql": {
+		Summary: "Run a GraphQL query, or fetch the schema without one",
+		Tag:     "query",
+		Query: []apiParam{
+			{"query", "string", "GraphQL document; omit to get the schema in SDL form"},
+			{"operationName", "string", "operation to run if the document has several"},
+			{"variables", "string", "variables as a JSON object"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Query result, with any field errors", ref("GraphQLResponse")),
+			"400": errorResponse("Missing query or malformed variables"),
+		},
+	},
+	"POST /graphql": {
+		Summary: "Run a GraphQL query or mutation",
+		Tag:     "query",
+		RequestBody: obj{
+			"type": "object",
+			"properties": obj{
+				"query":         obj{"type": "string"},
+				"operationName": obj{"type": "string"},
+				"variables":     obj{"type": "object"},
+			},
+			"required": []string{"query"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Query result, with any field errors", ref("GraphQLResponse")),
+			"400": errorResponse("Missing query or invalid JSON"),
+		},
+	},
+	"GET /info": {
+		Summary:   "Build, uptime, limits and enabled features of the server",
+		Tag:       "admin",
+		Responses: map[string]obj{"200": jsonResponse("Server information", ref("Info"))},
+	},
+	"GET /stats": {
+		Summary:   "Current request statistics",
+		Tag:       "stats",
+		Responses: map[string]obj{"200": jsonResponse("Statistics", ref("Stats"))},
+	},
+	"POST /stats/reset": {
+		Summary:   "Reset request counters",
+		Tag:       "stats",
+		Responses: map[string]obj{"200": jsonResponse("Counters reset", statusSchema)},
+	},
+	"GET /stats/history": {
+		Summary: "Statistics snapshots recorded by the background worker",
+		Tag:     "stats",
+		Query: []apiParam{
+			{"window", "string", "how far back to look (Go duration)"},
+			{"step", "string", "downsample to one snapshot per step (Go duration)"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Snapshots, oldest first", obj{"type": "array", "items": ref("Stats")}),
+			"400": errorResponse("Invalid window or step"),
+		},
+	},
+	"GET /stats/clients": {
+		Summary: "The clients that sent the most traffic since the last reset",
+		Tag:     "stats",
+		Query: []apiParam{
+			{"n", "integer", "how many clients to return (default 10)"},
+			{"sort", "string", "rank by requests (default), errors or bytes"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Top clients", obj{
+				"type": "object",
+				"properties": obj{
+					"clients": obj{"type": "array", "items": ref("ClientStats")},
+					"tracked": obj{"type": "integer", "description": "clients with counters"},
+					"sort":    obj{"type": "string"},
+				},
+			}),
+			"400": errorResponse("Invalid n or sort"),
+		},
+	},
+	"GET /stats/hotkeys": {
+		Summary: "The most read and most written keys over the tracking window",
+		Tag:     "stats",
+		Query:   []apiParam{{"n", "integer", "how many keys of each kind to return (default 10)"}},
+		Responses: map[string]obj{
+			"200": jsonResponse("Estimated hot keys", obj{
+				"type": "object",
+				"properties": obj{
+					"window": obj{"type": "string", "description": "Go duration"},
+					"reads":  obj{"type": "array", "items": ref("HotKey")},
+					"writes": obj{"type": "array", "items": ref("HotKey")},
+				},
+			}),
+			"400": errorResponse("Invalid n"),
+			"404": errorResponse("Hot-key tracking is disabled"),
+		},
+	},
+	"GET /backup": {
+		Summary: "Stream a consistent snapshot as NDJSON",
+		Tag:     "admin",
+		Responses: map[string]obj{"200": {
+			"description": "One {\"key\",\"value\"} object per line",
+			"content":     obj{"application/x-ndjson": obj{"schema": ref("Record")}},
+		}},
+	},
+	"POST /bulk": {
+		Summary:     "Load an NDJSON stream of set/delete records atomically",
+		Tag:         "admin",
+		RequestBody: ref("BulkRecord"),
+		RequestType: "application/x-ndjson",
+		Responses: map[string]obj{"200": {
+			"description": "Progress acknowledgements, then a final commit or abort line",
+			"content":     obj{"application/x-ndjson": obj{"schema": ref("BulkAck")}},
+		}},
+	},
+	"GET /export": {
+		Summary: "Export the namespace as NDJSON in key order",
+		Tag:     "admin",
+		Query: []apiParam{
+			{"prefix", "string", "only export keys with this prefix"},
+			{"format", "string", "ndjson (default), csv for key,value rows under a header row, or resp for Redis SET commands to pipe into redis-cli --pipe"},
+		},
+		Responses: map[string]obj{
+			"200": {
+				"description": "One {\"key\",\"value\"} object per line, or with format=csv one row and with format=resp one SET command per key, as an attachment",
+				"content": obj{
+					"application/x-ndjson":     obj{"schema": ref("Record")},
+					"text/csv":                 obj{"schema": obj{"type": "string"}},
+					"application/octet-stream": obj{"schema": obj{"type": "string", "format": "binary"}},
+				},
+			},
+			"400": errorResponse("Invalid format"),
+		},
+	},
+	"POST /import": {
+		Summary: "Import an NDJSON export, a CSV file or a Redis RDB dump, streaming progress and a summary",
+		Tag:     "admin",
+		Query: []apiParam{
+			{"mode", "string", "merge (default) overwrites, replace also deletes keys not in the import, missing only adds new keys"},
+			{"format", "string", "ndjson (default); csv (also chosen by a text/csv body) for key,value[,ttl] rows, all validated before any is imported; or rdb for a Redis RDB dump, whose string keys are imported and other keys counted as unsupported"},
+			{"db", "integer", "with format=rdb, the Redis database to import (default 0)"},
+		},
+		RequestBody: ref("Record"),
+		RequestType: "application/x-ndjson",
+		Responses: map[string]obj{
+			"200": {
+				"description": "Progress lines, then a final done or failed line",
+				"content":     obj{"application/x-ndjson": obj{"schema": ref("ImportProgress")}},
+			},
+			"400": errorResponse("Invalid mode, format or db"),
+		},
+	},
+	"POST /clone": {
+		Summary: "Copy the namespace into another one, here or on another server",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type":     "object",
+			"required": []string{"target"},
+			"properties": obj{
+				"target":  obj{"type": "string", "description": "namespace to copy into, created if need be"},
+				"url":     obj{"type": "string", "description": "base URL of the server holding the target; the export is streamed to its import endpoint"},
+				"api_key": obj{"type": "string", "description": "with url, the API key to import with"},
+				"prefix":  obj{"type": "string", "description": "only copy keys with this prefix"},
+				"mode":    obj{"type": "string", "enum": []string{"merge", "replace", "missing"}, "description": "as for import (default merge)"},
+			},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Keys copied", ref("CloneResult")),
+			"400": errorResponse("Invalid target, url or mode, or the target is the source namespace"),
+			"502": errorResponse("The remote server failed the import or could not be reached"),
+			"503": errorResponse("Server is read-only"),
+		},
+	},
+	"GET /watch": {
+		Summary: "Stream change events over a WebSocket",
+		Tag:     "data",
+		Query:   []apiParam{{"prefix", "string", "only send events for keys with this prefix"}},
+		Responses: map[string]obj{
+			"101": {"description": "Switching to the WebSocket protocol; each text message is an Event"},
+			"400": errorResponse("Not a WebSocket upgrade request"),
+			"503": errorResponse("The watch feature is disabled"),
+		},
+	},
+	"GET /session": {
+		Summary: "Run get, set and delete commands over a WebSocket",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"101": {"description": "Switching to the WebSocket protocol. Each text message sent is a SessionCommand and is answered, in order, by a SessionReply carrying its id; commands may be pipelined."},
+			"400": errorResponse("Not a WebSocket upgrade request"),
+		},
+	},
+	"GET /cluster": {
+		Summary: "This node's view of the Raft cluster",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Cluster status", ref("ClusterStatus")),
+			"404": errorResponse("Clustering is not enabled"),
+		},
+	},
+	"GET /cluster/status": {
+		Summary: "This node's view of the Raft cluster: its role, the term and the leader, and whether it is in contact with a majority",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Cluster status", ref("ClusterStatus")),
+			"404": errorResponse("Clustering is not enabled"),
+		},
+	},
+	"GET /cluster/topology": {
+		Summary: "The nodes of the deployment and, when sharded, the hash ring that assigns keys to them",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Topology", ref("ClusterTopology")),
+			"404": errorResponse("No topology is configured"),
+		},
+	},
+	"GET /cluster/rebalance": {
+		Summary: "Progress of moving keys to their new owners since the hash ring last changed",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Rebalance progress", ref("RebalanceStatus")),
+			"404": errorResponse("Sharding is not enabled"),
+		},
+	},
+	"GET /changes": {
+		Summary: "Mutations after a sequence number, in order, across all namespaces",
+		Tag:     "data",
+		Query: []apiParam{
+			{"since", "integer", "return changes with a higher sequence number (default 0)"},
+			{"limit", "integer", "maximum events to return (default 100, max 1000)"},
+			{"epoch", "string", "epoch of the previous page; 410 if the server has restarted since"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("A page of changes", ref("ChangesPage")),
+			"400": errorResponse("Invalid parameter"),
+			"404": errorResponse("The change log is not enabled"),
+			"410": errorResponse("Changes after since are no longer retained"),
+			"503": errorResponse("The watch feature is disabled"),
+		},
+	},
+	"GET /queues/{name}": {
+		Summary: "Length of a queue",
+		Tag:     "queues",
+		Responses: map[string]obj{
+			"200": jsonResponse("Queue length", ref("QueueStats")),
+			"400": errorResponse("Invalid queue name"),
+		},
+	},
+	"POST /queues/{name}/push": {
+		Summary: "Append a message to a queue",
+		Tag:     "queues",
+		RequestBody: obj{
+			"type":       "object",
+			"required":   []string{"value"},
+			"properties": obj{"value": obj{"type": "string"}},
+		},
+		Responses: map[string]obj{
+			"201": jsonResponse("Pushed", obj{
+				"type": "object",
+				"properties": obj{
+					"id":     obj{"type": "integer"},
+					"length": obj{"type": "integer"},
+				},
+			}),
+			"400": errorResponse("Invalid body or queue name"),
+		},
+	},
+	"POST /queues/{name}/pop": {
+		Summary: "Take the oldest visible message, hiding it until acknowledged or the visibility timeout passes",
+		Tag:     "queues",
+		RequestBody: obj{
+			"type": "object",
+			"properties": obj{"visibility_timeout": obj{
+				"description": "seconds or a duration such as \"30s\"; default 30s, at most 12h; 0 removes the message at once",
+				"oneOf":       []obj{{"type": "number"}, {"type": "string"}},
+			}},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("A message", ref("QueueMessage")),
+			"204": obj{"description": "No visible message"},
+			"400": errorResponse("Invalid body or queue name"),
+		},
+	},
+	"POST /queues/{name}/ack": {
+		Summary: "Remove a popped message",
+		Tag:     "queues",
+		RequestBody: obj{
+			"type":       "object",
+			"required":   []string{"receipt"},
+			"properties": obj{"receipt": obj{"type": "string"}},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Acknowledged", statusSchema),
+			"400": errorResponse("Invalid receipt"),
+			"404": errorResponse("Message not found"),
+			"409": errorResponse("The visibility timeout has passed"),
+		},
+	},
+	"GET /sessions": {
+		Summary: "Live sessions, oldest first",
+		Tag:     "sessions",
+		Responses: map[string]obj{
+			"200": jsonResponse("The sessions", obj{"type": "array", "items": ref("KeySession")}),
+		},
+	},
+	"POST /sessions": {
+		Summary: "Start a session; keys written with X-Key-Session: {id} are deleted when it ends or is not renewed within its ttl",
+		Tag:     "sessions",
+		RequestBody: obj{
+			"type": "object",
+			"properties": obj{
+				"name": obj{"type": "string", "description": "label, such as the worker's name"},
+				"ttl":  sessionTTLSchema,
+			},
+		},
+		Responses: map[string]obj{
+			"201": jsonResponse("Started", ref("KeySession")),
+			"400": errorResponse("Invalid body"),
+		},
+	},
+	"GET /sessions/{id}": {
+		Summary: "A session and its keys",
+		Tag:     "sessions",
+		Responses: map[string]obj{
+			"200": jsonResponse("The session, with key_list", ref("KeySession")),
+			"404": errorResponse("Session not found or expired"),
+		},
+	},
+	"PUT /sessions/{id}": {
+		Summary: "Renew a session: the heartbeat that keeps its keys",
+		Tag:     "sessions",
+		RequestBody: obj{
+			"type": "object",
+			"properties": obj{
+				"ttl": sessionTTLSchema,
+			},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Renewed", ref("KeySession")),
+			"400": errorResponse("Invalid body"),
+			"404": errorResponse("Session not found or expired; its keys are, or are about to be, deleted"),
+		},
+	},
+	"DELETE /sessions/{id}": {
+		Summary: "End a session, deleting its keys",
+		Tag:     "sessions",
+		Responses: map[string]obj{
+			"200": jsonResponse("Ended", obj{"type": "object", "properties": obj{
+				"status":  obj{"type": "string"},
+				"deleted": obj{"type": "integer", "description": "keys deleted"},
+			}}),
+			"404": errorResponse("Session not found"),
+		},
+	},
+	"GET /locks": {
+		Summary: "Locks currently held",
+		Tag:     "locks",
+		Responses: map[string]obj{
+			"200": jsonResponse("Held locks, by name", obj{"type": "array", "items": ref("Lock")}),
+		},
+	},
+	"GET /locks/{name}": {
+		Summary: "The current holder of a lock",
+		Tag:     "locks",
+		Responses: map[string]obj{
+			"200": jsonResponse("The lease", ref("Lock")),
+			"404": errorResponse("Lock is not held"),
+		},
+	},
+	"POST /locks/{name}": {
+		Summary: "Acquire a lock with a lease; re-acquiring as the same owner extends it",
+		Tag:     "locks",
+		RequestBody: obj{
+			"type":     "object",
+			"required": []string{"owner"},
+			"properties": obj{
+				"owner": obj{"type": "string"},
+				"ttl":   lockTTLSchema,
+			},
+		},
+		Responses: map[string]obj{
+			"201": jsonResponse("Acquired; token is the fencing token to pass to guarded resources", ref("Lock")),
+			"400": errorResponse("Invalid body"),
+			"409": errorResponse("Held by another owner"),
+		},
+	},
+	"PUT /locks/{name}": {
+		Summary: "Refresh a lease",
+		Tag:     "locks",
+		RequestBody: obj{
+			"type":     "object",
+			"required": []string{"token"},
+			"properties": obj{
+				"token": obj{"type": "integer"},
+				"ttl":   lockTTLSchema,
+			},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Refreshed", ref("Lock")),
+			"400": errorResponse("Invalid body"),
+			"409": errorResponse("The lease has expired or the token is not the holder's"),
+		},
+	},
+	"DELETE /locks/{name}": {
+		Summary: "Release a lock",
+		Tag:     "locks",
+		Query: []apiParam{
+			{"token", "integer", "fencing token the lock was acquired with"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Released", statusSchema),
+			"400": errorResponse("Missing token"),
+			"409": errorResponse("The lease has expired or the token is not the holder's"),
+		},
+	},
+	"GET /schedules": {
+		Summary: "Pending scheduled operations, soonest first",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"200": jsonResponse("Scheduled operations", obj{"type": "array", "items": ref("ScheduledOp")}),
+		},
+	},
+	"POST /schedules": {
+		Summary: "Schedule a set or delete of a key for a future time",
+		Tag:     "data",
+		RequestBody: obj{
+			"type":     "object",
+			"required": []string{"op", "key"},
+			"properties": obj{
+				"op":    obj{"type": "string", "enum": []string{"set", "delete"}},
+				"key":   obj{"type": "string"},
+				"value": obj{"type": "string", "description": "required for set"},
+				"at":    obj{"type": "string", "format": "date-time"},
+				"in":    obj{"description": "instead of at: seconds, or a duration such as \"1h\", from now"},
+			},
+		},
+		Responses: map[string]obj{
+			"201": jsonResponse("Scheduled; the background job makes the write within a second of its time, as the client that scheduled it", ref("ScheduledOp")),
+			"400": errorResponse("Invalid op, key, value or time"),
+			"403": errorResponse("A tag of the key requires a scope the API key lacks"),
+			"503": errorResponse("Server is read-only"),
+		},
+	},
+	"GET /schedules/{id}": {
+		Summary: "A pending scheduled operation",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"200": jsonResponse("The operation", ref("ScheduledOp")),
+			"404": errorResponse("No pending operation with that id"),
+		},
+	},
+	"DELETE /schedules/{id}": {
+		Summary: "Cancel a pending scheduled operation",
+		Tag:     "data",
+		Responses: map[string]obj{
+			"200": jsonResponse("The cancelled operation", ref("ScheduledOp")),
+			"404": errorResponse("No pending operation with that id"),
+		},
+	},
+	"GET /replication/stream": {
+		Summary: "Stream mutations to a replica",
+		Tag:     "admin",
+		Query: []apiParam{
+			{"epoch", "string", "primary process the replica last synced from"},
+			{"from", "integer", "sequence number of the first mutation wanted"},
+			{"replica", "string", "ID the replica is listed under in /stats"},
+		},
+		Responses: map[string]obj{
+			"200": {
+				"description": "Mutations as they happen, and heartbeats with only head set while idle",
+				"content":     obj{"application/x-ndjson": obj{"schema": ref("ChangeEvent")}},
+			},
+			"404": errorResponse("This node does not serve replicas"),
+			"410": errorResponse("The replica must resync from /replication/snapshot"),
+		},
+	},
+	"GET /replication/snapshot": {
+		Summary: "Every key of every namespace, for a replica to resync from",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": {
+				"description": "Set entries; X-Replication-Epoch and X-Replication-Seq give the position to stream from",
+				"content":     obj{"application/x-ndjson": obj{"schema": ref("ChangeEvent")}},
+			},
+			"404": errorResponse("This node does not serve replicas"),
+		},
+	},
+	"POST /replication/apply": {
+		Summary: "Apply mutations mirrored from another site, in order",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type":       "object",
+			"properties": obj{"entries": obj{"type": "array", "items": ref("ChangeEvent")}},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Mutations applied", obj{
+				"type":       "object",
+				"properties": obj{"applied": obj{"type": "integer"}},
+			}),
+			"400": errorResponse("Invalid JSON or mutation"),
+			"503": errorResponse("Server is read-only"),
+		},
+	},
+	"GET /replication/digest": {
+		Summary: "Key count and checksum of every namespace, for comparing sites",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Digests", obj{"type": "array", "items": ref("NamespaceDigest")}),
+		},
+	},
+	"GET /audit": {
+		Summary: "Query the audit log of mutations, newest first",
+		Tag:     "admin",
+		Query: append(auditFilterParams,
+			apiParam{"limit", "integer", "maximum entries to return (default 100, max 1000)"}),
+		Responses: map[string]obj{
+			"200": jsonResponse("Audit entries", obj{"type": "array", "items": ref("AuditEntry")}),
+			"400": errorResponse("Invalid filter"),
+			"404": errorResponse("Audit log is not enabled"),
+		},
+	},
+	"GET /audit/export": {
+		Summary: "Download retained audit entries as NDJSON, oldest first",
+		Tag:     "admin",
+		Query:   auditFilterParams,
+		Responses: map[string]obj{
+			"200": {
+				"description": "One audit entry per line",
+				"content":     obj{"application/x-ndjson": obj{"schema": ref("AuditEntry")}},
+			},
+			"400": errorResponse("Invalid filter"),
+			"404": errorResponse("Audit log is not enabled"),
+		},
+	},
+	"GET /admin/recordings": {
+		Summary: "Recorded requests and their responses, newest first",
+		Tag:     "admin",
+		Query: append(recordingFilterParams,
+			apiParam{"limit", "integer", "maximum recordings to return (default 100, max 1000)"}),
+		Responses: map[string]obj{
+			"200": jsonResponse("Recordings", obj{"type": "array", "items": ref("Recording")}),
+			"400": errorResponse("Invalid filter"),
+			"404": errorResponse("Request recording is not enabled"),
+		},
+	},
+	"DELETE /admin/recordings": {
+		Summary: "Forget the recordings held in memory; the record file is kept",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Recordings cleared", obj{"type": "object", "properties": obj{"cleared": obj{"type": "integer"}}}),
+			"404": errorResponse("Request recording is not enabled"),
+		},
+	},
+	"GET /admin/recordings/export": {
+		Summary: "Download retained recordings as NDJSON, oldest first, for server replay",
+		Tag:     "admin",
+		Query:   recordingFilterParams,
+		Responses: map[string]obj{
+			"200": {
+				"description": "One recording per line",
+				"content":     obj{"application/x-ndjson": obj{"schema": ref("Recording")}},
+			},
+			"400": errorResponse("Invalid filter"),
+			"404": errorResponse("Request recording is not enabled"),
+		},
+	},
+	"GET /admin/eviction": {
+		Summary: "Eviction policy, budget and counters",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Eviction status", ref("EvictionStatus")),
+			"404": errorResponse("Eviction is not enabled"),
+		},
+	},
+	"PUT /admin/eviction": {
+		Summary: "Change the eviction budget",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type": "object",
+			"properties": obj{
+				"max_keys":   obj{"type": "integer"},
+				"max_memory": obj{"oneOf": []obj{{"type": "integer"}, {"type": "string", "example": "64MB"}}},
+			},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("New eviction status", ref("EvictionStatus")),
+			"400": errorResponse("Invalid budget"),
+			"404": errorResponse("Eviction is not enabled"),
+		},
+	},
+	"POST /auth/token": {
+		Summary: "Issue a short-lived token for a service account, granting keys under a prefix",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type":     "object",
+			"required": []string{"name", "permissions"},
+			"properties": obj{
+				"name":        obj{"type": "string", "description": "the service account, as the client is named in logs and stats"},
+				"namespace":   obj{"type": "string", "description": "the only namespace the token grants; any if empty"},
+				"prefix":      obj{"type": "string", "description": "keys the token grants; all if empty"},
+				"permissions": obj{"type": "array", "items": obj{"type": "string", "enum": []string{"read", "write", "delete"}}},
+				"scopes":      obj{"type": "array", "items": obj{"type": "string"}, "description": "scopes the token holds, from those of the caller"},
+				"ttl":         obj{"description": "seconds or a duration such as \"15m\" (default -token-ttl, at most -token-max-ttl)"},
+			},
+		},
+		Responses: map[string]obj{
+			"201": jsonResponse("The token, shown only this once, and what it grants", ref("IssuedToken")),
+			"400": errorResponse("Invalid name, permissions or ttl"),
+			"403": errorResponse("The caller lacks the token admin scope or a scope it would grant"),
+			"404": errorResponse("Token issuance is not enabled"),
+		},
+	},
+	"POST /auth/token/revoke": {
+		Summary: "Revoke an issued token, by the token itself or its id",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type": "object",
+			"properties": obj{
+				"token":   obj{"type": "string"},
+				"id":      obj{"type": "string"},
+				"expires": obj{"type": "string", "format": "date-time", "description": "with id, when the token expires; the entry is kept for -token-max-ttl otherwise"},
+			},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Token revoked", statusSchema),
+			"400": errorResponse("Neither a valid token nor an id"),
+			"403": errorResponse("The caller lacks the token admin scope"),
+			"404": errorResponse("Token issuance is not enabled"),
+		},
+	},
+	"GET /auth/token/revoked": {
+		Summary: "The revoked tokens that have not expired yet",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Revocation list", obj{"type": "array", "items": obj{
+				"type": "object",
+				"properties": obj{
+					"id":      obj{"type": "string"},
+					"revoked": obj{"type": "string", "format": "date-time"},
+					"expires": obj{"type": "string", "format": "date-time"},
+				},
+			}}),
+			"403": errorResponse("The caller lacks the token admin scope"),
+			"404": errorResponse("Token issuance is not enabled"),
+		},
+	},
+	"GET /ns": {
+		Summary: "List namespaces",
+		Tag:     "namespaces",
+		Responses: map[string]obj{"200": jsonResponse("Namespaces and their key counts", obj{
+			"type": "array",
+			"items": obj{
+				"type": "object",
+				"properties": obj{
+					"name":      obj{"type": "string"},
+					"data_size": obj{"type": "integer"},
+				},
+			},
+		})},
+	},
+	"GET /ns/{namespace}/stats": {
+		Summary: "Request statistics of a namespace",
+		Tag:     "namespaces",
+		Responses: map[string]obj{
+			"200": jsonResponse("Statistics", ref("NamespaceStats")),
+			"404": errorResponse("Namespace not found"),
+		},
+	},
+	"GET /ns/{namespace}/usage": {
+		Summary: "Current size and quota of a namespace",
+		Tag:     "namespaces",
+		Responses: map[string]obj{
+			"200": jsonResponse("Usage", obj{
+				"type": "object",
+				"properties": obj{
+					"namespace": obj{"type": "string"},
+					"keys":      obj{"type": "integer"},
+					"bytes":     obj{"type": "integer"},
+					"quota": obj{
+						"type": "object",
+						"properties": obj{
+							"max_keys":  obj{"type": "integer"},
+							"max_bytes": obj{"type": "integer"},
+						},
+					},
+				},
+			}),
+			"404": errorResponse("Namespace not found"),
+		},
+	},
+	"DELETE /ns/{namespace}": {
+		Summary: "Delete a namespace and all of its keys",
+		Tag:     "namespaces",
+		Responses: map[string]obj{
+			"200": jsonResponse("Namespace deleted", statusSchema),
+			"400": errorResponse("The default namespace cannot be deleted"),
+			"404": errorResponse("Namespace not found"),
+		},
+	},
+	"GET /admin/webhooks": {
+		Summary:   "List notification webhooks",
+		Tag:       "admin",
+		Responses: map[string]obj{"200": jsonResponse("Webhooks", obj{"type": "array", "items": ref("Webhook")})},
+	},
+	"POST /admin/webhooks": {
+		Summary: "Register a notification webhook",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type":     "object",
+			"required": []string{"url"},
+			"properties": obj{
+				"url":    obj{"type": "string"},
+				"prefix": obj{"type": "string"},
+				"secret": obj{"type": "string"},
+				"events": obj{
+					"type":        "array",
+					"items":       obj{"type": "string", "enum": append([]string{"*"}, eventTypes...)},
+					"description": "server event types to send instead of key changes",
+				},
+			},
+		},
+		Responses: map[string]obj{
+			"201": jsonResponse("Webhook registered", ref("Webhook")),
+			"400": errorResponse("Invalid request"),
+		},
+	},
+	"DELETE /admin/webhooks/{id}": {
+		Summary: "Remove a notification webhook",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Webhook removed", statusSchema),
+			"404": errorResponse("Webhook not found"),
+		},
+	},
+	"GET /admin/backups": {
+		Summary: "List snapshot backups in object storage, newest first",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Backups", obj{"type": "array", "items": ref("Backup")}),
+			"404": errorResponse("Backups are not configured"),
+			"502": errorResponse("The object store request failed"),
+		},
+	},
+	"POST /admin/flush": {
+		Summary: "Delete every key of a namespace, or those under a prefix",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type": "object",
+			"properties": obj{
+				"namespace": obj{"type": "string", "description": "namespace to clear, by default the default one"},
+				"prefix":    obj{"type": "string", "description": "only clear keys starting with this"},
+			},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Keys removed", obj{
+				"type": "object",
+				"properties": obj{
+					"status":    obj{"type": "string"},
+					"namespace": obj{"type": "string"},
+					"deleted":   obj{"type": "integer"},
+				},
+			}),
+			"202": jsonResponse("With -confirm-destructive, repeat with the token in X-Confirm-Token to carry it out", ref("ConfirmationRequired")),
+			"400": errorResponse("Invalid JSON"),
+			"404": errorResponse("Namespace not found"),
+			"409": errorResponse("Invalid or expired confirmation token"),
+			"503": errorResponse("Server is read-only"),
+		},
+	},
+	"GET /admin/events": {
+		Summary: "Stream server events: job failures, panics, evictions, saved snapshots and uploaded backups",
+		Tag:     "admin",
+		Query:   []apiParam{{"types", "string", "comma-separated event types to stream (default all)"}},
+		Responses: map[string]obj{
+			"200": {"description": "Server-Sent Events, each named by its type with a ServerEvent as data", "content": obj{"text/event-stream": obj{"schema": ref("ServerEvent")}}},
+			"400": errorResponse("Unknown event type"),
+		},
+	},
+	"GET /admin/jobs": {
+		Summary: "Background jobs and the outcome of their last run",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Registered jobs", obj{"type": "array", "items": ref("Job")}),
+		},
+	},
+	"GET /admin/mirror": {
+		Summary: "Progress of mirroring this node's mutations to another site",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Mirror status", ref("MirrorStatus")),
+			"404": errorResponse("Mirroring is not enabled"),
+		},
+	},
+	"GET /admin/mirror/diff": {
+		Summary: "Compare the key count and checksum of every namespace with the mirror's",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Comparison", ref("MirrorDiff")),
+			"404": errorResponse("Mirroring is not enabled"),
+			"502": errorResponse("The mirror could not be reached"),
+		},
+	},
+	"GET /admin/shadow": {
+		Summary: "Status of shadow writes to a second backend",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Shadow status", ref("ShadowStatus")),
+			"404": errorResponse("Shadow writes are not enabled"),
+		},
+	},
+	"GET /admin/shadow/compare": {
+		Summary: "Compare every key of the default namespace with the shadow backend's",
+		Tag:     "admin",
+		Query: []apiParam{
+			{"limit", "integer", "most differing keys to list (default 100, max 10000)"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Comparison", ref("ShadowDiff")),
+			"400": errorResponse("Invalid limit"),
+			"404": errorResponse("Shadow writes are not enabled"),
+		},
+	},
+	"GET /admin/requests": {
+		Summary: "Requests being served, oldest first",
+		Tag:     "admin",
+		Query: []apiParam{
+			{"min_age", "string", "only requests in flight for at least this long, as a duration such as \"10s\""},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Requests", obj{"type": "array", "items": ref("InflightRequest")}),
+			"400": errorResponse("Invalid min_age"),
+		},
+	},
+	"DELETE /admin/requests/{id}": {
+		Summary: "Cancel the context of the in-flight requests with a request ID; a response already being sent is cut off and its connection dropped",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Cancelled", obj{
+				"type": "object",
+				"properties": obj{
+					"status":    obj{"type": "string"},
+					"cancelled": obj{"type": "integer", "description": "requests with the ID"},
+				},
+			}),
+			"404": errorResponse("No request in flight with the ID"),
+		},
+	},
+	"GET /admin/lockouts": {
+		Summary: "Client addresses that failed to authenticate recently, locked out ones first",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Clients", obj{"type": "array", "items": ref("LockedClient")}),
+			"404": errorResponse("Authentication lockout is not enabled"),
+		},
+	},
+	"DELETE /admin/lockouts/{remote}": {
+		Summary: "Lift the lockout of a client address and forget its failures",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Unlocked", statusSchema),
+			"404": errorResponse("Lockout is not enabled or the address has no failures"),
+		},
+	},
+	"POST /admin/diagnostics": {
+		Summary: "Write a diagnostic report, as on SIGUSR1, to the server's diagnostics directory",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Report written", obj{
+				"type": "object",
+				"properties": obj{
+					"status": obj{"type": "string"},
+					"path":   obj{"type": "string", "description": "file on the server"},
+				},
+			}),
+			"404": errorResponse("Diagnostic reports are disabled"),
+			"500": errorResponse("The report could not be written"),
+		},
+	},
+	"POST /admin/verify": {
+		Summary: "Check every value, in memory and in the data file, against its checksum",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Verification report", obj{
+				"type": "object",
+				"properties": obj{
+					"namespaces": obj{"type": "array", "items": obj{
+						"type": "object",
+						"properties": obj{
+							"namespace": obj{"type": "string"},
+							"supported": obj{"type": "boolean", "description": "false if the backend keeps no checksums"},
+							"checked":   obj{"type": "integer"},
+							"corrupt":   obj{"type": "array", "items": obj{"type": "string"}},
+						},
+					}},
+					"data_file": obj{
+						"type": "object",
+						"properties": obj{
+							"path":            obj{"type": "string"},
+							"format_version":  obj{"type": "integer", "description": "0 for a file written before formats were versioned"},
+							"checked":         obj{"type": "integer"},
+							"corrupt":         obj{"type": "array", "items": obj{"type": "string"}},
+							"skipped_at_load": obj{"type": "array", "items": obj{"type": "string"}},
+							"error":           obj{"type": "string"},
+						},
+					},
+					"corrupt":      obj{"type": "integer", "description": "corrupted entries found in total"},
+					"took_seconds": obj{"type": "number"},
+				},
+			}),
+		},
+	},
+	"GET /admin/chaos": {
+		Summary: "Get the fault injection rules and how many faults were injected",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Chaos rules", ref("ChaosStatus")),
+			"404": errorResponse("Chaos mode is not enabled"),
+		},
+	},
+	"PUT /admin/chaos": {
+		Summary: "Replace the fault injection rules",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type": "object",
+			"properties": obj{
+				"rules": obj{
+					"type":                 "object",
+					"description":          `rules by "METHOD /path", or "*" for every route outside /admin`,
+					"additionalProperties": ref("ChaosRule"),
+				},
+			},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Rules applied", ref("ChaosStatus")),
+			"400": errorResponse("Invalid rule or unknown route"),
+			"404": errorResponse("Chaos mode is not enabled"),
+		},
+	},
+	"DELETE /admin/chaos": {
+		Summary: "Stop injecting faults",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"204": obj{"description": "Rules removed"},
+			"404": errorResponse("Chaos mode is not enabled"),
+		},
+	},
+	"POST /admin/promote": {
+		Summary: "Promote this replica to a primary that accepts writes",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Promoted", obj{
+				"type": "object",
+				"properties": obj{
+					"status":    obj{"type": "string"},
+					"promotion": ref("Promotion"),
+				},
+			}),
+			"409": errorResponse("This node is not a replica"),
+		},
+	},
+	"GET /admin/maintenance": {
+		Summary: "Get whether the server is in read-only mode",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Read-only mode", ref("Maintenance")),
+		},
+	},
+	"GET /admin/flags": {
+		Summary: "Feature flags gating optional subsystems",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"200": jsonResponse("Feature flags by name", obj{"type": "array", "items": ref("FeatureFlag")}),
+		},
+	},
+	"PUT /admin/flags/{name}": {
+		Summary: "Turn a feature on or off on this node",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type":       "object",
+			"required":   []string{"enabled"},
+			"properties": obj{"enabled": obj{"type": "boolean"}},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("The feature flag", ref("FeatureFlag")),
+			"400": errorResponse("Invalid JSON or missing enabled"),
+			"404": errorResponse("Unknown feature"),
+		},
+	},
+	"PUT /admin/maintenance": {
+		Summary: "Switch read-only mode on or off",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type":     "object",
+			"required": []string{"read_only"},
+			"properties": obj{
+				"read_only": obj{"type": "boolean"},
+				"reason":    obj{"type": "string"},
+				"retry_after": obj{
+					"description": "Retry-After sent to rejected writes, in seconds or as a duration such as \"5m\"; default 60s",
+					"oneOf":       []obj{{"type": "number"}, {"type": "string"}},
+				},
+			},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Read-only mode", ref("Maintenance")),
+			"400": errorResponse("Invalid JSON or retry_after"),
+		},
+	},
+	"POST /admin/backups": {
+		Summary: "Upload a snapshot of the default namespace now",
+		Tag:     "admin",
+		Responses: map[string]obj{
+			"201": jsonResponse("Backup uploaded", obj{
+				"type": "object",
+				"properties": obj{
+					"name":  obj{"type": "string"},
+					"keys":  obj{"type": "integer"},
+					"size":  obj{"type": "integer"},
+					"taken": obj{"type": "string", "format": "date-time"},
+				},
+			}),
+			"404": errorResponse("Backups are not configured"),
+			"502": errorResponse("The object store request failed"),
+		},
+	},
+	"POST /admin/backups/restore": {
+		Summary: "Replace the default namespace with a backup",
+		Tag:     "admin",
+		RequestBody: obj{
+			"type":       "object",
+			"properties": obj{"name": obj{"type": "string", "description": "backup to restore; the newest when omitted"}},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Summary of the restore", ref("ImportProgress")),
+			"202": jsonResponse("With -confirm-destructive, repeat with the token in X-Confirm-Token to carry it out", ref("ConfirmationRequired")),
+			"404": errorResponse("Backup not found, or backups are not configured"),
+			"409": errorResponse("Invalid or expired confirmation token"),
+			"502": errorResponse("The object store request failed"),
+		},
+	},
+	"POST /admin/restore": {
+		Summary: "Rebuild a namespace as it was at a point in time from the write-ahead log",
+		Tag:     "admin",
+		Query: []apiParam{
+			{"timestamp", "string", "RFC 3339 time to restore to"},
+			{"namespace", "string", "namespace to restore (default the default namespace)"},
+			{"target", "string", "namespace to restore into, which must not hold keys; default the namespace name followed by the timestamp"},
+			{"replace", "boolean", "replace the namespace itself instead"},
+		},
+		Responses: map[string]obj{
+			"200": jsonResponse("Summary of the restore", ref("PointInTimeRestore")),
+			"202": jsonResponse("With replace and -confirm-destructive, repeat with the token in X-Confirm-Token to carry it out", ref("ConfirmationRequired")),
+			"400": errorResponse("Invalid timestamp or namespace, or a timestamp in the future"),
+			"404": errorResponse("The write-ahead log is not enabled, or does not reach back to the timestamp"),
+			"409": errorResponse("The target namespace holds keys, or an invalid or expired confirmation token"),
+		},
+	},
+	"POST /admin/compact": {
+		Summary: "Reclaim the space of expired tombstones, old WAL files and the storage file's free pages, streaming progress",
+		Tag:     "admin",
+		Query: []apiParam{
+			{"force", "boolean", "rewrite the storage file even if little of it is free"},
+			{"history", "boolean", "also drop the value history of deleted keys"},
+		},
+		Responses: map[string]obj{
+			"200": {
+				"description": "A line as each step starts, then a summary",
+				"content":     obj{"application/x-ndjson": obj{"schema": ref("CompactProgress")}},
+			},
+			"202": jsonResponse("With history and -confirm-destructive, repeat with the token in X-Confirm-Token to carry it out", ref("ConfirmationRequired")),
+			"400": errorResponse("Invalid force or history, or history without value history enabled"),
+			"409": errorResponse("A compaction is already running, or an invalid or expired confirmation token"),
+		},
+	},
+	"GET /admin/schemas": {
+		Summary:   "List the JSON Schemas values are validated against",
+		Tag:       "admin",
+		Responses: map[string]obj{"200": jsonResponse("Schemas", obj{"type": "array", "items": ref("Schema")})},
+	},
+	"PUT /admin/schemas": {
+		Summary:     "Register or replace the JSON Schema for a key prefix",
+		Tag:         "admin",
+		RequestBody: ref("Schema"),
+		Responses: map[string]obj{
+			"200": jsonResponse("Schema registered", statusSchema),
+			"400": errorResponse("Invalid schema"),
+		},
+	},
+	"DELETE /admin/schemas": {
+		Summary: "Remove the JSON Schema for a key prefix",
+		Tag:     "admin",
+		Query:   []apiParam{{"prefix", "string", "prefix the schema is registered for"}},
+		Responses: map[string]obj{
+			"200": jsonResponse("Schema removed", statusSchema),
+			"404": errorResponse("No schema for prefix"),
+		},
+	},
+}
+
+func errorResponse(description string) obj {
+	return obj{
+		"description": description,
+		"content":     obj{"application/json": obj{"schema": ref("Error")}},
+	}
+}
+
+var apiSchemas = obj{
+	"Backup": obj{
+		"type": "object",
+		"properties": obj{
+			"name":          obj{"type": "string"},
+			"size":          obj{"type": "integer"},
+			"last_modified": obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"Error": obj{
+		"type":     "object",
+		"required": []string{"error"},
+		"properties": obj{"error": obj{
+			"type":     "object",
+			"required": []string{"code", "message"},
+			"properties": obj{
+				"code":       obj{"type": "string", "example": codeKeyNotFound},
+				"message":    obj{"type": "string"},
+				"request_id": obj{"type": "string"},
+				"details":    obj{"type": "array", "items": obj{"type": "string"}},
+				"fields": obj{
+					"type":        "array",
+					"description": "what is wrong with each rejected key or member, for invalid_request errors",
+					"items": obj{
+						"type": "object",
+						"properties": obj{
+							"field":  obj{"type": "string"},
+							"code":   obj{"type": "string", "enum": []string{fieldEmptyKey, fieldInvalidKey, fieldNotString, fieldValueTooLarge, fieldUnknown, fieldWrongType}},
+							"reason": obj{"type": "string"},
+						},
+					},
+				},
+			},
+		}},
+	},
+	"Event": obj{
+		"type": "object",
+		"properties": obj{
+			"type":     obj{"type": "string", "enum": []string{"set", "delete", "expired"}, "description": "expired for a key deleted because its TTL ran out"},
+			"key":      obj{"type": "string"},
+			"value":    obj{"type": "string"},
+			"created":  obj{"type": "boolean"},
+			"revision": obj{"type": "integer"},
+			"time":     obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"Stats": obj{
+		"type": "object",
+		"properties": obj{
+			"time":               obj{"type": "string", "format": "date-time"},
+			"total_requests":     obj{"type": "integer"},
+			"data_size":          obj{"type": "integer"},
+			"method_count":       obj{"type": "object", "additionalProperties": obj{"type": "integer"}},
+			"errors":             obj{"type": "integer"},
+			"panics":             obj{"type": "integer"},
+			"evictions":          obj{"type": "integer"},
+			"writes":             obj{"type": "integer", "description": "keys set"},
+			"deletes":            obj{"type": "integer", "description": "keys removed"},
+			"rates":              obj{"type": "object", "additionalProperties": ref("WindowRates"), "description": "rates of change over the last 1m, 5m and 15m, once the background worker has history to compare with"},
+			"runtime":            ref("RuntimeStats"),
+			"replication":        obj{"type": "object", "description": "role, position and lag of a primary or replica, when replicating, and for a promoted replica its Promotion"},
+			"value_compression":  obj{"type": "object", "description": "values compressed and skipped, bytes in and out, ratio and CPU seconds spent, when values are compressed in memory"},
+			"value_encryption":   obj{"type": "object", "description": "encrypted prefixes, decrypt scope, and values sealed, opened, withheld from clients without the scope and failing to open, when values are encrypted"},
+			"wal":                obj{"type": "object", "description": "the write-ahead log's directory, segments, snapshots and bytes on disk, the oldest time it can restore to, and the records appended and failed, when it is enabled"},
+			"gc":                 obj{"type": "object", "description": "estimates of the space held by tombstones, value history, WAL files and the storage file, and how much of it POST /admin/compact would reclaim now, with the result of the last compaction"},
+			"registration":       obj{"type": "object", "description": "the instance's ID and URL, the registration file and registry, whether it is registered, when it last was, and the last error, when the instance registers itself"},
+			"value_hooks":        obj{"type": "array", "items": obj{"type": "object"}, "description": "the prefix and name of each value hook, with the writes and reads it transformed and the writes it rejected, when value hooks are enabled"},
+			"schedules":          obj{"type": "object", "description": "scheduled operations pending, and carried out or failed since the start"},
+			"expiry":             obj{"type": "object", "description": "keys that expire, keys expired since the start, and reads that extended a sliding TTL"},
+			"sessions":           obj{"type": "object", "description": "command sessions active and opened since the start, and commands run over them"},
+			"key_sessions":       obj{"type": "object", "description": "sessions of /sessions active, keys attached to them, sessions expired and ended since the start, and keys deleted with them"},
+			"shadow":             obj{"type": "object", "description": "with shadow writes, as GET /admin/shadow"},
+			"requests_cancelled": obj{"type": "integer", "description": "requests cancelled with DELETE /admin/requests/{id} since the start, once there is one"},
+			"priority":           obj{"type": "object", "description": "batch_share and, by priority class (interactive or batch, from X-Priority or the API key), the requests seen and shed"},
+			"cache":              obj{"type": "object", "description": "capacity, bytes, entries, hits, misses, evictions and hit_ratio of the value cache, with a disk backend, and with a cache TTL its stale_hits, refreshes and refresh_failures"},
+			"alerts":             obj{"type": "array", "items": ref("AlertState"), "description": "the alert rules and whether they are firing, when alerts are configured"},
+			"slow_requests":      obj{"type": "object", "description": "threshold, count and by_route of requests slower than the slow request threshold, when one is set"},
+			"lock_contention":    obj{"type": "object", "description": "acquisitions, contended acquisitions, wait_ns and max_wait_ns of the server's locks in total, per lock and by_route, when lock stats are on"},
+		},
+	},
+	"AlertState": obj{
+		"type": "object",
+		"properties": obj{
+			"rule":          obj{"type": "string", "example": "error_rate>0.05"},
+			"value":         obj{"type": "number", "description": "the metric when last checked, absent while it is unavailable"},
+			"firing":        obj{"type": "boolean"},
+			"since":         obj{"type": "string", "format": "date-time"},
+			"last_notified": obj{"type": "string", "format": "date-time"},
+			"suppressed":    obj{"type": "integer", "description": "breaches not notified because they began within the cooldown"},
+		},
+	},
+	"WindowRates": obj{
+		"type": "object",
+		"properties": obj{
+			"seconds":           obj{"type": "number", "description": "how much of the window the history covers"},
+			"writes_per_sec":    obj{"type": "number"},
+			"deletes_per_sec":   obj{"type": "number"},
+			"requests_per_sec":  obj{"type": "number"},
+			"errors_per_sec":    obj{"type": "number"},
+			"error_rate":        obj{"type": "number", "description": "fraction of the window's requests that failed"},
+			"data_size_growth":  obj{"type": "integer", "description": "change in the number of keys"},
+			"data_size_per_sec": obj{"type": "number"},
+		},
+	},
+	"Info": obj{
+		"type": "object",
+		"properties": obj{
+			"build": obj{
+				"type": "object",
+				"properties": obj{
+					"version":    obj{"type": "string"},
+					"commit":     obj{"type": "string"},
+					"modified":   obj{"type": "boolean", "description": "built from a tree with uncommitted changes"},
+					"build_time": obj{"type": "string"},
+					"go_version": obj{"type": "string"},
+					"platform":   obj{"type": "string", "description": "GOOS/GOARCH"},
+				},
+			},
+			"node_id":        obj{"type": "string"},
+			"started":        obj{"type": "string", "format": "date-time"},
+			"uptime":         obj{"type": "string", "description": "Go duration"},
+			"uptime_seconds": obj{"type": "integer"},
+			"limits":         obj{"type": "object", "description": "configured limits; 0 means unlimited", "additionalProperties": obj{"type": "number"}},
+			"features":       obj{"type": "object", "additionalProperties": obj{"type": "boolean"}},
+			"error_locales":  obj{"type": "array", "items": obj{"type": "string"}, "description": "languages error messages are available in, chosen by Accept-Language; codes are the same in every language"},
+			"routes": obj{
+				"type":        "object",
+				"description": "the routes served and those disabled by configuration, as \"METHOD /path\" without the /v1 prefix",
+				"properties": obj{
+					"active":   obj{"type": "array", "items": obj{"type": "string"}},
+					"disabled": obj{"type": "array", "items": obj{"type": "string"}},
+				},
+			},
+		},
+	},
+	"GraphQLResponse": obj{
+		"type": "object",
+		"properties": obj{
+			"data": obj{"type": "object", "description": "the selected fields; absent if the document was rejected"},
+			"errors": obj{"type": "array", "items": obj{
+				"type": "object",
+				"properties": obj{
+					"message":    obj{"type": "string"},
+					"path":       obj{"type": "array", "items": obj{}},
+					"locations":  obj{"type": "array", "items": obj{"type": "object"}},
+					"extensions": obj{"type": "object", "properties": obj{"code": obj{"type": "string"}}},
+				},
+			}},
+		},
+	},
+	"RuntimeStats": obj{
+		"type":        "object",
+		"description": "Memory and scheduler figures of the process; only in GET /stats",
+		"properties": obj{
+			"heap_in_use":       obj{"type": "integer", "description": "bytes"},
+			"heap_objects":      obj{"type": "integer"},
+			"total_alloc":       obj{"type": "integer", "description": "bytes allocated since start"},
+			"sys":               obj{"type": "integer", "description": "bytes obtained from the OS"},
+			"num_gc":            obj{"type": "integer"},
+			"gc_pause_total_ns": obj{"type": "integer"},
+			"gc_pause_last_ns":  obj{"type": "integer"},
+			"gc_pause_max_ns":   obj{"type": "integer", "description": "longest of the last 256 pauses"},
+			"goroutines":        obj{"type": "integer"},
+			"store_bytes":       obj{"type": "integer", "description": "sum of key and value lengths across namespaces"},
+		},
+	},
+	"ChangeEvent": obj{
+		"type": "object",
+		"properties": obj{
+			"seq":   obj{"type": "integer"},
+			"op":    obj{"type": "string", "enum": []string{"set", "delete", "expire"}, "description": "expire deletes a key whose TTL ran out"},
+			"ns":    obj{"type": "string"},
+			"key":   obj{"type": "string"},
+			"value": obj{"type": "string"},
+			"type":  obj{"type": "string", "description": "content type of a raw value"},
+			"time":  obj{"type": "string", "format": "date-time"},
+			"head":  obj{"type": "integer", "description": "on heartbeats, the primary's latest sequence number"},
+		},
+	},
+	"ChangesPage": obj{
+		"type": "object",
+		"properties": obj{
+			"epoch":  obj{"type": "string", "description": "server process the sequence numbers belong to"},
+			"events": obj{"type": "array", "items": ref("ChangeEvent")},
+			"next":   obj{"type": "integer", "description": "since for the next page"},
+			"head":   obj{"type": "integer", "description": "latest sequence number"},
+		},
+	},
+	"QueueStats": obj{
+		"type": "object",
+		"properties": obj{
+			"length":    obj{"type": "integer"},
+			"in_flight": obj{"type": "integer", "description": "popped, not yet acknowledged"},
+		},
+	},
+	"ClientStats": obj{
+		"type": "object",
+		"properties": obj{
+			"client":    obj{"type": "string", "description": "key:{name} for an API key, otherwise the client's IP address"},
+			"requests":  obj{"type": "integer", "description": "successful requests"},
+			"errors":    obj{"type": "integer", "description": "requests answered with 4xx or 5xx"},
+			"bytes_in":  obj{"type": "integer"},
+			"bytes_out": obj{"type": "integer"},
+			"last_seen": obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"HotKey": obj{
+		"type": "object",
+		"properties": obj{
+			"namespace": obj{"type": "string"},
+			"key":       obj{"type": "string"},
+			"count":     obj{"type": "integer", "description": "estimated accesses; never below the true count"},
+		},
+	},
+	"Job": obj{
+		"type": "object",
+		"properties": obj{
+			"name":          obj{"type": "string"},
+			"interval":      obj{"type": "string", "description": "Go duration"},
+			"runs":          obj{"type": "integer"},
+			"failures":      obj{"type": "integer", "description": "runs that returned an error or panicked"},
+			"panics":        obj{"type": "integer"},
+			"last_run":      obj{"type": "string", "format": "date-time"},
+			"last_duration": obj{"type": "string", "description": "Go duration"},
+			"last_error":    obj{"type": "string"},
+			"next_run":      obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"ChaosRule": obj{
+		"type": "object",
+		"properties": obj{
+			"latency":            obj{"type": "string", "description": `delay before the request is handled, e.g. "250ms"`},
+			"jitter":             obj{"type": "string", "description": "up to this much extra delay, chosen at random"},
+			"error_rate":         obj{"type": "number", "description": "probability of failing with a 500 before the request is handled"},
+			"partial_write_rate": obj{"type": "number", "description": "probability of failing a write with a 500 after it was applied"},
+		},
+	},
+	"ChaosStatus": obj{
+		"type": "object",
+		"properties": obj{
+			"rules": obj{"type": "object", "additionalProperties": ref("ChaosRule")},
+			"injected": obj{
+				"type": "object",
+				"properties": obj{
+					"delayed":        obj{"type": "integer"},
+					"errors":         obj{"type": "integer"},
+					"partial_writes": obj{"type": "integer"},
+				},
+			},
+		},
+	},
+	"FeatureFlag": obj{
+		"type": "object",
+		"properties": obj{
+			"name":        obj{"type": "string", "enum": []string{"compression", "watch", "webhooks"}},
+			"enabled":     obj{"type": "boolean"},
+			"description": obj{"type": "string"},
+			"changed_at":  obj{"type": "string", "format": "date-time", "description": "when it was last flipped, if since startup"},
+		},
+	},
+	"Maintenance": obj{
+		"type": "object",
+		"properties": obj{
+			"read_only":   obj{"type": "boolean"},
+			"reason":      obj{"type": "string"},
+			"retry_after": obj{"type": "integer", "description": "seconds"},
+			"since":       obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"QueueMessage": obj{
+		"type": "object",
+		"properties": obj{
+			"id":         obj{"type": "integer"},
+			"value":      obj{"type": "string"},
+			"deliveries": obj{"type": "integer"},
+			"receipt":    obj{"type": "string", "description": "acknowledges this delivery; absent when the message was removed on pop"},
+			"visible_at": obj{"type": "string", "format": "date-time", "description": "when the message is delivered again if not acknowledged"},
+		},
+	},
+	"KeySession": obj{
+		"type": "object",
+		"properties": obj{
+			"id":         obj{"type": "string"},
+			"name":       obj{"type": "string"},
+			"ttl":        obj{"type": "number", "description": "lease length in seconds"},
+			"created":    obj{"type": "string", "format": "date-time"},
+			"renewed":    obj{"type": "string", "format": "date-time"},
+			"expires_at": obj{"type": "string", "format": "date-time"},
+			"keys":       obj{"type": "integer", "description": "keys attached"},
+			"key_list":   obj{"type": "object", "additionalProperties": obj{"type": "array", "items": obj{"type": "string"}}, "description": "the keys attached, by namespace"},
+		},
+	},
+	"Lock": obj{
+		"type": "object",
+		"properties": obj{
+			"name":       obj{"type": "string"},
+			"owner":      obj{"type": "string"},
+			"token":      obj{"type": "integer", "description": "fencing token; higher on every new acquisition"},
+			"acquired":   obj{"type": "string", "format": "date-time"},
+			"expires_at": obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"ScheduledOp": obj{
+		"type": "object",
+		"properties": obj{
+			"id":        obj{"type": "string"},
+			"op":        obj{"type": "string", "enum": []string{"set", "delete"}},
+			"namespace": obj{"type": "string"},
+			"key":       obj{"type": "string"},
+			"value":     obj{"type": "string"},
+			"at":        obj{"type": "string", "format": "date-time"},
+			"created":   obj{"type": "string", "format": "date-time"},
+			"client":    obj{"type": "string", "description": "API key the write is made as"},
+		},
+	},
+	"ClusterTopology": obj{
+		"type": "object",
+		"properties": obj{
+			"self":      obj{"type": "string"},
+			"discovery": obj{"type": "string", "enum": []string{discoveryStatic, discoveryDNS, discoveryGossip}},
+			"changed":   obj{"type": "string", "format": "date-time", "description": "when discovery last changed the nodes"},
+			"nodes": obj{"type": "array", "items": obj{
+				"type": "object",
+				"properties": obj{
+					"id":     obj{"type": "string"},
+					"url":    obj{"type": "string"},
+					"region": obj{"type": "string"},
+				},
+			}},
+			"hash":   obj{"type": "string", "description": "hash of keys and ring points: the first 8 bytes of SHA-256, big-endian", "example": ringHash},
+			"vnodes": obj{"type": "integer", "description": "ring points per node, at the hash of \"ID#i\""},
+			"ring": obj{"type": "array", "description": "ring points in token order; a key belongs to the first at or after its hash, wrapping around", "items": obj{
+				"type": "object",
+				"properties": obj{
+					"token": obj{"type": "string", "description": "hex"},
+					"node":  obj{"type": "string"},
+				},
+			}},
+		},
+	},
+	"RebalanceStatus": obj{
+		"type": "object",
+		"properties": obj{
+			"state":         obj{"type": "string", "enum": []string{"idle", "moving", "waiting", "done"}, "description": "waiting: this node has moved its keys while others still move theirs here"},
+			"ring":          obj{"type": "string", "description": "version of the ring being moved to"},
+			"started":       obj{"type": "string", "format": "date-time"},
+			"finished":      obj{"type": "string", "format": "date-time"},
+			"rate":          obj{"type": "integer", "description": "keys moved per second at most"},
+			"keys_scanned":  obj{"type": "integer"},
+			"keys_to_move":  obj{"type": "integer"},
+			"keys_moved":    obj{"type": "integer"},
+			"keys_failed":   obj{"type": "integer", "description": "keys that could not be sent; tried again shortly"},
+			"keys_received": obj{"type": "integer", "description": "keys moved here since the node started"},
+			"dual_reads":    obj{"type": "integer", "description": "requests for keys not yet moved here, served by their previous owner, since the node started"},
+			"waiting_for":   obj{"type": "array", "items": obj{"type": "string"}},
+		},
+	},
+	"IssuedToken": obj{
+		"type": "object",
+		"properties": obj{
+			"token":       obj{"type": "string", "description": "sent as a Bearer token; starts with kvt_"},
+			"id":          obj{"type": "string", "description": "what the token is revoked by"},
+			"name":        obj{"type": "string"},
+			"namespace":   obj{"type": "string"},
+			"prefix":      obj{"type": "string"},
+			"permissions": obj{"type": "array", "items": obj{"type": "string"}},
+			"scopes":      obj{"type": "array", "items": obj{"type": "string"}},
+			"expires":     obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"Promotion": obj{
+		"type": "object",
+		"properties": obj{
+			"time":           obj{"type": "string", "format": "date-time"},
+			"former_primary": obj{"type": "string"},
+			"reason":         obj{"type": "string", "description": "POST /admin/promote, or how long the primary had not been heard from"},
+			"applied_seq":    obj{"type": "integer", "description": "last mutation of the former primary applied"},
+			"lag_entries":    obj{"type": "integer", "description": "mutations the former primary was known to have that were not applied, and are lost"},
+		},
+	},
+	"InflightRequest": obj{
+		"type": "object",
+		"properties": obj{
+			"id":            obj{"type": "string", "description": "the request ID, as in X-Request-ID"},
+			"method":        obj{"type": "string"},
+			"path":          obj{"type": "string"},
+			"route":         obj{"type": "string", "description": "the route pattern, once matched"},
+			"remote":        obj{"type": "string"},
+			"started":       obj{"type": "string", "format": "date-time"},
+			"elapsed_ms":    obj{"type": "integer"},
+			"bytes_written": obj{"type": "integer", "description": "response bytes sent so far"},
+			"cancelled":     obj{"type": "boolean"},
+		},
+	},
+	"LockedClient": obj{
+		"type": "object",
+		"properties": obj{
+			"remote":       obj{"type": "string"},
+			"failures":     obj{"type": "integer", "description": "failures in the current window"},
+			"lockouts":     obj{"type": "integer", "description": "lockouts since the last success"},
+			"last_failure": obj{"type": "string", "format": "date-time"},
+			"locked_until": obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"MirrorStatus": obj{
+		"type": "object",
+		"properties": obj{
+			"remote":      obj{"type": "string"},
+			"connected":   obj{"type": "boolean", "description": "whether the last batch was accepted"},
+			"sent_seq":    obj{"type": "integer", "description": "last mutation the mirror has accepted"},
+			"head_seq":    obj{"type": "integer", "description": "latest mutation made here"},
+			"lag_entries": obj{"type": "integer"},
+			"batches":     obj{"type": "integer"},
+			"entries":     obj{"type": "integer"},
+			"retries":     obj{"type": "integer"},
+			"resyncs":     obj{"type": "integer", "description": "times every key was copied, at start and after falling behind the backlog"},
+			"last_sent":   obj{"type": "string", "format": "date-time"},
+			"last_error":  obj{"type": "string"},
+			"error_since": obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"NamespaceDigest": obj{
+		"type": "object",
+		"properties": obj{
+			"namespace": obj{"type": "string"},
+			"keys":      obj{"type": "integer"},
+			"checksum":  obj{"type": "string", "description": "hex CRC-32C of every key and value in key order"},
+		},
+	},
+	"MirrorDiff": obj{
+		"type": "object",
+		"properties": obj{
+			"remote":      obj{"type": "string"},
+			"diverged":    obj{"type": "boolean"},
+			"lag_entries": obj{"type": "integer", "description": "mutations the mirror had yet to accept; recent writes differ until it has"},
+			"namespaces": obj{"type": "array", "items": obj{
+				"type": "object",
+				"properties": obj{
+					"namespace":       obj{"type": "string"},
+					"local_keys":      obj{"type": "integer"},
+					"remote_keys":     obj{"type": "integer"},
+					"local_checksum":  obj{"type": "string"},
+					"remote_checksum": obj{"type": "string"},
+					"match":           obj{"type": "boolean"},
+				},
+			}},
+		},
+	},
+	"ShadowStatus": obj{
+		"type": "object",
+		"properties": obj{
+			"storage":     obj{"type": "string"},
+			"path":        obj{"type": "string"},
+			"synced":      obj{"type": "boolean", "description": "whether the first copy of the dataset is done"},
+			"queued":      obj{"type": "integer", "description": "writes waiting to be applied"},
+			"applied":     obj{"type": "integer"},
+			"failed":      obj{"type": "integer"},
+			"dropped":     obj{"type": "integer", "description": "writes lost to a full queue; the dataset is copied again"},
+			"resyncs":     obj{"type": "integer", "description": "times the dataset was copied again after writes were lost or failed"},
+			"last_error":  obj{"type": "string"},
+			"error_since": obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"ShadowDiff": obj{
+		"type": "object",
+		"properties": obj{
+			"diverged":     obj{"type": "boolean"},
+			"primary_keys": obj{"type": "integer"},
+			"shadow_keys":  obj{"type": "integer"},
+			"matching":     obj{"type": "integer"},
+			"missing":      obj{"type": "integer", "description": "keys the shadow lacks"},
+			"extra":        obj{"type": "integer", "description": "keys only the shadow has"},
+			"different":    obj{"type": "integer", "description": "keys whose values differ"},
+			"queued":       obj{"type": "integer", "description": "writes yet to be applied; recent writes differ until they are"},
+			"keys": obj{"type": "array", "items": obj{
+				"type": "object",
+				"properties": obj{
+					"key":  obj{"type": "string"},
+					"kind": obj{"type": "string", "enum": []string{"missing", "extra", "different"}},
+				},
+			}},
+			"keys_truncated": obj{"type": "boolean"},
+		},
+	},
+	"ClusterStatus": obj{
+		"type": "object",
+		"properties": obj{
+			"id":            obj{"type": "string"},
+			"role":          obj{"type": "string", "enum": []string{"follower", "candidate", "leader"}},
+			"term":          obj{"type": "integer"},
+			"leader":        obj{"type": "string"},
+			"leader_url":    obj{"type": "string"},
+			"quorum":        obj{"type": "boolean", "description": "whether this node is in contact with a majority; a leader that is not takes no writes and steps down"},
+			"last_index":    obj{"type": "integer"},
+			"commit_index":  obj{"type": "integer"},
+			"applied_index": obj{"type": "integer"},
+			"replicas":      obj{"type": "object", "description": "on the leader, the log index each peer has replicated up to", "additionalProperties": obj{"type": "integer"}},
+		},
+	},
+	"Recording": obj{
+		"type": "object",
+		"properties": obj{
+			"seq":         obj{"type": "integer"},
+			"time":        obj{"type": "string", "format": "date-time"},
+			"request_id":  obj{"type": "string"},
+			"duration_ms": obj{"type": "number"},
+			"request": obj{
+				"type":  "object",
+				"allOf": []obj{ref("RecordedBody")},
+				"properties": obj{
+					"method": obj{"type": "string"},
+					"url":    obj{"type": "string", "description": "path and query, with credential parameters redacted"},
+					"header": obj{"type": "object", "additionalProperties": obj{"type": "array", "items": obj{"type": "string"}}, "description": "with credential headers redacted"},
+				},
+			},
+			"response": obj{
+				"type":  "object",
+				"allOf": []obj{ref("RecordedBody")},
+				"properties": obj{
+					"status": obj{"type": "integer"},
+					"header": obj{"type": "object", "additionalProperties": obj{"type": "array", "items": obj{"type": "string"}}},
+				},
+			},
+		},
+	},
+	"RecordedBody": obj{
+		"type": "object",
+		"properties": obj{
+			"body":           obj{"type": "string", "description": "redacted for the /auth routes"},
+			"body_encoding":  obj{"type": "string", "enum": []string{"base64"}, "description": "set for a body that is not UTF-8 text"},
+			"body_size":      obj{"type": "integer", "description": "size of the whole body in bytes"},
+			"body_truncated": obj{"type": "boolean", "description": "set if only the first -record-body-limit bytes were kept"},
+		},
+	},
+	"AuditEntry": obj{
+		"type": "object",
+		"properties": obj{
+			"seq":        obj{"type": "integer"},
+			"time":       obj{"type": "string", "format": "date-time"},
+			"op":         obj{"type": "string", "enum": []string{"set", "delete", "expire", "delete_namespace", "auth_failure", "auth_lockout"}},
+			"namespace":  obj{"type": "string"},
+			"key":        obj{"type": "string"},
+			"client":     obj{"type": "string"},
+			"remote":     obj{"type": "string", "description": "client address, for auth_failure and auth_lockout"},
+			"request_id": obj{"type": "string"},
+			"old_hash":   obj{"type": "string"},
+			"new_hash":   obj{"type": "string"},
+		},
+	},
+	"KeyMeta": obj{
+		"type": "object",
+		"properties": obj{
+			"key":          obj{"type": "string"},
+			"value":        obj{"type": "string"},
+			"content_type": obj{"type": "string", "description": "media type of a value stored with PUT"},
+			"created_at":   obj{"type": "string", "format": "date-time"},
+			"updated_at":   obj{"type": "string", "format": "date-time"},
+			"revision":     obj{"type": "integer"},
+			"reads":        obj{"type": "integer"},
+			"last_read":    obj{"type": "string", "format": "date-time"},
+			"size":         obj{"type": "integer"},
+			"tags":         obj{"type": "array", "items": obj{"type": "string"}},
+		},
+	},
+	"EvictionStatus": obj{
+		"type": "object",
+		"properties": obj{
+			"policy": obj{"type": "string", "enum": []string{"lru", "lfu", "random"}},
+			"budget": obj{
+				"type": "object",
+				"properties": obj{
+					"max_keys":   obj{"type": "integer"},
+					"max_memory": obj{"type": "integer"},
+				},
+			},
+			"keys":      obj{"type": "integer"},
+			"memory":    obj{"type": "integer"},
+			"evictions": obj{"type": "integer"},
+		},
+	},
+	"NamespaceStats": obj{
+		"type": "object",
+		"properties": obj{
+			"namespace":      obj{"type": "string"},
+			"data_size":      obj{"type": "integer"},
+			"total_requests": obj{"type": "integer"},
+			"method_count":   obj{"type": "object", "additionalProperties": obj{"type": "integer"}},
+			"errors":         obj{"type": "integer"},
+		},
+	},
+	"Record": obj{
+		"type":       "object",
+		"properties": obj{"key": obj{"type": "string"}, "value": obj{"type": "string"}},
+	},
+	"BulkRecord": obj{
+		"type": "object",
+		"properties": obj{
+			"op":    obj{"type": "string", "enum": []string{"set", "delete", "commit", "abort"}},
+			"key":   obj{"type": "string"},
+			"value": obj{"type": "string"},
+		},
+	},
+	"BulkAck": obj{
+		"type": "object",
+		"properties": obj{
+			"status":   obj{"type": "string"},
+			"received": obj{"type": "integer"},
+			"applied":  obj{"type": "integer"},
+			"rolled_back": obj{
+				"type":        "integer",
+				"description": "Records of a failed commit that were applied and then undone",
+			},
+			"error": obj{"type": "string"},
+		},
+	},
+	"CloneResult": obj{
+		"type":        "object",
+		"description": "The summary of the import into the target",
+		"allOf":       []obj{ref("ImportProgress")},
+		"properties": obj{
+			"source": obj{"type": "string"},
+			"target": obj{"type": "string"},
+			"url":    obj{"type": "string"},
+		},
+	},
+	"PointInTimeRestore": obj{
+		"type":        "object",
+		"description": "The summary of the import into the target",
+		"allOf":       []obj{ref("ImportProgress")},
+		"properties": obj{
+			"source":    obj{"type": "string"},
+			"target":    obj{"type": "string"},
+			"timestamp": obj{"type": "string", "format": "date-time"},
+			"snapshot":  obj{"type": "string", "format": "date-time", "description": "when the snapshot the restore started from was taken"},
+			"replayed":  obj{"type": "integer", "description": "mutations of the log replayed onto the snapshot"},
+		},
+	},
+	"CompactProgress": obj{
+		"type": "object",
+		"properties": obj{
+			"status": obj{"type": "string", "enum": []string{"compacting", "done", "failed"}},
+			"step":   obj{"type": "string", "description": "the step starting, on compacting lines"},
+			"done": obj{"type": "array", "items": obj{
+				"type": "object",
+				"properties": obj{
+					"step":            obj{"type": "string", "enum": []string{"tombstones", "history", "wal", "storage"}},
+					"items":           obj{"type": "integer", "description": "tombstones purged, versions dropped or WAL files deleted"},
+					"reclaimed_bytes": obj{"type": "integer"},
+					"error":           obj{"type": "string"},
+				},
+			}},
+			"reclaimed_bytes": obj{"type": "integer"},
+			"started":         obj{"type": "string", "format": "date-time"},
+			"took_seconds":    obj{"type": "number"},
+		},
+	},
+	"ImportProgress": obj{
+		"type": "object",
+		"properties": obj{
+			"status":      obj{"type": "string", "enum": []string{"importing", "done", "failed"}},
+			"mode":        obj{"type": "string"},
+			"received":    obj{"type": "integer"},
+			"created":     obj{"type": "integer"},
+			"updated":     obj{"type": "integer"},
+			"skipped":     obj{"type": "integer", "description": "entries already holding the imported value, or existing keys in missing mode"},
+			"deleted":     obj{"type": "integer"},
+			"unsupported": obj{"type": "integer", "description": "keys of an RDB dump left out for not holding strings"},
+			"report": obj{
+				"type":        "object",
+				"description": "with format=csv, on the last line: whether a header row was skipped, the rows read and rejected, and the problems (rejected rows) and warnings (rows imported other than as written, such as a duplicate key) by line, at most 100 of each",
+				"properties": obj{
+					"header":   obj{"type": "boolean"},
+					"rows":     obj{"type": "integer"},
+					"invalid":  obj{"type": "integer"},
+					"problems": obj{"type": "array", "items": ref("CSVProblem")},
+					"warnings": obj{"type": "array", "items": ref("CSVProblem")},
+				},
+			},
+			"error": obj{"type": "string"},
+		},
+	},
+	"SessionCommand": obj{
+		"type":     "object",
+		"required": []string{"op"},
+		"properties": obj{
+			"id":    obj{"description": "any JSON value, echoed in the reply"},
+			"op":    obj{"type": "string", "enum": []string{"get", "set", "delete", "mget", "mset", "ping"}},
+			"key":   obj{"type": "string", "description": "for get, set and delete"},
+			"value": obj{"type": "string", "description": "for set"},
+			"keys":  obj{"type": "array", "items": obj{"type": "string"}, "description": "for mget"},
+			"items": obj{"type": "object", "additionalProperties": obj{"type": "string"}, "description": "for mset; validated in full before any is set"},
+		},
+	},
+	"SessionReply": obj{
+		"type": "object",
+		"properties": obj{
+			"id":      obj{"description": "the command's id"},
+			"ok":      obj{"type": "boolean"},
+			"value":   obj{"type": "string", "description": "for get"},
+			"values":  stringMapSchema,
+			"missing": obj{"type": "array", "items": obj{"type": "string"}, "description": "keys of an mget that do not exist"},
+			"error":   obj{"type": "object", "description": "when ok is false: the code and message the operation gets over HTTP"},
+		},
+	},
+	"CSVProblem": obj{
+		"type": "object",
+		"properties": obj{
+			"line":   obj{"type": "integer"},
+			"key":    obj{"type": "string"},
+			"code":   obj{"type": "string", "description": "bad_row, invalid_ttl, duplicate_key, validation_failed, or a field code of invalid_request"},
+			"reason": obj{"type": "string"},
+		},
+	},
+	"IndexDef": obj{
+		"type":     "object",
+		"required": []string{"name"},
+		"properties": obj{
+			"name":  obj{"type": "string"},
+			"field": obj{"type": "string", "description": "JSONPath of the indexed field; omit to index whole values"},
+		},
+	},
+	"Range": obj{
+		"type": "object",
+		"properties": obj{
+			"entries": obj{"type": "array", "items": obj{
+				"type": "object",
+				"properties": obj{
+					"key":   obj{"type": "string"},
+					"value": obj{"type": "string"},
+				},
+			}},
+			"next": obj{"type": "string", "description": "bound to continue a scan cut short by limit"},
+		},
+	},
+	"ConfirmationRequired": obj{
+		"type": "object",
+		"properties": obj{
+			"status":        obj{"type": "string", "enum": []string{"confirmation_required"}},
+			"operation":     obj{"type": "string", "enum": []string{"flush", "delete_prefix", "restore"}},
+			"impact":        obj{"type": "object", "description": "what the operation would do: the namespace, prefix or backup and the number of keys affected"},
+			"confirm_token": obj{"type": "string"},
+			"expires_at":    obj{"type": "string", "format": "date-time"},
+		},
+	},
+	"KeyRange": obj{
+		"type": "object",
+		"properties": obj{
+			"keys": obj{"type": "array", "items": obj{"type": "string"}},
+			"next": obj{"type": "string", "description": "bound to continue a scan cut short by limit"},
+		},
+	},
+	"SortedList": obj{
+		"type": "object",
+		"properties": obj{
+			"entries": obj{"type": "array", "items": obj{
+				"type":        "object",
+				"description": "the key, its value unless fields leave it out, and with meta the fields of KeyMeta",
+				"properties": obj{
+					"key":   obj{"type": "string"},
+					"value": obj{"type": "string"},
+				},
+			}},
+			"next": obj{"type": "string", "description": "cursor to pass as after to continue a listing cut short by limit"},
+		},
+	},
+	"Schema": obj{
+		"type":     "object",
+		"required": []string{"schema"},
+		"properties": obj{
+			"prefix": obj{"type": "string"},
+			"schema": obj{"description": "A JSON Schema document"},
+		},
+	},
+	"Webhook": obj{
+		"type": "object",
+		"properties": obj{
+			"id":     obj{"type": "string"},
+			"url":    obj{"type": "string"},
+			"prefix": obj{"type": "string"},
+			"events": obj{"type": "array", "items": obj{"type": "string"}},
+			"stats":  obj{"type": "object"},
+		},
+	},
+	"ServerEvent": obj{
+		"type": "object",
+		"properties": obj{
+			"type":    obj{"type": "string", "enum": eventTypes},
+			"time":    obj{"type": "string", "format": "date-time"},
+			"source":  obj{"type": "string", "description": "the job, route, file, backup or key the event is about"},
+			"message": obj{"type": "string"},
+			"fields":  obj{"type": "object"},
+		},
+	},
+}
+
+// withNamespaceNotFound returns a copy of responses with the 404 a
+// namespaced route gives for an unknown namespace.
+func withNamespaceNotFound(responses map[string]obj) map[string]obj {
+	out := make(map[string]obj, len(responses)+1)
+	for code, r := range responses {
+		out[code] = r
+	}
+	if _, ok := out["404"]; !ok {
+		out["404"] = errorResponse("Namespace not found")
+	}
+	return out
+}
+
+var pathParamRE = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+// buildOpenAPI generates the OpenAPI 3 document for the registered routes.
+func buildOpenAPI(routes []routeInfo) []byte {
+	paths := obj{}
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].path < routes[j].path })
+	for _, rt := range routes {
+		op, ok := apiOperations[rt.method+" "+rt.path]
+		if !ok {
+			// Namespaced data routes behave like their default-namespace
+			// counterparts.
+			if rest, cut := strings.CutPrefix(rt.path, "/ns/{namespace}"); cut {
+				op, ok = apiOperations[rt.method+" "+rest]
+				op.Summary += " in a namespace"
+				op.Responses = withNamespaceNotFound(op.Responses)
+			}
+		}
+		if !ok {
+			op = apiOperation{Summary: rt.method + " " + rt.path}
+		}
+
+		var params []obj
+		for _, m := range pathParamRE.FindAllStringSubmatch(rt.path, -1) {
+			params = append(params, obj{
+				"name": m[1], "in": "path", "required": true,
+				"schema": obj{"type": "string"},
+			})
+		}
+		for _, q := range op.Query {
+			params = append(params, obj{
+				"name": q.Name, "in": "query", "description": q.Description,
+				"schema": obj{"type": q.Type},
+			})
+		}
+
+		resp := obj{
+			"401": errorResponse("Missing or invalid API key"),
+			"405": errorResponse("Method not allowed"),
+			"429": errorResponse("Rate limit exceeded; see Retry-After"),
+		}
+		for code, r := range op.Responses {
+			resp[code] = r
+		}
+
+		operation := obj{
+			"summary":     op.Summary,
+			"operationId": operationID(rt.method, rt.path),
+			"responses":   resp,
+		}
+		if op.Tag != "" {
+			operation["tags"] = []string{op.Tag}
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.RequestBody != nil {
+			ct := op.RequestType
+			if ct == "" {
+				ct = "application/json"
+			}
+			operation["requestBody"] = obj{
+				"required": true,
+				"content":  obj{ct: obj{"schema": op.RequestBody}},
+			}
+		}
+
+		item, _ := paths[apiPrefix+rt.path].(obj)
+		if item == nil {
+			item = obj{}
+			paths[apiPrefix+rt.path] = item
+		}
+		item[strings.ToLower(rt.method)] = operation
+	}
+
+	doc := obj{
+		"openapi": "3.0.3",
+		"info": obj{
+			"title":       "Key/value store API",
+			"version":     "1",
+			"description": "Any request may take ?envelope= (or X-Envelope): true wraps JSON responses as {\"data\": ..., \"meta\": {\"version\", \"count\", \"took_ms\"}}, error bodies as {\"error\": ..., \"meta\": ...}; headers sends only X-Data-Version, the namespace's latest write revision, and, for listings, X-Total-Count; false, the default, neither.",
+		},
+		"paths": paths,
+		"components": obj{
+			"schemas": apiSchemas,
+			"securitySchemes": obj{
+				"bearer": obj{"type": "http", "scheme": "bearer"},
+				"apiKey": obj{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"signed": obj{
+					"type":        "http",
+					"scheme":      signingScheme,
+					"description": "key=NAME, timestamp=UNIX, signature=HEX: hex HMAC-SHA256, under the signing key's secret, of the method, the path and query, the timestamp and the hex SHA-256 of the body, joined by newlines. Each signature is accepted once, within the signing window of the server's clock.",
+				},
+			},
+		},
+		"security": []obj{{}, {"bearer": []string{}}, {"apiKey": []string{}}, {"signed": []string{}}},
+	}
+	b, _ := json.MarshalIndent(doc, "", "  ")
+	return b
+}
+
+// operationID derives a stable identifier, e.g. "DELETE /data/{key}" ->
+// "deleteDataByKey".
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, seg := range strings.Split(strings.Trim(path, "/"), "/") {
+		if m := pathParamRE.FindStringSubmatch(seg); m != nil {
+			seg = "by-" + m[1]
+		}
+		for _, w := range strings.FieldsFunc(seg, func(r rune) bool { return r == '-' || r == '_' }) {
+			b.WriteString(strings.ToUpper(w[:1]) + w[1:])
+		}
+	}
+	return b.String()
+}
+
+// openAPIHandler serves a pre-built OpenAPI document.
+func openAPIHandler(doc []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}
+}
+
+// swaggerUIPage loads Swagger UI from a CDN and points it at /openapi.json.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>API explorer</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.onload = () => { window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" }); };
+  </script>
+</body>
+</html>
+`
+
+// GET
+func swaggerUIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,562 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// snapshotFormat names the format of data files in their header, and
+// snapshotVersion is the newest version of it this server reads. Change
+// the version whenever a file written by this server could be misread by
+// one that knows only the previous version. Version 1 files hold JSON
+// lines; version 2 files, written with any other PersistCodec, hold the
+// records of the codec their header names. Version 3 files are version 2
+// files whose records may belong to namespaces other than the default
+// one, written in whatever codec, JSON included, so that older servers
+// refuse them rather than load every namespace into the default one. A
+// file holding only the default namespace is still written as version 1
+// or 2, which older servers read.
+const (
+	snapshotFormat  = "kv-snapshot"
+	snapshotVersion = 3
+)
+
+// errSnapshotVersion is returned for a data file in a format version this
+// server does not know, typically one written by a newer server.
+var errSnapshotVersion = errors.New("unsupported snapshot format version")
+
+// snapshotHeader is the first line of a data file.
+type snapshotHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Codec   string    `json:"codec,omitempty"`
+}
+
+// snapshotTrailer is the last line of a data file: the number of entries
+// and the SHA-256 of the lines holding them, so that a truncated or
+// spliced file is refused rather than partly loaded.
+type snapshotTrailer struct {
+	End    bool   `json:"end"`
+	Keys   int    `json:"keys"`
+	SHA256 string `json:"sha256"`
+}
+
+// writeSnapshot encodes snap as JSON lines, one entry per key with the
+// checksum of its value and the key's tags and expiry, and returns the
+// number of entries written. A snapshot missing corrupted values is
+// refused; see Snapshot.Err.
+func writeSnapshot(w io.Writer, snap *Snapshot) (int, error) {
+	if err := snap.Err(); err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	n := 0
+	var err error
+	snap.Range(func(k, v string) bool {
+		e := snap.entry(k, v)
+		e.CRC = formatChecksum(checksum(v))
+		if err = enc.Encode(e); err != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	return n, err
+}
+
+// writeSnapshotFile encodes snaps, the default namespace first, the way
+// data files hold them: the entries of writeSnapshot between a header and
+// a trailer, or with a codec other than JSON, or namespaces besides the
+// default one, their records.
+func writeSnapshotFile(w io.Writer, snaps []*Snapshot, codec PersistCodec) (int, error) {
+	for _, snap := range snaps {
+		if err := snap.Err(); err != nil {
+			return 0, err
+		}
+	}
+	if codec == nil {
+		codec = jsonPersistCodec{}
+	}
+	enc := json.NewEncoder(w)
+	hdr := snapshotHeader{Format: snapshotFormat, Version: 1, Created: time.Now().UTC()}
+	switch {
+	case len(snaps) > 1:
+		hdr.Version, hdr.Codec = snapshotVersion, codec.Name()
+	case codec.Name() != persistJSON:
+		hdr.Version, hdr.Codec = 2, codec.Name()
+	}
+	if err := enc.Encode(hdr); err != nil {
+		return 0, err
+	}
+	if hdr.Codec != "" {
+		return writeSnapshotRecords(w, snaps, codec)
+	}
+	h := sha256.New()
+	n, err := writeSnapshot(io.MultiWriter(w, h), snaps[0])
+	if err != nil {
+		return n, err
+	}
+	return n, enc.Encode(snapshotTrailer{End: true, Keys: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+}
+
+// writeSnapshotRecords writes the entries of snaps as records of codec,
+// then a trailer whose checksum is entryDigest's, which does not depend on
+// the codec.
+func writeSnapshotRecords(w io.Writer, snaps []*Snapshot, codec PersistCodec) (int, error) {
+	enc := codec.NewEncoder(w)
+	h := sha256.New()
+	n := 0
+	var err error
+	for _, snap := range snaps {
+		snap.Range(func(k, v string) bool {
+			e := snap.entry(k, v)
+			rec := &PersistRecord{NS: snap.ns, Key: k, Value: v, CRC: formatChecksum(checksum(v)), Tags: e.Tags}
+			rec.setExpiry(e.Expiry)
+			if err = enc.Encode(rec); err != nil {
+				return false
+			}
+			entryDigest(h, rec)
+			n++
+			return true
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, enc.Encode(&PersistRecord{End: true, Keys: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+}
+
+// entryDigest adds an entry of a version 2 data file to the checksum of
+// its trailer: the key and the value, each after its length as a varint.
+// An entry with tags, an expiry or a namespace other than the default one
+// adds the number of its tags and each after its length, then 1 and its
+// deadline in Unix nanoseconds, TTL and whether it slides as varints if
+// it expires or 0 if not, then its namespace after its length; one with
+// none of them adds what it did before keys had them.
+func entryDigest(h io.Writer, rec *PersistRecord) {
+	str := func(s string) {
+		h.Write(binary.AppendUvarint(nil, uint64(len(s))))
+		io.WriteString(h, s)
+	}
+	str(rec.Key)
+	str(rec.Value)
+	if len(rec.Tags) == 0 && rec.Expires.IsZero() && rec.NS == "" {
+		return
+	}
+	h.Write(binary.AppendUvarint(nil, uint64(len(rec.Tags))))
+	for _, t := range rec.Tags {
+		str(t)
+	}
+	b := []byte{0}
+	if !rec.Expires.IsZero() {
+		b[0] = 1
+		b = binary.AppendVarint(b, rec.Expires.UnixNano())
+		b = binary.AppendVarint(b, int64(rec.TTL))
+		if rec.Sliding {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	h.Write(b)
+	str(rec.NS)
+}
+
+// saveSnapshotFile atomically replaces path with the contents of snaps,
+// encoded with codec; see writeSnapshotFile. The data is written to a temporary file in the same
+// directory, synced, and renamed into place so a crash never leaves a
+// half-written file behind. With a key ring the file is encrypted with its
+// primary key.
+func saveSnapshotFile(path string, snaps []*Snapshot, kr *keyRing, codec PersistCodec) (int, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var n int
+	if kr != nil {
+		// The plaintext is only ever held in memory.
+		var buf bytes.Buffer
+		if n, err = writeSnapshotFile(&buf, snaps, codec); err == nil {
+			_, err = tmp.Write(kr.seal(buf.Bytes()))
+		}
+	} else {
+		bw := bufio.NewWriter(tmp)
+		n, err = writeSnapshotFile(bw, snaps, codec)
+		if err == nil {
+			err = bw.Flush()
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// snapshotLoad describes a snapshot file that was read.
+type snapshotLoad struct {
+	Keys    int       // entries read intact
+	KeyID   string    // key the file was encrypted with, "" if plaintext
+	Corrupt []string  // keys whose value failed its checksum
+	Version int       // format version, 0 for a file from before versions
+	Created time.Time // when the file was written, if it says
+	Codec   string    // PersistCodec the entries are in
+	// Namespaces names the namespaces besides the default one the file
+	// holds keys of.
+	Namespaces []string
+}
+
+// loadSnapshotFile reads a file written by saveSnapshotFile into the
+// namespaces of nr, creating those other than the default one, with the
+// tags and expiries saved with the keys, decrypting it with kr if it is
+// encrypted. Keys whose time came while the file was not loaded are
+// loaded all the same and swept soon after. Nothing is loaded unless the
+// file's framing checks out; see readSnapshot. Entries that fail their
+// checksum are skipped and listed in the result rather than failing the
+// load. A missing file is not an error; it simply loads nothing.
+func loadSnapshotFile(path string, nr *namespaceRegistry, kr *keyRing) (snapshotLoad, error) {
+	return readSnapshotFile(path, kr, func(e snapshotEntry) error {
+		ns := nr.def
+		if e.NS != "" {
+			ns = nr.get(e.NS, true)
+		}
+		if err := ns.store.Set(e.Key, e.Value); err != nil {
+			return err
+		}
+		ns.tags.set(e.Key, e.Tags)
+		ns.expiries.set(e.Key, e.Expiry)
+		return nil
+	})
+}
+
+// readSnapshotFile decodes the snapshot file at path, calling fn with
+// every entry whose checksum holds once the file has been read in full and
+// checked.
+func readSnapshotFile(path string, kr *keyRing, fn func(e snapshotEntry) error) (snapshotLoad, error) {
+	var res snapshotLoad
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if magic, _ := r.(*bufio.Reader).Peek(len(encMagic)); isEncrypted(magic) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return res, err
+		}
+		plain, id, err := kr.open(data)
+		res.KeyID = id
+		if err != nil {
+			return res, err
+		}
+		r = bytes.NewReader(plain)
+	}
+	err = readSnapshot(path, r, fn, &res)
+	return res, err
+}
+
+// snapshotLine is a line of a data file past its header: an entry or the
+// trailer.
+type snapshotLine struct {
+	snapshotEntry
+	snapshotTrailer
+}
+
+// readSnapshot decodes the lines of a data file from r and passes its
+// entries to fn. Entries carrying a CRC that does not match their value
+// are not passed on; their keys are listed in res instead.
+//
+// A file that starts with a header must be in a format version this
+// server knows and end with a trailer whose count matches what came
+// before it, or none of it is passed on: entries are held back until the
+// trailer has been checked. The trailer's checksum covers corrupted
+// entries too, so it is only held against a file without any; one with
+// them is loaded without them. A file without a header is from before
+// formats were versioned and is read as plain entries.
+func readSnapshot(path string, r io.Reader, fn func(e snapshotEntry) error, res *snapshotLoad) error {
+	br := bufio.NewReader(r)
+	line, rerr := br.ReadBytes('\n')
+	var hdr snapshotHeader
+	if json.Unmarshal(line, &hdr) == nil && hdr.Format != "" {
+		if hdr.Format != snapshotFormat {
+			return fmt.Errorf("%s: not a data file: format %q", path, hdr.Format)
+		}
+		if hdr.Version < 1 || hdr.Version > snapshotVersion {
+			return fmt.Errorf("%s: %w %d; this server reads versions up to %d", path, errSnapshotVersion, hdr.Version, snapshotVersion)
+		}
+		res.Version, res.Created = hdr.Version, hdr.Created
+		if rerr != nil {
+			return fmt.Errorf("%s: truncated: no trailer", path)
+		}
+		if hdr.Version >= 2 {
+			codec, err := persistCodecFor(hdr.Codec)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			res.Codec = codec.Name()
+			return readSnapshotRecords(path, codec.NewDecoder(br), fn, res)
+		}
+		line, rerr = br.ReadBytes('\n')
+	}
+	res.Codec = persistJSON
+
+	h := sha256.New()
+	var trailer *snapshotTrailer
+	var staged []snapshotEntry
+	for n := 1; ; n++ {
+		if rerr != nil && rerr != io.EOF {
+			return fmt.Errorf("%s: %w", path, rerr)
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			if trailer != nil {
+				return fmt.Errorf("%s: data after the trailer", path)
+			}
+			var l snapshotLine
+			if err := json.Unmarshal(line, &l); err != nil {
+				return fmt.Errorf("%s: entry %d: %w", path, n, err)
+			}
+			switch {
+			case l.End && res.Version > 0:
+				trailer = &l.snapshotTrailer
+			case !l.intact():
+				h.Write(line)
+				res.Corrupt = append(res.Corrupt, l.Key)
+			default:
+				h.Write(line)
+				staged = append(staged, snapshotEntry{Key: l.Key, Value: l.Value, Tags: l.Tags, Expiry: l.Expiry})
+				res.Keys++
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		line, rerr = br.ReadBytes('\n')
+	}
+	if res.Version > 0 {
+		if err := checkTrailer(path, h.Sum(nil), trailer, res); err != nil {
+			return err
+		}
+	}
+	return commitSnapshot(staged, fn)
+}
+
+// checkTrailer checks the trailer of a versioned data file, nil if there
+// was none, against the entries read before it and, unless some were
+// corrupted and so already account for a mismatch, the checksum of them.
+func checkTrailer(path string, sum []byte, trailer *snapshotTrailer, res *snapshotLoad) error {
+	if trailer == nil {
+		return fmt.Errorf("%s: truncated: no trailer after %d entries", path, res.Keys+len(res.Corrupt))
+	}
+	if got := res.Keys + len(res.Corrupt); got != trailer.Keys {
+		return fmt.Errorf("%s: holds %d entries, the trailer says %d", path, got, trailer.Keys)
+	}
+	if hex.EncodeToString(sum) != trailer.SHA256 && len(res.Corrupt) == 0 {
+		return fmt.Errorf("%s: entries do not match the checksum in the trailer", path)
+	}
+	return nil
+}
+
+// commitSnapshot passes the entries of a data file that checked out to fn.
+func commitSnapshot(staged []snapshotEntry, fn func(e snapshotEntry) error) error {
+	for _, e := range staged {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSnapshotRecords is readSnapshot for the records of a version 2 file,
+// read by dec.
+func readSnapshotRecords(path string, dec PersistDecoder, fn func(e snapshotEntry) error, res *snapshotLoad) error {
+	h := sha256.New()
+	var trailer *snapshotTrailer
+	var staged []snapshotEntry
+	for n := 1; ; n++ {
+		var rec PersistRecord
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%s: truncated in entry %d", path, n)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: entry %d: %w", path, n, err)
+		}
+		if trailer != nil {
+			return fmt.Errorf("%s: data after the trailer", path)
+		}
+		if rec.End {
+			trailer = &snapshotTrailer{End: true, Keys: rec.Keys, SHA256: rec.SHA256}
+			continue
+		}
+		entryDigest(h, &rec)
+		if e := (snapshotEntry{Key: rec.Key, Value: rec.Value, CRC: rec.CRC}); !e.intact() {
+			res.Corrupt = append(res.Corrupt, rec.Key)
+			continue
+		}
+		if rec.NS != "" && (res.Version < 3 || !namespaceNameRE.MatchString(rec.NS)) {
+			return fmt.Errorf("%s: entry %d: invalid namespace %q", path, n, rec.NS)
+		}
+		if rec.NS == defaultNamespace {
+			rec.NS = ""
+		}
+		if rec.NS != "" && !slices.Contains(res.Namespaces, rec.NS) {
+			res.Namespaces = append(res.Namespaces, rec.NS)
+		}
+		staged = append(staged, snapshotEntry{NS: rec.NS, Key: rec.Key, Value: rec.Value, Tags: rec.Tags, Expiry: rec.expiry()})
+		res.Keys++
+	}
+	if err := checkTrailer(path, h.Sum(nil), trailer, res); err != nil {
+		return err
+	}
+	return commitSnapshot(staged, fn)
+}
+
+// SnapshotInfo describes a data file checked by VerifySnapshotFile.
+type SnapshotInfo struct {
+	Path string `json:"path"`
+	// Version is the format version of the file, 0 for a file written
+	// before formats were versioned.
+	Version int       `json:"format_version"`
+	Created time.Time `json:"created"`
+	// Codec is the PersistCodec the file's entries are in.
+	Codec   string   `json:"codec,omitempty"`
+	KeyID   string   `json:"key_id,omitempty"`
+	Keys    int      `json:"keys"`
+	Corrupt []string `json:"corrupt"`
+	// Namespaces names the namespaces besides the default one the file
+	// holds keys of.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// VerifySnapshotFile reads the data file at path as a server starting on
+// it would, without loading it anywhere, and describes it. The error
+// says why a server would refuse the file; corrupted entries, which it
+// would skip, are listed in the result instead. keyFile and key are the
+// encryption keys a server would be given, needed only to read an
+// encrypted file.
+func VerifySnapshotFile(path, keyFile, key string) (SnapshotInfo, error) {
+	info := SnapshotInfo{Path: path, Corrupt: []string{}}
+	if _, err := os.Stat(path); err != nil {
+		return info, err
+	}
+	kr, err := loadKeyRing(keyFile, key)
+	if err != nil {
+		return info, fmt.Errorf("load encryption keys: %w", err)
+	}
+	res, err := readSnapshotFile(path, kr, func(snapshotEntry) error { return nil })
+	info.Version, info.Created, info.KeyID, info.Keys = res.Version, res.Created, res.KeyID, res.Keys
+	info.Codec, info.Namespaces = res.Codec, res.Namespaces
+	info.Corrupt = append(info.Corrupt, res.Corrupt...)
+	return info, err
+}
+
+// ConvertSnapshotFile rewrites the data file at path in the persistence
+// codec named codec, as a server configured with it would when next
+// saving the file, and describes the file as it was. The file is
+// encrypted again if it was, with the primary of the keys keyFile and key
+// give. A file holding corrupted entries is left alone, since converting
+// it would drop them, and so is one a running server holds.
+func ConvertSnapshotFile(path, codec, keyFile, key string) (SnapshotInfo, error) {
+	info := SnapshotInfo{Path: path, Corrupt: []string{}}
+	c, err := persistCodecFor(codec)
+	if err != nil {
+		return info, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return info, err
+	}
+	lock, err := lockDataFile(path)
+	if err != nil {
+		return info, err
+	}
+	defer lock.Close()
+	kr, err := loadKeyRing(keyFile, key)
+	if err != nil {
+		return info, fmt.Errorf("load encryption keys: %w", err)
+	}
+	var entries []snapshotEntry
+	res, err := readSnapshotFile(path, kr, func(e snapshotEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	info.Version, info.Created, info.KeyID, info.Keys = res.Version, res.Created, res.KeyID, res.Keys
+	info.Codec = res.Codec
+	info.Corrupt = append(info.Corrupt, res.Corrupt...)
+	if err != nil {
+		return info, err
+	}
+	if len(res.Corrupt) > 0 {
+		return info, fmt.Errorf("%s: %d corrupted entries would be lost", path, len(res.Corrupt))
+	}
+	if res.KeyID == "" {
+		kr = nil
+	}
+	_, err = saveSnapshotFile(path, entrySnapshots(entries), kr, c)
+	return info, err
+}
+
+// entrySnapshots groups entries read from a data file into a snapshot of
+// each namespace they belong to, the default one first, as
+// saveSnapshotFile takes them.
+func entrySnapshots(entries []snapshotEntry) []*Snapshot {
+	type group struct {
+		data     map[string]string
+		tags     map[string][]string
+		expiries map[string]keyExpiry
+	}
+	groups := map[string]*group{"": {data: map[string]string{}, tags: map[string][]string{}, expiries: map[string]keyExpiry{}}}
+	names := []string{""}
+	for _, e := range entries {
+		g := groups[e.NS]
+		if g == nil {
+			g = &group{data: map[string]string{}, tags: map[string][]string{}, expiries: map[string]keyExpiry{}}
+			groups[e.NS] = g
+			names = append(names, e.NS)
+		}
+		g.data[e.Key] = e.Value
+		if len(e.Tags) > 0 {
+			g.tags[e.Key] = e.Tags
+		}
+		if e.Expiry != nil {
+			g.expiries[e.Key] = *e.Expiry
+		}
+	}
+	snaps := make([]*Snapshot, 0, len(names))
+	for _, name := range names {
+		g := groups[name]
+		snap := NewSnapshot(g.data)
+		snap.ns, snap.tags, snap.expiries = name, g.tags, g.expiries
+		snaps = append(snaps, snap)
+	}
+	return snaps
+}
@@ -0,0 +1,500 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Persistence codecs built in, by the names Config.PersistCodec takes.
+const (
+	persistJSON     = "json"
+	persistGob      = "gob"
+	persistProtobuf = "protobuf"
+	persistBinary   = "binary"
+)
+
+// PersistRecord is a record of a data file or of the write-ahead log: an
+// entry of a data file (Key, Value, CRC, Tags and the expiry), its trailer
+// (End, Keys and SHA256), a mutation of a log segment (Time, Op, NS, Key,
+// Value, Tags and the expiry) or a key of a log snapshot (NS, Key, Value,
+// Tags and the expiry). The expiry is Expires, TTL and Sliding, all zero
+// for a key that does not expire.
+type PersistRecord struct {
+	Time   time.Time `json:"time,omitzero"`
+	Op     string    `json:"op,omitempty"`
+	NS     string    `json:"ns,omitempty"`
+	Key    string    `json:"key,omitempty"`
+	Value  string    `json:"value,omitempty"`
+	CRC    string    `json:"crc,omitempty"`
+	End    bool      `json:"end,omitempty"`
+	Keys   int       `json:"keys,omitempty"`
+	SHA256 string    `json:"sha256,omitempty"`
+	Tags   []string  `json:"tags,omitempty"`
+
+	Expires time.Time     `json:"expires,omitzero"`
+	TTL     time.Duration `json:"ttl,omitempty"`
+	Sliding bool          `json:"sliding,omitempty"`
+}
+
+// expiry returns the expiry rec carries, nil if none.
+func (rec *PersistRecord) expiry() *keyExpiry {
+	if rec.Expires.IsZero() {
+		return nil
+	}
+	return &keyExpiry{At: rec.Expires, TTL: rec.TTL, Sliding: rec.Sliding}
+}
+
+// setExpiry makes rec carry e, if it is not nil.
+func (rec *PersistRecord) setExpiry(e *keyExpiry) {
+	if e != nil {
+		rec.Expires, rec.TTL, rec.Sliding = e.At, e.TTL, e.Sliding
+	}
+}
+
+// PersistCodec encodes the records of data files and write-ahead log files.
+// The codec a file was written with is named in its header, so files of
+// any registered codec are read whatever Config.PersistCodec is, and data
+// files are rewritten in the configured codec when next saved.
+type PersistCodec interface {
+	// Name is how Config.PersistCodec and file headers name the codec.
+	Name() string
+	NewEncoder(w io.Writer) PersistEncoder
+	NewDecoder(r io.Reader) PersistDecoder
+}
+
+// PersistEncoder writes records in a codec's format. Each Encode writes
+// the whole record, so a log flushed after it holds every record encoded.
+type PersistEncoder interface {
+	Encode(rec *PersistRecord) error
+}
+
+// PersistDecoder reads records written by the matching PersistEncoder.
+// Decode returns io.EOF after the last record, and io.ErrUnexpectedEOF for
+// one cut short, as a crash while it was written leaves it.
+type PersistDecoder interface {
+	Decode(rec *PersistRecord) error
+}
+
+var persistCodecs = struct {
+	sync.RWMutex
+	byName map[string]PersistCodec
+}{byName: map[string]PersistCodec{
+	persistJSON:     jsonPersistCodec{},
+	persistGob:      gobPersistCodec{},
+	persistProtobuf: protobufPersistCodec{},
+	persistBinary:   binaryPersistCodec{},
+}}
+
+// RegisterPersistCodec makes c available to Config.PersistCodec and to the
+// reading of files written with it. It replaces a codec of the same name,
+// built-in ones included.
+func RegisterPersistCodec(c PersistCodec) {
+	persistCodecs.Lock()
+	defer persistCodecs.Unlock()
+	persistCodecs.byName[c.Name()] = c
+}
+
+// persistCodecFor returns the codec named name, JSON for "".
+func persistCodecFor(name string) (PersistCodec, error) {
+	if name == "" {
+		name = persistJSON
+	}
+	persistCodecs.RLock()
+	defer persistCodecs.RUnlock()
+	if c, ok := persistCodecs.byName[name]; ok {
+		return c, nil
+	}
+	names := make([]string, 0, len(persistCodecs.byName))
+	for n := range persistCodecs.byName {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown persistence codec %q; have %v", name, names)
+}
+
+// jsonPersistCodec writes a record per line, as data files and the log
+// were written before codecs could be chosen.
+type jsonPersistCodec struct{}
+
+func (jsonPersistCodec) Name() string { return persistJSON }
+
+func (jsonPersistCodec) NewEncoder(w io.Writer) PersistEncoder {
+	return jsonPersistEncoder{json.NewEncoder(w)}
+}
+
+func (jsonPersistCodec) NewDecoder(r io.Reader) PersistDecoder {
+	return jsonPersistDecoder{json.NewDecoder(r)}
+}
+
+type jsonPersistEncoder struct{ enc *json.Encoder }
+
+func (e jsonPersistEncoder) Encode(rec *PersistRecord) error { return e.enc.Encode(rec) }
+
+type jsonPersistDecoder struct{ dec *json.Decoder }
+
+func (d jsonPersistDecoder) Decode(rec *PersistRecord) error {
+	*rec = PersistRecord{}
+	return d.dec.Decode(rec)
+}
+
+// gobPersistCodec writes a gob stream of records; the type is described
+// once, at the start of the file.
+type gobPersistCodec struct{}
+
+func (gobPersistCodec) Name() string { return persistGob }
+
+func (gobPersistCodec) NewEncoder(w io.Writer) PersistEncoder {
+	return gobPersistEncoder{gob.NewEncoder(w)}
+}
+
+func (gobPersistCodec) NewDecoder(r io.Reader) PersistDecoder {
+	return gobPersistDecoder{gob.NewDecoder(r)}
+}
+
+type gobPersistEncoder struct{ enc *gob.Encoder }
+
+func (e gobPersistEncoder) Encode(rec *PersistRecord) error { return e.enc.Encode(rec) }
+
+type gobPersistDecoder struct{ dec *gob.Decoder }
+
+func (d gobPersistDecoder) Decode(rec *PersistRecord) error {
+	*rec = PersistRecord{}
+	return d.dec.Decode(rec)
+}
+
+// Field numbers of a record in the protobuf codec:
+//
+//	message Record {
+//	  int64 time = 1; // Unix nanoseconds, 0 for none
+//	  string op = 2;
+//	  string ns = 3;
+//	  string key = 4;
+//	  bytes value = 5;
+//	  string crc = 6;
+//	  bool end = 7;
+//	  int64 keys = 8;
+//	  string sha256 = 9;
+//	  repeated string tags = 10;
+//	  int64 expires = 11; // Unix nanoseconds, 0 for none
+//	  int64 ttl = 12;     // nanoseconds
+//	  bool sliding = 13;
+//	}
+const (
+	pbTime protowire.Number = iota + 1
+	pbOp
+	pbNS
+	pbKey
+	pbValue
+	pbCRC
+	pbEnd
+	pbKeys
+	pbSHA256
+	pbTags
+	pbExpires
+	pbTTL
+	pbSliding
+)
+
+// protobufPersistCodec writes each record as the Record message above,
+// prefixed with its length as a varint, as protodelim does.
+type protobufPersistCodec struct{}
+
+func (protobufPersistCodec) Name() string { return persistProtobuf }
+
+func (protobufPersistCodec) NewEncoder(w io.Writer) PersistEncoder {
+	return &framedEncoder{w: w, marshal: marshalRecordProto}
+}
+
+func (protobufPersistCodec) NewDecoder(r io.Reader) PersistDecoder {
+	return &framedDecoder{r: bufio.NewReader(r), unmarshal: unmarshalRecordProto}
+}
+
+func marshalRecordProto(b []byte, rec *PersistRecord) []byte {
+	str := func(b []byte, n protowire.Number, s string) []byte {
+		if s == "" {
+			return b
+		}
+		return protowire.AppendString(protowire.AppendTag(b, n, protowire.BytesType), s)
+	}
+	if !rec.Time.IsZero() {
+		b = protowire.AppendVarint(protowire.AppendTag(b, pbTime, protowire.VarintType), uint64(rec.Time.UnixNano()))
+	}
+	b = str(b, pbOp, rec.Op)
+	b = str(b, pbNS, rec.NS)
+	b = str(b, pbKey, rec.Key)
+	b = str(b, pbValue, rec.Value)
+	b = str(b, pbCRC, rec.CRC)
+	if rec.End {
+		b = protowire.AppendVarint(protowire.AppendTag(b, pbEnd, protowire.VarintType), 1)
+	}
+	if rec.Keys != 0 {
+		b = protowire.AppendVarint(protowire.AppendTag(b, pbKeys, protowire.VarintType), uint64(rec.Keys))
+	}
+	b = str(b, pbSHA256, rec.SHA256)
+	for _, t := range rec.Tags {
+		b = protowire.AppendString(protowire.AppendTag(b, pbTags, protowire.BytesType), t)
+	}
+	if !rec.Expires.IsZero() {
+		b = protowire.AppendVarint(protowire.AppendTag(b, pbExpires, protowire.VarintType), uint64(rec.Expires.UnixNano()))
+	}
+	if rec.TTL != 0 {
+		b = protowire.AppendVarint(protowire.AppendTag(b, pbTTL, protowire.VarintType), uint64(rec.TTL))
+	}
+	if rec.Sliding {
+		b = protowire.AppendVarint(protowire.AppendTag(b, pbSliding, protowire.VarintType), 1)
+	}
+	return b
+}
+
+func unmarshalRecordProto(b []byte, rec *PersistRecord) error {
+	*rec = PersistRecord{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case pbTime:
+				rec.Time = time.Unix(0, int64(v)).UTC()
+			case pbEnd:
+				rec.End = v != 0
+			case pbKeys:
+				rec.Keys = int(v)
+			case pbExpires:
+				rec.Expires = time.Unix(0, int64(v)).UTC()
+			case pbTTL:
+				rec.TTL = time.Duration(v)
+			case pbSliding:
+				rec.Sliding = v != 0
+			}
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case pbOp:
+				rec.Op = string(v)
+			case pbNS:
+				rec.NS = string(v)
+			case pbKey:
+				rec.Key = string(v)
+			case pbValue:
+				rec.Value = string(v)
+			case pbCRC:
+				rec.CRC = string(v)
+			case pbSHA256:
+				rec.SHA256 = string(v)
+			case pbTags:
+				rec.Tags = append(rec.Tags, string(v))
+			}
+		default:
+			// Fields of a newer writer are skipped.
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// binaryPersistCodec is the most compact codec: each record is its length
+// as a varint, then a flags byte, the time as a varint if flagged, the
+// string fields as a varint length and their bytes, and the trailer's key
+// count. It does not describe itself, so fields added since follow the
+// key count, each only if flagged: the tags, as their number and each
+// tag like a string field, then the expiry, as its deadline in Unix
+// nanoseconds and its TTL as varints, with whether it slides a flag of
+// its own. Readers that predate a field ignore its flag and the bytes
+// after the key count.
+type binaryPersistCodec struct{}
+
+func (binaryPersistCodec) Name() string { return persistBinary }
+
+func (binaryPersistCodec) NewEncoder(w io.Writer) PersistEncoder {
+	return &framedEncoder{w: w, marshal: marshalRecordBinary}
+}
+
+func (binaryPersistCodec) NewDecoder(r io.Reader) PersistDecoder {
+	return &framedDecoder{r: bufio.NewReader(r), unmarshal: unmarshalRecordBinary}
+}
+
+const (
+	binaryFlagTime = 1 << iota
+	binaryFlagEnd
+	binaryFlagTags
+	binaryFlagExpiry
+	binaryFlagSliding
+)
+
+func marshalRecordBinary(b []byte, rec *PersistRecord) []byte {
+	var flags byte
+	if !rec.Time.IsZero() {
+		flags |= binaryFlagTime
+	}
+	if rec.End {
+		flags |= binaryFlagEnd
+	}
+	if len(rec.Tags) > 0 {
+		flags |= binaryFlagTags
+	}
+	if !rec.Expires.IsZero() {
+		flags |= binaryFlagExpiry
+		if rec.Sliding {
+			flags |= binaryFlagSliding
+		}
+	}
+	b = append(b, flags)
+	if flags&binaryFlagTime != 0 {
+		b = binary.AppendVarint(b, rec.Time.UnixNano())
+	}
+	for _, s := range []string{rec.Op, rec.NS, rec.Key, rec.Value, rec.CRC, rec.SHA256} {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	b = binary.AppendUvarint(b, uint64(rec.Keys))
+	if flags&binaryFlagTags != 0 {
+		b = binary.AppendUvarint(b, uint64(len(rec.Tags)))
+		for _, t := range rec.Tags {
+			b = binary.AppendUvarint(b, uint64(len(t)))
+			b = append(b, t...)
+		}
+	}
+	if flags&binaryFlagExpiry != 0 {
+		b = binary.AppendVarint(b, rec.Expires.UnixNano())
+		b = binary.AppendVarint(b, int64(rec.TTL))
+	}
+	return b
+}
+
+var errBadRecord = errors.New("malformed record")
+
+// maxRecordSize bounds the length a framed record may claim, so that a
+// corrupted length is refused rather than allocated.
+const maxRecordSize = 1 << 30
+
+func unmarshalRecordBinary(b []byte, rec *PersistRecord) error {
+	*rec = PersistRecord{}
+	if len(b) == 0 {
+		return errBadRecord
+	}
+	flags := b[0]
+	b = b[1:]
+	if flags&binaryFlagTime != 0 {
+		t, n := binary.Varint(b)
+		if n <= 0 {
+			return errBadRecord
+		}
+		rec.Time, b = time.Unix(0, t).UTC(), b[n:]
+	}
+	rec.End = flags&binaryFlagEnd != 0
+	str := func(s *string) bool {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return false
+		}
+		*s, b = string(b[n:n+int(l)]), b[n+int(l):]
+		return true
+	}
+	for _, s := range []*string{&rec.Op, &rec.NS, &rec.Key, &rec.Value, &rec.CRC, &rec.SHA256} {
+		if !str(s) {
+			return errBadRecord
+		}
+	}
+	keys, n := binary.Uvarint(b)
+	if n <= 0 {
+		return errBadRecord
+	}
+	rec.Keys, b = int(keys), b[n:]
+	if flags&binaryFlagTags != 0 {
+		count, n := binary.Uvarint(b)
+		// Every tag takes at least its length byte.
+		if n <= 0 || uint64(len(b)-n) < count {
+			return errBadRecord
+		}
+		b = b[n:]
+		rec.Tags = make([]string, count)
+		for i := range rec.Tags {
+			if !str(&rec.Tags[i]) {
+				return errBadRecord
+			}
+		}
+	}
+	if flags&binaryFlagExpiry != 0 {
+		at, n := binary.Varint(b)
+		if n <= 0 {
+			return errBadRecord
+		}
+		ttl, m := binary.Varint(b[n:])
+		if m <= 0 {
+			return errBadRecord
+		}
+		rec.Expires, rec.TTL, b = time.Unix(0, at).UTC(), time.Duration(ttl), b[n+m:]
+		rec.Sliding = flags&binaryFlagSliding != 0
+	}
+	return nil
+}
+
+// framedEncoder writes each record marshaled by marshal, prefixed with
+// its length as a varint.
+type framedEncoder struct {
+	w       io.Writer
+	buf     []byte
+	marshal func(b []byte, rec *PersistRecord) []byte
+}
+
+func (e *framedEncoder) Encode(rec *PersistRecord) error {
+	body := e.marshal(e.buf[:0], rec)
+	frame := binary.AppendUvarint(make([]byte, 0, len(body)+binary.MaxVarintLen64), uint64(len(body)))
+	e.buf = body
+	_, err := e.w.Write(append(frame, body...))
+	return err
+}
+
+// framedDecoder reads the records of a framedEncoder.
+type framedDecoder struct {
+	r         *bufio.Reader
+	buf       []byte
+	unmarshal func(b []byte, rec *PersistRecord) error
+}
+
+func (d *framedDecoder) Decode(rec *PersistRecord) error {
+	l, err := binary.ReadUvarint(d.r)
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if l > maxRecordSize {
+		return errBadRecord
+	}
+	if cap(d.buf) < int(l) {
+		d.buf = make([]byte, l)
+	}
+	d.buf = d.buf[:l]
+	if _, err := io.ReadFull(d.r, d.buf); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	return d.unmarshal(d.buf, rec)
+}
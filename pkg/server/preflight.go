@@ -0,0 +1,417 @@
+package server
+
+import (
+	"cmp"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Levels of a PreflightCheck.
+const (
+	PreflightError   = "error"
+	PreflightWarning = "warning"
+)
+
+const (
+	// minClockYear is the earliest year the system clock may read: one
+	// before it has never been set.
+	minClockYear = 2020
+	// maxFileSkew is how far in the future a data file may have been
+	// modified before the clock is suspected to have gone back.
+	maxFileSkew = time.Hour
+)
+
+// PreflightCheck is the outcome of one of the checks Preflight runs.
+type PreflightCheck struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	// Level is PreflightError for a check the server cannot start without
+	// passing, or PreflightWarning.
+	Level  string `json:"level"`
+	Detail string `json:"detail,omitempty"`
+	// Fix says what to do about a failed check.
+	Fix string `json:"fix,omitempty"`
+}
+
+func (c PreflightCheck) String() string {
+	if c.OK {
+		return "ok: " + c.Name
+	}
+	s := c.Level + ": " + c.Name + ": " + c.Detail
+	if c.Fix != "" {
+		s += " (" + c.Fix + ")"
+	}
+	return s
+}
+
+// PreflightFailed returns an error listing the checks of checks that
+// failed with PreflightError, or nil if none did.
+func PreflightFailed(checks []PreflightCheck) error {
+	var errs []error
+	for _, c := range checks {
+		if !c.OK && c.Level == PreflightError {
+			errs = append(errs, errors.New(c.String()))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d pre-flight checks failed:\n%w", len(errs), len(checks), errors.Join(errs...))
+}
+
+// Preflight checks that cfg is consistent and what a server with it needs
+// from its host before it starts: that every listen address is free and configured once, that no
+// other server holds the data file or is registered under this instance's
+// ID, that the clock is plausible, that the directories written to are
+// writable and that the TLS key pair loads. It changes nothing, so that
+// it can be run against a live deployment, and finds the problems that
+// would otherwise stop New or Start, or a running server when it first
+// saves its data.
+func Preflight(cfg Config) []PreflightCheck {
+	var checks []PreflightCheck
+	add := func(c PreflightCheck) {
+		if c.Level == "" {
+			c.Level = PreflightError
+		}
+		checks = append(checks, c)
+	}
+
+	c := PreflightCheck{Name: "configuration", OK: true}
+	if err := validateConfig(cfg); err != nil {
+		c.OK, c.Detail, c.Fix = false, err.Error(), "correct the flags; -h lists them"
+	}
+	add(c)
+
+	// A process started by Upgrade inherits its sockets and the lock on
+	// the data file from one that is still serving.
+	if !upgrading() {
+		for _, c := range preflightListen(cfg) {
+			add(c)
+		}
+		if cfg.DataFile != "" {
+			add(preflightDataLock(cfg.DataFile))
+		}
+	}
+	for _, c := range preflightClock(cfg) {
+		add(c)
+	}
+	for _, c := range preflightWritable(cfg) {
+		add(c)
+	}
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		c := PreflightCheck{Name: "TLS key pair", OK: true}
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey); err != nil {
+			c.OK, c.Detail, c.Fix = false, err.Error(), "point -tls-cert and -tls-key at a readable PEM certificate and its key"
+		}
+		add(c)
+	}
+	if cfg.RegistrationFile != "" {
+		add(preflightRegistration(cfg))
+	}
+	return checks
+}
+
+// preflightListen checks each address the server listens on by listening
+// on it briefly, or for a Unix socket by connecting to it.
+func preflightListen(cfg Config) []PreflightCheck {
+	type spec struct{ name, flag, addr string }
+	specs := []spec{{"http", "-addr", cfg.Addr}}
+	for _, addr := range cfg.ExtraAddrs {
+		specs = append(specs, spec{"http", "-listen", addr})
+	}
+	if cfg.AdminAddr != "" {
+		specs = append(specs, spec{"admin", "-admin-addr", cfg.AdminAddr})
+	}
+	if cfg.GRPCAddr != "" {
+		specs = append(specs, spec{"gRPC", "-grpc-addr", cfg.GRPCAddr})
+	}
+	if cfg.RedisAddr != "" {
+		specs = append(specs, spec{"Redis", "-redis-addr", cfg.RedisAddr})
+	}
+
+	var out []PreflightCheck
+	seen := make(map[string]string)
+	// Listeners are held until every address is tried, so that overlapping
+	// ones, such as ":8080" and "127.0.0.1:8080", fail as they would in
+	// Start.
+	var held []net.Listener
+	defer func() {
+		for _, ln := range held {
+			ln.Close()
+		}
+	}()
+	for _, sp := range specs {
+		c := PreflightCheck{Name: fmt.Sprintf("%s listen address %s", sp.name, sp.addr), OK: true}
+		key := listenKey(sp.addr)
+		if prev, dup := seen[key]; dup && key != "" {
+			c.OK, c.Detail = false, "also given to "+prev
+			c.Fix = "give " + sp.flag + " an address no other listener uses"
+			out = append(out, c)
+			continue
+		}
+		seen[key] = sp.flag
+		if path, ok := strings.CutPrefix(sp.addr, unixPrefix); ok {
+			if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+				conn.Close()
+				c.OK, c.Detail = false, "a process is already serving on the socket"
+				c.Fix = "stop it, or give " + sp.flag + " another socket path"
+			} else if _, err := os.Stat(filepath.Dir(path)); err != nil {
+				c.OK, c.Detail, c.Fix = false, err.Error(), "create the socket's directory"
+			}
+		} else if ln, err := net.Listen("tcp", sp.addr); err != nil {
+			c.OK, c.Detail = false, err.Error()
+			c.Fix = "stop the process using the port, or give " + sp.flag + " another address"
+			if errors.Is(err, os.ErrPermission) {
+				c.Fix = "ports below 1024 need privileges: give " + sp.flag + " a higher port"
+			}
+		} else {
+			held = append(held, ln)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// listenKey returns what identifies addr among the listeners, so that
+// "localhost:8080" and "127.0.0.1:8080" are told apart but ":8080" and
+// "0.0.0.0:8080" are not. Port 0, which picks a free port, has none.
+func listenKey(addr string) string {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		return "unix:" + filepath.Clean(path)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "0" {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = ""
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// preflightDataLock checks that no other server has the data file locked.
+func preflightDataLock(path string) PreflightCheck {
+	c := PreflightCheck{Name: "lock on data file " + path, OK: true}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return c
+	} else if err != nil {
+		c.OK, c.Detail, c.Fix = false, err.Error(), "let the server's user read and write "+path+".lock"
+		return c
+	}
+	defer f.Close()
+	if err := tryLock(f); errors.Is(err, errLocked) {
+		c.OK, c.Detail = false, "in use by another server"+lockHolder(f)
+		c.Fix = "stop it, or give this one another -data-file"
+	}
+	return c
+}
+
+// preflightClock checks that the clock has been set, and warns of files
+// written after what it reads now, as left by a clock that went back.
+func preflightClock(cfg Config) []PreflightCheck {
+	now := time.Now()
+	c := PreflightCheck{Name: "system clock", OK: true}
+	if now.Year() < minClockYear {
+		c.OK, c.Detail = false, "reads "+now.UTC().Format(time.RFC3339)
+		c.Fix = "set the clock, for example by enabling NTP; expiry, tokens and signed requests depend on it"
+	}
+	out := []PreflightCheck{c}
+	for _, path := range []string{cfg.DataFile, cfg.StoragePath} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().Sub(now) <= maxFileSkew {
+			continue
+		}
+		out = append(out, PreflightCheck{
+			Name:   "modification time of " + path,
+			Level:  PreflightWarning,
+			Detail: fmt.Sprintf("%s is in the future, by %s", fi.ModTime().UTC().Format(time.RFC3339), fi.ModTime().Sub(now).Round(time.Second)),
+			Fix:    "check the clock; keys would expire late and snapshots sort out of order",
+		})
+	}
+	return out
+}
+
+// preflightWritable checks that the server can create files where it
+// writes them: next to each file it writes, and in each directory it
+// writes to, or the closest parent that exists, as those are created.
+func preflightWritable(cfg Config) []PreflightCheck {
+	type spec struct {
+		flag, path string
+		dir        bool
+	}
+	specs := []spec{
+		{"-data-file", cfg.DataFile, false},
+		{"-storage-path", cfg.StoragePath, false},
+		{"-shadow-storage-path", cfg.ShadowStoragePath, false},
+		{"-audit-file", cfg.AuditFile, false},
+		{"-record-file", cfg.RecordFile, false},
+		{"-token-revocation-file", cfg.TokenRevocationFile, false},
+		{"-register-file", cfg.RegistrationFile, false},
+		{"-wal-dir", cfg.WALDir, true},
+		{"-raft-dir", cfg.RaftDir, true},
+		{"-diagnostics-dir", cfg.DiagnosticsDir, true},
+	}
+	var out []PreflightCheck
+	seen := make(map[string]bool)
+	for _, sp := range specs {
+		if sp.path == "" {
+			continue
+		}
+		dir := sp.path
+		if !sp.dir {
+			dir = filepath.Dir(sp.path)
+		}
+		c := PreflightCheck{Name: "writable directory " + dir + " (" + sp.flag + ")", OK: true}
+		if sp.dir {
+			for {
+				if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+					break
+				}
+				dir = filepath.Dir(dir)
+			}
+		}
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if fi, err := os.Stat(dir); err != nil {
+			c.OK, c.Detail, c.Fix = false, err.Error(), "create the directory, or point "+sp.flag+" elsewhere"
+		} else if !fi.IsDir() {
+			c.OK, c.Detail, c.Fix = false, dir+" is not a directory", "point "+sp.flag+" elsewhere"
+		} else if f, err := os.CreateTemp(dir, ".kv-preflight-*"); err != nil {
+			c.OK, c.Detail, c.Fix = false, err.Error(), "let the server's user write to "+dir+", or point "+sp.flag+" elsewhere"
+		} else {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// preflightRegistration checks that no other live instance is listed in
+// the registration file under the ID this one would register as. An entry
+// not refreshed for two intervals is taken as left by an instance that
+// crashed, and is replaced.
+func preflightRegistration(cfg Config) PreflightCheck {
+	id := preflightInstanceID(cfg)
+	c := PreflightCheck{Name: "registration of " + id + " in " + cfg.RegistrationFile, OK: true}
+	buf, err := os.ReadFile(cfg.RegistrationFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return c
+	} else if err != nil {
+		c.OK, c.Detail, c.Fix = false, err.Error(), "let the server's user read and write the file"
+		return c
+	}
+	instances := make(map[string]instanceRecord)
+	if len(strings.TrimSpace(string(buf))) > 0 {
+		if err := json.Unmarshal(buf, &instances); err != nil {
+			c.OK, c.Detail, c.Fix = false, err.Error(), "repair the file, or remove it to start a new one"
+			return c
+		}
+	}
+	rec, ok := instances[id]
+	interval := cmp.Or(cfg.RegistrationInterval, defaultRegistrationInterval)
+	if !ok || rec.PID == os.Getpid() || time.Since(rec.Updated) > 2*interval {
+		return c
+	}
+	c.OK = false
+	c.Detail = fmt.Sprintf("already registered by process %d at %s, last refreshed %s ago", rec.PID, rec.URL, time.Since(rec.Updated).Round(time.Second))
+	c.Fix = "stop that instance, or give this one another -node-id"
+	return c
+}
+
+// preflightInstanceID returns the ID instanceRecord would give the server
+// once listening, with the port it is configured with.
+func preflightInstanceID(cfg Config) string {
+	if cfg.NodeID != "" {
+		return cfg.NodeID
+	}
+	var host, port string
+	if cfg.AdvertiseURL != "" {
+		if u, err := url.Parse(cfg.AdvertiseURL); err == nil {
+			host, port = u.Hostname(), u.Port()
+		}
+	} else if h, p, err := net.SplitHostPort(cfg.Addr); err == nil {
+		host, port = h, p
+		if ip := net.ParseIP(h); h == "" || (ip != nil && ip.IsUnspecified()) {
+			host, _ = os.Hostname()
+		}
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		port = "0"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// validateConfig rejects settings that contradict each other or name no
+// valid choice, which New and Preflight can tell without opening anything.
+func validateConfig(cfg Config) error {
+	if _, err := persistCodecFor(cfg.PersistCodec); err != nil {
+		return err
+	}
+	switch cfg.Storage {
+	case "", storageMemory:
+	case storageSQLite, storageBolt:
+		if cfg.DataFile != "" {
+			return fmt.Errorf("the %s backend is durable by itself and cannot be combined with a data file", cfg.Storage)
+		}
+	default:
+		return fmt.Errorf("invalid storage backend %q", cfg.Storage)
+	}
+	if cfg.CacheStaleWhileRevalidate > 0 && cfg.CacheTTL <= 0 {
+		return errors.New("cache stale-while-revalidate needs a cache TTL")
+	}
+	if cfg.RaftDir != "" && cfg.ReplicaOf != "" {
+		return errors.New("a Raft cluster node cannot also be a replica")
+	}
+	if cfg.PromoteAfter > 0 && cfg.ReplicaOf == "" {
+		return errors.New("automatic promotion needs a primary to replicate from")
+	}
+	if cfg.PromoteAfter > 0 && cfg.PromoteAfter < 2*replHeartbeat {
+		return fmt.Errorf("promote-after must be at least %s, twice the replication heartbeat", 2*replHeartbeat)
+	}
+	switch cfg.ReadConsistency {
+	case "", readLocal, readLeader, readLinearizable:
+	default:
+		return fmt.Errorf("invalid read consistency %q", cfg.ReadConsistency)
+	}
+	switch cfg.WorkerLog {
+	case "", workerLogText, workerLogJSON, workerLogNone:
+	default:
+		return fmt.Errorf("invalid worker log format %q", cfg.WorkerLog)
+	}
+	if cfg.AdminAddr == "" && (cfg.Pprof || len(cfg.AdminAPIKeys) > 0) {
+		return errors.New("pprof and admin API keys require an admin listener")
+	}
+	if len(cfg.Alerts) > 0 && cfg.AlertURL == "" {
+		return errors.New("alert rules require an alert URL")
+	}
+	if _, err := newValueCodec(cfg.ValueCompression, cfg.ValueCompressionMin); err != nil {
+		return err
+	}
+	if _, err := parseResponseHeaders(cfg.Headers); err != nil {
+		return fmt.Errorf("invalid header: %w", err)
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return err
+	}
+	if _, err := newPriorities(cfg); err != nil {
+		return err
+	}
+	_, err := newRegistration(cfg)
+	return err
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultBatchShare is the share of a limit batch requests may use when
+// none is configured.
+const defaultBatchShare = 0.5
+
+// priorityClass is how urgent a request is, for shedding load.
+type priorityClass int
+
+const (
+	priorityInteractive priorityClass = iota // a client waiting on the answer, the default
+	priorityBatch                            // bulk work that can retry later
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"interactive", "batch"}
+
+func (c priorityClass) String() string { return priorityNames[c] }
+
+func parsePriority(v string) (priorityClass, bool) {
+	for c, name := range priorityNames {
+		if strings.EqualFold(v, name) {
+			return priorityClass(c), true
+		}
+	}
+	return priorityInteractive, false
+}
+
+// APIKeyPriorities gives the priority class of the requests of API keys,
+// by key name: "interactive" or "batch". It implements flag.Value as
+// "name=class".
+type APIKeyPriorities map[string]string
+
+func (f *APIKeyPriorities) String() string {
+	parts := make([]string, 0, len(*f))
+	for name, class := range *f {
+		parts = append(parts, name+"="+class)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f *APIKeyPriorities) Set(v string) error {
+	name, class, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("api key priority %q must be in name=class form", v)
+	}
+	if _, ok := parsePriority(class); !ok {
+		return fmt.Errorf("api key priority %q: class must be interactive or batch", v)
+	}
+	if *f == nil {
+		*f = make(APIKeyPriorities)
+	}
+	(*f)[name] = strings.ToLower(class)
+	return nil
+}
+
+// priorities classifies requests and counts them by class. A request is
+// of the class its API key is configured with, which it cannot override,
+// or else of the class it asks for with X-Priority. Keys are matched by
+// their secret, as requests are classified before they are authenticated,
+// so that an overloaded server sheds them before spending any work on
+// them.
+type priorities struct {
+	byToken map[string]priorityClass
+	share   float64
+
+	requests [numPriorities]atomic.Int64
+	shed     [numPriorities]atomic.Int64
+}
+
+func newPriorities(cfg Config) (*priorities, error) {
+	p := &priorities{byToken: make(map[string]priorityClass, len(cfg.APIKeyPriorities)), share: cfg.BatchShare}
+	if p.share <= 0 || p.share > 1 {
+		p.share = defaultBatchShare
+	}
+	for name, class := range cfg.APIKeyPriorities {
+		secret, ok := cfg.APIKeys[name]
+		if !ok {
+			return nil, fmt.Errorf("priority for unknown api key %q", name)
+		}
+		c, ok := parsePriority(class)
+		if !ok {
+			return nil, fmt.Errorf("api key %q: unknown priority class %q", name, class)
+		}
+		p.byToken[secret] = c
+	}
+	return p, nil
+}
+
+// limit returns how much of limit requests of class may use.
+func (p *priorities) limit(class priorityClass, limit int64) int64 {
+	if class != priorityBatch || limit <= 0 {
+		return limit
+	}
+	return max(int64(float64(limit)*p.share), 1)
+}
+
+// priorityFrom returns the priority class withPriority gave the request
+// of ctx.
+func priorityFrom(ctx context.Context) priorityClass {
+	c, _ := ctx.Value(priorityKey).(priorityClass)
+	return c
+}
+
+// withPriority classifies each request, rejecting an X-Priority that
+// names no class. It runs before withAdmission, which sheds by class.
+func (s *Server) withPriority(next http.Handler) http.Handler {
+	p := s.priorities
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := priorityInteractive
+		if c, ok := p.byToken[bearerToken(r)]; ok {
+			class = c
+		} else if v := r.Header.Get("X-Priority"); v != "" {
+			c, ok := parsePriority(v)
+			if !ok {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParam, "X-Priority must be interactive or batch")
+				return
+			}
+			class = c
+		}
+		p.requests[class].Add(1)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), priorityKey, class)))
+	})
+}
+
+// priorityClassStats is a class's entry in the "priority" entry of
+// /stats. Shed counts the requests of the class that admission control
+// or a concurrency limit turned away.
+type priorityClassStats struct {
+	Requests int64 `json:"requests"`
+	Shed     int64 `json:"shed"`
+}
+
+// priorityStats is the "priority" entry of /stats.
+type priorityStats struct {
+	BatchShare float64                       `json:"batch_share"`
+	Classes    map[string]priorityClassStats `json:"classes"`
+}
+
+func (s *Server) priorityStats() priorityStats {
+	p := s.priorities
+	st := priorityStats{BatchShare: p.share, Classes: make(map[string]priorityClassStats, numPriorities)}
+	var routeShed [numPriorities]int64
+	for _, rl := range s.routeLimits {
+		for c := range rl.rejectedBy {
+			routeShed[c] += rl.rejectedBy[c].Load()
+		}
+	}
+	for c, name := range priorityNames {
+		st.Classes[name] = priorityClassStats{Requests: p.requests[c].Load(), Shed: p.shed[c].Load() + routeShed[c]}
+	}
+	return st
+}
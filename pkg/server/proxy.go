@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trustedProxies are the networks of load balancers whose word is taken
+// for the address of the client they forward.
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses CIDRs, or single addresses, of trusted proxies.
+func parseTrustedProxies(specs []string) (trustedProxies, error) {
+	var out trustedProxies
+	for _, spec := range specs {
+		if p, err := netip.ParsePrefix(spec); err == nil {
+			out = append(out, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(spec)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an address or CIDR", spec)
+		}
+		out = append(out, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+	}
+	return out, nil
+}
+
+func (t trustedProxies) contains(a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range t {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost is the host part of r.RemoteAddr.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// withClientIP replaces the remote address of requests that come from a
+// trusted proxy with that of the client the proxy names in Forwarded or,
+// failing that, X-Forwarded-For, so that everything downstream sees the
+// real client. Hops are read from the right: the first one that is not a
+// trusted proxy is the client.
+func withClientIP(t trustedProxies) Middleware {
+	if len(t) == 0 {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer, err := netip.ParseAddr(remoteHost(r))
+			if err == nil && t.contains(peer) {
+				hops := forwardedFor(r.Header)
+				if hops == nil {
+					hops = xForwardedFor(r.Header)
+				}
+				if client, ok := t.client(hops); ok {
+					r2 := *r
+					r2.RemoteAddr = client
+					r = &r2
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// client picks the client out of the forwarding chain hops, nearest last,
+// as host:port. ok is false if there is no usable hop.
+func (t trustedProxies) client(hops []string) (client string, ok bool) {
+	for i := len(hops) - 1; i >= 0; i-- {
+		ap, valid := parseHop(hops[i])
+		if !valid {
+			// "unknown", an obfuscated name or garbage: nothing beyond
+			// this hop can be attributed.
+			break
+		}
+		client, ok = ap.String(), true
+		if !t.contains(ap.Addr()) {
+			break
+		}
+	}
+	return client, ok
+}
+
+// parseHop parses an address from a forwarding header, with or without a
+// port and IPv6 brackets. A missing port is reported as 0.
+func parseHop(s string) (netip.AddrPort, bool) {
+	s = strings.TrimSpace(s)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(a.Unmap(), 0), true
+}
+
+// forwardedFor returns the for= parameters of the Forwarded headers
+// (RFC 7239), or nil if there are none.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("Forwarded") {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+func xForwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	return hops
+}
+
+// proxyListener accepts connections that may start with a PROXY protocol
+// (v1 or v2) header, as sent by HAProxy, AWS NLB and others, and reports
+// the client address it carries as the connection's remote address. Only
+// trusted peers may send one; from any other peer the bytes are left for
+// the server to reject as a malformed request.
+type proxyListener struct {
+	net.Listener
+	trusted trustedProxies
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	trusted := false
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		ip, _ := netip.AddrFromSlice(a.IP)
+		trusted = l.trusted.contains(ip)
+	}
+	return &proxyConn{Conn: c, trusted: trusted}, nil
+}
+
+// proxyConn reads the PROXY header on first use rather than in Accept, so
+// that a slow peer holds up only its own connection.
+type proxyConn struct {
+	net.Conn
+	trusted bool
+
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		c.remote = c.Conn.RemoteAddr()
+		if !c.trusted {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		addr, err := readProxyHeader(c.r)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// proxyV1MaxLen is the longest v1 header, CRLF included.
+const proxyV1MaxLen = 107
+
+// readProxyHeader consumes a PROXY protocol header from r and returns the
+// client address it gives. It returns nil without reading anything if r
+// does not start with one, and nil after reading one that gives no address,
+// such as a health check by the proxy itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		if b, err := r.Peek(len(proxyV1Prefix)); err != nil || !bytes.Equal(b, proxyV1Prefix) {
+			return nil, nil
+		}
+		return readProxyV1(r)
+	case proxyV2Sig[0]:
+		if b, err := r.Peek(len(proxyV2Sig)); err != nil || !bytes.Equal(b, proxyV2Sig) {
+			return nil, nil
+		}
+		r.Discard(len(proxyV2Sig))
+		return readProxyV2(r)
+	}
+	return nil, nil
+}
+
+// readProxyV1 reads "PROXY TCP4 src dst sport dport\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip, err := netip.ParseAddr(f[2])
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(port))), nil
+}
+
+// readProxyV2 reads the binary header that follows the v2 signature.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errProxyHeader
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errProxyHeader
+	}
+	if hdr[0]&0xf == 0 {
+		// LOCAL: the proxy's own connection.
+		return nil, nil
+	}
+	var ip netip.Addr
+	var port []byte
+	switch hdr[1] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		ip, port = netip.AddrFrom4([4]byte(body[0:4])), body[8:10]
+	case 2:
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		ip, port = netip.AddrFrom16([16]byte(body[0:16])).Unmap(), body[32:34]
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port))), nil
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVisibilityTimeout = 30 * time.Second
+	maxVisibilityTimeout     = 12 * time.Hour
+)
+
+// queuePrefix starts the keys queue messages are stored under:
+// "queue/{name}/{id}", with the ID zero-padded to 20 digits so that keys
+// sort in the order messages were pushed. Keeping messages in the store
+// means they are persisted, backed up and replicated like any other key.
+const queuePrefix = "queue/"
+
+var queueNameRE = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+func queueKey(name string, id uint64) string {
+	return fmt.Sprintf("%s%s/%020d", queuePrefix, name, id)
+}
+
+// parseQueueKey splits a message key into its queue name and ID.
+func parseQueueKey(key string) (string, uint64, bool) {
+	rest, ok := strings.CutPrefix(key, queuePrefix)
+	if !ok {
+		return "", 0, false
+	}
+	i := strings.LastIndexByte(rest, '/')
+	if i < 0 || len(rest)-i-1 != 20 || !queueNameRE.MatchString(rest[:i]) {
+		return "", 0, false
+	}
+	id, err := strconv.ParseUint(rest[i+1:], 10, 64)
+	return rest[:i], id, err == nil
+}
+
+// queueRecord is the stored value of a message. A popped message keeps
+// its record with VisibleAt in the future until it is acknowledged; if it
+// is not, it is delivered again once VisibleAt passes.
+type queueRecord struct {
+	Value      string    `json:"value"`
+	VisibleAt  time.Time `json:"visible_at,omitzero"`
+	Deliveries int       `json:"deliveries,omitempty"`
+}
+
+// queueMessage is a message as pop returns it. Receipt acknowledges this
+// delivery only; it stops working once the message is delivered again.
+type queueMessage struct {
+	ID         uint64    `json:"id"`
+	Value      string    `json:"value"`
+	Deliveries int       `json:"deliveries"`
+	Receipt    string    `json:"receipt,omitempty"`
+	VisibleAt  time.Time `json:"visible_at,omitzero"`
+}
+
+// queueState is the index of one queue: its message IDs in order and
+// their records.
+type queueState struct {
+	ids  []uint64
+	msgs map[uint64]queueRecord
+	last uint64 // highest ID handed out or seen
+}
+
+// queueIndex tracks the queues of a namespace. It is kept up to date by a
+// change listener, so messages written by replication, Raft or a restore
+// are picked up like local pushes.
+type queueIndex struct {
+	mu     sync.Mutex
+	byName map[string]*queueState
+
+	// popMu serializes the read-modify-write of pops and acks. It is held
+	// across the store write, which calls back into apply, so it must not
+	// be mu.
+	popMu sync.Mutex
+}
+
+func newQueueIndex() *queueIndex {
+	return &queueIndex{byName: make(map[string]*queueState)}
+}
+
+func (qi *queueIndex) stateLocked(name string) *queueState {
+	st := qi.byName[name]
+	if st == nil {
+		st = &queueState{msgs: make(map[uint64]queueRecord)}
+		qi.byName[name] = st
+	}
+	return st
+}
+
+// apply updates the index for a change to a message key.
+func (qi *queueIndex) apply(ev Event) {
+	name, id, ok := parseQueueKey(ev.Key)
+	if !ok {
+		return
+	}
+	var rec queueRecord
+	if ev.Type != "delete" && json.Unmarshal([]byte(ev.Value), &rec) != nil {
+		// Not a message; treat the key as gone from the queue.
+		ev.Type = "delete"
+	}
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	st := qi.stateLocked(name)
+	i := sort.Search(len(st.ids), func(i int) bool { return st.ids[i] >= id })
+	present := i < len(st.ids) && st.ids[i] == id
+	if ev.Type == "delete" {
+		if present {
+			st.ids = append(st.ids[:i], st.ids[i+1:]...)
+			delete(st.msgs, id)
+		}
+		if len(st.ids) == 0 {
+			delete(qi.byName, name)
+		}
+		return
+	}
+	if !present {
+		st.ids = append(st.ids, 0)
+		copy(st.ids[i+1:], st.ids[i:])
+		st.ids[i] = id
+	}
+	st.msgs[id] = rec
+	st.last = max(st.last, id)
+}
+
+// nextID returns an ID for a new message on name. IDs start from the
+// clock, so they keep increasing across restarts even after a queue has
+// been drained, and a stale receipt cannot match a new message.
+func (qi *queueIndex) nextID(name string) uint64 {
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	st := qi.stateLocked(name)
+	st.last = max(st.last+1, uint64(time.Now().UnixNano()))
+	return st.last
+}
+
+// next returns the first message of name visible at now.
+func (qi *queueIndex) next(name string, now time.Time) (uint64, queueRecord, bool) {
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	if st := qi.byName[name]; st != nil {
+		for _, id := range st.ids {
+			if rec := st.msgs[id]; !rec.VisibleAt.After(now) {
+				return id, rec, true
+			}
+		}
+	}
+	return 0, queueRecord{}, false
+}
+
+func (qi *queueIndex) get(name string, id uint64) (queueRecord, bool) {
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	if st := qi.byName[name]; st != nil {
+		rec, ok := st.msgs[id]
+		return rec, ok
+	}
+	return queueRecord{}, false
+}
+
+// queueStats is the length of a queue and how many of its messages are
+// popped but not yet acknowledged.
+type queueStats struct {
+	Length   int `json:"length"`
+	InFlight int `json:"in_flight"`
+}
+
+func (qi *queueIndex) statsLocked(st *queueState, now time.Time) queueStats {
+	qs := queueStats{Length: len(st.ids)}
+	for _, rec := range st.msgs {
+		if rec.VisibleAt.After(now) {
+			qs.InFlight++
+		}
+	}
+	return qs
+}
+
+func (qi *queueIndex) stats(name string) queueStats {
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	if st := qi.byName[name]; st != nil {
+		return qi.statsLocked(st, time.Now())
+	}
+	return queueStats{}
+}
+
+// all returns the stats of every non-empty queue.
+func (qi *queueIndex) all() map[string]queueStats {
+	now := time.Now()
+	qi.mu.Lock()
+	defer qi.mu.Unlock()
+	out := make(map[string]queueStats, len(qi.byName))
+	for name, st := range qi.byName {
+		if len(st.ids) > 0 {
+			out[name] = qi.statsLocked(st, now)
+		}
+	}
+	return out
+}
+
+// queueName returns the {name} path segment, answering 400 if it is not a
+// valid queue name.
+func queueName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := r.PathValue("name")
+	if !queueNameRE.MatchString(name) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid queue name")
+		return "", false
+	}
+	return name, true
+}
+
+// POST
+//
+// pushHandler appends {"value": "..."} to the queue, creating it.
+func (s *Server) pushHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	name, ok := queueName(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Value *string `json:"value"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Value == nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "value is required")
+		return
+	}
+	ns := s.namespaceFrom(r.Context())
+	id := ns.queues.nextID(name)
+	buf, _ := json.Marshal(queueRecord{Value: *req.Value})
+	if err := s.applySet(r.Context(), ns, queueKey(name, id), string(buf)); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": id, "length": ns.queues.stats(name).Length})
+}
+
+// POST
+//
+// popHandler hands out the oldest visible message of the queue, or
+// answers 204 when there is none. The message stays in the queue, hidden
+// for the visibility timeout (default 30s), until it is acknowledged with
+// its receipt; with a timeout of 0 it is removed at once.
+func (s *Server) popHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	name, ok := queueName(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		VisibilityTimeout json.RawMessage `json:"visibility_timeout"`
+	}
+	if r.ContentLength != 0 {
+		if !s.decodeJSON(w, r, &req) {
+			return
+		}
+	}
+	vt, ok := parseDurationJSON(req.VisibilityTimeout, defaultVisibilityTimeout)
+	if !ok || vt > maxVisibilityTimeout {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "visibility_timeout must be seconds or a duration such as \"30s\", up to 12h")
+		return
+	}
+
+	ns := s.namespaceFrom(r.Context())
+	ns.queues.popMu.Lock()
+	defer ns.queues.popMu.Unlock()
+	now := time.Now().UTC()
+	id, rec, ok := ns.queues.next(name, now)
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	rec.Deliveries++
+	msg := queueMessage{ID: id, Value: rec.Value, Deliveries: rec.Deliveries}
+	var err error
+	if vt == 0 {
+		err = s.applyDelete(r.Context(), ns, queueKey(name, id))
+	} else {
+		rec.VisibleAt = now.Add(vt)
+		msg.VisibleAt = rec.VisibleAt
+		msg.Receipt = fmt.Sprintf("%d.%d", id, rec.Deliveries)
+		buf, _ := json.Marshal(rec)
+		err = s.applySet(r.Context(), ns, queueKey(name, id), string(buf))
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, msg)
+}
+
+// POST
+//
+// ackHandler removes a popped message, given the receipt of its latest
+// delivery.
+func (s *Server) ackHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	name, ok := queueName(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Receipt string `json:"receipt"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	idStr, delStr, _ := strings.Cut(req.Receipt, ".")
+	id, err1 := strconv.ParseUint(idStr, 10, 64)
+	deliveries, err2 := strconv.Atoi(delStr)
+	if err1 != nil || err2 != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid receipt")
+		return
+	}
+
+	ns := s.namespaceFrom(r.Context())
+	ns.queues.popMu.Lock()
+	defer ns.queues.popMu.Unlock()
+	rec, ok := ns.queues.get(name, id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Message not found")
+		return
+	}
+	if rec.Deliveries != deliveries || !rec.VisibleAt.After(time.Now()) {
+		writeError(w, r, http.StatusConflict, codeConflict, "The visibility timeout has passed; the message may have been delivered again")
+		return
+	}
+	if err := s.applyDelete(r.Context(), ns, queueKey(name, id)); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "acknowledged"})
+}
+
+// GET
+func (s *Server) queueStatsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := queueName(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.namespaceFrom(r.Context()).queues.stats(name))
+}
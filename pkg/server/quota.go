@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Quota limits the size of a namespace. Zero fields are unlimited. Bytes
+// count the lengths of keys plus values.
+type Quota struct {
+	MaxKeys  int   `json:"max_keys,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+func (q Quota) unlimited() bool { return q.MaxKeys <= 0 && q.MaxBytes <= 0 }
+
+// parseQuota parses "KEYS:BYTES", where either side may be empty or 0 for
+// no limit.
+func parseQuota(v string) (Quota, error) {
+	keys, bytes, _ := strings.Cut(v, ":")
+	var q Quota
+	var err error
+	if keys != "" {
+		if q.MaxKeys, err = strconv.Atoi(keys); err != nil || q.MaxKeys < 0 {
+			return Quota{}, fmt.Errorf("invalid key limit %q", keys)
+		}
+	}
+	if bytes != "" {
+		if q.MaxBytes, err = strconv.ParseInt(bytes, 10, 64); err != nil || q.MaxBytes < 0 {
+			return Quota{}, fmt.Errorf("invalid byte limit %q", bytes)
+		}
+	}
+	return q, nil
+}
+
+// Quotas maps namespace names to their quotas. It implements flag.Value,
+// parsing repeated "namespace=KEYS:BYTES" arguments.
+type Quotas map[string]Quota
+
+func (f *Quotas) String() string {
+	names := make([]string, 0, len(*f))
+	for name, q := range *f {
+		names = append(names, fmt.Sprintf("%s=%d:%d", name, q.MaxKeys, q.MaxBytes))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (f *Quotas) Set(v string) error {
+	name, spec, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("quota %q must be in namespace=KEYS:BYTES form", v)
+	}
+	q, err := parseQuota(spec)
+	if err != nil {
+		return fmt.Errorf("quota %q: %w", v, err)
+	}
+	if *f == nil {
+		*f = make(Quotas)
+	}
+	(*f)[name] = q
+	return nil
+}
+
+// usage is the current size of a namespace.
+type usage struct {
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+func entrySize(key, value string) int64 { return int64(len(key) + len(value)) }
+
+// storedSize returns the size of the entry under key, preferring metadata
+// so that the lookup is not counted as a read.
+func storedSize(store Store, key string) (int64, error) {
+	if mp, ok := store.(metadataProvider); ok {
+		meta, err := mp.Metadata(key)
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(key) + meta.Size), nil
+	}
+	v, err := store.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return entrySize(key, v), nil
+}
+
+// measureUsage computes the usage of store from a snapshot.
+func measureUsage(store Store) usage {
+	var u usage
+	store.Snapshot().Range(func(k, v string) bool {
+		u.Keys++
+		u.Bytes += entrySize(k, v)
+		return true
+	})
+	return u
+}
+
+// quotaStore enforces a Quota on the store it wraps and keeps a running
+// count of its usage. Writes are serialized so the check and the update
+// cannot race.
+type quotaStore struct {
+	Store
+	quota Quota
+
+	mu    sync.Mutex
+	usage usage
+}
+
+func newQuotaStore(inner Store, q Quota) *quotaStore {
+	return &quotaStore{Store: inner, quota: q, usage: measureUsage(inner)}
+}
+
+// GetContext forwards to the wrapped store.
+func (qs *quotaStore) GetContext(ctx context.Context, key string) (string, error) {
+	return forwardGet(ctx, qs.Store, key)
+}
+
+func (qs *quotaStore) Set(key, value string) error {
+	return qs.set(key, value, false, func() error { return qs.Store.Set(key, value) })
+}
+
+// Create sets key only if it is absent.
+func (qs *quotaStore) Create(key, value string) error {
+	return qs.set(key, value, true, func() error { return createValue(qs.Store, key, value) })
+}
+
+// Swap sets key and returns the value it replaced.
+func (qs *quotaStore) Swap(key, value string) (old string, existed bool, err error) {
+	err = qs.set(key, value, false, func() error {
+		var err error
+		old, existed, err = swapValue(qs.Store, key, value)
+		return err
+	})
+	return old, existed, err
+}
+
+// set checks a write of key against the quota and performs it with write.
+func (qs *quotaStore) set(key, value string, create bool, write func() error) error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	next := qs.usage
+	if old, err := storedSize(qs.Store, key); err == nil {
+		if create {
+			return &KeyError{Op: "create", Key: key, Err: ErrKeyExists}
+		}
+		next.Bytes += entrySize(key, value) - old
+	} else {
+		next.Keys++
+		next.Bytes += entrySize(key, value)
+	}
+	if qs.quota.MaxKeys > 0 && next.Keys > qs.quota.MaxKeys {
+		return &KeyError{Op: "set", Key: key, Err: fmt.Errorf("%w: key limit of %d reached", ErrQuotaExceeded, qs.quota.MaxKeys)}
+	}
+	if qs.quota.MaxBytes > 0 && next.Bytes > qs.quota.MaxBytes && next.Bytes > qs.usage.Bytes {
+		return &KeyError{Op: "set", Key: key, Err: fmt.Errorf("%w: byte limit of %d reached", ErrQuotaExceeded, qs.quota.MaxBytes)}
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	qs.usage = next
+	return nil
+}
+
+func (qs *quotaStore) Delete(key string) error {
+	return qs.remove(key, func() error { return qs.Store.Delete(key) })
+}
+
+// Take deletes key and returns its value.
+func (qs *quotaStore) Take(key string) (old string, err error) {
+	err = qs.remove(key, func() error {
+		var err error
+		old, err = takeValue(qs.Store, key)
+		return err
+	})
+	return old, err
+}
+
+// TakeAt deletes key and returns its value if it was last written at rev.
+func (qs *quotaStore) TakeAt(key string, rev uint64) (old string, err error) {
+	err = qs.remove(key, func() error {
+		var err error
+		old, err = takeValueAt(qs.Store, key, rev)
+		return err
+	})
+	return old, err
+}
+
+func (qs *quotaStore) remove(key string, del func() error) error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	old, err := storedSize(qs.Store, key)
+	if err != nil {
+		return err
+	}
+	if err := del(); err != nil {
+		return err
+	}
+	qs.usage.Keys--
+	qs.usage.Bytes -= old
+	return nil
+}
+
+// ClearPrefix removes the keys starting with prefix and releases their
+// usage.
+func (qs *quotaStore) ClearPrefix(prefix string) (map[string]string, error) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	removed, err := clearPrefix(qs.Store, prefix)
+	for k, v := range removed {
+		qs.usage.Keys--
+		qs.usage.Bytes -= entrySize(k, v)
+	}
+	return removed, err
+}
+
+// LastRevision forwards to the wrapped store when it numbers its writes.
+func (qs *quotaStore) LastRevision() uint64 {
+	if rc, ok := qs.Store.(revisionCounter); ok {
+		return rc.LastRevision()
+	}
+	return 0
+}
+
+// Revision forwards to the wrapped store when it tracks revisions.
+func (qs *quotaStore) Revision(key string) (uint64, error) {
+	if rv, ok := qs.Store.(keyRevisioner); ok {
+		return rv.Revision(key)
+	}
+	return 0, &KeyError{Op: "revision", Key: key, Err: ErrKeyNotFound}
+}
+
+// Peek forwards to the wrapped store.
+func (qs *quotaStore) Peek(key string) (string, error) {
+	if v, ok := peekValue(qs.Store, key); ok {
+		return v, nil
+	}
+	return "", &KeyError{Op: "get", Key: key, Err: ErrKeyNotFound}
+}
+
+// Verify forwards to the wrapped store when it keeps checksums.
+func (qs *quotaStore) Verify() (int, []string) {
+	checked, corrupt, _ := verifyStore(qs.Store)
+	return checked, corrupt
+}
+
+// Metadata forwards to the wrapped store when it tracks metadata.
+func (qs *quotaStore) Metadata(key string) (KeyMeta, error) {
+	if mp, ok := qs.Store.(metadataProvider); ok {
+		return mp.Metadata(key)
+	}
+	return KeyMeta{}, &KeyError{Op: "metadata", Key: key, Err: ErrKeyNotFound}
+}
+
+func (qs *quotaStore) currentUsage() usage {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return qs.usage
+}
+
+// usageOf returns the usage of store, from the running count when it
+// enforces a quota.
+func usageOf(store Store) usage {
+	if qs, ok := store.(*quotaStore); ok {
+		return qs.currentUsage()
+	}
+	return measureUsage(store)
+}
+
+// namespaceUsage is the body of GET /ns/{namespace}/usage.
+type namespaceUsage struct {
+	Namespace string `json:"namespace"`
+	usage
+	Quota Quota `json:"quota"`
+}
+
+// GET
+func (s *Server) namespaceUsageHandler(w http.ResponseWriter, r *http.Request) {
+	ns := s.namespaceFrom(r.Context())
+	out := namespaceUsage{Namespace: ns.name, usage: usageOf(ns.store)}
+	if qs, ok := ns.store.(*quotaStore); ok {
+		out.Quota = qs.quota
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,1202 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// raftRole is the part a node currently plays in its Raft group.
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (r raftRole) String() string {
+	switch r {
+	case raftCandidate:
+		return "candidate"
+	case raftLeader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// raftEntry is one replicated mutation. A new leader appends an entry
+// with no Op to commit the entries of earlier terms.
+type raftEntry struct {
+	Term  uint64   `json:"term"`
+	Index uint64   `json:"index"`
+	Op    string   `json:"op,omitempty"` // "set", "create", "delete", "expire" or "flush"
+	NS    string   `json:"ns,omitempty"`
+	Key   string   `json:"key,omitempty"`
+	Value string   `json:"value,omitempty"`
+	Type  string   `json:"type,omitempty"` // content type of a raw value
+	Tags  []string `json:"tags,omitempty"`
+	// Expiry is the expiry the key has once the entry is applied.
+	Expiry *keyExpiry `json:"expiry,omitempty"`
+}
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term      uint64      `json:"term"`
+	Leader    string      `json:"leader"`
+	PrevIndex uint64      `json:"prev_index"`
+	PrevTerm  uint64      `json:"prev_term"`
+	Entries   []raftEntry `json:"entries,omitempty"`
+	Commit    uint64      `json:"commit"`
+}
+
+// appendResponse acknowledges an appendRequest. On success Match is the
+// last index known to agree with the leader; otherwise Conflict is where
+// the leader should retry from.
+type appendResponse struct {
+	Term     uint64 `json:"term"`
+	Success  bool   `json:"success"`
+	Match    uint64 `json:"match,omitempty"`
+	Conflict uint64 `json:"conflict,omitempty"`
+}
+
+// raftWaiter is the proposer of the entry at some index, waiting for it
+// to be applied.
+type raftWaiter struct {
+	term uint64
+	ctx  context.Context
+	done chan error
+}
+
+// snapshotRequest sends a follower the leader's snapshot when it needs
+// entries the leader's log no longer holds. It is answered like an
+// appendRequest, with the snapshot's index as Match.
+type snapshotRequest struct {
+	Term     uint64       `json:"term"`
+	Leader   string       `json:"leader"`
+	Snapshot raftSnapshot `json:"snapshot"`
+}
+
+// raftBatch bounds the entries sent in one append request.
+const raftBatch = 256
+
+// raftSnapshotEvery is how many entries a node applies before it
+// snapshots the store and drops them from its log.
+const raftSnapshotEvery = 8192
+
+// raftSnapshotTimeout bounds sending a snapshot to a follower, which takes
+// longer than the other RPCs.
+const raftSnapshotTimeout = time.Minute
+
+// raftFSM is the state machine a raftNode replicates: apply applies a
+// committed entry, state returns the entries that rebuild the whole
+// state, for a snapshot, and restore replaces the state with those of a
+// snapshot.
+type raftFSM struct {
+	apply   func(ctx context.Context, e raftEntry) error
+	state   func() []raftEntry
+	restore func(state []raftEntry) error
+}
+
+// raftNode runs the Raft consensus protocol over HTTP with the other
+// nodes of the topology. Committed entries are handed to fsm.apply in log
+// order on every node.
+type raftNode struct {
+	id      string
+	peers   []topologyNode // every member but this one
+	secret  string
+	timeout time.Duration // base election timeout
+	client  *http.Client
+	storage *raftStorage
+	fsm     raftFSM
+	logger  *log.Logger
+
+	mu       sync.Mutex
+	role     raftRole
+	term     uint64
+	votedFor string
+	leader   string
+	log      []raftEntry // log[i].Index == log[0].Index+i; log[0] is the last entry of the snapshot, or a sentinel
+	commit   uint64
+	applied  uint64
+	deadline time.Time            // when to start an election unless a leader is heard from
+	heard    time.Time            // when the leader was last heard from
+	acked    map[string]time.Time // on the leader, when each peer last acknowledged it
+	previous string               // the last other node heard from as leader
+	next     map[string]uint64
+	match    map[string]uint64
+	inflight map[string]bool
+	snapSent map[string]time.Time // on the leader, when each peer was last sent the snapshot
+	waiters  map[uint64]*raftWaiter
+	changed  chan struct{} // closed and replaced whenever the state advances
+
+	kick   chan struct{}
+	applyC chan struct{}
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newRaftNode(t *topology, dir, secret string, timeout time.Duration, kr *keyRing, fsm raftFSM, logger *log.Logger) (*raftNode, error) {
+	st, err := openRaftStorage(dir, kr)
+	if err != nil {
+		return nil, err
+	}
+	n := &raftNode{
+		id:       t.Self,
+		secret:   secret,
+		timeout:  timeout,
+		client:   &http.Client{Timeout: timeout / 2},
+		storage:  st,
+		fsm:      fsm,
+		logger:   logger,
+		term:     st.term,
+		votedFor: st.vote,
+		log:      append([]raftEntry{st.base}, st.entries...),
+		// The snapshot holds committed entries only; the applier
+		// restores it first.
+		commit:   st.base.Index,
+		next:     make(map[string]uint64),
+		match:    make(map[string]uint64),
+		inflight: make(map[string]bool),
+		snapSent: make(map[string]time.Time),
+		acked:    make(map[string]time.Time),
+		waiters:  make(map[uint64]*raftWaiter),
+		changed:  make(chan struct{}),
+		kick:     make(chan struct{}, 1),
+		applyC:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	st.entries = nil
+	for _, node := range t.Nodes {
+		if node.ID != t.Self {
+			n.peers = append(n.peers, node)
+		}
+	}
+	n.resetDeadlineLocked()
+	return n, nil
+}
+
+func (n *raftNode) start() {
+	n.wg.Add(2)
+	go n.run()
+	go n.applier()
+}
+
+func (n *raftNode) close() error {
+	close(n.stop)
+	n.wg.Wait()
+	return n.storage.close()
+}
+
+func (n *raftNode) lastLocked() raftEntry { return n.log[len(n.log)-1] }
+
+// entryLocked returns the entry at index, which must be no older than the
+// last entry of the snapshot.
+func (n *raftNode) entryLocked(index uint64) raftEntry { return n.log[index-n.log[0].Index] }
+
+func (n *raftNode) quorum() int { return (len(n.peers)+1)/2 + 1 }
+
+func (n *raftNode) resetDeadlineLocked() {
+	n.deadline = time.Now().Add(n.timeout + time.Duration(rand.Int63n(int64(n.timeout))))
+}
+
+// broadcastLocked wakes everything waiting for the state to change.
+func (n *raftNode) broadcastLocked() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *raftNode) signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (n *raftNode) persistStateLocked() error {
+	if err := n.storage.saveState(n.term, n.votedFor); err != nil {
+		n.logger.Printf("[Raft] Saving state: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (n *raftNode) becomeFollowerLocked(term uint64) {
+	if term > n.term {
+		n.term, n.votedFor, n.leader = term, "", ""
+		n.persistStateLocked()
+	}
+	if n.role == raftLeader {
+		n.logger.Printf("[Raft] Stepping down in term %d", n.term)
+	}
+	n.role = raftFollower
+	n.broadcastLocked()
+}
+
+// run drives elections and, on the leader, heartbeats and replication.
+func (n *raftNode) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.timeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		case <-n.kick:
+		}
+		n.mu.Lock()
+		if n.role == raftLeader && !n.quorateLocked(time.Now()) {
+			n.logger.Printf("[Raft] Lost contact with a majority; stepping down in term %d", n.term)
+			n.role = raftFollower
+			n.leader = ""
+			n.resetDeadlineLocked()
+			// Whether pending writes commit is now up to the next leader,
+			// as after a timeout; their clients need not wait to find out.
+			for index, w := range n.waiters {
+				delete(n.waiters, index)
+				w.done <- ErrNotLeader
+			}
+			n.broadcastLocked()
+		} else if n.role == raftLeader {
+			for _, p := range n.peers {
+				if !n.inflight[p.ID] {
+					n.inflight[p.ID] = true
+					go n.replicateLoop(p)
+				}
+			}
+		} else if time.Now().After(n.deadline) {
+			n.campaignLocked()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *raftNode) campaignLocked() {
+	n.role = raftCandidate
+	n.term++
+	n.votedFor = n.id
+	n.leader = ""
+	clear(n.acked)
+	n.resetDeadlineLocked()
+	if n.persistStateLocked() != nil {
+		return
+	}
+	last := n.lastLocked()
+	req := voteRequest{Term: n.term, Candidate: n.id, LastIndex: last.Index, LastTerm: last.Term}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeaderLocked()
+		return
+	}
+	for _, p := range n.peers {
+		go func(p topologyNode) {
+			var resp voteResponse
+			if err := n.call(p, "vote", req, &resp); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollowerLocked(resp.Term)
+				return
+			}
+			if n.role != raftCandidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			// A vote counts as the first acknowledgement of the leader.
+			n.acked[p.ID] = time.Now()
+			if votes++; votes >= n.quorum() {
+				n.becomeLeaderLocked()
+			}
+		}(p)
+	}
+}
+
+func (n *raftNode) becomeLeaderLocked() {
+	n.role = raftLeader
+	n.leader = n.id
+	last := n.lastLocked().Index
+	for _, p := range n.peers {
+		n.next[p.ID] = last + 1
+		n.match[p.ID] = 0
+	}
+	n.logger.Printf("[Raft] Elected leader for term %d", n.term)
+	// Entries from earlier terms are only known to be committed once an
+	// entry of this term is.
+	n.appendLocked(raftEntry{})
+	n.broadcastLocked()
+	n.signal(n.kick)
+}
+
+// appendLocked adds e to the leader's log in the current term.
+func (n *raftNode) appendLocked(e raftEntry) error {
+	e.Term = n.term
+	e.Index = n.lastLocked().Index + 1
+	if err := n.storage.append([]raftEntry{e}); err != nil {
+		n.logger.Printf("[Raft] Appending to log: %v", err)
+		return err
+	}
+	n.log = append(n.log, e)
+	n.advanceCommitLocked()
+	return nil
+}
+
+// advanceCommitLocked commits the newest entry of the current term that
+// a majority holds.
+func (n *raftNode) advanceCommitLocked() {
+	for i := n.lastLocked().Index; i > n.commit && n.entryLocked(i).Term == n.term; i-- {
+		count := 1
+		for _, m := range n.match {
+			if m >= i {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commit = i
+			n.broadcastLocked()
+			n.signal(n.applyC)
+			return
+		}
+	}
+}
+
+// replicateLoop sends a peer everything it is missing, then clears its
+// in-flight flag.
+func (n *raftNode) replicateLoop(p topologyNode) {
+	for n.replicate(p) {
+		n.mu.Lock()
+		behind := n.role == raftLeader && n.next[p.ID] <= n.lastLocked().Index
+		n.mu.Unlock()
+		if !behind {
+			break
+		}
+	}
+	n.mu.Lock()
+	n.inflight[p.ID] = false
+	n.mu.Unlock()
+}
+
+// replicate sends one append request to p. It reports whether p
+// acknowledged this node as leader of the current term.
+func (n *raftNode) replicate(p topologyNode) bool {
+	n.mu.Lock()
+	if n.role != raftLeader {
+		n.mu.Unlock()
+		return false
+	}
+	next := n.next[p.ID]
+	base := n.log[0].Index
+	if next <= base {
+		// A snapshot is large, so a peer that is down is not sent one
+		// on every heartbeat.
+		if time.Since(n.snapSent[p.ID]) < n.timeout {
+			n.mu.Unlock()
+			return false
+		}
+		n.snapSent[p.ID] = time.Now()
+		term := n.term
+		n.mu.Unlock()
+		return n.sendSnapshot(p, term)
+	}
+	end := min(n.lastLocked().Index+1, next+raftBatch)
+	req := appendRequest{
+		Term:      n.term,
+		Leader:    n.id,
+		PrevIndex: next - 1,
+		PrevTerm:  n.entryLocked(next - 1).Term,
+		Entries:   append([]raftEntry(nil), n.log[next-base:end-base]...),
+		Commit:    n.commit,
+	}
+	n.mu.Unlock()
+
+	var resp appendResponse
+	if err := n.call(p, "append", req, &resp); err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollowerLocked(resp.Term)
+		return false
+	}
+	if n.role != raftLeader || n.term != req.Term {
+		return false
+	}
+	n.acked[p.ID] = time.Now()
+	if resp.Success {
+		if resp.Match > n.match[p.ID] {
+			n.match[p.ID] = resp.Match
+		}
+		n.next[p.ID] = resp.Match + 1
+		n.advanceCommitLocked()
+	} else {
+		n.next[p.ID] = max(1, min(resp.Conflict, n.lastLocked().Index+1))
+	}
+	return true
+}
+
+// sendSnapshot sends p the snapshot, as leader of term, for the entries it
+// is missing that the log no longer holds. It reports whether p
+// acknowledged this node as leader of the term.
+func (n *raftNode) sendSnapshot(p topologyNode, term uint64) bool {
+	snap, err := n.storage.loadSnapshot()
+	if err != nil {
+		n.logger.Printf("[Raft] Reading snapshot for %s: %v", p.ID, err)
+		return false
+	}
+	req := snapshotRequest{Term: term, Leader: n.id, Snapshot: snap}
+	var resp appendResponse
+	client := &http.Client{Timeout: raftSnapshotTimeout}
+	if err := n.callWith(client, p, "snapshot", req, &resp); err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollowerLocked(resp.Term)
+		return false
+	}
+	if n.role != raftLeader || n.term != term {
+		return false
+	}
+	n.acked[p.ID] = time.Now()
+	if resp.Success {
+		n.logger.Printf("[Raft] Sent %s the snapshot at %d", p.ID, snap.Index)
+		n.match[p.ID] = max(n.match[p.ID], resp.Match)
+		n.next[p.ID] = resp.Match + 1
+		n.advanceCommitLocked()
+	}
+	return true
+}
+
+func (n *raftNode) handleVote(req voteRequest) voteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		n.becomeFollowerLocked(req.Term)
+	}
+	resp := voteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return resp
+	}
+	last := n.lastLocked()
+	if req.LastTerm < last.Term || (req.LastTerm == last.Term && req.LastIndex < last.Index) {
+		return resp
+	}
+	n.votedFor = req.Candidate
+	if n.persistStateLocked() != nil {
+		return resp
+	}
+	n.resetDeadlineLocked()
+	resp.Granted = true
+	return resp
+}
+
+// heardFromLocked accepts an RPC from the leader of term, reporting false
+// if term is stale.
+func (n *raftNode) heardFromLocked(term uint64, leader string) bool {
+	if term < n.term {
+		return false
+	}
+	if term > n.term || n.role != raftFollower {
+		n.becomeFollowerLocked(term)
+	}
+	if n.leader != leader {
+		n.leader = leader
+		n.broadcastLocked()
+	}
+	n.previous = leader
+	n.resetDeadlineLocked()
+	n.heard = time.Now()
+	return true
+}
+
+func (n *raftNode) handleAppend(req appendRequest) appendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.heardFromLocked(req.Term, req.Leader) {
+		return appendResponse{Term: n.term}
+	}
+	resp := appendResponse{Term: n.term}
+
+	last := n.lastLocked().Index
+	if req.PrevIndex > last {
+		resp.Conflict = last + 1
+		return resp
+	}
+	if base := n.log[0].Index; req.PrevIndex < base {
+		// The entries up to the snapshot are committed, so they agree
+		// with the leader's.
+		skip := min(base-req.PrevIndex, uint64(len(req.Entries)))
+		if skip > 0 {
+			req.PrevTerm = req.Entries[skip-1].Term
+		}
+		req.PrevIndex += skip
+		req.Entries = req.Entries[skip:]
+		if req.PrevIndex < base {
+			resp.Success, resp.Match = true, req.PrevIndex
+			return resp
+		}
+	}
+	if t := n.entryLocked(req.PrevIndex).Term; t != req.PrevTerm {
+		// Skip back over the whole conflicting term at once.
+		i := req.PrevIndex
+		for i > n.commit+1 && n.entryLocked(i-1).Term == t {
+			i--
+		}
+		resp.Conflict = i
+		return resp
+	}
+
+	for i, e := range req.Entries {
+		if e.Index <= last && n.entryLocked(e.Index).Term == e.Term {
+			continue
+		}
+		// Everything from here on is new; drop any conflicting suffix.
+		var err error
+		if e.Index <= last {
+			n.log = n.log[:e.Index-n.log[0].Index]
+			err = n.storage.rewrite(n.log[1:])
+		}
+		if err == nil {
+			err = n.storage.append(req.Entries[i:])
+		}
+		if err != nil {
+			n.logger.Printf("[Raft] Appending to log: %v", err)
+			return resp
+		}
+		n.log = append(n.log, req.Entries[i:]...)
+		break
+	}
+
+	resp.Success = true
+	resp.Match = req.PrevIndex + uint64(len(req.Entries))
+	if c := min(req.Commit, resp.Match); c > n.commit {
+		n.commit = c
+		n.broadcastLocked()
+		n.signal(n.applyC)
+	}
+	return resp
+}
+
+// handleSnapshot installs the leader's snapshot when it is ahead of the
+// entries this node has committed: the log is cut to the entries after
+// it, all of them if they do not follow on from it, and the applier
+// restores it.
+func (n *raftNode) handleSnapshot(req snapshotRequest) appendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.heardFromLocked(req.Term, req.Leader) {
+		return appendResponse{Term: n.term}
+	}
+	resp := appendResponse{Term: n.term}
+	snap := req.Snapshot
+	if snap.Index <= n.commit {
+		resp.Success, resp.Match = true, snap.Index
+		return resp
+	}
+	if err := n.storage.saveSnapshot(snap); err != nil {
+		n.logger.Printf("[Raft] Saving snapshot: %v", err)
+		return resp
+	}
+	head := raftEntry{Index: snap.Index, Term: snap.Term}
+	if snap.Index <= n.lastLocked().Index && n.entryLocked(snap.Index).Term == snap.Term {
+		n.log = append([]raftEntry{head}, n.log[snap.Index-n.log[0].Index+1:]...)
+	} else {
+		n.log = []raftEntry{head}
+	}
+	if err := n.storage.rewrite(n.log[1:]); err != nil {
+		n.logger.Printf("[Raft] Rewriting log: %v", err)
+		return resp
+	}
+	n.logger.Printf("[Raft] Installing the snapshot at %d from %s", snap.Index, req.Leader)
+	n.commit = snap.Index
+	n.broadcastLocked()
+	n.signal(n.applyC)
+	resp.Success, resp.Match = true, snap.Index
+	return resp
+}
+
+// applier hands committed entries to apply in order and reports the
+// results to their proposers, restoring the snapshot first when the log
+// no longer holds the next entry to apply.
+func (n *raftNode) applier() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyC:
+		}
+		n.mu.Lock()
+		for n.applied < n.commit {
+			if n.applied < n.log[0].Index {
+				n.mu.Unlock()
+				index, err := n.restoreSnapshot()
+				n.mu.Lock()
+				if err != nil {
+					n.logger.Printf("[Raft] Restoring snapshot: %v", err)
+					break
+				}
+				for i, w := range n.waiters {
+					if i <= index {
+						// Whether it was committed is not known.
+						delete(n.waiters, i)
+						w.done <- ErrNotLeader
+					}
+				}
+				n.applied = index
+				n.broadcastLocked()
+				continue
+			}
+			e := n.entryLocked(n.applied + 1)
+			w := n.waiters[e.Index]
+			delete(n.waiters, e.Index)
+			n.mu.Unlock()
+
+			var err error
+			if e.Op != "" {
+				ctx := context.Background()
+				if w != nil && w.term == e.Term {
+					ctx = w.ctx
+				}
+				err = n.fsm.apply(ctx, e)
+			}
+			if w != nil {
+				if w.term != e.Term {
+					// The proposal was overwritten by another leader.
+					err = ErrNotLeader
+				}
+				w.done <- err
+			}
+
+			n.mu.Lock()
+			n.applied = e.Index
+			n.broadcastLocked()
+		}
+		due := n.applied-n.log[0].Index >= raftSnapshotEvery
+		n.mu.Unlock()
+		if due {
+			n.snapshot()
+		}
+	}
+}
+
+// restoreSnapshot replaces the state with the snapshot's, returning the
+// index of its last entry.
+func (n *raftNode) restoreSnapshot() (uint64, error) {
+	snap, err := n.storage.loadSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	if err := n.fsm.restore(snap.State); err != nil {
+		return 0, err
+	}
+	n.logger.Printf("[Raft] Restored the snapshot at %d: %d keys", snap.Index, len(snap.State))
+	return snap.Index, nil
+}
+
+// snapshot saves the state as of the last entry applied, then drops the
+// entries up to it from the log. Only the applier calls it, so nothing is
+// applied while the state is read.
+func (n *raftNode) snapshot() {
+	n.mu.Lock()
+	index := n.applied
+	term := n.entryLocked(index).Term
+	n.mu.Unlock()
+	snap := raftSnapshot{Index: index, Term: term, State: n.fsm.state()}
+	if err := n.storage.saveSnapshot(snap); err != nil {
+		n.logger.Printf("[Raft] Saving snapshot: %v", err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	base := n.log[0].Index
+	if index <= base {
+		return
+	}
+	n.log = append([]raftEntry{{Index: index, Term: term}}, n.log[index-base+1:]...)
+	if err := n.storage.rewrite(n.log[1:]); err != nil {
+		n.logger.Printf("[Raft] Rewriting log: %v", err)
+		return
+	}
+	n.logger.Printf("[Raft] Snapshot at %d; dropped %d entries from the log", index, index-base)
+}
+
+// propose replicates e through the leader's log and returns the result
+// of applying it once committed.
+func (n *raftNode) propose(ctx context.Context, e raftEntry) error {
+	n.mu.Lock()
+	if n.role != raftLeader || !n.quorateLocked(time.Now()) {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	if err := n.appendLocked(e); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	index := n.lastLocked().Index
+	w := &raftWaiter{term: n.term, ctx: ctx, done: make(chan error, 1)}
+	n.waiters[index] = w
+	n.mu.Unlock()
+	n.signal(n.kick)
+	n.signal(n.applyC)
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		if n.waiters[index] == w {
+			delete(n.waiters, index)
+		}
+		n.mu.Unlock()
+		return ctx.Err()
+	case <-n.stop:
+		return ErrReadOnly
+	}
+}
+
+// readBarrier returns once this node, as leader, has applied every entry
+// committed before the call, after confirming with a majority that it is
+// still the leader.
+func (n *raftNode) readBarrier(ctx context.Context) error {
+	n.mu.Lock()
+	if n.role != raftLeader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	term := n.term
+	n.mu.Unlock()
+
+	acks := make(chan bool, len(n.peers))
+	for _, p := range n.peers {
+		go func(p topologyNode) { acks <- n.replicate(p) }(p)
+	}
+	for count, i := 1, 0; count < n.quorum(); i++ {
+		if i == len(n.peers) {
+			return ErrNotLeader
+		}
+		select {
+		case ok := <-acks:
+			if ok {
+				count++
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// The commit index is only current once an entry of this term is
+	// committed.
+	if err := n.waitLocked(ctx, func() bool { return n.term != term || n.entryLocked(n.commit).Term == term }); err != nil {
+		return err
+	}
+	if n.term != term {
+		return ErrNotLeader
+	}
+	readIndex := n.commit
+	return n.waitLocked(ctx, func() bool { return n.applied >= readIndex })
+}
+
+// waitLocked blocks until cond holds, releasing n.mu while waiting.
+func (n *raftNode) waitLocked(ctx context.Context, cond func() bool) error {
+	for !cond() {
+		ch := n.changed
+		n.mu.Unlock()
+		var err error
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-n.stop:
+			err = ErrReadOnly
+		}
+		n.mu.Lock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quorateLocked reports whether this node, as leader, has been
+// acknowledged by a majority within the last election timeout. A leader
+// cut off from the majority may already have been replaced, so it takes
+// no writes and serves no leader reads while quorateLocked is false, and
+// steps down once it notices; a partition therefore never has two leaders
+// taking writes.
+func (n *raftNode) quorateLocked(now time.Time) bool {
+	count := 1
+	for _, p := range n.peers {
+		if now.Sub(n.acked[p.ID]) <= n.timeout {
+			count++
+		}
+	}
+	return count >= n.quorum()
+}
+
+// leaderID returns the ID of the current leader, or "" if none is known.
+// A leader cut off from the majority does not count as one.
+func (n *raftNode) leaderID() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == raftCandidate || n.role == raftLeader && !n.quorateLocked(time.Now()) {
+		return ""
+	}
+	return n.leader
+}
+
+// leaderHint returns the last other node this node followed as leader,
+// for clients to try while it knows of no leader. It may be out of date.
+func (n *raftNode) leaderHint() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.previous
+}
+
+// isLeader reports whether this node leads the cluster, in contact with
+// a majority.
+func (n *raftNode) isLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == raftLeader && n.quorateLocked(time.Now())
+}
+
+// raftStatus is reported by GET /cluster and GET /cluster/status. Quorum
+// reports whether this node is in contact with a majority: as leader, it
+// was acknowledged by one within the election timeout; otherwise, it
+// heard from a leader within it.
+type raftStatus struct {
+	ID        string            `json:"id"`
+	Role      string            `json:"role"`
+	Term      uint64            `json:"term"`
+	Leader    string            `json:"leader,omitempty"`
+	LeaderURL string            `json:"leader_url,omitempty"`
+	Quorum    bool              `json:"quorum"`
+	Snapshot  uint64            `json:"snapshot_index"`
+	Last      uint64            `json:"last_index"`
+	Commit    uint64            `json:"commit_index"`
+	Applied   uint64            `json:"applied_index"`
+	Replicas  map[string]uint64 `json:"replicas,omitempty"` // match index by peer, on the leader
+}
+
+func (n *raftNode) status() raftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st := raftStatus{
+		ID:       n.id,
+		Role:     n.role.String(),
+		Term:     n.term,
+		Leader:   n.leader,
+		Snapshot: n.log[0].Index,
+		Last:     n.lastLocked().Index,
+		Commit:   n.commit,
+		Applied:  n.applied,
+	}
+	now := time.Now()
+	if n.role == raftLeader {
+		st.Quorum = n.quorateLocked(now)
+	} else {
+		st.Quorum = n.leader != "" && now.Sub(n.heard) <= n.timeout
+	}
+	if n.role == raftLeader {
+		st.Replicas = make(map[string]uint64, len(n.match))
+		for id, m := range n.match {
+			st.Replicas[id] = m
+		}
+	}
+	return st
+}
+
+// call posts a Raft RPC to a peer.
+func (n *raftNode) call(p topologyNode, method string, req, resp interface{}) error {
+	return n.callWith(n.client, p, method, req, resp)
+}
+
+func (n *raftNode) callWith(client *http.Client, p topologyNode, method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hr, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(p.URL, "/")+"/raft/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		hr.Header.Set("X-Raft-Secret", n.secret)
+	}
+	res, err := client.Do(hr)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", p.ID, method, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// rpcHandler serves the Raft RPCs of the other members under /raft/. It
+// sits outside the API middleware, so peers need no API key; they
+// authenticate with the shared secret instead, if one is set.
+func (n *raftNode) rpcHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /raft/vote", func(w http.ResponseWriter, r *http.Request) {
+		var req voteRequest
+		if n.decodeRPC(w, r, &req) {
+			writeJSON(w, http.StatusOK, n.handleVote(req))
+		}
+	})
+	mux.HandleFunc("POST /raft/append", func(w http.ResponseWriter, r *http.Request) {
+		var req appendRequest
+		if n.decodeRPC(w, r, &req) {
+			writeJSON(w, http.StatusOK, n.handleAppend(req))
+		}
+	})
+	mux.HandleFunc("POST /raft/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		var req snapshotRequest
+		if n.decodeRPC(w, r, &req) {
+			writeJSON(w, http.StatusOK, n.handleSnapshot(req))
+		}
+	})
+	return mux
+}
+
+func (n *raftNode) decodeRPC(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Raft-Secret")), []byte(n.secret)) != 1 {
+		writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid cluster secret")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+		return false
+	}
+	return true
+}
+
+// applyRaftEntry applies a committed entry to the store on this node.
+func (s *Server) applyRaftEntry(ctx context.Context, e raftEntry) error {
+	ctx = withTags(withContentType(context.WithValue(ctx, replayKey, true), e.Type), e.Tags)
+	ctx = withExpiry(ctx, e.Expiry)
+	ns := s.namespaces.get(e.NS, true)
+	if e.Op == "create" {
+		ctx = withCreateOnly(ctx)
+	}
+	switch e.Op {
+	case "delete":
+		return s.applyDelete(ctx, ns, e.Key)
+	case "expire":
+		return s.applyDelete(withExpiring(ctx), ns, e.Key)
+	case "flush":
+		return s.applyFlush(ctx, ns, e.Key)
+	}
+	return s.applySet(ctx, ns, e.Key, e.Value)
+}
+
+// raftSnapshotState returns the entries that set every key of every
+// namespace as it is, for a Raft snapshot.
+func (s *Server) raftSnapshotState() []raftEntry {
+	var state []raftEntry
+	for _, ns := range s.namespaces.list() {
+		ns.store.Snapshot().Range(func(k, v string) bool {
+			state = append(state, raftEntry{Op: "set", NS: ns.name, Key: k, Value: v,
+				Type: ns.types.get(k), Tags: ns.tags.get(k), Expiry: ns.expiries.get(k)})
+			return true
+		})
+	}
+	return state
+}
+
+// restoreRaftSnapshot replaces the keys of every namespace with those of a
+// Raft snapshot.
+func (s *Server) restoreRaftSnapshot(state []raftEntry) error {
+	ctx := context.WithValue(context.Background(), replayKey, true)
+	for _, ns := range s.namespaces.list() {
+		if err := s.applyFlush(ctx, ns, ""); err != nil {
+			return err
+		}
+	}
+	for _, e := range state {
+		if err := s.applyRaftEntry(context.Background(), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicated reports whether a write with ctx should be proposed to the
+// Raft group rather than applied directly.
+func (s *Server) replicated(ctx context.Context) bool {
+	return s.raft != nil && !replaying(ctx)
+}
+
+// Read consistency levels, chosen per request with ?consistency= or
+// X-Read-Consistency, or for the server with Config.ReadConsistency. A
+// replica serves local reads itself and sends the others to its primary.
+const (
+	readLocal        = "local"        // whatever this node has applied
+	readLeader       = "leader"       // served by the leader
+	readLinearizable = "linearizable" // the leader, after confirming it still leads
+)
+
+// consistentRead enforces the requested read consistency on a read
+// route, after holding a read with a consistency token until the node has
+// caught up to it. Reads a follower or a replica cannot serve, including
+// local reads its data is too stale for, are redirected to the leader or
+// the primary.
+func (s *Server) consistentRead(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tok := r.Header.Get(consistencyTokenHeader); tok != "" && !s.awaitToken(w, r, tok) {
+			return
+		}
+		level, maxStale, err := s.readConsistency(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+			return
+		}
+		if s.raft == nil && s.replica.Load() == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if level == readLocal {
+			if maxStale >= 0 {
+				if age, ok := s.staleness(); !ok || age > maxStale {
+					s.redirectUpstream(w, r)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.replica.Load() != nil || !s.raft.isLeader() {
+			s.redirectUpstream(w, r)
+			return
+		}
+		if level == readLinearizable {
+			if err := s.raft.readBarrier(r.Context()); err != nil {
+				writeStoreError(w, r, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readConsistency returns the consistency level of a read, and the
+// staleness it tolerates with ?max_staleness= or X-Max-Staleness, or -1
+// for any.
+func (s *Server) readConsistency(r *http.Request) (string, time.Duration, error) {
+	q := r.URL.Query()
+	level := cmp.Or(q.Get("consistency"), r.Header.Get("X-Read-Consistency"), s.cfg.ReadConsistency, readLocal)
+	switch level {
+	case readLocal, readLeader, readLinearizable:
+	default:
+		return "", 0, errors.New("consistency must be local, leader or linearizable")
+	}
+	v := cmp.Or(q.Get("max_staleness"), r.Header.Get("X-Max-Staleness"))
+	if v == "" {
+		return level, -1, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return "", 0, errors.New("max_staleness must be a duration such as \"2s\"")
+	}
+	if level != readLocal {
+		return "", 0, errors.New("max_staleness only applies to local reads")
+	}
+	return level, d, nil
+}
+
+// staleness returns how far behind the leader or the primary this node's
+// data may be, and false if that is not known. A leader is never behind.
+// A replica's contact with its primary is timed by the server's clock,
+// Raft's by the node's own.
+func (s *Server) staleness() (time.Duration, bool) {
+	if s.raft != nil {
+		return s.raft.staleness(time.Now())
+	}
+	if rp := s.replica.Load(); rp != nil {
+		return rp.staleness(s.clock.Now())
+	}
+	return 0, true
+}
+
+// staleness is how long ago this node, as a follower, last heard from the
+// leader with every entry then committed applied.
+func (n *raftNode) staleness(now time.Time) (time.Duration, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == raftLeader {
+		return 0, true
+	}
+	if n.heard.IsZero() || n.applied < n.commit {
+		return 0, false
+	}
+	return now.Sub(n.heard), true
+}
+
+// redirectUpstream sends r to the Raft leader or, on a replica, to the
+// primary.
+func (s *Server) redirectUpstream(w http.ResponseWriter, r *http.Request) {
+	if rp := s.replica.Load(); rp != nil {
+		http.Redirect(w, r, rp.primary+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+	s.redirectToLeader(w, r)
+}
+
+// redirectToLeader sends r to the current leader with a 307, or fails
+// with 503 while no leader is known.
+func (s *Server) redirectToLeader(w http.ResponseWriter, r *http.Request) {
+	leader := s.topology.primary()
+	if leader == nil {
+		s.topology.writeNoLeader(w, r)
+		return
+	}
+	http.Redirect(w, r, strings.TrimSuffix(leader.URL, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// GET
+//
+// clusterHandler reports this node's view of the Raft group.
+func (s *Server) clusterHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Clustering is not enabled")
+		return
+	}
+	st := s.raft.status()
+	if leader := s.topology.node(st.Leader); leader != nil {
+		st.LeaderURL = leader.URL
+	}
+	writeJSON(w, http.StatusOK, st)
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Files of a raftStorage directory.
+const (
+	raftLogPlain     = "log.ndjson"
+	raftLogSealed    = "log.sealed"
+	raftSnapshotFile = "snapshot"
+)
+
+// raftStorage keeps a Raft node's durable state in a directory: the
+// current term and vote in state.json, rewritten atomically; the snapshot
+// of the store the log starts after in snapshot; and the log since then,
+// one entry per line, in log.ndjson or, with an encryption key, in
+// log.sealed as the frames of a sealedWriter. The snapshot is encrypted
+// with the key too. Term, vote and log are synced before a node answers
+// an RPC that depends on them.
+type raftStorage struct {
+	dir string
+	kr  *keyRing    // nil unless the log and snapshot are encrypted
+	f   *os.File    // the log, opened for appending
+	w   flushWriter // what entries are encoded to, over f
+
+	// snapMu serializes writes of the snapshot, which the applier and
+	// snapshots installed by the leader both make.
+	snapMu    sync.Mutex
+	snapIndex uint64
+
+	// Loaded by openRaftStorage and handed to the node.
+	term    uint64
+	vote    string
+	base    raftEntry // the last entry of the snapshot
+	entries []raftEntry
+}
+
+type raftState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// raftSnapshot is the state of the store as of the entry at Index, of
+// Term: the entries that set every key it then held.
+type raftSnapshot struct {
+	Index uint64      `json:"index"`
+	Term  uint64      `json:"term"`
+	State []raftEntry `json:"state"`
+}
+
+func openRaftStorage(dir string, kr *keyRing) (*raftStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	// A directory made before its files were private is made so now.
+	if err := os.Chmod(dir, 0o700); err != nil {
+		return nil, err
+	}
+	st := &raftStorage{dir: dir, kr: kr}
+	buf, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var s raftState
+		if err := json.Unmarshal(buf, &s); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, "state.json"), err)
+		}
+		st.term, st.vote = s.Term, s.Vote
+	}
+
+	snap, err := st.loadSnapshot()
+	if err == nil {
+		st.base = raftEntry{Index: snap.Index, Term: snap.Term}
+		st.snapIndex = snap.Index
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, name := range []string{raftLogSealed, raftLogPlain} {
+		err := st.readLog(name)
+		if err == nil {
+			break
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	// Rewriting drops anything after the last good entry, and moves the
+	// log to the file the key ring calls for.
+	if err := st.rewrite(st.entries); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// readLog loads the entries of the log file name that follow the
+// snapshot.
+func (st *raftStorage) readLog(name string) error {
+	path := filepath.Join(st.dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if name == raftLogSealed {
+		if st.kr == nil {
+			return fmt.Errorf("%s is encrypted but no encryption key is configured", path)
+		}
+		r = newSealedReader(st.kr, r)
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<30)
+	for sc.Scan() {
+		var e raftEntry
+		// A torn last line, from a crash mid-append, ends the log.
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			break
+		}
+		if e.Index <= st.base.Index {
+			// Written before the snapshot was taken.
+			continue
+		}
+		if e.Index != st.base.Index+uint64(len(st.entries))+1 {
+			break
+		}
+		st.entries = append(st.entries, e)
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (st *raftStorage) saveState(term uint64, vote string) error {
+	buf, err := json.Marshal(raftState{Term: term, Vote: vote})
+	if err != nil {
+		return err
+	}
+	return st.replace("state.json", buf)
+}
+
+// logName returns the file the log is written to.
+func (st *raftStorage) logName() string {
+	if st.kr != nil {
+		return raftLogSealed
+	}
+	return raftLogPlain
+}
+
+// writer returns what entries are encoded to in w: a sealedWriter with
+// an encryption key, or w itself.
+func (st *raftStorage) writer(w *bufio.Writer) flushWriter {
+	if st.kr != nil {
+		return newSealedWriter(st.kr, w)
+	}
+	return w
+}
+
+// append adds entries to the end of the log.
+func (st *raftStorage) append(entries []raftEntry) error {
+	enc := json.NewEncoder(st.w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := st.w.Flush(); err != nil {
+		return err
+	}
+	return st.f.Sync()
+}
+
+// rewrite replaces the whole log with entries.
+func (st *raftStorage) rewrite(entries []raftEntry) error {
+	var buf bytes.Buffer
+	w := st.writer(bufio.NewWriter(&buf))
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	name := st.logName()
+	if err := st.replace(name, buf.Bytes()); err != nil {
+		return err
+	}
+	for _, other := range []string{raftLogPlain, raftLogSealed} {
+		if other != name {
+			if err := os.Remove(filepath.Join(st.dir, other)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	if st.f != nil {
+		st.f.Close()
+	}
+	f, err := os.OpenFile(filepath.Join(st.dir, name), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	st.f, st.w = f, st.writer(bufio.NewWriter(f))
+	return nil
+}
+
+// saveSnapshot replaces the snapshot with snap, unless the one saved
+// already is as recent.
+func (st *raftStorage) saveSnapshot(snap raftSnapshot) error {
+	st.snapMu.Lock()
+	defer st.snapMu.Unlock()
+	if snap.Index <= st.snapIndex {
+		return nil
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if st.kr != nil {
+		data = st.kr.seal(data)
+	}
+	if err := st.replace(raftSnapshotFile, data); err != nil {
+		return err
+	}
+	st.snapIndex = snap.Index
+	return nil
+}
+
+// loadSnapshot reads the snapshot, returning an error satisfying
+// os.ErrNotExist if none was taken yet.
+func (st *raftStorage) loadSnapshot() (raftSnapshot, error) {
+	path := filepath.Join(st.dir, raftSnapshotFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return raftSnapshot{}, err
+	}
+	if isEncrypted(data) {
+		if data, _, err = st.kr.open(data); err != nil {
+			return raftSnapshot{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	var snap raftSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return raftSnapshot{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return snap, nil
+}
+
+// replace atomically writes data to name in the storage directory.
+func (st *raftStorage) replace(name string, data []byte) error {
+	tmp, err := os.CreateTemp(st.dir, name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(st.dir, name))
+}
+
+func (st *raftStorage) close() error {
+	return st.f.Close()
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const maxRangeLimit = 10000
+
+// rangeResult is the body of a range scan. Entries are in key order, which
+// a JSON object cannot promise.
+type rangeResult struct {
+	Entries []snapshotEntry `json:"entries"`
+	// Next is the key to pass as from (or, in reverse, as to) to continue
+	// a scan cut short by limit.
+	Next string `json:"next,omitempty"`
+}
+
+// rangeScan answers GET /data?from=A&to=B with the keys k where
+// A <= k < B in lexicographic order; either bound may be left out.
+// ?reverse=true walks from the top of the range down and ?limit caps the
+// number of entries (default and maximum 10000). Without values in
+// fields only the keys are returned.
+func (s *Server) rangeScan(w http.ResponseWriter, r *http.Request, fields listFields) {
+	q := r.URL.Query()
+	limit := maxRangeLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid limit")
+			return
+		}
+		limit = min(n, maxRangeLimit)
+	}
+	reverse := q.Get("reverse") == "true"
+
+	ns := s.namespaceFrom(r.Context())
+	snap := visible(ns.store.Snapshot(), s.hiddenKeys(r.Context(), ns, false))
+	kr := keysInRange(snap.Between(q.Get("from"), q.Get("to")), limit, reverse)
+	if !fields.values {
+		writeKeyRange(w, r, kr)
+		return
+	}
+	res := rangeResult{Entries: make([]snapshotEntry, len(kr.Keys)), Next: kr.Next}
+	for i, k := range kr.Keys {
+		v, _ := snap.Get(k)
+		v, _ = s.reveal(r.Context(), k, v)
+		res.Entries[i] = snapshotEntry{Key: k, Value: v}
+	}
+	writeRange(w, r, res)
+}
+
+// keysInRange picks up to limit of keys, in order or in reverse, and the
+// key at which to continue when there are more.
+func keysInRange(keys []string, limit int, reverse bool) keyRange {
+	res := keyRange{Keys: make([]string, 0, min(len(keys), limit))}
+	for i := range keys {
+		k := keys[i]
+		if reverse {
+			k = keys[len(keys)-1-i]
+		}
+		if len(res.Keys) == limit {
+			if reverse {
+				// to is exclusive, so continuing below the last key
+				// returned starts at the key just passed.
+				res.Next = res.Keys[limit-1]
+			} else {
+				res.Next = k
+			}
+			break
+		}
+		res.Keys = append(res.Keys, k)
+	}
+	return res
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a per-client token bucket limiter. Clients are identified by
+// API key name when authenticated and by remote IP otherwise.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64
+	clock Clock
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiterIdle is how long a client's bucket is kept after its last
+// request.
+const rateLimiterIdle = 10 * time.Minute
+
+func newRateLimiter(rate float64, burst int, clock Clock) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: clock.Now(),
+		clock:     clock,
+	}
+}
+
+// allow takes a token for client, returning how long to wait when none is
+// available.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > rateLimiterIdle {
+		for id, b := range l.buckets {
+			if now.Sub(b.last) > rateLimiterIdle {
+				delete(l.buckets, id)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// clientKey identifies the caller for per-client accounting.
+func clientKey(r *http.Request) string {
+	return clientKeyFor(clientIDFrom(r.Context()), remoteHost(r))
+}
+
+// clientKeyFor identifies the caller authenticated as the API key id, or
+// by its address remote for anonymous requests.
+func clientKeyFor(id, remote string) string {
+	if id != "" {
+		return "key:" + id
+	}
+	return remote
+}
+
+// withRateLimit answers 429 once a client exceeds its request budget.
+func withRateLimit(l *rateLimiter) Middleware {
+	if l == nil {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, wait := l.allow(clientKey(r), l.clock.Now())
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, r, http.StatusTooManyRequests, codeRateLimited, "Rate limit exceeded")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import "time"
+
+// rateWindows are the windows the background worker computes rates over,
+// by the names they have in /stats.
+var rateWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+// windowRates are the rates of change of the counters over one window.
+// Seconds is how much of the window the history covers: less than the
+// window while the server is younger than it.
+type windowRates struct {
+	Seconds        float64 `json:"seconds"`
+	WritesPerSec   float64 `json:"writes_per_sec"`
+	DeletesPerSec  float64 `json:"deletes_per_sec"`
+	RequestsPerSec float64 `json:"requests_per_sec"`
+	ErrorsPerSec   float64 `json:"errors_per_sec"`
+	// ErrorRate is the fraction of the window's requests that failed.
+	ErrorRate float64 `json:"error_rate"`
+	// DataSizeGrowth is the change in the number of keys, which is
+	// negative when the store shrank.
+	DataSizeGrowth int     `json:"data_size_growth"`
+	DataSizePerSec float64 `json:"data_size_per_sec"`
+}
+
+// before returns the newest snapshot taken at or before t, or the oldest
+// one if the ring does not reach back that far.
+func (r *statsRing) before(t time.Time) (statsSnapshot, bool) {
+	if r.n == 0 {
+		return statsSnapshot{}, false
+	}
+	found := r.buf[r.start]
+	for i := 1; i < r.n; i++ {
+		snap := r.buf[(r.start+i)%len(r.buf)]
+		if snap.Time.After(t) {
+			break
+		}
+		found = snap
+	}
+	return found, true
+}
+
+// rates computes the rates of change between the snapshots of each
+// window and cur, the latest one. Windows the history does not cover at
+// all yet are left out.
+func (r *statsRing) rates(cur statsSnapshot) map[string]windowRates {
+	out := make(map[string]windowRates, len(rateWindows))
+	for _, w := range rateWindows {
+		old, ok := r.before(cur.Time.Add(-w.d))
+		elapsed := cur.Time.Sub(old.Time).Seconds()
+		if !ok || elapsed <= 0 {
+			continue
+		}
+		requests := counterDelta(old.TotalRequests, cur.TotalRequests)
+		errors := counterDelta(old.Errors, cur.Errors)
+		wr := windowRates{
+			Seconds:        elapsed,
+			WritesPerSec:   float64(counterDelta(old.Writes, cur.Writes)) / elapsed,
+			DeletesPerSec:  float64(counterDelta(old.Deletes, cur.Deletes)) / elapsed,
+			RequestsPerSec: float64(requests) / elapsed,
+			ErrorsPerSec:   float64(errors) / elapsed,
+			DataSizeGrowth: cur.DataSize - old.DataSize,
+		}
+		if total := requests + errors; total > 0 {
+			wr.ErrorRate = float64(errors) / float64(total)
+		}
+		wr.DataSizePerSec = float64(wr.DataSizeGrowth) / elapsed
+		out[w.name] = wr
+	}
+	return out
+}
+
+// counterDelta is how much a counter grew from a to b. A counter smaller
+// than before has been reset by POST /stats/reset, so all of b is new.
+func counterDelta(a, b int) int {
+	if b < a {
+		return b
+	}
+	return b - a
+}
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Redis RDB opcodes and the value types that can be skipped. Types not
+// listed here (modules, streams, hashes with field expiry) cannot be skipped
+// without decoding them and make the import fail.
+const (
+	rdbOpSlotInfo     = 0xF4
+	rdbOpFunction2    = 0xF5
+	rdbOpIdle         = 0xF8
+	rdbOpFreq         = 0xF9
+	rdbOpAux          = 0xFA
+	rdbOpResizeDB     = 0xFB
+	rdbOpExpireTimeMS = 0xFC
+	rdbOpExpireTime   = 0xFD
+	rdbOpSelectDB     = 0xFE
+	rdbOpEOF          = 0xFF
+
+	rdbTypeString         = 0
+	rdbTypeList           = 1
+	rdbTypeSet            = 2
+	rdbTypeZSet           = 3
+	rdbTypeHash           = 4
+	rdbTypeZSet2          = 5
+	rdbTypeHashZipmap     = 9
+	rdbTypeListZiplist    = 10
+	rdbTypeSetIntset      = 11
+	rdbTypeZSetZiplist    = 12
+	rdbTypeHashZiplist    = 13
+	rdbTypeListQuicklist  = 14
+	rdbTypeHashListpack   = 16
+	rdbTypeZSetListpack   = 17
+	rdbTypeListQuicklist2 = 18
+	rdbTypeSetListpack    = 20
+)
+
+// Special string encodings, flagged by the top bits of a length.
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// rdbMaxString is Redis's own limit on the size of a string.
+const rdbMaxString = 512 << 20
+
+// rdbCRCTable is for the CRC-64 variant (Jones) Redis checksums dumps
+// with; the polynomial is in its reversed form.
+var rdbCRCTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+// rdbReader reads the string keys of one database of a Redis RDB dump as
+// export entries, for POST /import?format=rdb. Keys of other types are
+// counted in skipped and left out, as are keys that had already expired
+// when the dump is read; keys with a TTL in the future keep what is left
+// of it, as a fixed expiry. The CRC-64 trailer, when the
+// dump has one, is checked once the whole dump is read.
+type rdbReader struct {
+	br      *bufio.Reader
+	crc     uint64 // Redis's CRC-64 (Jones) of the bytes read so far
+	db      uint64
+	now     time.Time
+	version int
+	skipped int
+
+	curDB    uint64
+	expireAt time.Time
+	done     bool
+}
+
+func newRDBReader(r io.Reader, db uint64) *rdbReader {
+	return &rdbReader{br: bufio.NewReader(r), db: db, now: time.Now(), version: -1}
+}
+
+func (rr *rdbReader) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rr.br, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rr.crc = ^crc64.Update(^rr.crc, rdbCRCTable, buf)
+	return buf, nil
+}
+
+func (rr *rdbReader) byte() (byte, error) {
+	b, err := rr.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// length reads a length-encoded integer. With encoded set, the value is
+// instead one of the special string encodings.
+func (rr *rdbReader) length() (n uint64, encoded bool, err error) {
+	b, err := rr.byte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := rr.byte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case 2:
+		switch b {
+		case 0x80:
+			buf, err := rr.read(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := rr.read(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		}
+		return 0, false, fmt.Errorf("invalid length encoding 0x%02x", b)
+	}
+	return uint64(b & 0x3f), true, nil
+}
+
+func (rr *rdbReader) plainLength() (uint64, error) {
+	n, encoded, err := rr.length()
+	if err == nil && encoded {
+		err = errors.New("unexpected string encoding in a length")
+	}
+	return n, err
+}
+
+func (rr *rdbReader) string() (string, error) {
+	n, encoded, err := rr.length()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		if n > rdbMaxString {
+			return "", fmt.Errorf("string of %d bytes is too long", n)
+		}
+		buf, err := rr.read(int(n))
+		return string(buf), err
+	}
+	switch n {
+	case rdbEncInt8:
+		buf, err := rr.read(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(buf[0]))), nil
+	case rdbEncInt16:
+		buf, err := rr.read(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case rdbEncInt32:
+		buf, err := rr.read(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	case rdbEncLZF:
+		clen, err := rr.plainLength()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := rr.plainLength()
+		if err != nil {
+			return "", err
+		}
+		if clen > rdbMaxString || ulen > rdbMaxString {
+			return "", errors.New("compressed string is too long")
+		}
+		buf, err := rr.read(int(clen))
+		if err != nil {
+			return "", err
+		}
+		out, err := lzfDecompress(buf, int(ulen))
+		return string(out), err
+	}
+	return "", fmt.Errorf("unknown string encoding %d", n)
+}
+
+// lzfDecompress expands data compressed with LZF, as Redis compresses
+// long strings, into exactly n bytes.
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			run := ctrl + 1
+			if i+run > len(in) {
+				return nil, errors.New("truncated LZF literal")
+			}
+			out = append(out, in[i:i+run]...)
+			i += run
+			continue
+		}
+		run := ctrl >> 5
+		if run == 7 {
+			if i >= len(in) {
+				return nil, errors.New("truncated LZF back reference")
+			}
+			run += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("truncated LZF back reference")
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errors.New("LZF back reference before the start")
+		}
+		for j := 0; j < run+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, fmt.Errorf("LZF data expands to %d bytes, want %d", len(out), n)
+	}
+	return out, nil
+}
+
+// skipStrings skips n strings.
+func (rr *rdbReader) skipStrings(n uint64) error {
+	for ; n > 0; n-- {
+		if _, err := rr.string(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipValue skips a value of a type other than string.
+func (rr *rdbReader) skipValue(typ byte) error {
+	switch typ {
+	case rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZSetZiplist,
+		rdbTypeHashZiplist, rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+		// A single blob.
+		return rr.skipStrings(1)
+	}
+	n, err := rr.plainLength()
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuicklist:
+		return rr.skipStrings(n)
+	case rdbTypeHash:
+		return rr.skipStrings(2 * n)
+	case rdbTypeZSet:
+		for ; n > 0; n-- {
+			if _, err := rr.string(); err != nil {
+				return err
+			}
+			// The score is a length byte and its text, or 253, 254 and 255
+			// alone for NaN, +inf and -inf.
+			l, err := rr.byte()
+			if err != nil {
+				return err
+			}
+			if l < 253 {
+				if _, err := rr.read(int(l)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case rdbTypeZSet2:
+		for ; n > 0; n-- {
+			if _, err := rr.string(); err != nil {
+				return err
+			}
+			if _, err := rr.read(8); err != nil {
+				return err
+			}
+		}
+		return nil
+	case rdbTypeListQuicklist2:
+		for ; n > 0; n-- {
+			if _, err := rr.plainLength(); err != nil { // container kind
+				return err
+			}
+			if err := rr.skipStrings(1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported value type %d", typ)
+}
+
+func (rr *rdbReader) header() error {
+	buf, err := rr.read(9)
+	if err != nil || string(buf[:5]) != "REDIS" {
+		return errors.New("not a Redis RDB dump")
+	}
+	if rr.version, err = strconv.Atoi(string(buf[5:])); err != nil {
+		return errors.New("not a Redis RDB dump")
+	}
+	return nil
+}
+
+// next returns the next string key of the database, or io.EOF after the
+// last one.
+func (rr *rdbReader) next() (snapshotEntry, error) {
+	if rr.version < 0 {
+		if err := rr.header(); err != nil {
+			return snapshotEntry{}, err
+		}
+	}
+	for !rr.done {
+		op, err := rr.byte()
+		if err != nil {
+			return snapshotEntry{}, err
+		}
+		switch op {
+		case rdbOpEOF:
+			rr.done = true
+			if err := rr.checksum(); err != nil {
+				return snapshotEntry{}, err
+			}
+			continue
+		case rdbOpSelectDB:
+			if rr.curDB, err = rr.plainLength(); err != nil {
+				return snapshotEntry{}, err
+			}
+			continue
+		case rdbOpResizeDB:
+			if _, err = rr.plainLength(); err == nil {
+				_, err = rr.plainLength()
+			}
+		case rdbOpSlotInfo:
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = rr.plainLength()
+			}
+		case rdbOpAux:
+			err = rr.skipStrings(2)
+		case rdbOpFunction2:
+			err = rr.skipStrings(1)
+		case rdbOpIdle:
+			_, err = rr.plainLength()
+		case rdbOpFreq:
+			_, err = rr.byte()
+		case rdbOpExpireTime:
+			var buf []byte
+			if buf, err = rr.read(4); err == nil {
+				rr.expireAt = time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
+			}
+		case rdbOpExpireTimeMS:
+			var buf []byte
+			if buf, err = rr.read(8); err == nil {
+				rr.expireAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(buf)))
+			}
+		default:
+			e, keep, err := rr.entry(op)
+			if err != nil {
+				return snapshotEntry{}, err
+			}
+			if keep {
+				return e, nil
+			}
+		}
+		if err != nil {
+			return snapshotEntry{}, err
+		}
+	}
+	return snapshotEntry{}, io.EOF
+}
+
+// entry reads a key and its value of type typ, reporting whether it is to
+// be imported.
+func (rr *rdbReader) entry(typ byte) (snapshotEntry, bool, error) {
+	expireAt := rr.expireAt
+	rr.expireAt = time.Time{}
+	key, err := rr.string()
+	if err != nil {
+		return snapshotEntry{}, false, err
+	}
+	if typ != rdbTypeString {
+		if err := rr.skipValue(typ); err != nil {
+			return snapshotEntry{}, false, fmt.Errorf("key %q: %w", key, err)
+		}
+		if rr.curDB == rr.db {
+			rr.skipped++
+		}
+		return snapshotEntry{}, false, nil
+	}
+	value, err := rr.string()
+	if err != nil {
+		return snapshotEntry{}, false, fmt.Errorf("key %q: %w", key, err)
+	}
+	keep := rr.curDB == rr.db && (expireAt.IsZero() || expireAt.After(rr.now))
+	e := snapshotEntry{Key: key, Value: value}
+	if !expireAt.IsZero() {
+		e.TTL = expireAt.Sub(rr.now)
+	}
+	return e, keep, nil
+}
+
+// checksum checks the CRC-64 trailer of dumps from RDB version 5 on. A
+// zero checksum means Redis was configured not to compute one.
+func (rr *rdbReader) checksum() error {
+	if rr.version < 5 {
+		return nil
+	}
+	want := rr.crc
+	buf, err := rr.read(8)
+	if err != nil {
+		return fmt.Errorf("checksum: %w", err)
+	}
+	if got := binary.LittleEndian.Uint64(buf); got != 0 && got != want {
+		return fmt.Errorf("checksum mismatch: dump says %016x, data is %016x", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rebalanceBatchSize is the most keys sent to a new owner in one request.
+const rebalanceBatchSize = 100
+
+// defaultRebalanceRate is how many keys per second a node moves to their
+// new owners by default.
+const defaultRebalanceRate = 500
+
+// rebalanceResends is how many times a node sends a key again that was
+// written while it was being moved before it gives up until the next try.
+const rebalanceResends = 3
+
+// rebalanceRetry is how long a node waits to move the keys it failed to
+// move again.
+const rebalanceRetry = 10 * time.Second
+
+// rebalanceBatch is the body of POST /cluster/rebalance, which peers send
+// each other while rebalancing: keys the receiver now owns, or, with Done
+// set, word that the sender has moved all of its keys to Ring. Resend
+// marks keys written at the sender while it moved them, which replace the
+// copies it sent.
+type rebalanceBatch struct {
+	From    string      `json:"from"`
+	Ring    string      `json:"ring"`
+	Entries []replEntry `json:"entries,omitempty"`
+	Resend  bool        `json:"resend,omitempty"`
+	Done    bool        `json:"done,omitempty"`
+}
+
+// rebalanceStatus is the GET /cluster/rebalance response. State is "idle"
+// before the ring first changes, "moving" while this node sends keys to
+// their new owners, "waiting" once it has while other nodes still send it
+// theirs, and "done". Received and DualReads count since the node started.
+type rebalanceStatus struct {
+	State     string     `json:"state"`
+	Ring      string     `json:"ring,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Rate      int        `json:"rate"`
+	Scanned   int        `json:"keys_scanned"`
+	ToMove    int        `json:"keys_to_move"`
+	Moved     int        `json:"keys_moved"`
+	Failed    int        `json:"keys_failed"`
+	Received  int        `json:"keys_received"`
+	DualReads int64      `json:"dual_reads"`
+	Waiting   []string   `json:"waiting_for,omitempty"` // nodes still moving keys here
+}
+
+// rebalancer moves keys to their owners after discovery changes the hash
+// ring. Every node sends the keys it no longer owns to their new owner,
+// at most rate a second, deleting each once the owner has it, and then
+// tells every node of the ring it is done. Until they all have, a request
+// for a key this node now owns but does not hold yet is served by its
+// previous owner, so that no key goes missing meanwhile. The previous
+// owner is the owner on the ring before the change or, for a key this
+// node owned on it too, as a node that just joined does, on the ring
+// without this node.
+//
+// Keys are sent create-only: one written to its new owner since the ring
+// changed is newer than the copy being moved, which is dropped. A key is
+// deleted only if it was not written after it was sent, by a request that
+// reached this node before it saw the change; it is sent again instead.
+type rebalancer struct {
+	s      *Server
+	rate   int
+	secret string
+	client *http.Client
+	kick   chan struct{}
+
+	mu     sync.Mutex
+	prev   *hashRing                  // the ring before the change, while dual reads are on
+	others *hashRing                  // the ring without this node, while dual reads are on
+	ring   *hashRing                  // the ring being moved to
+	done   map[string]map[string]bool // nodes done moving, by ring version
+	status rebalanceStatus
+}
+
+func newRebalancer(s *Server, rate int, secret string) *rebalancer {
+	if rate <= 0 {
+		rate = defaultRebalanceRate
+	}
+	return &rebalancer{
+		s:      s,
+		rate:   rate,
+		secret: secret,
+		client: &http.Client{Timeout: 30 * time.Second},
+		kick:   make(chan struct{}, 1),
+		done:   make(map[string]map[string]bool),
+		status: rebalanceStatus{State: "idle", Rate: rate},
+	}
+}
+
+// begin starts moving keys from prev to next. A change during a rebalance
+// starts it over; dual reads then go to the owners of the latest ring
+// before it.
+func (rb *rebalancer) begin(prev, next *hashRing) {
+	now := time.Now().UTC()
+	var others []topologyNode
+	for _, id := range next.nodes {
+		if id != rb.s.topology.Self {
+			others = append(others, topologyNode{ID: id})
+		}
+	}
+	rb.mu.Lock()
+	rb.prev, rb.ring = prev, next
+	rb.others = newHashRing(others, next.vnodes)
+	// Nodes may have told this one they are done before it saw the change.
+	for v := range rb.done {
+		if v != next.version {
+			delete(rb.done, v)
+		}
+	}
+	st := rb.status
+	rb.status = rebalanceStatus{State: "moving", Ring: next.version, Started: &now, Rate: rb.rate,
+		Received: st.Received, DualReads: st.DualReads}
+	rb.mu.Unlock()
+	rb.s.logger.Printf("[Rebalance] Ring changed to %s; moving keys", next.version)
+	select {
+	case rb.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run moves keys whenever the ring changes, until stop is closed.
+func (rb *rebalancer) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-rb.kick:
+		case <-stop:
+			return
+		}
+		if !rb.move(stop) {
+			time.AfterFunc(rebalanceRetry, func() {
+				select {
+				case rb.kick <- struct{}{}:
+				default:
+				}
+			})
+		}
+	}
+}
+
+// previousOwner returns the owner of key before the ring changed, or ""
+// once the rebalance is over.
+func (rb *rebalancer) previousOwner(key string) string {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.prev == nil {
+		return ""
+	}
+	if owner := rb.prev.owner(key); owner != rb.s.topology.Self {
+		return owner
+	}
+	if len(rb.others.points) == 0 {
+		return ""
+	}
+	return rb.others.owner(key)
+}
+
+// move sends every key this node holds but no longer owns to its owner,
+// then tells the other nodes it is done. It reports false if any key or
+// notice could not be sent, to be tried again.
+func (rb *rebalancer) move(stop <-chan struct{}) bool {
+	rb.mu.Lock()
+	ring := rb.ring
+	rb.status.Scanned, rb.status.ToMove, rb.status.Moved, rb.status.Failed = 0, 0, 0, 0
+	rb.mu.Unlock()
+	if ring == nil {
+		return true
+	}
+	self := rb.s.topology.Self
+
+	// Find what to move first, so that progress has a total.
+	type pending struct {
+		ns   *namespace
+		keys []string
+	}
+	byOwner := make(map[string][]pending)
+	scanned, toMove := 0, 0
+	for _, ns := range rb.s.namespaces.list() {
+		moving := make(map[string][]string)
+		for _, k := range ns.store.Snapshot().keys {
+			scanned++
+			if owner := ring.owner(k); owner != self {
+				moving[owner] = append(moving[owner], k)
+				toMove++
+			}
+		}
+		for owner, keys := range moving {
+			byOwner[owner] = append(byOwner[owner], pending{ns, keys})
+		}
+	}
+	rb.mu.Lock()
+	rb.status.Scanned, rb.status.ToMove = scanned, toMove
+	rb.mu.Unlock()
+
+	ok := true
+	for owner, parts := range byOwner {
+		for _, part := range parts {
+			for i := 0; i < len(part.keys); i += rebalanceBatchSize {
+				if rb.superseded(ring) {
+					return true
+				}
+				keys := part.keys[i:min(i+rebalanceBatchSize, len(part.keys))]
+				n, err := rb.send(owner, ring, part.ns, keys)
+				rb.mu.Lock()
+				rb.status.Moved += n
+				if err != nil {
+					rb.status.Failed += len(keys) - n
+				}
+				rb.mu.Unlock()
+				if err != nil {
+					rb.s.logger.Printf("[Rebalance] Moving %d keys to %s: %v", len(keys), owner, err)
+					ok = false
+					break
+				}
+				// Throttle to rate keys a second.
+				select {
+				case <-time.After(time.Duration(len(keys)) * time.Second / time.Duration(rb.rate)):
+				case <-stop:
+					return true
+				}
+			}
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	for _, id := range ring.nodes {
+		if id == self {
+			continue
+		}
+		if err := rb.post(id, rebalanceBatch{From: self, Ring: ring.version, Done: true}); err != nil {
+			rb.s.logger.Printf("[Rebalance] Telling %s the move is done: %v", id, err)
+			ok = false
+		}
+	}
+	if ok {
+		rb.mu.Lock()
+		if rb.ring == ring && rb.status.State == "moving" {
+			rb.status.State = "waiting"
+			rb.finishLocked()
+		}
+		rb.mu.Unlock()
+	}
+	return ok
+}
+
+// superseded reports whether the ring changed again since ring.
+func (rb *rebalancer) superseded(ring *hashRing) bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.ring != ring
+}
+
+// send moves keys of ns to owner, returning how many it moved. Each key
+// is sent as it is now and then deleted, unless it was written in between:
+// then it is sent again to replace the copy the owner has, up to
+// rebalanceResends times.
+func (rb *rebalancer) send(owner string, ring *hashRing, ns *namespace, keys []string) (int, error) {
+	moved := 0
+	for attempt := 0; len(keys) > 0; attempt++ {
+		if attempt > rebalanceResends {
+			return moved, fmt.Errorf("%d keys kept changing while being moved", len(keys))
+		}
+		batch := rebalanceBatch{From: rb.s.topology.Self, Ring: ring.version, Resend: attempt > 0}
+		var revs []uint64
+		for _, k := range keys {
+			// The revision is read first: if the value is newer, deleting
+			// at it fails and the key is sent again.
+			rev := revisionOf(ns.store, k)
+			v, ok := peekValue(ns.store, k)
+			if !ok {
+				continue
+			}
+			batch.Entries = append(batch.Entries, replEntry{Op: "set", NS: ns.name, Key: k, Value: v,
+				Type: ns.types.get(k), Tags: ns.tags.get(k), Expiry: ns.expiries.get(k)})
+			revs = append(revs, rev)
+		}
+		if len(batch.Entries) == 0 {
+			break
+		}
+		if err := rb.post(owner, batch); err != nil {
+			return moved, err
+		}
+		keys = nil
+		for i, e := range batch.Entries {
+			var err error
+			if revs[i] != 0 {
+				err = rb.s.applyDelete(withDeleteAt(context.Background(), revs[i]), ns, e.Key)
+			} else if v, ok := peekValue(ns.store, e.Key); ok && v != e.Value {
+				// The store does not track revisions.
+				err = ErrConflict
+			} else {
+				err = rb.s.applyDelete(context.Background(), ns, e.Key)
+			}
+			switch {
+			case err == nil, errors.Is(err, ErrKeyNotFound):
+				moved++
+			case errors.Is(err, ErrConflict):
+				keys = append(keys, e.Key)
+			default:
+				moved++
+				rb.s.logger.Printf("[Rebalance] Deleting moved key %q: %v", e.Key, err)
+			}
+		}
+	}
+	return moved, nil
+}
+
+func (rb *rebalancer) post(id string, batch rebalanceBatch) error {
+	node := rb.s.topology.node(id)
+	if node == nil {
+		return fmt.Errorf("node %s left", id)
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(node.URL, "/")+"/cluster/rebalance", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if rb.secret != "" {
+		req.Header.Set("X-Raft-Secret", rb.secret)
+	}
+	res, err := rb.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New(res.Status)
+	}
+	return nil
+}
+
+// finishLocked ends the rebalance once this node has moved its keys and
+// every other node of the ring has said it moved its own.
+func (rb *rebalancer) finishLocked() {
+	if rb.status.State != "waiting" {
+		return
+	}
+	self := rb.s.topology.Self
+	var waiting []string
+	for _, id := range rb.ring.nodes {
+		if id != self && !rb.done[rb.ring.version][id] {
+			waiting = append(waiting, id)
+		}
+	}
+	rb.status.Waiting = waiting
+	if len(waiting) > 0 {
+		return
+	}
+	now := time.Now().UTC()
+	rb.prev, rb.others = nil, nil
+	rb.status.State = "done"
+	rb.status.Finished = &now
+	rb.s.logger.Printf("[Rebalance] Ring %s is balanced: moved %d keys, received %d", rb.ring.version, rb.status.Moved, rb.status.Received)
+}
+
+// handler serves POST /cluster/rebalance for the other nodes. Like gossip
+// it sits outside the API middleware and authenticates them with the
+// cluster secret, if one is set.
+func (rb *rebalancer) handler(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Raft-Secret")), []byte(rb.secret)) != 1 {
+		writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid cluster secret")
+		return
+	}
+	var batch rebalanceBatch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+		return
+	}
+	if batch.Done {
+		rb.mu.Lock()
+		if rb.done[batch.Ring] == nil {
+			rb.done[batch.Ring] = make(map[string]bool)
+		}
+		rb.done[batch.Ring][batch.From] = true
+		if rb.ring != nil && rb.ring.version == batch.Ring {
+			rb.finishLocked()
+		}
+		rb.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]int{})
+		return
+	}
+	received := 0
+	for _, e := range batch.Entries {
+		ctx := context.WithValue(r.Context(), replayKey, true)
+		if !batch.Resend {
+			ctx = withCreateOnly(ctx)
+		}
+		err := rb.s.applyReplicated(ctx, e)
+		switch {
+		case err == nil:
+			received++
+		case errors.Is(err, ErrKeyExists):
+			// Written here since the ring changed.
+		default:
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+	rb.mu.Lock()
+	rb.status.Received += received
+	rb.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]int{"received": received})
+}
+
+// dualRead serves r at the previous owner of key if this node owns it but
+// does not hold it yet, reporting whether it did. PUT replaces the value
+// whatever it was and is always served by the new owner.
+func (rb *rebalancer) dualRead(w http.ResponseWriter, r *http.Request, sr *shardRouter, key string) bool {
+	if r.Method == http.MethodPut {
+		return false
+	}
+	prev := rb.previousOwner(key)
+	if prev == "" || prev == sr.topo.Self {
+		return false
+	}
+	ns := rb.s.namespaces.def
+	if name := r.PathValue("namespace"); name != "" {
+		if ns = rb.s.namespaces.get(name, false); ns == nil {
+			return false
+		}
+	}
+	if _, ok := peekValue(ns.store, key); ok {
+		return false
+	}
+	sr.mu.RLock()
+	proxy := sr.proxies[prev]
+	sr.mu.RUnlock()
+	if proxy == nil {
+		return false
+	}
+	rb.mu.Lock()
+	rb.status.DualReads++
+	rb.mu.Unlock()
+	w.Header().Set("X-Shard-Node", prev)
+	r.Header.Set(forwardedHeader, sr.topo.Self)
+	proxy.ServeHTTP(w, r)
+	return true
+}
+
+// GET
+//
+// rebalanceHandler reports the progress of the latest rebalance.
+func (s *Server) rebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if s.rebalance == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Sharding is not enabled")
+		return
+	}
+	s.rebalance.mu.Lock()
+	st := s.rebalance.status
+	s.rebalance.mu.Unlock()
+	writeJSON(w, http.StatusOK, st)
+}
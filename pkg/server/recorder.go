@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultRecordBodyLimit = 64 << 10
+	defaultRecordingLimit  = 100
+	maxRecordingLimit      = 1000
+)
+
+// recordedHeaders are the headers whose values are left out of recordings,
+// as they carry credentials. The signature of a signed request is sent in
+// Authorization.
+var recordedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"X-Raft-Secret":       true,
+	confirmHeader:         true,
+}
+
+// recordedParams are the query parameters left out of recordings.
+var recordedParams = []string{"api_key", "access_token", "secret"}
+
+// recordedBody is a captured request or response body, up to the body
+// limit.
+type recordedBody struct {
+	Body string `json:"body,omitempty"`
+	// Encoding is "base64" for a body that is not UTF-8 text.
+	Encoding  string `json:"body_encoding,omitempty"`
+	Size      int64  `json:"body_size"`
+	Truncated bool   `json:"body_truncated,omitempty"`
+}
+
+func captureBody(b []byte, size int64, limit int) recordedBody {
+	rb := recordedBody{Size: size}
+	if len(b) > limit {
+		b, rb.Truncated = b[:limit], true
+	}
+	if utf8.Valid(b) {
+		rb.Body = string(b)
+	} else {
+		rb.Body, rb.Encoding = base64.StdEncoding.EncodeToString(b), "base64"
+	}
+	return rb
+}
+
+type recordedRequest struct {
+	Method string `json:"method"`
+	// URL is the path and query the request was sent to.
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	recordedBody
+}
+
+type recordedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	recordedBody
+}
+
+// recording is one captured request and the response it got.
+type recording struct {
+	Seq        uint64           `json:"seq"`
+	Time       time.Time        `json:"time"`
+	RequestID  string           `json:"request_id,omitempty"`
+	DurationMS float64          `json:"duration_ms"`
+	Request    recordedRequest  `json:"request"`
+	Response   recordedResponse `json:"response"`
+}
+
+// recorder keeps the most recent requests and responses in memory for
+// /admin/recordings, and appends every one to a file as NDJSON when one
+// is configured, for replaying with "server replay". Credentials are left
+// out: the headers of recordedHeaders, the query parameters of
+// recordedParams and the bodies of the /auth routes, which carry tokens.
+// So are the bodies of requests handlers mark with redactRecording: those
+// of keys stored encrypted or tagged to be masked, and confirmation tokens.
+type recorder struct {
+	bodyLimit int
+
+	mu    sync.Mutex
+	seq   uint64
+	ring  []recording
+	start int
+	size  int
+
+	file *os.File
+	w    *bufio.Writer
+}
+
+func newRecorder(size int, path string, bodyLimit int) (*recorder, error) {
+	if bodyLimit <= 0 {
+		bodyLimit = defaultRecordBodyLimit
+	}
+	rec := &recorder{size: size, bodyLimit: bodyLimit}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		rec.file = f
+		rec.w = bufio.NewWriter(f)
+	}
+	return rec, nil
+}
+
+func (rec *recorder) append(e recording) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.seq++
+	e.Seq = rec.seq
+	if rec.size > 0 {
+		if len(rec.ring) < rec.size {
+			rec.ring = append(rec.ring, e)
+		} else {
+			rec.ring[rec.start] = e
+			rec.start = (rec.start + 1) % rec.size
+		}
+	}
+	if rec.w != nil {
+		json.NewEncoder(rec.w).Encode(e)
+		rec.w.Flush()
+	}
+}
+
+// recordingFilter selects recordings for /admin/recordings.
+type recordingFilter struct {
+	method, prefix, requestID string
+	status                    int
+	after                     uint64
+}
+
+func (f recordingFilter) match(e recording) bool {
+	return (f.method == "" || e.Request.Method == f.method) &&
+		strings.HasPrefix(e.Request.URL, f.prefix) &&
+		(f.requestID == "" || e.RequestID == f.requestID) &&
+		(f.status == 0 || e.Response.Status == f.status) &&
+		e.Seq > f.after
+}
+
+// query returns up to limit matching recordings, newest first. limit <= 0
+// returns every match, oldest first, for export.
+func (rec *recorder) query(f recordingFilter, limit int) []recording {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	n := len(rec.ring)
+	out := []recording{}
+	if limit <= 0 {
+		for i := 0; i < n; i++ {
+			if e := rec.ring[(rec.start+i)%n]; f.match(e) {
+				out = append(out, e)
+			}
+		}
+		return out
+	}
+	for i := n - 1; i >= 0 && len(out) < limit; i-- {
+		if e := rec.ring[(rec.start+i)%n]; f.match(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// clear forgets the recordings held in memory; the file is left alone.
+func (rec *recorder) clear() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	n := len(rec.ring)
+	rec.ring, rec.start = nil, 0
+	return n
+}
+
+func (rec *recorder) close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		return nil
+	}
+	rec.w.Flush()
+	return rec.file.Close()
+}
+
+// sanitizeHeader copies h without the values of credential headers.
+func sanitizeHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for name := range out {
+		if recordedHeaders[name] {
+			out[name] = []string{redacted}
+		}
+	}
+	return out
+}
+
+// sanitizeURL returns the path and query of u without credential
+// parameters.
+func sanitizeURL(u *url.URL) string {
+	q := u.Query()
+	changed := false
+	for _, name := range recordedParams {
+		if q.Has(name) {
+			q.Set(name, redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return u.RequestURI()
+	}
+	return u.EscapedPath() + "?" + q.Encode()
+}
+
+// recordedWriter passes a response through while keeping a copy of its
+// first limit bytes, and one more to tell that it was cut short.
+type recordedWriter struct {
+	*responseWriter
+	limit int
+	body  bytes.Buffer
+}
+
+func (w *recordedWriter) Write(b []byte) (int, error) {
+	if room := w.limit + 1 - w.body.Len(); room > 0 {
+		w.body.Write(b[:min(len(b), room)])
+	}
+	return w.responseWriter.Write(b)
+}
+
+// redactRecording leaves the request and response bodies of the request
+// ctx belongs to out of its recording.
+func redactRecording(ctx context.Context) {
+	if slot, ok := ctx.Value(redactSlotKey).(*bool); ok {
+		*slot = true
+	}
+}
+
+// withRecording records every request and its response when a recorder
+// is configured. The first bodyLimit bytes of the request body are read
+// ahead of the handler, so that what was sent is captured even if the
+// handler does not read it. Upgrades, probes and the recordings
+// themselves are not recorded.
+func (s *Server) withRecording(next http.Handler) http.Handler {
+	rec := s.recorder
+	if rec == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, apiPrefix)
+		if r.Header.Get("Upgrade") != "" || strings.HasPrefix(p, "/admin/recordings") ||
+			p == "/healthz" || p == "/readyz" || p == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		head, _ := io.ReadAll(io.LimitReader(r.Body, int64(rec.bodyLimit)+1))
+		body := &countingReader{ReadCloser: struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}}
+		r.Body = body
+		var redact bool
+		r = r.WithContext(context.WithValue(r.Context(), redactSlotKey, &redact))
+		e := recording{
+			Time:      start.UTC(),
+			RequestID: requestIDFrom(r.Context()),
+			Request: recordedRequest{
+				Method: r.Method,
+				URL:    sanitizeURL(r.URL),
+				Header: sanitizeHeader(r.Header),
+			},
+		}
+		rw := &recordedWriter{responseWriter: wrapResponseWriter(w), limit: rec.bodyLimit}
+		next.ServeHTTP(rw, r)
+
+		e.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+		e.Request.recordedBody = captureBody(head, max(body.n, int64(len(head))), rec.bodyLimit)
+		e.Response = recordedResponse{
+			Status:       rw.status,
+			Header:       sanitizeHeader(rw.Header()),
+			recordedBody: captureBody(rw.body.Bytes(), int64(rw.bytes), rec.bodyLimit),
+		}
+		// The body is captured before compression.
+		e.Response.Header.Del("Content-Encoding")
+		if redact || strings.HasPrefix(p, "/auth/") {
+			e.Request.Body, e.Request.Encoding = redacted, ""
+			e.Response.Body, e.Response.Encoding = redacted, ""
+		}
+		rec.append(e)
+	})
+}
+
+// parseRecordingFilter reads the filter query parameters shared by
+// /admin/recordings and /admin/recordings/export.
+func parseRecordingFilter(r *http.Request) (recordingFilter, string) {
+	q := r.URL.Query()
+	f := recordingFilter{method: strings.ToUpper(q.Get("method")), prefix: q.Get("prefix"), requestID: q.Get("request_id")}
+	if v := q.Get("status"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return f, "Invalid status"
+		}
+		f.status = n
+	}
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return f, "Invalid after"
+		}
+		f.after = n
+	}
+	return f, ""
+}
+
+// GET
+//
+// listRecordingsHandler returns matching recordings, newest first.
+// Filters: ?method, ?prefix of the URL, ?status, ?request_id, ?after=SEQ
+// and ?limit (default 100, max 1000).
+func (s *Server) listRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.recorder == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Request recording is not enabled")
+		return
+	}
+	f, bad := parseRecordingFilter(r)
+	if bad != "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, bad)
+		return
+	}
+	limit := defaultRecordingLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid limit")
+			return
+		}
+		limit = min(n, maxRecordingLimit)
+	}
+	writeJSON(w, http.StatusOK, s.recorder.query(f, limit))
+}
+
+// GET
+//
+// exportRecordingsHandler streams every retained matching recording as
+// NDJSON, oldest first, as a file download for "server replay".
+func (s *Server) exportRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.recorder == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Request recording is not enabled")
+		return
+	}
+	f, bad := parseRecordingFilter(r)
+	if bad != "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, bad)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="recordings.ndjson"`)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, e := range s.recorder.query(f, 0) {
+		enc.Encode(e)
+	}
+	bw.Flush()
+}
+
+// DELETE
+//
+// clearRecordingsHandler forgets the recordings held in memory.
+func (s *Server) clearRecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.recorder == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Request recording is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"cleared": s.recorder.clear()})
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultRegistrationInterval is how often the registration is refreshed
+// by default.
+const defaultRegistrationInterval = 30 * time.Second
+
+// registrationLockWait is how long an instance waits for another's lock on
+// the registration file, and how old a lock must be to be taken as left
+// behind by a crashed instance.
+const registrationLockWait = 5 * time.Second
+
+// instanceRecord is what an instance registers about itself.
+type instanceRecord struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Host    string    `json:"host"`
+	Port    int       `json:"port"`
+	Version string    `json:"version"`
+	Role    string    `json:"role"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+}
+
+// registration keeps this instance listed in a registration file and with
+// a registry endpoint while it serves. The file maps instance IDs to
+// records and is shared by the instances that list themselves in it; an
+// instance is PUT as JSON to registry/{id}, again every interval so that
+// the registry can expire instances that stopped without saying so, and
+// DELETEd from it on shutdown.
+type registration struct {
+	file     string
+	registry string
+	interval time.Duration
+	client   *http.Client
+
+	mu         sync.Mutex
+	rec        instanceRecord
+	registered bool
+	lastError  string
+}
+
+// registrationStats is the "registration" entry of /stats.
+type registrationStats struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	File       string    `json:"file,omitempty"`
+	Registry   string    `json:"registry,omitempty"`
+	Registered bool      `json:"registered"`
+	Updated    time.Time `json:"updated"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// newRegistration returns the registration of cfg, or nil if the instance
+// registers nowhere.
+func newRegistration(cfg Config) (*registration, error) {
+	if cfg.RegistrationFile == "" && cfg.RegistryURL == "" {
+		return nil, nil
+	}
+	if cfg.RegistryURL != "" {
+		if u, err := url.Parse(cfg.RegistryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("registry URL %q must be an http(s) URL", cfg.RegistryURL)
+		}
+	}
+	interval := cmp.Or(cfg.RegistrationInterval, defaultRegistrationInterval)
+	return &registration{
+		file:     cfg.RegistrationFile,
+		registry: cfg.RegistryURL,
+		interval: interval,
+		client:   &http.Client{Timeout: min(interval, 10*time.Second)},
+	}, nil
+}
+
+// instanceRecord describes this instance as it is serving now: at
+// AdvertiseURL, or else at the address of its first HTTP listener.
+func (s *Server) instanceRecord() instanceRecord {
+	rec := instanceRecord{Version: Version, Role: s.role(), PID: os.Getpid(), Started: s.started.UTC()}
+	if s.cfg.AdvertiseURL != "" {
+		rec.URL = s.cfg.AdvertiseURL
+		if u, err := url.Parse(rec.URL); err == nil {
+			rec.Host = u.Hostname()
+			rec.Port, _ = strconv.Atoi(u.Port())
+		}
+	} else if addr, ok := s.Addr().(*net.TCPAddr); ok {
+		rec.Host, rec.Port = addr.IP.String(), addr.Port
+		if addr.IP.IsUnspecified() {
+			rec.Host, _ = os.Hostname()
+		}
+		scheme := "http"
+		if s.cfg.TLSCert != "" {
+			scheme = "https"
+		}
+		rec.URL = scheme + "://" + net.JoinHostPort(rec.Host, strconv.Itoa(rec.Port))
+	}
+	rec.ID = cmp.Or(s.cfg.NodeID, net.JoinHostPort(rec.Host, strconv.Itoa(rec.Port)))
+	return rec
+}
+
+// role is what this instance does in its deployment: its Raft role, a
+// replica or primary of asynchronous replication, or standalone.
+func (s *Server) role() string {
+	switch {
+	case s.raft != nil:
+		return s.raft.status().Role
+	case s.replica.Load() != nil:
+		return "replica"
+	case s.namespaces.replication != nil:
+		return "primary"
+	}
+	return "standalone"
+}
+
+// register lists the instance, or refreshes its listing. Once the server
+// has started to shut down it does nothing, so that a refresh while
+// draining does not undo the deregistration.
+func (s *Server) register() error {
+	if s.notReady.Load() {
+		return nil
+	}
+	rg := s.registration
+	rec := s.instanceRecord()
+	rec.Updated = time.Now().UTC()
+	var errs []error
+	if rg.file != "" {
+		if err := updateRegistrationFile(rg.file, func(m map[string]instanceRecord) { m[rec.ID] = rec }); err != nil {
+			errs = append(errs, fmt.Errorf("register in %s: %w", rg.file, err))
+		}
+	}
+	if rg.registry != "" {
+		if err := rg.call(context.Background(), http.MethodPut, rec); err != nil {
+			errs = append(errs, fmt.Errorf("register with %s: %w", rg.registry, err))
+		}
+	}
+	err := errors.Join(errs...)
+
+	rg.mu.Lock()
+	first := !rg.registered
+	rg.rec, rg.registered, rg.lastError = rec, err == nil, ""
+	if err != nil {
+		rg.lastError = err.Error()
+	}
+	rg.mu.Unlock()
+	if first && err == nil {
+		s.logger.Printf("[Registration] Registered %s at %s as %s", rec.ID, rec.URL, rec.Role)
+	}
+	return err
+}
+
+// deregister removes the instance from the file and the registry, logging
+// what fails, as the instance is going away regardless.
+func (s *Server) deregister(ctx context.Context) {
+	rg := s.registration
+	rg.mu.Lock()
+	rec := rg.rec
+	rg.registered = false
+	rg.mu.Unlock()
+	if rec.ID == "" {
+		rec = s.instanceRecord()
+	}
+	if rg.file != "" {
+		if err := updateRegistrationFile(rg.file, func(m map[string]instanceRecord) { delete(m, rec.ID) }); err != nil {
+			s.logger.Printf("[Registration] Deregister from %s: %v", rg.file, err)
+		}
+	}
+	if rg.registry != "" {
+		if err := rg.call(ctx, http.MethodDelete, rec); err != nil {
+			s.logger.Printf("[Registration] Deregister from %s: %v", rg.registry, err)
+		}
+	}
+	s.logger.Printf("[Registration] Deregistered %s", rec.ID)
+}
+
+// call sends rec to registry/{id} with method.
+func (rg *registration) call(ctx context.Context, method string, rec instanceRecord) error {
+	var body []byte
+	if method != http.MethodDelete {
+		body, _ = json.Marshal(rec)
+	}
+	u, err := url.JoinPath(rg.registry, rec.ID)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := rg.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && !(method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+func (rg *registration) stats() registrationStats {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	return registrationStats{
+		ID:         rg.rec.ID,
+		URL:        rg.rec.URL,
+		File:       rg.file,
+		Registry:   rg.registry,
+		Registered: rg.registered,
+		Updated:    rg.rec.Updated,
+		LastError:  rg.lastError,
+	}
+}
+
+// updateRegistrationFile applies fn to the instances listed in path and
+// writes them back atomically. Instances sharing the file take turns with
+// a lock file next to it.
+func updateRegistrationFile(path string, fn func(map[string]instanceRecord)) error {
+	unlock, err := lockRegistrationFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	instances := make(map[string]instanceRecord)
+	buf, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	case len(bytes.TrimSpace(buf)) > 0:
+		if err := json.Unmarshal(buf, &instances); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	fn(instances)
+	buf, err = json.MarshalIndent(instances, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// lockRegistrationFile creates the lock file, waiting for another holder
+// to remove it, or taking it over once it is older than
+// registrationLockWait.
+func lockRegistrationFile(lock string) (unlock func(), err error) {
+	deadline := time.Now().Add(registrationLockWait)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > registrationLockWait {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is held by another instance", lock)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,567 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replEntry is a line of the replication stream: a mutation, or with only
+// Head set, a heartbeat carrying the primary's latest sequence number.
+type replEntry struct {
+	Seq    uint64     `json:"seq,omitempty"`
+	Op     string     `json:"op,omitempty"` // "set", "delete" or "expire"
+	NS     string     `json:"ns,omitempty"`
+	Key    string     `json:"key,omitempty"`
+	Value  string     `json:"value,omitempty"`
+	Type   string     `json:"type,omitempty"` // content type of a raw value
+	Tags   []string   `json:"tags,omitempty"`
+	Expiry *keyExpiry `json:"expiry,omitempty"`
+	Time   time.Time  `json:"time,omitzero"`
+	Head   uint64     `json:"head,omitempty"`
+}
+
+// errTooFarBehind is returned for a replica asking for mutations the
+// backlog no longer holds, or ones from another primary process.
+var errTooFarBehind = errors.New("replica is too far behind")
+
+// replicationLog is the backlog of a node's most recent mutations, from
+// which replicas catch up after connecting and /changes is served.
+// Sequence numbers start over in every process, which is told apart by
+// its epoch.
+type replicationLog struct {
+	epoch string
+	max   int
+
+	mu       sync.Mutex
+	entries  []replEntry
+	next     uint64 // sequence number of the next mutation
+	changed  chan struct{}
+	replicas map[string]*replicaConn
+}
+
+// replicaConn is a replica currently streaming from this primary.
+type replicaConn struct {
+	ID        string    `json:"id"`
+	Addr      string    `json:"addr"`
+	Sent      uint64    `json:"sent_seq"`
+	Lag       uint64    `json:"lag_entries"`
+	Connected time.Time `json:"connected"`
+}
+
+func newReplicationLog(max int) *replicationLog {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &replicationLog{
+		epoch:    hex.EncodeToString(b),
+		max:      max,
+		next:     1,
+		changed:  make(chan struct{}),
+		replicas: make(map[string]*replicaConn),
+	}
+}
+
+// listener returns a watchHub listener recording the mutations of ns. It
+// runs under the store's lock, so entries are in the order they were
+// applied.
+func (rl *replicationLog) listener(ns *namespace) func(Event) {
+	return func(ev Event) {
+		e := replEntry{Op: ev.Type, NS: ns.name, Key: ev.Key, Time: ev.Time}
+		if ev.Expired {
+			e.Op = "expire"
+		}
+		if ev.Type == "set" {
+			e.Value, e.Type, e.Tags = ev.Value, ns.types.get(ev.Key), ns.tags.get(ev.Key)
+			e.Expiry = ns.expiries.get(ev.Key)
+		}
+		rl.add(e)
+	}
+}
+
+func (rl *replicationLog) add(e replEntry) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	e.Seq = rl.next
+	rl.next++
+	rl.entries = append(rl.entries, e)
+	if len(rl.entries) >= 2*rl.max {
+		rl.entries = append([]replEntry(nil), rl.entries[len(rl.entries)-rl.max:]...)
+	}
+	close(rl.changed)
+	rl.changed = make(chan struct{})
+}
+
+// head returns the sequence number of the latest mutation.
+func (rl *replicationLog) head() uint64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.next - 1
+}
+
+// since returns the entries from sequence number from on, the latest
+// sequence number, and a channel closed when more arrive.
+func (rl *replicationLog) since(from uint64) ([]replEntry, uint64, <-chan struct{}, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	first := rl.next - uint64(len(rl.entries))
+	if from < first || from > rl.next {
+		return nil, 0, nil, errTooFarBehind
+	}
+	out := append([]replEntry(nil), rl.entries[from-first:]...)
+	return out, rl.next - 1, rl.changed, nil
+}
+
+// enableReplication starts recording the mutations of ns for replicas if
+// this node serves any.
+func (nr *namespaceRegistry) enableReplication(ns *namespace) {
+	if nr.replication != nil {
+		ns.hub.addListener(nr.replication.listener(ns))
+	}
+}
+
+// replHeartbeat is how often an idle stream reports the primary's head.
+const replHeartbeat = time.Second
+
+// GET
+//
+// replicationStreamHandler streams mutations from ?from= on to a replica
+// as NDJSON, with heartbeats while idle. It answers 410 when the replica
+// must resync from /replication/snapshot first: when ?epoch= names
+// another primary process or the backlog no longer reaches back to from.
+func (s *Server) replicationStreamHandler(w http.ResponseWriter, r *http.Request) {
+	rl := s.namespaces.replication
+	if rl == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Replication is not enabled")
+		return
+	}
+	q := r.URL.Query()
+	from, err := strconv.ParseUint(q.Get("from"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "from must be a sequence number")
+		return
+	}
+	entries, head, changed, err := rl.since(from)
+	if err != nil || q.Get("epoch") != rl.epoch {
+		writeError(w, r, http.StatusGone, codeResyncRequired, "Replica must resync from a snapshot")
+		return
+	}
+
+	id := q.Get("replica")
+	if id == "" {
+		id = r.RemoteAddr
+	}
+	conn := &replicaConn{ID: id, Addr: r.RemoteAddr, Sent: from - 1, Connected: s.clock.Now().UTC()}
+	rl.mu.Lock()
+	rl.replicas[id] = conn
+	rl.mu.Unlock()
+	defer func() {
+		rl.mu.Lock()
+		if rl.replicas[id] == conn {
+			delete(rl.replicas, id)
+		}
+		rl.mu.Unlock()
+	}()
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's write timeout.
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Replication-Epoch", rl.epoch)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	heartbeat := time.NewTicker(replHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		for _, e := range entries {
+			if enc.Encode(e) != nil {
+				return
+			}
+		}
+		if len(entries) == 0 {
+			enc.Encode(replEntry{Head: head})
+		} else {
+			from = entries[len(entries)-1].Seq + 1
+		}
+		if bw.Flush() != nil || rc.Flush() != nil {
+			return
+		}
+		rl.mu.Lock()
+		conn.Sent = from - 1
+		rl.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+		case <-r.Context().Done():
+			return
+		case <-s.shutdownCh:
+			return
+		}
+		// A replica too slow to keep up is dropped; it resyncs when it
+		// reconnects.
+		if entries, head, changed, err = rl.since(from); err != nil {
+			return
+		}
+	}
+}
+
+// GET
+//
+// replicationSnapshotHandler sends every key of every namespace as NDJSON,
+// for a replica to resync from. X-Replication-Seq is the sequence number
+// to stream from afterwards, less one; mutations after it may already be
+// in the snapshot, which is harmless since replaying them is idempotent.
+func (s *Server) replicationSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	rl := s.namespaces.replication
+	if rl == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Replication is not enabled")
+		return
+	}
+	head := rl.head()
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Replication-Epoch", rl.epoch)
+	w.Header().Set("X-Replication-Seq", strconv.FormatUint(head, 10))
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, ns := range s.namespaces.list() {
+		var err error
+		ns.store.Snapshot().Range(func(k, v string) bool {
+			err = enc.Encode(replEntry{Op: "set", NS: ns.name, Key: k, Value: v, Type: ns.types.get(k), Tags: ns.tags.get(k), Expiry: ns.expiries.get(k)})
+			return err == nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	bw.Flush()
+}
+
+// replica follows a primary, applying its mutations to this node, which
+// is otherwise read-only.
+type replica struct {
+	primary string
+	id      string
+	apiKey  string
+	client  *http.Client
+
+	mu          sync.Mutex
+	epoch       string
+	applied     uint64
+	head        uint64
+	connected   bool
+	lastContact time.Time
+	caughtUp    time.Time
+	resyncs     int
+	lastError   string
+	changed     chan struct{} // closed and replaced whenever applied advances
+
+	// promoteAfter, if positive, promotes the node once the primary has
+	// not been heard from for that long.
+	promoteAfter time.Duration
+	// promoted is closed when the node is promoted, which stops
+	// followPrimary; done is closed once it has stopped, if it was running.
+	promoted chan struct{}
+	running  bool
+	done     chan struct{}
+}
+
+// replicaRetry is how long a replica waits before reconnecting.
+const replicaRetry = time.Second
+
+// followPrimary runs until shutdown or promotion, streaming from the
+// primary and resyncing from a snapshot whenever it has to.
+func (s *Server) followPrimary(rp *replica) {
+	rp.mu.Lock()
+	select {
+	case <-rp.promoted:
+		rp.mu.Unlock()
+		return
+	default:
+	}
+	rp.running = true
+	rp.mu.Unlock()
+	defer close(rp.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.shutdownCh:
+		case <-rp.promoted:
+		}
+		cancel()
+	}()
+	if rp.promoteAfter > 0 {
+		go s.watchPrimary(ctx, rp)
+	}
+
+	for ctx.Err() == nil {
+		rp.mu.Lock()
+		epoch := rp.epoch
+		rp.mu.Unlock()
+
+		var err error
+		if epoch == "" {
+			err = s.resync(ctx, rp)
+		} else {
+			err = s.streamFromPrimary(ctx, rp)
+		}
+		rp.mu.Lock()
+		rp.connected = false
+		if errors.Is(err, errTooFarBehind) {
+			rp.epoch = ""
+			rp.mu.Unlock()
+			s.logger.Printf("[Replica] Too far behind %s; resyncing", rp.primary)
+			continue
+		}
+		if err != nil && ctx.Err() == nil {
+			rp.lastError = err.Error()
+			s.logger.Printf("[Replica] %v", err)
+		}
+		rp.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(replicaRetry):
+		}
+	}
+}
+
+func (rp *replica) get(ctx context.Context, path string, q url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rp.primary+apiPrefix+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if rp.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+rp.apiKey)
+	}
+	res, err := rp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res, nil
+	case http.StatusGone:
+		res.Body.Close()
+		return nil, errTooFarBehind
+	default:
+		res.Body.Close()
+		return nil, fmt.Errorf("%s from %s", res.Status, rp.primary+path)
+	}
+}
+
+// resync replaces the contents of every namespace with a snapshot of the
+// primary's.
+func (s *Server) resync(ctx context.Context, rp *replica) error {
+	res, err := rp.get(ctx, "/replication/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	epoch := res.Header.Get("X-Replication-Epoch")
+	seq, err := strconv.ParseUint(res.Header.Get("X-Replication-Seq"), 10, 64)
+	if err != nil || epoch == "" {
+		return errors.New("snapshot without a replication position")
+	}
+
+	ctx = context.WithValue(ctx, replayKey, true)
+	seen := make(map[string]map[string]struct{})
+	dec := json.NewDecoder(bufio.NewReader(res.Body))
+	n := 0
+	for {
+		var e replEntry
+		if err := dec.Decode(&e); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("read snapshot: %w", err)
+		}
+		if err := s.applyReplicated(ctx, e); err != nil {
+			return err
+		}
+		if seen[e.NS] == nil {
+			seen[e.NS] = make(map[string]struct{})
+		}
+		seen[e.NS][e.Key] = struct{}{}
+		n++
+		// A snapshot arriving is the primary being heard from, so that a
+		// long resync does not look like a failed primary.
+		rp.mu.Lock()
+		rp.lastContact = s.clock.Now()
+		rp.mu.Unlock()
+	}
+	// Drop whatever the primary no longer has.
+	for _, ns := range s.namespaces.list() {
+		for _, k := range ns.store.Snapshot().keys {
+			if _, ok := seen[ns.name][k]; !ok {
+				s.applyDelete(ctx, ns, k)
+			}
+		}
+	}
+
+	rp.mu.Lock()
+	rp.epoch, rp.applied, rp.head = epoch, seq, seq
+	now := s.clock.Now()
+	rp.lastContact, rp.caughtUp = now, now
+	rp.resyncs++
+	rp.advancedLocked()
+	rp.mu.Unlock()
+	s.logger.Printf("[Replica] Resynced %d keys from %s at %s:%d", n, rp.primary, epoch, seq)
+	return nil
+}
+
+// streamFromPrimary applies the primary's mutations until the stream
+// ends.
+func (s *Server) streamFromPrimary(ctx context.Context, rp *replica) error {
+	rp.mu.Lock()
+	q := url.Values{"epoch": {rp.epoch}, "from": {strconv.FormatUint(rp.applied+1, 10)}, "replica": {rp.id}}
+	rp.mu.Unlock()
+	res, err := rp.get(ctx, "/replication/stream", q)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	rp.mu.Lock()
+	rp.connected, rp.lastError = true, ""
+	rp.mu.Unlock()
+	ctx = context.WithValue(ctx, replayKey, true)
+	dec := json.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		var e replEntry
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("stream from %s: %w", rp.primary, err)
+		}
+		if e.Seq != 0 {
+			if err := s.applyReplicated(ctx, e); err != nil {
+				return err
+			}
+		}
+		now := s.clock.Now()
+		rp.mu.Lock()
+		rp.lastContact = now
+		if e.Seq != 0 {
+			rp.applied = e.Seq
+			rp.advancedLocked()
+		}
+		rp.head = max(rp.head, e.Head, e.Seq)
+		if rp.applied >= rp.head {
+			rp.caughtUp = now
+		}
+		rp.mu.Unlock()
+	}
+}
+
+func (s *Server) applyReplicated(ctx context.Context, e replEntry) error {
+	ns := s.namespaces.get(e.NS, true)
+	if e.Op == "delete" || e.Op == "expire" {
+		if e.Op == "expire" {
+			ctx = withExpiring(ctx)
+		}
+		if err := s.applyDelete(ctx, ns, e.Key); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		return nil
+	}
+	return s.applySet(withExpiry(withTags(withContentType(ctx, e.Type), e.Tags), e.Expiry), ns, e.Key, e.Value)
+}
+
+// replicationStats is the "replication" section of /stats.
+func (s *Server) replicationStats() map[string]interface{} {
+	if rp := s.replica.Load(); rp != nil {
+		rp.mu.Lock()
+		defer rp.mu.Unlock()
+		st := map[string]interface{}{
+			"role":        "replica",
+			"primary":     rp.primary,
+			"connected":   rp.connected,
+			"applied_seq": rp.applied,
+			"primary_seq": rp.head,
+			"lag_entries": rp.head - rp.applied,
+			"resyncs":     rp.resyncs,
+		}
+		if !rp.caughtUp.IsZero() {
+			st["lag_seconds"] = s.clock.Now().Sub(rp.caughtUp).Seconds()
+			if rp.applied >= rp.head {
+				st["lag_seconds"] = 0.0
+			}
+			st["last_contact"] = rp.lastContact.UTC()
+		}
+		if rp.lastError != "" {
+			st["last_error"] = rp.lastError
+		}
+		return st
+	}
+	rl := s.namespaces.replication
+	if rl == nil {
+		if p := s.promotion.Load(); p != nil {
+			return map[string]interface{}{"role": "primary", "promoted": p}
+		}
+		return nil
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	replicas := make([]replicaConn, 0, len(rl.replicas))
+	for _, c := range rl.replicas {
+		c := *c
+		c.Lag = rl.next - 1 - c.Sent
+		replicas = append(replicas, c)
+	}
+	st := map[string]interface{}{
+		"role":       "primary",
+		"epoch":      rl.epoch,
+		"seq":        rl.next - 1,
+		"oldest_seq": rl.next - uint64(len(rl.entries)),
+		"replicas":   replicas,
+	}
+	if p := s.promotion.Load(); p != nil {
+		st["promoted"] = p
+	}
+	return st
+}
+
+// staleness is how long ago the replica last knew itself to have every
+// mutation of the primary.
+func (rp *replica) staleness(now time.Time) (time.Duration, bool) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	switch {
+	case rp.caughtUp.IsZero():
+		return 0, false
+	case rp.connected && rp.applied >= rp.head:
+		return now.Sub(rp.lastContact), true
+	}
+	return now.Sub(rp.caughtUp), true
+}
+
+// newReplica prepares to follow the primary at primaryURL.
+func newReplica(primaryURL, id, apiKey string, promoteAfter time.Duration) (*replica, error) {
+	u, err := url.Parse(primaryURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid primary URL %q", primaryURL)
+	}
+	// The client has no timeout: the stream stays open indefinitely.
+	return &replica{
+		primary:      strings.TrimSuffix(primaryURL, "/"),
+		id:           id,
+		apiKey:       apiKey,
+		client:       &http.Client{},
+		changed:      make(chan struct{}),
+		promoteAfter: promoteAfter,
+		promoted:     make(chan struct{}),
+		done:         make(chan struct{}),
+	}, nil
+}
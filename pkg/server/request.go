@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Codes of the individual problems listed in the "fields" of an
+// invalid_request error.
+const (
+	fieldEmptyKey      = "empty_key"
+	fieldInvalidKey    = "invalid_key"
+	fieldNotString     = "not_string"
+	fieldValueTooLarge = "value_too_large"
+	fieldUnknown       = "unknown_field"
+	fieldWrongType     = "wrong_type"
+)
+
+// fieldError is one problem with a request body: a key of a POST /data
+// payload, or a member of any other JSON body.
+type fieldError struct {
+	Field  string `json:"field"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// writeFieldErrors rejects a request whose body decoded but failed
+// validation, listing every problem found rather than just the first.
+func writeFieldErrors(w http.ResponseWriter, r *http.Request, fields []fieldError) {
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+	msg := "1 field was rejected"
+	if len(fields) != 1 {
+		msg = fmt.Sprintf("%d fields were rejected", len(fields))
+	}
+	msg = localizedMessage(w, r, codeInvalidRequest, msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(errorBody{Error: errorDetail{
+		Code:      codeInvalidRequest,
+		Message:   msg,
+		RequestID: requestIDFrom(r.Context()),
+		Fields:    fields,
+	}})
+}
+
+// checkPayload returns what is wrong with the keys and values of a POST
+// /data payload: the key rules and the value size limit, checked up front
+// so that every rejected key is reported at once.
+func (s *Server) checkPayload(payload map[string]string) []fieldError {
+	var fields []fieldError
+	for k, v := range payload {
+		if err := s.keyRules.check("set", k); err != nil {
+			code := fieldInvalidKey
+			if k == "" {
+				code = fieldEmptyKey
+			}
+			fields = append(fields, fieldError{Field: k, Code: code, Reason: err.Error()})
+			continue
+		}
+		if max := s.cfg.MaxValueSize; max > 0 && int64(len(v)) > max {
+			fields = append(fields, fieldError{Field: k, Code: fieldValueTooLarge, Reason: fmt.Sprintf("value is %d bytes, more than the %d allowed", len(v), max)})
+		}
+	}
+	return fields
+}
+
+// checkContentType makes sure a request body is declared with a media type
+// the endpoint reads, as decided by accept, answering 415 naming want if
+// it is not. The only parameter looked at is charset, which must be UTF-8
+// if given. A request without a body needs no Content-Type.
+func checkContentType(w http.ResponseWriter, r *http.Request, want string, accept func(mediaType string) bool) bool {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" && r.ContentLength == 0 {
+		return true
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	var msg string
+	switch charset := strings.ToLower(params["charset"]); {
+	case ct == "":
+		msg = "Content-Type is required; send " + want
+	case err != nil:
+		msg = fmt.Sprintf("Invalid Content-Type %q; send %s", ct, want)
+	case !accept(mt):
+		msg = fmt.Sprintf("Content-Type %s is not supported; send %s", mt, want)
+	case charset != "" && charset != "utf-8" && charset != "utf8":
+		msg = fmt.Sprintf("Charset %s is not supported; send UTF-8", params["charset"])
+	default:
+		return true
+	}
+	writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, msg)
+	return false
+}
+
+// isJSONMediaType reports whether mt is application/json or a +json type
+// such as application/merge-patch+json.
+func isJSONMediaType(mt string) bool {
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// checkDataContentType is checkContentType for POST /data, which also
+// takes msgpack and protobuf.
+func checkDataContentType(w http.ResponseWriter, r *http.Request) bool {
+	return checkContentType(w, r, "application/json, "+msgpackContentType+" or "+protobufContentType, func(mt string) bool {
+		_, ok := parseFormat(mt)
+		return ok || isJSONMediaType(mt)
+	})
+}
+
+// decodeJSON decodes a JSON request body into v, answering 415 if it is
+// not declared as JSON and 400 with what is wrong if it cannot be decoded.
+// In strict mode members v has no field for are rejected rather than
+// ignored.
+func (s *Server) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if !checkContentType(w, r, "application/json", isJSONMediaType) {
+		return false
+	}
+	dec := json.NewDecoder(r.Body)
+	if s.cfg.StrictJSON {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(v)
+	if err == nil {
+		return true
+	}
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		writeFieldErrors(w, r, []fieldError{{Field: typeErr.Field, Code: fieldWrongType, Reason: "must be " + jsonKind(typeErr.Type)}})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no type for this error.
+		name := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		writeFieldErrors(w, r, []fieldError{{Field: name, Code: fieldUnknown, Reason: "not a member of this request"}})
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, describeJSONError(err))
+	}
+	return false
+}
+
+// describeJSONError turns an error from decoding a JSON body into a message
+// saying where it went wrong.
+func describeJSONError(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "Invalid JSON: the body is empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "Invalid JSON: the body ends too soon"
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("Invalid JSON at byte %d: %s", syntaxErr.Offset, strings.TrimPrefix(syntaxErr.Error(), "json: "))
+	case errors.As(err, &typeErr) && typeErr.Field == "":
+		return "Invalid JSON: the body must be " + jsonKind(typeErr.Type) + ", not " + jsonValueName(typeErr.Value)
+	}
+	return "Invalid JSON"
+}
+
+// jsonKind names the JSON type values of t are decoded from.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Pointer:
+		return jsonKind(t.Elem())
+	}
+	return "a number"
+}
+
+// jsonValueName names a JSON value as described by json.UnmarshalTypeError.
+func jsonValueName(v string) string {
+	switch v {
+	case "array", "object":
+		return "an " + v
+	case "bool":
+		return "a boolean"
+	}
+	return "a " + v
+}
@@ -0,0 +1,542 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// respServer speaks a subset of the Redis protocol (RESP2) on top of the
+// server's store: PING, ECHO, GET, SET (with NX), SETNX, GETSET, GETDEL,
+// DEL, EXISTS, KEYS, TTL, AUTH, plus the handful of connection commands redis-cli sends on startup.
+// When the server authenticates requests, a connection must AUTH, or HELLO
+// with AUTH, before anything but PING.
+type respServer struct {
+	s *Server
+
+	mu    sync.Mutex
+	lns   []net.Listener
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// respMaxBulk bounds the size of a single bulk string argument.
+const respMaxBulk = 64 << 20
+
+var errRESPProtocol = errors.New("protocol error")
+
+func newRESPServer(s *Server) *respServer {
+	return &respServer{s: s, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accepts connections on ln until it is closed. It may be called for
+// several listeners at once.
+func (rs *respServer) Serve(ln net.Listener) error {
+	rs.mu.Lock()
+	rs.lns = append(rs.lns, ln)
+	rs.mu.Unlock()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		rs.mu.Lock()
+		rs.conns[c] = struct{}{}
+		rs.mu.Unlock()
+		rs.wg.Add(1)
+		go rs.serveConn(c)
+	}
+}
+
+// Close stops accepting connections, closes existing ones and waits for
+// their goroutines to exit.
+func (rs *respServer) Close() {
+	rs.mu.Lock()
+	for _, ln := range rs.lns {
+		ln.Close()
+	}
+	for c := range rs.conns {
+		c.Close()
+	}
+	rs.mu.Unlock()
+	rs.wg.Wait()
+}
+
+func (rs *respServer) serveConn(c net.Conn) {
+	defer func() {
+		c.Close()
+		rs.mu.Lock()
+		delete(rs.conns, c)
+		rs.mu.Unlock()
+		rs.wg.Done()
+	}()
+
+	cn := &respConn{ctx: context.Background(), remote: c.RemoteAddr().String()}
+	if host, _, err := net.SplitHostPort(cn.remote); err == nil {
+		cn.remote = host
+	}
+	br := bufio.NewReader(c)
+	bw := bufio.NewWriter(c)
+	for {
+		args, err := readRESPCommand(br)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				writeRESPError(bw, "ERR "+err.Error())
+				bw.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := rs.dispatch(bw, cn, args)
+		// Pipelined commands are answered in one write.
+		if br.Buffered() == 0 || quit {
+			if err := bw.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// readRESPCommand reads either a RESP array of bulk strings or an inline
+// command (space separated, as typed into telnet).
+func readRESPCommand(br *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(br)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > 1024*1024 {
+		return nil, errRESPProtocol
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		hdr, err := readRESPLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(hdr, "$") {
+			return nil, errRESPProtocol
+		}
+		size, err := strconv.Atoi(hdr[1:])
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, errRESPProtocol
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readRESPLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeRESPSimple(w *bufio.Writer, s string) { w.WriteString("+" + s + "\r\n") }
+func writeRESPError(w *bufio.Writer, s string)  { w.WriteString("-" + s + "\r\n") }
+func writeRESPInt(w *bufio.Writer, n int)       { w.WriteString(":" + strconv.Itoa(n) + "\r\n") }
+func writeRESPNull(w *bufio.Writer)             { w.WriteString("$-1\r\n") }
+
+func writeRESPBulk(w *bufio.Writer, s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func writeRESPArray(w *bufio.Writer, items []string) {
+	w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, it := range items {
+		writeRESPBulk(w, it)
+	}
+}
+
+// writeRESPStoreError maps store errors onto Redis-style error prefixes.
+func writeRESPStoreError(w *bufio.Writer, err error) {
+	switch {
+	case errors.Is(err, ErrReadOnly):
+		writeRESPError(w, "READONLY "+messageForError(err))
+	case errors.Is(err, ErrMissingScope):
+		writeRESPError(w, "NOPERM "+messageForError(err))
+	default:
+		writeRESPError(w, "ERR "+messageForError(err))
+	}
+}
+
+func wrongArgs(w *bufio.Writer, cmd string) {
+	writeRESPError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+// respConn is the state of a connection: ctx carries the identity of the
+// client once it has authenticated.
+type respConn struct {
+	ctx    context.Context
+	remote string
+	authed bool
+}
+
+// login authenticates a connection with AUTH or HELLO ... AUTH, writing
+// the reply to an AUTH that fails. A password given without a user name,
+// or with the user "default", is taken as a bearer token.
+func (rs *respServer) login(w *bufio.Writer, cn *respConn, user, pass string) bool {
+	if rs.s.auth == nil {
+		writeRESPError(w, "ERR AUTH <password> called without any password configured for the default user")
+		return false
+	}
+	creds := Credentials{Token: pass}
+	if user != "" && user != "default" {
+		creds = Credentials{Username: user, Password: pass}
+	}
+	ctx, err := rs.s.auth.login(context.Background(), creds, cn.remote)
+	var locked *lockedOutError
+	switch {
+	case err == nil:
+	case errors.As(err, &locked):
+		writeRESPError(w, "ERR "+err.Error())
+		return false
+	case errors.Is(err, ErrUnauthenticated):
+		writeRESPError(w, "WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	default:
+		writeRESPError(w, "ERR the authentication provider is unavailable")
+		return false
+	}
+	if g := grantFrom(ctx); g != nil && g.Namespace != "" && g.Namespace != defaultNamespace {
+		writeRESPError(w, "NOPERM this token only grants access to namespace "+g.Namespace)
+		return false
+	}
+	cn.ctx, cn.authed = ctx, true
+	return true
+}
+
+// dispatch executes one command and reports whether the client asked to
+// close the connection.
+func (rs *respServer) dispatch(w *bufio.Writer, cn *respConn, args []string) bool {
+	ctx := cn.ctx
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+	switch cmd {
+	case "PING", "AUTH", "HELLO", "QUIT":
+	default:
+		if rs.s.auth != nil && !cn.authed {
+			writeRESPError(w, "NOAUTH Authentication required.")
+			return false
+		}
+	}
+	switch cmd {
+	case "GET", "SET", "SETNX", "GETSET", "GETDEL", "TTL":
+		if len(args) > 0 {
+			args[0] = rs.s.keyRules.canonical(args[0])
+		}
+	case "DEL", "EXISTS":
+		for i := range args {
+			args[i] = rs.s.keyRules.canonical(args[i])
+		}
+	}
+
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			writeRESPBulk(w, args[0])
+		} else {
+			writeRESPSimple(w, "PONG")
+		}
+	case "ECHO":
+		if len(args) != 1 {
+			wrongArgs(w, cmd)
+			break
+		}
+		writeRESPBulk(w, args[0])
+	case "QUIT":
+		writeRESPSimple(w, "OK")
+		return true
+	case "SELECT":
+		if len(args) != 1 || args[0] != "0" {
+			writeRESPError(w, "ERR DB index is out of range")
+			break
+		}
+		writeRESPSimple(w, "OK")
+	case "AUTH":
+		switch len(args) {
+		case 1:
+			if rs.login(w, cn, "", args[0]) {
+				writeRESPSimple(w, "OK")
+			}
+		case 2:
+			if rs.login(w, cn, args[0], args[1]) {
+				writeRESPSimple(w, "OK")
+			}
+		default:
+			wrongArgs(w, cmd)
+		}
+	case "HELLO":
+		// HELLO [protover [AUTH username password] [SETNAME name]]
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(args[i], "AUTH") {
+				if i+2 >= len(args) {
+					writeRESPError(w, "ERR syntax error")
+					return false
+				}
+				if !rs.login(w, cn, args[i+1], args[i+2]) {
+					return false
+				}
+				break
+			}
+		}
+		if rs.s.auth != nil && !cn.authed {
+			writeRESPError(w, "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+			break
+		}
+		// redis-cli probes this on connect; an empty reply is enough.
+		writeRESPArray(w, nil)
+	case "COMMAND", "CLIENT":
+		// redis-cli probes these on connect; an empty reply is enough.
+		writeRESPArray(w, nil)
+
+	case "GET":
+		if len(args) != 1 {
+			wrongArgs(w, cmd)
+			break
+		}
+		v, err := rs.s.readKey(ctx, rs.s.namespaces.def, args[0])
+		if errors.Is(err, ErrKeyNotFound) {
+			writeRESPNull(w)
+		} else if err != nil {
+			writeRESPStoreError(w, err)
+		} else {
+			writeRESPBulk(w, v)
+		}
+	case "SET":
+		nx := len(args) == 3 && strings.EqualFold(args[2], "NX")
+		if len(args) != 2 && !nx {
+			// Options other than NX, such as EX, are not supported.
+			writeRESPError(w, "ERR syntax error")
+			break
+		}
+		if nx {
+			ctx = withCreateOnly(ctx)
+		}
+		err := rs.s.setKey(ctx, args[0], args[1])
+		if nx && errors.Is(err, ErrKeyExists) {
+			writeRESPNull(w)
+			break
+		}
+		if err != nil {
+			writeRESPStoreError(w, err)
+			break
+		}
+		writeRESPSimple(w, "OK")
+	case "SETNX":
+		if len(args) != 2 {
+			wrongArgs(w, cmd)
+			break
+		}
+		err := rs.s.setKey(withCreateOnly(ctx), args[0], args[1])
+		if errors.Is(err, ErrKeyExists) {
+			writeRESPInt(w, 0)
+		} else if err != nil {
+			writeRESPStoreError(w, err)
+		} else {
+			writeRESPInt(w, 1)
+		}
+	case "GETSET":
+		if len(args) != 2 {
+			wrongArgs(w, cmd)
+			break
+		}
+		// The previous value is returned, so the key must be readable.
+		if err := rs.s.checkRead(ctx, rs.s.namespaces.def, args[0]); err != nil {
+			writeRESPStoreError(w, err)
+			break
+		}
+		var prev previousValue
+		if err := rs.s.setKey(withPrevious(ctx, &prev), args[0], args[1]); err != nil {
+			writeRESPStoreError(w, err)
+		} else if !prev.Existed {
+			writeRESPNull(w)
+		} else {
+			v, _ := rs.s.reveal(ctx, args[0], prev.Value)
+			writeRESPBulk(w, v)
+		}
+	case "GETDEL":
+		if len(args) != 1 {
+			wrongArgs(w, cmd)
+			break
+		}
+		if err := rs.s.checkRead(ctx, rs.s.namespaces.def, args[0]); err != nil {
+			writeRESPStoreError(w, err)
+			break
+		}
+		var prev previousValue
+		err := rs.s.deleteKey(withPrevious(ctx, &prev), args[0])
+		if errors.Is(err, ErrKeyNotFound) {
+			writeRESPNull(w)
+		} else if err != nil {
+			writeRESPStoreError(w, err)
+		} else {
+			v, _ := rs.s.reveal(ctx, args[0], prev.Value)
+			writeRESPBulk(w, v)
+		}
+	case "DEL":
+		if len(args) == 0 {
+			wrongArgs(w, cmd)
+			break
+		}
+		n := 0
+		for _, key := range args {
+			err := rs.s.deleteKey(ctx, key)
+			if err == nil {
+				n++
+			} else if !errors.Is(err, ErrKeyNotFound) {
+				writeRESPStoreError(w, err)
+				return false
+			}
+		}
+		writeRESPInt(w, n)
+	case "EXISTS":
+		if len(args) == 0 {
+			wrongArgs(w, cmd)
+			break
+		}
+		// Keys the client may not read count as missing, as KEYS leaves
+		// them out.
+		hide := rs.s.hiddenKeys(ctx, rs.s.namespaces.def, false)
+		n := 0
+		for _, key := range args {
+			if hide != nil && hide(key) {
+				continue
+			}
+			if _, live := rs.s.checkExpiry(rs.s.namespaces.def, key, false); !live {
+				continue
+			}
+			if _, err := rs.s.store.Get(key); err == nil {
+				n++
+			}
+		}
+		writeRESPInt(w, n)
+	case "KEYS":
+		if len(args) != 1 {
+			wrongArgs(w, cmd)
+			break
+		}
+		def := rs.s.namespaces.def
+		hide := rs.s.hiddenKeys(ctx, def, false)
+		var keys []string
+		visible(rs.s.store.Snapshot(), hide).Range(func(k, _ string) bool {
+			if !globMatch(args[0], k) {
+				return true
+			}
+			if _, live := rs.s.checkExpiry(def, k, false); live {
+				keys = append(keys, k)
+			}
+			return true
+		})
+		sort.Strings(keys)
+		writeRESPArray(w, keys)
+	case "TTL":
+		if len(args) != 1 {
+			wrongArgs(w, cmd)
+			break
+		}
+		// -1 for a key that does not expire, -2 for a missing one.
+		e, live := rs.s.checkExpiry(rs.s.namespaces.def, args[0], false)
+		if _, err := rs.s.store.Get(args[0]); err != nil || !live {
+			writeRESPInt(w, -2)
+		} else if e == nil {
+			writeRESPInt(w, -1)
+		} else {
+			writeRESPInt(w, int(e.remaining(rs.s.clock.Now())))
+		}
+	default:
+		writeRESPError(w, fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(cmd)))
+	}
+	return false
+}
+
+// globMatch reports whether s matches a Redis-style glob pattern: * and ?
+// match any characters (including "/"), [abc] and [a-z] match classes, [^a]
+// negates, and \ escapes the next character.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if s == "" {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return pattern == s
+			}
+			class := pattern[1 : end+1]
+			negate := strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					if class[i] <= s[0] && s[0] <= class[i+2] {
+						matched = true
+					}
+					i += 2
+				} else if class[i] == s[0] {
+					matched = true
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			pattern, s = pattern[end+2:], s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return s == ""
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiPrefix is the path prefix of the current API version.
+const apiPrefix = "/v1"
+
+// router registers versioned routes on a ServeMux, optionally applying
+// per-route middleware.
+type router struct {
+	mux    *http.ServeMux
+	legacy bool
+	routes []routeInfo
+
+	// keyMW runs first on every route with a {key} segment.
+	keyMW Middleware
+	// limits bound the concurrency of the routes they name, ahead of
+	// any other route middleware.
+	limits routeLimits
+	// chaos injects faults into every route but /admin/chaos, inside
+	// the concurrency limit.
+	chaos *chaosInjector
+	// grants, if set, returns the middleware holding clients with an
+	// issued token to what it grants on a route, run after keyMW.
+	grants func(method, path string) Middleware
+	// tagMW and then expiryMW run last on every route with a {key}
+	// segment and on POST /data.
+	tagMW    Middleware
+	expiryMW Middleware
+	// switches turns off the routes disabled by configuration.
+	switches *routeSwitch
+}
+
+// routeInfo records a registered route for the OpenAPI document.
+type routeInfo struct {
+	method, path string
+}
+
+// handle mounts h at method + /v1 + path, and also at the unversioned path
+// when legacy routes are enabled.
+func (rt *router) handle(method, path string, h http.HandlerFunc, mws ...Middleware) {
+	if rt.switches != nil && rt.switches.off(method, path) {
+		off := rt.switches.handler(method, path)
+		rt.mux.Handle(method+" "+apiPrefix+path, off)
+		if rt.legacy {
+			rt.mux.Handle(method+" "+path, off)
+		}
+		return
+	}
+	if rt.grants != nil {
+		mws = append([]Middleware{rt.grants(method, path)}, mws...)
+	}
+	if rt.keyMW != nil && strings.Contains(path, "{key}") {
+		mws = append([]Middleware{rt.keyMW}, mws...)
+	}
+	if strings.Contains(path, "{key}") || strings.HasSuffix(path, "/data") && method == http.MethodPost {
+		// Innermost, so that the key and namespace are resolved.
+		mws = append(mws, rt.tagMW, rt.expiryMW)
+	}
+	if rt.chaos != nil && path != "/admin/chaos" {
+		mws = append([]Middleware{rt.chaos.middleware(method, path)}, mws...)
+	}
+	if lim := rt.limits.middleware(method, path); lim != nil {
+		mws = append([]Middleware{lim}, mws...)
+	}
+	route := method + " " + path
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflightFrom(r.Context()).setRoute(route)
+		t := timingFrom(r.Context())
+		t.handlerStarted(route)
+		defer t.handlerDone()
+		h(w, r)
+	}), mws...)
+	rt.routes = append(rt.routes, routeInfo{method, path})
+	rt.mux.Handle(method+" "+apiPrefix+path, handler)
+	if rt.legacy {
+		rt.mux.Handle(method+" "+path, handler)
+	}
+}
+
+// routes builds the request router. Every endpoint lives under /v1; with
+// legacy set the same handlers are also mounted at their old unversioned
+// paths. The OpenAPI document is served at /openapi.json, with swaggerUI
+// an interactive explorer at /docs, and with dashboard the dashboard at
+// /ui.
+func (s *Server) routes(legacy, swaggerUI, dashboard bool) http.Handler {
+	rt := &router{mux: http.NewServeMux(), legacy: legacy, limits: s.routeLimits, chaos: s.chaos, tagMW: s.withKeyTags, expiryMW: s.withKeyExpiry, switches: s.routeSwitch}
+	if s.keyRules.normalize {
+		rt.keyMW = s.normalizeKey
+	}
+	if s.tokens != nil {
+		rt.grants = s.grantMiddleware
+	}
+
+	rt.handle("GET", "/data", s.getDataHandler, s.consistentRead)
+	rt.handle("POST", "/data", s.postDataHandler, s.routeToShard)
+	rt.handle("DELETE", "/data", s.deletePrefixHandler)
+	rt.handle("GET", "/data/{key}", s.getKeyHandler, s.routeToShard, s.consistentRead)
+	rt.handle("HEAD", "/data/{key}", s.headKeyHandler, s.routeToShard, s.consistentRead)
+	rt.handle("PUT", "/data/{key}", s.putKeyHandler, s.routeToShard)
+	rt.handle("DELETE", "/data/{key}", s.deleteDataHandler, s.routeToShard)
+	rt.handle("PATCH", "/data/{key}", s.patchKeyHandler, s.routeToShard)
+	rt.handle("GET", "/data/{key}/meta", s.getKeyMetaHandler, s.routeToShard, s.consistentRead)
+	rt.handle("GET", "/data/{key}/exists", s.keyExistsHandler, s.routeToShard)
+	rt.handle("POST", "/data/{key}/restore", s.restoreKeyHandler, s.routeToShard)
+	rt.handle("GET", "/data/{key}/history", s.keyHistoryHandler, s.routeToShard, s.consistentRead)
+	rt.handle("POST", "/data/{key}/getset", s.getSetHandler, s.routeToShard)
+	rt.handle("POST", "/data/{key}/getdel", s.getDelHandler, s.routeToShard)
+	rt.handle("POST", "/data/{key}/lpush", s.lpushHandler, s.routeToShard)
+	rt.handle("POST", "/data/{key}/rpush", s.rpushHandler, s.routeToShard)
+	rt.handle("POST", "/data/{key}/lpop", s.lpopHandler, s.routeToShard)
+	rt.handle("POST", "/data/{key}/rpop", s.rpopHandler, s.routeToShard)
+	rt.handle("GET", "/data/{key}/lrange", s.lrangeHandler, s.routeToShard, s.consistentRead)
+	rt.handle("POST", "/data/{key}/sadd", s.saddHandler, s.routeToShard)
+	rt.handle("POST", "/data/{key}/srem", s.sremHandler, s.routeToShard)
+	rt.handle("GET", "/data/{key}/smembers", s.smembersHandler, s.routeToShard, s.consistentRead)
+	rt.handle("GET", "/tombstones", s.listTombstonesHandler)
+	rt.handle("GET", "/indexes", s.listIndexesHandler)
+	rt.handle("POST", "/indexes", s.createIndexHandler)
+	rt.handle("DELETE", "/indexes/{name}", s.deleteIndexHandler)
+	rt.handle("GET", "/query", s.queryHandler, s.consistentRead)
+	rt.handle("GET", "/search", s.searchHandler, s.consistentRead)
+	rt.handle("GET", "/graphql", s.graphqlHandler, s.consistentRead)
+	rt.handle("POST", "/graphql", s.graphqlHandler)
+	rt.handle("GET", "/info", s.infoHandler)
+	rt.handle("GET", "/stats", s.statsHandler)
+	rt.handle("POST", "/stats/reset", s.statsResetHandler)
+	rt.handle("GET", "/stats/clients", s.clientStatsHandler)
+	rt.handle("GET", "/stats/hotkeys", s.hotKeysHandler)
+	rt.handle("GET", "/stats/history", s.statsHistoryHandler)
+	rt.handle("GET", "/backup", s.backupHandler)
+	rt.handle("POST", "/bulk", s.bulkLoadHandler)
+	rt.handle("GET", "/export", s.exportHandler, s.consistentRead)
+	rt.handle("POST", "/import", s.importHandler)
+	rt.handle("POST", "/clone", s.cloneNamespaceHandler)
+	rt.handle("GET", "/watch", s.watchHandler, s.requireFeature(featureWatch))
+	rt.handle("GET", "/session", s.sessionHandler)
+	rt.handle("GET", "/changes", s.changesHandler, s.requireFeature(featureWatch))
+	rt.handle("GET", "/queues/{name}", s.queueStatsHandler)
+	rt.handle("POST", "/queues/{name}/push", s.pushHandler)
+	rt.handle("POST", "/queues/{name}/pop", s.popHandler)
+	rt.handle("POST", "/queues/{name}/ack", s.ackHandler)
+	rt.handle("GET", "/locks", s.listLocksHandler)
+	rt.handle("GET", "/locks/{name}", s.getLockHandler)
+	rt.handle("POST", "/locks/{name}", s.acquireLockHandler)
+	rt.handle("PUT", "/locks/{name}", s.refreshLockHandler)
+	rt.handle("DELETE", "/locks/{name}", s.releaseLockHandler)
+	rt.handle("GET", "/sessions", s.listSessionsHandler)
+	rt.handle("POST", "/sessions", s.createSessionHandler)
+	rt.handle("GET", "/sessions/{id}", s.getSessionHandler)
+	rt.handle("PUT", "/sessions/{id}", s.renewSessionHandler)
+	rt.handle("DELETE", "/sessions/{id}", s.endSessionHandler)
+	rt.handle("GET", "/schedules", s.listSchedulesHandler)
+	rt.handle("POST", "/schedules", s.createScheduleHandler)
+	rt.handle("GET", "/schedules/{id}", s.getScheduleHandler)
+	rt.handle("DELETE", "/schedules/{id}", s.cancelScheduleHandler)
+	rt.handle("GET", "/admin/webhooks", s.listWebhooksHandler)
+	rt.handle("POST", "/admin/webhooks", s.addWebhookHandler)
+	rt.handle("DELETE", "/admin/webhooks/{id}", s.deleteWebhookHandler)
+	rt.handle("GET", "/admin/backups", s.listBackupsHandler)
+	rt.handle("POST", "/admin/backups", s.createBackupHandler)
+	rt.handle("POST", "/admin/backups/restore", s.restoreBackupHandler)
+	rt.handle("POST", "/admin/restore", s.pointInTimeRestoreHandler)
+	rt.handle("GET", "/admin/schemas", s.listSchemasHandler)
+	rt.handle("PUT", "/admin/schemas", s.putSchemaHandler)
+	rt.handle("DELETE", "/admin/schemas", s.deleteSchemaHandler)
+
+	rt.handle("GET", "/cluster", s.clusterHandler)
+	rt.handle("GET", "/cluster/status", s.clusterHandler)
+	rt.handle("GET", "/cluster/topology", s.clusterTopologyHandler)
+	rt.handle("GET", "/cluster/rebalance", s.rebalanceHandler)
+	rt.handle("GET", "/replication/stream", s.replicationStreamHandler)
+	rt.handle("GET", "/replication/snapshot", s.replicationSnapshotHandler)
+	rt.handle("POST", "/replication/apply", s.applyMirrorHandler)
+	rt.handle("GET", "/replication/digest", s.mirrorDigestHandler)
+
+	rt.handle("GET", "/audit", s.auditHandler)
+	rt.handle("GET", "/audit/export", s.auditExportHandler)
+	rt.handle("GET", "/admin/recordings", s.listRecordingsHandler)
+	rt.handle("DELETE", "/admin/recordings", s.clearRecordingsHandler)
+	rt.handle("GET", "/admin/recordings/export", s.exportRecordingsHandler)
+	rt.handle("POST", "/admin/flush", s.flushHandler)
+	rt.handle("GET", "/admin/jobs", s.listJobsHandler)
+	rt.handle("GET", "/admin/events", s.eventsHandler)
+	rt.handle("GET", "/admin/mirror", s.mirrorStatusHandler)
+	rt.handle("GET", "/admin/mirror/diff", s.mirrorDiffHandler)
+	rt.handle("GET", "/admin/shadow", s.shadowStatusHandler)
+	rt.handle("GET", "/admin/shadow/compare", s.shadowCompareHandler)
+	rt.handle("GET", "/admin/requests", s.listRequestsHandler)
+	rt.handle("DELETE", "/admin/requests/{id}", s.cancelRequestHandler)
+	rt.handle("GET", "/admin/lockouts", s.listLockoutsHandler)
+	rt.handle("DELETE", "/admin/lockouts/{remote}", s.unlockHandler)
+	rt.handle("POST", "/admin/diagnostics", s.diagnosticsHandler)
+	rt.handle("POST", "/admin/verify", s.verifyHandler)
+	rt.handle("POST", "/admin/compact", s.compactHandler)
+	rt.handle("GET", "/admin/chaos", s.getChaosHandler)
+	rt.handle("PUT", "/admin/chaos", s.putChaosHandler)
+	rt.handle("DELETE", "/admin/chaos", s.deleteChaosHandler)
+	rt.handle("POST", "/admin/promote", s.promoteHandler)
+	rt.handle("GET", "/admin/maintenance", s.getMaintenanceHandler)
+	rt.handle("PUT", "/admin/maintenance", s.putMaintenanceHandler)
+	rt.handle("GET", "/admin/flags", s.listFlagsHandler)
+	rt.handle("PUT", "/admin/flags/{name}", s.putFlagHandler)
+	rt.handle("GET", "/admin/eviction", s.getEvictionHandler)
+	rt.handle("PUT", "/admin/eviction", s.putEvictionHandler)
+
+	rt.handle("POST", "/auth/token", s.issueTokenHandler)
+	rt.handle("POST", "/auth/token/revoke", s.revokeTokenHandler)
+	rt.handle("GET", "/auth/token/revoked", s.listRevokedHandler)
+
+	rt.handle("GET", "/ns", s.listNamespacesHandler)
+	rt.handle("DELETE", "/ns/{namespace}", s.deleteNamespaceHandler, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/stats", s.namespaceStatsHandler, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/usage", s.namespaceUsageHandler, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/data", s.getDataHandler, s.withNamespace, s.consistentRead)
+	rt.handle("POST", "/ns/{namespace}/data", s.postDataHandler, s.routeToShard, s.withNamespace)
+	rt.handle("DELETE", "/ns/{namespace}/data", s.deletePrefixHandler, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/data/{key}", s.getKeyHandler, s.routeToShard, s.withNamespace, s.consistentRead)
+	rt.handle("HEAD", "/ns/{namespace}/data/{key}", s.headKeyHandler, s.routeToShard, s.withNamespace, s.consistentRead)
+	rt.handle("PUT", "/ns/{namespace}/data/{key}", s.putKeyHandler, s.routeToShard, s.withNamespace)
+	rt.handle("DELETE", "/ns/{namespace}/data/{key}", s.deleteDataHandler, s.routeToShard, s.withNamespace)
+	rt.handle("PATCH", "/ns/{namespace}/data/{key}", s.patchKeyHandler, s.routeToShard, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/data/{key}/meta", s.getKeyMetaHandler, s.routeToShard, s.withNamespace, s.consistentRead)
+	rt.handle("GET", "/ns/{namespace}/data/{key}/exists", s.keyExistsHandler, s.routeToShard, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/data/{key}/restore", s.restoreKeyHandler, s.routeToShard, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/data/{key}/history", s.keyHistoryHandler, s.routeToShard, s.withNamespace, s.consistentRead)
+	rt.handle("POST", "/ns/{namespace}/data/{key}/getset", s.getSetHandler, s.routeToShard, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/data/{key}/getdel", s.getDelHandler, s.routeToShard, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/data/{key}/lpush", s.lpushHandler, s.routeToShard, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/data/{key}/rpush", s.rpushHandler, s.routeToShard, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/data/{key}/lpop", s.lpopHandler, s.routeToShard, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/data/{key}/rpop", s.rpopHandler, s.routeToShard, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/data/{key}/lrange", s.lrangeHandler, s.routeToShard, s.withNamespace, s.consistentRead)
+	rt.handle("POST", "/ns/{namespace}/data/{key}/sadd", s.saddHandler, s.routeToShard, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/data/{key}/srem", s.sremHandler, s.routeToShard, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/data/{key}/smembers", s.smembersHandler, s.routeToShard, s.withNamespace, s.consistentRead)
+	rt.handle("GET", "/ns/{namespace}/tombstones", s.listTombstonesHandler, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/indexes", s.listIndexesHandler, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/indexes", s.createIndexHandler, s.withNamespace)
+	rt.handle("DELETE", "/ns/{namespace}/indexes/{name}", s.deleteIndexHandler, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/query", s.queryHandler, s.withNamespace, s.consistentRead)
+	rt.handle("GET", "/ns/{namespace}/search", s.searchHandler, s.withNamespace, s.consistentRead)
+	rt.handle("GET", "/ns/{namespace}/export", s.exportHandler, s.withNamespace, s.consistentRead)
+	rt.handle("GET", "/ns/{namespace}/changes", s.changesHandler, s.requireFeature(featureWatch), s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/queues/{name}", s.queueStatsHandler, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/queues/{name}/push", s.pushHandler, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/queues/{name}/pop", s.popHandler, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/queues/{name}/ack", s.ackHandler, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/import", s.importHandler, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/clone", s.cloneNamespaceHandler, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/session", s.sessionHandler, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/schedules", s.listSchedulesHandler, s.withNamespace)
+	rt.handle("POST", "/ns/{namespace}/schedules", s.createScheduleHandler, s.withNamespace)
+	rt.handle("GET", "/ns/{namespace}/schedules/{id}", s.getScheduleHandler, s.withNamespace)
+	rt.handle("DELETE", "/ns/{namespace}/schedules/{id}", s.cancelScheduleHandler, s.withNamespace)
+
+	rt.mux.HandleFunc("GET /healthz", s.healthzHandler)
+	rt.mux.HandleFunc("GET /readyz", s.readyzHandler)
+	rt.mux.HandleFunc("GET /metrics", s.metricsHandler)
+	if s.cfg.Pprof {
+		handlePprof(rt.mux)
+	}
+	if s.cfg.Expvar {
+		rt.mux.HandleFunc("GET /debug/vars", s.expvarHandler)
+	}
+	rt.mux.Handle("GET /openapi.json", openAPIHandler(buildOpenAPI(rt.routes)))
+	if swaggerUI {
+		rt.mux.HandleFunc("GET /docs", swaggerUIHandler)
+	}
+	if dashboard {
+		rt.mux.HandleFunc("GET "+uiPath, uiHandler)
+	}
+
+	return withErrorEnvelope(rt.mux)
+}
+
+// withErrorEnvelope replaces the ServeMux's built-in plain-text 404 and 405
+// responses with the JSON error envelope, so unmatched requests look like
+// every other error. OPTIONS requests to a known path, which the ServeMux
+// answers with 405, get 204 and the path's Allow header instead.
+func withErrorEnvelope(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &statusRecorder{header: make(http.Header)}
+		h.ServeHTTP(rec, r)
+		switch rec.status {
+		case http.StatusNotFound:
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Not found")
+		case http.StatusMethodNotAllowed:
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Allow", rec.header.Get("Allow")+", OPTIONS")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Allow", rec.header.Get("Allow"))
+			methodNotAllowed(w, r)
+		default:
+			// Redirects (e.g. path cleaning) are passed through as-is.
+			for k, v := range rec.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.status)
+		}
+	})
+}
+
+// statusRecorder captures the status and headers of a response, discarding
+// its body.
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *statusRecorder) Header() http.Header { return r.header }
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
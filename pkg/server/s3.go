@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client talks to an S3-compatible object store using path-style URLs
+// (endpoint/bucket/key) and AWS Signature Version 4, which AWS, MinIO,
+// Ceph and most other implementations accept. Only the handful of calls
+// backups need are implemented.
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Client(endpoint, bucket, region, accessKey, secretKey string) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Client{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// s3Object is an entry of a bucket listing.
+type s3Object struct {
+	Key          string    `xml:"Key" json:"name"`
+	Size         int64     `xml:"Size" json:"size"`
+	LastModified time.Time `xml:"LastModified" json:"last_modified"`
+}
+
+// s3Error is an error response from the object store.
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: HTTP %d", e.Status)
+	}
+	return fmt.Sprintf("s3: HTTP %d: %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (c *s3Client) put(ctx context.Context, key string, body []byte, contentType string) error {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, body, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// get returns the object's body, which the caller must close.
+func (c *s3Client) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *s3Client) remove(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list returns every object under prefix, following continuation tokens.
+func (c *s3Client) list(ctx context.Context, prefix string) ([]s3Object, error) {
+	var out []s3Object
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, http.MethodGet, "", q, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: decode listing: %w", err)
+		}
+		out = append(out, page.Contents...)
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return out, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// do sends a signed request for key in the bucket (the bucket itself when
+// key is empty) and turns non-2xx responses into an *s3Error.
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	// Send the path exactly as it is signed.
+	u.RawPath = awsEscape(u.Path, false)
+	u.RawQuery = awsQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.sign(req, body, time.Now().UTC())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &s3Error{Status: resp.StatusCode}
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host"}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			signed = append(signed, lower)
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	sort.Strings(signed)
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		canonicalHeaders.WriteString(h + ":" + headers[h] + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape percent-encodes s the way SigV4 requires: everything but
+// unreserved characters, with '/' kept unless encodeSlash is set.
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsQuery encodes q in the canonical form SigV4 signs: sorted by name,
+// with names and values escaped by awsEscape.
+func awsQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		values := append([]string(nil), q[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(name, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scheduledOp is a set or delete to be made at a given time.
+type scheduledOp struct {
+	ID        string    `json:"id"`
+	Op        string    `json:"op"` // "set" or "delete"
+	Namespace string    `json:"namespace"`
+	Key       string    `json:"key"`
+	Value     *string   `json:"value,omitempty"`
+	At        time.Time `json:"at"`
+	Created   time.Time `json:"created"`
+	Client    string    `json:"client,omitempty"`
+}
+
+// scheduleTable holds the pending scheduled operations. Like leases, they
+// are kept in memory only, on the node that accepted them.
+type scheduleTable struct {
+	mu   sync.Mutex
+	byID map[string]*scheduledOp
+
+	done   int64 // operations carried out
+	failed int64 // operations that failed when their time came
+}
+
+func newScheduleTable() *scheduleTable {
+	return &scheduleTable{byID: make(map[string]*scheduledOp)}
+}
+
+func (st *scheduleTable) add(op scheduledOp) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.byID[op.ID] = &op
+}
+
+func (st *scheduleTable) get(id string) (scheduledOp, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if op := st.byID[id]; op != nil {
+		return *op, true
+	}
+	return scheduledOp{}, false
+}
+
+// cancel removes a pending operation, returning it.
+func (st *scheduleTable) cancel(id string) (scheduledOp, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	op := st.byID[id]
+	if op == nil {
+		return scheduledOp{}, false
+	}
+	delete(st.byID, id)
+	return *op, true
+}
+
+// list returns the pending operations on namespace, soonest first.
+func (st *scheduleTable) list(namespace string) []scheduledOp {
+	st.mu.Lock()
+	out := make([]scheduledOp, 0, len(st.byID))
+	for _, op := range st.byID {
+		if op.Namespace == namespace {
+			out = append(out, *op)
+		}
+	}
+	st.mu.Unlock()
+	sortScheduled(out)
+	return out
+}
+
+// take removes and returns the operations due at now, soonest first.
+func (st *scheduleTable) take(now time.Time) []scheduledOp {
+	st.mu.Lock()
+	var due []scheduledOp
+	for id, op := range st.byID {
+		if !now.Before(op.At) {
+			due = append(due, *op)
+			delete(st.byID, id)
+		}
+	}
+	st.mu.Unlock()
+	sortScheduled(due)
+	return due
+}
+
+func (st *scheduleTable) record(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err != nil {
+		st.failed++
+	} else {
+		st.done++
+	}
+}
+
+func (st *scheduleTable) stats() map[string]int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return map[string]int64{
+		"pending": int64(len(st.byID)),
+		"done":    st.done,
+		"failed":  st.failed,
+	}
+}
+
+func sortScheduled(ops []scheduledOp) {
+	sort.Slice(ops, func(i, j int) bool {
+		if !ops[i].At.Equal(ops[j].At) {
+			return ops[i].At.Before(ops[j].At)
+		}
+		return ops[i].ID < ops[j].ID
+	})
+}
+
+// runScheduled carries out the scheduled operations that are due, each
+// as its client would have made it then: validated, audited and checked
+// against tag policies with the client's scopes. A failure is logged and
+// the operation dropped.
+func (s *Server) runScheduled() error {
+	ops := s.schedules.take(time.Now())
+	failed := 0
+	for _, op := range ops {
+		err := s.runScheduledOp(op)
+		s.schedules.record(err)
+		if err != nil {
+			failed++
+			s.logger.Printf("[Worker] Scheduled %s %s of %q failed: %v", op.ID, op.Op, op.Key, err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d scheduled operations failed", failed, len(ops))
+	}
+	return nil
+}
+
+func (s *Server) runScheduledOp(op scheduledOp) error {
+	ns := s.namespaces.get(op.Namespace, false)
+	if ns == nil {
+		return fmt.Errorf("namespace %s no longer exists", op.Namespace)
+	}
+	ctx := context.WithValue(context.Background(), namespaceKey, ns)
+	ctx = context.WithValue(ctx, clientIDKey, op.Client)
+	if d := s.cfg.RequestTimeout; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	if op.Op == "delete" {
+		return s.deleteKey(ctx, op.Key)
+	}
+	return s.setKey(ctx, op.Key, *op.Value)
+}
+
+// scheduleRequest is the body of POST /schedules. The time is at, or in
+// from now.
+type scheduleRequest struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Value *string         `json:"value"`
+	At    time.Time       `json:"at"`
+	In    json.RawMessage `json:"in"`
+}
+
+// POST
+//
+// createScheduleHandler schedules a set or delete of a key for a future
+// time, answering 201 with the scheduled operation. The key and value are
+// checked against the key rules, the size limit and the tag policies now;
+// schemas and validation webhooks see the write when it is made.
+func (s *Server) createScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	var req scheduleRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	now := time.Now().UTC()
+	at := req.At
+	if len(req.In) > 0 {
+		d, ok := parseDurationJSON(req.In, 0)
+		if !ok || !at.IsZero() {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "in must be seconds or a duration such as \"1h\", and not given with at")
+			return
+		}
+		at = now.Add(d)
+	}
+	switch {
+	case req.Op != "set" && req.Op != "delete":
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "op must be set or delete")
+		return
+	case req.Op == "set" && req.Value == nil:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "value is required to schedule a set")
+		return
+	case req.Op == "delete" && req.Value != nil:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "value is not allowed with delete")
+		return
+	case at.IsZero() || !at.After(now):
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "at or in must be a time in the future")
+		return
+	}
+
+	ctx := r.Context()
+	ns := s.namespaceFrom(ctx)
+	key := s.keyRules.canonical(req.Key)
+	value := ""
+	if req.Value != nil {
+		value = *req.Value
+	}
+	if fields := s.checkPayload(map[string]string{key: value}); len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
+		return
+	}
+	if err := s.checkTags(ctx, req.Op, key, ns.tags.get(key)); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	op := scheduledOp{
+		ID:        newRequestID(),
+		Op:        req.Op,
+		Namespace: ns.name,
+		Key:       key,
+		Value:     req.Value,
+		At:        at.UTC(),
+		Created:   now,
+		Client:    clientIDFrom(ctx),
+	}
+	s.schedules.add(op)
+	writeJSON(w, http.StatusCreated, op)
+}
+
+// GET
+//
+// listSchedulesHandler returns the pending operations on the namespace,
+// soonest first.
+func (s *Server) listSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.schedules.list(s.namespaceFrom(r.Context()).name))
+}
+
+// GET
+func (s *Server) getScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	op, ok := s.schedules.get(r.PathValue("id"))
+	if !ok || op.Namespace != s.namespaceFrom(r.Context()).name {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No pending scheduled operation with that id")
+		return
+	}
+	writeJSON(w, http.StatusOK, op)
+}
+
+// DELETE
+//
+// cancelScheduleHandler cancels a pending operation, answering with it.
+func (s *Server) cancelScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if op, ok := s.schedules.get(id); !ok || op.Namespace != s.namespaceFrom(r.Context()).name {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No pending scheduled operation with that id")
+		return
+	}
+	op, ok := s.schedules.cancel(id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No pending scheduled operation with that id")
+		return
+	}
+	writeJSON(w, http.StatusOK, op)
+}
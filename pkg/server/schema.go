@@ -0,0 +1,539 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// jsonSchema is a compiled JSON Schema. The supported keywords are type,
+// enum, const, properties, required, additionalProperties, minProperties,
+// maxProperties, items, minItems, maxItems, uniqueItems, minLength,
+// maxLength, pattern, minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum, multipleOf, allOf, anyOf, oneOf and not; others are
+// ignored.
+type jsonSchema struct {
+	boolean *bool // set for the schemas true and false
+
+	types    []string
+	enum     []interface{}
+	constVal interface{}
+	hasConst bool
+
+	properties    map[string]*jsonSchema
+	required      []string
+	additional    *jsonSchema
+	minProperties *int
+	maxProperties *int
+
+	items       *jsonSchema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	multipleOf                         *float64
+
+	allOf, anyOf, oneOf []*jsonSchema
+	not                 *jsonSchema
+}
+
+func compileSchema(raw interface{}) (*jsonSchema, error) {
+	switch v := raw.(type) {
+	case bool:
+		return &jsonSchema{boolean: &v}, nil
+	case map[string]interface{}:
+		return compileSchemaObject(v)
+	}
+	return nil, fmt.Errorf("schema must be an object or a boolean")
+}
+
+func compileSchemaObject(m map[string]interface{}) (*jsonSchema, error) {
+	s := &jsonSchema{}
+	var err error
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("type must be a string or an array of strings")
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("type must be a string or an array of strings")
+	}
+	if e, ok := m["enum"]; ok {
+		if s.enum, ok = e.([]interface{}); !ok {
+			return nil, fmt.Errorf("enum must be an array")
+		}
+	}
+	s.constVal, s.hasConst = m["const"]
+
+	if p, ok := m["properties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("properties must be an object")
+		}
+		s.properties = make(map[string]*jsonSchema, len(props))
+		for name, sub := range props {
+			if s.properties[name], err = compileSchema(sub); err != nil {
+				return nil, fmt.Errorf("properties.%s: %w", name, err)
+			}
+		}
+	}
+	if r, ok := m["required"]; ok {
+		list, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("required must be an array of strings")
+		}
+		for _, v := range list {
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("required must be an array of strings")
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	for keyword, dst := range map[string]**jsonSchema{
+		"additionalProperties": &s.additional,
+		"items":                &s.items,
+		"not":                  &s.not,
+	} {
+		if sub, ok := m[keyword]; ok {
+			if *dst, err = compileSchema(sub); err != nil {
+				return nil, fmt.Errorf("%s: %w", keyword, err)
+			}
+		}
+	}
+	for keyword, dst := range map[string]*[]*jsonSchema{
+		"allOf": &s.allOf,
+		"anyOf": &s.anyOf,
+		"oneOf": &s.oneOf,
+	} {
+		if v, ok := m[keyword]; ok {
+			list, ok := v.([]interface{})
+			if !ok || len(list) == 0 {
+				return nil, fmt.Errorf("%s must be a non-empty array", keyword)
+			}
+			for i, sub := range list {
+				c, err := compileSchema(sub)
+				if err != nil {
+					return nil, fmt.Errorf("%s[%d]: %w", keyword, i, err)
+				}
+				*dst = append(*dst, c)
+			}
+		}
+	}
+
+	for keyword, dst := range map[string]**int{
+		"minProperties": &s.minProperties,
+		"maxProperties": &s.maxProperties,
+		"minItems":      &s.minItems,
+		"maxItems":      &s.maxItems,
+		"minLength":     &s.minLength,
+		"maxLength":     &s.maxLength,
+	} {
+		if v, ok := m[keyword]; ok {
+			f, ok := v.(float64)
+			if !ok || f < 0 || f != math.Trunc(f) {
+				return nil, fmt.Errorf("%s must be a non-negative integer", keyword)
+			}
+			n := int(f)
+			*dst = &n
+		}
+	}
+	for keyword, dst := range map[string]**float64{
+		"minimum":          &s.minimum,
+		"maximum":          &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMinimum,
+		"exclusiveMaximum": &s.exclusiveMaximum,
+		"multipleOf":       &s.multipleOf,
+	} {
+		if v, ok := m[keyword]; ok {
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a number", keyword)
+			}
+			*dst = &f
+		}
+	}
+	if u, ok := m["uniqueItems"].(bool); ok {
+		s.uniqueItems = u
+	}
+	if p, ok := m["pattern"]; ok {
+		str, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("pattern must be a string")
+		}
+		if s.pattern, err = regexp.Compile(str); err != nil {
+			return nil, fmt.Errorf("pattern: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func jsonType(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if x == math.Trunc(x) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func typeMatches(want, got string) bool {
+	return want == got || (want == "number" && got == "integer")
+}
+
+// validate appends a message for every violation of s by v to errs. path
+// locates v in the document, in JSONPath form.
+func (s *jsonSchema) validate(v interface{}, path string, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+	if s.boolean != nil {
+		if !*s.boolean {
+			fail("no value is allowed here")
+		}
+		return
+	}
+
+	if len(s.types) > 0 {
+		got := jsonType(v)
+		ok := false
+		for _, t := range s.types {
+			ok = ok || typeMatches(t, got)
+		}
+		if !ok {
+			fail("expected %s, got %s", strings.Join(s.types, " or "), got)
+			return
+		}
+	}
+	if s.enum != nil {
+		ok := false
+		for _, e := range s.enum {
+			ok = ok || reflect.DeepEqual(e, v)
+		}
+		if !ok {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constVal, v) {
+		fail("value must equal the constant")
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := x[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		if s.minProperties != nil && len(x) < *s.minProperties {
+			fail("must have at least %d properties", *s.minProperties)
+		}
+		if s.maxProperties != nil && len(x) > *s.maxProperties {
+			fail("must have at most %d properties", *s.maxProperties)
+		}
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if sub, ok := s.properties[name]; ok {
+				sub.validate(x[name], path+"."+name, errs)
+			} else if s.additional != nil {
+				if s.additional.boolean != nil && !*s.additional.boolean {
+					fail("unexpected property %q", name)
+				} else {
+					s.additional.validate(x[name], path+"."+name, errs)
+				}
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(x) < *s.minItems {
+			fail("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(x) > *s.maxItems {
+			fail("must have at most %d items", *s.maxItems)
+		}
+		if s.uniqueItems {
+			for i := range x {
+				for j := i + 1; j < len(x); j++ {
+					if reflect.DeepEqual(x[i], x[j]) {
+						fail("items %d and %d are equal", i, j)
+					}
+				}
+			}
+		}
+		if s.items != nil {
+			for i, item := range x {
+				s.items.validate(item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(x)
+		if s.minLength != nil && n < *s.minLength {
+			fail("must be at least %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("must be at most %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(x) {
+			fail("does not match pattern %q", s.pattern.String())
+		}
+	case float64:
+		if s.minimum != nil && x < *s.minimum {
+			fail("must be >= %v", *s.minimum)
+		}
+		if s.maximum != nil && x > *s.maximum {
+			fail("must be <= %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && x <= *s.exclusiveMinimum {
+			fail("must be > %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && x >= *s.exclusiveMaximum {
+			fail("must be < %v", *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil && *s.multipleOf != 0 {
+			if q := x / *s.multipleOf; q != math.Trunc(q) {
+				fail("must be a multiple of %v", *s.multipleOf)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, errs)
+	}
+	if len(s.anyOf) > 0 {
+		ok := false
+		for _, sub := range s.anyOf {
+			ok = ok || sub.valid(v)
+		}
+		if !ok {
+			fail("does not match any of the anyOf schemas")
+		}
+	}
+	if len(s.oneOf) > 0 {
+		n := 0
+		for _, sub := range s.oneOf {
+			if sub.valid(v) {
+				n++
+			}
+		}
+		if n != 1 {
+			fail("must match exactly one of the oneOf schemas, matched %d", n)
+		}
+	}
+	if s.not != nil && s.not.valid(v) {
+		fail("must not match the not schema")
+	}
+}
+
+func (s *jsonSchema) valid(v interface{}) bool {
+	var errs []string
+	s.validate(v, "$", &errs)
+	return len(errs) == 0
+}
+
+// SchemaError reports why a value was rejected by a JSON Schema.
+type SchemaError struct {
+	Key    string
+	Prefix string
+	Errors []string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("value of %q does not match the schema for prefix %q: %s",
+		e.Key, e.Prefix, strings.Join(e.Errors, "; "))
+}
+
+func (e *SchemaError) Unwrap() error { return ErrValidationFailed }
+
+// schemaEntry is a schema registered for a key prefix.
+type schemaEntry struct {
+	Prefix string          `json:"prefix"`
+	Schema json.RawMessage `json:"schema"`
+
+	compiled *jsonSchema
+}
+
+// schemaRegistry maps key prefixes to JSON Schemas. A value is checked
+// against the schema with the longest matching prefix.
+type schemaRegistry struct {
+	mu      sync.RWMutex
+	entries map[string]*schemaEntry
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{entries: make(map[string]*schemaEntry)}
+}
+
+func (sr *schemaRegistry) set(prefix string, raw json.RawMessage) error {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("schema is not valid JSON: %w", err)
+	}
+	compiled, err := compileSchema(doc)
+	if err != nil {
+		return err
+	}
+	sr.mu.Lock()
+	sr.entries[prefix] = &schemaEntry{Prefix: prefix, Schema: raw, compiled: compiled}
+	sr.mu.Unlock()
+	return nil
+}
+
+// loadFile registers the schema stored in path for prefix.
+func (sr *schemaRegistry) loadFile(prefix, path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return sr.set(prefix, raw)
+}
+
+func (sr *schemaRegistry) remove(prefix string) bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if _, ok := sr.entries[prefix]; !ok {
+		return false
+	}
+	delete(sr.entries, prefix)
+	return true
+}
+
+func (sr *schemaRegistry) list() []*schemaEntry {
+	sr.mu.RLock()
+	out := make([]*schemaEntry, 0, len(sr.entries))
+	for _, e := range sr.entries {
+		out = append(out, e)
+	}
+	sr.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Prefix < out[j].Prefix })
+	return out
+}
+
+// match returns the entry with the longest prefix of key, or nil.
+func (sr *schemaRegistry) match(key string) *schemaEntry {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	var best *schemaEntry
+	for p, e := range sr.entries {
+		if strings.HasPrefix(key, p) && (best == nil || len(p) > len(best.Prefix)) {
+			best = e
+		}
+	}
+	return best
+}
+
+// Validate checks value against the schema registered for key, if any.
+func (sr *schemaRegistry) Validate(key, value string) error {
+	e := sr.match(key)
+	if e == nil {
+		return nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(value), &doc); err != nil {
+		return &SchemaError{Key: key, Prefix: e.Prefix, Errors: []string{"$: value is not valid JSON"}}
+	}
+	var errs []string
+	e.compiled.validate(doc, "$", &errs)
+	if len(errs) > 0 {
+		return &SchemaError{Key: key, Prefix: e.Prefix, Errors: errs}
+	}
+	return nil
+}
+
+// SchemaFiles maps key prefixes to JSON Schema files. It implements
+// flag.Value, parsing repeated "prefix=path" arguments.
+type SchemaFiles map[string]string
+
+func (f *SchemaFiles) String() string {
+	parts := make([]string, 0, len(*f))
+	for p, path := range *f {
+		parts = append(parts, p+"="+path)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f *SchemaFiles) Set(v string) error {
+	prefix, path, ok := strings.Cut(v, "=")
+	if !ok || path == "" {
+		return fmt.Errorf("schema %q must be in prefix=path form", v)
+	}
+	if *f == nil {
+		*f = make(SchemaFiles)
+	}
+	(*f)[prefix] = path
+	return nil
+}
+
+// GET
+func (s *Server) listSchemasHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.schemas.list())
+}
+
+// PUT
+//
+// putSchemaHandler registers or replaces the schema for a prefix. The body
+// is {"prefix": "...", "schema": {...}}.
+func (s *Server) putSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix string          `json:"prefix"`
+		Schema json.RawMessage `json:"schema"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Schema) == 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "schema is required")
+		return
+	}
+	if err := s.schemas.set(req.Prefix, req.Schema); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid schema: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "registered", "prefix": req.Prefix})
+}
+
+// DELETE
+func (s *Server) deleteSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.schemas.remove(r.URL.Query().Get("prefix")) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No schema for prefix")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 1000
+)
+
+// tokenize splits text into lower-cased runs of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// valueTokens returns the searchable tokens of a stored value. For JSON
+// objects and arrays only the string and number leaves are searched, so
+// member names and punctuation do not match; other values are searched as
+// plain text.
+func valueTokens(value string) []string {
+	var doc interface{}
+	if json.Unmarshal([]byte(value), &doc) != nil {
+		return tokenize(value)
+	}
+	var out []string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch x := v.(type) {
+		case string:
+			out = append(out, tokenize(x)...)
+		case float64:
+			out = append(out, tokenize(strconv.FormatFloat(x, 'f', -1, 64))...)
+		case []interface{}:
+			for _, item := range x {
+				walk(item)
+			}
+		case map[string]interface{}:
+			for _, item := range x {
+				walk(item)
+			}
+		}
+	}
+	walk(doc)
+	return out
+}
+
+// searchIndex is an inverted index from tokens to the keys whose values
+// contain them, fed from a namespace's watch hub.
+type searchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]int // token -> key -> occurrences
+	docs     map[string][]string       // key -> its distinct tokens
+	lengths  map[string]int            // key -> number of tokens
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[string]int),
+		docs:     make(map[string][]string),
+		lengths:  make(map[string]int),
+	}
+}
+
+// apply is a watchHub listener.
+func (si *searchIndex) apply(ev Event) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.removeLocked(ev.Key)
+	if ev.Type == "delete" {
+		return
+	}
+	tokens := valueTokens(ev.Value)
+	if len(tokens) == 0 {
+		return
+	}
+	counts := make(map[string]int)
+	for _, t := range tokens {
+		counts[t]++
+	}
+	distinct := make([]string, 0, len(counts))
+	for t, n := range counts {
+		keys := si.postings[t]
+		if keys == nil {
+			keys = make(map[string]int)
+			si.postings[t] = keys
+		}
+		keys[ev.Key] = n
+		distinct = append(distinct, t)
+	}
+	si.docs[ev.Key] = distinct
+	si.lengths[ev.Key] = len(tokens)
+}
+
+func (si *searchIndex) removeLocked(key string) {
+	for _, t := range si.docs[key] {
+		keys := si.postings[t]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(si.postings, t)
+		}
+	}
+	delete(si.docs, key)
+	delete(si.lengths, key)
+}
+
+// searchHit is one ranked result of a search.
+type searchHit struct {
+	Key   string  `json:"key"`
+	Score float64 `json:"score"`
+}
+
+// search ranks the keys matching the query terms by TF-IDF, with term
+// frequencies normalised by value length. With all set a key must contain
+// every term; otherwise any one is enough. It returns the total number of
+// matches and up to limit of the best, highest score first.
+func (si *searchIndex) search(terms []string, all bool, prefix string, limit int) (int, []searchHit) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	n := float64(len(si.docs))
+	scores := make(map[string]float64)
+	matched := make(map[string]int)
+	seen := make(map[string]bool, len(terms))
+	distinct := 0
+	for _, t := range terms {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		distinct++
+		keys := si.postings[t]
+		idf := math.Log(1 + n/float64(len(keys)+1))
+		for k, tf := range keys {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			scores[k] += float64(tf) / float64(si.lengths[k]) * idf
+			matched[k]++
+		}
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for k, score := range scores {
+		if all && matched[k] < distinct {
+			continue
+		}
+		hits = append(hits, searchHit{Key: k, Score: math.Round(score*1e6) / 1e6})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Key < hits[j].Key
+	})
+	total := len(hits)
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return total, hits
+}
+
+// GET
+//
+// searchHandler answers ?q= with the keys whose values contain every term,
+// best match first. ?mode=any matches keys containing any term; ?prefix
+// restricts the keys searched and ?limit (default 20, max 1000) caps the
+// results.
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	ns := s.namespaceFrom(r.Context())
+	if ns.search == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Full-text search is not enabled")
+		return
+	}
+	q := r.URL.Query()
+	terms := tokenize(q.Get("q"))
+	if len(terms) == 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "q must contain at least one word")
+		return
+	}
+	var all bool
+	switch q.Get("mode") {
+	case "", "all":
+		all = true
+	case "any":
+	default:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "mode must be all or any")
+		return
+	}
+	limit := defaultSearchLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid limit")
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+	total, hits := ns.search.search(terms, all, q.Get("prefix"), limit)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"query": q.Get("q"),
+		"total": total,
+		"hits":  hits,
+	})
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits on fetching a seed from a URL.
+const (
+	seedFetchTimeout = 30 * time.Second
+	maxSeedSize      = 256 << 20
+)
+
+// loadSeed reads a flat key/value mapping from src, a .json, .yaml, .yml
+// or .csv file or an http(s) URL of one. A URL's format is taken from the
+// extension of its path, or else its Content-Type, and defaults to JSON.
+// If checksum, the hex SHA-256 of the contents (optionally prefixed
+// "sha256:"), is set, contents that do not match it are rejected.
+func loadSeed(src, checksum string) (map[string]string, error) {
+	var (
+		buf    []byte
+		format string
+		err    error
+	)
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		buf, format, err = fetchSeed(src)
+	} else {
+		buf, err = os.ReadFile(src)
+		format = filepath.Ext(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" {
+		want, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(checksum), "sha256:"))
+		if err != nil || len(want) != sha256.Size {
+			return nil, errors.New("seed checksum must be a hex SHA-256")
+		}
+		if got := sha256.Sum256(buf); !bytes.Equal(got[:], want) {
+			return nil, fmt.Errorf("%s: checksum mismatch: got sha256:%x", src, got)
+		}
+	}
+	switch strings.ToLower(format) {
+	case ".yaml", ".yml":
+		return parseFlatYAML(buf)
+	case ".csv":
+		return parseSeedCSV(buf)
+	default:
+		var data map[string]string
+		if err := json.Unmarshal(buf, &data); err != nil {
+			return nil, fmt.Errorf("%s: %w", src, err)
+		}
+		return data, nil
+	}
+}
+
+// fetchSeed downloads a seed, returning it with the extension of its
+// format.
+func fetchSeed(src string) ([]byte, string, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, "", err
+	}
+	client := &http.Client{Timeout: seedFetchTimeout}
+	resp, err := client.Get(src)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: %s", src, resp.Status)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, maxSeedSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(buf) > maxSeedSize {
+		return nil, "", fmt.Errorf("%s: larger than %d bytes", src, maxSeedSize)
+	}
+	format := path.Ext(u.Path)
+	if format == "" {
+		mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		switch {
+		case mt == "text/csv":
+			format = ".csv"
+		case strings.Contains(mt, "yaml"):
+			format = ".yaml"
+		}
+	}
+	return buf, format, nil
+}
+
+// parseSeedCSV parses key,value rows, under an optional header row.
+func parseSeedCSV(buf []byte) (map[string]string, error) {
+	cr := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(buf, []byte("\xef\xbb\xbf"))))
+	cr.FieldsPerRecord = -1
+	data := make(map[string]string)
+	for first := true; ; first = false {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && isCSVHeader(row) {
+			continue
+		}
+		if len(row) != 2 {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("line %d: want 2 columns (key,value), got %d", line, len(row))
+		}
+		data[row[0]] = row[1]
+	}
+}
+
+// parseFlatYAML parses the subset of YAML needed for seed files: one
+// "key: value" pair per line, optionally quoted, with # comments and blank
+// lines ignored. Nested mappings and sequences are rejected.
+func parseFlatYAML(buf []byte) (map[string]string, error) {
+	data := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if line != trimmed {
+			return nil, fmt.Errorf("line %d: nested values are not supported", lineNo)
+		}
+		// A double-quoted key may itself contain a colon.
+		split := 0
+		if strings.HasPrefix(line, `"`) {
+			if q, err := strconv.QuotedPrefix(line); err == nil {
+				split = len(q)
+			}
+		}
+		sep := strings.Index(line[split:], ":")
+		if sep < 0 {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+		}
+		k, v := line[:split+sep], line[split+sep+1:]
+		key, err := unquoteYAML(strings.TrimSpace(k))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		value, err := unquoteYAML(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		data[key] = value
+	}
+	return data, sc.Err()
+}
+
+func unquoteYAML(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", errors.New("unterminated quoted string")
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s, nil
+}
+
+// seedStore writes data into store. Keys that already exist are left alone
+// unless overwrite is set. It returns how many keys were written.
+func seedStore(store Store, data map[string]string, overwrite bool) (int, error) {
+	n := 0
+	for k, v := range data {
+		if !overwrite {
+			if _, err := store.Get(k); err == nil {
+				continue
+			}
+		}
+		if err := store.Set(k, v); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
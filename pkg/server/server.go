@@ -0,0 +1,1380 @@
+// Package server implements the key/value server: the HTTP API, and the
+// optional gRPC and Redis protocol listeners.
+//
+// To embed it, create a Server with New and either mount Handler in an
+// existing http.Server or run it on its own listeners:
+//
+//	srv, err := server.New(server.WithAddr(":9000"))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	if err := srv.Start(); err != nil {
+//		log.Fatal(err)
+//	}
+//	defer srv.Stop(context.Background())
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Server is a key/value server. It can be run on its own listeners with
+// Start and Stop, or mounted into another program via Handler.
+type Server struct {
+	mu            timedMutex
+	store         Store
+	totalRequests int
+	methodCount   map[string]int
+	errorCount    int
+	panicCount    int
+	history       *statsRing
+	shutdownCh    chan struct{}
+
+	hub        *watchHub
+	webhooks   *webhookDispatcher
+	namespaces *namespaceRegistry
+	sessions   sessionStats
+	expiry     expiryStats
+
+	// limiter, if set, is the per-client rate limit, also applied to each
+	// command of a command session.
+	limiter *rateLimiter
+
+	// evictor, if set, keeps the store within a memory budget. It is also
+	// s.store.
+	evictor *evictingStore
+
+	// audit, if set, records every mutation.
+	audit *auditLog
+	// recorder, if set, captures requests and responses for replaying.
+	recorder *recorder
+
+	// backups, if set, uploads snapshots to object storage.
+	backups *backupManager
+
+	// keys, if set, encrypts the data file and backups.
+	keys *keyRing
+	// persist is the codec the data file is written in.
+	persist PersistCodec
+
+	// raft, if set, replicates every write through a Raft group made of
+	// the topology's nodes.
+	raft     *raftNode
+	topology *topology
+
+	// discovery, set with a topology, keeps its membership up to date.
+	discovery *discovery
+	// registration, if set, lists the instance in a registration file or
+	// with a registry while it serves.
+	registration *registration
+
+	// replica, if set, follows a primary; the node is read-only otherwise.
+	// It is cleared when the node is promoted, recorded in promotion.
+	replica   atomic.Pointer[replica]
+	promotion atomic.Pointer[promotion]
+
+	// mirror, if set, copies the node's mutations to another site.
+	mirror *mirror
+	// shadow, if set, applies writes to a second backend as well.
+	shadow *shadowWriter
+
+	// auth, if set, authenticates API requests, and tokens checks the
+	// tokens issued to service accounts.
+	auth   *authenticator
+	tokens *tokenIssuer
+
+	// shards, if set, forwards requests for keys owned by other nodes,
+	// and rebalance moves keys to them when the ring changes.
+	shards    *shardRouter
+	rebalance *rebalancer
+
+	// locks holds the leases taken through /locks.
+	locks *lockTable
+	// keySessions holds the sessions of /sessions and the keys attached
+	// to them.
+	keySessions *sessionTable
+
+	// schedules holds the operations scheduled through /schedules.
+	schedules *scheduleTable
+
+	// clients counts traffic per client for /stats/clients.
+	clients *clientTable
+
+	// routeLimits cap the concurrency of expensive routes.
+	routeLimits routeLimits
+	// routeSwitch turns off the routes of Config.DisabledRoutes.
+	routeSwitch *routeSwitch
+
+	// chaos, if set, injects faults into routes as told by /admin/chaos.
+	chaos *chaosInjector
+
+	// slowLog, if set, logs and counts requests slower than
+	// Config.SlowRequestThreshold.
+	slowLog *slowLog
+
+	// statsd, if set, pushes metrics to a StatsD daemon.
+	statsd *statsdExporter
+
+	// alerter, if set, notifies Config.AlertURL of alert rules crossing
+	// their thresholds.
+	alerter *alerter
+
+	// lockStats, if set, counts the contention on s.mu and the
+	// namespaces' locks.
+	lockStats *lockStats
+
+	// proxies are the load balancers trusted to name the client.
+	proxies trustedProxies
+
+	// backend is the store New opened from the configuration, if it needs
+	// closing.
+	backend io.Closer
+	// dataLock is the lock on DataFile held while the server runs.
+	dataLock *os.File
+
+	// codec, if set, compresses values held in memory.
+	codec *valueCodec
+	// dedup, if set, stores identical values once.
+	dedup *dedupPool
+	// flags are the runtime switches of /admin/flags.
+	flags *featureFlags
+	// confirms, if set, holds the tokens that confirm destructive
+	// operations.
+	confirms *confirmations
+
+	// sealer, if set, encrypts the values of keys under
+	// Config.EncryptPrefixes.
+	sealer *valueSealer
+	// hooks transform values under Config.ValueHooks prefixes.
+	hooks valueHooks
+
+	// cache, if set, holds hot values of the backend in memory.
+	cache *cacheStore
+
+	// graphql is the schema served at /graphql.
+	graphql *gqlSchema
+
+	// hotKeys, if set, estimates the most accessed keys for /stats/hotkeys.
+	hotKeys *hotKeyTracker
+
+	// idempotency, if set, replays responses to retried writes.
+	idempotency *idempotencyCache
+
+	// validator, if set, approves writes before they reach the store.
+	validator *webhookValidator
+
+	// schemas holds the JSON Schemas values must match, by key prefix.
+	schemas *schemaRegistry
+
+	// keyRules are the naming rules for keys written by clients.
+	keyRules *keyRules
+
+	// draining is set during shutdown; mutations are rejected with
+	// ErrReadOnly while it is true. notReady is set before it, when
+	// shutdown begins, and fails /readyz.
+	draining atomic.Bool
+	notReady atomic.Bool
+
+	// events carries the events of handlers and jobs to the log, stats,
+	// webhooks and GET /admin/events.
+	events *eventBus
+
+	// admission, if set, sheds requests while the server is overloaded.
+	admission *admission
+	// priorities classify requests for admission and concurrency limits.
+	priorities *priorities
+
+	// deadlines counts requests that ran out of time.
+	deadlines deadlineStats
+
+	// inFlight is the number of HTTP requests being handled, and requests
+	// the requests themselves.
+	inFlight atomic.Int64
+	requests requestTable
+
+	// writeCount and deleteCount are the keys set and removed, counted
+	// apart from the request counters since one request can touch many
+	// keys.
+	writeCount  atomic.Int64
+	deleteCount atomic.Int64
+
+	// rates are the rates of change of the counters over the last 1, 5
+	// and 15 minutes, as of the background worker's last snapshot. They
+	// are guarded by mu.
+	rates map[string]windowRates
+
+	// maintenance is the read-only switch of /admin/maintenance.
+	maintenance maintenanceMode
+
+	// jobs are the periodic background tasks listed in /admin/jobs.
+	jobs jobScheduler
+	// clock is the time of key TTLs, jobs, rate limits and stats
+	// snapshots.
+	clock Clock
+
+	// recentErrors are the last failed requests, for diagnostic reports.
+	recentErrors errorRing
+
+	// compactMu is held by the compaction of POST /admin/compact, and
+	// lastCompaction is its last result, for /stats.
+	compactMu      sync.Mutex
+	lastCompaction atomic.Pointer[compactProgress]
+
+	// loadCorrupt are the keys skipped when the data file was loaded
+	// because their value failed its checksum, for /admin/verify.
+	loadCorrupt []string
+
+	// started is when the server was created, for the uptime in /info.
+	started time.Time
+
+	cfg     Config
+	logger  *log.Logger
+	handler http.Handler
+	// adminHandler serves the admin listener: handler, or with
+	// AdminAPIKeys the same routes authenticated by those keys.
+	adminHandler http.Handler
+
+	// listeners serve the HTTP API; ln is the first, on Addr.
+	listeners []*httpListener
+	ln        net.Listener
+	// sockets are the listeners as opened, by name, for Upgrade; handedOff
+	// is set once another process has taken them over.
+	sockets   map[string]net.Listener
+	handedOff atomic.Bool
+	grpcSrv   *grpc.Server
+	respSrv   *respServer
+	errs      chan error
+	stopOnce  sync.Once
+}
+
+// Option configures a Server created by New.
+type Option func(*options)
+
+type options struct {
+	cfg         Config
+	store       Store
+	logger      *log.Logger
+	auth        AuthProvider
+	middlewares []Middleware
+	clock       Clock
+}
+
+// WithConfig replaces the whole configuration.
+func WithConfig(cfg Config) Option {
+	return func(o *options) { o.cfg = cfg }
+}
+
+// WithAddr sets the HTTP listen address.
+func WithAddr(addr string) Option {
+	return func(o *options) { o.cfg.Addr = addr }
+}
+
+// WithStore backs the server with store instead of a new in-memory store.
+func WithStore(store Store) Option {
+	return func(o *options) { o.store = store }
+}
+
+// WithLogger sends the server's log output to l instead of the standard
+// logger.
+func WithLogger(l *log.Logger) Option {
+	return func(o *options) { o.logger = l }
+}
+
+// WithAuthProvider authenticates API requests with p instead of the
+// provider Config.AuthProvider selects.
+func WithAuthProvider(p AuthProvider) Option {
+	return func(o *options) { o.auth = p }
+}
+
+// WithMiddleware wraps the API handler in additional middleware, innermost
+// of the built-in chain, in the order given.
+func WithMiddleware(mws ...Middleware) Option {
+	return func(o *options) { o.middlewares = append(o.middlewares, mws...) }
+}
+
+// WithClock runs the server's key TTLs, background jobs, rate limits and
+// stats snapshots on c instead of SystemClock.
+func WithClock(c Clock) Option {
+	return func(o *options) { o.clock = c }
+}
+
+// New creates a server from DefaultConfig modified by opts. It loads the
+// data and seed files, if configured, but does not listen until Start.
+func New(opts ...Option) (*Server, error) {
+	o := options{cfg: DefaultConfig()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := validateConfig(o.cfg); err != nil {
+		return nil, err
+	}
+	codec, err := newValueCodec(o.cfg.ValueCompression, o.cfg.ValueCompressionMin)
+	if err != nil {
+		return nil, err
+	}
+	dedup := newDedupPool(o.cfg.Dedup, o.cfg.DedupMinSize)
+	var backend io.Closer
+	switch {
+	case o.store != nil:
+	case o.cfg.Storage == "" || o.cfg.Storage == storageMemory:
+		mem := newMemoryStore()
+		mem.codec = codec
+		mem.dedup = dedup
+		o.store = mem
+	case o.cfg.Storage == storageSQLite:
+		st, err := openSQLiteStore(o.cfg.StoragePath)
+		if err != nil {
+			return nil, err
+		}
+		o.store, backend = st, st
+	case o.cfg.Storage == storageBolt:
+		st, err := openBoltStore(o.cfg.StoragePath)
+		if err != nil {
+			return nil, err
+		}
+		o.store, backend = st, st
+	}
+	var cache *cacheStore
+	if backend != nil && o.cfg.CacheSize > 0 {
+		cache = newCacheStore(o.store, o.cfg.CacheSize, o.cfg.CacheTTL, o.cfg.CacheStaleWhileRevalidate)
+		o.store = cache
+	}
+	if o.logger == nil {
+		o.logger = log.Default()
+	}
+	cfg := o.cfg
+
+	responseHeaders, err := parseResponseHeaders(cfg.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	topo, err := newTopology(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topology: %w", err)
+	}
+	var disc *discovery
+	if topo != nil {
+		if disc, err = newDiscovery(cfg, topo, o.logger); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.RaftDir != "" && topo == nil {
+		return nil, errors.New("clustering requires a topology")
+	}
+	if cfg.Sharding && (topo == nil || cfg.RaftDir != "") {
+		return nil, errors.New("sharding requires a topology and cannot be combined with Raft")
+	}
+	if cfg.RaftDir != "" && disc.dynamic() {
+		return nil, errors.New("the members of a Raft cluster are fixed; use static discovery")
+	}
+	auth := o.auth
+	if auth == nil {
+		if auth, err = newAuthProvider(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TagPolicies.scoped() && auth == nil {
+		return nil, errors.New("tag policies with scopes require authentication")
+	}
+	if len(cfg.EncryptPrefixes) > 0 && auth == nil {
+		return nil, errors.New("value encryption requires authentication")
+	}
+	if cfg.TokenSecret != "" && auth == nil {
+		return nil, errors.New("token issuance requires authentication")
+	}
+
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ProxyProtocol && len(proxies) == 0 {
+		return nil, errors.New("the PROXY protocol requires trusted proxies")
+	}
+	keyRules, err := newKeyRules(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	features, err := newFeatureFlags(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newServer(o.store)
+	s.cfg = cfg
+	if o.clock != nil {
+		s.clock = o.clock
+	}
+	s.flags = features
+	s.backend = backend
+	s.cache = cache
+	s.codec = codec
+	s.namespaces.codec = codec
+	s.dedup = dedup
+	s.confirms = newConfirmations(cfg)
+	s.namespaces.dedup = dedup
+	s.keyRules = keyRules
+	if cfg.ReadOnly {
+		s.maintenance.set(true, "started read-only", defaultMaintenanceRetry)
+	}
+	s.logger = o.logger
+	s.topology = topo
+	s.discovery = disc
+	if s.keys, err = loadKeyRing(cfg.EncryptionKeyFile, cfg.EncryptionKey); err != nil {
+		return nil, fmt.Errorf("load encryption keys: %w", err)
+	}
+	if cfg.RaftDir != "" {
+		fsm := raftFSM{apply: s.applyRaftEntry, state: s.raftSnapshotState, restore: s.restoreRaftSnapshot}
+		if s.raft, err = newRaftNode(topo, cfg.RaftDir, cfg.RaftSecret, cfg.RaftElectionTimeout, s.keys, fsm, o.logger); err != nil {
+			return nil, fmt.Errorf("open raft state: %w", err)
+		}
+		topo.leader = s.raft.leaderID
+		topo.hint = s.raft.leaderHint
+	}
+	redirects := topo
+	if cfg.Sharding {
+		if s.shards, err = newShardRouter(topo, cfg.ShardVNodes); err != nil {
+			return nil, fmt.Errorf("invalid topology: %w", err)
+		}
+		s.rebalance = newRebalancer(s, cfg.RebalanceRate, cfg.RaftSecret)
+		topo.onChange = func(nodes []topologyNode) {
+			prev := s.shards.currentRing()
+			if err := s.shards.rebuild(nodes); err != nil {
+				s.logger.Printf("[Discovery] Keeping the hash ring: %v", err)
+				return
+			}
+			s.rebalance.begin(prev, s.shards.currentRing())
+		}
+		// Every node takes writes for the keys it owns.
+		redirects = nil
+	}
+	s.webhooks.logger = o.logger
+	s.proxies = proxies
+	s.history = newStatsRing(cfg.StatsRetention, cfg.WorkerInterval)
+	if cfg.HotKeyWindow > 0 {
+		s.hotKeys = newHotKeyTracker(cfg.HotKeyWindow)
+	}
+	s.namespaces.historyDepth = cfg.HistoryDepth
+	s.namespaces.enableHistory(s.namespaces.def)
+	s.namespaces.search = cfg.Search
+	s.namespaces.enableSearch(s.namespaces.def)
+	s.namespaces.bloomKeys, s.namespaces.bloomFPRate = cfg.BloomKeys, cfg.BloomFPRate
+	s.namespaces.enableBloom(s.namespaces.def)
+	s.namespaces.indexes = cfg.Indexes
+	s.namespaces.declareIndexes(s.namespaces.def)
+	s.webhooks.secret = cfg.WebhookSecret
+	for _, h := range cfg.Webhooks {
+		s.webhooks.add(h.Prefix, h.URL, "", nil)
+	}
+	if len(cfg.ValidationHooks) > 0 {
+		s.validator = newWebhookValidator(cfg.ValidationHooks, cfg.ValidateTimeout, cfg.ValidateFailOpen)
+	}
+	if s.registration, err = newRegistration(cfg); err != nil {
+		return nil, err
+	}
+	for prefix, path := range cfg.Schemas {
+		if err := s.schemas.loadFile(prefix, path); err != nil {
+			return nil, fmt.Errorf("load schema for prefix %q: %w", prefix, err)
+		}
+	}
+
+	if cfg.BackupBucket != "" {
+		c, err := newS3Client(cfg.BackupEndpoint, cfg.BackupBucket, cfg.BackupRegion, cfg.BackupAccessKey, cfg.BackupSecretKey)
+		if err != nil {
+			return nil, fmt.Errorf("backups: %w", err)
+		}
+		s.backups = &backupManager{s3: c, prefix: cfg.BackupPrefix, retain: cfg.BackupRetain}
+	}
+
+	if cfg.AuditSize > 0 || cfg.AuditFile != "" {
+		if s.audit, err = newAuditLog(cfg.AuditSize, cfg.AuditFile); err != nil {
+			return nil, fmt.Errorf("open audit log: %w", err)
+		}
+	}
+	if cfg.RecordSize > 0 || cfg.RecordFile != "" {
+		if s.recorder, err = newRecorder(cfg.RecordSize, cfg.RecordFile, cfg.RecordBodyLimit); err != nil {
+			return nil, fmt.Errorf("open request recording: %w", err)
+		}
+		s.logger.Printf("Recording requests and responses; credentials are left out, but keys and values are kept")
+	}
+
+	if s.hooks, err = newValueHooks(cfg.ValueHooks); err != nil {
+		return nil, err
+	}
+	if s.sealer, err = newValueSealer(s.keys, cfg.EncryptPrefixes, cfg.DecryptScope); err != nil {
+		return nil, err
+	}
+	if s.persist, err = persistCodecFor(cfg.PersistCodec); err != nil {
+		return nil, err
+	}
+	if cfg.DataFile != "" {
+		if s.dataLock, err = lockDataFile(cfg.DataFile); err != nil {
+			return nil, err
+		}
+		res, err := loadSnapshotFile(cfg.DataFile, s.namespaces, s.keys)
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %w", cfg.DataFile, err)
+		}
+		n, id := res.Keys, res.KeyID
+		if len(res.Namespaces) > 0 {
+			s.logger.Printf("Loaded %d keys from %s, in namespaces %s besides the default one", n, cfg.DataFile, strings.Join(res.Namespaces, ", "))
+		} else {
+			s.logger.Printf("Loaded %d keys from %s", n, cfg.DataFile)
+		}
+		if len(res.Corrupt) > 0 {
+			s.loadCorrupt = res.Corrupt
+			s.logger.Printf("Skipped %d corrupted entries in %s: %s", len(res.Corrupt), cfg.DataFile, strings.Join(res.Corrupt, ", "))
+		}
+		if s.keys != nil && n > 0 && id != s.keys.primary {
+			if id == "" {
+				s.logger.Printf("%s is not encrypted; it will be encrypted when next saved", cfg.DataFile)
+			} else {
+				s.logger.Printf("%s is encrypted with key %s; it will be re-encrypted with key %s when next saved", cfg.DataFile, id, s.keys.primary)
+			}
+		}
+		if n > 0 && res.Codec != "" && res.Codec != s.persist.Name() {
+			s.logger.Printf("%s is in the %s format; it will be rewritten in %s when next saved", cfg.DataFile, res.Codec, s.persist.Name())
+		}
+	}
+	if cfg.SeedFile != "" && cfg.SeedIfEmpty && s.store.Len() > 0 {
+		s.logger.Printf("Store holds %d keys; not seeding from %s", s.store.Len(), cfg.SeedFile)
+	} else if cfg.SeedFile != "" {
+		data, err := loadSeed(cfg.SeedFile, cfg.SeedChecksum)
+		if err != nil {
+			return nil, fmt.Errorf("read seed: %w", err)
+		}
+		for k, v := range data {
+			if data[k], err = s.sealValue(k, v); err != nil {
+				return nil, fmt.Errorf("seed store: %w", err)
+			}
+		}
+		n, err := seedStore(s.store, data, cfg.SeedOverwrite)
+		if err != nil {
+			return nil, fmt.Errorf("seed store: %w", err)
+		}
+		s.logger.Printf("Seeded %d of %d keys from %s", n, len(data), cfg.SeedFile)
+	}
+	if cfg.ReplicationBacklog > 0 {
+		s.namespaces.replication = newReplicationLog(cfg.ReplicationBacklog)
+		// The data file may have created namespaces besides the default.
+		for _, ns := range s.namespaces.list() {
+			s.namespaces.enableReplication(ns)
+		}
+	}
+	if cfg.WALDir != "" {
+		if s.namespaces.wal, err = newWALLog(cfg, s.keys); err != nil {
+			return nil, fmt.Errorf("write-ahead log: %w", err)
+		}
+		for _, ns := range s.namespaces.list() {
+			s.namespaces.enableWAL(ns)
+		}
+		if err := s.namespaces.wal.rotate(s.namespaces.list()); err != nil {
+			s.namespaces.wal.close()
+			return nil, fmt.Errorf("write-ahead log: %w", err)
+		}
+	}
+	if cfg.ReplicaOf != "" {
+		id := cfg.NodeID
+		if id == "" {
+			id, _ = os.Hostname()
+		}
+		rp, err := newReplica(cfg.ReplicaOf, id, cfg.ReplicaAPIKey, cfg.PromoteAfter)
+		if err != nil {
+			return nil, err
+		}
+		s.replica.Store(rp)
+	}
+	if cfg.MirrorURL != "" {
+		if s.mirror, err = newMirror(s, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ShadowStorage != "" {
+		if s.shadow, err = newShadowWriter(s.store, cfg, s.logger); err != nil {
+			return nil, err
+		}
+		s.hub.addListener(s.shadow.enqueue)
+	}
+	if cfg.TokenSecret != "" {
+		if s.tokens, err = newTokenIssuer(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.MaxKeys > 0 || cfg.MaxMemory > 0 {
+		es, err := newEvictingStore(s.store, cfg.EvictionPolicy, Budget{MaxKeys: cfg.MaxKeys, MaxMemory: cfg.MaxMemory})
+		if err != nil {
+			return nil, err
+		}
+		es.onEvict = func(key string) {
+			s.events.publish(serverEvent{Type: eventEviction, Source: key, Message: "Evicted " + key})
+		}
+		s.evictor = es
+		s.store = es
+	}
+
+	// Apply quotas after loading so usage accounting starts from the
+	// loaded data.
+	s.namespaces.quotas = cfg.Quotas
+	for _, ns := range s.namespaces.list() {
+		if ns == s.namespaces.def {
+			ns.store = s.namespaces.withQuota(defaultNamespace, s.store)
+		} else {
+			ns.store = s.namespaces.withQuota(ns.name, ns.store)
+		}
+	}
+
+	if cfg.RateLimit > 0 {
+		s.limiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst, s.clock)
+	}
+	var accessLog Middleware
+	if cfg.AccessLog {
+		accessLog = s.withAccessLog
+	}
+	if cfg.IdempotencyWindow > 0 {
+		s.idempotency = newIdempotencyCache(cfg.IdempotencyWindow, s.clock)
+	}
+	if cfg.SlowRequestThreshold > 0 {
+		s.slowLog = newSlowLog(cfg.SlowRequestThreshold)
+	}
+	if cfg.LockStats {
+		s.lockStats = newLockStats()
+		s.mu.stats = s.lockStats
+		s.namespaces.lockStats = s.lockStats
+		for _, ns := range s.namespaces.list() {
+			ns.mu.stats = s.lockStats
+		}
+	}
+	if s.priorities, err = newPriorities(cfg); err != nil {
+		return nil, err
+	}
+	if s.admission = newAdmission(cfg); s.admission != nil {
+		s.mu.queue = &s.admission.queue
+		s.namespaces.lockQueue = &s.admission.queue
+		for _, ns := range s.namespaces.list() {
+			ns.mu.queue = &s.admission.queue
+		}
+	}
+	if cfg.StatsDAddr != "" {
+		if s.statsd, err = newStatsDExporter(cfg.StatsDAddr, cfg.StatsDPrefix); err != nil {
+			return nil, fmt.Errorf("statsd: %w", err)
+		}
+	}
+	if len(cfg.Alerts) > 0 {
+		s.alerter = newAlerter(cfg.Alerts, cfg.AlertURL, cfg.WebhookSecret, cfg.AlertCooldown)
+	}
+	s.registerJobs()
+	var consistencyTokens Middleware
+	if s.consistencyToken() != "" {
+		consistencyTokens = s.withConsistencyToken
+	}
+	var authMW Middleware
+	if auth != nil {
+		s.auth = &authenticator{p: auth, tokens: s.tokens, signer: newRequestSigner(cfg), lockout: newAuthLockout(cfg), audit: s.audit, logger: s.logger}
+		authMW = s.auth.middleware
+	}
+	// The admin listener, with keys of its own, authenticates with them
+	// alone.
+	adminAuthMW := authMW
+	if len(cfg.AdminAPIKeys) > 0 {
+		admin := &authenticator{p: keyProvider(cfg.AdminAPIKeys), lockout: newAuthLockout(cfg), audit: s.audit, logger: s.logger}
+		adminAuthMW = admin.middleware
+	}
+	middlewares := func(authenticate Middleware) []Middleware {
+		return []Middleware{
+			withClientIP(s.proxies),
+			withRequestID,
+			s.withInflight,
+			s.withTiming,
+			accessLog,
+			s.withMetrics,
+			s.withPriority,
+			s.withAdmission,
+			s.withCompression,
+			s.withRecording,
+			s.withTimeout(cfg.RequestTimeout),
+			s.withEnvelope,
+			s.withRecovery,
+			withResponseHeaders(responseHeaders),
+			withCORS(cfg.CORSOrigins, cfg.CORSMethods, cfg.CORSHeaders, cfg.CORSMaxAge),
+			withTopologyRedirects(redirects),
+			authenticate,
+			withRateLimit(s.limiter),
+			withIdempotency(s.idempotency),
+			consistencyTokens,
+		}
+	}
+	s.graphql = s.newGraphQLSchema()
+	s.routeLimits = newRouteLimits(cfg.ConcurrencyLimits, s.priorities)
+	s.routeSwitch = newRouteSwitch(cfg.DisabledRoutes)
+	if cfg.Chaos {
+		s.chaos = newChaosInjector()
+		s.logger.Printf("Chaos mode is enabled; faults can be injected through /admin/chaos")
+	}
+	routes := s.routes(cfg.LegacyRoutes, cfg.SwaggerUI, cfg.Dashboard)
+	s.handler = chain(routes, append(middlewares(authMW), o.middlewares...)...)
+	s.adminHandler = s.handler
+	if len(cfg.AdminAPIKeys) > 0 {
+		s.adminHandler = chain(routes, append(middlewares(adminAuthMW), o.middlewares...)...)
+	}
+	if unknown := s.routeLimits.unused(); len(unknown) > 0 {
+		return nil, fmt.Errorf("concurrency limit for unknown route %q", unknown[0])
+	}
+	if unknown := s.routeSwitch.unused(); len(unknown) > 0 {
+		return nil, fmt.Errorf("disabled route %q matches no route", unknown[0])
+	}
+	if n := len(s.routeSwitch.disabled); n > 0 {
+		s.logger.Printf("%d routes are disabled by configuration", n)
+	}
+	if cfg.Expvar {
+		s.publishStats()
+	}
+	if s.raft != nil || s.rebalance != nil || disc != nil && disc.mode == discoveryGossip {
+		mux := http.NewServeMux()
+		if s.raft != nil {
+			mux.Handle("/raft/", s.raft.rpcHandler())
+		}
+		if disc.mode == discoveryGossip {
+			mux.HandleFunc("POST /cluster/gossip", disc.gossipHandler)
+		}
+		if s.rebalance != nil {
+			mux.HandleFunc("POST /cluster/rebalance", s.rebalance.handler)
+		}
+		mux.Handle("/", s.handler)
+		s.handler = mux
+	}
+	return s, nil
+}
+
+func newServer(store Store) *Server {
+	s := &Server{
+		mu:          timedMutex{name: "server"},
+		store:       store,
+		clock:       SystemClock,
+		started:     time.Now(),
+		methodCount: make(map[string]int),
+		history:     newStatsRing(defaultStatsRetention, workerInterval),
+		shutdownCh:  make(chan struct{}),
+		hub:         newWatchHub(),
+		webhooks:    newWebhookDispatcher(""),
+		events:      newEventBus(),
+		logger:      log.Default(),
+		errs:        make(chan error, 3),
+		schemas:     newSchemaRegistry(),
+		locks:       newLockTable(),
+		keySessions: newSessionTable(),
+		schedules:   newScheduleTable(),
+		clients:     newClientTable(),
+		keyRules:    &keyRules{},
+	}
+	s.namespaces = newNamespaceRegistry(newNamespace(defaultNamespace, store, s.hub))
+	s.hub.addListener(s.enqueueWebhooks)
+	s.events.subscribe(s.logEvent)
+	s.events.subscribe(s.webhooks.notify)
+	if n, ok := store.(changeNotifier); ok {
+		n.OnChange(s.hub.publish)
+	}
+	return s
+}
+
+// Handler returns the HTTP API with its full middleware chain, for mounting
+// in another server. It does not require Start.
+func (s *Server) Handler() http.Handler { return s.handler }
+
+// Store returns the store backing the server.
+func (s *Server) Store() Store { return s.store }
+
+// Start opens the configured listeners and serves on them in the
+// background. It returns once the listeners are open; errors from serving
+// afterwards are reported on Err.
+func (s *Server) Start() error {
+	cfg := s.cfg
+	listeners, err := s.listenHTTP()
+	if err != nil {
+		return err
+	}
+	closeHTTP := func() {
+		for _, hl := range listeners {
+			hl.ln.Close()
+		}
+	}
+
+	var gln, rln net.Listener
+	if cfg.GRPCAddr != "" {
+		if gln, err = s.listen("grpc", cfg.GRPCAddr); err != nil {
+			closeHTTP()
+			return fmt.Errorf("gRPC listen: %w", err)
+		}
+	}
+	if cfg.RedisAddr != "" {
+		if rln, err = s.listen("redis", cfg.RedisAddr); err != nil {
+			closeHTTP()
+			if gln != nil {
+				gln.Close()
+			}
+			return fmt.Errorf("Redis listen: %w", err)
+		}
+	}
+
+	s.startBackgroundWorker()
+	if rp := s.replica.Load(); rp != nil {
+		go s.followPrimary(rp)
+	}
+	if s.raft != nil {
+		s.raft.start()
+	}
+	if s.rebalance != nil {
+		go s.rebalance.run(s.shutdownCh)
+	}
+	if s.mirror != nil {
+		go s.mirror.run(s.shutdownCh)
+	}
+	if s.shadow != nil {
+		s.shadow.start()
+	}
+	if s.discovery != nil && s.discovery.dynamic() {
+		go func() {
+			if err := s.discovery.refresh(); err != nil {
+				s.logger.Printf("[Discovery] %v", err)
+			}
+		}()
+	}
+
+	s.ln = listeners[0].ln
+	s.listeners = listeners
+	for _, hl := range listeners {
+		s.serve(hl)
+	}
+	if s.registration != nil {
+		go func() {
+			if err := s.register(); err != nil {
+				s.logger.Printf("[Registration] %v", err)
+			}
+		}()
+	}
+
+	if gln != nil {
+		s.grpcSrv = newGRPCServer(s)
+		go func() {
+			if err := s.grpcSrv.Serve(gln); err != nil {
+				s.errs <- fmt.Errorf("gRPC: %w", err)
+			}
+		}()
+		s.logger.Println("gRPC server starting on", gln.Addr())
+	}
+	if rln != nil {
+		s.respSrv = newRESPServer(s)
+		go func() {
+			if err := s.respSrv.Serve(rln); err != nil {
+				s.errs <- fmt.Errorf("Redis protocol: %w", err)
+			}
+		}()
+		s.logger.Println("Redis protocol server starting on", rln.Addr())
+		// The HTTP listeners hand over the Redis protocol connections
+		// they accept.
+		for _, hl := range listeners {
+			sl, ok := hl.ln.(*sniffListener)
+			if !ok || sl.resp == nil {
+				continue
+			}
+			go func() {
+				if err := s.respSrv.Serve(sl.respListener()); err != nil {
+					s.errs <- fmt.Errorf("Redis protocol on %s: %w", hl.name, err)
+				}
+			}()
+		}
+	}
+	signalReady()
+	return nil
+}
+
+// Addr returns the address the HTTP listener is bound to, or nil before
+// Start.
+func (s *Server) Addr() net.Addr {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+// Err reports errors that stop a listener after Start.
+func (s *Server) Err() <-chan error { return s.errs }
+
+// Stop shuts the server down gracefully: /readyz starts failing and the
+// server keeps serving for the configured drain period, then new writes are
+// rejected, in-flight requests are given until ctx is done, or
+// ShutdownTimeout has passed, to finish, and the store is persisted to the
+// data file if one is configured. It is safe to call Stop on a server that
+// was never started.
+func (s *Server) Stop(ctx context.Context) error {
+	var err error
+	s.stopOnce.Do(func() {
+		if s.cfg.ShutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.cfg.ShutdownTimeout)
+			defer cancel()
+		}
+
+		// Fail readiness first so that load balancers stop sending
+		// traffic, while requests already routed here are served in full.
+		// After Upgrade the new process answers on the same sockets, so
+		// there is nothing to drain.
+		s.notReady.Store(true)
+		if s.registration != nil && len(s.listeners) > 0 && !s.handedOff.Load() {
+			s.deregister(ctx)
+		}
+		if d := s.cfg.DrainPeriod; d > 0 && len(s.listeners) > 0 && !s.handedOff.Load() {
+			s.logger.Printf("Draining for %s, %d requests in flight", d, s.inFlight.Load())
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+			}
+		}
+
+		// Reject new writes, then let in-flight requests finish
+		s.draining.Store(true)
+		if n := s.inFlight.Load(); n > 0 {
+			s.logger.Printf("Waiting for %d in-flight requests", n)
+		}
+
+		// Stop background worker; this also ends open watch streams so
+		// they don't hold up the shutdown
+		close(s.shutdownCh)
+
+		if len(s.listeners) > 0 {
+			if s.handedOff.Load() {
+				select {
+				case <-time.After(handoffGrace):
+				case <-ctx.Done():
+				}
+			}
+			var wg sync.WaitGroup
+			for _, hl := range s.listeners {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if e := hl.shutdown(ctx); e != nil {
+						s.logger.Printf("Server shutdown (%s): %v", hl.name, e)
+					}
+				}()
+			}
+			wg.Wait()
+		}
+		if s.grpcSrv != nil {
+			s.grpcSrv.GracefulStop()
+		}
+		if s.respSrv != nil {
+			s.respSrv.Close()
+		}
+		if s.raft != nil {
+			if e := s.raft.close(); e != nil {
+				s.logger.Printf("Closing raft log: %v", e)
+			}
+		}
+		s.webhooks.close()
+		if s.statsd != nil {
+			// A last push so the final requests are not lost.
+			if e := s.pushStatsD(); e != nil {
+				s.logger.Printf("Pushing to StatsD: %v", e)
+			}
+			s.statsd.conn.Close()
+		}
+		if s.audit != nil {
+			if e := s.audit.close(); e != nil {
+				s.logger.Printf("Closing audit log: %v", e)
+			}
+		}
+		if s.recorder != nil {
+			if e := s.recorder.close(); e != nil {
+				s.logger.Printf("Closing request recording: %v", e)
+			}
+		}
+		if s.shadow != nil {
+			if e := s.shadow.close(); e != nil {
+				s.logger.Printf("Closing shadow backend: %v", e)
+			}
+		}
+		if s.namespaces.wal != nil {
+			if e := s.namespaces.wal.close(); e != nil {
+				s.logger.Printf("Closing write-ahead log: %v", e)
+			}
+		}
+
+		if s.cfg.DataFile != "" && !s.handedOff.Load() {
+			n, e := saveSnapshotFile(s.cfg.DataFile, s.namespaces.snapshots(), s.keys, s.persist)
+			if e != nil {
+				err = fmt.Errorf("persist data to %s: %w", s.cfg.DataFile, e)
+				return
+			}
+			s.snapshotSaved(n, "")
+		}
+		if s.backend != nil {
+			if e := s.backend.Close(); e != nil {
+				err = fmt.Errorf("close store: %w", e)
+			}
+		}
+		if s.dataLock != nil {
+			s.dataLock.Close()
+		}
+	})
+	return err
+}
+
+// checkWritable reports whether mutations are currently accepted, writing an
+// error response if they are not.
+func (s *Server) checkWritable(w http.ResponseWriter, r *http.Request) bool {
+	if err := s.writesAllowed(); err != nil {
+		writeStoreError(w, r, err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) incrementError(ctx context.Context) {
+	s.mu.lock(ctx)
+	s.errorCount++
+	s.mu.Unlock()
+}
+
+// startBackgroundWorker starts the registered jobs; they stop when the
+// server shuts down.
+func (s *Server) startBackgroundWorker() {
+	s.jobs.start(s.clock, s.events, s.shutdownCh)
+	go func() {
+		<-s.shutdownCh
+		s.logger.Println("[Worker] Stopped")
+	}()
+}
+
+// setKey validates and applies a single write.
+func (s *Server) setKey(ctx context.Context, key, value string) error {
+	if err := s.writesAllowed(); err != nil {
+		return err
+	}
+	if err := s.validateWrite(ctx, "set", key, value); err != nil {
+		return err
+	}
+	return s.applySet(ctx, s.namespaceFrom(ctx), key, value)
+}
+
+// readKey reads key of ns as GET /data/{key} would, for the protocols
+// other than HTTP: the client's issued token, tag policies, expiry and
+// value encryption included.
+func (s *Server) readKey(ctx context.Context, ns *namespace, key string) (string, error) {
+	if err := s.checkRead(ctx, ns, key); err != nil {
+		return "", err
+	}
+	if _, live := s.checkExpiry(ns, key, true); !live {
+		return "", &KeyError{Op: "get", Key: key, Err: ErrKeyNotFound}
+	}
+	s.hotKeys.read(ns.name, key)
+	v, err := getValue(ctx, ns.store, key)
+	if err != nil {
+		return "", err
+	}
+	v, _ = s.reveal(ctx, key, v)
+	return v, nil
+}
+
+// checkRead fails a read of key in ns that the client's issued token or
+// the tag policies on key do not allow it.
+func (s *Server) checkRead(ctx context.Context, ns *namespace, key string) error {
+	if err := checkGrant(ctx, "get", key); err != nil {
+		return err
+	}
+	return s.checkTags(ctx, "get", key, ns.tags.get(key))
+}
+
+// replaying reports whether a write is being replayed from a Raft log or a
+// primary rather than made by a client.
+func replaying(ctx context.Context) bool {
+	v, _ := ctx.Value(replayKey).(bool)
+	return v
+}
+
+// withCreateOnly returns a copy of ctx under which applySet fails with
+// ErrKeyExists rather than overwrite a key that is already set.
+func withCreateOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, createOnlyKey, true)
+}
+
+func createOnly(ctx context.Context) bool {
+	v, _ := ctx.Value(createOnlyKey).(bool)
+	return v
+}
+
+// withDeleteAt returns a copy of ctx under which applyDelete fails with
+// ErrConflict unless key was last written at rev.
+func withDeleteAt(ctx context.Context, rev uint64) context.Context {
+	return context.WithValue(ctx, deleteAtKey, rev)
+}
+
+func deleteAt(ctx context.Context) (uint64, bool) {
+	rev, ok := ctx.Value(deleteAtKey).(uint64)
+	return rev, ok
+}
+
+// previousValue receives the value a write replaced.
+type previousValue struct {
+	Value   string
+	Existed bool
+}
+
+// withPrevious returns a copy of ctx under which applySet and applyDelete
+// store the value they replace or remove in prev, read in the same atomic
+// step as the write. Under Raft, prev is filled in on the node that
+// proposed the write.
+func withPrevious(ctx context.Context, prev *previousValue) context.Context {
+	return context.WithValue(ctx, previousKey, prev)
+}
+
+func previousFrom(ctx context.Context) *previousValue {
+	p, _ := ctx.Value(previousKey).(*previousValue)
+	return p
+}
+
+// withStoredValue returns a copy of ctx under which applySet writes the
+// value as given, without running it through the value hooks or sealing
+// it: it is one read back from the store, being put back.
+func withStoredValue(ctx context.Context) context.Context {
+	return context.WithValue(ctx, storedKey, true)
+}
+
+func storedValue(ctx context.Context) bool {
+	v, _ := ctx.Value(storedKey).(bool)
+	return v
+}
+
+// deleteKey validates and applies a single delete.
+func (s *Server) deleteKey(ctx context.Context, key string) error {
+	if err := s.writesAllowed(); err != nil {
+		return err
+	}
+	if err := s.validateWrite(ctx, "delete", key, ""); err != nil {
+		return err
+	}
+	return s.applyDelete(ctx, s.namespaceFrom(ctx), key)
+}
+
+// validateWrite checks a write against the key naming rules, the value
+// size limit, the registered schemas and the validation webhooks. Deletes
+// are only checked for reserved prefixes and seen by the webhooks.
+func (s *Server) validateWrite(ctx context.Context, op, key, value string) error {
+	if err := s.keyRules.check(op, key); err != nil {
+		return err
+	}
+	if err := s.checkKeyTags(ctx, op, key); err != nil {
+		return err
+	}
+	if err := checkGrant(ctx, op, key); err != nil {
+		return err
+	}
+	if op == "set" {
+		if max := s.cfg.MaxValueSize; max > 0 && int64(len(value)) > max {
+			return &KeyError{Op: "set", Key: key, Err: ErrValueTooLarge}
+		}
+		if err := s.schemas.Validate(key, value); err != nil {
+			return err
+		}
+	}
+	if s.validator != nil {
+		return s.validator.Validate(ctx, op, key, value)
+	}
+	return nil
+}
+
+// applySet writes an already validated value to ns. Every write, whatever
+// protocol it arrived on, ends up here; in a cluster it is proposed to the
+// Raft group and applied here again on every node once committed.
+// Values are run through Config.ValueHooks, then sealed if they are under
+// Config.EncryptPrefixes, before either happens, unless they are put back
+// as stored; see withStoredValue.
+func (s *Server) applySet(ctx context.Context, ns *namespace, key, value string) error {
+	if !replaying(ctx) && !storedValue(ctx) {
+		var err error
+		if value, err = s.hooks.write(ctx, key, value); err != nil {
+			return err
+		}
+		if value, err = s.sealValue(key, value); err != nil {
+			return err
+		}
+	}
+	// Writes replayed from a Raft log or a primary leave sessions alone,
+	// which are only held on the node that granted them.
+	unbind := func() {}
+	if !replaying(ctx) {
+		var err error
+		if unbind, err = s.bindSession(ctx, ns, key); err != nil {
+			return err
+		}
+	}
+	if s.replicated(ctx) {
+		op := "set"
+		if createOnly(ctx) {
+			op = "create"
+		}
+		err := s.raft.propose(ctx, raftEntry{Op: op, NS: ns.name, Key: key, Value: value, Type: contentTypeFrom(ctx), Tags: writeTags(ctx, ns, key), Expiry: writeExpiry(ctx, ns, key)})
+		if err != nil {
+			unbind()
+		}
+		return err
+	}
+	if s.replica.Load() != nil && !replaying(ctx) {
+		unbind()
+		return ErrReadOnly
+	}
+	prev := previousFrom(ctx)
+	// The type, tags and expiry are recorded first so that change
+	// listeners see them.
+	prevType, prevTags, prevExpiry := ns.types.get(key), ns.tags.get(key), ns.expiries.get(key)
+	ns.types.set(key, contentTypeFrom(ctx))
+	tags, setTags := tagsFrom(ctx)
+	if setTags {
+		ns.tags.set(key, tags)
+	}
+	expiry, setExpiry := expiryFrom(ctx)
+	if setExpiry {
+		ns.expiries.set(key, expiry)
+	}
+	var old string
+	var existed bool
+	var err error
+	done := storeTimer(ctx)
+	switch {
+	case createOnly(ctx):
+		err = createValue(ns.store, key, value)
+	case prev != nil || s.audit != nil:
+		old, existed, err = swapValue(ns.store, key, value)
+	default:
+		err = ns.store.Set(key, value)
+	}
+	done()
+	if err != nil {
+		unbind()
+		ns.types.set(key, prevType)
+		if setTags {
+			ns.tags.set(key, prevTags)
+		}
+		if setExpiry {
+			ns.expiries.set(key, prevExpiry)
+		}
+		return err
+	}
+	if prev != nil {
+		*prev = previousValue{Value: old, Existed: existed}
+	}
+	ns.tombstones.forget(key)
+	s.writeCount.Add(1)
+	s.hotKeys.write(ns.name, key)
+	if s.audit != nil {
+		if s.masked(prevTags) || s.masked(ns.tags.get(key)) {
+			ctx = withMaskedAudit(ctx)
+		}
+		s.audit.record(ctx, "set", ns.name, key, old, existed, value, true)
+	}
+	return nil
+}
+
+// applyDelete removes key from ns, keeping a tombstone when soft delete is
+// enabled. Like applySet, it is the single path for deletes.
+func (s *Server) applyDelete(ctx context.Context, ns *namespace, key string) error {
+	op := "delete"
+	if expiring(ctx) {
+		op = "expire"
+	}
+	if s.replicated(ctx) {
+		return s.raft.propose(ctx, raftEntry{Op: op, NS: ns.name, Key: key})
+	}
+	if s.replica.Load() != nil && !replaying(ctx) {
+		return ErrReadOnly
+	}
+	if op == "expire" {
+		ns.hub.markExpiring(key, true)
+		defer ns.hub.markExpiring(key, false)
+	}
+	prev := previousFrom(ctx)
+	if s.masked(ns.tags.get(key)) {
+		ctx = withMaskedAudit(ctx)
+	}
+	var old string
+	var err error
+	done := storeTimer(ctx)
+	if rev, ok := deleteAt(ctx); ok {
+		old, err = takeValueAt(ns.store, key, rev)
+	} else if prev != nil || s.audit != nil || s.cfg.SoftDeleteRetention > 0 {
+		old, err = takeValue(ns.store, key)
+	} else {
+		err = ns.store.Delete(key)
+	}
+	done()
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		*prev = previousValue{Value: old, Existed: true}
+	}
+	if s.cfg.SoftDeleteRetention > 0 {
+		ns.tombstones.add(key, old, s.cfg.SoftDeleteRetention)
+	}
+	s.deleteCount.Add(1)
+	s.keySessions.detach(ns.name, key)
+	s.hotKeys.write(ns.name, key)
+	if s.audit != nil {
+		s.audit.record(ctx, op, ns.name, key, old, true, "", false)
+	}
+	return nil
+}
+
+// withFlushed returns a copy of ctx under which applyFlush stores the
+// number of keys it removed in n. Under Raft, n is filled in on the node
+// that proposed the flush.
+func withFlushed(ctx context.Context, n *int) context.Context {
+	return context.WithValue(ctx, flushedKey, n)
+}
+
+// applyFlush removes every key of ns starting with prefix, all of them for
+// "", in one atomic step when the store supports it. No tombstones are
+// kept, and the flush is audited as a single entry.
+func (s *Server) applyFlush(ctx context.Context, ns *namespace, prefix string) error {
+	if s.replicated(ctx) {
+		return s.raft.propose(ctx, raftEntry{Op: "flush", NS: ns.name, Key: prefix})
+	}
+	if s.replica.Load() != nil && !replaying(ctx) {
+		return ErrReadOnly
+	}
+	done := storeTimer(ctx)
+	removed, err := clearPrefix(ns.store, prefix)
+	done()
+	for k := range removed {
+		ns.tombstones.forget(k)
+	}
+	s.deleteCount.Add(int64(len(removed)))
+	if n, ok := ctx.Value(flushedKey).(*int); ok {
+		*n = len(removed)
+	}
+	if s.audit != nil && len(removed) > 0 {
+		s.audit.record(ctx, "flush", ns.name, prefix, "", false, "", false)
+	}
+	return err
+}
+
+// countRequest records a successfully handled request.
+func (s *Server) countRequest(r *http.Request) {
+	s.mu.lock(r.Context())
+	s.totalRequests++
+	s.methodCount[r.Method]++
+	s.mu.Unlock()
+}
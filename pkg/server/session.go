@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// sessionCommand is a request frame of a command session. ID is any JSON
+// value and is echoed in the reply, so a client pipelining commands can
+// match replies to them.
+type sessionCommand struct {
+	ID    json.RawMessage   `json:"id,omitempty"`
+	Op    string            `json:"op"` // get, set, delete, mget, mset or ping
+	Key   string            `json:"key,omitempty"`
+	Value *string           `json:"value,omitempty"`
+	Keys  []string          `json:"keys,omitempty"`  // mget
+	Items map[string]string `json:"items,omitempty"` // mset
+}
+
+// sessionReply answers a sessionCommand. Error is set, with OK false,
+// exactly when the same operation over HTTP would have failed, and holds
+// the same code and message.
+type sessionReply struct {
+	ID      json.RawMessage   `json:"id,omitempty"`
+	OK      bool              `json:"ok"`
+	Value   *string           `json:"value,omitempty"`
+	Values  map[string]string `json:"values,omitempty"`
+	Missing []string          `json:"missing,omitempty"`
+	Error   *errorDetail      `json:"error,omitempty"`
+}
+
+// sessionStats counts command sessions for /stats.
+type sessionStats struct {
+	active   atomic.Int64
+	total    atomic.Int64
+	commands atomic.Int64
+}
+
+func (ss *sessionStats) stats() map[string]int64 {
+	return map[string]int64{
+		"active":   ss.active.Load(),
+		"total":    ss.total.Load(),
+		"commands": ss.commands.Load(),
+	}
+}
+
+// GET
+//
+// sessionHandler upgrades to a WebSocket over which the client sends
+// sessionCommand frames and gets a sessionReply for each. Commands run one
+// at a time in the order they arrive, so a client may send many without
+// waiting and a read always sees the writes sent before it. The API key,
+// namespace and rate limit of the upgrade request apply to every command;
+// each has the request timeout to itself.
+func (s *Server) sessionHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	s.sessions.active.Add(1)
+	s.sessions.total.Add(1)
+	defer s.sessions.active.Add(-1)
+
+	msgs := make(chan []byte)
+	go func() {
+		defer close(msgs)
+		for {
+			msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-s.shutdownCh:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			out, _ := json.Marshal(s.sessionCommand(r, msg))
+			if err := ws.WriteText(out); err != nil {
+				return
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// sessionCommand runs one frame of a command session.
+func (s *Server) sessionCommand(r *http.Request, msg []byte) sessionReply {
+	s.sessions.commands.Add(1)
+	var cmd sessionCommand
+	if err := json.Unmarshal(msg, &cmd); err != nil {
+		return sessionError(nil, codeInvalidJSON, describeJSONError(err))
+	}
+	if s.limiter != nil {
+		if ok, _ := s.limiter.allow(clientKey(r), time.Now()); !ok {
+			return sessionError(cmd.ID, codeRateLimited, "Rate limit exceeded")
+		}
+	}
+	ctx := r.Context()
+	if d := s.cfg.RequestTimeout; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	ns := s.namespaceFrom(ctx)
+	reply := sessionReply{ID: cmd.ID, OK: true}
+	var err error
+	switch cmd.Op {
+	case "ping":
+	case "get":
+		key := s.keyRules.canonical(cmd.Key)
+		var v string
+		if v, err = s.readKey(ctx, ns, key); err == nil {
+			reply.Value = &v
+		}
+	case "set":
+		if cmd.Value == nil {
+			return sessionError(cmd.ID, codeInvalidParam, "value is required")
+		}
+		err = s.setKey(ctx, s.keyRules.canonical(cmd.Key), *cmd.Value)
+	case "delete":
+		err = s.deleteKey(ctx, s.keyRules.canonical(cmd.Key))
+	case "mget":
+		reply.Values = make(map[string]string, len(cmd.Keys))
+		for _, key := range cmd.Keys {
+			key = s.keyRules.canonical(key)
+			v, e := s.readKey(ctx, ns, key)
+			if errors.Is(e, ErrKeyNotFound) {
+				reply.Missing = append(reply.Missing, key)
+				continue
+			} else if e != nil {
+				err = e
+				break
+			}
+			reply.Values[key] = v
+		}
+	case "mset":
+		return s.sessionSetMany(ctx, cmd)
+	default:
+		return sessionError(cmd.ID, codeInvalidParam, "op must be get, set, delete, mget, mset or ping")
+	}
+	if err != nil {
+		s.incrementError(ctx)
+		return sessionError(cmd.ID, codeForError(err), messageForError(err))
+	}
+	return reply
+}
+
+// sessionSetMany sets every item of an mset as POST /data does: all of
+// them are validated before any is written.
+func (s *Server) sessionSetMany(ctx context.Context, cmd sessionCommand) sessionReply {
+	fail := func(err error) sessionReply {
+		s.incrementError(ctx)
+		return sessionError(cmd.ID, codeForError(err), messageForError(err))
+	}
+	if err := s.writesAllowed(); err != nil {
+		return fail(err)
+	}
+	items := s.keyRules.canonicalKeys(cmd.Items)
+	if fields := s.checkPayload(items); len(fields) > 0 {
+		s.incrementError(ctx)
+		reply := sessionError(cmd.ID, codeInvalidRequest, "Some items were rejected")
+		reply.Error.Fields = fields
+		return reply
+	}
+	for k, v := range items {
+		if err := s.validateWrite(ctx, "set", k, v); err != nil {
+			return fail(err)
+		}
+	}
+	ns := s.namespaceFrom(ctx)
+	for k, v := range items {
+		if err := s.applySet(ctx, ns, k, v); err != nil {
+			return fail(err)
+		}
+	}
+	return sessionReply{ID: cmd.ID, OK: true}
+}
+
+func sessionError(id json.RawMessage, code, message string) sessionReply {
+	return sessionReply{ID: id, Error: &errorDetail{Code: code, Message: message}}
+}
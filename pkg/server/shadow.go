@@ -0,0 +1,342 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultShadowQueue is how many writes may wait for the shadow
+	// backend by default.
+	defaultShadowQueue = 10000
+	// shadowResyncDelay is how long the shadow writer waits before
+	// copying the dataset again after writes were lost.
+	shadowResyncDelay = 10 * time.Second
+	// defaultShadowSample and maxShadowSample bound the keys
+	// GET /admin/shadow/compare lists.
+	defaultShadowSample = 100
+	maxShadowSample     = 10000
+)
+
+// openBackend opens a storage backend by the name Config.Storage takes. The
+// closer is nil for the memory backend.
+func openBackend(kind, path string) (Store, io.Closer, error) {
+	switch kind {
+	case storageMemory:
+		return newMemoryStore(), nil, nil
+	case storageSQLite:
+		st, err := openSQLiteStore(path)
+		return st, st, err
+	case storageBolt:
+		st, err := openBoltStore(path)
+		return st, st, err
+	}
+	return nil, nil, fmt.Errorf("invalid storage backend %q", kind)
+}
+
+// shadowStats is the "shadow" entry of /stats and the body of
+// GET /admin/shadow.
+type shadowStats struct {
+	Storage string `json:"storage"`
+	Path    string `json:"path,omitempty"`
+	// Synced is set once the first copy of the dataset is done.
+	Synced     bool      `json:"synced"`
+	Queued     int       `json:"queued"`
+	Applied    int64     `json:"applied"`
+	Failed     int64     `json:"failed"`
+	Dropped    int64     `json:"dropped"`
+	Resyncs    int64     `json:"resyncs"`
+	LastError  string    `json:"last_error,omitempty"`
+	ErrorSince time.Time `json:"error_since,omitzero"`
+}
+
+// shadowWriter applies every write of the default namespace to a second
+// backend as well, as a rehearsal for moving to it: after copying the
+// dataset over, it follows the primary's changes, in order and
+// asynchronously, so that writes are never held up or failed by the
+// shadow. Writes it could not apply, or had to drop when its queue was
+// full, make it copy the dataset over again once its queue is empty.
+// GET /admin/shadow/compare says how far the two have diverged.
+type shadowWriter struct {
+	primary Store
+	store   Store
+	closer  io.Closer
+	logger  *log.Logger
+
+	ch      chan Event
+	done    chan struct{}
+	started atomic.Bool
+
+	// mu guards closing ch against enqueue.
+	mu     sync.Mutex
+	closed bool
+
+	synced  atomic.Bool
+	resync  atomic.Bool
+	applied atomic.Int64
+	failed  atomic.Int64
+	dropped atomic.Int64
+	resyncs atomic.Int64
+
+	storage, path string
+
+	errMu      sync.Mutex
+	lastError  string
+	errorSince time.Time
+}
+
+func newShadowWriter(primary Store, cfg Config, logger *log.Logger) (*shadowWriter, error) {
+	if cfg.ShadowStorage == cfg.Storage && cfg.ShadowStoragePath == cfg.StoragePath && cfg.Storage != storageMemory {
+		return nil, errors.New("the shadow backend must not be the primary's storage file")
+	}
+	if _, ok := primary.(changeNotifier); !ok {
+		return nil, errors.New("shadow writes need a store that reports its changes")
+	}
+	st, closer, err := openBackend(cfg.ShadowStorage, cfg.ShadowStoragePath)
+	if err != nil {
+		return nil, fmt.Errorf("shadow backend: %w", err)
+	}
+	queue := cfg.ShadowQueue
+	if queue <= 0 {
+		queue = defaultShadowQueue
+	}
+	return &shadowWriter{
+		primary: primary,
+		store:   st,
+		closer:  closer,
+		logger:  logger,
+		ch:      make(chan Event, queue),
+		done:    make(chan struct{}),
+		storage: cfg.ShadowStorage,
+		path:    cfg.ShadowStoragePath,
+	}, nil
+}
+
+// enqueue is a listener of the default namespace's changes. It must not
+// block, so a write that finds the queue full is dropped and the dataset
+// copied again later.
+func (sh *shadowWriter) enqueue(ev Event) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.closed {
+		return
+	}
+	select {
+	case sh.ch <- ev:
+	default:
+		sh.dropped.Add(1)
+		sh.resync.Store(true)
+	}
+}
+
+func (sh *shadowWriter) start() {
+	sh.started.Store(true)
+	go sh.run()
+}
+
+func (sh *shadowWriter) run() {
+	defer close(sh.done)
+	sh.copyAll()
+	var retry <-chan time.Time
+	for {
+		if retry == nil && sh.resync.Load() {
+			retry = time.After(shadowResyncDelay)
+		}
+		select {
+		case ev, ok := <-sh.ch:
+			if !ok {
+				return
+			}
+			sh.apply(ev)
+		case <-retry:
+			retry = nil
+			if len(sh.ch) == 0 {
+				sh.resyncs.Add(1)
+				sh.copyAll()
+			}
+		}
+	}
+}
+
+func (sh *shadowWriter) apply(ev Event) {
+	var err error
+	if ev.Type == "delete" || ev.Type == "expired" {
+		err = sh.store.Delete(ev.Key)
+		if errors.Is(err, ErrKeyNotFound) {
+			err = nil
+		}
+	} else {
+		err = sh.store.Set(ev.Key, ev.Value)
+	}
+	sh.record(err)
+}
+
+// copyAll copies the primary's dataset to the shadow: keys it lacks or holds
+// differently are set and keys the primary does not have are deleted.
+// Writes queued meanwhile are applied after it, so the two converge.
+func (sh *shadowWriter) copyAll() {
+	sh.resync.Store(false)
+	want, have := sh.primary.Snapshot(), sh.store.Snapshot()
+	want.Range(func(k, v string) bool {
+		if cur, ok := have.Get(k); !ok || cur != v {
+			sh.record(sh.store.Set(k, v))
+		}
+		return true
+	})
+	have.Range(func(k, _ string) bool {
+		if _, ok := want.Get(k); !ok {
+			if err := sh.store.Delete(k); err != nil && !errors.Is(err, ErrKeyNotFound) {
+				sh.record(err)
+			}
+		}
+		return true
+	})
+	if !sh.synced.Swap(true) {
+		sh.logger.Printf("[Shadow] Copied %d keys to the %s shadow backend", want.Len(), sh.storage)
+	}
+}
+
+func (sh *shadowWriter) record(err error) {
+	sh.errMu.Lock()
+	defer sh.errMu.Unlock()
+	if err == nil {
+		sh.applied.Add(1)
+		sh.lastError, sh.errorSince = "", time.Time{}
+		return
+	}
+	sh.failed.Add(1)
+	sh.resync.Store(true)
+	if sh.lastError == "" {
+		sh.errorSince = time.Now().UTC()
+		sh.logger.Printf("[Shadow] Write to the shadow backend failed: %v", err)
+	}
+	sh.lastError = err.Error()
+}
+
+func (sh *shadowWriter) snapshot() shadowStats {
+	st := shadowStats{Storage: sh.storage, Path: sh.path}
+	st.Synced = sh.synced.Load()
+	st.Queued = len(sh.ch)
+	st.Applied = sh.applied.Load()
+	st.Failed = sh.failed.Load()
+	st.Dropped = sh.dropped.Load()
+	st.Resyncs = sh.resyncs.Load()
+	sh.errMu.Lock()
+	st.LastError, st.ErrorSince = sh.lastError, sh.errorSince
+	sh.errMu.Unlock()
+	return st
+}
+
+// close applies the writes still queued and closes the shadow backend.
+func (sh *shadowWriter) close() error {
+	sh.mu.Lock()
+	if !sh.closed {
+		sh.closed = true
+		close(sh.ch)
+	}
+	sh.mu.Unlock()
+	if sh.started.Load() {
+		<-sh.done
+	}
+	if sh.closer == nil {
+		return nil
+	}
+	return sh.closer.Close()
+}
+
+// shadowDiffKey is a key the primary and shadow backends disagree on.
+type shadowDiffKey struct {
+	Key string `json:"key"`
+	// Kind is "missing" from the shadow, "extra" in it or "different".
+	Kind string `json:"kind"`
+}
+
+// shadowDiff is the body of GET /admin/shadow/compare.
+type shadowDiff struct {
+	Diverged      bool            `json:"diverged"`
+	PrimaryKeys   int             `json:"primary_keys"`
+	ShadowKeys    int             `json:"shadow_keys"`
+	Matching      int             `json:"matching"`
+	Missing       int             `json:"missing"`
+	Extra         int             `json:"extra"`
+	Different     int             `json:"different"`
+	Queued        int             `json:"queued"`
+	Keys          []shadowDiffKey `json:"keys"`
+	KeysTruncated bool            `json:"keys_truncated,omitempty"`
+}
+
+// compare compares the two backends key by key, listing up to limit of
+// the keys they disagree on.
+func (sh *shadowWriter) compare(limit int) shadowDiff {
+	queued := len(sh.ch)
+	want, have := sh.primary.Snapshot(), sh.store.Snapshot()
+	d := shadowDiff{PrimaryKeys: want.Len(), ShadowKeys: have.Len(), Queued: queued, Keys: []shadowDiffKey{}}
+	note := func(key, kind string) {
+		if len(d.Keys) < limit {
+			d.Keys = append(d.Keys, shadowDiffKey{Key: key, Kind: kind})
+		} else {
+			d.KeysTruncated = true
+		}
+	}
+	want.Range(func(k, v string) bool {
+		switch cur, ok := have.Get(k); {
+		case !ok:
+			d.Missing++
+			note(k, "missing")
+		case cur != v:
+			d.Different++
+			note(k, "different")
+		default:
+			d.Matching++
+		}
+		return true
+	})
+	have.Range(func(k, _ string) bool {
+		if _, ok := want.Get(k); !ok {
+			d.Extra++
+			note(k, "extra")
+		}
+		return true
+	})
+	d.Diverged = d.Missing+d.Extra+d.Different > 0
+	return d
+}
+
+// GET
+func (s *Server) shadowStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if s.shadow == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Shadow writes are not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.shadow.snapshot())
+}
+
+// GET
+//
+// shadowCompareHandler compares every key of the default namespace with
+// the shadow backend's, listing up to ?limit (default 100) of those that
+// differ. Shadow writes are asynchronous, so writes still queued differ
+// too; queued says how many there were when the comparison was made.
+func (s *Server) shadowCompareHandler(w http.ResponseWriter, r *http.Request) {
+	if s.shadow == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Shadow writes are not enabled")
+		return
+	}
+	limit := defaultShadowSample
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid limit")
+			return
+		}
+		limit = min(n, maxShadowSample)
+	}
+	writeJSON(w, http.StatusOK, s.shadow.compare(limit))
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultShardVNodes is the number of points each node gets on the hash
+// ring when sharding is enabled.
+const defaultShardVNodes = 64
+
+// ringPoint is one virtual node on the hash ring.
+type ringPoint struct {
+	token uint64
+	node  string
+}
+
+// hashRing assigns keys to the nodes of the topology by consistent
+// hashing. Each node gets vnodes points at the hash of "ID#i"; a key
+// belongs to the node of the first point at or after the hash of the key,
+// wrapping around. Clients can compute the same from /cluster/topology
+// and send requests to the owner directly.
+//
+// Version identifies the ring by its nodes, so that nodes can tell
+// whether they agree on it.
+type hashRing struct {
+	vnodes  int
+	points  []ringPoint
+	nodes   []string // IDs in order
+	version string
+}
+
+// ringHash is the name of hash64 in /cluster/topology.
+const ringHash = "sha256-64"
+
+// hash64 places a string on the ring: the first 8 bytes of its SHA-256,
+// big-endian. It is in every client's standard library, and unlike FNV
+// it spreads keys differing only in a suffix over the whole ring.
+func hash64(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newHashRing(nodes []topologyNode, vnodes int) *hashRing {
+	hr := &hashRing{vnodes: vnodes}
+	for _, n := range nodes {
+		hr.nodes = append(hr.nodes, n.ID)
+		for i := 0; i < vnodes; i++ {
+			hr.points = append(hr.points, ringPoint{hash64(n.ID + "#" + strconv.Itoa(i)), n.ID})
+		}
+	}
+	sort.Slice(hr.points, func(i, j int) bool { return hr.points[i].token < hr.points[j].token })
+	sort.Strings(hr.nodes)
+	hr.version = strconv.FormatUint(hash64(strconv.Itoa(vnodes)+"/"+strings.Join(hr.nodes, ",")), 16)
+	return hr
+}
+
+func (hr *hashRing) has(id string) bool {
+	i := sort.SearchStrings(hr.nodes, id)
+	return i < len(hr.nodes) && hr.nodes[i] == id
+}
+
+// owner returns the ID of the node key belongs to.
+func (hr *hashRing) owner(key string) string {
+	h := hash64(key)
+	i := sort.Search(len(hr.points), func(i int) bool { return hr.points[i].token >= h })
+	if i == len(hr.points) {
+		i = 0
+	}
+	return hr.points[i].node
+}
+
+// shardRouter forwards requests for keys this node does not own to their
+// owner. Its ring is rebuilt whenever discovery changes the topology's
+// membership; keys are not moved, so those whose owner changed read as
+// missing until they are written again.
+type shardRouter struct {
+	topo   *topology
+	vnodes int
+
+	mu      sync.RWMutex
+	ring    *hashRing
+	proxies map[string]*httputil.ReverseProxy
+}
+
+// forwardedHeader marks a request one node has proxied to another. Such
+// requests are always served where they arrive, so nodes with different
+// rings cannot bounce a request between them forever.
+const forwardedHeader = "X-Forwarded-By-Node"
+
+func newShardRouter(t *topology, vnodes int) (*shardRouter, error) {
+	sr := &shardRouter{topo: t, vnodes: vnodes}
+	if err := sr.rebuild(t.members()); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// rebuild spreads the keyspace over nodes. A node with an invalid URL
+// leaves the ring as it was.
+func (sr *shardRouter) rebuild(nodes []topologyNode) error {
+	proxies := make(map[string]*httputil.ReverseProxy, len(nodes))
+	for _, n := range nodes {
+		if n.ID == sr.topo.Self {
+			continue
+		}
+		u, err := url.Parse(n.URL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("node %q: invalid URL %q", n.ID, n.URL)
+		}
+		p := httputil.NewSingleHostReverseProxy(u)
+		id := n.ID
+		p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			writeError(w, r, http.StatusBadGateway, codeShardUnavailable, fmt.Sprintf("Node %s, which owns this key, is unavailable", id))
+		}
+		proxies[n.ID] = p
+	}
+	ring := newHashRing(nodes, sr.vnodes)
+	sr.mu.Lock()
+	sr.ring, sr.proxies = ring, proxies
+	sr.mu.Unlock()
+	return nil
+}
+
+func (sr *shardRouter) currentRing() *hashRing {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.ring
+}
+
+// routeToShard serves a single-key request locally if this node owns the
+// key and proxies it to the owner otherwise. POST /data is forwarded when
+// every key in the body has the same owner; batches spanning nodes are
+// rejected, since they could not be applied atomically.
+func (s *Server) routeToShard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := s.shards
+		if sr == nil || r.Header.Get(forwardedHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var owner string
+		ring := sr.currentRing()
+		if key := r.PathValue("key"); key != "" {
+			owner = ring.owner(key)
+		} else {
+			if !checkDataContentType(w, r) {
+				return
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "Could not read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			payload, _, err := decodeDataBody(r, s.cfg.StrictJSON)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidJSON, invalidBodyMessage(r, err))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			for k := range s.keyRules.canonicalKeys(payload) {
+				if o := ring.owner(k); owner == "" {
+					owner = o
+				} else if o != owner {
+					writeError(w, r, http.StatusBadRequest, codeCrossShard, "Keys belong to different nodes; write them in separate requests")
+					return
+				}
+			}
+		}
+		if key := r.PathValue("key"); key != "" && owner == sr.topo.Self && s.rebalance.dualRead(w, r, sr, key) {
+			return
+		}
+		w.Header().Set("X-Shard-Node", owner)
+		if owner == "" || owner == sr.topo.Self {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sr.mu.RLock()
+		proxy := sr.proxies[owner]
+		sr.mu.RUnlock()
+		if proxy == nil {
+			// The owner left while the request was routed.
+			writeError(w, r, http.StatusBadGateway, codeShardUnavailable, fmt.Sprintf("Node %s, which owns this key, is unavailable", owner))
+			return
+		}
+		r.Header.Set(forwardedHeader, sr.topo.Self)
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// clusterNode is a node in the /cluster/topology response.
+type clusterNode struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Region string `json:"region,omitempty"`
+}
+
+// clusterTopology is the /cluster/topology response. Ring lists the
+// points of the hash ring in token order, with tokens as hex strings;
+// it is omitted unless the keyspace is sharded.
+//
+// Discovery is how the nodes were found, and Changed when discovery last
+// changed them.
+type clusterTopology struct {
+	Self      string        `json:"self"`
+	Discovery string        `json:"discovery"`
+	Changed   *time.Time    `json:"changed,omitempty"`
+	Nodes     []clusterNode `json:"nodes"`
+	Hash      string        `json:"hash,omitempty"`
+	VNodes    int           `json:"vnodes,omitempty"`
+	Ring      []ringJSON    `json:"ring,omitempty"`
+}
+
+type ringJSON struct {
+	Token string `json:"token"`
+	Node  string `json:"node"`
+}
+
+// GET
+func (s *Server) clusterTopologyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.topology == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No topology is configured")
+		return
+	}
+	nodes := s.topology.members()
+	out := clusterTopology{Self: s.topology.Self, Discovery: s.discovery.mode, Nodes: make([]clusterNode, 0, len(nodes))}
+	if t := s.topology.lastChange(); !t.IsZero() {
+		out.Changed = &t
+	}
+	for _, n := range nodes {
+		out.Nodes = append(out.Nodes, clusterNode{ID: n.ID, URL: n.URL, Region: n.Region})
+	}
+	if sr := s.shards; sr != nil {
+		ring := sr.currentRing()
+		out.Hash = ringHash
+		out.VNodes = ring.vnodes
+		out.Ring = make([]ringJSON, len(ring.points))
+		for i, p := range ring.points {
+			out.Ring[i] = ringJSON{Token: strconv.FormatUint(p.token, 16), Node: p.node}
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
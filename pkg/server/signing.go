@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// signingScheme is the Authorization scheme of signed requests:
+	//
+	//	Authorization: KV-HMAC-SHA256 key=NAME, timestamp=UNIX, signature=HEX
+	//
+	// where the signature is the HMAC-SHA256, under the key's secret, of
+	// signingString.
+	signingScheme = "KV-HMAC-SHA256"
+
+	// defaultSigningWindow is how far the timestamp of a signed request may
+	// be from the server's clock by default.
+	defaultSigningWindow = 5 * time.Minute
+
+	// maxSignedRequest is the largest request body accepted with a
+	// signature; the body is buffered to hash it.
+	maxSignedRequest = 32 << 20
+)
+
+// errSignature is why a signed request was refused.
+var errSignature = fmt.Errorf("%w: bad request signature", ErrUnauthenticated)
+
+// signingString is what a request is signed over: the method, the path
+// and query as sent, the timestamp and the hex SHA-256 of the body, one
+// per line.
+func signingString(method, uri, timestamp string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return method + "\n" + uri + "\n" + timestamp + "\n" + hex.EncodeToString(sum[:])
+}
+
+// requestSigner verifies requests signed with one of keys, for callers
+// that hold a shared secret but cannot use TLS client certificates. A
+// request must be signed within window of the server's clock and each
+// signature is accepted once, so a captured request cannot be replayed.
+// Signatures are remembered per node: behind a load balancer a replay to
+// another node within the window is only caught if it is sent there.
+type requestSigner struct {
+	keys   APIKeys
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // signature to when it may be forgotten
+	lastPrune time.Time
+	verified  uint64
+	replays   uint64
+}
+
+// signingPruneInterval is how often forgettable signatures are dropped.
+const signingPruneInterval = 10 * time.Second
+
+func newRequestSigner(cfg Config) *requestSigner {
+	if len(cfg.SigningKeys) == 0 {
+		return nil
+	}
+	window := cfg.SigningWindow
+	if window <= 0 {
+		window = defaultSigningWindow
+	}
+	return &requestSigner{keys: cfg.SigningKeys, window: window, seen: make(map[string]time.Time)}
+}
+
+// signed reports whether r carries a signature rather than other
+// credentials.
+func signed(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), signingScheme+" ")
+}
+
+// parseSignature splits the parameters of a signed Authorization header.
+func parseSignature(header string) (key, timestamp string, sig []byte, err error) {
+	params := map[string]string{}
+	for _, p := range strings.Split(strings.TrimPrefix(header, signingScheme+" "), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok {
+			return "", "", nil, errSignature
+		}
+		params[name] = value
+	}
+	key, timestamp = params["key"], params["timestamp"]
+	if sig, err = hex.DecodeString(params["signature"]); err != nil || key == "" || timestamp == "" || len(sig) != sha256.Size {
+		return "", "", nil, errSignature
+	}
+	return key, timestamp, sig, nil
+}
+
+// verify checks the signature of r, returning the name of the key that
+// signed it. The body is read and put back for the handler.
+func (rs *requestSigner) verify(w http.ResponseWriter, r *http.Request, now time.Time) (string, error) {
+	key, timestamp, sig, err := parseSignature(r.Header.Get("Authorization"))
+	if err != nil {
+		return key, err
+	}
+	secret, ok := rs.keys[key]
+	if !ok {
+		return key, errSignature
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return key, errSignature
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > rs.window || skew < -rs.window {
+		return key, fmt.Errorf("%w: timestamp outside the %s window", ErrUnauthenticated, rs.window)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedRequest))
+	if errBodyTooLarge(err) {
+		return key, err
+	} else if err != nil {
+		return key, fmt.Errorf("%w: reading body: %v", ErrUnauthenticated, err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingString(r.Method, r.URL.RequestURI(), timestamp, body)))
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return key, errSignature
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if now.Sub(rs.lastPrune) > signingPruneInterval {
+		for s, until := range rs.seen {
+			if now.After(until) {
+				delete(rs.seen, s)
+			}
+		}
+		rs.lastPrune = now
+	}
+	id := string(sig)
+	if _, dup := rs.seen[id]; dup {
+		rs.replays++
+		return key, fmt.Errorf("%w: replayed request", ErrUnauthenticated)
+	}
+	// A signature stays valid until window after its timestamp, so it is
+	// remembered until then.
+	rs.seen[id] = time.Unix(unix, 0).Add(rs.window)
+	rs.verified++
+	return key, nil
+}
+
+func (rs *requestSigner) stats() map[string]interface{} {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return map[string]interface{}{
+		"keys":     len(rs.keys),
+		"verified": rs.verified,
+		"replays":  rs.replays,
+		"window":   rs.window.String(),
+	}
+}
+
+// errBodyTooLarge reports whether err is from reading a request body past
+// its limit.
+func errBodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
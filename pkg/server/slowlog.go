@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestTiming breaks the time a request took into the phases slow
+// request logging reports. It lives in the request's context, and its
+// methods do nothing on a nil timing, so the hooks cost nothing when
+// logging is off.
+type requestTiming struct {
+	start        time.Time
+	route        atomic.Pointer[string] // "METHOD /path", once a route is matched
+	handlerStart atomic.Int64           // nanoseconds after start
+	handlerEnd   atomic.Int64
+	firstWrite   atomic.Int64
+	lockWait     atomic.Int64 // nanoseconds
+	storeTime    atomic.Int64
+}
+
+// timingFrom returns the timing of the request ctx belongs to, or nil.
+func timingFrom(ctx context.Context) *requestTiming {
+	t, _ := ctx.Value(timingKey).(*requestTiming)
+	return t
+}
+
+func (t *requestTiming) since() int64 {
+	// Offsets are stored plus one so that zero means "not yet".
+	return int64(time.Since(t.start)) + 1
+}
+
+// handlerStarted records that the route's handler is about to run.
+func (t *requestTiming) handlerStarted(route string) {
+	if t == nil {
+		return
+	}
+	t.route.Store(&route)
+	t.handlerStart.CompareAndSwap(0, t.since())
+}
+
+func (t *requestTiming) handlerDone() {
+	if t != nil {
+		t.handlerEnd.CompareAndSwap(0, t.since())
+	}
+}
+
+func (t *requestTiming) wrote() {
+	if t != nil && t.firstWrite.Load() == 0 {
+		t.firstWrite.CompareAndSwap(0, t.since())
+	}
+}
+
+func (t *requestTiming) addLockWait(d time.Duration) {
+	if t != nil {
+		t.lockWait.Add(int64(d))
+	}
+}
+
+// storeTimer starts timing a store operation made for the request ctx
+// belongs to; call the function it returns when the operation is done.
+func storeTimer(ctx context.Context) func() {
+	t := timingFrom(ctx)
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() { t.storeTime.Add(int64(time.Since(start))) }
+}
+
+// routeName returns the route the request was matched to, "unmatched"
+// if none was, and "background" for work done outside a request.
+func (t *requestTiming) routeName() string {
+	if t == nil {
+		return "background"
+	}
+	if p := t.route.Load(); p != nil {
+		return *p
+	}
+	return "unmatched"
+}
+
+// timingBreakdown is how a finished request's time was spent.
+type timingBreakdown struct {
+	total, queue, lock, store, encode time.Duration
+}
+
+func (t *requestTiming) breakdown() timingBreakdown {
+	at := func(v *atomic.Int64) time.Duration {
+		if n := v.Load(); n > 0 {
+			return time.Duration(n - 1)
+		}
+		return 0
+	}
+	b := timingBreakdown{
+		total: time.Since(t.start),
+		lock:  time.Duration(t.lockWait.Load()),
+		store: time.Duration(t.storeTime.Load()),
+	}
+	start, end, write := at(&t.handlerStart), at(&t.handlerEnd), at(&t.firstWrite)
+	if t.handlerStart.Load() == 0 {
+		// Answered before reaching a handler, by auth or a rate limit.
+		start = b.total
+	}
+	b.queue = start
+	if end == 0 {
+		end = b.total
+	}
+	if write > 0 && end > write {
+		b.encode = end - write
+	}
+	return b
+}
+
+// slowLog counts and logs the requests taking longer than a threshold.
+type slowLog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	count   int64
+	byRoute map[string]int64
+}
+
+func newSlowLog(threshold time.Duration) *slowLog {
+	return &slowLog{threshold: threshold, byRoute: make(map[string]int64)}
+}
+
+// withTiming times every request when slow requests are logged or lock
+// contention is counted, logging a warning with the breakdown of those
+// taking longer than the threshold.
+func (s *Server) withTiming(next http.Handler) http.Handler {
+	sl := s.slowLog
+	if sl == nil && s.lockStats == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &requestTiming{start: time.Now()}
+		rw := &timedWriter{responseWriter: wrapResponseWriter(w), t: t}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), timingKey, t)))
+		if sl == nil {
+			return
+		}
+		b := t.breakdown()
+		if b.total < sl.threshold {
+			return
+		}
+		route := t.routeName()
+		sl.mu.Lock()
+		sl.count++
+		sl.byRoute[route]++
+		sl.mu.Unlock()
+		s.logger.Printf("WARN slow request %s %s %d %s (queue=%s lock=%s store=%s encode=%s) request=%s",
+			r.Method, r.URL.RequestURI(), rw.status, b.total.Round(time.Microsecond),
+			b.queue.Round(time.Microsecond), b.lock.Round(time.Microsecond), b.store.Round(time.Microsecond),
+			b.encode.Round(time.Microsecond), requestIDFrom(r.Context()))
+	})
+}
+
+// timedWriter notes when the response starts being written.
+type timedWriter struct {
+	*responseWriter
+	t *requestTiming
+}
+
+func (w *timedWriter) WriteHeader(status int) {
+	w.t.wrote()
+	w.responseWriter.WriteHeader(status)
+}
+
+func (w *timedWriter) Write(b []byte) (int, error) {
+	w.t.wrote()
+	return w.responseWriter.Write(b)
+}
+
+// stats is the "slow_requests" section of /stats.
+func (sl *slowLog) stats() map[string]interface{} {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	byRoute := make(map[string]int64, len(sl.byRoute))
+	for route, n := range sl.byRoute {
+		byRoute[route] = n
+	}
+	return map[string]interface{}{
+		"threshold": sl.threshold.String(),
+		"count":     sl.count,
+		"by_route":  byRoute,
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshot is an immutable, point-in-time copy of a store. Keys are kept in
+// sorted order so that streaming the same snapshot twice yields identical
+// output.
+type Snapshot struct {
+	Taken time.Time
+	keys  []string
+	data  map[string]string
+
+	// packed holds the keys whose values in data are compressed by codec.
+	packed map[string]bool
+	codec  *valueCodec
+	// corrupt holds the keys left out for values that were corrupted in
+	// memory; see Err.
+	corrupt []string
+	// ns names the namespace annotate took the snapshot of, "" for the
+	// default one and for a snapshot of a store alone. tags and expiries
+	// hold the tags and expiries of the keys, as annotate found them.
+	ns       string
+	tags     map[string][]string
+	expiries map[string]keyExpiry
+}
+
+// NewSnapshot takes ownership of data; callers must not modify it afterwards.
+func NewSnapshot(data map[string]string) *Snapshot {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return &Snapshot{Taken: time.Now().UTC(), keys: keys, data: data}
+}
+
+func (s *Snapshot) Len() int { return len(s.keys) }
+
+// Err returns an error wrapping ErrCorrupted that names the keys left out
+// of the snapshot because their compressed values were corrupted in
+// memory, or nil if none were. Backups, exports and the data file are not
+// written from such a snapshot, which would silently lose the keys.
+func (s *Snapshot) Err() error {
+	if len(s.corrupt) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %d values left out of the snapshot: %s", ErrCorrupted, len(s.corrupt), strings.Join(s.corrupt, ", "))
+}
+
+// entry returns the entry of key k with value v as the snapshot's writers
+// keep it, with the key's tags and expiry.
+func (s *Snapshot) entry(k, v string) snapshotEntry {
+	e := snapshotEntry{Key: k, Value: v, Tags: s.tags[k]}
+	if x, ok := s.expiries[k]; ok {
+		e.Expiry = &x
+	}
+	return e
+}
+
+// value returns the value of k held in data, expanding it if it is
+// compressed. Only values that passed their checksum are in a snapshot,
+// so it fails only if the codec cannot read what it wrote.
+func (s *Snapshot) value(k string) (string, bool) {
+	v := s.data[k]
+	if !s.packed[k] {
+		return v, true
+	}
+	v, err := s.codec.decode(v)
+	return v, err == nil
+}
+
+// Get returns the value stored under key at the time of the snapshot.
+func (s *Snapshot) Get(key string) (string, bool) {
+	if _, ok := s.data[key]; !ok {
+		return "", false
+	}
+	return s.value(key)
+}
+
+// Range calls fn for each entry in key order until fn returns false.
+func (s *Snapshot) Range(fn func(key, value string) bool) {
+	for _, k := range s.keys {
+		v, ok := s.value(k)
+		if !ok {
+			continue
+		}
+		if !fn(k, v) {
+			return
+		}
+	}
+}
+
+// narrow returns a snapshot of just keys, which must be a subset of the
+// snapshot's, sharing its data.
+func (s *Snapshot) narrow(keys []string) *Snapshot {
+	out := *s
+	out.keys = keys
+	return &out
+}
+
+// values returns the snapshot's data as a map, which must not be modified.
+func (s *Snapshot) values() map[string]string {
+	if len(s.packed) == 0 {
+		return s.data
+	}
+	out := make(map[string]string, len(s.data))
+	for k := range s.data {
+		if v, ok := s.value(k); ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// Between returns the sorted keys k with from <= k < to. An empty to means
+// no upper bound.
+func (s *Snapshot) Between(from, to string) []string {
+	lo := sort.SearchStrings(s.keys, from)
+	hi := len(s.keys)
+	if to != "" {
+		hi = sort.SearchStrings(s.keys, to)
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return s.keys[lo:hi]
+}
+
+type snapshotEntry struct {
+	// NS is the namespace of an entry of a data file, "" for the default
+	// one. Exports are of one namespace and leave it out.
+	NS    string `json:"-"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// CRC is the hex CRC-32C of Value, written to snapshot files so bit
+	// rot is caught when they are loaded. Older files have none.
+	CRC string `json:"crc,omitempty"`
+	// TTL, if set, is the time to live an import gives the key. Only CSV
+	// and RDB imports carry one.
+	TTL time.Duration `json:"-"`
+	// Tags are the tags of the key, kept in data files, backups and
+	// exports so that their policies still hold once the entry is loaded
+	// or imported.
+	Tags []string `json:"tags,omitempty"`
+	// Expiry is when the key expires, kept beside Tags so that a loaded or
+	// imported key expires when it would have.
+	Expiry *keyExpiry `json:"expiry,omitempty"`
+}
+
+// GET
+func (s *Server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	snap := s.namespaces.def.snapshot()
+	if err := snap.Err(); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Snapshot-Time", snap.Taken.Format(time.RFC3339Nano))
+	w.Header().Set("X-Snapshot-Keys", strconv.Itoa(snap.Len()))
+
+	writeSnapshot(s.streamDeadlines(w).writer(w), snap)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// sniffTimeout bounds how long a new connection may take to send its first
+// byte before it is dropped.
+const sniffTimeout = 10 * time.Second
+
+// sniffLineMax bounds how much of a plaintext connection's first line is
+// read to tell HTTP from the Redis protocol.
+const sniffLineMax = 4096
+
+// sniffListener serves TLS and plaintext connections on the same port. Each
+// accepted connection is classified by its first byte: a TLS handshake
+// record starts with 0x16, anything else is treated as plaintext HTTP.
+// With a RESP listener, plaintext connections speaking the Redis protocol
+// are told apart by their first line, which is a RESP array or an inline
+// command rather than an HTTP request line, and handed to it instead.
+type sniffListener struct {
+	net.Listener
+	tlsConfig *tls.Config // nil to serve plaintext only
+
+	conns     chan net.Conn
+	resp      *sniffedListener
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func newSniffListener(inner net.Listener, tlsConfig *tls.Config, resp bool) *sniffListener {
+	l := &sniffListener{
+		Listener:  inner,
+		tlsConfig: tlsConfig,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	if resp {
+		l.resp = &sniffedListener{parent: l, conns: make(chan net.Conn), closed: make(chan struct{})}
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *sniffListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.shutdown(err)
+			return
+		}
+		go l.classify(c)
+	}
+}
+
+func (l *sniffListener) classify(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	br := bufio.NewReader(c)
+	first, err := br.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	var out net.Conn = &peekedConn{Conn: c, r: br}
+	conns, closed := l.conns, chan struct{}(nil)
+	switch {
+	case first[0] == 0x16 && l.tlsConfig != nil:
+		out = tls.Server(out, l.tlsConfig)
+	case l.resp != nil && sniffRESP(c, br):
+		conns, closed = l.resp.conns, l.resp.closed
+	}
+
+	select {
+	case conns <- out:
+	case <-l.done:
+		out.Close()
+	case <-closed:
+		out.Close()
+	}
+}
+
+// sniffRESP reports whether the plaintext connection c, read through br,
+// speaks the Redis protocol: its first line is a RESP array or an inline
+// command, where HTTP sends a request line ending in its version.
+func sniffRESP(c net.Conn, br *bufio.Reader) bool {
+	if first, _ := br.Peek(1); first[0] == '*' {
+		return true
+	}
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	for n := 1; n <= sniffLineMax; n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return false
+		}
+		if b[n-1] != '\n' {
+			continue
+		}
+		fields := bytes.Fields(b)
+		return len(fields) > 0 && !bytes.HasPrefix(fields[len(fields)-1], []byte("HTTP/"))
+	}
+	return false
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniffListener) Close() error {
+	return l.shutdown(nil)
+}
+
+// shutdown closes the listener once, remembering the accept error (if any)
+// that caused it so Accept can report it.
+func (l *sniffListener) shutdown(cause error) error {
+	err := errors.New("listener already closed")
+	l.closeOnce.Do(func() {
+		l.err = cause
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// respListener returns the listener Redis protocol connections are
+// accepted from, or nil if they are served as HTTP.
+func (l *sniffListener) respListener() net.Listener {
+	if l.resp == nil {
+		return nil
+	}
+	return l.resp
+}
+
+// sniffedListener accepts the connections a sniffListener classified as
+// the Redis protocol. Closing it stops only those; closing its parent
+// stops both.
+type sniffedListener struct {
+	parent    *sniffListener
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *sniffedListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.parent.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniffedListener) Close() error {
+	err := errors.New("listener already closed")
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = nil
+	})
+	return err
+}
+
+func (l *sniffedListener) Addr() net.Addr { return l.parent.Addr() }
+
+// peekedConn replays bytes buffered while sniffing before reading from the
+// underlying connection.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
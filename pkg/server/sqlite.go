@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// Storage backends, chosen with Config.Storage.
+const (
+	storageMemory = "memory"
+	storageSQLite = "sqlite"
+	storageBolt   = "bolt"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS kv (
+	key     BLOB PRIMARY KEY,
+	value   BLOB NOT NULL,
+	rev     INTEGER NOT NULL,
+	created INTEGER NOT NULL,
+	updated INTEGER NOT NULL
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS kv_meta (
+	name  TEXT PRIMARY KEY,
+	value INTEGER NOT NULL
+);
+INSERT OR IGNORE INTO kv_meta (name, value) VALUES ('revision', 0);
+`
+
+// sqliteStore keeps keys in a single SQLite database file in WAL mode, so
+// every write is durable once it returns and the data set need not fit in
+// memory. Writes are serialized by mu, which is also what orders change
+// events; reads run concurrently against the last committed state.
+//
+// Full reads (All, Snapshot) still copy every key into memory. Access
+// counts are kept in memory and start from zero when the file is opened.
+type sqliteStore struct {
+	db *sql.DB
+
+	mu  sync.Mutex
+	gen uint64 // last revision this process committed, for the snapshot cache
+
+	snapMu  sync.Mutex
+	snap    *Snapshot
+	snapGen uint64
+
+	access   sync.Map // key -> *accessStats
+	onChange func(Event)
+}
+
+// openSQLiteStore opens or creates the database at path.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	if path == "" {
+		return nil, errors.New("the sqlite backend requires a storage path")
+	}
+	// Write transactions take the write lock up front so that they wait on
+	// another process, such as the other side of a graceful upgrade,
+	// rather than fail when they upgrade from reading.
+	q := url.Values{
+		"_pragma": {"journal_mode(WAL)", "synchronous(NORMAL)", "busy_timeout(5000)"},
+		"_txlock": {"immediate"},
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	st := &sqliteStore{db: db}
+	if err := db.QueryRow(`SELECT value FROM kv_meta WHERE name = 'revision'`).Scan(&st.gen); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	return st, nil
+}
+
+// Close closes the database.
+func (st *sqliteStore) Close() error {
+	return st.db.Close()
+}
+
+// OnChange registers fn to be called after every committed mutation. It
+// must be set before the store is used concurrently.
+func (st *sqliteStore) OnChange(fn func(Event)) {
+	st.onChange = fn
+}
+
+func (st *sqliteStore) notify(ev Event) {
+	if st.onChange != nil {
+		ev.Time = time.Now().UTC()
+		st.onChange(ev)
+	}
+}
+
+func (st *sqliteStore) accessFor(key string) *accessStats {
+	if a, ok := st.access.Load(key); ok {
+		return a.(*accessStats)
+	}
+	a, _ := st.access.LoadOrStore(key, new(accessStats))
+	return a.(*accessStats)
+}
+
+func (st *sqliteStore) Get(key string) (string, error) {
+	return st.GetContext(context.Background(), key)
+}
+
+// GetContext reads key, giving up when ctx is done.
+func (st *sqliteStore) GetContext(ctx context.Context, key string) (string, error) {
+	v, err := st.peek(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	a := st.accessFor(key)
+	a.reads.Add(1)
+	a.lastRead.Store(time.Now().UnixNano())
+	return v, nil
+}
+
+// Peek returns the value of key without counting a read.
+func (st *sqliteStore) Peek(key string) (string, error) {
+	return st.peek(context.Background(), key)
+}
+
+func (st *sqliteStore) peek(ctx context.Context, key string) (string, error) {
+	var v []byte
+	err := st.db.QueryRowContext(ctx, `SELECT value FROM kv WHERE key = ?`, []byte(key)).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", &KeyError{Op: "get", Key: key, Err: ErrKeyNotFound}
+	} else if err != nil {
+		return "", &KeyError{Op: "get", Key: key, Err: err}
+	}
+	return string(v), nil
+}
+
+// Metadata returns the bookkeeping of key without counting it as a read.
+func (st *sqliteStore) Metadata(key string) (KeyMeta, error) {
+	var rev uint64
+	var created, updated int64
+	var size int
+	err := st.db.QueryRow(`SELECT rev, created, updated, length(value) FROM kv WHERE key = ?`, []byte(key)).Scan(&rev, &created, &updated, &size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return KeyMeta{}, &KeyError{Op: "metadata", Key: key, Err: ErrKeyNotFound}
+	} else if err != nil {
+		return KeyMeta{}, &KeyError{Op: "metadata", Key: key, Err: err}
+	}
+	meta := KeyMeta{
+		CreatedAt: time.Unix(0, created).UTC(),
+		UpdatedAt: time.Unix(0, updated).UTC(),
+		Revision:  rev,
+		Size:      size,
+	}
+	if a, ok := st.access.Load(key); ok {
+		meta.Reads = a.(*accessStats).reads.Load()
+		if ns := a.(*accessStats).lastRead.Load(); ns != 0 {
+			meta.LastRead = time.Unix(0, ns).UTC()
+		}
+	}
+	return meta, nil
+}
+
+// LastRevision returns the revision of the latest write, by any process.
+func (st *sqliteStore) LastRevision() uint64 {
+	var gen uint64
+	st.db.QueryRow(`SELECT value FROM kv_meta WHERE name = 'revision'`).Scan(&gen)
+	return gen
+}
+
+// Revision returns the revision at which key was last written.
+func (st *sqliteStore) Revision(key string) (uint64, error) {
+	var rev uint64
+	err := st.db.QueryRow(`SELECT rev FROM kv WHERE key = ?`, []byte(key)).Scan(&rev)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, &KeyError{Op: "revision", Key: key, Err: ErrKeyNotFound}
+	} else if err != nil {
+		return 0, &KeyError{Op: "revision", Key: key, Err: err}
+	}
+	return rev, nil
+}
+
+// write runs fn in a transaction with mu held. fn takes the revisions of
+// its changes from next, and the events it returns are published once the
+// transaction has committed. Nothing is committed if fn used no revision.
+func (st *sqliteStore) write(fn func(tx *sql.Tx, next func() uint64) ([]Event, error)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// The revision is read afresh rather than trusted from memory in case
+	// another process has written since.
+	var gen uint64
+	if err := tx.QueryRow(`SELECT value FROM kv_meta WHERE name = 'revision'`).Scan(&gen); err != nil {
+		return err
+	}
+	start := gen
+	next := func() uint64 { gen++; return gen }
+	events, err := fn(tx, next)
+	if err != nil {
+		return err
+	}
+	if gen == start {
+		return nil
+	}
+	if _, err := tx.Exec(`UPDATE kv_meta SET value = ? WHERE name = 'revision'`, gen); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	st.gen = gen
+	for _, ev := range events {
+		st.notify(ev)
+	}
+	return nil
+}
+
+func (st *sqliteStore) Set(key, value string) error {
+	_, _, err := st.set(key, value, false)
+	return err
+}
+
+// Create sets key only if it is absent.
+func (st *sqliteStore) Create(key, value string) error {
+	_, _, err := st.set(key, value, true)
+	return err
+}
+
+// Swap sets key and returns the value it replaced.
+func (st *sqliteStore) Swap(key, value string) (string, bool, error) {
+	return st.set(key, value, false)
+}
+
+func (st *sqliteStore) set(key, value string, create bool) (old string, existed bool, err error) {
+	err = st.write(func(tx *sql.Tx, next func() uint64) ([]Event, error) {
+		var prev []byte
+		err := tx.QueryRow(`SELECT value FROM kv WHERE key = ?`, []byte(key)).Scan(&prev)
+		switch {
+		case err == nil:
+			old, existed = string(prev), true
+		case !errors.Is(err, sql.ErrNoRows):
+			return nil, err
+		}
+		if existed && create {
+			return nil, &KeyError{Op: "create", Key: key, Err: ErrKeyExists}
+		}
+		rev, now := next(), time.Now().UnixNano()
+		_, err = tx.Exec(`INSERT INTO kv (key, value, rev, created, updated) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (key) DO UPDATE SET value = excluded.value, rev = excluded.rev, updated = excluded.updated`,
+			[]byte(key), []byte(value), rev, now, now)
+		if err != nil {
+			return nil, err
+		}
+		return []Event{{Type: "set", Key: key, Value: value, Created: !existed, Revision: rev}}, nil
+	})
+	var ke *KeyError
+	if err != nil && !errors.As(err, &ke) {
+		err = &KeyError{Op: "set", Key: key, Err: err}
+	}
+	return old, existed, err
+}
+
+func (st *sqliteStore) Delete(key string) error {
+	_, err := st.Take(key)
+	return err
+}
+
+// Take deletes key and returns its value.
+func (st *sqliteStore) Take(key string) (string, error) {
+	return st.take(key, false, 0)
+}
+
+// TakeAt deletes key and returns its value if it was last written at rev.
+func (st *sqliteStore) TakeAt(key string, rev uint64) (string, error) {
+	return st.take(key, true, rev)
+}
+
+// take deletes key, only if it was last written at rev when atRev is set.
+func (st *sqliteStore) take(key string, atRev bool, rev uint64) (old string, err error) {
+	err = st.write(func(tx *sql.Tx, next func() uint64) ([]Event, error) {
+		var cur uint64
+		var prev []byte
+		err := tx.QueryRow(`SELECT rev, value FROM kv WHERE key = ?`, []byte(key)).Scan(&cur, &prev)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &KeyError{Op: "delete", Key: key, Err: ErrKeyNotFound}
+		} else if err != nil {
+			return nil, err
+		}
+		if atRev && cur != rev {
+			return nil, &KeyError{Op: "delete", Key: key, Err: ErrConflict}
+		}
+		if _, err := tx.Exec(`DELETE FROM kv WHERE key = ?`, []byte(key)); err != nil {
+			return nil, err
+		}
+		old = string(prev)
+		return []Event{{Type: "delete", Key: key, Revision: next()}}, nil
+	})
+	var ke *KeyError
+	if err != nil && !errors.As(err, &ke) {
+		err = &KeyError{Op: "delete", Key: key, Err: err}
+	}
+	if err == nil {
+		st.access.Delete(key)
+	}
+	return old, err
+}
+
+// ClearPrefix removes the keys starting with prefix in one transaction.
+func (st *sqliteStore) ClearPrefix(prefix string) (map[string]string, error) {
+	removed := make(map[string]string)
+	err := st.write(func(tx *sql.Tx, next func() uint64) ([]Event, error) {
+		q, args := `DELETE FROM kv WHERE key >= ? RETURNING key, value`, []interface{}{[]byte(prefix)}
+		if end := prefixEnd(prefix); end != "" {
+			q, args = `DELETE FROM kv WHERE key >= ? AND key < ? RETURNING key, value`, append(args, []byte(end))
+		}
+		rows, err := tx.Query(q, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var events []Event
+		for rows.Next() {
+			var k, v []byte
+			if err := rows.Scan(&k, &v); err != nil {
+				return nil, err
+			}
+			removed[string(k)] = string(v)
+			events = append(events, Event{Type: "delete", Key: string(k), Revision: next()})
+		}
+		return events, rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	for k := range removed {
+		st.access.Delete(k)
+	}
+	return removed, nil
+}
+
+// All returns a copy of the stored data.
+func (st *sqliteStore) All() map[string]string {
+	data, _ := st.load()
+	return data
+}
+
+// load reads every key, along with the revision the data is current as of.
+func (st *sqliteStore) load() (map[string]string, uint64) {
+	data := make(map[string]string)
+	tx, err := st.db.Begin()
+	if err != nil {
+		return data, 0
+	}
+	defer tx.Rollback()
+	var gen uint64
+	if err := tx.QueryRow(`SELECT value FROM kv_meta WHERE name = 'revision'`).Scan(&gen); err != nil {
+		return data, 0
+	}
+	rows, err := tx.Query(`SELECT key, value FROM kv`)
+	if err != nil {
+		return data, 0
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k, v []byte
+		if rows.Scan(&k, &v) == nil {
+			data[string(k)] = string(v)
+		}
+	}
+	return data, gen
+}
+
+func (st *sqliteStore) Len() int {
+	var n int
+	st.db.QueryRow(`SELECT count(*) FROM kv`).Scan(&n)
+	return n
+}
+
+// Snapshot is served from a cached copy until a write has been committed
+// since it was taken.
+func (st *sqliteStore) Snapshot() *Snapshot {
+	st.snapMu.Lock()
+	defer st.snapMu.Unlock()
+	st.mu.Lock()
+	gen := st.gen
+	st.mu.Unlock()
+	if st.snap != nil && st.snapGen == gen {
+		return st.snap
+	}
+	data, gen := st.load()
+	st.snap = NewSnapshot(data)
+	st.snapGen = gen
+	return st.snap
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// promotion records how a replica became a primary, for /stats.
+type promotion struct {
+	Time    time.Time `json:"time"`
+	Primary string    `json:"former_primary"`
+	Reason  string    `json:"reason"`
+	// AppliedSeq is the last mutation of the former primary applied, and
+	// LagEntries how many more it was known to have, which are lost.
+	AppliedSeq uint64 `json:"applied_seq"`
+	LagEntries uint64 `json:"lag_entries"`
+}
+
+// promote makes this replica a primary: it stops following the primary,
+// waits for whatever it was applying to finish, and from then on accepts
+// writes. It returns nil if the node is not a replica, or was promoted
+// already.
+func (s *Server) promote(reason string) *promotion {
+	rp := s.replica.Load()
+	if rp == nil {
+		return nil
+	}
+	rp.mu.Lock()
+	select {
+	case <-rp.promoted:
+		rp.mu.Unlock()
+		return nil
+	default:
+	}
+	close(rp.promoted)
+	running := rp.running
+	rp.mu.Unlock()
+	if running {
+		<-rp.done
+	}
+
+	rp.mu.Lock()
+	p := &promotion{
+		Time:       s.clock.Now().UTC(),
+		Primary:    rp.primary,
+		Reason:     reason,
+		AppliedSeq: rp.applied,
+		LagEntries: rp.head - rp.applied,
+	}
+	rp.mu.Unlock()
+	s.promotion.Store(p)
+	s.replica.Store(nil)
+	s.logger.Printf("[Replica] Promoted to primary (%s) at %s:%d, %d entries behind %s; restart without -replica-of, or it will follow %s again",
+		reason, rp.epoch, p.AppliedSeq, p.LagEntries, rp.primary, rp.primary)
+	return p
+}
+
+// watchPrimary promotes the node once the primary, which sends a
+// heartbeat every replHeartbeat while a stream is open, has not been heard
+// from for rp.promoteAfter. A replica that has never synced is not
+// promoted, since it has nothing to serve.
+func (s *Server) watchPrimary(ctx context.Context, rp *replica) {
+	t := s.clock.NewTimer(replHeartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C():
+			t.Reset(replHeartbeat)
+			rp.mu.Lock()
+			silent := now.Sub(rp.lastContact)
+			synced := !rp.caughtUp.IsZero()
+			rp.mu.Unlock()
+			if synced && silent >= rp.promoteAfter {
+				// promote waits for followPrimary, which does not wait
+				// for this goroutine.
+				go s.promote("primary not heard from for " + silent.Round(time.Second).String())
+				return
+			}
+		}
+	}
+}
+
+// POST
+//
+// promoteHandler promotes this replica to a primary, so that it takes
+// over from a primary that failed or is being retired. The mutations it
+// had not received by then are not recovered, so the response says how
+// far behind it was.
+func (s *Server) promoteHandler(w http.ResponseWriter, r *http.Request) {
+	p := s.promote("promoted with POST /admin/promote")
+	if p == nil {
+		writeError(w, r, http.StatusConflict, codeConflict, "This node is not a replica")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "promoted", "promotion": p})
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// workerInterval is how often the background worker records a snapshot
+// by default, and how often it sweeps expired entries.
+const workerInterval = 5 * time.Second
+
+// Formats the background worker can report each snapshot in
+// (Config.WorkerLog): a line of text or a JSON object through the logger,
+// or not at all.
+const (
+	workerLogText = "text"
+	workerLogJSON = "json"
+	workerLogNone = "none"
+)
+
+// defaultStatsRetention is how far back /stats/history can look.
+const defaultStatsRetention = 24 * time.Hour
+
+type statsSnapshot struct {
+	Time          time.Time      `json:"time"`
+	TotalRequests int            `json:"total_requests"`
+	DataSize      int            `json:"data_size"`
+	MethodCount   map[string]int `json:"method_count"`
+	Errors        int            `json:"errors"`
+	Panics        int            `json:"panics"`
+	Evictions     int            `json:"evictions"`
+	Writes        int            `json:"writes"`
+	Deletes       int            `json:"deletes"`
+}
+
+// snapshotLocked captures the current counters. s.mu must be held.
+func (s *Server) snapshotLocked() statsSnapshot {
+	methods := make(map[string]int, len(s.methodCount))
+	for m, n := range s.methodCount {
+		methods[m] = n
+	}
+	return statsSnapshot{
+		Time:          s.clock.Now().UTC(),
+		TotalRequests: s.totalRequests,
+		DataSize:      s.store.Len(),
+		MethodCount:   methods,
+		Errors:        s.errorCount,
+		Panics:        s.panicCount,
+		Evictions:     s.evictionCount(),
+		Writes:        int(s.writeCount.Load()),
+		Deletes:       int(s.deleteCount.Load()),
+	}
+}
+
+// runtimeStats are the process figures in /stats. Byte counts are in bytes
+// and pauses in nanoseconds.
+type runtimeStats struct {
+	HeapInUse    uint64 `json:"heap_in_use"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	TotalAlloc   uint64 `json:"total_alloc"`
+	Sys          uint64 `json:"sys"`
+	NumGC        uint32 `json:"num_gc"`
+	GCPauseTotal uint64 `json:"gc_pause_total_ns"`
+	GCPauseLast  uint64 `json:"gc_pause_last_ns"`
+	GCPauseMax   uint64 `json:"gc_pause_max_ns"` // over the last 256 cycles
+	Goroutines   int    `json:"goroutines"`
+	// StoreBytes estimates the memory held by data as the sum of key and
+	// value lengths across all namespaces; the true footprint is higher by
+	// the store's own overhead.
+	StoreBytes int64 `json:"store_bytes"`
+}
+
+func (s *Server) runtimeStats() runtimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	rs := runtimeStats{
+		HeapInUse:    m.HeapInuse,
+		HeapObjects:  m.HeapObjects,
+		TotalAlloc:   m.TotalAlloc,
+		Sys:          m.Sys,
+		NumGC:        m.NumGC,
+		GCPauseTotal: m.PauseTotalNs,
+		Goroutines:   runtime.NumGoroutine(),
+	}
+	if m.NumGC > 0 {
+		rs.GCPauseLast = m.PauseNs[(m.NumGC+255)%256]
+	}
+	for i := uint32(0); i < min(m.NumGC, 256); i++ {
+		rs.GCPauseMax = max(rs.GCPauseMax, m.PauseNs[i])
+	}
+	for _, ns := range s.namespaces.list() {
+		rs.StoreBytes += usageOf(ns.store).Bytes
+	}
+	return rs
+}
+
+// evictionCount returns the number of keys evicted so far.
+func (s *Server) evictionCount() int {
+	if s.evictor == nil {
+		return 0
+	}
+	return s.evictor.evictionCount()
+}
+
+// reportSnapshot writes snap to the log in the configured format.
+func (s *Server) reportSnapshot(snap statsSnapshot) {
+	switch s.cfg.WorkerLog {
+	case workerLogText:
+		s.logger.Printf("[Worker] Requests: %d, Data size: %d, Errors: %d",
+			snap.TotalRequests, snap.DataSize, snap.Errors)
+	case workerLogJSON:
+		b, err := json.Marshal(snap)
+		if err != nil {
+			return
+		}
+		s.logger.Printf("[Worker] %s", b)
+	}
+}
+
+// recordSnapshot appends the current counters to the history ring and
+// works out the rates of change over the last few windows.
+func (s *Server) recordSnapshot() statsSnapshot {
+	s.mu.lock(context.Background())
+	defer s.mu.Unlock()
+	snap := s.snapshotLocked()
+	s.history.add(snap)
+	s.rates = s.history.rates(snap)
+	return snap
+}
+
+// statsRing is a fixed-size ring of snapshots, oldest first. Once full, each
+// new snapshot overwrites the oldest one.
+type statsRing struct {
+	buf   []statsSnapshot
+	start int
+	n     int
+}
+
+func newStatsRing(retention, interval time.Duration) *statsRing {
+	size := 1
+	if interval > 0 {
+		size = int(retention / interval)
+	}
+	if size < 1 {
+		size = 1
+	}
+	return &statsRing{buf: make([]statsSnapshot, size)}
+}
+
+func (r *statsRing) add(snap statsSnapshot) {
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = snap
+		r.n++
+		return
+	}
+	r.buf[r.start] = snap
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// query returns the snapshots taken at or after since, keeping only the last
+// snapshot of each step-sized time bucket. A zero step keeps everything.
+func (r *statsRing) query(since time.Time, step time.Duration) []statsSnapshot {
+	out := []statsSnapshot{}
+	var bucket time.Time
+	for i := 0; i < r.n; i++ {
+		snap := r.buf[(r.start+i)%len(r.buf)]
+		if snap.Time.Before(since) {
+			continue
+		}
+		if step > 0 {
+			b := snap.Time.Truncate(step)
+			if len(out) > 0 && b.Equal(bucket) {
+				out[len(out)-1] = snap
+				continue
+			}
+			bucket = b
+		}
+		out = append(out, snap)
+	}
+	return out
+}
+
+// POST
+func (s *Server) statsResetHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.lock(r.Context())
+	s.totalRequests = 0
+	s.methodCount = make(map[string]int)
+	s.errorCount = 0
+	s.panicCount = 0
+	s.writeCount.Store(0)
+	s.deleteCount.Store(0)
+	s.mu.Unlock()
+	s.clients.reset()
+	s.hotKeys.reset()
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "reset"})
+}
+
+// GET
+//
+// statsHistoryHandler returns recorded snapshots. ?window=24h limits how far
+// back to look and ?step=5m downsamples to one snapshot per step.
+func (s *Server) statsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	var step time.Duration
+	q := r.URL.Query()
+	if v := q.Get("window"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid window")
+			return
+		}
+		since = s.clock.Now().Add(-window)
+	}
+	if v := q.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid step")
+			return
+		}
+		step = d
+	}
+
+	s.mu.lock(r.Context())
+	history := s.history.query(since, step)
+	s.mu.Unlock()
+
+	json.NewEncoder(w).Encode(history)
+}
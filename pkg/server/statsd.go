@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// statsdPacketSize keeps packets under a typical Ethernet MTU once IP
+	// and UDP headers are added.
+	statsdPacketSize = 1432
+	// statsdMaxSamples bounds the request timings kept per method between
+	// two pushes; beyond it they are sampled.
+	statsdMaxSamples = 1000
+)
+
+// timerSamples is a reservoir of the durations seen since the last push.
+type timerSamples struct {
+	seen    int
+	samples []float64 // milliseconds
+}
+
+func (t *timerSamples) add(ms float64) {
+	t.seen++
+	if len(t.samples) < statsdMaxSamples {
+		t.samples = append(t.samples, ms)
+	} else if i := rand.Intn(t.seen); i < statsdMaxSamples {
+		t.samples[i] = ms
+	}
+}
+
+// statsdExporter pushes the server's counters, gauges and request timings
+// to a StatsD daemon over UDP every Config.StatsDInterval. Counters are
+// sent as the change since the previous push.
+type statsdExporter struct {
+	conn   net.Conn
+	prefix string
+
+	mu     sync.Mutex
+	timers map[string]*timerSamples // by method
+
+	last map[string]int64 // counter values at the previous push; push only
+}
+
+func newStatsDExporter(addr, prefix string) (*statsdExporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdExporter{
+		conn:   conn,
+		prefix: prefix,
+		timers: make(map[string]*timerSamples),
+		last:   make(map[string]int64),
+	}, nil
+}
+
+// timing records how long a request took.
+func (e *statsdExporter) timing(method string, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	t := e.timers[method]
+	if t == nil {
+		t = &timerSamples{}
+		e.timers[method] = t
+	}
+	t.add(ms)
+}
+
+// statsdBatch packs metric lines into packets.
+type statsdBatch struct {
+	e       *statsdExporter
+	buf     bytes.Buffer
+	packets [][]byte
+}
+
+func (b *statsdBatch) add(format string, args ...interface{}) {
+	line := b.e.prefix + fmt.Sprintf(format, args...)
+	if b.buf.Len() > 0 && b.buf.Len()+1+len(line) > statsdPacketSize {
+		b.flush()
+	}
+	if b.buf.Len() > 0 {
+		b.buf.WriteByte('\n')
+	}
+	b.buf.WriteString(line)
+}
+
+func (b *statsdBatch) flush() {
+	if b.buf.Len() > 0 {
+		b.packets = append(b.packets, append([]byte(nil), b.buf.Bytes()...))
+		b.buf.Reset()
+	}
+}
+
+// counter adds the change in a counter since the last push.
+func (b *statsdBatch) counter(name string, v int64) {
+	prev, seen := b.e.last[name]
+	b.e.last[name] = v
+	d := v - prev
+	if v < prev {
+		d = v // reset by POST /stats/reset
+	}
+	if d != 0 || !seen {
+		b.add("%s:%d|c", name, d)
+	}
+}
+
+func (b *statsdBatch) gauge(name string, v int64) {
+	b.add("%s:%d|g", name, v)
+}
+
+// pushStatsD sends one round of metrics. It is run by the "statsd" job.
+func (s *Server) pushStatsD() error {
+	e := s.statsd
+	b := &statsdBatch{e: e}
+
+	s.mu.lock(context.Background())
+	snap := s.snapshotLocked()
+	s.mu.Unlock()
+	rt := s.runtimeStats()
+
+	b.counter("requests", int64(snap.TotalRequests))
+	b.counter("errors", int64(snap.Errors))
+	b.counter("panics", int64(snap.Panics))
+	b.counter("evictions", int64(snap.Evictions))
+	b.counter("writes", int64(snap.Writes))
+	b.counter("deletes", int64(snap.Deletes))
+	methods := make([]string, 0, len(snap.MethodCount))
+	for m := range snap.MethodCount {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		b.counter("requests."+m, int64(snap.MethodCount[m]))
+	}
+
+	b.gauge("keys", int64(snap.DataSize))
+	b.gauge("in_flight", s.inFlight.Load())
+	b.gauge("store_bytes", rt.StoreBytes)
+	b.gauge("heap_in_use", int64(rt.HeapInUse))
+	b.gauge("goroutines", int64(rt.Goroutines))
+
+	e.mu.Lock()
+	timers := e.timers
+	e.timers = make(map[string]*timerSamples)
+	e.mu.Unlock()
+	methods = methods[:0]
+	for m := range timers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		t := timers[m]
+		rate := ""
+		if t.seen > len(t.samples) {
+			rate = "|@" + strconv.FormatFloat(float64(len(t.samples))/float64(t.seen), 'f', 4, 64)
+		}
+		for _, ms := range t.samples {
+			b.add("request_time.%s:%s|ms%s", m, strconv.FormatFloat(ms, 'f', 3, 64), rate)
+		}
+	}
+	b.flush()
+
+	for _, p := range b.packets {
+		if _, err := e.conn.Write(p); err != nil {
+			return fmt.Errorf("statsd: %w", err)
+		}
+	}
+	return nil
+}
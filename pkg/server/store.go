@@ -0,0 +1,632 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store is the storage backend used by the server.
+type Store interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
+	Delete(key string) error
+	All() map[string]string
+	Len() int
+	// Snapshot returns a consistent point-in-time copy of the store.
+	Snapshot() *Snapshot
+}
+
+// Event describes a single mutation of the store.
+type Event struct {
+	Type     string    `json:"type"` // "set" or "delete"; to watchers, "expired" for expired keys
+	Key      string    `json:"key"`
+	Value    string    `json:"value,omitempty"`
+	Created  bool      `json:"created,omitempty"` // set of a previously absent key
+	Revision uint64    `json:"revision"`
+	Time     time.Time `json:"time"`
+	// Expired marks the delete of a key whose time was up. Listeners see
+	// it as a delete; watchers get it with Type "expired".
+	Expired bool `json:"-"`
+}
+
+// changeNotifier is implemented by stores that can report their mutations.
+// fn is called synchronously for every change, in revision order for any
+// given key, and must not call back into the store.
+type changeNotifier interface {
+	OnChange(fn func(Event))
+}
+
+// shardCount is the number of independently locked partitions in a
+// memoryStore. Must be a power of two.
+const shardCount = 32
+
+// keyRevisioner is implemented by stores that track the revision at which
+// each key was last modified.
+type keyRevisioner interface {
+	Revision(key string) (uint64, error)
+}
+
+// revisionCounter is implemented by stores that number their writes: it
+// returns the revision of the latest, the version of the whole dataset.
+type revisionCounter interface {
+	LastRevision() uint64
+}
+
+// contextGetter is implemented by stores whose reads can block, such as
+// ones backed by a disk or the network, so that a read gives up once the
+// request is cancelled or times out.
+type contextGetter interface {
+	GetContext(ctx context.Context, key string) (string, error)
+}
+
+// getValue reads key from store on behalf of a request, failing with the
+// context's error if it is already done.
+func getValue(ctx context.Context, store Store, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	defer storeTimer(ctx)()
+	return forwardGet(ctx, store, key)
+}
+
+// forwardGet reads key from the store a wrapper wraps, passing ctx on if
+// it is a contextGetter. Unlike getValue it does not time the read, which
+// the outermost store's getValue already does.
+func forwardGet(ctx context.Context, store Store, key string) (string, error) {
+	if cg, ok := store.(contextGetter); ok {
+		return cg.GetContext(ctx, key)
+	}
+	return store.Get(key)
+}
+
+// keyCreator is implemented by stores that can set a key only if it is
+// absent, as one atomic step.
+type keyCreator interface {
+	Create(key, value string) error
+}
+
+// createValue sets key in store unless it already exists, failing with
+// ErrKeyExists if it does. Stores that are not keyCreators fall back to a
+// check followed by a set, which a concurrent write can slip between.
+func createValue(store Store, key, value string) error {
+	if c, ok := store.(keyCreator); ok {
+		return c.Create(key, value)
+	}
+	if _, ok := peekValue(store, key); ok {
+		return &KeyError{Op: "create", Key: key, Err: ErrKeyExists}
+	}
+	return store.Set(key, value)
+}
+
+// valueSwapper is implemented by stores that can replace or remove a
+// value and return the previous one as one atomic step.
+type valueSwapper interface {
+	// Swap sets key and returns the value it replaced, if any.
+	Swap(key, value string) (old string, existed bool, err error)
+	// Take deletes key and returns its value.
+	Take(key string) (string, error)
+}
+
+// swapValue sets key in store and returns the value it replaced. Stores
+// that are not valueSwappers fall back to a read followed by a set.
+func swapValue(store Store, key, value string) (string, bool, error) {
+	if sw, ok := store.(valueSwapper); ok {
+		return sw.Swap(key, value)
+	}
+	old, existed := peekValue(store, key)
+	return old, existed, store.Set(key, value)
+}
+
+// takeValue deletes key from store and returns its value, with the same
+// fallback as swapValue.
+func takeValue(store Store, key string) (string, error) {
+	if sw, ok := store.(valueSwapper); ok {
+		return sw.Take(key)
+	}
+	old, ok := peekValue(store, key)
+	if !ok {
+		return "", &KeyError{Op: "delete", Key: key, Err: ErrKeyNotFound}
+	}
+	return old, store.Delete(key)
+}
+
+// revisionTaker is implemented by stores that can delete a key only if
+// it was not written since a revision, as one atomic step.
+type revisionTaker interface {
+	// TakeAt deletes key and returns its value if it was last written at
+	// rev, and fails with ErrConflict if it was not.
+	TakeAt(key string, rev uint64) (string, error)
+}
+
+// takeValueAt deletes key from store if it was last written at rev and
+// returns its value. Stores that are not revisionTakers fall back to
+// comparing the revision before taking the value.
+func takeValueAt(store Store, key string, rev uint64) (string, error) {
+	if rt, ok := store.(revisionTaker); ok {
+		return rt.TakeAt(key, rev)
+	}
+	if _, ok := peekValue(store, key); !ok {
+		return "", &KeyError{Op: "delete", Key: key, Err: ErrKeyNotFound}
+	}
+	if revisionOf(store, key) != rev {
+		return "", &KeyError{Op: "delete", Key: key, Err: ErrConflict}
+	}
+	return takeValue(store, key)
+}
+
+// prefixClearer is implemented by stores that can remove every key with a
+// prefix in one atomic step.
+type prefixClearer interface {
+	// ClearPrefix removes the keys starting with prefix, every key for
+	// "", and returns them with their values.
+	ClearPrefix(prefix string) (map[string]string, error)
+}
+
+// clearPrefix removes the keys starting with prefix from store and returns
+// them with their values. Stores without ClearPrefix have the keys deleted
+// one at a time, so concurrent readers may see a partly cleared store.
+func clearPrefix(store Store, prefix string) (map[string]string, error) {
+	if pc, ok := store.(prefixClearer); ok {
+		return pc.ClearPrefix(prefix)
+	}
+	removed := make(map[string]string)
+	for _, k := range store.Snapshot().Between(prefix, prefixEnd(prefix)) {
+		v, err := takeValue(store, k)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed[k] = v
+	}
+	return removed, nil
+}
+
+// KeyMeta is the bookkeeping kept for a key.
+type KeyMeta struct {
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Revision  uint64    `json:"revision"`
+	Reads     uint64    `json:"reads"`
+	LastRead  time.Time `json:"last_read,omitzero"`
+	Size      int       `json:"size"`
+}
+
+// valuePeeker is implemented by stores that can read a value without
+// counting it as an access.
+type valuePeeker interface {
+	Peek(key string) (string, error)
+}
+
+// peekValue reads key from store, without touching its access statistics
+// where the store supports that.
+func peekValue(store Store, key string) (string, bool) {
+	var v string
+	var err error
+	if p, ok := store.(valuePeeker); ok {
+		v, err = p.Peek(key)
+	} else {
+		v, err = store.Get(key)
+	}
+	return v, err == nil
+}
+
+// metadataProvider is implemented by stores that track KeyMeta.
+type metadataProvider interface {
+	Metadata(key string) (KeyMeta, error)
+}
+
+// memEntry is a stored value together with its bookkeeping.
+type memEntry struct {
+	value   string
+	packed  bool   // value is compressed by the store's codec
+	size    int    // length of the value as written
+	sum     uint32 // checksum of value, as stored
+	rev     uint64 // revision of the last write
+	created time.Time
+	updated time.Time
+	access  *accessStats // shared across overwrites of the key
+	shared  *sharedValue // the pooled value, with deduplication
+}
+
+// accessStats counts reads of a key. It is updated under the shard's read
+// lock, hence the atomics.
+type accessStats struct {
+	reads    atomic.Uint64
+	lastRead atomic.Int64 // UnixNano, 0 if never read
+}
+
+type shard struct {
+	mu   sync.RWMutex
+	data map[string]memEntry
+}
+
+// memoryStore spreads keys over shardCount maps so that operations on
+// different keys rarely contend on the same lock.
+//
+// Full reads are served from a cached Snapshot which is only rebuilt once a
+// write has happened since it was taken, so repeated GET /data calls neither
+// copy the map nor block writers while the response is encoded.
+type memoryStore struct {
+	shards [shardCount]shard
+
+	// gen is bumped under the shard lock on every mutation and doubles as
+	// the store's revision number.
+	gen     atomic.Uint64
+	snapMu  sync.Mutex
+	snap    *Snapshot
+	snapGen uint64
+
+	onChange func(Event)
+
+	// codec, if set, compresses large values, and dedup, if set, stores
+	// identical ones once. They must be set before the store is used.
+	codec *valueCodec
+	dedup *dedupPool
+}
+
+// NewMemoryStore returns the default in-memory Store.
+func NewMemoryStore() Store {
+	return newMemoryStore()
+}
+
+func newMemoryStore() *memoryStore {
+	m := &memoryStore{}
+	for i := range m.shards {
+		m.shards[i].data = make(map[string]memEntry)
+	}
+	return m
+}
+
+func (m *memoryStore) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &m.shards[h.Sum32()&(shardCount-1)]
+}
+
+// valueOf returns the value held in e, failing if it is compressed and
+// cannot be expanded.
+func (m *memoryStore) valueOf(e memEntry) (string, error) {
+	if e.packed {
+		return m.codec.decode(e.value)
+	}
+	return e.value, nil
+}
+
+// oldValueOf is valueOf for an entry just overwritten or removed, whose
+// value is only reported: one that cannot be expanded is reported empty,
+// since the write that replaced it has been made either way.
+func (m *memoryStore) oldValueOf(e memEntry) string {
+	v, _ := m.valueOf(e)
+	return v
+}
+
+// readEntry returns the value held in e after checking it against its
+// checksum.
+func (m *memoryStore) readEntry(key string, e memEntry) (string, error) {
+	if checksum(e.value) != e.sum {
+		return "", &KeyError{Op: "get", Key: key, Err: ErrCorrupted}
+	}
+	v, err := m.valueOf(e)
+	if err != nil {
+		return "", &KeyError{Op: "get", Key: key, Err: err}
+	}
+	return v, nil
+}
+
+func (m *memoryStore) Get(key string) (string, error) {
+	sh := m.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e, ok := sh.data[key]
+	if !ok {
+		return "", &KeyError{Op: "get", Key: key, Err: ErrKeyNotFound}
+	}
+	e.access.reads.Add(1)
+	e.access.lastRead.Store(time.Now().UnixNano())
+	return m.readEntry(key, e)
+}
+
+// Peek returns the value of key without counting a read.
+func (m *memoryStore) Peek(key string) (string, error) {
+	sh := m.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e, ok := sh.data[key]
+	if !ok {
+		return "", &KeyError{Op: "get", Key: key, Err: ErrKeyNotFound}
+	}
+	return m.readEntry(key, e)
+}
+
+// Metadata returns the bookkeeping of key without counting it as a read.
+func (m *memoryStore) Metadata(key string) (KeyMeta, error) {
+	sh := m.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e, ok := sh.data[key]
+	if !ok {
+		return KeyMeta{}, &KeyError{Op: "metadata", Key: key, Err: ErrKeyNotFound}
+	}
+	meta := KeyMeta{
+		CreatedAt: e.created,
+		UpdatedAt: e.updated,
+		Revision:  e.rev,
+		Reads:     e.access.reads.Load(),
+		Size:      e.size,
+	}
+	if ns := e.access.lastRead.Load(); ns != 0 {
+		meta.LastRead = time.Unix(0, ns).UTC()
+	}
+	return meta, nil
+}
+
+// LastRevision returns the revision of the latest write.
+func (m *memoryStore) LastRevision() uint64 { return m.gen.Load() }
+
+// Revision returns the revision at which key was last written.
+func (m *memoryStore) Revision(key string) (uint64, error) {
+	sh := m.shardFor(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e, ok := sh.data[key]
+	if !ok {
+		return 0, &KeyError{Op: "revision", Key: key, Err: ErrKeyNotFound}
+	}
+	return e.rev, nil
+}
+
+// OnChange registers fn to be called after every mutation. It must be set
+// before the store is used concurrently.
+func (m *memoryStore) OnChange(fn func(Event)) {
+	m.onChange = fn
+}
+
+// notify reports a mutation. The shard lock must be held so that events
+// for the same key are delivered in order.
+func (m *memoryStore) notify(ev Event) {
+	if m.onChange != nil {
+		ev.Time = time.Now().UTC()
+		m.onChange(ev)
+	}
+}
+
+func (m *memoryStore) Set(key, value string) error {
+	_, _, err := m.set(key, value, false)
+	return err
+}
+
+// Create sets key only if it is absent.
+func (m *memoryStore) Create(key, value string) error {
+	_, _, err := m.set(key, value, true)
+	return err
+}
+
+// Swap sets key and returns the value it replaced.
+func (m *memoryStore) Swap(key, value string) (string, bool, error) {
+	old, existed, err := m.set(key, value, false)
+	if !existed || err != nil {
+		return "", existed, err
+	}
+	return m.oldValueOf(old), true, nil
+}
+
+// set writes key and returns the entry it replaced.
+func (m *memoryStore) set(key, value string, create bool) (memEntry, bool, error) {
+	// Compress and checksum before taking the lock; they are the slow
+	// part.
+	var stored string
+	var packed bool
+	var sum uint32
+	shared := m.dedup.intern(value, m.codec)
+	if shared != nil {
+		stored, packed, sum = shared.stored, shared.packed, shared.sum
+	} else {
+		stored, packed = m.codec.encode(value)
+		sum = checksum(stored)
+	}
+	sh := m.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old, existed := sh.data[key]
+	if existed && create {
+		m.dedup.release(shared)
+		return memEntry{}, true, &KeyError{Op: "create", Key: key, Err: ErrKeyExists}
+	}
+	rev := m.gen.Add(1)
+	now := time.Now().UTC()
+	e := memEntry{value: stored, packed: packed, size: len(value), sum: sum, rev: rev, created: now, updated: now, access: old.access, shared: shared}
+	if existed {
+		e.created = old.created
+		m.dedup.release(old.shared)
+	} else {
+		e.access = new(accessStats)
+	}
+	sh.data[key] = e
+	m.notify(Event{Type: "set", Key: key, Value: value, Created: !existed, Revision: rev})
+	return old, existed, nil
+}
+
+func (m *memoryStore) Delete(key string) error {
+	_, err := m.Take(key)
+	return err
+}
+
+// Take deletes key and returns its value.
+func (m *memoryStore) Take(key string) (string, error) {
+	sh := m.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old, ok := sh.data[key]
+	if !ok {
+		return "", &KeyError{Op: "delete", Key: key, Err: ErrKeyNotFound}
+	}
+	delete(sh.data, key)
+	m.dedup.release(old.shared)
+	m.notify(Event{Type: "delete", Key: key, Revision: m.gen.Add(1)})
+	return m.oldValueOf(old), nil
+}
+
+// TakeAt deletes key and returns its value if it was last written at rev.
+func (m *memoryStore) TakeAt(key string, rev uint64) (string, error) {
+	sh := m.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old, ok := sh.data[key]
+	if !ok {
+		return "", &KeyError{Op: "delete", Key: key, Err: ErrKeyNotFound}
+	}
+	if old.rev != rev {
+		return "", &KeyError{Op: "delete", Key: key, Err: ErrConflict}
+	}
+	delete(sh.data, key)
+	m.dedup.release(old.shared)
+	m.notify(Event{Type: "delete", Key: key, Revision: m.gen.Add(1)})
+	return m.oldValueOf(old), nil
+}
+
+// ClearPrefix removes the keys starting with prefix with every shard
+// locked, so no reader sees the store partly cleared.
+func (m *memoryStore) ClearPrefix(prefix string) (map[string]string, error) {
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+	}
+	defer func() {
+		for i := range m.shards {
+			m.shards[i].mu.Unlock()
+		}
+	}()
+	removed := make(map[string]string)
+	for i := range m.shards {
+		sh := &m.shards[i]
+		for k, e := range sh.data {
+			if strings.HasPrefix(k, prefix) {
+				delete(sh.data, k)
+				m.dedup.release(e.shared)
+				removed[k] = m.oldValueOf(e)
+				m.notify(Event{Type: "delete", Key: k, Revision: m.gen.Add(1)})
+			}
+		}
+	}
+	return removed, nil
+}
+
+// Verify checks every value against its checksum and returns the number
+// checked and the keys that failed. Shards are locked one at a time, so
+// writes to the rest of the store carry on during the scan.
+func (m *memoryStore) Verify() (checked int, corrupt []string) {
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		for k, e := range sh.data {
+			if checksum(e.value) != e.sum {
+				corrupt = append(corrupt, k)
+			}
+		}
+		checked += len(sh.data)
+		sh.mu.RUnlock()
+	}
+	sort.Strings(corrupt)
+	return checked, corrupt
+}
+
+// rlockAll read-locks every shard in index order, giving callers a
+// consistent view across the whole store.
+func (m *memoryStore) rlockAll() {
+	for i := range m.shards {
+		m.shards[i].mu.RLock()
+	}
+}
+
+func (m *memoryStore) runlockAll() {
+	for i := range m.shards {
+		m.shards[i].mu.RUnlock()
+	}
+}
+
+// All returns a copy of the stored data, leaving out compressed values
+// corrupted in memory, which Get and Snapshot report.
+func (m *memoryStore) All() map[string]string {
+	m.rlockAll()
+	defer m.runlockAll()
+	out, packed, _ := m.copyLocked()
+	for k := range packed {
+		v, err := m.codec.decode(out[k])
+		if err != nil {
+			delete(out, k)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// copyLocked copies every shard into one map, leaving compressed values,
+// whose keys it returns in packed, as they are. Compressed values that
+// fail their checksum, and so could not be expanded, are left out and
+// their keys returned in corrupt. All shards must be read-locked.
+func (m *memoryStore) copyLocked() (out map[string]string, packed map[string]bool, corrupt []string) {
+	n := 0
+	for i := range m.shards {
+		n += len(m.shards[i].data)
+	}
+	out = make(map[string]string, n)
+	for i := range m.shards {
+		for k, e := range m.shards[i].data {
+			if e.packed && checksum(e.value) != e.sum {
+				corrupt = append(corrupt, k)
+				continue
+			}
+			out[k] = e.value
+			if e.packed {
+				if packed == nil {
+					packed = make(map[string]bool)
+				}
+				packed[k] = true
+			}
+		}
+	}
+	sort.Strings(corrupt)
+	return out, packed, corrupt
+}
+
+func (m *memoryStore) Len() int {
+	n := 0
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.RLock()
+		n += len(sh.data)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+func (m *memoryStore) Snapshot() *Snapshot {
+	m.snapMu.Lock()
+	defer m.snapMu.Unlock()
+	if m.snap != nil && m.snapGen == m.gen.Load() {
+		return m.snap
+	}
+
+	m.rlockAll()
+	gen := m.gen.Load()
+	data, packed, corrupt := m.copyLocked()
+	m.runlockAll()
+
+	m.snap = NewSnapshot(data)
+	m.snap.corrupt = corrupt
+	if packed != nil {
+		// Values stay compressed in the snapshot and are expanded as
+		// they are read, so a snapshot costs no more memory than usual.
+		m.snap.packed, m.snap.codec = packed, m.codec
+	}
+	m.snapGen = gen
+	return m.snap
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// benchKeys is how many distinct keys the store benchmarks spread their
+// operations over.
+const benchKeys = 10000
+
+// benchStore is the part of a Store the benchmarks exercise.
+type benchStore interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
+}
+
+// mutexStore is the baseline the sharded memoryStore is measured against:
+// the store it replaced, one map behind one sync.Mutex, without the
+// checksums and access statistics of memoryStore. The gap between them at
+// -cpu 1 is that bookkeeping, and how it changes as -cpu grows is the lock
+// contention sharding saves.
+type mutexStore struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func (m *mutexStore) Get(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.data[key]
+	if !ok {
+		return "", &KeyError{Op: "get", Key: key, Err: ErrKeyNotFound}
+	}
+	return v, nil
+}
+
+func (m *mutexStore) Set(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = value
+	return nil
+}
+
+// benchKeyNames are built once so that the benchmarks do not measure
+// strconv.
+var benchKeyNames = func() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	return keys
+}()
+
+// runStoreBench runs op in parallel against a memoryStore and a
+// mutexStore, each filled with benchKeys keys, every goroutine walking the
+// keys from its own starting point. n counts the goroutine's operations.
+func runStoreBench(b *testing.B, op func(st benchStore, key string, n int)) {
+	stores := []struct {
+		name string
+		st   benchStore
+	}{
+		{"sharded", newMemoryStore()},
+		{"single-mutex", &mutexStore{data: make(map[string]string)}},
+	}
+	for _, tc := range stores {
+		for _, k := range benchKeyNames {
+			tc.st.Set(k, "value")
+		}
+		b.Run(tc.name, func(b *testing.B) {
+			var seed atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				start := int(seed.Add(7919))
+				for n := 0; pb.Next(); n++ {
+					op(tc.st, benchKeyNames[(start+n)%benchKeys], n)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStoreGetParallel(b *testing.B) {
+	runStoreBench(b, func(st benchStore, key string, _ int) {
+		st.Get(key)
+	})
+}
+
+func BenchmarkStoreSetParallel(b *testing.B) {
+	runStoreBench(b, func(st benchStore, key string, _ int) {
+		st.Set(key, "value")
+	})
+}
+
+// BenchmarkStoreMixedParallel does one Set for every nine Gets.
+func BenchmarkStoreMixedParallel(b *testing.B) {
+	runStoreBench(b, func(st benchStore, key string, n int) {
+		if n%10 == 0 {
+			st.Set(key, "value")
+		} else {
+			st.Get(key)
+		}
+	})
+}
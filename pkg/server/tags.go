@@ -0,0 +1,356 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// tagsHeader carries the tags of a key: sent on a write to tag the keys it
+// sets, and returned on reads of a tagged key. A write without it keeps
+// the key's tags; an empty one clears them.
+const tagsHeader = "X-Key-Tags"
+
+var tagNameRE = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// TagPolicy is what a tag on a key entails.
+type TagPolicy struct {
+	// Scope, if set, must be held by the API key of a client reading or
+	// writing a key with the tag; other clients get 403 for it and do
+	// not see it in listings.
+	Scope string
+	// NoExport leaves keys with the tag out of /export.
+	NoExport bool
+	// Mask records writes to keys with the tag in the audit log without
+	// the hashes of their values.
+	Mask bool
+}
+
+// TagPolicies maps tags to their policies. It implements flag.Value,
+// parsing repeated "tag=rule,rule" arguments where the rules are
+// scope:NAME, no-export and mask, e.g. "sensitive=scope:secrets,no-export,mask".
+type TagPolicies map[string]TagPolicy
+
+func (f *TagPolicies) String() string {
+	parts := make([]string, 0, len(*f))
+	for tag, p := range *f {
+		var rules []string
+		if p.Scope != "" {
+			rules = append(rules, "scope:"+p.Scope)
+		}
+		if p.NoExport {
+			rules = append(rules, "no-export")
+		}
+		if p.Mask {
+			rules = append(rules, "mask")
+		}
+		parts = append(parts, tag+"="+strings.Join(rules, ","))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ";")
+}
+
+func (f *TagPolicies) Set(v string) error {
+	tag, rules, ok := strings.Cut(v, "=")
+	if !ok || !tagNameRE.MatchString(tag) || rules == "" {
+		return fmt.Errorf("tag policy %q must be in tag=rule,rule form", v)
+	}
+	var p TagPolicy
+	for _, rule := range strings.Split(rules, ",") {
+		switch rule = strings.TrimSpace(rule); {
+		case rule == "no-export":
+			p.NoExport = true
+		case rule == "mask":
+			p.Mask = true
+		case strings.HasPrefix(rule, "scope:") && len(rule) > len("scope:"):
+			p.Scope = strings.TrimPrefix(rule, "scope:")
+		default:
+			return fmt.Errorf("tag policy %q: unknown rule %q (want scope:NAME, no-export or mask)", v, rule)
+		}
+	}
+	if *f == nil {
+		*f = make(TagPolicies)
+	}
+	(*f)[tag] = p
+	return nil
+}
+
+// scoped reports whether any policy requires a scope.
+func (f TagPolicies) scoped() bool {
+	for _, p := range f {
+		if p.Scope != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyScopes maps API key names to the scopes they hold. It implements
+// flag.Value, parsing repeated "name=scope,scope" arguments.
+type APIKeyScopes map[string][]string
+
+func (f *APIKeyScopes) String() string {
+	parts := make([]string, 0, len(*f))
+	for name, scopes := range *f {
+		parts = append(parts, name+"="+strings.Join(scopes, ","))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ";")
+}
+
+func (f *APIKeyScopes) Set(v string) error {
+	name, scopes, ok := strings.Cut(v, "=")
+	if !ok || name == "" || scopes == "" {
+		return fmt.Errorf("api key scopes %q must be in name=scope,scope form", v)
+	}
+	if *f == nil {
+		*f = make(APIKeyScopes)
+	}
+	(*f)[name] = append((*f)[name], splitNames(scopes)...)
+	return nil
+}
+
+// keyTags holds the tags of the keys of a namespace. They are kept in
+// memory beside the store, and saved with the keys in data files, the
+// write-ahead log and backups.
+type keyTags struct {
+	mu    sync.RWMutex
+	byKey map[string][]string
+}
+
+func newKeyTags() *keyTags {
+	return &keyTags{byKey: make(map[string][]string)}
+}
+
+func (kt *keyTags) get(key string) []string {
+	kt.mu.RLock()
+	defer kt.mu.RUnlock()
+	return kt.byKey[key]
+}
+
+// set replaces the tags of key, forgetting them when tags is empty.
+func (kt *keyTags) set(key string, tags []string) {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	if len(tags) == 0 {
+		delete(kt.byKey, key)
+	} else {
+		kt.byKey[key] = tags
+	}
+}
+
+// copy returns the tags of every tagged key.
+func (kt *keyTags) copy() map[string][]string {
+	kt.mu.RLock()
+	defer kt.mu.RUnlock()
+	out := make(map[string][]string, len(kt.byKey))
+	for k, t := range kt.byKey {
+		out[k] = t
+	}
+	return out
+}
+
+// forget is a watchHub listener that drops the tags of deleted keys.
+func (kt *keyTags) forget(ev Event) {
+	if ev.Type == "delete" {
+		kt.set(ev.Key, nil)
+	}
+}
+
+// parseTags parses an X-Key-Tags header: a comma-separated list of tag
+// names, returned sorted and without duplicates.
+func parseTags(v string) ([]string, error) {
+	var tags []string
+	for _, tag := range splitNames(v) {
+		if !tagNameRE.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return slices.Compact(tags), nil
+}
+
+// splitNames splits a comma-separated list of names.
+func splitNames(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+}
+
+// withTags returns a copy of ctx under which applySet gives the key it
+// writes tags, replacing its current ones.
+func withTags(ctx context.Context, tags []string) context.Context {
+	return context.WithValue(ctx, tagsKey, tags)
+}
+
+// tagsFrom returns the tags of a write, and false if it leaves the key's
+// tags as they are.
+func tagsFrom(ctx context.Context) ([]string, bool) {
+	tags, ok := ctx.Value(tagsKey).([]string)
+	return tags, ok
+}
+
+// writeTags returns the tags key has once the write ctx belongs to is
+// applied.
+func writeTags(ctx context.Context, ns *namespace, key string) []string {
+	if tags, ok := tagsFrom(ctx); ok {
+		return tags
+	}
+	return ns.tags.get(key)
+}
+
+func withMaskedAudit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, maskAuditKey, true)
+}
+
+func maskedAudit(ctx context.Context) bool {
+	masked, _ := ctx.Value(maskAuditKey).(bool)
+	return masked
+}
+
+// hasScope reports whether the client of ctx holds scope, by APIKeyScopes
+// or from the auth provider.
+func (s *Server) hasScope(ctx context.Context, scope string) bool {
+	return slices.Contains(s.cfg.APIKeyScopes[clientIDFrom(ctx)], scope) || slices.Contains(scopesFrom(ctx), scope)
+}
+
+// checkTags returns ErrMissingScope, wrapped in a KeyError for op on key,
+// if a policy of one of tags requires a scope the client of ctx lacks.
+func (s *Server) checkTags(ctx context.Context, op, key string, tags []string) error {
+	for _, tag := range tags {
+		if p := s.cfg.TagPolicies[tag]; p.Scope != "" && !s.hasScope(ctx, p.Scope) {
+			return &KeyError{Op: op, Key: key, Err: fmt.Errorf("%w: tag %s requires scope %s", ErrMissingScope, tag, p.Scope)}
+		}
+	}
+	return nil
+}
+
+// checkKeyTags checks a write to key against the policies of the tags the
+// key has now and of those the write gives it. Writes replayed from a Raft
+// log or a primary were checked where they were made.
+func (s *Server) checkKeyTags(ctx context.Context, op, key string) error {
+	if len(s.cfg.TagPolicies) == 0 || replaying(ctx) {
+		return nil
+	}
+	ns := s.namespaceFrom(ctx)
+	if err := s.checkTags(ctx, op, key, ns.tags.get(key)); err != nil {
+		return err
+	}
+	if tags, ok := tagsFrom(ctx); ok {
+		return s.checkTags(ctx, op, key, tags)
+	}
+	return nil
+}
+
+// masked reports whether writes to a key with tags are audited without
+// value hashes, and requests for it recorded without bodies.
+func (s *Server) masked(tags []string) bool {
+	for _, tag := range tags {
+		if s.cfg.TagPolicies[tag].Mask {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenKeys returns a filter telling which keys of ns the client of ctx
+// may not see in a listing, or with export set in an export as well; nil
+// if it may see them all.
+func (s *Server) hiddenKeys(ctx context.Context, ns *namespace, export bool) func(key string) bool {
+	hidden := make(map[string]bool)
+	for tag, p := range s.cfg.TagPolicies {
+		if (p.Scope != "" && !s.hasScope(ctx, p.Scope)) || (export && p.NoExport) {
+			hidden[tag] = true
+		}
+	}
+	// A client with an issued token sees only the keys under its prefix.
+	grant := grantFrom(ctx)
+	if len(hidden) == 0 && grant == nil {
+		return nil
+	}
+	return func(key string) bool {
+		if grant != nil && !strings.HasPrefix(key, grant.Prefix) {
+			return true
+		}
+		for _, tag := range ns.tags.get(key) {
+			if hidden[tag] {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// visible narrows snap to the keys hide leaves, all of them for a nil
+// hide.
+func visible(snap *Snapshot, hide func(key string) bool) *Snapshot {
+	if hide == nil {
+		return snap
+	}
+	keys := make([]string, 0, len(snap.keys))
+	for _, k := range snap.keys {
+		if !hide(k) {
+			keys = append(keys, k)
+		}
+	}
+	return snap.narrow(keys)
+}
+
+// visibleValues is Snapshot.values for the keys hide leaves.
+func visibleValues(snap *Snapshot, hide func(key string) bool) map[string]string {
+	if hide == nil {
+		return snap.values()
+	}
+	out := make(map[string]string, snap.Len())
+	visible(snap, hide).Range(func(k, v string) bool {
+		out[k] = v
+		return true
+	})
+	return out
+}
+
+// withKeyTags reads the X-Key-Tags of writes into the context for
+// applySet and, on routes naming a key, answers 403 for a key whose tags
+// require a scope the client lacks. Reads of a tagged key return its tags
+// in X-Key-Tags.
+func (s *Server) withKeyTags(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if v, ok := r.Header[tagsHeader]; ok && !read {
+			tags, err := parseTags(strings.Join(v, ","))
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid "+tagsHeader+": "+err.Error())
+				return
+			}
+			ctx = withTags(ctx, tags)
+		}
+		if key := r.PathValue("key"); key != "" {
+			ns := s.namespaceFrom(ctx)
+			op := "get"
+			if !read {
+				op = "set"
+			}
+			err := s.checkTags(ctx, op, key, ns.tags.get(key))
+			if tags, ok := tagsFrom(ctx); ok && err == nil {
+				err = s.checkTags(ctx, op, key, tags)
+			}
+			if err != nil {
+				writeStoreError(w, r, err)
+				return
+			}
+			if written, _ := tagsFrom(ctx); s.sealer.covers(key) || s.masked(ns.tags.get(key)) || s.masked(written) {
+				redactRecording(ctx)
+			}
+			if tags := ns.tags.get(key); read && len(tags) > 0 {
+				w.Header().Set(tagsHeader, strings.Join(tags, ","))
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// untimedPaths stream their response, long-poll or move whole datasets,
+// and are bounded only by the HTTP server's own timeouts. Paths are given
+// without the /v1 and /ns/{namespace} prefixes.
+var untimedPaths = map[string]bool{
+	"/watch":                   true,
+	"/backup":                  true,
+	"/bulk":                    true,
+	"/export":                  true,
+	"/import":                  true,
+	"/clone":                   true,
+	"/replication/stream":      true,
+	"/replication/snapshot":    true,
+	"/audit/export":            true,
+	"/admin/recordings/export": true,
+	"/admin/events":            true,
+	"/admin/backups":           true,
+	"/admin/backups/restore":   true,
+	"/admin/restore":           true,
+	"/admin/compact":           true,
+	"/admin/shadow/compare":    true,
+	"/debug/pprof/profile":     true,
+	"/debug/pprof/trace":       true,
+}
+
+// untimed reports whether r is exempt from the request timeout.
+func untimed(r *http.Request) bool {
+	if r.URL.Query().Get("watch") == "true" || r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	p := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	if rest, ok := strings.CutPrefix(p, "/ns/"); ok {
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			p = rest[i:]
+		}
+	}
+	if p == "/data" && r.Method == http.MethodGet && streamedListing(r) {
+		return true
+	}
+	return untimedPaths[p]
+}
+
+// Headers a client gives its own deadline in: an RFC 3339 time or Unix
+// milliseconds, or a gRPC-style timeout such as "250m", digits followed by
+// H, M, S, m, u or n.
+const (
+	deadlineHeader    = "X-Request-Deadline"
+	grpcTimeoutHeader = "Grpc-Timeout"
+)
+
+// grpcTimeoutUnits are the units of Grpc-Timeout.
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// clientDeadline returns the deadline r asks for in deadlineHeader or
+// grpcTimeoutHeader, if any, and false with a message for one it cannot
+// read.
+func clientDeadline(r *http.Request, now time.Time) (time.Time, string, bool) {
+	if v := r.Header.Get(deadlineHeader); v != "" {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, "", true
+		}
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.UnixMilli(ms), "", true
+		}
+		return time.Time{}, deadlineHeader + " must be an RFC 3339 time or Unix milliseconds", false
+	}
+	if v := r.Header.Get(grpcTimeoutHeader); v != "" {
+		unit, ok := grpcTimeoutUnits[v[len(v)-1]]
+		n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if !ok || err != nil || n < 0 || len(v) > 9 {
+			return time.Time{}, grpcTimeoutHeader + " must be up to 8 digits followed by H, M, S, m, u or n", false
+		}
+		return now.Add(time.Duration(n) * unit), "", true
+	}
+	return time.Time{}, "", true
+}
+
+// deadlineStats counts requests that ran out of time, separating those
+// cut short by the client's own deadline from server timeouts.
+type deadlineStats struct {
+	withDeadline atomic.Int64 // requests giving a deadline
+	exceeded     atomic.Int64 // cut short by it, or arriving past it
+	timedOut     atomic.Int64 // cut short by the request timeout
+}
+
+func (ds *deadlineStats) stats() map[string]int64 {
+	return map[string]int64{
+		"with_deadline":     ds.withDeadline.Load(),
+		"deadline_exceeded": ds.exceeded.Load(),
+		"timed_out":         ds.timedOut.Load(),
+	}
+}
+
+// withTimeout bounds the time a handler may take to d, or to the deadline
+// the client gives in X-Request-Deadline or Grpc-Timeout if that is
+// sooner; a client deadline applies even when d is 0. The request's
+// context is cancelled once the time has passed, which stops work that
+// honours it such as Raft proposals, validation webhooks and reads of
+// stores that accept a context, and the client is answered even if the
+// handler is still blocked: 503 for the request timeout, 504 for its own
+// deadline. Until the handler returns its response is buffered, so that
+// it cannot interleave with the timeout response.
+func (s *Server) withTimeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if untimed(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			now := time.Now()
+			deadline, msg, ok := clientDeadline(r, now)
+			if !ok {
+				writeError(w, r, http.StatusBadRequest, codeInvalidParam, msg)
+				return
+			}
+			byClient := !deadline.IsZero()
+			if byClient {
+				s.deadlines.withDeadline.Add(1)
+				if !deadline.After(now) {
+					s.deadlines.exceeded.Add(1)
+					writeError(w, r, http.StatusGatewayTimeout, codeDeadlineExceeded, "Request deadline has passed")
+					return
+				}
+			}
+			if d > 0 && (!byClient || now.Add(d).Before(deadline)) {
+				deadline, byClient = now.Add(d), false
+			}
+			if deadline.IsZero() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithDeadline(r.Context(), deadline)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			tw := &timeoutWriter{header: make(http.Header)}
+			done := make(chan struct{})
+			panicked := make(chan interface{}, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+					close(done)
+				}()
+				next.ServeHTTP(tw, r)
+			}()
+			select {
+			case <-done:
+				select {
+				case p := <-panicked:
+					panic(p)
+				default:
+				}
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.writeTo(w)
+			case <-ctx.Done():
+				tw.mu.Lock()
+				tw.timedOut = true
+				tw.mu.Unlock()
+				switch {
+				case errors.Is(context.Cause(ctx), errRequestCancelled):
+					writeError(w, r, http.StatusServiceUnavailable, codeRequestCancelled, "Request was cancelled by an administrator")
+				case byClient:
+					s.deadlines.exceeded.Add(1)
+					writeError(w, r, http.StatusGatewayTimeout, codeDeadlineExceeded, "Request deadline exceeded")
+				default:
+					s.deadlines.timedOut.Add(1)
+					writeError(w, r, http.StatusServiceUnavailable, codeTimeout, "Request timed out")
+				}
+			}
+		})
+	}
+}
+
+// timeoutWriter holds a response until the handler has finished within
+// its deadline. Writes after the deadline fail with http.ErrHandlerTimeout.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+// writeTo sends the buffered response. tw.mu must be held.
+func (tw *timeoutWriter) writeTo(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range tw.header {
+		h[k] = v
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	w.WriteHeader(tw.status)
+	w.Write(tw.buf.Bytes())
+}
+
+// streamDeadlines moves the connection's read and write deadlines on by
+// ReadTimeout and WriteTimeout each time a stream reads or writes, as the
+// long poll of watch does once, so that a bulk load, export, import, large
+// value or full listing is bounded by how long it stalls rather than by
+// how long it takes in all. A zero timeout leaves its deadline alone.
+type streamDeadlines struct {
+	rc          *http.ResponseController
+	read, write time.Duration
+}
+
+func (s *Server) streamDeadlines(w http.ResponseWriter) *streamDeadlines {
+	return &streamDeadlines{rc: http.NewResponseController(w), read: s.cfg.ReadTimeout, write: s.cfg.WriteTimeout}
+}
+
+// reader returns r, reading from which extends the read deadline first.
+// Once r is at EOF it no longer does: the server then reads the connection
+// itself, without a deadline, to notice the client going away.
+func (d *streamDeadlines) reader(r io.Reader) io.Reader {
+	if d.read <= 0 {
+		return r
+	}
+	return &deadlineReader{r: r, d: d}
+}
+
+// writer returns w, writing to which extends the write deadline first.
+func (d *streamDeadlines) writer(w http.ResponseWriter) http.ResponseWriter {
+	if d.write <= 0 {
+		return w
+	}
+	return &deadlineWriter{ResponseWriter: w, d: d}
+}
+
+type deadlineReader struct {
+	r   io.Reader
+	d   *streamDeadlines
+	eof bool
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	if !dr.eof {
+		dr.d.rc.SetReadDeadline(time.Now().Add(dr.d.read))
+	}
+	n, err := dr.r.Read(p)
+	if err == io.EOF {
+		dr.eof = true
+	}
+	return n, err
+}
+
+type deadlineWriter struct {
+	http.ResponseWriter
+	d *streamDeadlines
+}
+
+func (dw *deadlineWriter) Write(b []byte) (int, error) {
+	dw.d.rc.SetWriteDeadline(time.Now().Add(dw.d.write))
+	return dw.ResponseWriter.Write(b)
+}
+
+func (dw *deadlineWriter) Unwrap() http.ResponseWriter { return dw.ResponseWriter }
@@ -0,0 +1,484 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// issuedTokenPrefix starts every token minted by POST /auth/token, which
+// tells them apart from the credentials the auth provider checks.
+const issuedTokenPrefix = "kvt_"
+
+// Token permissions. A request needs read for GET and HEAD, delete for
+// DELETE and write for everything else.
+const (
+	permRead   = "read"
+	permWrite  = "write"
+	permDelete = "delete"
+)
+
+// Defaults for Config.TokenTTL and Config.TokenMaxTTL.
+const (
+	defaultTokenTTL    = time.Hour
+	defaultTokenMaxTTL = 24 * time.Hour
+)
+
+// tokenClaims are what an issued token grants: the data routes, for keys
+// under Prefix in Namespace (any if empty), with Permissions and the
+// Scopes, until Expires.
+type tokenClaims struct {
+	ID          string    `json:"jti"`
+	Name        string    `json:"sub"`
+	Namespace   string    `json:"ns,omitempty"`
+	Prefix      string    `json:"prefix"`
+	Permissions []string  `json:"perm"`
+	Scopes      []string  `json:"scp,omitempty"`
+	Issued      time.Time `json:"iat"`
+	Expires     time.Time `json:"exp"`
+	IssuedBy    string    `json:"iss,omitempty"`
+}
+
+// allows reports whether the claims permit a request of method.
+func (c *tokenClaims) allows(method string) bool {
+	perm := permWrite
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		perm = permRead
+	case http.MethodDelete:
+		perm = permDelete
+	}
+	return slices.Contains(c.Permissions, perm)
+}
+
+// revokedToken is an entry of the revocation list, kept until the token
+// would have expired anyway.
+type revokedToken struct {
+	ID      string    `json:"id"`
+	Revoked time.Time `json:"revoked"`
+	Expires time.Time `json:"expires"`
+}
+
+// tokenIssuer mints and checks short-lived tokens for service accounts.
+// A token is its claims and an HMAC-SHA256 of them under the token
+// secret, so any node with the same secret accepts it without a lookup.
+// Revoked tokens are listed in memory, and in the revocation file if one
+// is set, until they expire; each node keeps its own list.
+type tokenIssuer struct {
+	secret     []byte
+	adminScope string
+	ttl        time.Duration
+	maxTTL     time.Duration
+	path       string
+
+	mu      sync.Mutex
+	revoked map[string]revokedToken
+	issued  int64
+}
+
+func newTokenIssuer(cfg Config) (*tokenIssuer, error) {
+	if len(cfg.TokenSecret) < 16 {
+		return nil, errors.New("the token secret must be at least 16 bytes")
+	}
+	ti := &tokenIssuer{
+		secret:     []byte(cfg.TokenSecret),
+		adminScope: cfg.TokenAdminScope,
+		ttl:        cfg.TokenTTL,
+		maxTTL:     cfg.TokenMaxTTL,
+		path:       cfg.TokenRevocationFile,
+		revoked:    make(map[string]revokedToken),
+	}
+	if ti.ttl <= 0 {
+		ti.ttl = defaultTokenTTL
+	}
+	if ti.maxTTL < ti.ttl {
+		ti.maxTTL = ti.ttl
+	}
+	if ti.path != "" {
+		buf, err := os.ReadFile(ti.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(buf) > 0 {
+			var list []revokedToken
+			if err := json.Unmarshal(buf, &list); err != nil {
+				return nil, fmt.Errorf("%s: %w", ti.path, err)
+			}
+			for _, rt := range list {
+				ti.revoked[rt.ID] = rt
+			}
+		}
+	}
+	return ti, nil
+}
+
+func (ti *tokenIssuer) sign(payload string) string {
+	mac := hmac.New(sha256.New, ti.secret)
+	mac.Write([]byte(issuedTokenPrefix + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mint returns the token for c.
+func (ti *tokenIssuer) mint(c tokenClaims) (string, error) {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(buf)
+	ti.mu.Lock()
+	ti.issued++
+	ti.mu.Unlock()
+	return issuedTokenPrefix + payload + "." + ti.sign(payload), nil
+}
+
+// parse returns the claims of token if it is one this issuer minted.
+func (ti *tokenIssuer) parse(token string) (*tokenClaims, error) {
+	payload, sig, ok := strings.Cut(strings.TrimPrefix(token, issuedTokenPrefix), ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(ti.sign(payload))) {
+		return nil, ErrUnauthenticated
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	var c tokenClaims
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, ErrUnauthenticated
+	}
+	return &c, nil
+}
+
+// verify returns the claims of token if it is one this issuer minted and
+// it has neither expired nor been revoked.
+func (ti *tokenIssuer) verify(token string) (*tokenClaims, error) {
+	c, err := ti.parse(token)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(c.Expires) {
+		return nil, fmt.Errorf("%w: token expired", ErrUnauthenticated)
+	}
+	ti.mu.Lock()
+	_, revoked := ti.revoked[c.ID]
+	ti.mu.Unlock()
+	if revoked {
+		return nil, fmt.Errorf("%w: token revoked", ErrUnauthenticated)
+	}
+	return c, nil
+}
+
+// revoke adds a token to the revocation list, returning false if it was
+// already there.
+func (ti *tokenIssuer) revoke(id string, expires time.Time) (bool, error) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if _, ok := ti.revoked[id]; ok {
+		return false, nil
+	}
+	ti.revoked[id] = revokedToken{ID: id, Revoked: time.Now().UTC(), Expires: expires.UTC()}
+	return true, ti.saveLocked()
+}
+
+// list returns the revocation list, soonest to expire first.
+func (ti *tokenIssuer) list() []revokedToken {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	out := make([]revokedToken, 0, len(ti.revoked))
+	for _, rt := range ti.revoked {
+		out = append(out, rt)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Expires.Before(out[j].Expires) })
+	return out
+}
+
+// prune drops revoked tokens that have expired since.
+func (ti *tokenIssuer) prune() error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	now := time.Now()
+	n := len(ti.revoked)
+	for id, rt := range ti.revoked {
+		if now.After(rt.Expires) {
+			delete(ti.revoked, id)
+		}
+	}
+	if len(ti.revoked) == n {
+		return nil
+	}
+	return ti.saveLocked()
+}
+
+func (ti *tokenIssuer) saveLocked() error {
+	if ti.path == "" {
+		return nil
+	}
+	list := make([]revokedToken, 0, len(ti.revoked))
+	for _, rt := range ti.revoked {
+		list = append(list, rt)
+	}
+	buf, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ti.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ti.path)
+}
+
+func (ti *tokenIssuer) stats() map[string]int64 {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return map[string]int64{"issued": ti.issued, "revoked": int64(len(ti.revoked))}
+}
+
+// grantFrom returns the claims of the issued token that authenticated the
+// request of ctx, or nil for any other client.
+func grantFrom(ctx context.Context) *tokenClaims {
+	c, _ := ctx.Value(grantKey).(*tokenClaims)
+	return c
+}
+
+// isDataRoute reports whether path, a route pattern, is one of the data
+// routes issued tokens may use.
+func isDataRoute(path string) bool {
+	path = strings.TrimPrefix(path, "/ns/{namespace}")
+	return path == "/data" || strings.HasPrefix(path, "/data/{key}")
+}
+
+// grantMiddleware returns the middleware that holds clients with an issued
+// token to what it grants on the route method + path: only the data
+// routes, with the permission the method needs, and keys under the
+// token's prefix. Keys written by POST /data are checked by validateWrite
+// and listings leave out the others.
+func (s *Server) grantMiddleware(method, path string) Middleware {
+	allowed := isDataRoute(path)
+	if strings.HasSuffix(path, "/data") && method != http.MethodGet && method != http.MethodPost {
+		// DELETE /data clears a prefix the token may not cover.
+		allowed = false
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			g := grantFrom(r.Context())
+			switch {
+			case g == nil:
+			case !allowed:
+				writeError(w, r, http.StatusForbidden, codeForbidden, "This token only grants access to keys under "+g.Prefix)
+				return
+			case !g.allows(method):
+				writeError(w, r, http.StatusForbidden, codeForbidden, "This token does not grant "+method)
+				return
+			case g.Namespace != "" && g.Namespace != namespaceName(r):
+				writeError(w, r, http.StatusForbidden, codeForbidden, "This token only grants access to namespace "+g.Namespace)
+				return
+			}
+			if key := r.PathValue("key"); g != nil && key != "" && !strings.HasPrefix(key, g.Prefix) {
+				writeError(w, r, http.StatusForbidden, codeForbidden, "This token only grants access to keys under "+g.Prefix)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// namespaceName returns the namespace r addresses.
+func namespaceName(r *http.Request) string {
+	if ns := r.PathValue("namespace"); ns != "" {
+		return ns
+	}
+	return defaultNamespace
+}
+
+// checkGrant fails a read ("get") or write of op to key that the client's
+// issued token, if it has one, does not grant.
+func checkGrant(ctx context.Context, op, key string) error {
+	g := grantFrom(ctx)
+	if g == nil {
+		return nil
+	}
+	perm := permWrite
+	switch op {
+	case "get":
+		perm = permRead
+	case "delete":
+		perm = permDelete
+	}
+	if !strings.HasPrefix(key, g.Prefix) || !slices.Contains(g.Permissions, perm) {
+		return &KeyError{Op: op, Key: key, Err: fmt.Errorf("%w: not granted by this token", ErrMissingScope)}
+	}
+	return nil
+}
+
+// tokenRequest is the body of POST /auth/token.
+type tokenRequest struct {
+	Name        string          `json:"name"`
+	Namespace   string          `json:"namespace"`
+	Prefix      string          `json:"prefix"`
+	Permissions []string        `json:"permissions"`
+	Scopes      []string        `json:"scopes"`
+	TTL         json.RawMessage `json:"ttl"`
+}
+
+// tokenResponse is the answer to POST /auth/token: the token, given only
+// this once, and what it grants.
+type tokenResponse struct {
+	Token       string    `json:"token"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Prefix      string    `json:"prefix"`
+	Permissions []string  `json:"permissions"`
+	Scopes      []string  `json:"scopes,omitempty"`
+	Expires     time.Time `json:"expires"`
+}
+
+// requireTokenAdmin answers 404 if tokens are not enabled and 403 unless
+// the client holds the token admin scope, reporting whether it may go on.
+func (s *Server) requireTokenAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if s.tokens == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Token issuance is not enabled")
+		return false
+	}
+	if grantFrom(r.Context()) != nil || !s.hasScope(r.Context(), s.tokens.adminScope) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "Issuing and revoking tokens requires scope "+s.tokens.adminScope)
+		return false
+	}
+	return true
+}
+
+// POST
+//
+// issueTokenHandler mints a token for a service account, answering 201.
+// The token grants the data routes for keys under prefix with the given
+// permissions, read, write and delete, and scopes the caller holds
+// itself, for ttl, at most TokenMaxTTL.
+func (s *Server) issueTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireTokenAdmin(w, r) {
+		return
+	}
+	var req tokenRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	ttl, ok := parseDurationJSON(req.TTL, s.tokens.ttl)
+	switch {
+	case req.Name == "":
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "name is required")
+		return
+	case !ok || ttl <= 0 || ttl > s.tokens.maxTTL:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, fmt.Sprintf("ttl must be seconds or a duration such as \"1h\", up to %s", s.tokens.maxTTL))
+		return
+	case len(req.Permissions) == 0:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "permissions must list read, write or delete")
+		return
+	}
+	for _, p := range req.Permissions {
+		if p != permRead && p != permWrite && p != permDelete {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, fmt.Sprintf("unknown permission %q; want read, write or delete", p))
+			return
+		}
+	}
+	for _, sc := range req.Scopes {
+		if !s.hasScope(r.Context(), sc) {
+			writeError(w, r, http.StatusForbidden, codeForbidden, "Cannot grant scope "+sc+", which the caller does not hold")
+			return
+		}
+	}
+	now := time.Now().UTC()
+	c := tokenClaims{
+		ID:          newRequestID(),
+		Name:        req.Name,
+		Namespace:   req.Namespace,
+		Prefix:      s.keyRules.canonical(req.Prefix),
+		Permissions: req.Permissions,
+		Scopes:      req.Scopes,
+		Issued:      now,
+		Expires:     now.Add(ttl),
+		IssuedBy:    clientIDFrom(r.Context()),
+	}
+	token, err := s.tokens.mint(c)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	s.logger.Printf("[Auth] %s issued token %s for %s on %q until %s", c.IssuedBy, c.ID, c.Name, c.Prefix, c.Expires.Format(time.RFC3339))
+	writeJSON(w, http.StatusCreated, tokenResponse{
+		Token:       token,
+		ID:          c.ID,
+		Name:        c.Name,
+		Namespace:   c.Namespace,
+		Prefix:      c.Prefix,
+		Permissions: c.Permissions,
+		Scopes:      c.Scopes,
+		Expires:     c.Expires,
+	})
+}
+
+// revokeRequest is the body of POST /auth/token/revoke: the token itself,
+// or its id and, so that the entry can be dropped once it would have
+// expired, its expiry.
+type revokeRequest struct {
+	Token   string    `json:"token"`
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// POST
+//
+// revokeTokenHandler adds a token to the revocation list. A token revoked
+// by id without its expiry is listed for TokenMaxTTL.
+func (s *Server) revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireTokenAdmin(w, r) {
+		return
+	}
+	var req revokeRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	id, expires := req.ID, req.Expires
+	if req.Token != "" {
+		c, err := s.tokens.parse(req.Token)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Not a valid token: "+err.Error())
+			return
+		}
+		id, expires = c.ID, c.Expires
+	}
+	if id == "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "token or id is required")
+		return
+	}
+	if expires.IsZero() {
+		expires = time.Now().Add(s.tokens.maxTTL)
+	}
+	added, err := s.tokens.revoke(id, expires)
+	if err != nil {
+		s.logger.Printf("[Auth] Saving the revocation list: %v", err)
+	}
+	if added {
+		s.logger.Printf("[Auth] %s revoked token %s", clientIDFrom(r.Context()), id)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "revoked", "id": id})
+}
+
+// GET
+//
+// listRevokedHandler returns the revocation list.
+func (s *Server) listRevokedHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireTokenAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.tokens.list())
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tombstone is a soft-deleted key kept until it expires.
+type tombstone struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	DeletedAt time.Time `json:"deleted_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// tombstoneSet holds the soft-deleted keys of a namespace.
+type tombstoneSet struct {
+	mu    sync.Mutex
+	byKey map[string]tombstone
+}
+
+func newTombstoneSet() *tombstoneSet {
+	return &tombstoneSet{byKey: make(map[string]tombstone)}
+}
+
+func (ts *tombstoneSet) add(key, value string, retention time.Duration) {
+	now := time.Now().UTC()
+	ts.mu.Lock()
+	ts.byKey[key] = tombstone{Key: key, Value: value, DeletedAt: now, ExpiresAt: now.Add(retention)}
+	ts.mu.Unlock()
+}
+
+// take removes and returns the live tombstone for key.
+func (ts *tombstoneSet) take(key string) (tombstone, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.byKey[key]
+	if !ok {
+		return tombstone{}, false
+	}
+	delete(ts.byKey, key)
+	if time.Now().After(t.ExpiresAt) {
+		return tombstone{}, false
+	}
+	return t, true
+}
+
+// forget drops the tombstone of key, e.g. because the key was written again.
+func (ts *tombstoneSet) forget(key string) {
+	ts.mu.Lock()
+	delete(ts.byKey, key)
+	ts.mu.Unlock()
+}
+
+// purge drops expired tombstones and returns how many were removed.
+func (ts *tombstoneSet) purge(now time.Time) int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	n := 0
+	for k, t := range ts.byKey {
+		if now.After(t.ExpiresAt) {
+			delete(ts.byKey, k)
+			n++
+		}
+	}
+	return n
+}
+
+func (ts *tombstoneSet) list() []tombstone {
+	ts.mu.Lock()
+	out := make([]tombstone, 0, len(ts.byKey))
+	for _, t := range ts.byKey {
+		out = append(out, t)
+	}
+	ts.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// purgeTombstones drops expired tombstones in every namespace.
+func (s *Server) purgeTombstones() int {
+	now := time.Now()
+	n := 0
+	for _, ns := range s.namespaces.list() {
+		n += ns.tombstones.purge(now)
+	}
+	return n
+}
+
+// POST
+//
+// restoreKeyHandler undeletes a soft-deleted key. It fails with 409 if the
+// key has been written again since it was deleted.
+func (s *Server) restoreKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w, r) {
+		return
+	}
+	key := r.PathValue("key")
+	ns := s.namespaceFrom(r.Context())
+	if _, err := ns.store.Get(key); err == nil {
+		writeError(w, r, http.StatusConflict, codeConflict, "Key exists")
+		return
+	}
+	t, ok := ns.tombstones.take(key)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No deleted key to restore")
+		return
+	}
+	if err := s.setKey(r.Context(), key, t.Value); err != nil {
+		// Keep the tombstone so the restore can be retried.
+		ns.tombstones.add(key, t.Value, time.Until(t.ExpiresAt))
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{key: t.Value})
+}
+
+// GET
+func (s *Server) listTombstonesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.namespaceFrom(r.Context()).tombstones.list())
+}
+
+// usage returns the number of tombstones and the bytes of their keys and
+// values, in total and for those expired by now.
+func (ts *tombstoneSet) usage(now time.Time) (n int, bytes int64, expired int, expiredBytes int64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for k, t := range ts.byKey {
+		size := int64(len(k) + len(t.Value))
+		n, bytes = n+1, bytes+size
+		if now.After(t.ExpiresAt) {
+			expired, expiredBytes = expired+1, expiredBytes+size
+		}
+	}
+	return n, bytes, expired, expiredBytes
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// topologyNode describes one instance in a multi-node deployment.
+type topologyNode struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Region  string `json:"region"`
+	Primary bool   `json:"primary"`
+}
+
+// leaderHintHeader is sent with the 503 for a write while no leader is
+// known, with the URL of the node last known to lead, if any.
+const leaderHintHeader = "X-Leader-Hint"
+
+// topology is the node map loaded from -topology, kept up to date by node
+// discovery. Self is the ID of the node this process runs as. In a Raft
+// cluster leader reports the elected leader, which then takes the place of
+// the static primary, and hint the last one known while there is none.
+//
+// Nodes is only read directly while loading; afterwards members returns
+// it, and setMembers replaces it as a whole, so a node returned before a
+// change stays valid.
+type topology struct {
+	Self   string         `json:"-"`
+	Nodes  []topologyNode `json:"nodes"`
+	leader func() string
+	hint   func() string
+
+	mu       sync.RWMutex
+	changed  time.Time                  // when membership last changed
+	onChange func(nodes []topologyNode) // called after every change
+}
+
+// members returns the current nodes, sorted by ID after the first change.
+func (t *topology) members() []topologyNode {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.Nodes
+}
+
+// setMembers replaces the nodes, returning the IDs of the nodes that
+// joined and left; a node whose URL, region or primary flag changed does
+// both. This node itself is never removed.
+func (t *topology) setMembers(nodes []topologyNode) (joined, left []string) {
+	nodes = append([]topologyNode(nil), nodes...)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	t.mu.Lock()
+	old := make(map[string]topologyNode, len(t.Nodes))
+	for _, n := range t.Nodes {
+		old[n.ID] = n
+	}
+	next := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		next[n.ID] = true
+		if o, ok := old[n.ID]; !ok || o != n {
+			joined = append(joined, n.ID)
+		}
+	}
+	if !next[t.Self] {
+		if self, ok := old[t.Self]; ok {
+			nodes = append(nodes, self)
+			next[t.Self] = true
+		}
+	}
+	for _, o := range t.Nodes {
+		if n := nodesByID(nodes, o.ID); n == nil || *n != o {
+			left = append(left, o.ID)
+		}
+	}
+	if len(joined) == 0 && len(left) == 0 {
+		t.mu.Unlock()
+		return nil, nil
+	}
+	t.Nodes = nodes
+	t.changed = time.Now().UTC()
+	onChange := t.onChange
+	t.mu.Unlock()
+	if onChange != nil {
+		onChange(nodes)
+	}
+	return joined, left
+}
+
+// lastChange returns when membership last changed, zero if it never has.
+func (t *topology) lastChange() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.changed
+}
+
+func nodesByID(nodes []topologyNode, id string) *topologyNode {
+	for i := range nodes {
+		if nodes[i].ID == id {
+			return &nodes[i]
+		}
+	}
+	return nil
+}
+
+func (t *topology) node(id string) *topologyNode {
+	return nodesByID(t.members(), id)
+}
+
+// primary returns the node that accepts writes, or nil while a cluster
+// has no leader.
+func (t *topology) primary() *topologyNode {
+	if t.leader != nil {
+		return t.node(t.leader())
+	}
+	nodes := t.members()
+	for i := range nodes {
+		if nodes[i].Primary {
+			return &nodes[i]
+		}
+	}
+	return nil
+}
+
+// nearest returns a node in region, preferring this node, or nil if the
+// region has no nodes.
+func (t *topology) nearest(region string) *topologyNode {
+	nodes := t.members()
+	if self := nodesByID(nodes, t.Self); self != nil && self.Region == region {
+		return self
+	}
+	for i := range nodes {
+		if nodes[i].Region == region {
+			return &nodes[i]
+		}
+	}
+	return nil
+}
+
+// writeNoLeader fails r with 503 while there is no primary.
+func (t *topology) writeNoLeader(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	if t.hint != nil {
+		if n := t.node(t.hint()); n != nil && n.ID != t.Self {
+			w.Header().Set(leaderHintHeader, n.URL)
+		}
+	}
+	writeStoreError(w, r, ErrNotLeader)
+}
+
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// withTopologyRedirects sends writes received by a non-primary node to the
+// primary with a 307, which preserves the method and body, or fails them
+// with 503 while a cluster has no leader. Every response carries
+// X-Primary-Node when there is a primary; reads from clients that announce
+// their region via X-Client-Region also get X-Nearest-Node when a closer
+// node exists.
+func withTopologyRedirects(t *topology) Middleware {
+	if t == nil {
+		return nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			primary := t.primary()
+			if primary != nil {
+				w.Header().Set("X-Primary-Node", primary.URL)
+			}
+
+			if isWriteMethod(r.Method) && primary == nil {
+				t.writeNoLeader(w, r)
+				return
+			}
+			if isWriteMethod(r.Method) && primary.ID != t.Self {
+				http.Redirect(w, r, strings.TrimSuffix(primary.URL, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+				return
+			}
+			if region := r.Header.Get("X-Client-Region"); region != "" {
+				if n := t.nearest(region); n != nil && n.ID != t.Self {
+					w.Header().Set("X-Nearest-Node", n.URL)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A ValueHook transforms the values of keys on their way into and out of
+// the store, to normalize, redact or enrich them. Hooks are compiled in:
+// a deployment registers its own with RegisterValueHook, typically from
+// an init function in its main package, and enables them by name under
+// key prefixes with Config.ValueHooks.
+type ValueHook interface {
+	// OnWrite returns the value to store for key, or an error to reject
+	// the write, which the client sees as a failed validation.
+	OnWrite(ctx context.Context, key, value string) (string, error)
+	// OnRead returns the value a client reads for key.
+	OnRead(ctx context.Context, key, value string) string
+}
+
+// ValueHookFuncs adapts a pair of functions to a ValueHook. Either may be
+// nil, leaving values alone in that direction.
+type ValueHookFuncs struct {
+	Write func(ctx context.Context, key, value string) (string, error)
+	Read  func(ctx context.Context, key, value string) string
+}
+
+func (f ValueHookFuncs) OnWrite(ctx context.Context, key, value string) (string, error) {
+	if f.Write == nil {
+		return value, nil
+	}
+	return f.Write(ctx, key, value)
+}
+
+func (f ValueHookFuncs) OnRead(ctx context.Context, key, value string) string {
+	if f.Read == nil {
+		return value
+	}
+	return f.Read(ctx, key, value)
+}
+
+// A ValueHookFactory builds a hook from the options it is enabled with.
+type ValueHookFactory func(opts map[string]string) (ValueHook, error)
+
+var (
+	valueHookMu        sync.RWMutex
+	valueHookFactories = map[string]ValueHookFactory{
+		"trim":      func(map[string]string) (ValueHook, error) { return ValueHookFuncs{Write: trimHook}, nil },
+		"lowercase": func(map[string]string) (ValueHook, error) { return ValueHookFuncs{Write: lowercaseHook}, nil },
+		"json":      func(map[string]string) (ValueHook, error) { return ValueHookFuncs{Write: compactJSONHook}, nil },
+		"redact":    newRedactHook,
+		"stamp":     newStampHook,
+	}
+)
+
+// RegisterValueHook makes a hook available under name to
+// Config.ValueHooks. It panics if the name is taken, as two plugins
+// claiming the same name is a build mistake.
+func RegisterValueHook(name string, factory ValueHookFactory) {
+	valueHookMu.Lock()
+	defer valueHookMu.Unlock()
+	if _, ok := valueHookFactories[name]; ok {
+		panic("server: value hook " + name + " registered twice")
+	}
+	valueHookFactories[name] = factory
+}
+
+// ValueHookNames lists the registered hooks.
+func ValueHookNames() []string {
+	valueHookMu.RLock()
+	defer valueHookMu.RUnlock()
+	names := make([]string, 0, len(valueHookFactories))
+	for name := range valueHookFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValueHookSpec enables the hook Name for the keys under Prefix, with the
+// options the hook takes.
+type ValueHookSpec struct {
+	Prefix  string
+	Name    string
+	Options map[string]string
+}
+
+// ValueHookList holds hooks in the order they are applied to writes; reads
+// apply them in reverse. It implements flag.Value, parsing repeated
+// "prefix=name" arguments, optionally followed by "?opt=value&..." with
+// the options URL-encoded.
+type ValueHookList []ValueHookSpec
+
+func (f *ValueHookList) String() string {
+	parts := make([]string, len(*f))
+	for i, h := range *f {
+		parts[i] = h.Prefix + "=" + h.Name
+		if len(h.Options) > 0 {
+			q := make(url.Values, len(h.Options))
+			for k, v := range h.Options {
+				q.Set(k, v)
+			}
+			parts[i] += "?" + q.Encode()
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *ValueHookList) Set(v string) error {
+	prefix, spec, ok := strings.Cut(v, "=")
+	name, query, _ := strings.Cut(spec, "?")
+	if !ok || name == "" {
+		return fmt.Errorf("value hook %q must be in prefix=name form", v)
+	}
+	h := ValueHookSpec{Prefix: prefix, Name: name}
+	if query != "" {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			return fmt.Errorf("value hook %q: options: %v", v, err)
+		}
+		h.Options = make(map[string]string, len(q))
+		for k := range q {
+			h.Options[k] = q.Get(k)
+		}
+	}
+	*f = append(*f, h)
+	return nil
+}
+
+// valueHook is an enabled hook and what it has done.
+type valueHook struct {
+	ValueHookSpec
+	hook ValueHook
+
+	writes   atomic.Int64
+	reads    atomic.Int64
+	rejected atomic.Int64
+}
+
+// valueHookStats is an element of the "value_hooks" entry of /stats.
+type valueHookStats struct {
+	Prefix   string `json:"prefix"`
+	Name     string `json:"name"`
+	Writes   int64  `json:"writes"`
+	Reads    int64  `json:"reads"`
+	Rejected int64  `json:"rejected"`
+}
+
+// valueHooks applies the enabled hooks whose prefix matches a key.
+type valueHooks []*valueHook
+
+// newValueHooks builds the hooks of specs, or returns nil if there are
+// none.
+func newValueHooks(specs ValueHookList) (valueHooks, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	hooks := make(valueHooks, 0, len(specs))
+	for _, spec := range specs {
+		valueHookMu.RLock()
+		factory, ok := valueHookFactories[spec.Name]
+		valueHookMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown value hook %q; registered: %s", spec.Name, strings.Join(ValueHookNames(), ", "))
+		}
+		hook, err := factory(spec.Options)
+		if err != nil {
+			return nil, fmt.Errorf("value hook %s: %w", spec.Name, err)
+		}
+		hooks = append(hooks, &valueHook{ValueHookSpec: spec, hook: hook})
+	}
+	return hooks, nil
+}
+
+// write runs value through the hooks for key, in order.
+func (hs valueHooks) write(ctx context.Context, key, value string) (string, error) {
+	for _, h := range hs {
+		if !strings.HasPrefix(key, h.Prefix) {
+			continue
+		}
+		v, err := h.hook.OnWrite(ctx, key, value)
+		if err != nil {
+			h.rejected.Add(1)
+			return "", &KeyError{Op: "set", Key: key, Err: fmt.Errorf("%w: %s: %v", ErrValidationFailed, h.Name, err)}
+		}
+		h.writes.Add(1)
+		value = v
+	}
+	return value, nil
+}
+
+// read runs value through the hooks for key, in reverse order.
+func (hs valueHooks) read(ctx context.Context, key, value string) string {
+	for i := len(hs) - 1; i >= 0; i-- {
+		h := hs[i]
+		if !strings.HasPrefix(key, h.Prefix) {
+			continue
+		}
+		value = h.hook.OnRead(ctx, key, value)
+		h.reads.Add(1)
+	}
+	return value
+}
+
+func (hs valueHooks) stats() []valueHookStats {
+	out := make([]valueHookStats, len(hs))
+	for i, h := range hs {
+		out[i] = valueHookStats{Prefix: h.Prefix, Name: h.Name, Writes: h.writes.Load(), Reads: h.reads.Load(), Rejected: h.rejected.Load()}
+	}
+	return out
+}
+
+func trimHook(_ context.Context, _, value string) (string, error) {
+	return strings.TrimSpace(value), nil
+}
+
+func lowercaseHook(_ context.Context, _, value string) (string, error) {
+	return strings.ToLower(value), nil
+}
+
+// compactJSONHook stores JSON values without insignificant whitespace and
+// rejects values that are not JSON.
+func compactJSONHook(_ context.Context, _, value string) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(value)); err != nil {
+		return "", fmt.Errorf("value is not JSON: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// newRedactHook builds the redact hook, which replaces every match of the
+// regular expression option pattern with the option with (default
+// "[REDACTED]") in what clients read. The stored value is left whole.
+func newRedactHook(opts map[string]string) (ValueHook, error) {
+	if opts["pattern"] == "" {
+		return nil, fmt.Errorf("pattern option is required")
+	}
+	re, err := regexp.Compile(opts["pattern"])
+	if err != nil {
+		return nil, fmt.Errorf("pattern: %v", err)
+	}
+	with, ok := opts["with"]
+	if !ok {
+		with = "[REDACTED]"
+	}
+	return ValueHookFuncs{Read: func(_ context.Context, _, value string) string {
+		return re.ReplaceAllLiteralString(value, with)
+	}}, nil
+}
+
+// newStampHook builds the stamp hook, which sets the field named by the
+// option field (default "updated_at") of JSON object values to the time
+// of the write. Other values are stored as they are.
+func newStampHook(opts map[string]string) (ValueHook, error) {
+	field := opts["field"]
+	if field == "" {
+		field = "updated_at"
+	}
+	return ValueHookFuncs{Write: func(_ context.Context, _, value string) (string, error) {
+		var doc map[string]json.RawMessage
+		if json.Unmarshal([]byte(value), &doc) != nil || doc == nil {
+			return value, nil
+		}
+		doc[field], _ = json.Marshal(time.Now().UTC().Format(time.RFC3339Nano))
+		out, err := json.Marshal(doc)
+		return string(out), err
+	}}, nil
+}
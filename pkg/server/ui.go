@@ -0,0 +1,261 @@
+package server
+
+import "net/http"
+
+// uiPath is where the dashboard is served. The page itself holds no data
+// and is served without authentication; every API call it makes carries
+// the key entered on the page, so it sees only what that key may.
+const uiPath = "/ui"
+
+// GET
+//
+// uiHandler serves the dashboard: live server stats, a key browser with
+// search, and controls for flushing, exporting and read-only mode.
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(dashboardPage))
+}
+
+// dashboardPage is self-contained so that it works without network access
+// beyond the server. It polls /v1/stats rather than holding a stream open.
+const dashboardPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>KV dashboard</title>
+  <style>
+    body { font: 14px system-ui, sans-serif; margin: 0; background: #f5f6f8; color: #222; }
+    header { background: #223; color: #fff; padding: 10px 20px; display: flex; gap: 16px; align-items: center; }
+    header h1 { font-size: 16px; margin: 0; flex: 1; }
+    header input { width: 220px; }
+    main { display: grid; grid-template-columns: 1fr 1fr; gap: 16px; padding: 16px 20px; }
+    section { background: #fff; border-radius: 6px; padding: 12px 16px; box-shadow: 0 1px 2px #0002; }
+    section.wide { grid-column: 1 / 3; }
+    h2 { font-size: 14px; margin: 0 0 10px; }
+    .tiles { display: grid; grid-template-columns: repeat(4, 1fr); gap: 8px; }
+    .tile { background: #f0f2f5; border-radius: 4px; padding: 8px; }
+    .tile b { display: block; font-size: 18px; }
+    table { border-collapse: collapse; width: 100%; }
+    td, th { text-align: left; padding: 4px 6px; border-bottom: 1px solid #eee; vertical-align: top; }
+    td.key { font-family: monospace; cursor: pointer; color: #125; white-space: nowrap; }
+    td.val { font-family: monospace; word-break: break-all; color: #555; }
+    pre { background: #f0f2f5; padding: 8px; max-height: 300px; overflow: auto; white-space: pre-wrap; word-break: break-all; }
+    button { cursor: pointer; }
+    button.danger { color: #a00; }
+    #status { font-size: 12px; }
+    .err { color: #c00; }
+  </style>
+</head>
+<body>
+<header>
+  <h1>KV dashboard <span id="node"></span></h1>
+  <label>API key <input id="apikey" type="password" placeholder="only if required"></label>
+  <span id="status"></span>
+</header>
+<main>
+  <section>
+    <h2>Stats</h2>
+    <div class="tiles" id="tiles"></div>
+    <canvas id="chart" width="560" height="90"></canvas>
+  </section>
+  <section>
+    <h2>Controls</h2>
+    <p>Read-only mode: <b id="ro">?</b> <button id="toggle">Toggle</button></p>
+    <p><button id="export">Export</button> downloads every key as JSON lines.</p>
+    <p><input id="flushPrefix" placeholder="prefix (empty for all keys)">
+       <button id="flush" class="danger">Flush</button></p>
+    <p id="ctlmsg"></p>
+  </section>
+  <section class="wide">
+    <h2>Keys</h2>
+    <input id="prefix" placeholder="key prefix"> <button id="browse">Browse</button>
+    <input id="query" placeholder="search values"> <button id="search">Search</button>
+    <button id="more" hidden>More</button>
+    <table><tbody id="keys"></tbody></table>
+    <pre id="value" hidden></pre>
+  </section>
+</main>
+<script>
+const $ = id => document.getElementById(id);
+$("apikey").value = sessionStorage.getItem("kv-api-key") || "";
+$("apikey").onchange = () => sessionStorage.setItem("kv-api-key", $("apikey").value);
+
+async function api(method, path, body) {
+  const headers = {};
+  const key = $("apikey").value;
+  if (key) headers["Authorization"] = "Bearer " + key;
+  if (body !== undefined) headers["Content-Type"] = "application/json";
+  const res = await fetch("/v1" + path, { method, headers, body: body === undefined ? undefined : JSON.stringify(body) });
+  if (!res.ok) {
+    let msg = res.status + " " + res.statusText;
+    try { msg = (await res.json()).error.message; } catch (e) {}
+    throw new Error(msg);
+  }
+  return res;
+}
+
+function status(msg, err) {
+  $("status").textContent = msg;
+  $("status").className = err ? "err" : "";
+}
+
+const rates = [];
+let last = null;
+
+function fmtBytes(n) {
+  const units = ["B", "KB", "MB", "GB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+async function refreshStats() {
+  try {
+    const s = await (await api("GET", "/stats")).json();
+    const now = Date.now();
+    let rate = 0;
+    if (last) rate = Math.max(0, (s.total_requests - last.total) * 1000 / (now - last.at));
+    last = { total: s.total_requests, at: now };
+    rates.push(rate);
+    if (rates.length > 60) rates.shift();
+    const rt = s.runtime || {};
+    const tiles = [
+      ["keys", s.data_size], ["requests/s", rate.toFixed(1)], ["in flight", s.in_flight], ["errors", s.errors],
+      ["requests", s.total_requests], ["heap", fmtBytes(rt.heap_in_use || 0)], ["goroutines", rt.goroutines], ["evictions", s.evictions],
+    ];
+    $("tiles").innerHTML = "";
+    for (const [name, v] of tiles) {
+      const d = document.createElement("div");
+      d.className = "tile";
+      d.innerHTML = "<b></b>";
+      d.firstChild.textContent = v === undefined ? "-" : v;
+      d.append(name);
+      $("tiles").append(d);
+    }
+    drawChart();
+    status("updated " + new Date().toLocaleTimeString());
+  } catch (e) {
+    status("stats: " + e.message, true);
+  }
+}
+
+function drawChart() {
+  const c = $("chart"), g = c.getContext("2d");
+  g.clearRect(0, 0, c.width, c.height);
+  const max = Math.max(1, ...rates);
+  g.strokeStyle = "#36c";
+  g.beginPath();
+  rates.forEach((v, i) => {
+    const x = i * c.width / 59, y = c.height - 4 - v / max * (c.height - 8);
+    i ? g.lineTo(x, y) : g.moveTo(x, y);
+  });
+  g.stroke();
+  g.fillStyle = "#888";
+  g.fillText("requests/s, max " + max.toFixed(1), 4, 12);
+}
+
+async function refreshMaintenance() {
+  try {
+    const m = await (await api("GET", "/admin/maintenance")).json();
+    $("ro").textContent = m.read_only ? "on" : "off";
+    $("ro").dataset.on = m.read_only;
+  } catch (e) {
+    $("ro").textContent = "unavailable";
+  }
+}
+
+$("toggle").onclick = async () => {
+  try {
+    await api("PUT", "/admin/maintenance", { read_only: $("ro").dataset.on !== "true", reason: "set from dashboard" });
+    refreshMaintenance();
+  } catch (e) { $("ctlmsg").textContent = e.message; }
+};
+
+$("export").onclick = async () => {
+  try {
+    const blob = await (await api("GET", "/export")).blob();
+    const a = document.createElement("a");
+    a.href = URL.createObjectURL(blob);
+    a.download = "kv-export.jsonl";
+    a.click();
+    URL.revokeObjectURL(a.href);
+  } catch (e) { $("ctlmsg").textContent = e.message; }
+};
+
+$("flush").onclick = async () => {
+  const prefix = $("flushPrefix").value;
+  if (!confirm(prefix ? "Delete every key under " + prefix + "?" : "Delete every key?")) return;
+  try {
+    const r = await (await api("POST", "/admin/flush", prefix ? { prefix } : {})).json();
+    $("ctlmsg").textContent = "Deleted " + r.deleted + " keys";
+    refreshStats();
+  } catch (e) { $("ctlmsg").textContent = e.message; }
+};
+
+let next = "";
+
+function addRow(key, value) {
+  const tr = document.createElement("tr");
+  const k = document.createElement("td"), v = document.createElement("td");
+  k.className = "key";
+  v.className = "val";
+  k.textContent = key;
+  v.textContent = value.length > 120 ? value.slice(0, 120) + "..." : value;
+  k.onclick = () => showValue(key);
+  tr.append(k, v);
+  $("keys").append(tr);
+}
+
+async function browse(from) {
+  const prefix = $("prefix").value;
+  const q = new URLSearchParams({ from: from || prefix, limit: "100" });
+  if (prefix) q.set("to", prefix + "\uffff");
+  try {
+    const r = await (await api("GET", "/data?" + q)).json();
+    if (!from) $("keys").innerHTML = "";
+    for (const e of r.entries) addRow(e.key, String(e.value));
+    next = r.next || "";
+    $("more").hidden = !next;
+    if (!from && !r.entries.length) $("keys").innerHTML = "<tr><td>No keys</td></tr>";
+  } catch (e) { $("keys").innerHTML = ""; status("keys: " + e.message, true); }
+}
+
+async function search() {
+  const q = new URLSearchParams({ q: $("query").value, prefix: $("prefix").value, limit: "100" });
+  try {
+    const r = await (await api("GET", "/search?" + q)).json();
+    $("keys").innerHTML = "";
+    $("more").hidden = true;
+    for (const h of r.hits) addRow(h.key, "score " + h.score.toFixed(3));
+    if (!r.hits.length) $("keys").innerHTML = "<tr><td>No matches</td></tr>";
+  } catch (e) { status("search: " + e.message, true); }
+}
+
+async function showValue(key) {
+  try {
+    const text = await (await api("GET", "/data/" + encodeURIComponent(key))).text();
+    $("value").hidden = false;
+    $("value").textContent = key + "\n\n" + text;
+  } catch (e) { status(key + ": " + e.message, true); }
+}
+
+$("browse").onclick = () => browse("");
+$("more").onclick = () => browse(next);
+$("search").onclick = search;
+$("prefix").onkeydown = e => { if (e.key === "Enter") browse(""); };
+$("query").onkeydown = e => { if (e.key === "Enter") search(); };
+
+api("GET", "/info").then(r => r.json()).then(info => {
+  $("node").textContent = (info.node_id ? info.node_id + " · " : "") + info.build.version;
+  $("search").disabled = $("query").disabled = !info.features.search;
+}).catch(() => {});
+refreshStats();
+refreshMaintenance();
+browse("");
+setInterval(refreshStats, 2000);
+setInterval(refreshMaintenance, 10000);
+</script>
+</body>
+</html>
+`
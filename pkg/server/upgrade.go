@@ -0,0 +1,202 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment through which a process started by Upgrade finds the sockets
+// it inherits, as "http=3,grpc=4", and the pipe it reports readiness on.
+const (
+	envListenFDs = "KV_LISTEN_FDS"
+	envReadyFD   = "KV_READY_FD"
+)
+
+// upgradeTimeout is how long Upgrade waits for the new process to serve.
+const upgradeTimeout = 30 * time.Second
+
+// handoffGrace is how long Stop lets connections this process accepted
+// before Upgrade send their first request. net/http drops connections that
+// only do so once shutdown has begun.
+const handoffGrace = time.Second
+
+// inheritedFile returns the descriptor named name that Upgrade handed this
+// process, or nil if there is none.
+func inheritedFile(name string) (*os.File, error) {
+	for _, item := range strings.Split(os.Getenv(envListenFDs), ",") {
+		n, fd, ok := strings.Cut(item, "=")
+		if !ok || n != name {
+			continue
+		}
+		i, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid descriptor %q", envListenFDs, fd)
+		}
+		return os.NewFile(uintptr(i), name), nil
+	}
+	return nil, nil
+}
+
+func inheritedListener(name string) (net.Listener, error) {
+	f, err := inheritedFile(name)
+	if f == nil || err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherit %s listener: %w", name, err)
+	}
+	return ln, nil
+}
+
+// upgrading reports whether this process was started by Upgrade and has
+// yet to take over from the process that started it.
+func upgrading() bool { return os.Getenv(envListenFDs) != "" }
+
+// signalReady tells the process that started this one with Upgrade that it
+// is serving, so that the old process can stop.
+func signalReady() {
+	v := os.Getenv(envReadyFD)
+	os.Unsetenv(envReadyFD)
+	os.Unsetenv(envListenFDs)
+	if i, err := strconv.Atoi(v); err == nil {
+		f := os.NewFile(uintptr(i), "ready")
+		f.Write([]byte{1})
+		f.Close()
+	}
+}
+
+// Upgrade hands the server's listening sockets to a new copy of the running
+// binary, started with the same arguments and environment, and returns
+// once that process is serving on them. The caller then stops this server,
+// which finishes the requests it has while new connections go to the new
+// process, and exits. If the new process fails to start, Upgrade returns
+// an error and this server carries on as before.
+//
+// With a data file, writes are rejected with 503 until the new process
+// serves, so that it loads everything this one accepted; the data is saved
+// here, and not again by Stop. Without one the new process starts empty,
+// unless it is a replica. Raft nodes and the bolt backend cannot be upgraded
+// this way, and it is not supported on Windows.
+func (s *Server) Upgrade() (err error) {
+	if s.raft != nil {
+		return errors.New("a Raft node cannot hand over its sockets; restart cluster nodes one at a time")
+	}
+	if _, ok := s.backend.(*boltStore); ok {
+		return errors.New("the bolt backend locks its file against a second process; restart instead")
+	}
+	if len(s.sockets) == 0 {
+		return errors.New("server is not started")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			if f != s.dataLock {
+				f.Close()
+			}
+		}
+	}()
+	var fds []string
+	names := make([]string, 0, len(s.sockets))
+	for name := range s.sockets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ln := s.sockets[name]
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s listener cannot be handed over", name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("%s listener: %w", name, err)
+		}
+		files = append(files, f)
+		// ExtraFiles start after stdin, stdout and stderr.
+		fds = append(fds, name+"="+strconv.Itoa(2+len(files)))
+	}
+	if s.dataLock != nil {
+		// The new process shares the lock on the data file, which this
+		// one gives up only by exiting.
+		files = append(files, s.dataLock)
+		fds = append(fds, dataLockName+"="+strconv.Itoa(2+len(files)))
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	if s.cfg.DataFile != "" && !s.draining.Load() {
+		s.draining.Store(true)
+		defer func() {
+			if err != nil {
+				s.draining.Store(false)
+			}
+		}()
+		n, err := saveSnapshotFile(s.cfg.DataFile, s.namespaces.snapshots(), s.keys, s.persist)
+		if err != nil {
+			return fmt.Errorf("persist data to %s: %w", s.cfg.DataFile, err)
+		}
+		s.snapshotSaved(n, " for the new process")
+	} else if s.cfg.DataFile == "" && s.backend == nil && s.replica.Load() == nil {
+		s.logger.Println("No data file: the new process starts with an empty store")
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		envListenFDs+"="+strings.Join(fds, ","),
+		envReadyFD+"="+strconv.Itoa(2+len(files)))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start new process: %w", err)
+	}
+	// Close our end so that the read below fails if the child exits.
+	readyW.Close()
+	files = files[:len(files)-1]
+	go cmd.Wait()
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err != nil {
+			return fmt.Errorf("new process %d exited before serving", cmd.Process.Pid)
+		}
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process %d did not serve within %s", cmd.Process.Pid, upgradeTimeout)
+	}
+	// Stop accepting here; the new process takes every new connection.
+	// Unix sockets stay in place for it.
+	s.handedOff.Store(true)
+	for _, ln := range s.sockets {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	for _, hl := range s.listeners {
+		hl.ln.Close()
+	}
+	s.logger.Printf("Handed listeners to new process %d", cmd.Process.Pid)
+	return nil
+}
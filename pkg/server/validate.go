@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webhookValidator calls external validation webhooks synchronously before a
+// write is committed. A webhook approves a write by answering 2xx; any other
+// status rejects it, with the response body used as the reason.
+type webhookValidator struct {
+	hooks  []PrefixURL
+	client *http.Client
+	// failOpen lets writes through when a webhook cannot be reached or
+	// times out. Otherwise such writes are rejected.
+	failOpen bool
+}
+
+func newWebhookValidator(hooks []PrefixURL, timeout time.Duration, failOpen bool) *webhookValidator {
+	return &webhookValidator{
+		hooks:    hooks,
+		client:   &http.Client{Timeout: timeout},
+		failOpen: failOpen,
+	}
+}
+
+type validationRequest struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Validate checks a single mutation against every hook whose prefix matches
+// key. op is "set" or "delete".
+func (v *webhookValidator) Validate(ctx context.Context, op, key, value string) error {
+	for _, h := range v.hooks {
+		if !strings.HasPrefix(key, h.Prefix) {
+			continue
+		}
+		if err := v.call(ctx, h, validationRequest{Op: op, Key: key, Value: value}); err != nil {
+			return &KeyError{Op: "validate", Key: key, Err: err}
+		}
+	}
+	return nil
+}
+
+func (v *webhookValidator) call(ctx context.Context, h PrefixURL, body validationRequest) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		if v.failOpen {
+			return nil
+		}
+		return fmt.Errorf("%w: webhook unavailable", ErrValidationFailed)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	reason, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if len(bytes.TrimSpace(reason)) == 0 {
+		reason = []byte(resp.Status)
+	}
+	return fmt.Errorf("%w: %s", ErrValidationFailed, bytes.TrimSpace(reason))
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithms for Config.ValueCompression.
+const (
+	valueCompressionSnappy = "snappy"
+	valueCompressionZstd   = "zstd"
+)
+
+// defaultValueCompressionMin is the smallest value compressed by default;
+// below it the saving rarely pays for the CPU.
+const defaultValueCompressionMin = 1024
+
+// valueCodec compresses values held in memory. Values shorter than minSize,
+// and values that do not get smaller, are kept as they are. It is safe for
+// concurrent use and shared by every namespace.
+type valueCodec struct {
+	name    string
+	minSize int
+	enc     func(src []byte) []byte
+	dec     func(src []byte) ([]byte, error)
+
+	compressed   atomic.Int64 // values stored compressed
+	skipped      atomic.Int64 // values over the threshold that did not shrink
+	bytesIn      atomic.Int64 // original size of the compressed values
+	bytesOut     atomic.Int64 // their compressed size
+	compressNs   atomic.Int64
+	decompressed atomic.Int64
+	decompressNs atomic.Int64
+}
+
+// valueCompressionStats is the "value_compression" entry of /stats. The
+// figures cover every value written since the start, including ones since
+// overwritten or deleted.
+type valueCompressionStats struct {
+	Algorithm         string  `json:"algorithm"`
+	MinSize           int     `json:"min_size"`
+	Compressed        int64   `json:"compressed"`
+	Skipped           int64   `json:"skipped"`
+	BytesIn           int64   `json:"bytes_in"`
+	BytesOut          int64   `json:"bytes_out"`
+	Ratio             float64 `json:"ratio"`
+	CompressSeconds   float64 `json:"compress_seconds"`
+	Decompressed      int64   `json:"decompressed"`
+	DecompressSeconds float64 `json:"decompress_seconds"`
+}
+
+// newValueCodec returns the codec for algorithm, or nil for "".
+func newValueCodec(algorithm string, minSize int) (*valueCodec, error) {
+	c := &valueCodec{name: algorithm, minSize: minSize}
+	switch algorithm {
+	case "":
+		return nil, nil
+	case valueCompressionSnappy:
+		c.enc = func(src []byte) []byte { return snappy.Encode(nil, src) }
+		c.dec = func(src []byte) ([]byte, error) { return snappy.Decode(nil, src) }
+	case valueCompressionZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			return nil, err
+		}
+		c.enc = func(src []byte) []byte { return enc.EncodeAll(src, nil) }
+		c.dec = func(src []byte) ([]byte, error) { return dec.DecodeAll(src, nil) }
+	default:
+		return nil, fmt.Errorf("unknown value compression %q (want snappy or zstd)", algorithm)
+	}
+	if c.minSize <= 0 {
+		c.minSize = defaultValueCompressionMin
+	}
+	return c, nil
+}
+
+// encode returns value as it should be stored and whether that is
+// compressed. A nil codec stores everything as is.
+func (c *valueCodec) encode(value string) (string, bool) {
+	if c == nil || len(value) < c.minSize {
+		return value, false
+	}
+	start := time.Now()
+	out := c.enc([]byte(value))
+	c.compressNs.Add(int64(time.Since(start)))
+	if len(out) >= len(value) {
+		c.skipped.Add(1)
+		return value, false
+	}
+	c.compressed.Add(1)
+	c.bytesIn.Add(int64(len(value)))
+	c.bytesOut.Add(int64(len(out)))
+	return string(out), true
+}
+
+// decode reverses encode for a value it compressed. It fails only for
+// data corrupted in memory since, which readers check the value's
+// checksum for first.
+func (c *valueCodec) decode(stored string) (string, error) {
+	start := time.Now()
+	out, err := c.dec([]byte(stored))
+	if err != nil {
+		return "", fmt.Errorf("%w: decompress: %v", ErrCorrupted, err)
+	}
+	c.decompressed.Add(1)
+	c.decompressNs.Add(int64(time.Since(start)))
+	return string(out), nil
+}
+
+func (c *valueCodec) stats() valueCompressionStats {
+	st := valueCompressionStats{
+		Algorithm:         c.name,
+		MinSize:           c.minSize,
+		Compressed:        c.compressed.Load(),
+		Skipped:           c.skipped.Load(),
+		BytesIn:           c.bytesIn.Load(),
+		BytesOut:          c.bytesOut.Load(),
+		CompressSeconds:   time.Duration(c.compressNs.Load()).Seconds(),
+		Decompressed:      c.decompressed.Load(),
+		DecompressSeconds: time.Duration(c.decompressNs.Load()).Seconds(),
+	}
+	if st.BytesOut > 0 {
+		st.Ratio = float64(st.BytesIn) / float64(st.BytesOut)
+	}
+	return st
+}
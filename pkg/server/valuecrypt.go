@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// sealedPrefix starts every value encrypted under Config.EncryptPrefixes.
+// It is followed by the value's data key, sealed by the key ring, and the
+// value sealed by the data key, both in unpadded base64 and separated by
+// a colon.
+const sealedPrefix = "kve1:"
+
+var sealedEncoding = base64.RawStdEncoding
+
+// valueSealer encrypts the values of keys under configured prefixes with
+// envelope encryption: every value gets a fresh AES-256 data key, and only
+// that data key is sealed with the key ring, so rotating the ring's
+// primary key does not require re-encrypting the values.
+type valueSealer struct {
+	keys     *keyRing
+	prefixes []string
+	scope    string
+
+	sealed   atomic.Int64 // values encrypted
+	opened   atomic.Int64 // values decrypted for a client
+	withheld atomic.Int64 // reads answered with the sealed value for lack of the scope
+	failures atomic.Int64 // sealed values that could not be opened
+}
+
+// valueEncryptionStats is the "value_encryption" entry of /stats.
+type valueEncryptionStats struct {
+	Prefixes []string `json:"prefixes"`
+	Scope    string   `json:"scope"`
+	Sealed   int64    `json:"sealed"`
+	Opened   int64    `json:"opened"`
+	Withheld int64    `json:"withheld"`
+	Failures int64    `json:"failures"`
+}
+
+// newValueSealer returns the sealer for prefixes, or nil if there are none.
+func newValueSealer(kr *keyRing, prefixes []string, scope string) (*valueSealer, error) {
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	if kr == nil {
+		return nil, errors.New("value encryption requires an encryption key")
+	}
+	if scope == "" {
+		return nil, errors.New("value encryption requires a decrypt scope")
+	}
+	return &valueSealer{keys: kr, prefixes: prefixes, scope: scope}, nil
+}
+
+// covers reports whether the value of key is stored encrypted. A nil
+// sealer covers nothing.
+func (vs *valueSealer) covers(key string) bool {
+	if vs == nil {
+		return false
+	}
+	for _, p := range vs.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (vs *valueSealer) seal(value string) (string, error) {
+	dek := make([]byte, 32)
+	rand.Read(dek)
+	aead, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	body := aead.Seal(nonce, nonce, []byte(value), nil)
+	vs.sealed.Add(1)
+	return sealedPrefix + sealedEncoding.EncodeToString(vs.keys.seal(dek)) + ":" + sealedEncoding.EncodeToString(body), nil
+}
+
+func (vs *valueSealer) open(stored string) (string, error) {
+	wrapped, body, ok := strings.Cut(strings.TrimPrefix(stored, sealedPrefix), ":")
+	if !ok {
+		return "", errors.New("malformed sealed value")
+	}
+	raw, err := sealedEncoding.DecodeString(wrapped)
+	if err != nil {
+		return "", errors.New("malformed sealed value")
+	}
+	dek, _, err := vs.keys.open(raw)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	data, err := sealedEncoding.DecodeString(body)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", errors.New("malformed sealed value")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt value: %w", err)
+	}
+	return string(plain), nil
+}
+
+// isSealed reports whether a stored value was written by valueSealer.seal.
+func isSealed(v string) bool {
+	return strings.HasPrefix(v, sealedPrefix)
+}
+
+// sealValue returns value as it is stored under key. A value that is
+// already sealed, such as one from an export being imported again, is
+// stored as it is once it is known to open with the key ring.
+func (s *Server) sealValue(key, value string) (string, error) {
+	vs := s.sealer
+	if !vs.covers(key) {
+		return value, nil
+	}
+	if isSealed(value) {
+		if _, err := vs.open(value); err != nil {
+			return "", &KeyError{Op: "set", Key: key, Err: fmt.Errorf("%w: sealed value cannot be opened: %v", ErrValidationFailed, err)}
+		}
+		return value, nil
+	}
+	return vs.seal(value)
+}
+
+// reveal returns the stored value of key as the client of ctx may read
+// it: decrypted if it holds the decrypt scope, and otherwise sealed, then
+// run through Config.ValueHooks. The second result is false if the value
+// is returned sealed, which the hooks leave alone.
+func (s *Server) reveal(ctx context.Context, key, stored string) (string, bool) {
+	v, ok := s.unseal(ctx, stored)
+	if ok {
+		v = s.hooks.read(ctx, key, v)
+	}
+	return v, ok
+}
+
+func (s *Server) unseal(ctx context.Context, stored string) (string, bool) {
+	vs := s.sealer
+	if vs == nil || !isSealed(stored) {
+		return stored, true
+	}
+	if !s.hasScope(ctx, vs.scope) {
+		vs.withheld.Add(1)
+		return stored, false
+	}
+	v, err := vs.open(stored)
+	if err != nil {
+		vs.failures.Add(1)
+		s.logger.Printf("Cannot open sealed value: %v", err)
+		return stored, false
+	}
+	vs.opened.Add(1)
+	return v, true
+}
+
+// revealAll returns m with reveal applied to every value. m itself may
+// belong to a snapshot and is left alone.
+func (s *Server) revealAll(ctx context.Context, m map[string]string) map[string]string {
+	if s.sealer == nil && s.hooks == nil {
+		return m
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k], _ = s.reveal(ctx, k, v)
+	}
+	return out
+}
+
+func (vs *valueSealer) stats() valueEncryptionStats {
+	return valueEncryptionStats{
+		Prefixes: vs.prefixes,
+		Scope:    vs.scope,
+		Sealed:   vs.sealed.Load(),
+		Opened:   vs.opened.Load(),
+		Withheld: vs.withheld.Load(),
+		Failures: vs.failures.Load(),
+	}
+}
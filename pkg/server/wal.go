@@ -0,0 +1,693 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for Config.WALSnapshotInterval and Config.WALRetention.
+const (
+	defaultWALSnapshotInterval = time.Hour
+	defaultWALRetention        = 24 * time.Hour
+)
+
+// WAL file suffixes. Both kinds of file are named by the Unix time in
+// nanoseconds, zero-padded so that names sort by time: a segment by when
+// it was opened, a snapshot by when its last namespace was read.
+const (
+	walSegmentSuffix  = ".wal"
+	walSnapshotSuffix = ".snap"
+)
+
+// walFormat names the header line a segment or snapshot written in a
+// PersistCodec other than JSON, or encrypted, starts with. Plain JSON
+// files have no header.
+const walFormat = "kv-wal"
+
+// walHeader is the header line of a file. The records of a Sealed file
+// follow as the frames of a sealedWriter, encrypted with the key ring of
+// Config.EncryptionKeyFile and Config.EncryptionKey.
+type walHeader struct {
+	Format string `json:"format"`
+	Codec  string `json:"codec"`
+	Sealed bool   `json:"sealed,omitempty"`
+}
+
+// walQueueSize is how many records the log holds for its writer before
+// the mutations logging more wait for it.
+const walQueueSize = 4096
+
+// walRecord is a record of a segment or a snapshot. Segments hold the
+// mutations of every namespace as they happen: "set" and "delete", and
+// "drop" for a deleted namespace. Snapshots hold every key of every
+// namespace, with no op or time. Sets and snapshots carry the key's tags
+// and expiry.
+type walRecord struct {
+	Time   time.Time  `json:"time,omitzero"`
+	Op     string     `json:"op,omitempty"`
+	NS     string     `json:"ns"`
+	Key    string     `json:"key,omitempty"`
+	Value  string     `json:"value,omitempty"`
+	Tags   []string   `json:"tags,omitempty"`
+	Expiry *keyExpiry `json:"expiry,omitempty"`
+
+	// synced, on a record that is not written, is closed once every
+	// record queued before it is.
+	synced chan struct{}
+}
+
+// walLog is a write-ahead log of the mutations of every namespace, cut
+// into segments with a snapshot of every namespace taken after each one
+// is opened. The state of a namespace at any moment since the oldest
+// snapshot is that snapshot with the mutations of the segments since
+// replayed up to the moment: replaying a mutation the snapshot already
+// holds sets the key to what it was then, and any later mutation of the
+// key follows it.
+type walLog struct {
+	dir       string
+	interval  time.Duration
+	retention time.Duration
+	codec     PersistCodec
+	kr        *keyRing // nil unless files are encrypted
+
+	// rotating serializes rotations, so that a segment and its snapshot
+	// are never interleaved with another's.
+	rotating sync.Mutex
+
+	mu  sync.Mutex
+	seg *os.File
+	w   flushWriter
+	enc func(walRecord) error
+
+	// Mutations are queued for a writer goroutine, so that they are not
+	// encoded and flushed under the locks of their namespace. qmu guards
+	// sending, which stops once the log is closed.
+	qmu    sync.RWMutex
+	queue  chan walRecord
+	closed bool
+	done   chan struct{}
+
+	appended  atomic.Int64
+	failures  atomic.Int64
+	lastError atomic.Value // string
+}
+
+// walStats is the "wal" entry of /stats.
+type walStats struct {
+	Dir       string    `json:"dir"`
+	Segments  int       `json:"segments"`
+	Snapshots int       `json:"snapshots"`
+	Bytes     int64     `json:"bytes"`
+	Oldest    time.Time `json:"restorable_since,omitzero"`
+	Appended  int64     `json:"appended"`
+	Queued    int       `json:"queued"`
+	Failures  int64     `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func newWALLog(cfg Config, kr *keyRing) (*walLog, error) {
+	codec, err := persistCodecFor(cfg.PersistCodec)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.WALDir, 0o700); err != nil {
+		return nil, err
+	}
+	wl := &walLog{
+		dir:       cfg.WALDir,
+		interval:  cmp.Or(cfg.WALSnapshotInterval, defaultWALSnapshotInterval),
+		retention: cmp.Or(cfg.WALRetention, defaultWALRetention),
+		codec:     codec,
+		kr:        kr,
+		queue:     make(chan walRecord, walQueueSize),
+		done:      make(chan struct{}),
+	}
+	go wl.run()
+	return wl, nil
+}
+
+// newWriter returns a function writing records to f in the log's codec,
+// after the header of a file that is encrypted or in a codec other than
+// JSON, and the writer to flush once they are written.
+func (wl *walLog) newWriter(f io.Writer) (flushWriter, func(walRecord) error, error) {
+	bw := bufio.NewWriter(f)
+	if wl.kr == nil && wl.codec.Name() == persistJSON {
+		enc := json.NewEncoder(bw)
+		return bw, func(rec walRecord) error { return enc.Encode(rec) }, nil
+	}
+	hdr := walHeader{Format: walFormat, Codec: wl.codec.Name(), Sealed: wl.kr != nil}
+	if err := json.NewEncoder(bw).Encode(hdr); err != nil {
+		return nil, nil, err
+	}
+	var w flushWriter = bw
+	if wl.kr != nil {
+		w = newSealedWriter(wl.kr, bw)
+	}
+	enc := wl.codec.NewEncoder(w)
+	return w, func(rec walRecord) error {
+		prec := &PersistRecord{Time: rec.Time, Op: rec.Op, NS: rec.NS, Key: rec.Key, Value: rec.Value, Tags: rec.Tags}
+		prec.setExpiry(rec.Expiry)
+		return enc.Encode(prec)
+	}, nil
+}
+
+// enableWAL logs the mutations of ns if the log is enabled.
+func (nr *namespaceRegistry) enableWAL(ns *namespace) {
+	if nr.wal != nil {
+		ns.hub.addListener(nr.wal.listener(ns))
+	}
+}
+
+// listener returns the watchHub listener logging the mutations of ns.
+// applySet records the tags and expiry of a key before its write is
+// published.
+func (wl *walLog) listener(ns *namespace) func(Event) {
+	return func(ev Event) {
+		rec := walRecord{Time: ev.Time, Op: ev.Type, NS: ns.name, Key: ev.Key, Value: ev.Value}
+		if ev.Type == "set" {
+			rec.Tags, rec.Expiry = ns.tags.get(ev.Key), ns.expiries.get(ev.Key)
+		} else {
+			rec.Op, rec.Value = "delete", ""
+		}
+		wl.append(rec)
+	}
+}
+
+// dropped logs that the namespace name was deleted with all of its keys.
+func (wl *walLog) dropped(name string) {
+	wl.append(walRecord{Time: time.Now().UTC(), Op: "drop", NS: name})
+}
+
+// append queues rec for the writer. Mutations only wait for it once the
+// queue is full.
+func (wl *walLog) append(rec walRecord) {
+	wl.qmu.RLock()
+	defer wl.qmu.RUnlock()
+	if !wl.closed {
+		wl.queue <- rec
+	}
+}
+
+// sync returns once the records queued so far are written.
+func (wl *walLog) sync() {
+	synced := make(chan struct{})
+	wl.qmu.RLock()
+	if wl.closed {
+		wl.qmu.RUnlock()
+		return
+	}
+	wl.queue <- walRecord{synced: synced}
+	wl.qmu.RUnlock()
+	<-synced
+}
+
+// run writes the queued records to the open segment until the log is
+// closed. The records queued by the time it wakes are written together
+// and flushed once, so the segment holds them all if the process dies.
+func (wl *walLog) run() {
+	defer close(wl.done)
+	for rec := range wl.queue {
+		wl.mu.Lock()
+		var synced []chan struct{}
+		for n := len(wl.queue); ; n-- {
+			if rec.synced != nil {
+				synced = append(synced, rec.synced)
+			} else {
+				wl.write(rec)
+			}
+			if n == 0 {
+				break
+			}
+			rec = <-wl.queue
+		}
+		if wl.w != nil {
+			if err := wl.w.Flush(); err != nil {
+				wl.failed(err)
+			}
+		}
+		wl.mu.Unlock()
+		for _, ch := range synced {
+			close(ch)
+		}
+	}
+}
+
+func (wl *walLog) write(rec walRecord) {
+	if wl.w == nil {
+		return
+	}
+	if err := wl.enc(rec); err != nil {
+		wl.failed(err)
+		return
+	}
+	wl.appended.Add(1)
+}
+
+func (wl *walLog) failed(err error) {
+	wl.failures.Add(1)
+	wl.lastError.Store(err.Error())
+}
+
+// rotate opens a new segment, then snapshots every namespace, and prunes
+// the files retention no longer needs.
+func (wl *walLog) rotate(namespaces []*namespace) error {
+	wl.rotating.Lock()
+	defer wl.rotating.Unlock()
+
+	name := filepath.Join(wl.dir, walFileName(time.Now(), walSegmentSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		wl.failed(err)
+		return err
+	}
+	w, enc, err := wl.newWriter(f)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		wl.failed(err)
+		return err
+	}
+	wl.mu.Lock()
+	if wl.seg != nil {
+		wl.w.Flush()
+		wl.seg.Close()
+	}
+	wl.seg, wl.w, wl.enc = f, w, enc
+	wl.mu.Unlock()
+
+	if err := wl.snapshot(namespaces); err != nil {
+		wl.failed(err)
+		return err
+	}
+	return wl.prune(time.Now())
+}
+
+// snapshot writes every key of namespaces to a new snapshot file, named
+// by when the last of them was read.
+func (wl *walLog) snapshot(namespaces []*namespace) error {
+	tmp, err := os.CreateTemp(wl.dir, "snapshot.tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	bw, enc, err := wl.newWriter(tmp)
+	for _, ns := range namespaces {
+		if err != nil {
+			break
+		}
+		snap := ns.snapshot()
+		snap.Range(func(k, v string) bool {
+			e := snap.entry(k, v)
+			err = enc(walRecord{NS: ns.name, Key: k, Value: v, Tags: e.Tags, Expiry: e.Expiry})
+			return err == nil
+		})
+	}
+	taken := time.Now()
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(wl.dir, walFileName(taken, walSnapshotSuffix)))
+}
+
+func walFileName(t time.Time, suffix string) string {
+	return fmt.Sprintf("%020d%s", t.UnixNano(), suffix)
+}
+
+// walFile is a segment or snapshot in the log's directory.
+type walFile struct {
+	path string
+	time time.Time
+	size int64
+}
+
+// files lists the segments and the snapshots, oldest first.
+func (wl *walLog) files() (segments, snapshots []walFile, err error) {
+	entries, err := os.ReadDir(wl.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		suffix := filepath.Ext(name)
+		if suffix != walSegmentSuffix && suffix != walSnapshotSuffix {
+			continue
+		}
+		ns, err := strconv.ParseInt(strings.TrimSuffix(name, suffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		f := walFile{path: filepath.Join(wl.dir, name), time: time.Unix(0, ns)}
+		if fi, err := e.Info(); err == nil {
+			f.size = fi.Size()
+		}
+		if suffix == walSegmentSuffix {
+			segments = append(segments, f)
+		} else {
+			snapshots = append(snapshots, f)
+		}
+	}
+	return segments, snapshots, nil
+}
+
+// base returns the newest snapshot taken at or before at, and the
+// segments to replay onto it: the one open when it was taken and every
+// later one opened by at.
+func (wl *walLog) base(at time.Time) (walFile, []walFile, error) {
+	segments, snapshots, err := wl.files()
+	if err != nil {
+		return walFile{}, nil, err
+	}
+	i := len(snapshots) - 1
+	for i >= 0 && snapshots[i].time.After(at) {
+		i--
+	}
+	if i < 0 {
+		return walFile{}, nil, errNoSnapshot
+	}
+	snap := snapshots[i]
+	first := 0
+	for j, seg := range segments {
+		if !seg.time.After(snap.time) {
+			first = j
+		}
+	}
+	var replay []walFile
+	for _, seg := range segments[first:] {
+		if !seg.time.After(at) {
+			replay = append(replay, seg)
+		}
+	}
+	return snap, replay, nil
+}
+
+var errNoSnapshot = errors.New("no snapshot that old")
+
+// prune deletes the files prunable lists.
+func (wl *walLog) prune(now time.Time) error {
+	files, err := wl.prunable(now)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range files {
+		errs = append(errs, os.Remove(f.path))
+	}
+	return errors.Join(errs...)
+}
+
+// prunable lists the snapshots older than the retention but the newest of
+// them, which are no longer needed for any moment within the retention to
+// be restored, and the segments only older snapshots need.
+func (wl *walLog) prunable(now time.Time) ([]walFile, error) {
+	segments, snapshots, err := wl.files()
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+	cutoff := now.Add(-wl.retention)
+	keep := 0
+	for i, snap := range snapshots {
+		if !snap.time.After(cutoff) {
+			keep = i
+		}
+	}
+	oldest := snapshots[keep].time
+	files := append([]walFile(nil), snapshots[:keep]...)
+	for i, seg := range segments {
+		// A segment is needed from the last one opened by the oldest
+		// snapshot on.
+		if i+1 < len(segments) && !segments[i+1].time.After(oldest) {
+			files = append(files, seg)
+		}
+	}
+	return files, nil
+}
+
+// stateAt rebuilds the keys, values, tags and expiries of the namespace
+// name as they were at the moment given, returning them in key order with the time of the
+// snapshot they start from and the number of mutations replayed onto it.
+func (wl *walLog) stateAt(name string, at time.Time) ([]snapshotEntry, time.Time, int, error) {
+	wl.sync()
+	snap, segments, err := wl.base(at)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	state := make(map[string]snapshotEntry)
+	err = readWALFile(snap.path, wl.kr, func(rec walRecord) bool {
+		if rec.NS == name {
+			state[rec.Key] = snapshotEntry{Key: rec.Key, Value: rec.Value, Tags: rec.Tags, Expiry: rec.Expiry}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	replayed := 0
+	for _, seg := range segments {
+		err := readWALFile(seg.path, wl.kr, func(rec walRecord) bool {
+			// Records of different namespaces may be slightly out of
+			// time order, so the whole segment is read.
+			if rec.NS != name || rec.Time.After(at) {
+				return true
+			}
+			switch rec.Op {
+			case "set":
+				state[rec.Key] = snapshotEntry{Key: rec.Key, Value: rec.Value, Tags: rec.Tags, Expiry: rec.Expiry}
+			case "delete":
+				delete(state, rec.Key)
+			case "drop":
+				clear(state)
+			}
+			replayed++
+			return true
+		})
+		if err != nil {
+			return nil, time.Time{}, 0, err
+		}
+	}
+	entries := make([]snapshotEntry, 0, len(state))
+	for _, e := range state {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b snapshotEntry) int { return strings.Compare(a.Key, b.Key) })
+	return entries, snap.time, replayed, nil
+}
+
+// readWALFile calls fn with every record of the file at path until fn
+// returns false. The file is read in the codec its header names, whatever
+// the log is written in now. A torn final record, from a crash while it
+// was written, is where the file ends. An encrypted file is opened with
+// any key of kr.
+func readWALFile(path string, kr *keyRing, fn func(walRecord) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	first, err := br.ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	var hdr walHeader
+	if json.Unmarshal(first, &hdr) != nil || hdr.Format != walFormat {
+		dec := json.NewDecoder(io.MultiReader(bytes.NewReader(first), br))
+		for {
+			var rec walRecord
+			if err := dec.Decode(&rec); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if !fn(rec) {
+				return nil
+			}
+		}
+	}
+	codec, err := persistCodecFor(hdr.Codec)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	var r io.Reader = br
+	if hdr.Sealed {
+		if kr == nil {
+			return fmt.Errorf("%s is encrypted but no encryption key is configured", path)
+		}
+		r = newSealedReader(kr, br)
+	}
+	dec := codec.NewDecoder(r)
+	for {
+		var rec PersistRecord
+		if err := dec.Decode(&rec); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if !fn(walRecord{Time: rec.Time, Op: rec.Op, NS: rec.NS, Key: rec.Key, Value: rec.Value, Tags: rec.Tags, Expiry: rec.expiry()}) {
+			return nil
+		}
+	}
+}
+
+// close writes the records still queued and closes the open segment.
+func (wl *walLog) close() error {
+	wl.qmu.Lock()
+	if !wl.closed {
+		wl.closed = true
+		close(wl.queue)
+	}
+	wl.qmu.Unlock()
+	<-wl.done
+
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	if wl.seg == nil {
+		return nil
+	}
+	wl.w.Flush()
+	err := wl.seg.Close()
+	wl.seg, wl.w, wl.enc = nil, nil, nil
+	return err
+}
+
+func (wl *walLog) stats() walStats {
+	st := walStats{Dir: wl.dir, Appended: wl.appended.Load(), Queued: len(wl.queue), Failures: wl.failures.Load()}
+	st.LastError, _ = wl.lastError.Load().(string)
+	segments, snapshots, err := wl.files()
+	if err != nil {
+		st.LastError = err.Error()
+		return st
+	}
+	st.Segments, st.Snapshots = len(segments), len(snapshots)
+	for _, f := range append(segments, snapshots...) {
+		st.Bytes += f.size
+	}
+	if len(snapshots) > 0 {
+		st.Oldest = snapshots[0].time.UTC()
+	}
+	return st
+}
+
+// pitrResult is the body of POST /admin/restore.
+type pitrResult struct {
+	Source    string    `json:"source"`
+	Target    string    `json:"target"`
+	Timestamp time.Time `json:"timestamp"`
+	Snapshot  time.Time `json:"snapshot"`
+	Replayed  int       `json:"replayed"`
+	importProgress
+}
+
+// POST
+//
+// pointInTimeRestoreHandler rebuilds ?namespace (default the default
+// namespace) as it was at ?timestamp (RFC 3339) from the write-ahead log,
+// into the namespace ?target, which must not hold keys yet; it defaults to
+// the source's name followed by the timestamp. With ?replace=true the
+// source namespace itself is replaced, once confirmed when destructive
+// operations need confirmation. Keys are restored with the expiry they had
+// then, a sliding key's as of its last write; those whose time has since
+// come are swept.
+func (s *Server) pointInTimeRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	wl := s.namespaces.wal
+	if wl == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "The write-ahead log is not enabled")
+		return
+	}
+	if !s.checkWritable(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	at, err := time.Parse(time.RFC3339Nano, q.Get("timestamp"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "timestamp must be an RFC 3339 time")
+		return
+	}
+	if at.After(time.Now()) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "timestamp is in the future")
+		return
+	}
+	source := cmp.Or(q.Get("namespace"), defaultNamespace)
+	replace := q.Get("replace") == "true"
+	target := q.Get("target")
+	switch {
+	case replace && target != "" && target != source:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "target cannot be given with replace")
+		return
+	case replace:
+		target = source
+	case target == "":
+		target = source + "-" + at.UTC().Format("20060102T150405Z")
+	case target == source:
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Restoring over the source namespace needs replace=true")
+		return
+	}
+	if !namespaceNameRE.MatchString(source) || !namespaceNameRE.MatchString(target) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid namespace name")
+		return
+	}
+	if ns := s.namespaces.get(target, false); ns != nil && !replace && ns.store.Len() > 0 {
+		writeError(w, r, http.StatusConflict, codeConflict, "Namespace "+target+" already holds keys")
+		return
+	}
+
+	entries, base, replayed, err := wl.stateAt(source, at)
+	switch {
+	case errors.Is(err, errNoSnapshot):
+		msg := "The write-ahead log does not reach back to " + at.UTC().Format(time.RFC3339)
+		if since := wl.stats().Oldest; !since.IsZero() {
+			msg += "; it reaches back to " + since.Format(time.RFC3339)
+		}
+		writeError(w, r, http.StatusNotFound, codeNotFound, msg)
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Reading the write-ahead log failed: "+err.Error())
+		return
+	}
+	if replace {
+		replaced := 0
+		if ns := s.namespaces.get(source, false); ns != nil {
+			replaced = ns.store.Len()
+		}
+		impact := map[string]interface{}{"namespace": source, "timestamp": at.UTC(), "keys_replaced": replaced, "keys_restored": len(entries)}
+		if _, ok := s.confirmed(w, r, "restore", source+"@"+at.UTC().Format(time.RFC3339Nano), impact); !ok {
+			return
+		}
+	}
+
+	dst := s.namespaces.get(target, true)
+	res := pitrResult{Source: source, Target: target, Timestamp: at.UTC(), Snapshot: base.UTC(), Replayed: replayed}
+	res.importProgress, err = s.importEntries(context.WithValue(r.Context(), namespaceKey, dst), sliceEntries(entries), "replace", nil)
+	if err != nil {
+		s.incrementError(r.Context())
+		writeJSON(w, statusForError(err), res)
+		return
+	}
+	s.logger.Printf("Restored namespace %s as of %s into %s: %d keys", source, at.UTC().Format(time.RFC3339), target, len(entries))
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchBuffer is how many undelivered events a watcher may have queued
+// before it is considered too slow and disconnected.
+const watchBuffer = 256
+
+// watchRecent is how many of the latest events the hub remembers, so that
+// long-poll watchers can catch up on changes made just before they
+// subscribed.
+const watchRecent = 1024
+
+// watchHub fans store events out to subscribers.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+
+	// recent is a ring of the last watchRecent events, oldest at
+	// recentStart.
+	recent      []Event
+	recentStart int
+
+	// listeners are called for every event under mu and must not block.
+	listeners []func(Event)
+
+	// expiring holds the keys being deleted because their time is up, so
+	// that their delete events are marked Expired.
+	expiring map[string]bool
+}
+
+// watcher receives events for keys under prefix on C. C is closed when the
+// watcher is cancelled or falls too far behind.
+type watcher struct {
+	prefix string
+	C      chan Event
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]struct{}), expiring: make(map[string]bool)}
+}
+
+// markExpiring marks the delete of key that is about to be made as an
+// expiry, until unmarked.
+func (h *watchHub) markExpiring(key string, on bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if on {
+		h.expiring[key] = true
+	} else {
+		delete(h.expiring, key)
+	}
+}
+
+func (h *watchHub) subscribe(prefix string) *watcher {
+	w := &watcher{prefix: prefix, C: make(chan Event, watchBuffer)}
+	h.mu.Lock()
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+	return w
+}
+
+// addListener registers fn to receive every event. fn is called with the
+// hub locked and must hand the event off without blocking.
+func (h *watchHub) addListener(fn func(Event)) {
+	h.mu.Lock()
+	h.listeners = append(h.listeners, fn)
+	h.mu.Unlock()
+}
+
+// latestSince returns the most recent remembered event for key with a
+// revision greater than since.
+func (h *watchHub) latestSince(key string, since uint64) (Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.recent) - 1; i >= 0; i-- {
+		ev := h.recent[(h.recentStart+i)%len(h.recent)]
+		if ev.Key == key && ev.Revision > since {
+			return ev, true
+		}
+	}
+	return Event{}, false
+}
+
+func (h *watchHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.C)
+	}
+}
+
+// publish delivers ev without blocking; watchers whose buffer is full are
+// dropped so one slow client cannot stall writers. The delete of an
+// expiring key reaches listeners marked Expired and watchers as an
+// "expired" event.
+func (h *watchHub) publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ev.Type == "delete" && h.expiring[ev.Key] {
+		ev.Expired = true
+	}
+	for _, fn := range h.listeners {
+		fn(ev)
+	}
+	if ev.Expired {
+		ev.Type = "expired"
+	}
+	if len(h.recent) < watchRecent {
+		h.recent = append(h.recent, ev)
+	} else {
+		h.recent[h.recentStart] = ev
+		h.recentStart = (h.recentStart + 1) % watchRecent
+	}
+	for w := range h.watchers {
+		if !strings.HasPrefix(ev.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.C <- ev:
+		default:
+			delete(h.watchers, w)
+			close(w.C)
+		}
+	}
+}
+
+// GET
+//
+// watchHandler upgrades to a WebSocket and streams change events as JSON
+// text messages, optionally restricted to keys under ?prefix=.
+func (s *Server) watchHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	sub := s.hub.subscribe(r.URL.Query().Get("prefix"))
+	defer s.hub.unsubscribe(sub)
+
+	// The read loop notices client disconnects and answers pings.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			msg, _ := json.Marshal(ev)
+			if err := ws.WriteText(msg); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+const (
+	defaultLongPollTimeout = 30 * time.Second
+	maxLongPollTimeout     = 5 * time.Minute
+)
+
+// longPollKey implements GET /data/{key}?watch=true&since=REV. It answers
+// as soon as key has a change with a revision above since, either one that
+// already happened or the next one to arrive. If nothing changes within
+// ?timeout= it answers 304 with the current revision in X-Revision.
+func (s *Server) longPollKey(w http.ResponseWriter, r *http.Request, key string) {
+	q := r.URL.Query()
+	var since uint64
+	if v := q.Get("since"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid since")
+			return
+		}
+		since = n
+	}
+	timeout := defaultLongPollTimeout
+	if v := q.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, "Invalid timeout")
+			return
+		}
+		timeout = min(d, maxLongPollTimeout)
+	}
+
+	// The server-wide write timeout may be shorter than the poll.
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+
+	ns := s.namespaceFrom(r.Context())
+
+	// Subscribe before looking at past state so nothing slips in between.
+	sub := ns.hub.subscribe(key)
+	defer ns.hub.unsubscribe(sub)
+
+	if ev, ok := ns.hub.latestSince(key, since); ok {
+		writeJSON(w, http.StatusOK, ev)
+		return
+	}
+	current := uint64(0)
+	if rv, ok := ns.store.(keyRevisioner); ok {
+		if rev, err := rv.Revision(key); err == nil {
+			current = rev
+			if rev > since {
+				v, _ := ns.store.Get(key)
+				writeJSON(w, http.StatusOK, Event{Type: "set", Key: key, Value: v, Revision: rev})
+				return
+			}
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				writeError(w, r, http.StatusServiceUnavailable, codeInternal, "Watch interrupted")
+				return
+			}
+			if ev.Key == key && ev.Revision > since {
+				writeJSON(w, http.StatusOK, ev)
+				return
+			}
+		case <-timer.C:
+			w.Header().Set("X-Revision", strconv.FormatUint(current, 10))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.shutdownCh:
+			writeError(w, r, http.StatusServiceUnavailable, codeInternal, "Server shutting down")
+			return
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookQueueSize   = 1024
+	webhookMaxAttempts = 5
+	webhookBaseBackoff = time.Second
+	webhookTimeout     = 5 * time.Second
+)
+
+// webhook is a registered notification target. Deliveries are queued and
+// sent in order by a dedicated goroutine.
+type webhook struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Prefix string `json:"prefix"`
+	// Events, if set, are the types of server events the hook is sent
+	// instead of key changes.
+	Events []string `json:"events,omitempty"`
+	secret string
+
+	queue chan webhookPayload
+	stop  chan struct{}
+
+	mu    sync.Mutex
+	stats webhookStats
+}
+
+type webhookStats struct {
+	Delivered  int       `json:"delivered"`
+	Failed     int       `json:"failed"`
+	Retries    int       `json:"retries"`
+	Dropped    int       `json:"dropped"`
+	LastStatus int       `json:"last_status,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastSent   time.Time `json:"last_sent,omitempty"`
+}
+
+// webhookPayload is the JSON body POSTed to webhook URLs. Key changes
+// have a key; server events a source, message and fields instead.
+type webhookPayload struct {
+	Event    string                 `json:"event"` // "created", "updated", "deleted" or "expired", or a server event type
+	Key      string                 `json:"key,omitempty"`
+	Value    string                 `json:"value,omitempty"`
+	Revision uint64                 `json:"revision,omitempty"`
+	Source   string                 `json:"source,omitempty"`
+	Message  string                 `json:"message,omitempty"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+	Time     time.Time              `json:"time"`
+}
+
+// webhookDispatcher delivers signed change notifications to webhooks.
+// Every request carries X-Webhook-Timestamp and
+// X-Webhook-Signature: sha256=HMAC(secret, timestamp + "." + body).
+type webhookDispatcher struct {
+	client *http.Client
+	logger *log.Logger
+	secret string // default secret for hooks registered without one
+
+	mu     sync.Mutex
+	hooks  map[string]*webhook
+	nextID int
+}
+
+func newWebhookDispatcher(secret string) *webhookDispatcher {
+	return &webhookDispatcher{
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: log.Default(),
+		secret: secret,
+		hooks:  make(map[string]*webhook),
+	}
+}
+
+func (d *webhookDispatcher) add(prefix, url, secret string, events []string) *webhook {
+	if secret == "" {
+		secret = d.secret
+	}
+	d.mu.Lock()
+	d.nextID++
+	h := &webhook{
+		ID:     strconv.Itoa(d.nextID),
+		URL:    url,
+		Prefix: prefix,
+		Events: events,
+		secret: secret,
+		queue:  make(chan webhookPayload, webhookQueueSize),
+		stop:   make(chan struct{}),
+	}
+	d.hooks[h.ID] = h
+	d.mu.Unlock()
+
+	go d.run(h)
+	return h
+}
+
+func (d *webhookDispatcher) remove(id string) bool {
+	d.mu.Lock()
+	h, ok := d.hooks[id]
+	delete(d.hooks, id)
+	d.mu.Unlock()
+	if ok {
+		close(h.stop)
+	}
+	return ok
+}
+
+func (d *webhookDispatcher) list() []*webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]*webhook, 0, len(d.hooks))
+	for _, h := range d.hooks {
+		out = append(out, h)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, _ := strconv.Atoi(out[i].ID)
+		b, _ := strconv.Atoi(out[j].ID)
+		return a < b
+	})
+	return out
+}
+
+// close stops every delivery goroutine; queued notifications are dropped.
+func (d *webhookDispatcher) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, h := range d.hooks {
+		close(h.stop)
+		delete(d.hooks, id)
+	}
+}
+
+// enqueue is registered as a watchHub listener and must not block.
+func (d *webhookDispatcher) enqueue(ev Event) {
+	p := webhookPayload{Event: "deleted", Key: ev.Key, Revision: ev.Revision, Time: ev.Time}
+	switch {
+	case ev.Type == "set":
+		p.Event, p.Value = "updated", ev.Value
+		if ev.Created {
+			p.Event = "created"
+		}
+	case ev.Expired:
+		p.Event = "expired"
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, h := range d.hooks {
+		if len(h.Events) == 0 && strings.HasPrefix(ev.Key, h.Prefix) {
+			h.offer(p)
+		}
+	}
+}
+
+// notify is the event bus's subscription, queueing server events for the
+// hooks subscribed to their type. It must not block.
+func (d *webhookDispatcher) notify(ev serverEvent) {
+	p := webhookPayload{Event: ev.Type, Source: ev.Source, Message: ev.Message, Fields: ev.Fields, Time: ev.Time}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, h := range d.hooks {
+		if hasEventType(h.Events, ev.Type) {
+			h.offer(p)
+		}
+	}
+}
+
+// offer queues p, dropping it if the queue is full.
+func (h *webhook) offer(p webhookPayload) {
+	select {
+	case h.queue <- p:
+	default:
+		h.mu.Lock()
+		h.stats.Dropped++
+		h.mu.Unlock()
+	}
+}
+
+func (d *webhookDispatcher) run(h *webhook) {
+	for {
+		select {
+		case p := <-h.queue:
+			d.deliver(h, p)
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// deliver sends p, retrying with exponential backoff on network errors and
+// non-2xx responses.
+func (d *webhookDispatcher) deliver(h *webhook, p webhookPayload) {
+	body, _ := json.Marshal(p)
+	backoff := webhookBaseBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := d.send(h, p.Event, body)
+
+		h.mu.Lock()
+		h.stats.LastStatus = status
+		h.stats.LastSent = time.Now().UTC()
+		if err == nil {
+			h.stats.Delivered++
+			h.stats.LastError = ""
+		} else {
+			h.stats.LastError = err.Error()
+			if attempt == webhookMaxAttempts {
+				h.stats.Failed++
+			} else {
+				h.stats.Retries++
+			}
+		}
+		h.mu.Unlock()
+
+		if err == nil {
+			return
+		}
+		if attempt == webhookMaxAttempts {
+			d.logger.Printf("webhook %s: giving up on %s %q after %d attempts: %v", h.ID, p.Event, p.Key, attempt, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+func (d *webhookDispatcher) send(h *webhook, event string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	if h.secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+type webhookView struct {
+	ID     string       `json:"id"`
+	URL    string       `json:"url"`
+	Prefix string       `json:"prefix"`
+	Events []string     `json:"events,omitempty"`
+	Stats  webhookStats `json:"stats"`
+}
+
+func (h *webhook) view() webhookView {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return webhookView{ID: h.ID, URL: h.URL, Prefix: h.Prefix, Events: h.Events, Stats: h.stats}
+}
+
+// GET
+func (s *Server) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks := s.webhooks.list()
+	out := make([]webhookView, len(hooks))
+	for i, h := range hooks {
+		out[i] = h.view()
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// POST
+//
+// addWebhookHandler registers a hook for changes to keys under prefix or,
+// with events, a list of server event types or "*", for those events.
+func (s *Server) addWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL    string   `json:"url"`
+		Prefix string   `json:"prefix"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if !strings.HasPrefix(req.URL, "http://") && !strings.HasPrefix(req.URL, "https://") {
+		writeError(w, r, http.StatusBadRequest, codeInvalidParam, "url must be an http(s) URL")
+		return
+	}
+	var events []string
+	if len(req.Events) > 0 {
+		var err error
+		if events, err = parseEventTypes(strings.Join(req.Events, ",")); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidParam, err.Error())
+			return
+		}
+	}
+	h := s.webhooks.add(req.Prefix, req.URL, req.Secret, events)
+	writeJSON(w, http.StatusCreated, h.view())
+}
+
+// DELETE
+func (s *Server) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.webhooks.remove(r.PathValue("id")) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Webhook not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal RFC 6455 server-side WebSocket support: enough for text messages,
+// ping/pong and close. Fragmented client messages are not supported.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// wsMaxMessage bounds the size of a frame accepted from a client.
+const wsMaxMessage = 1 << 20
+
+var errWSProtocol = errors.New("websocket protocol error")
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// wmu serialises frame writes from different goroutines.
+	wmu sync.Mutex
+}
+
+// upgradeWebSocket performs the opening handshake and takes over the
+// connection. On failure an error response has already been written.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		writeError(w, r, http.StatusBadRequest, codeBadUpgrade, "WebSocket upgrade required")
+		return nil, errWSProtocol
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, r, http.StatusBadRequest, codeBadUpgrade, "Unsupported WebSocket version")
+		return nil, errWSProtocol
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "WebSocket not supported")
+		return nil, err
+	}
+	// Drop the server's read/write timeouts; the session is long lived.
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	hdr := make([]byte, 2, 10)
+	hdr[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xFFFF:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	if _, err := c.conn.Write(hdr); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// WriteText sends a text message.
+func (c *wsConn) WriteText(msg []byte) error {
+	return c.writeFrame(wsOpText, msg)
+}
+
+// ReadMessage returns the next data message, answering pings along the way.
+// It returns io.EOF once the client closes the connection.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	for {
+		op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+		case wsOpPong:
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		default:
+			return payload, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	fin, op := hdr[0]&0x80 != 0, hdr[0]&0x0F
+	masked := hdr[1]&0x80 != 0
+	if !fin || !masked {
+		return 0, nil, errWSProtocol
+	}
+
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxMessage {
+		return 0, nil, errWSProtocol
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(wsOpClose, nil)
+	return c.conn.Close()
+}
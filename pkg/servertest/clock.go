@@ -0,0 +1,143 @@
+package servertest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/server"
+)
+
+// FakeClock is a server.Clock that only moves when told to, for testing
+// key TTLs, rate limits and background jobs without waiting for them:
+//
+//	clock := servertest.NewFakeClock(time.Time{})
+//	ts := servertest.NewServer(t, server.WithClock(clock))
+//	// ... set a key with X-Key-TTL: 10
+//	clock.Advance(11 * time.Second)
+//
+// Timers fire, in order, as Advance passes their deadlines. It is safe for
+// concurrent use.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	changed chan struct{} // closed and replaced when a timer is added
+}
+
+// NewFakeClock returns a clock reading start, or a fixed time in 2020 if
+// start is zero.
+func NewFakeClock(start time.Time) *FakeClock {
+	if start.IsZero() {
+		start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return &FakeClock{now: start, changed: make(chan struct{})}
+}
+
+// Now returns the clock's time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer that fires once the clock has been advanced by
+// d.
+func (c *FakeClock) NewTimer(d time.Duration) server.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.scheduleLocked(t, d)
+	return t
+}
+
+// Advance moves the clock on by d, firing the timers due by then.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.when
+		select {
+		case t.c <- t.when:
+		default:
+		}
+	}
+	c.now = end
+}
+
+// Timers returns how many timers are waiting to fire.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// WaitForTimers blocks until at least n timers are waiting, such as the
+// server's background jobs once started, or until timeout has passed in
+// real time, reporting whether they were.
+func (c *FakeClock) WaitForTimers(n int, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		c.mu.Lock()
+		if len(c.timers) >= n {
+			c.mu.Unlock()
+			return true
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+// scheduleLocked arms t to fire d from now. c.mu must be held.
+func (c *FakeClock) scheduleLocked(t *fakeTimer, d time.Duration) {
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// stopLocked disarms t, reporting whether it was armed. c.mu must be held.
+func (c *FakeClock) stopLocked(t *fakeTimer) bool {
+	for i, u := range c.timers {
+		if u == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	c     chan time.Time
+	when  time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.stopLocked(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	armed := t.clock.stopLocked(t)
+	t.clock.scheduleLocked(t, d)
+	return armed
+}
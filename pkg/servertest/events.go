@@ -0,0 +1,159 @@
+package servertest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/server"
+)
+
+// EventRecorder collects store events. It is safe for concurrent use.
+type EventRecorder struct {
+	mu      sync.Mutex
+	events  []server.Event
+	changed chan struct{} // closed and replaced on every event
+}
+
+// NewEventRecorder returns an empty recorder.
+func NewEventRecorder() *EventRecorder {
+	return &EventRecorder{changed: make(chan struct{})}
+}
+
+// Record adds ev. It has the signature of a store's change callback.
+func (r *EventRecorder) Record(ev server.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Events returns the events recorded so far, oldest first.
+func (r *EventRecorder) Events() []server.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]server.Event(nil), r.events...)
+}
+
+// Reset forgets the recorded events.
+func (r *EventRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = nil
+}
+
+// Wait blocks until at least n events have been recorded and returns
+// them, failing t if that takes longer than timeout.
+func (r *EventRecorder) Wait(t testing.TB, n int, timeout time.Duration) []server.Event {
+	t.Helper()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		r.mu.Lock()
+		if len(r.events) >= n {
+			out := append([]server.Event(nil), r.events...)
+			r.mu.Unlock()
+			return out
+		}
+		changed, got := r.changed, len(r.events)
+		r.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+			t.Fatalf("servertest: got %d events after %s, want %d", got, timeout, n)
+			return nil
+		}
+	}
+}
+
+// Webhook is a notification received by a WebhookRecorder.
+type Webhook struct {
+	Event    string      `json:"event"` // "created", "updated" or "deleted"
+	Key      string      `json:"key"`
+	Value    string      `json:"value,omitempty"`
+	Revision uint64      `json:"revision"`
+	Time     time.Time   `json:"time"`
+	Header   http.Header `json:"-"`
+	Body     []byte      `json:"-"`
+	// Signed is whether the signature matched the recorder's secret. It
+	// is false for every notification when the recorder has no secret.
+	Signed bool `json:"-"`
+}
+
+// WebhookRecorder is an HTTP server that accepts webhook notifications and
+// records them. Point the server's Webhooks setting at URL.
+type WebhookRecorder struct {
+	*httptest.Server
+	Events *EventRecorder // the notifications as store events, for Wait
+
+	secret string
+
+	mu       sync.Mutex
+	received []Webhook
+	status   int
+}
+
+// NewWebhookRecorder starts a recorder checking signatures against
+// secret, if it is not empty. It is closed when t finishes.
+func NewWebhookRecorder(t testing.TB, secret string) *WebhookRecorder {
+	wr := &WebhookRecorder{Events: NewEventRecorder(), secret: secret, status: http.StatusNoContent}
+	wr.Server = httptest.NewServer(http.HandlerFunc(wr.serve))
+	t.Cleanup(wr.Close)
+	return wr
+}
+
+// RespondWith makes the recorder answer later notifications with status,
+// so that retries can be exercised. Notifications are recorded whatever
+// the status.
+func (wr *WebhookRecorder) RespondWith(status int) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.status = status
+}
+
+// Received returns the notifications received so far, oldest first.
+func (wr *WebhookRecorder) Received() []Webhook {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return append([]Webhook(nil), wr.received...)
+}
+
+func (wr *WebhookRecorder) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	var hook Webhook
+	if err == nil {
+		err = json.Unmarshal(body, &hook)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hook.Header, hook.Body = r.Header.Clone(), body
+	if wr.secret != "" {
+		mac := hmac.New(sha256.New, []byte(wr.secret))
+		mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "."))
+		mac.Write(body)
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		hook.Signed = hmac.Equal([]byte(want), []byte(r.Header.Get("X-Webhook-Signature")))
+	}
+
+	wr.mu.Lock()
+	wr.received = append(wr.received, hook)
+	status := wr.status
+	wr.mu.Unlock()
+
+	ev := server.Event{Type: "set", Key: hook.Key, Value: hook.Value, Created: hook.Event == "created", Revision: hook.Revision, Time: hook.Time}
+	if hook.Event == "deleted" {
+		ev.Type = "delete"
+	}
+	wr.Events.Record(ev)
+	w.WriteHeader(status)
+}
@@ -0,0 +1,79 @@
+// Package servertest provides what integration tests of services built on
+// the key/value server need to run it in-process: a MockStore that records
+// calls and can be made to fail, a Server fixture serving the full
+// handler stack from an httptest.Server, recorders for store events and
+// webhook notifications, and a FakeClock to move the server's time on.
+//
+//	ts := servertest.NewServer(t)
+//	ts.Client.Set(ctx, "greeting", "hello")
+//	events := ts.Store.Events.Wait(t, 1, time.Second)
+package servertest
+
+import (
+	"context"
+	"log"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/client"
+	"github.com/almanac13/AdvProgAsik2/pkg/server"
+)
+
+// Server is a key/value server serving its HTTP API on a local port.
+type Server struct {
+	*httptest.Server
+
+	// KV is the server itself.
+	KV *server.Server
+	// Store is the MockStore backing the server, unless opts replaced it
+	// with server.WithStore.
+	Store *MockStore
+	// Client talks to the server, with no retries so failures surface
+	// at once.
+	Client *client.Client
+}
+
+// NewServer starts a server built by server.New with opts, backed by a new
+// MockStore and logging through t. Only the HTTP handler runs: listeners
+// configured in opts are not opened, and background jobs are not started.
+// It is shut down when t finishes.
+func NewServer(t testing.TB, opts ...server.Option) *Server {
+	t.Helper()
+	store := NewMockStore()
+	logs := &testWriter{t: t}
+	logs.live.Store(true)
+	opts = append([]server.Option{server.WithStore(store), server.WithLogger(log.New(logs, "", 0))}, opts...)
+	kv, err := server.New(opts...)
+	if err != nil {
+		t.Fatalf("servertest: %v", err)
+	}
+	hs := httptest.NewServer(kv.Handler())
+	t.Cleanup(func() {
+		hs.Close()
+		if err := kv.Stop(context.Background()); err != nil {
+			t.Errorf("servertest: stop: %v", err)
+		}
+		logs.live.Store(false)
+	})
+	return &Server{
+		Server: hs,
+		KV:     kv,
+		Store:  store,
+		Client: client.New(hs.URL, client.WithRetries(0)),
+	}
+}
+
+// testWriter sends log output to t until the test is over; goroutines
+// logging after that must not call t.
+type testWriter struct {
+	t    testing.TB
+	live atomic.Bool
+}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	if w.live.Load() {
+		w.t.Logf("%s", p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,131 @@
+package servertest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/client"
+	"github.com/almanac13/AdvProgAsik2/pkg/server"
+	"github.com/almanac13/AdvProgAsik2/pkg/servertest"
+)
+
+func TestServerRoundTrip(t *testing.T) {
+	ts := servertest.NewServer(t)
+	ctx := context.Background()
+
+	if err := ts.Client.Set(ctx, "greeting", "hello"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	got, err := ts.Client.Get(ctx, "greeting")
+	if err != nil || got != "hello" {
+		t.Fatalf("Get = %q, %v; want hello", got, err)
+	}
+	events := ts.Store.Events.Wait(t, 1, time.Second)
+	if ev := events[0]; ev.Type != "set" || ev.Key != "greeting" || ev.Value != "hello" {
+		t.Errorf("event = %+v, want a set of greeting to hello", ev)
+	}
+	var sets int
+	for _, c := range ts.Store.Calls() {
+		if c.Op == "set" && c.Key == "greeting" {
+			sets++
+		}
+	}
+	if sets != 1 {
+		t.Errorf("store saw %d sets of greeting, want 1: %v", sets, ts.Store.Calls())
+	}
+}
+
+func TestServerStoreFailure(t *testing.T) {
+	ts := servertest.NewServer(t)
+	ctx := context.Background()
+	ts.Store.FailOn("set", server.ErrReadOnly)
+
+	if err := ts.Client.Set(ctx, "k", "v"); !errors.Is(err, client.ErrReadOnly) {
+		t.Fatalf("Set with the store failing = %v, want %v", err, client.ErrReadOnly)
+	}
+	ts.Store.FailOn("set", nil)
+	if err := ts.Client.Set(ctx, "k", "v"); err != nil {
+		t.Fatalf("Set once the store recovers: %v", err)
+	}
+}
+
+func TestKeyTTLExpires(t *testing.T) {
+	clock := servertest.NewFakeClock(time.Time{})
+	ts := servertest.NewServer(t, server.WithClock(clock))
+	ctx := context.Background()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/data", strings.NewReader(`{"session":"abc"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Key-TTL", "10")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		t.Fatalf("POST /data with a TTL = %d", resp.StatusCode)
+	}
+
+	clock.Advance(9 * time.Second)
+	if got, err := ts.Client.Get(ctx, "session"); err != nil || got != "abc" {
+		t.Fatalf("Get before the TTL = %q, %v; want abc", got, err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := ts.Client.Get(ctx, "session"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Get after the TTL = %v, want %v", err, client.ErrNotFound)
+	}
+}
+
+func TestRateLimitRefills(t *testing.T) {
+	clock := servertest.NewFakeClock(time.Time{})
+	cfg := server.DefaultConfig()
+	cfg.RateLimit, cfg.RateBurst = 1, 2
+	ts := servertest.NewServer(t, server.WithConfig(cfg), server.WithClock(clock))
+	ctx := context.Background()
+
+	for i := range 2 {
+		if err := ts.Client.Set(ctx, "k", "v"); err != nil {
+			t.Fatalf("request %d within the burst: %v", i+1, err)
+		}
+	}
+	if err := ts.Client.Set(ctx, "k", "v"); !errors.Is(err, client.ErrRateLimited) {
+		t.Fatalf("request over the burst = %v, want %v", err, client.ErrRateLimited)
+	}
+	clock.Advance(time.Second)
+	if err := ts.Client.Set(ctx, "k", "v"); err != nil {
+		t.Fatalf("request a second later: %v", err)
+	}
+	if err := ts.Client.Set(ctx, "k", "v"); !errors.Is(err, client.ErrRateLimited) {
+		t.Fatalf("second request a second later = %v, want %v", err, client.ErrRateLimited)
+	}
+}
+
+func TestLockLeaseExpires(t *testing.T) {
+	clock := servertest.NewFakeClock(time.Time{})
+	ts := servertest.NewServer(t, server.WithClock(clock))
+
+	acquire := func(owner string) int {
+		t.Helper()
+		resp, err := http.Post(ts.URL+"/locks/job", "application/json", strings.NewReader(`{"owner":"`+owner+`","ttl":"30s"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := acquire("a"); got != http.StatusCreated {
+		t.Fatalf("acquiring a free lock = %d, want %d", got, http.StatusCreated)
+	}
+	clock.Advance(29 * time.Second)
+	if got := acquire("b"); got != http.StatusConflict {
+		t.Fatalf("acquiring a held lock = %d, want %d", got, http.StatusConflict)
+	}
+	clock.Advance(2 * time.Second)
+	if got := acquire("b"); got != http.StatusCreated {
+		t.Fatalf("acquiring a lock whose lease ran out = %d, want %d", got, http.StatusCreated)
+	}
+}
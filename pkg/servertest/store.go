@@ -0,0 +1,197 @@
+package servertest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/almanac13/AdvProgAsik2/pkg/server"
+)
+
+// Call is one operation made on a MockStore.
+type Call struct {
+	Op  string // "get", "set", "delete", "all", "len" or "snapshot"
+	Key string // empty for whole-store operations
+}
+
+// MockStore is an in-memory server.Store that records the calls made on
+// it and can be told to fail them. It reports its mutations like the real
+// store, so watches and webhooks work on a server backed by it, and keeps
+// them in Events. It is safe for concurrent use.
+type MockStore struct {
+	// Events receives every mutation, after the server has been told of
+	// it.
+	Events *EventRecorder
+
+	mu       sync.Mutex
+	data     map[string]string
+	rev      uint64
+	calls    []Call
+	fail     map[string]error
+	onChange func(server.Event)
+}
+
+// NewMockStore returns an empty MockStore.
+func NewMockStore() *MockStore {
+	return &MockStore{Events: NewEventRecorder(), data: make(map[string]string), fail: make(map[string]error)}
+}
+
+// NewMockStoreWith returns a MockStore holding data. Loading it is not
+// recorded as calls or events.
+func NewMockStoreWith(data map[string]string) *MockStore {
+	m := NewMockStore()
+	for k, v := range data {
+		m.data[k] = v
+	}
+	return m
+}
+
+// FailOn makes every later call of op fail with err, or succeed again
+// when err is nil. Errors meant to reach clients as a given status should
+// wrap the server's sentinels, e.g. server.ErrReadOnly.
+func (m *MockStore) FailOn(op string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		delete(m.fail, op)
+	} else {
+		m.fail[op] = err
+	}
+}
+
+// Calls returns the calls made so far, oldest first.
+func (m *MockStore) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// Reset forgets the recorded calls and events, leaving the data as it is.
+func (m *MockStore) Reset() {
+	m.mu.Lock()
+	m.calls = nil
+	m.mu.Unlock()
+	m.Events.Reset()
+}
+
+// begin records a call and returns the error it should fail with. m.mu
+// must be held.
+func (m *MockStore) begin(op, key string) error {
+	m.calls = append(m.calls, Call{Op: op, Key: key})
+	if err := m.fail[op]; err != nil {
+		if key == "" {
+			return err
+		}
+		return &server.KeyError{Op: op, Key: key, Err: err}
+	}
+	return nil
+}
+
+// notify reports a mutation with m.mu held, so events are delivered in
+// revision order.
+func (m *MockStore) notify(ev server.Event) {
+	ev.Time = time.Now().UTC()
+	if m.onChange != nil {
+		m.onChange(ev)
+	}
+	m.Events.Record(ev)
+}
+
+func (m *MockStore) Get(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin("get", key); err != nil {
+		return "", err
+	}
+	v, ok := m.data[key]
+	if !ok {
+		return "", &server.KeyError{Op: "get", Key: key, Err: server.ErrKeyNotFound}
+	}
+	return v, nil
+}
+
+func (m *MockStore) Set(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin("set", key); err != nil {
+		return err
+	}
+	_, existed := m.data[key]
+	m.data[key] = value
+	m.rev++
+	m.notify(server.Event{Type: "set", Key: key, Value: value, Created: !existed, Revision: m.rev})
+	return nil
+}
+
+func (m *MockStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin("delete", key); err != nil {
+		return err
+	}
+	if _, ok := m.data[key]; !ok {
+		return &server.KeyError{Op: "delete", Key: key, Err: server.ErrKeyNotFound}
+	}
+	delete(m.data, key)
+	m.rev++
+	m.notify(server.Event{Type: "delete", Key: key, Revision: m.rev})
+	return nil
+}
+
+// All returns a copy of the data. The Store interface has no way to fail
+// it, so an error set with FailOn("all", ...) is ignored.
+func (m *MockStore) All() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.begin("all", "")
+	return m.copyLocked()
+}
+
+func (m *MockStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.begin("len", "")
+	return len(m.data)
+}
+
+func (m *MockStore) Snapshot() *server.Snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.begin("snapshot", "")
+	return server.NewSnapshot(m.copyLocked())
+}
+
+// Keys returns the stored keys in order, without recording a call.
+func (m *MockStore) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.data))
+	for k := range m.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Value returns the value of key without recording a call.
+func (m *MockStore) Value(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.data[key]
+	return v, ok
+}
+
+// OnChange is called by the server to follow the store's mutations.
+func (m *MockStore) OnChange(fn func(server.Event)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onChange = fn
+}
+
+func (m *MockStore) copyLocked() map[string]string {
+	out := make(map[string]string, len(m.data))
+	for k, v := range m.data {
+		out[k] = v
+	}
+	return out
+}